@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// --- ACCEPT PACING ---
+
+// listenBacklog is the queue length requested for client listeners (0 keeps
+// Go's default, the OS maximum). The kernel caps it at net.core.somaxconn
+// on Linux and kern.ipc.somaxconn on macOS.
+var listenBacklog int
+
+// pacer is nil unless -accept-rate is above zero
+var pacer *acceptPacer
+
+// acceptPacer spreads the connections accepted from local clients over
+// time with a token bucket shared by every client listener. During a storm
+// from a misconfigured client the surplus waits in the listen backlog,
+// where the kernel completes the handshakes, instead of being accepted
+// faster than tunnels can be dialed.
+type acceptPacer struct {
+	Rate  float64 // connections per second
+	Burst int     // accepted without waiting after a quiet spell
+
+	now   func() time.Time
+	sleep func(time.Duration)
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+	pacing bool // the last accept had to wait
+
+	accepted atomic.Int64
+	paced    atomic.Int64
+	waited   atomic.Int64 // nanoseconds
+}
+
+func newAcceptPacer(rate float64, burst int) *acceptPacer {
+	if burst < 1 {
+		burst = max(int(rate), 1)
+	}
+	return &acceptPacer{Rate: rate, Burst: burst, tokens: float64(burst), now: time.Now, sleep: time.Sleep}
+}
+
+// wait takes a token for one accepted connection, sleeping until there is
+// one. Safe on a nil pacer.
+func (p *acceptPacer) wait() {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	now := p.now()
+	if !p.last.IsZero() {
+		p.tokens = min(p.tokens+now.Sub(p.last).Seconds()*p.Rate, float64(p.Burst))
+	}
+	p.last = now
+	p.tokens--
+	var delay time.Duration
+	if p.tokens < 0 {
+		delay = time.Duration(-p.tokens / p.Rate * float64(time.Second))
+	}
+	// Warn once when a storm starts, not for every paced connection
+	started := delay > 0 && !p.pacing
+	if delay > 0 {
+		p.pacing = true
+	} else if p.pacing && p.tokens >= float64(p.Burst)-1 {
+		p.pacing = false
+		fmt.Fprintln(console, ">>> Connection storm over: accepting at full speed")
+	}
+	p.mu.Unlock()
+
+	p.accepted.Add(1)
+	if delay == 0 {
+		return
+	}
+	if started {
+		fmt.Fprintf(console, "!!! Clients connect faster than -accept-rate %g/s, pacing accepts\n", p.Rate)
+		signal(SignalWarning, fmt.Sprintf("accept_paced rate=%g", p.Rate))
+	}
+	p.paced.Add(1)
+	p.waited.Add(int64(delay))
+	p.sleep(delay)
+}
+
+// pacedListener takes a token for every accepted connection
+type pacedListener struct {
+	net.Listener
+	pacer *acceptPacer
+}
+
+func (l pacedListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	l.pacer.wait()
+	return conn, nil
+}
+
+// AcceptStats is the body of /stats/accept
+type AcceptStats struct {
+	SchemaVersion int     `json:"schema_version"`
+	Backlog       int     `json:"backlog"`   // requested listen backlog, 0 = OS default
+	Rate          float64 `json:"rate"`      // -accept-rate, 0 = unlimited
+	Burst         int     `json:"burst"`     // -accept-burst
+	Accepted      int64   `json:"accepted"`  // client connections accepted since startup
+	Paced         int64   `json:"paced"`     // of those, held back by -accept-rate
+	WaitedMs      int64   `json:"waited_ms"` // total time paced connections were held back
+	Pacing        bool    `json:"pacing"`    // a storm is being paced right now
+	// Machine-wide kernel counters of connections dropped because a listen
+	// queue was full (Linux only)
+	ListenOverflows *int64 `json:"listen_overflows,omitempty"`
+	ListenDrops     *int64 `json:"listen_drops,omitempty"`
+}
+
+func acceptStats() AcceptStats {
+	st := AcceptStats{SchemaVersion: apiSchemaVersion, Backlog: listenBacklog}
+	if p := pacer; p != nil {
+		p.mu.Lock()
+		st.Pacing = p.pacing
+		p.mu.Unlock()
+		st.Rate, st.Burst = p.Rate, p.Burst
+		st.Accepted, st.Paced = p.accepted.Load(), p.paced.Load()
+		st.WaitedMs = time.Duration(p.waited.Load()).Milliseconds()
+	}
+	if overflows, drops, ok := listenOverflows(); ok {
+		st.ListenOverflows, st.ListenDrops = &overflows, &drops
+	}
+	return st
+}
+
+// handleAcceptStats serves the backlog and pacing state on the status API
+func handleAcceptStats(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(acceptStats())
+}
+
+// parseListenOverflows finds ListenOverflows and ListenDrops in the TcpExt
+// section of /proc/net/netstat: a line of names followed by one of values
+func parseListenOverflows(r io.Reader) (overflows, drops int64, ok bool) {
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 0, 64<<10), 1<<20)
+	var names []string
+	for sc.Scan() {
+		fields := strings.Fields(sc.Text())
+		if len(fields) == 0 || fields[0] != "TcpExt:" {
+			continue
+		}
+		if names == nil {
+			names = fields
+			continue
+		}
+		var foundO, foundD bool
+		for i, name := range names {
+			if i >= len(fields) {
+				break
+			}
+			v, err := strconv.ParseInt(fields[i], 10, 64)
+			if err != nil {
+				continue
+			}
+			switch name {
+			case "ListenOverflows":
+				overflows, foundO = v, true
+			case "ListenDrops":
+				drops, foundD = v, true
+			}
+		}
+		return overflows, drops, foundO && foundD
+	}
+	return 0, 0, false
+}
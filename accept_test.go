@@ -0,0 +1,84 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAcceptPacer(t *testing.T) {
+	now := time.Unix(1000, 0)
+	var slept []time.Duration
+	p := newAcceptPacer(10, 3)
+	p.now = func() time.Time { return now }
+	p.sleep = func(d time.Duration) { slept = append(slept, d) }
+
+	out := captureStdout(t, func() {
+		// The burst goes through, then every connection waits 100ms more
+		for range 5 {
+			p.wait()
+		}
+	})
+	if len(slept) != 2 || slept[0] != 100*time.Millisecond || slept[1] != 200*time.Millisecond {
+		t.Errorf("Expected waits of 100ms and 200ms after the burst, got %v", slept)
+	}
+	if strings.Count(out, "@@SIDECAR:WARNING@@ accept_paced rate=10") != 1 {
+		t.Errorf("Expected one accept_paced warning, got %q", out)
+	}
+
+	// A quiet second refills the bucket
+	now = now.Add(time.Second)
+	slept = nil
+	out = captureStdout(t, func() { p.wait() })
+	if len(slept) != 0 || !strings.Contains(out, "storm over") {
+		t.Errorf("Expected an immediate accept after a quiet spell, slept %v, output %q", slept, out)
+	}
+
+	st := p.accepted.Load()
+	if st != 6 || p.paced.Load() != 2 || time.Duration(p.waited.Load()) != 300*time.Millisecond {
+		t.Errorf("Expected 6 accepted, 2 paced for 300ms, got %d, %d, %s", st, p.paced.Load(), time.Duration(p.waited.Load()))
+	}
+
+	var nilPacer *acceptPacer
+	nilPacer.wait()
+}
+
+func TestParseListenOverflows(t *testing.T) {
+	netstat := "TcpExt: SyncookiesSent ListenOverflows ListenDrops TCPBacklogDrop\n" +
+		"TcpExt: 4 17 21 0\n" +
+		"IpExt: InNoRoutes InTruncatedPkts\n" +
+		"IpExt: 0 0\n"
+	overflows, drops, ok := parseListenOverflows(strings.NewReader(netstat))
+	if !ok || overflows != 17 || drops != 21 {
+		t.Errorf("Expected 17 overflows and 21 drops, got %d, %d, %v", overflows, drops, ok)
+	}
+	if _, _, ok := parseListenOverflows(strings.NewReader("IpExt: A\nIpExt: 1\n")); ok {
+		t.Error("Expected no counters without a TcpExt section")
+	}
+}
+
+func TestListenBacklog(t *testing.T) {
+	if !backlogSupported {
+		t.Skip("the backlog can't be changed on this platform")
+	}
+	saved := listenBacklog
+	defer func() { listenBacklog = saved }()
+	listenBacklog = 4096
+
+	ln, err := listenClients("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listenClients failed: %v", err)
+	}
+	defer ln.Close()
+	go func() {
+		if c, err := ln.Accept(); err == nil {
+			c.Close()
+		}
+	}()
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	conn.Close()
+}
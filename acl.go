@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// --- ACL DENIALS ---
+
+// aclRejectFormat is the engine log line written when a peer answers a TCP
+// SYN with a TSMP "rejected" message because its ACLs drop the flow.
+const aclRejectFormat = "open-conn-track: flow %v %v > %v rejected due to %v"
+
+// maxACLDenials bounds the history served by /acl/denials
+const maxACLDenials = 50
+
+// ACLDenial is one connection the destination refused because of ACLs
+type ACLDenial struct {
+	Source      string `json:"source"`
+	Destination string `json:"destination"`
+	Reason      string `json:"reason"` // "acl", or "shields" for shields-up peers
+	Time        string `json:"time"`
+}
+
+// aclDeniedError is returned by dials that the destination rejected
+type aclDeniedError struct {
+	Denial ACLDenial
+}
+
+func (e *aclDeniedError) Error() string {
+	if e.Denial.Reason == "shields" {
+		return fmt.Sprintf("connection to %s refused: peer has shields up", e.Denial.Destination)
+	}
+	return fmt.Sprintf("connection from %s to %s denied by tailnet ACLs", e.Denial.Source, e.Denial.Destination)
+}
+
+func (e *aclDeniedError) localize(lang string) string {
+	if e.Denial.Reason == "shields" {
+		return tr(lang, "client.shields_up", "destination", e.Denial.Destination)
+	}
+	return tr(lang, "client.acl_denied", "source", e.Denial.Source, "destination", e.Denial.Destination)
+}
+
+// isACLDenied reports whether err comes from a dial rejected by ACLs
+func isACLDenied(err error) bool {
+	var denied *aclDeniedError
+	return errors.As(err, &denied)
+}
+
+// aclMonitor collects rejections from the node's log and wakes up dials
+// waiting on the rejected destination.
+type aclMonitor struct {
+	mu      sync.Mutex
+	recent  []ACLDenial
+	waiters map[string][]chan ACLDenial // keyed by destination ip:port
+}
+
+var aclDenials = newACLMonitor()
+
+func newACLMonitor() *aclMonitor {
+	return &aclMonitor{waiters: make(map[string][]chan ACLDenial)}
+}
+
+// observeLog inspects a tsnet log line; hook it into tsnet.Server.Logf.
+func (m *aclMonitor) observeLog(format string, args ...any) {
+	if format != aclRejectFormat || len(args) != 4 {
+		return
+	}
+	m.record(ACLDenial{
+		Source:      fmt.Sprint(args[1]),
+		Destination: fmt.Sprint(args[2]),
+		Reason:      fmt.Sprint(args[3]),
+		Time:        time.Now().Format(time.RFC3339),
+	})
+}
+
+func (m *aclMonitor) record(d ACLDenial) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, ch := range m.waiters[d.Destination] {
+		select {
+		case ch <- d:
+		default:
+		}
+	}
+	fmt.Fprintf(console, "[ACL] %s -> %s rejected (%s)\n", d.Source, d.Destination, d.Reason)
+	audit.record("denied", "by", "acl", "source", d.Source, "destination", d.Destination, "reason", d.Reason)
+	m.recent = append(m.recent, d)
+	if len(m.recent) > maxACLDenials {
+		m.recent = m.recent[len(m.recent)-maxACLDenials:]
+	}
+}
+
+// watch returns a channel that receives a rejection of dst ("ip:port")
+func (m *aclMonitor) watch(dst string) (<-chan ACLDenial, func()) {
+	ch := make(chan ACLDenial, 1)
+	m.mu.Lock()
+	m.waiters[dst] = append(m.waiters[dst], ch)
+	m.mu.Unlock()
+	return ch, func() {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		list := m.waiters[dst]
+		for i, c := range list {
+			if c == ch {
+				m.waiters[dst] = append(list[:i], list[i+1:]...)
+				break
+			}
+		}
+		if len(m.waiters[dst]) == 0 {
+			delete(m.waiters, dst)
+		}
+	}
+}
+
+func (m *aclMonitor) list() []ACLDenial {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]ACLDenial{}, m.recent...)
+}
+
+// handleACLDenials serves the recent rejections on the status API
+func handleACLDenials(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(aclDenials.list())
+}
+
+// aclDialer fails dials as soon as the destination rejects them, instead of
+// letting them hang until the TCP connect times out.
+type aclDialer struct {
+	Base    Dialer
+	Lookup  func(host string) (netip.Addr, bool) // tailnet IP of a peer name
+	monitor *aclMonitor
+}
+
+func (d *aclDialer) Dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return d.Base.Dial(ctx, network, addr)
+	}
+	ip, err := netip.ParseAddr(host)
+	if err != nil {
+		var ok bool
+		if d.Lookup == nil {
+			return d.Base.Dial(ctx, network, addr)
+		}
+		if ip, ok = d.Lookup(host); !ok {
+			return d.Base.Dial(ctx, network, addr)
+		}
+	}
+
+	denied, stop := d.monitor.watch(net.JoinHostPort(ip.String(), port))
+	defer stop()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		conn, err := d.Base.Dial(ctx, network, addr)
+		done <- result{conn, err}
+	}()
+
+	select {
+	case r := <-done:
+		return r.conn, r.err
+	case denial := <-denied:
+		cancel()
+		if r := <-done; r.conn != nil {
+			r.conn.Close()
+		}
+		return nil, fmt.Errorf("%s: %w", addr, &aclDeniedError{Denial: denial})
+	}
+}
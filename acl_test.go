@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestACLDialerFailsFastOnRejection(t *testing.T) {
+	monitor := newACLMonitor()
+	hanging := &MockDialer{
+		DialFunc: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			<-ctx.Done() // a filtered SYN is never answered
+			return nil, ctx.Err()
+		},
+	}
+	d := &aclDialer{
+		Base: hanging,
+		Lookup: func(host string) (netip.Addr, bool) {
+			return netip.MustParseAddr("100.64.0.10"), host == "data-node"
+		},
+		monitor: monitor,
+	}
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		monitor.observeLog(aclRejectFormat, "TCP", "100.64.0.1:51000", "100.64.0.10:9000", "acl")
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	start := time.Now()
+	_, err := d.Dial(ctx, "tcp", "data-node:9000")
+	if !isACLDenied(err) {
+		t.Fatalf("Expected ACL denial, got %v", err)
+	}
+	if time.Since(start) > 2*time.Second {
+		t.Errorf("Expected the dial to fail fast, took %v", time.Since(start))
+	}
+
+	denials := monitor.list()
+	if len(denials) != 1 || denials[0].Destination != "100.64.0.10:9000" || denials[0].Source != "100.64.0.1:51000" {
+		t.Errorf("Unexpected denial history %+v", denials)
+	}
+
+	// Unrelated log lines are ignored
+	monitor.observeLog("open-conn-track: flow TCP %v got RST by peer", "x")
+	if len(monitor.list()) != 1 {
+		t.Error("Expected unrelated log lines to be ignored")
+	}
+}
+
+func TestHandleHTTPReportsACLDenial(t *testing.T) {
+	proxy := &TailscaleProxy{
+		Transport: &MockRoundTripper{
+			RoundTripFunc: func(req *http.Request) (*http.Response, error) {
+				return nil, &aclDeniedError{Denial: ACLDenial{Source: "100.64.0.1:51000", Destination: "100.64.0.10:80", Reason: "acl"}}
+			},
+		},
+	}
+	rec := httptest.NewRecorder()
+	proxy.ServeHTTP(rec, httptest.NewRequest("GET", "http://data-node/", nil))
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("Expected 403 for an ACL denial, got %d", rec.Code)
+	}
+}
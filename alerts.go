@@ -0,0 +1,360 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"tailscale.com/ipn/ipnstate"
+)
+
+// --- ALERTS ---
+
+const (
+	alertInterval    = 10 * time.Second // how often rules are checked by default
+	alertErrorWindow = 5 * time.Minute  // error_rate window by default
+	alertMinDials    = 10               // error_rate needs this many dials in the window by default
+)
+
+// Conditions an alert rule can watch
+const (
+	AlertPeerOffline = "peer_offline" // the peer is offline or gone from the tailnet
+	AlertPeerRelayed = "peer_relayed" // the peer is online but only reachable through DERP
+	AlertErrorRate   = "error_rate"   // the share of failed tailnet dials
+)
+
+// AlertsConfig is the alerts section of the config file. A rule fires an
+// ALERT signal once its condition has held for a while, and another when
+// it clears, so sinks (a webhook, the desktop) can tell someone.
+type AlertsConfig struct {
+	Interval string      `json:"interval,omitempty"` // how often the rules are checked, default 10s
+	Rules    []AlertRule `json:"rules"`
+}
+
+// AlertRule is one watched condition
+type AlertRule struct {
+	Name     string  `json:"name"`
+	When     string  `json:"when"`                // peer_offline, peer_relayed or error_rate
+	Peer     string  `json:"peer,omitempty"`      // peer_*: hostname or MagicDNS name; every peer if empty
+	For      string  `json:"for,omitempty"`       // how long the condition must hold before firing, default 0
+	Above    float64 `json:"above,omitempty"`     // error_rate: percent of dials that failed
+	Window   string  `json:"window,omitempty"`    // error_rate: default 5m
+	MinDials int     `json:"min_dials,omitempty"` // error_rate: fewer dials in the window never fire, default 10
+}
+
+func (c *AlertsConfig) validate() error {
+	if c.Interval != "" {
+		if d, err := time.ParseDuration(c.Interval); err != nil || d <= 0 {
+			return fmt.Errorf("alerts.interval: invalid duration %q", c.Interval)
+		}
+	}
+	seen := map[string]bool{}
+	for i, r := range c.Rules {
+		if err := r.validate(); err != nil {
+			return fmt.Errorf("alerts.rules[%d]: %w", i, err)
+		}
+		if seen[r.Name] {
+			return fmt.Errorf("alerts.rules[%d]: duplicate name %q", i, r.Name)
+		}
+		seen[r.Name] = true
+	}
+	return nil
+}
+
+func (r AlertRule) validate() error {
+	if r.Name == "" || strings.ContainsAny(r.Name, " \t\"=") {
+		return fmt.Errorf("name must be set and free of spaces, quotes and '=', got %q", r.Name)
+	}
+	switch r.When {
+	case AlertPeerOffline, AlertPeerRelayed:
+		if r.Above != 0 || r.Window != "" || r.MinDials != 0 {
+			return fmt.Errorf("above, window and min_dials only apply to %s", AlertErrorRate)
+		}
+	case AlertErrorRate:
+		if r.Peer != "" {
+			return fmt.Errorf("peer doesn't apply to %s", AlertErrorRate)
+		}
+		if r.Above <= 0 || r.Above >= 100 {
+			return fmt.Errorf("above must be a percent in (0, 100), got %v", r.Above)
+		}
+		if r.MinDials < 0 {
+			return fmt.Errorf("min_dials must not be negative")
+		}
+	default:
+		return fmt.Errorf("unknown condition %q (use %s, %s or %s)", r.When, AlertPeerOffline, AlertPeerRelayed, AlertErrorRate)
+	}
+	for _, d := range []struct{ name, value string }{{"for", r.For}, {"window", r.Window}} {
+		if d.value == "" {
+			continue
+		}
+		if v, err := time.ParseDuration(d.value); err != nil || v < 0 {
+			return fmt.Errorf("%s: invalid duration %q", d.name, d.value)
+		}
+	}
+	return nil
+}
+
+// Alert is one entry of /alerts: a condition that holds now
+type Alert struct {
+	Rule    string `json:"rule"`
+	When    string `json:"when"`
+	Peer    string `json:"peer,omitempty"`
+	Since   string `json:"since"`  // when the condition started to hold
+	Firing  bool   `json:"firing"` // held longer than the rule's for
+	Details string `json:"details,omitempty"`
+}
+
+// alertState is what the monitor knows about one rule, or one peer of a
+// rule covering every peer
+type alertState struct {
+	since   time.Time
+	firing  bool
+	details string
+}
+
+// dialSnapshot is the dial totals at one check, for error rates
+type dialSnapshot struct {
+	at            time.Time
+	dials, failed int64
+}
+
+// alertMonitor checks the rules at an interval
+type alertMonitor struct {
+	Interval time.Duration
+	rules    []AlertRule
+	status   func(ctx context.Context) (*ipnstate.Status, error)
+	totals   func() (dials, failed int64) // latencies.dialTotals outside of tests
+
+	mu      sync.Mutex
+	states  map[string]*alertState // by rule name and peer
+	history []dialSnapshot         // oldest first
+}
+
+// alerts is nil without an alerts section
+var alerts *alertMonitor
+
+func newAlertMonitor(cfg *AlertsConfig, status func(ctx context.Context) (*ipnstate.Status, error)) *alertMonitor {
+	m := &alertMonitor{Interval: alertInterval, rules: cfg.Rules, status: status, totals: latencies.dialTotals, states: map[string]*alertState{}}
+	if cfg.Interval != "" {
+		m.Interval, _ = time.ParseDuration(cfg.Interval)
+	}
+	return m
+}
+
+// durationOr parses a duration validate has accepted, or returns def
+func durationOr(s string, def time.Duration) time.Duration {
+	if d, err := time.ParseDuration(s); err == nil {
+		return d
+	}
+	return def
+}
+
+// check evaluates every rule against status (nil if the node didn't
+// answer, which skips the peer rules) and the dial totals at now
+func (m *alertMonitor) check(now time.Time, status *ipnstate.Status) {
+	dials, failed := m.totals()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.history = append(m.history, dialSnapshot{now, dials, failed})
+
+	holding := map[string]bool{}
+	longest := time.Duration(0)
+	for _, r := range m.rules {
+		switch r.When {
+		case AlertPeerOffline, AlertPeerRelayed:
+			if status == nil {
+				// Keep the peer states as they are until the node answers
+				for key := range m.states {
+					if strings.HasPrefix(key, r.Name+"\x00") {
+						holding[key] = true
+					}
+				}
+				continue
+			}
+			for peer, details := range peerConditions(r, status) {
+				key := r.Name + "\x00" + peer
+				holding[key] = true
+				m.hold(now, r, key, peer, details)
+			}
+		case AlertErrorRate:
+			window := durationOr(r.Window, alertErrorWindow)
+			longest = max(longest, window)
+			if details, ok := m.errorRate(now, r, window); ok {
+				holding[r.Name] = true
+				m.hold(now, r, r.Name, "", details)
+			}
+		}
+	}
+	for key, st := range m.states {
+		if !holding[key] {
+			rule, peer, _ := strings.Cut(key, "\x00")
+			if st.firing {
+				m.resolve(now, rule, peer, st)
+			}
+			delete(m.states, key)
+		}
+	}
+
+	// Keep the snapshots the longest window needs, and one before it
+	cutoff := now.Add(-longest)
+	i := 0
+	for i+1 < len(m.history) && !m.history[i+1].at.After(cutoff) {
+		i++
+	}
+	m.history = slices.Delete(m.history, 0, i)
+}
+
+// hold notes that r's condition holds for key and fires once it has held
+// for the rule's for. Callers hold m.mu.
+func (m *alertMonitor) hold(now time.Time, r AlertRule, key, peer, details string) {
+	st, ok := m.states[key]
+	if !ok {
+		st = &alertState{since: now}
+		m.states[key] = st
+	}
+	st.details = details
+	if st.firing || now.Sub(st.since) < durationOr(r.For, 0) {
+		return
+	}
+	st.firing = true
+	fmt.Fprintf(console, "!!! [ALERT] %s: %s\n", r.Name, details)
+	signal(SignalAlert, alertDetails(r.Name, "firing", r.When, peer, details))
+	audit.record("alert", "rule", r.Name, "state", "firing", "peer", peer)
+}
+
+// resolve announces that a firing alert cleared. Callers hold m.mu.
+func (m *alertMonitor) resolve(now time.Time, rule, peer string, st *alertState) {
+	after := now.Sub(st.since).Round(time.Second)
+	when := ""
+	for _, r := range m.rules {
+		if r.Name == rule {
+			when = r.When
+		}
+	}
+	fmt.Fprintf(console, ">>> [ALERT] %s resolved after %v\n", rule, after)
+	signal(SignalAlert, alertDetails(rule, "resolved", when, peer, "after="+after.String()))
+	audit.record("alert", "rule", rule, "state", "resolved", "peer", peer)
+}
+
+// alertDetails formats the ALERT signal's details
+func alertDetails(rule, state, when, peer, details string) string {
+	s := fmt.Sprintf("rule=%s state=%s when=%s", rule, state, when)
+	if peer != "" {
+		s += " peer=" + peer
+	}
+	return s + " " + details
+}
+
+// peerConditions returns the peers for which r's condition holds, with
+// the details of each. A rule naming a peer that isn't in the tailnet
+// counts it as offline.
+func peerConditions(r AlertRule, status *ipnstate.Status) map[string]string {
+	out := map[string]string{}
+	found := false
+	for _, peer := range status.Peer {
+		dnsName := strings.TrimSuffix(peer.DNSName, ".")
+		short, _, _ := strings.Cut(dnsName, ".")
+		if r.Peer != "" && !strings.EqualFold(peer.HostName, r.Peer) && !strings.EqualFold(dnsName, r.Peer) && !strings.EqualFold(short, r.Peer) {
+			continue
+		}
+		found = true
+		switch {
+		case r.When == AlertPeerOffline && !peer.Online:
+			details := "offline"
+			if !peer.LastSeen.IsZero() {
+				details += " last_seen=" + peer.LastSeen.UTC().Format(time.RFC3339)
+			}
+			out[peer.HostName] = details
+		case r.When == AlertPeerRelayed && peer.Online && peer.CurAddr == "":
+			out[peer.HostName] = "relayed=" + peer.Relay
+		}
+	}
+	if !found && r.Peer != "" && r.When == AlertPeerOffline {
+		out[r.Peer] = "not in the tailnet"
+	}
+	return out
+}
+
+// errorRate reports whether more than r.Above percent of the dials in the
+// window failed. Callers hold m.mu.
+func (m *alertMonitor) errorRate(now time.Time, r AlertRule, window time.Duration) (string, bool) {
+	if len(m.history) < 2 {
+		return "", false
+	}
+	// The newest snapshot at least window old, or the oldest there is
+	last := m.history[len(m.history)-1]
+	base := m.history[0]
+	for _, s := range m.history {
+		if s.at.After(now.Add(-window)) {
+			break
+		}
+		base = s
+	}
+	dials, failed := last.dials-base.dials, last.failed-base.failed
+	minDials := r.MinDials
+	if minDials == 0 {
+		minDials = alertMinDials
+	}
+	if dials <= 0 || dials < int64(minDials) {
+		return "", false
+	}
+	rate := 100 * float64(failed) / float64(dials)
+	if rate <= r.Above {
+		return "", false
+	}
+	return fmt.Sprintf("rate=%.1f%% failed=%d dials=%d window=%v", rate, failed, dials, window), true
+}
+
+// active lists the conditions that hold now, by rule and peer
+func (m *alertMonitor) active() []Alert {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	when := map[string]string{}
+	for _, r := range m.rules {
+		when[r.Name] = r.When
+	}
+	list := []Alert{}
+	for key, st := range m.states {
+		rule, peer, _ := strings.Cut(key, "\x00")
+		list = append(list, Alert{Rule: rule, When: when[rule], Peer: peer, Since: st.since.UTC().Format(time.RFC3339), Firing: st.firing, Details: st.details})
+	}
+	slices.SortFunc(list, func(a, b Alert) int {
+		return strings.Compare(a.Rule+"\x00"+a.Peer, b.Rule+"\x00"+b.Peer)
+	})
+	return list
+}
+
+// run checks every Interval until ctx is done
+func (m *alertMonitor) run(ctx context.Context) {
+	ticker := time.NewTicker(m.Interval)
+	defer ticker.Stop()
+	for {
+		sctx, cancel := context.WithTimeout(ctx, m.Interval)
+		status, err := m.status(sctx)
+		cancel()
+		if err != nil {
+			status = nil
+		}
+		m.check(time.Now(), status)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// handleAlerts serves the conditions that hold now
+func handleAlerts(w http.ResponseWriter, r *http.Request) {
+	if alerts == nil {
+		http.Error(w, "no alerts section in the config", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(alerts.active())
+}
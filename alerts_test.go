@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/types/key"
+)
+
+func TestAlertRuleValidate(t *testing.T) {
+	for _, r := range []AlertRule{
+		{Name: "", When: AlertPeerOffline},
+		{Name: "a b", When: AlertPeerOffline},
+		{Name: "x", When: "peer_slow"},
+		{Name: "x", When: AlertPeerOffline, For: "soon"},
+		{Name: "x", When: AlertPeerRelayed, Above: 5},
+		{Name: "x", When: AlertErrorRate},
+		{Name: "x", When: AlertErrorRate, Above: 10, Peer: "lab-db"},
+	} {
+		if err := r.validate(); err == nil {
+			t.Errorf("Expected %+v to be rejected", r)
+		}
+	}
+	cfg := AlertsConfig{Rules: []AlertRule{{Name: "x", When: AlertPeerOffline}, {Name: "x", When: AlertPeerRelayed}}}
+	if err := cfg.validate(); err == nil || !strings.Contains(err.Error(), "duplicate") {
+		t.Errorf("Expected duplicate names to be rejected, got %v", err)
+	}
+	cfg = AlertsConfig{Interval: "30s", Rules: []AlertRule{{Name: "x", When: AlertErrorRate, Above: 20, Window: "10m"}}}
+	if err := cfg.validate(); err != nil {
+		t.Errorf("Expected a valid config, got %v", err)
+	}
+}
+
+func alertStatus(peers ...*ipnstate.PeerStatus) *ipnstate.Status {
+	st := &ipnstate.Status{Peer: map[key.NodePublic]*ipnstate.PeerStatus{}}
+	for _, p := range peers {
+		st.Peer[key.NewNode().Public()] = p
+	}
+	return st
+}
+
+func TestAlertPeerRules(t *testing.T) {
+	m := newAlertMonitor(&AlertsConfig{Rules: []AlertRule{
+		{Name: "db-offline", When: AlertPeerOffline, Peer: "lab-db", For: "60s"},
+		{Name: "relayed", When: AlertPeerRelayed},
+	}}, nil)
+	m.totals = func() (int64, int64) { return 0, 0 }
+	start := time.Date(2026, 10, 1, 10, 0, 0, 0, time.UTC)
+
+	down := alertStatus(&ipnstate.PeerStatus{HostName: "lab-db"}, &ipnstate.PeerStatus{HostName: "scope", Online: true, Relay: "fra"})
+	out := captureStdout(t, func() { m.check(start, down) })
+	if strings.Contains(out, "rule=db-offline") {
+		t.Errorf("Expected db-offline to wait for 60s, got %q", out)
+	}
+	if !strings.Contains(out, "@@SIDECAR:ALERT@@ rule=relayed state=firing when=peer_relayed peer=scope relayed=fra") {
+		t.Errorf("Expected relayed to fire right away, got %q", out)
+	}
+	if got := m.active(); len(got) != 2 || got[0].Rule != "db-offline" || got[0].Firing || !got[1].Firing {
+		t.Errorf("Unexpected active alerts %+v", got)
+	}
+
+	out = captureStdout(t, func() { m.check(start.Add(time.Minute), down) })
+	if !strings.Contains(out, "rule=db-offline state=firing when=peer_offline peer=lab-db offline") || strings.Contains(out, "rule=relayed") {
+		t.Errorf("Expected only db-offline to fire, got %q", out)
+	}
+
+	// A check without status keeps the peer alerts as they are
+	out = captureStdout(t, func() { m.check(start.Add(90*time.Second), nil) })
+	if out != "" || len(m.active()) != 2 {
+		t.Errorf("Expected no change without status, got %q", out)
+	}
+
+	up := alertStatus(&ipnstate.PeerStatus{HostName: "lab-db", Online: true, CurAddr: "10.0.0.5:41641"})
+	out = captureStdout(t, func() { m.check(start.Add(2*time.Minute), up) })
+	if !strings.Contains(out, "rule=db-offline state=resolved when=peer_offline peer=lab-db after=2m0s") ||
+		!strings.Contains(out, "rule=relayed state=resolved") {
+		t.Errorf("Expected both to resolve, got %q", out)
+	}
+	if len(m.active()) != 0 {
+		t.Errorf("Expected nothing active, got %+v", m.active())
+	}
+
+	// A named peer that left the tailnet counts as offline
+	if got := peerConditions(AlertRule{When: AlertPeerOffline, Peer: "lab-db"}, alertStatus()); got["lab-db"] != "not in the tailnet" {
+		t.Errorf("Expected a missing peer to be offline, got %v", got)
+	}
+}
+
+func TestAlertErrorRate(t *testing.T) {
+	var dials, failed int64
+	m := newAlertMonitor(&AlertsConfig{Rules: []AlertRule{{Name: "errors", When: AlertErrorRate, Above: 20, Window: "5m"}}}, nil)
+	m.totals = func() (int64, int64) { return dials, failed }
+	start := time.Date(2026, 10, 1, 10, 0, 0, 0, time.UTC)
+
+	captureStdout(t, func() { m.check(start, nil) })
+	dials, failed = 5, 5
+	if out := captureStdout(t, func() { m.check(start.Add(time.Minute), nil) }); out != "" {
+		t.Errorf("Expected too few dials not to fire, got %q", out)
+	}
+	dials, failed = 40, 12
+	out := captureStdout(t, func() { m.check(start.Add(2*time.Minute), nil) })
+	if !strings.Contains(out, "rule=errors state=firing when=error_rate rate=30.0% failed=12 dials=40") {
+		t.Errorf("Expected the error rate to fire, got %q", out)
+	}
+
+	// Clean dials bring the rate down
+	dials = 200
+	out = captureStdout(t, func() { m.check(start.Add(6*time.Minute), nil) })
+	if !strings.Contains(out, "rule=errors state=resolved when=error_rate after=4m0s") {
+		t.Errorf("Expected the error rate to resolve, got %q", out)
+	}
+	captureStdout(t, func() { m.check(start.Add(12*time.Minute), nil) })
+	if len(m.history) > 3 {
+		t.Errorf("Expected old snapshots to be dropped, kept %d", len(m.history))
+	}
+}
+
+func TestAlertMonitorRun(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	m := newAlertMonitor(&AlertsConfig{Interval: "1h", Rules: []AlertRule{{Name: "any", When: AlertPeerOffline}}},
+		func(ctx context.Context) (*ipnstate.Status, error) {
+			cancel()
+			return alertStatus(&ipnstate.PeerStatus{HostName: "lab-db"}), nil
+		})
+	if m.Interval != time.Hour {
+		t.Errorf("Expected the configured interval, got %v", m.Interval)
+	}
+	captureStdout(t, func() { m.run(ctx) })
+	if got := m.active(); len(got) != 1 || got[0].Peer != "lab-db" || !got[0].Firing {
+		t.Errorf("Expected the first check to run right away, got %+v", got)
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// --- SERVICE ALIASES ---
+
+// aliasBase is the first loopback address handed out to aliases that don't
+// specify one. 127.0.1.0/24 is routed to the loopback interface on Linux and
+// stays clear of the 127.0.0.1 the proxies bind to.
+var aliasBase = net.IPv4(127, 0, 1, 1).To4()
+
+// ServiceAlias maps a local loopback IP to a tailnet host, so software that
+// insists on talking to a raw "server IP" can reach a named tailnet service.
+type ServiceAlias struct {
+	Host string // tailnet hostname (or IP) connections are forwarded to
+	IP   string // local loopback address the alias listens on
+}
+
+// aliasFlag collects repeated -alias flags of the form "host" or "host=ip"
+type aliasFlag []string
+
+func (a *aliasFlag) String() string {
+	return strings.Join(*a, ",")
+}
+
+func (a *aliasFlag) Set(value string) error {
+	*a = append(*a, value)
+	return nil
+}
+
+// parseAliases turns "host" / "host=ip" specs into aliases, assigning
+// sequential 127.0.1.x addresses to hosts without an explicit IP.
+func parseAliases(specs []string) ([]ServiceAlias, error) {
+	used := make(map[string]bool)
+	var aliases []ServiceAlias
+
+	for _, spec := range specs {
+		host, ip, _ := strings.Cut(spec, "=")
+		host = strings.TrimSpace(host)
+		ip = strings.TrimSpace(ip)
+		if host == "" {
+			return nil, fmt.Errorf("invalid alias %q: missing host", spec)
+		}
+		if ip != "" {
+			parsed := net.ParseIP(ip)
+			if parsed == nil || !parsed.IsLoopback() {
+				return nil, fmt.Errorf("invalid alias %q: %s is not a loopback address", spec, ip)
+			}
+			ip = parsed.String()
+			if used[ip] {
+				return nil, fmt.Errorf("invalid alias %q: %s is already assigned", spec, ip)
+			}
+			used[ip] = true
+		}
+		aliases = append(aliases, ServiceAlias{Host: host, IP: ip})
+	}
+
+	// Hand out addresses only after explicit ones are known so they never collide
+	next := make(net.IP, len(aliasBase))
+	copy(next, aliasBase)
+	for i := range aliases {
+		if aliases[i].IP != "" {
+			continue
+		}
+		for used[next.String()] {
+			next[3]++
+			if next[3] == 0 {
+				return nil, fmt.Errorf("ran out of alias addresses in 127.0.1.0/24")
+			}
+		}
+		aliases[i].IP = next.String()
+		used[aliases[i].IP] = true
+	}
+
+	return aliases, nil
+}
+
+// parsePorts parses a comma separated port list with optional ranges,
+// e.g. "80,443,8000-8010"
+func parsePorts(spec string) ([]int, error) {
+	seen := make(map[int]bool)
+	var ports []int
+
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		lo, hi, isRange := strings.Cut(part, "-")
+		start, err := strconv.Atoi(lo)
+		if err != nil {
+			return nil, fmt.Errorf("invalid port %q", part)
+		}
+		end := start
+		if isRange {
+			if end, err = strconv.Atoi(hi); err != nil {
+				return nil, fmt.Errorf("invalid port range %q", part)
+			}
+		}
+		if start < 1 || end > 65535 || start > end {
+			return nil, fmt.Errorf("invalid port range %q", part)
+		}
+		for p := start; p <= end; p++ {
+			if !seen[p] {
+				seen[p] = true
+				ports = append(ports, p)
+			}
+		}
+	}
+
+	if len(ports) == 0 {
+		return nil, fmt.Errorf("no ports given")
+	}
+	return ports, nil
+}
+
+// startAliases binds every alias IP on every port and forwards accepted
+// connections to the same port on the aliased tailnet host.
+func startAliases(d Dialer, aliases []ServiceAlias, ports []int) error {
+	for _, alias := range aliases {
+		for _, port := range ports {
+			addr := net.JoinHostPort(alias.IP, strconv.Itoa(port))
+			ln, err := listenClients(addr)
+			if err != nil {
+				if runtime.GOOS == "darwin" {
+					return fmt.Errorf("failed to listen on %s (run 'sudo ifconfig lo0 alias %s up' first): %w", addr, alias.IP, err)
+				}
+				return fmt.Errorf("failed to listen on %s: %w", addr, err)
+			}
+			target := net.JoinHostPort(alias.Host, strconv.Itoa(port))
+			go serveAlias(ln, d, target)
+			listeners.add(ListenerInfo{Mode: "alias", Addr: addr, Target: target})
+		}
+		fmt.Fprintf(console, ">>> Alias %s -> %s (ports: %d)\n", alias.IP, alias.Host, len(ports))
+		fmt.Fprintf(console, ">>> Add '%s %s' to your hosts file to reach it by name\n", alias.IP, alias.Host)
+		signal(SignalListening, fmt.Sprintf("mode=alias addr=%s host=%s", alias.IP, alias.Host))
+	}
+	return nil
+}
+
+// serveAlias accepts connections on ln and pipes each one to target via the tailnet
+func serveAlias(ln net.Listener, d Dialer, target string) {
+	serveForward(ln, "alias", func(ctx context.Context) (net.Conn, error) {
+		return d.Dial(ctx, "tcp", target)
+	})
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+)
+
+func TestParseAliases(t *testing.T) {
+	aliases, err := parseAliases([]string{"data-node", "core=127.0.1.1", "minio"})
+	if err != nil {
+		t.Fatalf("Failed to parse aliases: %v", err)
+	}
+
+	want := []ServiceAlias{
+		{Host: "data-node", IP: "127.0.1.2"},
+		{Host: "core", IP: "127.0.1.1"},
+		{Host: "minio", IP: "127.0.1.3"},
+	}
+	if len(aliases) != len(want) {
+		t.Fatalf("Expected %d aliases, got %d", len(want), len(aliases))
+	}
+	for i := range want {
+		if aliases[i] != want[i] {
+			t.Errorf("Expected alias %d to be %+v, got %+v", i, want[i], aliases[i])
+		}
+	}
+}
+
+func TestParseAliasesInvalid(t *testing.T) {
+	tests := map[string][]string{
+		"missing host":    {"=127.0.1.1"},
+		"non loopback ip": {"core=10.0.0.1"},
+		"duplicate ip":    {"a=127.0.1.5", "b=127.0.1.5"},
+		"unparseable ip":  {"core=not-an-ip"},
+	}
+	for name, specs := range tests {
+		t.Run(name, func(t *testing.T) {
+			if _, err := parseAliases(specs); err == nil {
+				t.Errorf("Expected error for %v", specs)
+			}
+		})
+	}
+}
+
+func TestParsePorts(t *testing.T) {
+	ports, err := parsePorts("80, 443,8000-8002,443")
+	if err != nil {
+		t.Fatalf("Failed to parse ports: %v", err)
+	}
+	want := []int{80, 443, 8000, 8001, 8002}
+	if len(ports) != len(want) {
+		t.Fatalf("Expected %v, got %v", want, ports)
+	}
+	for i := range want {
+		if ports[i] != want[i] {
+			t.Errorf("Expected %v, got %v", want, ports)
+		}
+	}
+
+	for _, bad := range []string{"", "http", "0", "70000", "90-80"} {
+		if _, err := parsePorts(bad); err == nil {
+			t.Errorf("Expected error for %q", bad)
+		}
+	}
+}
+
+func TestServeAlias(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer ln.Close()
+
+	dialed := make(chan string, 1)
+	mockDialer := &MockDialer{
+		DialFunc: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			dialed <- addr
+			client, server := net.Pipe()
+			go func() {
+				defer server.Close()
+				buf := make([]byte, 4)
+				io.ReadFull(server, buf)
+				server.Write(buf)
+			}()
+			return client, nil
+		},
+	}
+
+	go serveAlias(ln, mockDialer, "data-node:9000")
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to dial alias: %v", err)
+	}
+	defer conn.Close()
+
+	conn.Write([]byte("ping"))
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatalf("Failed to read echo: %v", err)
+	}
+	if string(buf) != "ping" {
+		t.Errorf("Expected 'ping', got '%s'", string(buf))
+	}
+	if addr := <-dialed; addr != "data-node:9000" {
+		t.Errorf("Expected dial to data-node:9000, got %s", addr)
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// --- API VERSIONING ---
+
+// apiSchemaVersion is bumped whenever a status API response changes in a way
+// that breaks existing clients. New fields don't bump it, so clients should
+// ignore fields they don't know.
+const apiSchemaVersion = 1
+
+// apiPrefix is where the current version of the status API is mounted
+const apiPrefix = "/api/v1"
+
+// schemaVersionHeader carries apiSchemaVersion on every response, including
+// the ones whose body is a JSON array and can't hold a schema_version field
+const schemaVersionHeader = "X-Sidecar-Schema-Version"
+
+// apiMux mounts every route under apiPrefix and, for clients written before
+// the API was versioned, at its bare legacy path as well
+type apiMux struct {
+	*http.ServeMux
+}
+
+// HandleFunc registers handler for pattern ("[METHOD ]/path") under both paths
+func (m apiMux) HandleFunc(pattern string, handler func(http.ResponseWriter, *http.Request)) {
+	method, path, ok := strings.Cut(pattern, " ")
+	if !ok {
+		method, path = "", pattern
+	}
+	versioned := apiPrefix + path
+	if method != "" {
+		versioned = method + " " + versioned
+	}
+	m.ServeMux.HandleFunc(versioned, handler)
+	m.ServeMux.HandleFunc(pattern, handler)
+}
+
+// withSchemaVersion stamps the schema version header on every response
+func withSchemaVersion(h http.Handler) http.Handler {
+	version := strconv.Itoa(apiSchemaVersion)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(schemaVersionHeader, version)
+		h.ServeHTTP(w, r)
+	})
+}
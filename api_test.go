@@ -0,0 +1,50 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+func TestAPIVersioning(t *testing.T) {
+	defer maintenance.Store(false)
+
+	mux := http.NewServeMux()
+	api := apiMux{mux}
+	api.HandleFunc("/control/maintenance", handleMaintenance)
+	api.HandleFunc("GET /connections", handleConnections)
+	handler := withSchemaVersion(mux)
+
+	// Versioned and legacy paths serve the same handler
+	for _, path := range []string{"/api/v1/control/maintenance", "/control/maintenance"} {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: expected status 200, got %d", path, w.Code)
+		}
+		if got := w.Header().Get(schemaVersionHeader); got != strconv.Itoa(apiSchemaVersion) {
+			t.Errorf("%s: expected schema version header %d, got %q", path, apiSchemaVersion, got)
+		}
+		var status MaintenanceStatus
+		if err := json.NewDecoder(w.Body).Decode(&status); err != nil {
+			t.Fatalf("%s: failed to decode response: %v", path, err)
+		}
+		if status.SchemaVersion != apiSchemaVersion {
+			t.Errorf("%s: expected schema_version %d, got %d", path, apiSchemaVersion, status.SchemaVersion)
+		}
+	}
+
+	// Method patterns keep their method under the prefix
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/api/v1/connections", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected status 200 for GET /api/v1/connections, got %d", w.Code)
+	}
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("POST", "/api/v1/connections", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected status 405 for POST /api/v1/connections, got %d", w.Code)
+	}
+}
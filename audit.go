@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// --- AUDIT LOG ---
+
+// AuditEntry is one line of the audit log. Hash covers the entry including
+// Prev, the previous entry's hash, so editing, removing or reordering lines
+// breaks the chain from that point on. It is keyed with a secret kept apart
+// from the log, so whoever can write the log can't forge a new chain.
+type AuditEntry struct {
+	Seq     int64             `json:"seq"`
+	Time    string            `json:"time"` // RFC 3339 with nanoseconds, UTC
+	Action  string            `json:"action"`
+	Details map[string]string `json:"details,omitempty"`
+	Prev    string            `json:"prev"` // "" for the first entry
+	Hash    string            `json:"hash"`
+}
+
+// AuditVerification is the result of checking an audit log's hash chain
+type AuditVerification struct {
+	SchemaVersion int    `json:"schema_version"`
+	Valid         bool   `json:"valid"`
+	Entries       int64  `json:"entries"`
+	LastHash      string `json:"last_hash"`
+	BrokenAt      int64  `json:"broken_at,omitempty"` // line of the first entry that doesn't match
+	Error         string `json:"error,omitempty"`
+}
+
+// hash returns the HMAC-SHA256 under key of the entry's compact JSON
+// encoding with an empty hash field
+func (e AuditEntry) hash(key []byte) string {
+	e.Hash = ""
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	enc.Encode(e)
+	mac := hmac.New(sha256.New, key)
+	mac.Write(bytes.TrimSuffix(buf.Bytes(), []byte("\n")))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// auditKeyFile is the key's name in the state directory unless -audit-key
+// names another file
+const auditKeyFile = "audit-key"
+
+// loadAuditKey reads the hex key at path, or creates the file with a random
+// key if there is none yet
+func loadAuditKey(path string) ([]byte, error) {
+	if data, err := os.ReadFile(path); err == nil {
+		key, err := hex.DecodeString(strings.TrimSpace(string(data)))
+		if err != nil || len(key) < 16 {
+			return nil, fmt.Errorf("%s is not a hex key of at least 16 bytes", path)
+		}
+		return key, nil
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	key := make([]byte, 32)
+	rand.Read(key)
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if _, err := fmt.Fprintln(f, hex.EncodeToString(key)); err != nil {
+		return nil, err
+	}
+	return key, f.Sync()
+}
+
+// auditLog appends hash-chained entries to a file opened append-only. All
+// methods do nothing on a nil *auditLog, so callers don't check -audit-log.
+type auditLog struct {
+	path string
+	key  []byte
+
+	mu   sync.Mutex
+	f    *os.File
+	seq  int64
+	last string
+	now  func() time.Time // time.Now outside of tests
+}
+
+// audit records control-plane actions when -audit-log is set
+var audit *auditLog
+
+// openAuditLog opens or creates the log at path and continues its chain,
+// keyed with key. A broken chain is reported, not repaired: it is the
+// evidence.
+func openAuditLog(path string, key []byte) (*auditLog, error) {
+	a := &auditLog{path: path, key: key, now: time.Now}
+	if existing, err := os.Open(path); err == nil {
+		v := verifyAudit(existing, key)
+		existing.Close()
+		if !v.Valid {
+			fmt.Fprintf(console, "!!! Audit log %s is broken at line %d: %s\n", path, v.BrokenAt, v.Error)
+			signal(SignalWarning, fmt.Sprintf("audit_chain_broken line=%d", v.BrokenAt))
+		}
+		a.seq, a.last = v.Entries, v.LastHash
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	a.f = f
+	return a, nil
+}
+
+// record appends an entry. Details are alternating keys and values.
+func (a *auditLog) record(action string, details ...string) {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	e := AuditEntry{
+		Seq:    a.seq + 1,
+		Time:   a.now().UTC().Format(time.RFC3339Nano),
+		Action: action,
+		Prev:   a.last,
+	}
+	if len(details) > 0 {
+		e.Details = map[string]string{}
+		for i := 0; i+1 < len(details); i += 2 {
+			e.Details[details[i]] = secrets.redact(details[i+1])
+		}
+	}
+	e.Hash = e.hash(a.key)
+
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	enc.Encode(e)
+	if _, err := a.f.Write(buf.Bytes()); err != nil {
+		fmt.Fprintf(console, "[AUDIT] Failed to write %s entry: %v\n", action, err)
+		return
+	}
+	// Entries must survive a crash right after the action
+	a.f.Sync()
+	a.seq, a.last = e.Seq, e.Hash
+}
+
+// verifyAudit checks every entry's hash under key and its link to the
+// previous one
+func verifyAudit(r io.Reader, key []byte) AuditVerification {
+	v := AuditVerification{SchemaVersion: apiSchemaVersion, Valid: true}
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64<<10), 1<<20)
+	line := int64(0)
+	for sc.Scan() {
+		line++
+		var e AuditEntry
+		err := json.Unmarshal(sc.Bytes(), &e)
+		switch {
+		case err != nil:
+			err = fmt.Errorf("unreadable entry: %v", err)
+		case e.Prev != v.LastHash:
+			err = fmt.Errorf("entry %d doesn't follow the previous entry", e.Seq)
+		case !hmac.Equal([]byte(e.Hash), []byte(e.hash(key))):
+			err = fmt.Errorf("entry %d was modified", e.Seq)
+		}
+		if err != nil && v.Valid {
+			v.Valid, v.BrokenAt, v.Error = false, line, err.Error()
+		}
+		// Later entries are still counted, so appending continues the file
+		v.Entries, v.LastHash = max(v.Entries, e.Seq), e.Hash
+	}
+	if err := sc.Err(); err != nil && v.Valid {
+		v.Valid, v.BrokenAt, v.Error = false, line+1, err.Error()
+	}
+	return v
+}
+
+// handleAudit serves the audit log as JSON lines
+func handleAudit(w http.ResponseWriter, r *http.Request) {
+	if audit == nil {
+		http.Error(w, "audit log is off (start with -audit-log)", http.StatusNotFound)
+		return
+	}
+	f, err := os.Open(audit.path)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	io.Copy(w, f)
+}
+
+// handleAuditVerify checks the hash chain of the audit log on disk
+func handleAuditVerify(w http.ResponseWriter, r *http.Request) {
+	if audit == nil {
+		http.Error(w, "audit log is off (start with -audit-log)", http.StatusNotFound)
+		return
+	}
+	f, err := os.Open(audit.path)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(verifyAudit(f, audit.key))
+}
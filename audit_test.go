@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAuditLogChain(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "audit.jsonl")
+	key, err := loadAuditKey(filepath.Join(dir, "state", auditKeyFile))
+	if err != nil {
+		t.Fatalf("Failed to create audit key: %v", err)
+	}
+	if again, err := loadAuditKey(filepath.Join(dir, "state", auditKeyFile)); err != nil || !bytes.Equal(again, key) {
+		t.Fatalf("Expected the key to be kept, got %x %v", again, err)
+	}
+	a, err := openAuditLog(path, key)
+	if err != nil {
+		t.Fatalf("Failed to open audit log: %v", err)
+	}
+	a.record("start", "version", "test")
+	a.record("maintenance", "enabled", "true")
+	a.f.Close()
+
+	// Reopening continues the chain
+	a, err = openAuditLog(path, key)
+	if err != nil {
+		t.Fatalf("Failed to reopen audit log: %v", err)
+	}
+	a.record("reload", "ok", "true")
+	a.f.Close()
+
+	data, _ := os.ReadFile(path)
+	v := verifyAudit(bytes.NewReader(data), key)
+	if !v.Valid || v.Entries != 3 {
+		t.Fatalf("Expected a valid chain of 3 entries, got %+v", v)
+	}
+
+	// Editing an entry breaks the chain there
+	tampered := strings.Replace(string(data), `"enabled":"true"`, `"enabled":"false"`, 1)
+	if v := verifyAudit(strings.NewReader(tampered), key); v.Valid || v.BrokenAt != 2 {
+		t.Errorf("Expected the edit to be detected on line 2, got %+v", v)
+	}
+
+	// So does removing one
+	lines := strings.SplitAfter(string(data), "\n")
+	if v := verifyAudit(strings.NewReader(lines[0]+lines[2]), key); v.Valid || v.BrokenAt != 2 {
+		t.Errorf("Expected the removal to be detected on line 2, got %+v", v)
+	}
+
+	// Without the key, a rewritten chain doesn't verify
+	forged, err := openAuditLog(filepath.Join(dir, "forged.jsonl"), []byte("guessed-key-guessed-key"))
+	if err != nil {
+		t.Fatalf("Failed to open audit log: %v", err)
+	}
+	forged.record("start", "version", "test")
+	forged.f.Close()
+	data, _ = os.ReadFile(forged.path)
+	if v := verifyAudit(bytes.NewReader(data), key); v.Valid || v.BrokenAt != 1 {
+		t.Errorf("Expected an entry keyed with another key to be rejected, got %+v", v)
+	}
+
+	// A nil log records nothing
+	var off *auditLog
+	off.record("start")
+}
@@ -0,0 +1,14 @@
+package main
+
+import "os"
+
+// listenOverflows reads the kernel's ListenOverflows and ListenDrops
+// counters from /proc/net/netstat
+func listenOverflows() (overflows, drops int64, ok bool) {
+	f, err := os.Open("/proc/net/netstat")
+	if err != nil {
+		return 0, 0, false
+	}
+	defer f.Close()
+	return parseListenOverflows(f)
+}
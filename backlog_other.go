@@ -0,0 +1,8 @@
+//go:build !linux
+
+package main
+
+// listenOverflows: only Linux exposes the counters without privileges
+func listenOverflows() (overflows, drops int64, ok bool) {
+	return 0, 0, false
+}
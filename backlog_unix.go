@@ -0,0 +1,36 @@
+//go:build !windows
+
+package main
+
+import (
+	"errors"
+	"net"
+	"syscall"
+)
+
+// backlogSupported: Linux, the BSDs and macOS resize the queue on a second listen()
+const backlogSupported = true
+
+// setBacklog listens on the socket again with backlog, which changes the
+// queue length of a listener that is already open
+func setBacklog(ln net.Listener, backlog int) error {
+	if tl := tcpListener(ln); tl != nil {
+		ln = tl
+	}
+	sc, ok := ln.(syscall.Conn)
+	if !ok {
+		return errors.New("listener has no socket")
+	}
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var opErr error
+	err = rc.Control(func(fd uintptr) {
+		opErr = syscall.Listen(int(fd), backlog)
+	})
+	if err != nil {
+		return err
+	}
+	return opErr
+}
@@ -0,0 +1,13 @@
+package main
+
+import (
+	"errors"
+	"net"
+)
+
+// backlogSupported: Winsock can't change the backlog of an open listener
+const backlogSupported = false
+
+func setBacklog(ln net.Listener, backlog int) error {
+	return errors.New("-listen-backlog is not supported on Windows")
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// --- LOAD BALANCING ---
+
+// Balancing strategies for PoolConfig.Balance
+const (
+	BalanceRoundRobin = "round_robin"
+	BalanceLeastConn  = "least_conn"
+)
+
+// Passive health checking: a backend that fails defaultMaxFailures dials in a
+// row is skipped for backendCooldown before it gets another chance.
+const (
+	defaultMaxFailures = 3
+	backendCooldown    = 30 * time.Second
+)
+
+// PoolConfig is the shared part of forward and route rules that name several
+// tailnet backends for a single destination.
+type PoolConfig struct {
+	Targets     []string `json:"targets"`                // tailnet host or host:port, tried in balancing order
+	Backup      []string `json:"backup,omitempty"`       // only used while every target is down or offline
+	Balance     string   `json:"balance,omitempty"`      // "round_robin" (default) or "least_conn"
+	Sticky      string   `json:"sticky,omitempty"`       // "client_ip" or "cookie" to pin clients to a backend
+	MaxFailures int      `json:"max_failures,omitempty"` // consecutive dial failures before a backend is skipped (default 3)
+}
+
+func (c PoolConfig) validate() error {
+	if len(c.Targets) == 0 {
+		return errors.New("at least one target is required")
+	}
+	switch c.Balance {
+	case "", BalanceRoundRobin, BalanceLeastConn:
+	default:
+		return fmt.Errorf("unknown balance strategy %q", c.Balance)
+	}
+	switch c.Sticky {
+	case "", StickyClientIP, StickyCookie:
+	default:
+		return fmt.Errorf("unknown sticky mode %q", c.Sticky)
+	}
+	if c.MaxFailures < 0 {
+		return fmt.Errorf("max_failures must not be negative, got %d", c.MaxFailures)
+	}
+	return nil
+}
+
+// backend is a single pool member and its passive health state
+type backend struct {
+	addr      string
+	backup    bool
+	active    atomic.Int64 // open connections, for least_conn
+	failures  int          // consecutive dial failures, guarded by Pool.mu
+	downUntil time.Time    // ejected until then, guarded by Pool.mu
+}
+
+// peerOnlineFunc reports whether a tailnet host is online; known is false for
+// hosts that aren't tailnet peers (or when presence can't be determined).
+type peerOnlineFunc func(host string) (online, known bool)
+
+// Pool balances dials across a set of tailnet backends, failing over to its
+// backup group when the primary group is unavailable.
+type Pool struct {
+	name        string
+	backends    []*backend // primary group followed by the backup group
+	primary     []*backend
+	secondary   []*backend
+	strategy    string
+	sticky      string
+	maxFailures int
+	online      peerOnlineFunc
+
+	mu         sync.Mutex
+	next       int
+	failedOver bool
+}
+
+func newPool(name string, cfg PoolConfig, online peerOnlineFunc) *Pool {
+	p := &Pool{
+		name:        name,
+		strategy:    cfg.Balance,
+		sticky:      cfg.Sticky,
+		maxFailures: cfg.MaxFailures,
+		online:      online,
+	}
+	if p.strategy == "" {
+		p.strategy = BalanceRoundRobin
+	}
+	if p.maxFailures == 0 {
+		p.maxFailures = defaultMaxFailures
+	}
+	for _, t := range cfg.Targets {
+		p.primary = append(p.primary, &backend{addr: t})
+	}
+	for _, t := range cfg.Backup {
+		p.secondary = append(p.secondary, &backend{addr: t, backup: true})
+	}
+	p.backends = append(append([]*backend{}, p.primary...), p.secondary...)
+	return p
+}
+
+// available reports whether b is neither ejected nor known to be offline.
+// Callers hold p.mu.
+func (p *Pool) available(b *backend) bool {
+	if time.Now().Before(b.downUntil) {
+		return false
+	}
+	if p.online != nil {
+		if online, known := p.online(addrHost(b.addr)); known && !online {
+			return false
+		}
+	}
+	return true
+}
+
+// arrange orders one priority group according to the balancing strategy,
+// moving the backend key hashes to to the front. Callers hold p.mu.
+func (p *Pool) arrange(group []*backend, start int, key string) []*backend {
+	n := len(group)
+	if n == 0 {
+		return nil
+	}
+	start %= n
+
+	if p.strategy == BalanceLeastConn {
+		best := -1
+		for i := 0; i < n; i++ {
+			idx := (start + i) % n
+			if !p.available(group[idx]) {
+				continue
+			}
+			if best < 0 || group[idx].active.Load() < group[best].active.Load() {
+				best = idx
+			}
+		}
+		if best >= 0 {
+			start = best
+		}
+	}
+
+	ordered := make([]*backend, 0, n)
+	for i := 0; i < n; i++ {
+		ordered = append(ordered, group[(start+i)%n])
+	}
+	if key != "" {
+		preferred := group[stickyHash(key)%uint32(n)]
+		for i, b := range ordered {
+			if b == preferred {
+				copy(ordered[1:i+1], ordered[:i])
+				ordered[0] = preferred
+				break
+			}
+		}
+	}
+	return ordered
+}
+
+// order returns the backends in the sequence they should be tried: available
+// primaries, then available backups, then everything else. Unavailable
+// backends are still returned last so a pool whose members are all down keeps
+// probing instead of failing outright. A non-empty key moves the backend it
+// hashes to to the front of its group.
+func (p *Pool) order(key string) []*backend {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	start := p.next
+	p.next++
+	return p.orderFrom(start, key)
+}
+
+// peek returns the order the next dial would use, without taking its turn
+func (p *Pool) peek(key string) []*backend {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.orderFrom(p.next, key)
+}
+
+// orderFrom is order for a given round-robin position. Callers hold p.mu.
+func (p *Pool) orderFrom(start int, key string) []*backend {
+	var ready, down []*backend
+	for _, group := range [][]*backend{p.primary, p.secondary} {
+		for _, b := range p.arrange(group, start, key) {
+			if p.available(b) {
+				ready = append(ready, b)
+			} else {
+				down = append(down, b)
+			}
+		}
+	}
+	return append(ready, down...)
+}
+
+// isDown reports whether b is currently ejected by passive health checks
+func (p *Pool) isDown(b *backend) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return !p.available(b)
+}
+
+// report records the outcome of a dial for passive health checking
+func (p *Pool) report(b *backend, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if err == nil {
+		b.failures = 0
+		b.downUntil = time.Time{}
+		p.noteServed(b)
+		return
+	}
+	b.failures++
+	if b.failures >= p.maxFailures {
+		if b.downUntil.IsZero() || time.Now().After(b.downUntil) {
+			fmt.Fprintf(console, "[POOL] Backend %s failed %d times, ejecting for %s\n", b.addr, b.failures, backendCooldown)
+		}
+		b.downUntil = time.Now().Add(backendCooldown)
+	}
+}
+
+// noteServed emits an event whenever traffic moves between the primary and
+// backup groups. Callers hold p.mu.
+func (p *Pool) noteServed(b *backend) {
+	switch {
+	case b.backup && !p.failedOver:
+		p.failedOver = true
+		fmt.Fprintf(console, "[POOL] %s: primary targets unavailable, failing over to %s\n", p.name, b.addr)
+		signal(SignalFailover, fmt.Sprintf("pool=%s target=%s", p.name, b.addr))
+	case !b.backup && p.failedOver:
+		p.failedOver = false
+		fmt.Fprintf(console, "[POOL] %s: primary target %s is back\n", p.name, b.addr)
+		signal(SignalFailback, fmt.Sprintf("pool=%s target=%s", p.name, b.addr))
+	}
+}
+
+// Dial connects to the first backend that answers, in balancing order.
+// port is used for backends configured without one.
+func (p *Pool) Dial(ctx context.Context, d Dialer, network, port string) (net.Conn, error) {
+	key := ""
+	if p.sticky != "" {
+		// Cookies only exist for plain HTTP (see Router.pin); everything
+		// else on a sticky pool is pinned by client IP
+		key = clientIP(ctx)
+	}
+
+	var errs []error
+	for _, b := range p.order(key) {
+		addr := b.addr
+		if _, _, err := net.SplitHostPort(addr); err != nil && port != "" {
+			addr = net.JoinHostPort(addr, port)
+		}
+
+		conn, err := d.Dial(ctx, network, addr)
+		p.report(b, err)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", addr, err))
+			if ctx.Err() != nil {
+				break
+			}
+			continue
+		}
+
+		b.active.Add(1)
+		return &poolConn{Conn: conn, backend: b}, nil
+	}
+	return nil, fmt.Errorf("all backends failed: %w", errors.Join(errs...))
+}
+
+// BackendStatus is the state of one pool member, for /routes
+type BackendStatus struct {
+	Addr      string `json:"addr"`
+	Backup    bool   `json:"backup,omitempty"`
+	Available bool   `json:"available"` // not ejected and not known to be offline
+	Active    int64  `json:"active"`    // open connections
+	Failures  int    `json:"failures"`  // consecutive failed dials
+}
+
+// status describes every backend, primaries first
+func (p *Pool) status() []BackendStatus {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	list := make([]BackendStatus, len(p.backends))
+	for i, b := range p.backends {
+		list[i] = BackendStatus{Addr: b.addr, Backup: b.backup, Available: p.available(b), Active: b.active.Load(), Failures: b.failures}
+	}
+	return list
+}
+
+// poolConn releases its backend's connection count on Close
+type poolConn struct {
+	net.Conn
+	backend *backend
+	once    sync.Once
+}
+
+func (c *poolConn) Close() error {
+	c.once.Do(func() { c.backend.active.Add(-1) })
+	return c.Conn.Close()
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+// recordingDialer returns pipes and records every address it was asked to dial.
+// Addresses in fail are refused.
+type recordingDialer struct {
+	dialed []string
+	fail   map[string]bool
+}
+
+func (d *recordingDialer) Dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	d.dialed = append(d.dialed, addr)
+	if d.fail[addr] {
+		return nil, errors.New("connection refused")
+	}
+	client, server := net.Pipe()
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+	return client, nil
+}
+
+func TestPoolRoundRobin(t *testing.T) {
+	d := &recordingDialer{}
+	pool := newPool("test", PoolConfig{Targets: []string{"w1:8000", "w2:8000", "w3:8000"}}, nil)
+
+	for i := 0; i < 6; i++ {
+		conn, err := pool.Dial(context.Background(), d, "tcp", "")
+		if err != nil {
+			t.Fatalf("Dial %d failed: %v", i, err)
+		}
+		conn.Close()
+	}
+
+	want := []string{"w1:8000", "w2:8000", "w3:8000", "w1:8000", "w2:8000", "w3:8000"}
+	for i := range want {
+		if d.dialed[i] != want[i] {
+			t.Fatalf("Expected dial order %v, got %v", want, d.dialed)
+		}
+	}
+}
+
+func TestPoolLeastConn(t *testing.T) {
+	d := &recordingDialer{}
+	pool := newPool("test", PoolConfig{Targets: []string{"w1", "w2"}, Balance: BalanceLeastConn}, nil)
+
+	// Hold a connection to whichever backend comes first
+	held, err := pool.Dial(context.Background(), d, "tcp", "9000")
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer held.Close()
+	first := d.dialed[0]
+
+	// Every further short-lived connection should go to the idle backend
+	for i := 0; i < 3; i++ {
+		conn, err := pool.Dial(context.Background(), d, "tcp", "9000")
+		if err != nil {
+			t.Fatalf("Dial failed: %v", err)
+		}
+		if got := d.dialed[len(d.dialed)-1]; got == first {
+			t.Errorf("Expected least_conn to avoid busy backend %s", first)
+		}
+		conn.Close()
+	}
+}
+
+func TestPoolPassiveHealthCheck(t *testing.T) {
+	d := &recordingDialer{fail: map[string]bool{"w1:80": true}}
+	pool := newPool("test", PoolConfig{Targets: []string{"w1", "w2"}}, nil)
+
+	// Dials keep succeeding by falling through to w2
+	for i := 0; i < defaultMaxFailures*2; i++ {
+		conn, err := pool.Dial(context.Background(), d, "tcp", "80")
+		if err != nil {
+			t.Fatalf("Dial %d failed: %v", i, err)
+		}
+		conn.Close()
+	}
+
+	// Once ejected, w1 is no longer tried first
+	d.dialed = nil
+	for i := 0; i < 4; i++ {
+		conn, err := pool.Dial(context.Background(), d, "tcp", "80")
+		if err != nil {
+			t.Fatalf("Dial failed: %v", err)
+		}
+		conn.Close()
+	}
+	for _, addr := range d.dialed {
+		if addr == "w1:80" {
+			t.Fatalf("Expected ejected backend to be skipped, got dials %v", d.dialed)
+		}
+	}
+
+	// After the cooldown it gets probed again
+	pool.backends[0].downUntil = time.Now().Add(-time.Second)
+	d.dialed = nil
+	for i := 0; i < 2; i++ {
+		if conn, err := pool.Dial(context.Background(), d, "tcp", "80"); err == nil {
+			conn.Close()
+		}
+	}
+	probed := false
+	for _, addr := range d.dialed {
+		probed = probed || addr == "w1:80"
+	}
+	if !probed {
+		t.Errorf("Expected backend to be probed after cooldown, got dials %v", d.dialed)
+	}
+}
+
+func TestPoolAllBackendsDown(t *testing.T) {
+	d := &recordingDialer{fail: map[string]bool{"w1:80": true, "w2:80": true}}
+	pool := newPool("test", PoolConfig{Targets: []string{"w1", "w2"}}, nil)
+
+	if _, err := pool.Dial(context.Background(), d, "tcp", "80"); err == nil {
+		t.Fatal("Expected error when every backend fails")
+	}
+	if len(d.dialed) != 2 {
+		t.Errorf("Expected both backends to be tried, got %v", d.dialed)
+	}
+}
+
+func TestPoolFailover(t *testing.T) {
+	d := &recordingDialer{fail: map[string]bool{"primary:5432": true}}
+	pool := newPool("db", PoolConfig{Targets: []string{"primary"}, Backup: []string{"standby"}, MaxFailures: 2}, nil)
+
+	// The standby takes over as soon as the primary dial fails
+	conn, err := pool.Dial(context.Background(), d, "tcp", "5432")
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	conn.Close()
+	if !pool.failedOver {
+		t.Error("Expected pool to report failover")
+	}
+
+	// After max_failures the primary isn't even tried any more
+	pool.Dial(context.Background(), d, "tcp", "5432")
+	d.dialed = nil
+	conn, _ = pool.Dial(context.Background(), d, "tcp", "5432")
+	conn.Close()
+	if len(d.dialed) != 1 || d.dialed[0] != "standby:5432" {
+		t.Errorf("Expected only standby to be dialed, got %v", d.dialed)
+	}
+
+	// Once the primary recovers and its cooldown ends, traffic fails back
+	d.fail = nil
+	pool.primary[0].downUntil = time.Now().Add(-time.Second)
+	conn, _ = pool.Dial(context.Background(), d, "tcp", "5432")
+	conn.Close()
+	if pool.failedOver {
+		t.Error("Expected pool to fail back to the primary")
+	}
+}
+
+func TestPoolSkipsOfflinePeers(t *testing.T) {
+	d := &recordingDialer{}
+	online := func(host string) (bool, bool) {
+		return host != "primary", true
+	}
+	pool := newPool("db", PoolConfig{Targets: []string{"primary"}, Backup: []string{"standby"}}, online)
+
+	conn, err := pool.Dial(context.Background(), d, "tcp", "5432")
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	conn.Close()
+	if len(d.dialed) != 1 || d.dialed[0] != "standby:5432" {
+		t.Errorf("Expected offline primary to be skipped, got %v", d.dialed)
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"testing"
+
+	"github.com/armon/go-socks5"
+)
+
+// Benchmarks for the proxy data paths. Everything runs over in-memory pipes
+// with a mock tailnet dialer, so results only depend on the sidecar's own
+// code and are comparable between runs:
+//
+//	go test -run '^$' -bench . -benchmem -count 5 > before.txt
+//	(apply change)
+//	go test -run '^$' -bench . -benchmem -count 5 > after.txt
+//	benchstat before.txt after.txt
+
+// quiet silences the per-request log lines for the rest of the benchmark
+func quiet(b *testing.B) {
+	devNull, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	if err != nil {
+		b.Fatalf("Failed to open %s: %v", os.DevNull, err)
+	}
+	stdout := console.swap(devNull)
+	b.Cleanup(func() {
+		console.swap(stdout)
+		devNull.Close()
+	})
+}
+
+// benchSizes are the payload sizes every data path is measured with
+var benchSizes = []int{1 << 10, 64 << 10, 1 << 20}
+
+// serveChunks answers every byte read from a connection with payload, like
+// a tailnet service streaming responses
+func serveChunks(ln net.Listener, payload []byte) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			buf := make([]byte, 1)
+			for {
+				if _, err := conn.Read(buf); err != nil {
+					return
+				}
+				if _, err := conn.Write(payload); err != nil {
+					return
+				}
+			}
+		}()
+	}
+}
+
+// fetchChunks requests b.N chunks over conn and reads them back
+func fetchChunks(b *testing.B, conn io.ReadWriter, size int) {
+	buf := make([]byte, size)
+	b.SetBytes(int64(size))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := conn.Write([]byte{'x'}); err != nil {
+			b.Fatalf("Write failed: %v", err)
+		}
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			b.Fatalf("Read failed: %v", err)
+		}
+	}
+}
+
+// discardWriter is a ResponseWriter that throws the body away
+type discardWriter struct {
+	header http.Header
+}
+
+func (w *discardWriter) Header() http.Header         { return w.header }
+func (w *discardWriter) Write(p []byte) (int, error) { return len(p), nil }
+func (w *discardWriter) WriteHeader(int)             {}
+
+func BenchmarkHTTPProxy(b *testing.B) {
+	for _, size := range benchSizes {
+		b.Run(fmt.Sprintf("%dKiB", size>>10), func(b *testing.B) {
+			quiet(b)
+			payload := make([]byte, size)
+			backend := newPipeListener()
+			defer backend.Close()
+			go http.Serve(backend, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write(payload)
+			}))
+
+			proxy := &TailscaleProxy{Transport: &http.Transport{DialContext: backend.Dial}}
+			w := &discardWriter{header: http.Header{}}
+			req, _ := http.NewRequest("GET", "http://data-node/blob", nil)
+			req.RemoteAddr = "127.0.0.1:50000"
+
+			b.SetBytes(int64(size))
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				clear(w.header)
+				proxy.ServeHTTP(w, req.Clone(context.Background()))
+			}
+		})
+	}
+}
+
+func BenchmarkConnectTunnel(b *testing.B) {
+	for _, size := range benchSizes {
+		b.Run(fmt.Sprintf("%dKiB", size>>10), func(b *testing.B) {
+			quiet(b)
+			backend := newPipeListener()
+			defer backend.Close()
+			go serveChunks(backend, make([]byte, size))
+
+			front := newPipeListener()
+			defer front.Close()
+			go http.Serve(front, &TailscaleProxy{Dialer: &MockDialer{DialFunc: backend.Dial}})
+
+			conn, err := front.Dial(context.Background(), "tcp", "")
+			if err != nil {
+				b.Fatalf("Failed to reach the proxy: %v", err)
+			}
+			defer conn.Close()
+			fmt.Fprintf(conn, "CONNECT data-node:443 HTTP/1.1\r\nHost: data-node:443\r\n\r\n")
+			br := bufio.NewReader(conn)
+			resp, err := http.ReadResponse(br, nil)
+			if err != nil || resp.StatusCode != http.StatusOK {
+				b.Fatalf("CONNECT failed: %v", err)
+			}
+
+			b.ReportAllocs()
+			fetchChunks(b, struct {
+				io.Reader
+				io.Writer
+			}{br, conn}, size)
+		})
+	}
+}
+
+func BenchmarkSOCKS5(b *testing.B) {
+	for _, size := range benchSizes {
+		b.Run(fmt.Sprintf("%dKiB", size>>10), func(b *testing.B) {
+			quiet(b)
+			backend := newPipeListener()
+			defer backend.Close()
+			go serveChunks(backend, make([]byte, size))
+
+			server, err := socks5.New(&socks5.Config{
+				Dial:     backend.Dial,
+				Resolver: tailnetResolver{},
+				Rewriter: clientAddrRewriter{},
+				Rules:    admissionRules{},
+			})
+			if err != nil {
+				b.Fatalf("Failed to create SOCKS5 server: %v", err)
+			}
+			front := newPipeListener()
+			defer front.Close()
+			go server.Serve(front)
+
+			conn, err := front.Dial(context.Background(), "tcp", "")
+			if err != nil {
+				b.Fatalf("Failed to reach the proxy: %v", err)
+			}
+			defer conn.Close()
+
+			// No auth, then CONNECT to the domain name "data-node" port 9000
+			// (pipes are synchronous, so read each reply before writing on)
+			host := "data-node"
+			conn.Write([]byte{5, 1, 0})
+			reply := make([]byte, 10)
+			if _, err := io.ReadFull(conn, reply[:2]); err != nil {
+				b.Fatalf("SOCKS5 handshake failed: %v", err)
+			}
+			connectReq := append([]byte{5, 1, 0, 3, byte(len(host))}, host...)
+			conn.Write(append(connectReq, 0x23, 0x28))
+			if _, err := io.ReadFull(conn, reply); err != nil || reply[1] != 0 {
+				b.Fatalf("SOCKS5 handshake failed: %v %v", err, reply)
+			}
+
+			b.ReportAllocs()
+			fetchChunks(b, conn, size)
+		})
+	}
+}
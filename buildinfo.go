@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+	"strings"
+)
+
+// --- BUILD INFO ---
+
+// Set with -ldflags "-X main.commit=... -X main.buildDate=..." by release
+// builds. Without them, the commit and time recorded by go build from the
+// checkout are used.
+var (
+	commit    = ""
+	buildDate = ""
+)
+
+// tailscaleModule is the module the node comes from
+const tailscaleModule = "tailscale.com"
+
+// BuildInfo is the body of /version, what a bug report needs to name the
+// exact binary
+type BuildInfo struct {
+	SchemaVersion int    `json:"schema_version"`
+	Version       string `json:"version"`
+	Commit        string `json:"commit,omitempty"`
+	Modified      bool   `json:"modified,omitempty"` // built from a checkout with local changes
+	GoVersion     string `json:"go_version"`
+	Tailscale     string `json:"tailscale_version,omitempty"`
+	BuildDate     string `json:"build_date,omitempty"`
+	Platform      string `json:"platform"`
+}
+
+// currentBuild reads the build info embedded in the binary
+func currentBuild() BuildInfo {
+	b := BuildInfo{
+		SchemaVersion: apiSchemaVersion,
+		Version:       version,
+		Commit:        commit,
+		GoVersion:     runtime.Version(),
+		BuildDate:     buildDate,
+		Platform:      runtime.GOOS + "/" + runtime.GOARCH,
+	}
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return b
+	}
+	for _, dep := range info.Deps {
+		if dep.Path == tailscaleModule {
+			if dep.Replace != nil {
+				dep = dep.Replace
+			}
+			b.Tailscale = dep.Version
+		}
+	}
+	for _, s := range info.Settings {
+		switch s.Key {
+		case "vcs.revision":
+			if b.Commit == "" {
+				b.Commit = s.Value
+			}
+		case "vcs.time":
+			if b.BuildDate == "" {
+				b.BuildDate = s.Value
+			}
+		case "vcs.modified":
+			b.Modified = s.Value == "true"
+		}
+	}
+	return b
+}
+
+// String is the detail of the STARTING signal: the version first, so
+// parsers that only read that keep working
+func (b BuildInfo) String() string {
+	parts := []string{b.Version}
+	add := func(key, value string) {
+		if value != "" {
+			parts = append(parts, key+"="+value)
+		}
+	}
+	add("commit", shortCommit(b.Commit, b.Modified))
+	add("go", b.GoVersion)
+	add("tailscale", b.Tailscale)
+	add("built", b.BuildDate)
+	add("platform", b.Platform)
+	return strings.Join(parts, " ")
+}
+
+// shortCommit abbreviates a revision like git does, marking local changes
+func shortCommit(rev string, modified bool) string {
+	if len(rev) > 12 {
+		rev = rev[:12]
+	}
+	if rev != "" && modified {
+		rev += "-dirty"
+	}
+	return rev
+}
+
+// handleVersion serves the build info
+func handleVersion(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(currentBuild())
+}
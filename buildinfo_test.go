@@ -0,0 +1,35 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestHandleVersion(t *testing.T) {
+	rec := httptest.NewRecorder()
+	handleVersion(rec, httptest.NewRequest("GET", "/version", nil))
+	var b BuildInfo
+	if err := json.NewDecoder(rec.Body).Decode(&b); err != nil {
+		t.Fatalf("Failed to decode build info: %v", err)
+	}
+	if b.Version != version || b.GoVersion != runtime.Version() || b.Platform != runtime.GOOS+"/"+runtime.GOARCH {
+		t.Errorf("Unexpected build info %+v", b)
+	}
+	if !strings.HasPrefix(b.Tailscale, "v1.") {
+		t.Errorf("Expected the tailscale.com version, got %q", b.Tailscale)
+	}
+}
+
+func TestBuildInfoString(t *testing.T) {
+	b := BuildInfo{Version: "v0.1.0", Commit: "3f2a9c1e7b40d5a8e6f1", Modified: true, GoVersion: "go1.25.5", Platform: "linux/amd64"}
+	want := "v0.1.0 commit=3f2a9c1e7b40-dirty go=go1.25.5 platform=linux/amd64"
+	if got := b.String(); got != want {
+		t.Errorf("Expected %q, got %q", want, got)
+	}
+	if got := (BuildInfo{Version: "dev"}).String(); got != "dev" {
+		t.Errorf("Expected unknown fields to be left out, got %q", got)
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// --- SESSION CAPTURE ---
+
+// maxCapturedBody is how much of each request/response body ends up in a
+// capture; the rest is only counted.
+const maxCapturedBody = 64 << 10
+
+// Capture writes proxied exchanges for selected target hosts into one file
+// per host, for debugging protocol incompatibilities. Plain HTTP is recorded
+// in full (bodies truncated); tunnels only get byte counts and timing since
+// their payload is usually TLS.
+type Capture struct {
+	Hosts    []string // target hosts to capture, with or without port
+	Dir      string
+	MaxBytes int64 // per file; capturing stops once a file reaches it
+
+	mu    sync.Mutex
+	sizes map[string]int64
+}
+
+func newCapture(hosts []string, dir string, maxBytes int64) (*Capture, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &Capture{Hosts: hosts, Dir: dir, MaxBytes: maxBytes, sizes: make(map[string]int64)}, nil
+}
+
+// match returns the configured host that requested matches, if any
+func (c *Capture) match(requested string) (string, bool) {
+	if c == nil {
+		return "", false
+	}
+	for _, h := range c.Hosts {
+		if matchHost(h, requested) {
+			return h, true
+		}
+	}
+	return "", false
+}
+
+// write appends a record to the capture file for host, respecting MaxBytes
+func (c *Capture) write(host string, record []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	size := c.sizes[host]
+	if size >= c.MaxBytes {
+		return
+	}
+	if size+int64(len(record)) > c.MaxBytes {
+		record = append(record[:c.MaxBytes-size:c.MaxBytes-size], "\n=== capture size limit reached ===\n"...)
+	}
+
+	// Tokens in URLs and bodies are scrubbed like in the logs
+	record = []byte(secrets.redact(string(record)))
+
+	name := strings.NewReplacer(":", "_", "/", "_", "*", "_").Replace(host) + ".capture"
+	f, err := os.OpenFile(filepath.Join(c.Dir, name), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		fmt.Fprintf(console, "[CAPTURE] Failed to open capture file: %v\n", err)
+		return
+	}
+	defer f.Close()
+
+	n, _ := f.Write(record)
+	c.sizes[host] = size + int64(n)
+	if c.sizes[host] >= c.MaxBytes {
+		fmt.Fprintf(console, "[CAPTURE] %s: size limit of %d bytes reached, capture stopped\n", host, c.MaxBytes)
+	}
+}
+
+// recordTunnel notes a finished tunnel to a captured host
+func (c *Capture) recordTunnel(kind, requestID, client, target string, started time.Time, tx, rx int64) {
+	host, ok := c.match(target)
+	if !ok {
+		return
+	}
+	record := fmt.Sprintf("=== %s %s %s -> %s id=%s duration=%s tx_bytes=%d rx_bytes=%d\n\n",
+		started.UTC().Format(time.RFC3339Nano), kind, client, target, requestID, time.Since(started).Round(time.Millisecond), tx, rx)
+	c.write(host, []byte(record))
+}
+
+// capturedBody keeps the first maxCapturedBody bytes written to it and
+// counts the rest
+type capturedBody struct {
+	buf   bytes.Buffer
+	total int64
+}
+
+func (b *capturedBody) Write(p []byte) (int, error) {
+	b.total += int64(len(p))
+	if room := maxCapturedBody - b.buf.Len(); room > 0 {
+		b.buf.Write(p[:min(room, len(p))])
+	}
+	return len(p), nil
+}
+
+func (b *capturedBody) writeTo(w *bytes.Buffer, prefix string) {
+	if b.total == 0 {
+		return
+	}
+	w.WriteString(prefix + "\n")
+	w.Write(b.buf.Bytes())
+	if b.total > int64(b.buf.Len()) {
+		fmt.Fprintf(w, "\n%s... (%d bytes not captured)", prefix, b.total-int64(b.buf.Len()))
+	}
+	w.WriteString("\n")
+}
+
+// httpCapture records a single plain HTTP exchange while it is proxied
+type httpCapture struct {
+	capture *Capture
+	host    string
+	started time.Time
+	req     *http.Request
+	reqBody capturedBody
+	resBody capturedBody
+}
+
+// startHTTP begins recording r if its host is captured. It tees the request
+// body, so it must be called before r is sent upstream. Returns nil otherwise.
+func (c *Capture) startHTTP(r *http.Request) *httpCapture {
+	host, ok := c.match(r.URL.Host)
+	if !ok {
+		return nil
+	}
+	hc := &httpCapture{capture: c, host: host, started: time.Now(), req: r}
+	if r.Body != nil && r.Body != http.NoBody {
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.TeeReader(r.Body, &hc.reqBody), r.Body}
+	}
+	return hc
+}
+
+// responseBody tees the upstream response body into the capture
+func (hc *httpCapture) responseBody(body io.Reader) io.Reader {
+	if hc == nil {
+		return body
+	}
+	return io.TeeReader(body, &hc.resBody)
+}
+
+// finish writes the exchange once the response has been relayed (or failed)
+func (hc *httpCapture) finish(resp *http.Response, err error) {
+	if hc == nil {
+		return
+	}
+
+	var rec bytes.Buffer
+	fmt.Fprintf(&rec, "=== %s %s %s %s duration=%s\n",
+		hc.started.UTC().Format(time.RFC3339Nano), hc.req.RemoteAddr, hc.req.Method, hc.req.URL, time.Since(hc.started).Round(time.Millisecond))
+
+	fmt.Fprintf(&rec, "> %s %s %s\n", hc.req.Method, hc.req.URL.RequestURI(), hc.req.Proto)
+	writeCapturedHeaders(&rec, "> ", hc.req.Header)
+	hc.reqBody.writeTo(&rec, ">")
+
+	if err != nil {
+		fmt.Fprintf(&rec, "! %v\n", err)
+	} else {
+		fmt.Fprintf(&rec, "< %s %s\n", resp.Proto, resp.Status)
+		writeCapturedHeaders(&rec, "< ", resp.Header)
+		hc.resBody.writeTo(&rec, "<")
+	}
+	rec.WriteString("\n")
+
+	hc.capture.write(hc.host, rec.Bytes())
+}
+
+func writeCapturedHeaders(w *bytes.Buffer, prefix string, h http.Header) {
+	var hb bytes.Buffer
+	redactHeader(h).Write(&hb)
+	for _, line := range strings.Split(strings.TrimRight(hb.String(), "\r\n"), "\r\n") {
+		if line != "" {
+			w.WriteString(prefix + line + "\n")
+		}
+	}
+}
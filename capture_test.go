@@ -0,0 +1,90 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCaptureHTTPExchange(t *testing.T) {
+	capture, err := newCapture([]string{"core"}, t.TempDir(), 1<<20)
+	if err != nil {
+		t.Fatalf("Failed to create capture: %v", err)
+	}
+
+	mockRT := &MockRoundTripper{
+		RoundTripFunc: func(req *http.Request) (*http.Response, error) {
+			io.ReadAll(req.Body)
+			header := make(http.Header)
+			header.Set("Content-Type", "application/json")
+			return &http.Response{
+				Proto:      "HTTP/1.1",
+				Status:     "200 OK",
+				StatusCode: 200,
+				Body:       io.NopCloser(strings.NewReader(`{"data":{"me":"bob"}}`)),
+				Header:     header,
+			}, nil
+		},
+	}
+	proxy := &TailscaleProxy{Transport: mockRT, Capture: capture}
+
+	req := httptest.NewRequest("POST", "http://core:8080/graphql", strings.NewReader(`{"query":"{ me }"}`))
+	req.Header.Set("X-Test", "1")
+	proxy.handleHTTP(httptest.NewRecorder(), req)
+
+	// Uncaptured hosts leave no trace
+	proxy.handleHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "http://minio:9000/", nil))
+
+	data, err := os.ReadFile(filepath.Join(capture.Dir, "core.capture"))
+	if err != nil {
+		t.Fatalf("Failed to read capture file: %v", err)
+	}
+	for _, want := range []string{
+		"> POST /graphql HTTP/1.1",
+		"> X-Test: 1",
+		`{"query":"{ me }"}`,
+		"< HTTP/1.1 200 OK",
+		"< Content-Type: application/json",
+		`{"data":{"me":"bob"}}`,
+	} {
+		if !strings.Contains(string(data), want) {
+			t.Errorf("Expected capture to contain %q, got:\n%s", want, data)
+		}
+	}
+
+	files, _ := os.ReadDir(capture.Dir)
+	if len(files) != 1 {
+		t.Errorf("Expected a single capture file, got %d", len(files))
+	}
+}
+
+func TestCaptureTunnelAndSizeLimit(t *testing.T) {
+	capture, err := newCapture([]string{"data-node:443"}, t.TempDir(), 200)
+	if err != nil {
+		t.Fatalf("Failed to create capture: %v", err)
+	}
+
+	for i := 0; i < 5; i++ {
+		capture.recordTunnel("connect", "a1b2", "127.0.0.1:5000", "data-node:443", time.Now(), 100, 2000)
+	}
+	capture.recordTunnel("connect", "a1b2", "127.0.0.1:5000", "data-node:8443", time.Now(), 1, 1)
+
+	data, err := os.ReadFile(filepath.Join(capture.Dir, "data-node_443.capture"))
+	if err != nil {
+		t.Fatalf("Failed to read capture file: %v", err)
+	}
+	if !strings.Contains(string(data), "tx_bytes=100 rx_bytes=2000") {
+		t.Errorf("Expected tunnel byte counts in capture, got:\n%s", data)
+	}
+	if !strings.Contains(string(data), "capture size limit reached") {
+		t.Errorf("Expected size limit marker, got:\n%s", data)
+	}
+	if int64(len(data)) > capture.MaxBytes+64 {
+		t.Errorf("Expected capture to stay near %d bytes, got %d", capture.MaxBytes, len(data))
+	}
+}
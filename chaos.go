@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// --- CHAOS MODE ---
+
+// minRetransmit is how long a "lost" write stalls at least, like a TCP
+// retransmission timeout
+const minRetransmit = 200 * time.Millisecond
+
+// maxResetAfter bounds how many bytes a connection picked for a reset
+// transfers before it is cut
+const maxResetAfter = 1 << 20
+
+// errChaosReset is what a connection fails with when chaos mode cuts it
+var errChaosReset = errors.New("chaos: connection reset")
+
+// ChaosConfig describes the faults injected into tailnet connections, so
+// client developers can test their retry logic against a bad network locally
+type ChaosConfig struct {
+	Latency   time.Duration // added to every dial and every write
+	Bandwidth int64         // bytes per second in each direction, 0 = unlimited
+	Fail      float64       // share of dials that fail (0-1)
+	Reset     float64       // share of connections reset mid-stream (0-1)
+	Loss      float64       // share of writes that stall like a retransmission (0-1)
+}
+
+// parseChaos parses a -chaos spec such as
+// "latency=200ms,loss=1%,bandwidth=10mbps,fail=5%,reset=1%"
+func parseChaos(spec string) (ChaosConfig, error) {
+	var cfg ChaosConfig
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(part, "=")
+		if !ok {
+			return cfg, fmt.Errorf("invalid chaos setting %q (want key=value)", part)
+		}
+		var err error
+		switch key {
+		case "latency":
+			cfg.Latency, err = time.ParseDuration(value)
+		case "bandwidth":
+			cfg.Bandwidth, err = parseBandwidth(value)
+		case "fail":
+			cfg.Fail, err = parseShare(value)
+		case "reset":
+			cfg.Reset, err = parseShare(value)
+		case "loss":
+			cfg.Loss, err = parseShare(value)
+		default:
+			return cfg, fmt.Errorf("unknown chaos setting %q (use latency, bandwidth, fail, reset or loss)", key)
+		}
+		if err != nil {
+			return cfg, fmt.Errorf("invalid chaos setting %q: %w", part, err)
+		}
+	}
+	return cfg, nil
+}
+
+// parseShare accepts "5%" or a fraction like "0.05"
+func parseShare(value string) (float64, error) {
+	percent := strings.HasSuffix(value, "%")
+	f, err := strconv.ParseFloat(strings.TrimSuffix(value, "%"), 64)
+	if err != nil {
+		return 0, err
+	}
+	if percent {
+		f /= 100
+	}
+	if f < 0 || f > 1 {
+		return 0, fmt.Errorf("must be between 0%% and 100%%")
+	}
+	return f, nil
+}
+
+// parseBandwidth accepts bits per second with a bps, kbps, mbps or gbps
+// suffix and returns bytes per second
+func parseBandwidth(value string) (int64, error) {
+	v := strings.ToLower(value)
+	mult := 1.0
+	for _, unit := range []struct {
+		suffix string
+		mult   float64
+	}{{"gbps", 1e9}, {"mbps", 1e6}, {"kbps", 1e3}, {"bps", 1}} {
+		if strings.HasSuffix(v, unit.suffix) {
+			v, mult = strings.TrimSuffix(v, unit.suffix), unit.mult
+			break
+		}
+	}
+	if v == strings.ToLower(value) {
+		return 0, fmt.Errorf("missing unit (bps, kbps, mbps or gbps)")
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil || f <= 0 {
+		return 0, fmt.Errorf("must be a positive rate")
+	}
+	return max(int64(f*mult/8), 1), nil
+}
+
+func (c ChaosConfig) String() string {
+	return fmt.Sprintf("latency=%s bandwidth=%dB/s fail=%g%% reset=%g%% loss=%g%%",
+		c.Latency, c.Bandwidth, c.Fail*100, c.Reset*100, c.Loss*100)
+}
+
+// chaosDialer injects the configured faults into every connection it dials
+type chaosDialer struct {
+	Base   Dialer
+	Config ChaosConfig
+	rand   func() float64 // rand.Float64 outside of tests
+}
+
+func (d *chaosDialer) chance() float64 {
+	if d.rand != nil {
+		return d.rand()
+	}
+	return rand.Float64()
+}
+
+func (d *chaosDialer) Dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	if d.Config.Latency > 0 {
+		select {
+		case <-time.After(d.Config.Latency):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	if d.Config.Fail > 0 && d.chance() < d.Config.Fail {
+		fmt.Fprintf(console, "[CHAOS] Failing dial to %s\n", addr)
+		return nil, fmt.Errorf("chaos: dial %s failed", addr)
+	}
+	conn, err := d.Base.Dial(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	cc := &chaosConn{Conn: conn, dialer: d, resetAfter: -1}
+	if d.Config.Reset > 0 && d.chance() < d.Config.Reset {
+		cc.resetAfter = int64(d.chance() * maxResetAfter)
+		fmt.Fprintf(console, "[CHAOS] Will reset %s after %d bytes\n", addr, cc.resetAfter)
+	}
+	return cc, nil
+}
+
+// chaosConn delays, throttles and eventually cuts a connection
+type chaosConn struct {
+	net.Conn
+	dialer *chaosDialer
+
+	mu         sync.Mutex
+	resetAfter int64 // bytes left before the reset, -1 if never
+	reset      bool
+}
+
+// consume counts n transferred bytes and reports whether the connection
+// has to be reset now
+func (c *chaosConn) consume(n int) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.reset {
+		return true
+	}
+	if c.resetAfter < 0 {
+		return false
+	}
+	c.resetAfter -= int64(n)
+	if c.resetAfter <= 0 {
+		c.reset = true
+		c.Conn.Close()
+		return true
+	}
+	return false
+}
+
+// throttle sleeps long enough for n bytes to respect the bandwidth cap
+func (c *chaosConn) throttle(n int) {
+	if bw := c.dialer.Config.Bandwidth; bw > 0 && n > 0 {
+		time.Sleep(time.Duration(int64(n) * int64(time.Second) / bw))
+	}
+}
+
+func (c *chaosConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.throttle(n)
+	if c.consume(n) {
+		return n, errChaosReset
+	}
+	return n, err
+}
+
+func (c *chaosConn) Write(b []byte) (int, error) {
+	cfg := c.dialer.Config
+	delay := cfg.Latency
+	if cfg.Loss > 0 && c.dialer.chance() < cfg.Loss {
+		delay += max(minRetransmit, 2*cfg.Latency)
+	}
+	time.Sleep(delay)
+	c.throttle(len(b))
+	if c.consume(len(b)) {
+		return 0, errChaosReset
+	}
+	return c.Conn.Write(b)
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseChaos(t *testing.T) {
+	cfg, err := parseChaos("latency=200ms, loss=1%,bandwidth=8mbps,fail=0.05,reset=10%")
+	if err != nil {
+		t.Fatalf("parseChaos failed: %v", err)
+	}
+	want := ChaosConfig{Latency: 200 * time.Millisecond, Loss: 0.01, Bandwidth: 1e6, Fail: 0.05, Reset: 0.1}
+	if cfg != want {
+		t.Errorf("Expected %+v, got %+v", want, cfg)
+	}
+
+	for _, spec := range []string{"latency", "latency=fast", "loss=150%", "bandwidth=10", "bandwidth=-1mbps", "jitter=5ms"} {
+		if _, err := parseChaos(spec); err == nil {
+			t.Errorf("Expected %q to be rejected", spec)
+		}
+	}
+}
+
+func TestChaosDialFailures(t *testing.T) {
+	base := &MockDialer{DialFunc: func(ctx context.Context, network, addr string) (net.Conn, error) {
+		c, _ := net.Pipe()
+		return c, nil
+	}}
+	roll := 0.5
+	d := &chaosDialer{Base: base, Config: ChaosConfig{Fail: 0.3}, rand: func() float64 { return roll }}
+
+	if _, err := d.Dial(context.Background(), "tcp", "data-node:80"); err != nil {
+		t.Errorf("Expected a roll above the failure share to dial, got %v", err)
+	}
+	roll = 0.1
+	if _, err := d.Dial(context.Background(), "tcp", "data-node:80"); err == nil || !strings.Contains(err.Error(), "chaos") {
+		t.Errorf("Expected an injected dial failure, got %v", err)
+	}
+}
+
+func TestChaosResetMidStream(t *testing.T) {
+	client, server := net.Pipe()
+	go io.Copy(io.Discard, server)
+	base := &MockDialer{DialFunc: func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return client, nil
+	}}
+	// Every connection is reset, after 0.001 * maxResetAfter bytes
+	d := &chaosDialer{Base: base, Config: ChaosConfig{Reset: 1}, rand: func() float64 { return 0.001 }}
+
+	conn, err := d.Dial(context.Background(), "tcp", "data-node:80")
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	chunk := make([]byte, 256)
+	var sent int
+	for sent < maxResetAfter {
+		if _, err = conn.Write(chunk); err != nil {
+			break
+		}
+		sent += len(chunk)
+	}
+	if !errors.Is(err, errChaosReset) {
+		t.Fatalf("Expected a chaos reset, got %v", err)
+	}
+	if limit := maxResetAfter / 1000; sent > limit+len(chunk) {
+		t.Errorf("Expected the reset after about %d bytes, got %d", limit, sent)
+	}
+}
+
+func TestChaosBandwidthAndLatency(t *testing.T) {
+	client, server := net.Pipe()
+	go io.Copy(io.Discard, server)
+	base := &MockDialer{DialFunc: func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return client, nil
+	}}
+	// 80 kbps = 10 KB/s, so 2 KB take about 200ms, plus 50ms for dial and write each
+	d := &chaosDialer{Base: base, Config: ChaosConfig{Latency: 50 * time.Millisecond, Bandwidth: 10000}}
+
+	start := time.Now()
+	conn, err := d.Dial(context.Background(), "tcp", "data-node:80")
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	conn.Write(make([]byte, 2000))
+	if elapsed := time.Since(start); elapsed < 290*time.Millisecond {
+		t.Errorf("Expected latency and throttling to take about 300ms, took %v", elapsed)
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// --- CLOCK SKEW ---
+
+// maxClockSkew is how far the local clock may be off before TLS and Noise
+// handshakes with control start failing in confusing ways
+const maxClockSkew = time.Minute
+
+// clockCheckInterval is how often a running sidecar compares clocks again.
+// Lab machines that sleep or lose NTP drift while the sidecar runs.
+const clockCheckInterval = time.Hour
+
+// clockOffset measures how far the local clock is ahead of the server's
+// (negative if behind), from the Date header of a request to base. Date
+// has a resolution of one second.
+func clockOffset(ctx context.Context, base string) (time.Duration, error) {
+	req, err := http.NewRequestWithContext(ctx, "HEAD", strings.TrimSuffix(base, "/")+"/key", nil)
+	if err != nil {
+		return 0, err
+	}
+	start := time.Now()
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	rtt := time.Since(start)
+	date, err := http.ParseTime(resp.Header.Get("Date"))
+	if err != nil {
+		return 0, fmt.Errorf("no Date header")
+	}
+	// The server stamped the reply around the middle of the round trip
+	local := start.Add(rtt / 2)
+	return local.Sub(date), nil
+}
+
+// clockMonitor compares the local clock with control's and warns the
+// parent with @@SIDECAR:CLOCK_SKEW@@ when it is too far off
+type clockMonitor struct {
+	server string
+	offset atomic.Int64 // last measured offset in nanoseconds
+	skewed atomic.Bool  // last measurement was beyond maxClockSkew
+}
+
+// clock is set while the node starts; nil disables the hint on Up failures
+var clock *clockMonitor
+
+// run checks right away and then every clockCheckInterval until ctx ends
+func (m *clockMonitor) run(ctx context.Context) {
+	ticker := time.NewTicker(clockCheckInterval)
+	defer ticker.Stop()
+	for {
+		checkCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+		m.check(checkCtx)
+		cancel()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// check measures once and signals when the clock went off, or when it is
+// still off by a different amount. Failed measurements change nothing.
+func (m *clockMonitor) check(ctx context.Context) {
+	offset, err := clockOffset(ctx, m.server)
+	if err != nil {
+		return
+	}
+	previous := time.Duration(m.offset.Swap(int64(offset)))
+	skewed := offset.Abs() > maxClockSkew
+	wasSkewed := m.skewed.Swap(skewed)
+	switch {
+	case skewed && (!wasSkewed || (offset-previous).Abs() > maxClockSkew):
+		fmt.Fprintf(console, "!!! [CLOCK] %s; TLS and Noise handshakes with control may fail. Fix the system time (NTP)\n", describeOffset(offset))
+		signal(SignalClockSkew, fmt.Sprintf("offset=%s server=%s", offset.Round(time.Second), m.server))
+	case !skewed && wasSkewed:
+		fmt.Fprintf(console, ">>> [CLOCK] Local clock is back within %s of control\n", maxClockSkew)
+	}
+}
+
+// upFailureHint points at the clock if it was off when the node started
+func (m *clockMonitor) upFailureHint() string {
+	if m == nil || !m.skewed.Load() {
+		return ""
+	}
+	return describeOffset(time.Duration(m.offset.Load())) + ", which breaks the handshake with control; fix the system time"
+}
+
+// describeOffset says which way the local clock is off
+func describeOffset(offset time.Duration) string {
+	if offset < 0 {
+		return fmt.Sprintf("local clock is %s behind control", (-offset).Round(time.Second))
+	}
+	return fmt.Sprintf("local clock is %s ahead of control", offset.Round(time.Second))
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestClockOffset(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Date", time.Now().Add(-10*time.Minute).UTC().Format(http.TimeFormat))
+	}))
+	defer server.Close()
+
+	offset, err := clockOffset(context.Background(), server.URL)
+	if err != nil || offset < 9*time.Minute || offset > 11*time.Minute {
+		t.Errorf("Expected to be 10m ahead, got %s, %v", offset, err)
+	}
+	if c := checkClock(context.Background(), server.URL); c.Status != checkFail || c.Code != CodeClockSkew {
+		t.Errorf("Expected the clock check to fail, got %+v", c)
+	}
+}
+
+func TestClockMonitor(t *testing.T) {
+	var serverAhead atomic.Int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Date", time.Now().Add(time.Duration(serverAhead.Load())).UTC().Format(http.TimeFormat))
+	}))
+	defer server.Close()
+	m := &clockMonitor{server: server.URL}
+	check := func(ahead time.Duration) string {
+		serverAhead.Store(int64(ahead))
+		return captureStdout(t, func() { m.check(context.Background()) })
+	}
+
+	if out := check(0); strings.Contains(out, SignalClockSkew) || m.upFailureHint() != "" {
+		t.Errorf("Expected no warning with a good clock, got %q", out)
+	}
+	out := check(5 * time.Minute)
+	// Date has a resolution of one second
+	if !strings.Contains(out, SignalClockSkew+" offset=-") || !strings.Contains(out, "s server="+server.URL) {
+		t.Errorf("Expected a skew warning, got %q", out)
+	}
+	if hint := m.upFailureHint(); !strings.Contains(hint, "behind control") {
+		t.Errorf("Expected a hint for Up failures, got %q", hint)
+	}
+	if out := check(5 * time.Minute); strings.Contains(out, SignalClockSkew) {
+		t.Errorf("Expected the same skew to be reported once, got %q", out)
+	}
+	if out := check(-10 * time.Minute); !strings.Contains(out, SignalClockSkew) {
+		t.Errorf("Expected a changed skew to be reported again, got %q", out)
+	}
+	if out := check(0); !strings.Contains(out, "back within") || m.upFailureHint() != "" {
+		t.Errorf("Expected the recovery to be logged, got %q", out)
+	}
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// --- COMPRESSED TUNNELS ---
+
+// compressPort is the well-known tailnet port sidecars accept compressed
+// tunnels on
+const compressPort = "9905"
+
+// compressHello opens a tunnel: "SIDECAR-ZSTD/1 <port>\n". The serving
+// sidecar answers "OK\n" or "ERR <reason>\n" before any data flows.
+const compressHello = "SIDECAR-ZSTD/1"
+
+// CompressZstd is the only ForwardRule.Compress value so far
+const CompressZstd = "zstd"
+
+const (
+	compressWindow    = 1 << 20 // encoder window, bounds memory per tunnel
+	compressMaxWindow = 8 << 20 // largest window a peer may make us decode with
+	compressTimeout   = 10 * time.Second
+)
+
+// CompressionStats is one row of /stats/compression: a forward, or the
+// tunnels other sidecars opened to this one ("inbound")
+type CompressionStats struct {
+	Name        string  `json:"name"`
+	Connections int64   `json:"connections"` // compressed tunnels
+	Fallbacks   int64   `json:"fallbacks"`   // plain connections to peers without compressed tunnels
+	RawBytes    int64   `json:"raw_bytes"`   // application data, both directions
+	WireBytes   int64   `json:"wire_bytes"`  // what crossed the tailnet for it
+	Ratio       float64 `json:"ratio"`       // raw_bytes / wire_bytes
+}
+
+type compressCounters struct {
+	conns, fallbacks atomic.Int64
+	raw, wire        trafficCounter
+}
+
+// compressionStats collects the counters per forward
+type compressionStats struct {
+	mu      sync.Mutex
+	entries map[string]*compressCounters
+}
+
+// compression is nil unless a forward compresses or -zstd-server is set
+var compression *compressionStats
+
+func newCompressionStats() *compressionStats {
+	return &compressionStats{entries: map[string]*compressCounters{}}
+}
+
+func (s *compressionStats) counters(name string) *compressCounters {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, ok := s.entries[name]
+	if !ok {
+		c = &compressCounters{}
+		s.entries[name] = c
+	}
+	return c
+}
+
+// stats returns the counters ordered by name
+func (s *compressionStats) stats() []CompressionStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := make([]CompressionStats, 0, len(s.entries))
+	for name, c := range s.entries {
+		st := CompressionStats{
+			Name:        name,
+			Connections: c.conns.Load(),
+			Fallbacks:   c.fallbacks.Load(),
+			RawBytes:    c.raw.rx.Load() + c.raw.tx.Load(),
+			WireBytes:   c.wire.rx.Load() + c.wire.tx.Load(),
+		}
+		if st.WireBytes > 0 {
+			st.Ratio = float64(st.RawBytes) / float64(st.WireBytes)
+		}
+		list = append(list, st)
+	}
+	slices.SortFunc(list, func(a, b CompressionStats) int { return strings.Compare(a.Name, b.Name) })
+	return list
+}
+
+// zstdDialer asks the sidecar on the target node for a compressed tunnel to
+// the target port and dials the target directly when that node doesn't
+// offer one.
+type zstdDialer struct {
+	Base     Dialer
+	resolve  func(addr string) (string, error) // service references, nil without a router
+	counters *compressCounters
+}
+
+func (d *zstdDialer) Dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	target := addr
+	if d.resolve != nil {
+		resolved, err := d.resolve(addr)
+		if err != nil {
+			return nil, err
+		}
+		target = resolved
+	}
+	if host, port, err := net.SplitHostPort(target); err == nil {
+		conn, err := d.Base.Dial(ctx, network, net.JoinHostPort(host, compressPort))
+		if err == nil {
+			zc, err := openCompressed(conn, port, d.counters)
+			if err == nil {
+				d.counters.conns.Add(1)
+				return zc, nil
+			}
+			conn.Close()
+			fmt.Fprintf(console, "[ZSTD] %s: no compressed tunnel (%v), connecting directly\n", target, err)
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+	}
+	d.counters.fallbacks.Add(1)
+	return d.Base.Dial(ctx, network, target)
+}
+
+// openCompressed runs the client side of the handshake on conn
+func openCompressed(conn net.Conn, port string, counters *compressCounters) (net.Conn, error) {
+	conn.SetDeadline(time.Now().Add(compressTimeout))
+	if _, err := fmt.Fprintf(conn, "%s %s\n", compressHello, port); err != nil {
+		return nil, err
+	}
+	br := bufio.NewReader(conn)
+	line, err := br.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if line = strings.TrimSpace(line); line != "OK" {
+		return nil, errors.New(strings.TrimPrefix(line, "ERR "))
+	}
+	conn.SetDeadline(time.Time{})
+	return newZstdConn(conn, br, counters)
+}
+
+// zstdConn compresses what is written to it and decompresses what is read.
+// Every Write is flushed as a block, so interactive protocols don't stall.
+type zstdConn struct {
+	net.Conn
+	enc      *zstd.Encoder
+	dec      *zstd.Decoder
+	counters *compressCounters
+
+	mu     sync.Mutex // serializes the encoder between Write and Close
+	closed sync.Once
+}
+
+// newZstdConn wraps conn; br reads from conn and may hold buffered bytes
+func newZstdConn(conn net.Conn, br *bufio.Reader, counters *compressCounters) (*zstdConn, error) {
+	wire := &countingConn{Conn: conn, counter: &counters.wire}
+	r := io.TeeReader(br, countingWriter{&counters.wire.rx})
+	enc, err := zstd.NewWriter(wire, zstd.WithEncoderConcurrency(1), zstd.WithWindowSize(compressWindow))
+	if err != nil {
+		return nil, err
+	}
+	// A synchronous decoder returns each flushed block as soon as it arrives
+	dec, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1), zstd.WithDecoderLowmem(true), zstd.WithDecoderMaxWindow(compressMaxWindow))
+	if err != nil {
+		return nil, err
+	}
+	return &zstdConn{Conn: conn, enc: enc, dec: dec, counters: counters}, nil
+}
+
+func (c *zstdConn) Read(b []byte) (int, error) {
+	n, err := c.dec.Read(b)
+	c.counters.raw.rx.Add(int64(n))
+	if errors.Is(err, io.ErrUnexpectedEOF) {
+		// The peer closed without ending the frame; every block it wrote
+		// was flushed, so nothing is missing
+		err = io.EOF
+	}
+	return n, err
+}
+
+func (c *zstdConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n, err := c.enc.Write(b)
+	if err == nil {
+		err = c.enc.Flush()
+	}
+	c.counters.raw.tx.Add(int64(n))
+	return n, err
+}
+
+// Close ends the frame when no Write is in flight, then the connection.
+// Synchronous decoders hold no goroutines, so the decoder is left to the GC.
+func (c *zstdConn) Close() error {
+	c.closed.Do(func() {
+		if c.mu.TryLock() {
+			c.enc.Close()
+			c.mu.Unlock()
+		}
+	})
+	return c.Conn.Close()
+}
+
+// NetConn returns the tailnet connection, like tls.Conn does
+func (c *zstdConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// serveCompressed accepts tunnels from other sidecars and pipes them to the
+// announced services on this host's loopback interface
+func serveCompressed(ln net.Listener, ports []int, counters *compressCounters) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			local, zc, err := acceptCompressed(conn, ports, counters)
+			if err != nil {
+				fmt.Fprintf(console, "[ZSTD] Refusing %s: %v\n", conn.RemoteAddr(), err)
+				fmt.Fprintf(conn, "ERR %v\n", err)
+				return
+			}
+			defer local.Close()
+			defer zc.Close()
+			counters.conns.Add(1)
+
+			fmt.Fprintf(console, "[ZSTD] %s -> %s\n", conn.RemoteAddr(), local.RemoteAddr())
+			go io.Copy(local, zc)
+			io.Copy(zc, local)
+		}()
+	}
+}
+
+// acceptCompressed reads the handshake and dials the requested service
+func acceptCompressed(conn net.Conn, ports []int, counters *compressCounters) (net.Conn, *zstdConn, error) {
+	conn.SetDeadline(time.Now().Add(compressTimeout))
+	br := bufio.NewReaderSize(conn, 4096)
+	line, err := br.ReadString('\n')
+	if err != nil {
+		return nil, nil, err
+	}
+	proto, portStr, _ := strings.Cut(strings.TrimSpace(line), " ")
+	if proto != compressHello {
+		return nil, nil, fmt.Errorf("unsupported tunnel %q", proto)
+	}
+	local, err := dialAnnounced(context.Background(), ports, portStr)
+	if err != nil {
+		return nil, nil, err
+	}
+	if _, err := io.WriteString(conn, "OK\n"); err != nil {
+		local.Close()
+		return nil, nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	zc, err := newZstdConn(conn, br, counters)
+	if err != nil {
+		local.Close()
+		return nil, nil, err
+	}
+	return local, zc, nil
+}
+
+// handleCompressionStats serves the compression counters on the status API
+func handleCompressionStats(w http.ResponseWriter, r *http.Request) {
+	if compression == nil {
+		http.Error(w, "no compressed forwards and no -zstd-server", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(compression.stats())
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+)
+
+// startEcho serves an echo service on loopback and returns its port
+func startEcho(t *testing.T) int {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return ln.Addr().(*net.TCPAddr).Port
+}
+
+func TestCompressedTunnel(t *testing.T) {
+	echoPort := startEcho(t)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer ln.Close()
+	stats := newCompressionStats()
+	go serveCompressed(ln, []int{echoPort}, stats.counters("inbound"))
+
+	// The "tailnet" sends the compression port to the serving sidecar
+	var dialed []string
+	base := &MockDialer{DialFunc: func(ctx context.Context, network, addr string) (net.Conn, error) {
+		dialed = append(dialed, addr)
+		_, port, _ := net.SplitHostPort(addr)
+		if port == compressPort {
+			return net.Dial("tcp", ln.Addr().String())
+		}
+		return net.Dial("tcp", net.JoinHostPort("127.0.0.1", port))
+	}}
+	d := &zstdDialer{Base: base, counters: stats.counters("127.0.0.1:9000")}
+
+	conn, err := d.Dial(context.Background(), "tcp", "data-node:"+strconv.Itoa(echoPort))
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	if _, ok := conn.(*zstdConn); !ok {
+		t.Fatalf("Expected a compressed tunnel, got %T (dialed %v)", conn, dialed)
+	}
+	csv := bytes.Repeat([]byte("timepoint,channel,x,y,intensity\n0,488,12,40,1031\n"), 2000)
+	go conn.Write(csv)
+	got := make([]byte, len(csv))
+	if _, err := io.ReadFull(conn, got); err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	conn.Close()
+	if !bytes.Equal(got, csv) {
+		t.Fatal("Echoed data differs from what was sent")
+	}
+
+	for _, st := range stats.stats() {
+		if st.Connections != 1 || st.Fallbacks != 0 {
+			t.Errorf("%s: expected 1 compressed connection, got %+v", st.Name, st)
+		}
+		if st.Name == "127.0.0.1:9000" && (st.RawBytes != int64(2*len(csv)) || st.Ratio < 10) {
+			t.Errorf("Expected CSV to compress well, got %+v", st)
+		}
+	}
+
+	// Ports that aren't announced are refused, and the forward dials directly
+	other := startEcho(t)
+	conn, err = d.Dial(context.Background(), "tcp", "data-node:"+strconv.Itoa(other))
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer conn.Close()
+	if _, ok := conn.(*zstdConn); ok {
+		t.Error("Expected a plain connection to an unannounced port")
+	}
+	if st := stats.stats()[0]; st.Fallbacks != 1 {
+		t.Errorf("Expected the fallback to be counted, got %+v", st)
+	}
+}
+
+func TestCompressedTunnelWithoutSidecar(t *testing.T) {
+	plain, _ := net.Pipe()
+	base := &MockDialer{DialFunc: func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if _, port, _ := net.SplitHostPort(addr); port == compressPort {
+			return nil, errors.New("connection refused")
+		}
+		return plain, nil
+	}}
+	counters := &compressCounters{}
+	d := &zstdDialer{Base: base, counters: counters}
+	conn, err := d.Dial(context.Background(), "tcp", "postgres-node:5432")
+	if err != nil || conn != plain {
+		t.Fatalf("Expected the direct connection, got %v, %v", conn, err)
+	}
+	if counters.fallbacks.Load() != 1 || counters.conns.Load() != 0 {
+		t.Errorf("Expected one fallback, got %d fallbacks and %d tunnels", counters.fallbacks.Load(), counters.conns.Load())
+	}
+}
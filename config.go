@@ -0,0 +1,160 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// --- CONFIG FILE ---
+
+// Config holds the rules that don't fit on a command line. It is loaded from
+// the JSON file given with -config; everything in it is optional.
+type Config struct {
+	Mirrors  []MirrorRule          `json:"mirrors,omitempty"`
+	Forwards []ForwardRule         `json:"forwards,omitempty"`
+	Routes   []RouteRule           `json:"routes,omitempty"`
+	Announce []ServiceAnnouncement `json:"announce,omitempty"`
+	Services map[string]string     `json:"services,omitempty"` // name -> tailnet host:port
+
+	RemoteExec *RemoteExecConfig `json:"remote_exec,omitempty"` // commands peers may run here
+	Share      *ShareConfig      `json:"share,omitempty"`       // who may send snippets here
+	Users      *UsersConfig      `json:"users,omitempty"`       // local accounts allowed to use the proxies (Linux)
+	Redact     []string          `json:"redact,omitempty"`      // extra regular expressions scrubbed from logs
+
+	ServiceToken *ServiceTokenConfig    `json:"service_token,omitempty"` // credentials attached to requests for Arkitekt core
+	GraphQL      []GraphQLRule          `json:"graphql,omitempty"`       // persisted queries and retries per GraphQL endpoint
+	S3           []S3Profile            `json:"s3,omitempty"`            // tuning for S3-compatible endpoints (MinIO)
+	Prewarm      *PrewarmConfig         `json:"prewarm,omitempty"`       // ready connections to the busiest destinations
+	Queue        []QueueRule            `json:"queue,omitempty"`         // uploads kept while their host is unreachable
+	Events       []SinkConfig           `json:"events,omitempty"`        // where signals go; stdout if empty
+	Alerts       *AlertsConfig          `json:"alerts,omitempty"`        // conditions that fire ALERT signals
+	Policies     map[string]ProxyPolicy `json:"policies,omitempty"`      // sessions selected by SOCKS5 user name
+	SNI          []SNIRule              `json:"sni,omitempty"`           // TLS server names and their targets in -mode sni
+	Expose       []ExposeRule           `json:"expose,omitempty"`        // local services published on the tailnet
+}
+
+// loadConfig reads and validates a JSON config file against its schema,
+// after expanding ${VARIABLES} from the environment. Unknown fields are
+// rejected so typos don't silently disable a rule.
+func loadConfig(path, profile string) (*Config, error) {
+	doc, err := readConfigDoc(path, os.LookupEnv, nil)
+	if err != nil {
+		var pathErr *os.PathError
+		if errors.As(err, &pathErr) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+	if err := applyProfile(doc, profile); err != nil {
+		return nil, fmt.Errorf("invalid config %s: %w", path, err)
+	}
+
+	var cfg Config
+	if err := decodeDoc(doc, &cfg); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+	if err := cfg.validate(); err != nil {
+		return nil, fmt.Errorf("invalid config %s: %w", path, err)
+	}
+	return &cfg, nil
+}
+
+func (c *Config) validate() error {
+	for i, m := range c.Mirrors {
+		if m.Host == "" || m.Target == "" {
+			return fmt.Errorf("mirrors[%d]: host and target are required", i)
+		}
+		if m.Percent <= 0 || m.Percent > 100 {
+			return fmt.Errorf("mirrors[%d]: percent must be in (0, 100], got %v", i, m.Percent)
+		}
+	}
+	for i, f := range c.Forwards {
+		if err := f.validate(); err != nil {
+			return fmt.Errorf("forwards[%d]: %w", i, err)
+		}
+	}
+	for i, r := range c.Routes {
+		if err := r.validate(); err != nil {
+			return fmt.Errorf("routes[%d]: %w", i, err)
+		}
+	}
+	for name, target := range c.Services {
+		if name == "" || strings.ContainsAny(name, ":/ ") || name != strings.ToLower(name) {
+			return fmt.Errorf("services: invalid name %q (lowercase, no ':', '/' or spaces)", name)
+		}
+		if _, _, err := net.SplitHostPort(target); err != nil {
+			return fmt.Errorf("services.%s: target must be host:port, got %q", name, target)
+		}
+	}
+	if c.RemoteExec != nil {
+		if err := c.RemoteExec.validate(); err != nil {
+			return err
+		}
+	}
+	if c.Share != nil {
+		if err := c.Share.validate(); err != nil {
+			return err
+		}
+	}
+	for i, expr := range c.Redact {
+		if _, err := regexp.Compile(expr); err != nil {
+			return fmt.Errorf("redact[%d]: %w", i, err)
+		}
+	}
+	if c.Users != nil {
+		if err := c.Users.validate(); err != nil {
+			return err
+		}
+	}
+	for i, g := range c.GraphQL {
+		if err := g.validate(); err != nil {
+			return fmt.Errorf("graphql[%d]: %w", i, err)
+		}
+	}
+	for i, p := range c.S3 {
+		if err := p.validate(); err != nil {
+			return fmt.Errorf("s3[%d]: %w", i, err)
+		}
+	}
+	if c.ServiceToken != nil {
+		if err := c.ServiceToken.validate(); err != nil {
+			return err
+		}
+	}
+	if c.Prewarm != nil {
+		if err := c.Prewarm.validate(); err != nil {
+			return err
+		}
+	}
+	for i, q := range c.Queue {
+		if err := q.validate(); err != nil {
+			return fmt.Errorf("queue[%d]: %w", i, err)
+		}
+	}
+	for i, e := range c.Events {
+		if err := e.validate(); err != nil {
+			return fmt.Errorf("events[%d]: %w", i, err)
+		}
+	}
+	for i, r := range c.SNI {
+		if err := r.validate(); err != nil {
+			return fmt.Errorf("sni[%d]: %w", i, err)
+		}
+	}
+	if err := validateExpose(c.Expose); err != nil {
+		return err
+	}
+	if err := validatePolicies(c.Policies); err != nil {
+		return err
+	}
+	if c.Alerts != nil {
+		if err := c.Alerts.validate(); err != nil {
+			return err
+		}
+	}
+	return validateAnnouncements(c.Announce)
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeTestConfig writes content to a config file in a temp dir
+func writeTestConfig(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "sidecar.json")
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatalf("Failed to write config: %v", err)
+	}
+	return path
+}
+
+func TestLoadConfig(t *testing.T) {
+	path := writeTestConfig(t, `{
+		"mirrors": [
+			{"host": "arkitekt-core", "target": "arkitekt-core-next", "percent": 10}
+		]
+	}`)
+
+	cfg, err := loadConfig(path, "")
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+	if len(cfg.Mirrors) != 1 {
+		t.Fatalf("Expected 1 mirror, got %d", len(cfg.Mirrors))
+	}
+	if cfg.Mirrors[0].Target != "arkitekt-core-next" || cfg.Mirrors[0].Percent != 10 {
+		t.Errorf("Unexpected mirror rule: %+v", cfg.Mirrors[0])
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		wantErr string
+	}{
+		{"unknown field", `{"mirrorz": []}`, "unknown field"},
+		{"missing target", `{"mirrors": [{"host": "a", "percent": 5}]}`, "mirrors[0]"},
+		{"percent too high", `{"mirrors": [{"host": "a", "target": "b", "percent": 150}]}`, "percent"},
+		{"not json", `mirrors: []`, "failed to parse"},
+		{"forward without listen", `{"forwards": [{"targets": ["w1:80"]}]}`, "forwards[0]: listen"},
+		{"unknown compression", `{"forwards": [{"listen": "9000", "targets": ["w1:80"], "compress": "gzip"}]}`, "forwards[0]: unknown compression"},
+		{"compressed and multiplexed", `{"forwards": [{"listen": "9000", "targets": ["w1:80"], "compress": "zstd", "multiplex": true}]}`, "can't be combined"},
+		{"negative prewarm", `{"prewarm": {"connections": -1}}`, "prewarm: "},
+		{"prewarm max_idle", `{"prewarm": {"max_idle": "soon"}}`, "prewarm.max_idle"},
+		{"route without targets", `{"routes": [{"host": "workers"}]}`, "routes[0]: at least one target"},
+		{"unknown balance", `{"routes": [{"host": "w", "targets": ["a"], "balance": "random"}]}`, "unknown balance"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := loadConfig(writeTestConfig(t, tc.content), "")
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("Expected error containing %q, got %v", tc.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestConfigValidatesServices(t *testing.T) {
+	for _, services := range []map[string]string{
+		{"minio": "data-node"},
+		{"Minio": "data-node:9000"},
+		{"a:b": "data-node:9000"},
+	} {
+		cfg := &Config{Services: services}
+		if err := cfg.validate(); err == nil {
+			t.Errorf("Expected error for %v", services)
+		}
+	}
+	cfg := &Config{Services: map[string]string{"minio": "data-node:9000"}}
+	if err := cfg.validate(); err != nil {
+		t.Errorf("Expected valid services, got %v", err)
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// --- CONNECTION TABLE ---
+
+// connections tracks every live tunnel and forwarded connection so operators
+// can see (and kill) what is keeping the sidecar busy.
+var connections = newConnTable()
+
+// ConnInfo describes one active connection in /connections
+type ConnInfo struct {
+	ID         string  `json:"id"`
+	RequestID  string  `json:"request_id"`
+	Kind       string  `json:"kind"` // connect, socks5, forward or alias
+	Client     string  `json:"client"`
+	Target     string  `json:"target"`
+	RxBytes    int64   `json:"rx_bytes"` // received from the target
+	TxBytes    int64   `json:"tx_bytes"` // sent to the target
+	Started    string  `json:"started"`
+	AgeSeconds float64 `json:"age_seconds"`
+}
+
+type connTable struct {
+	mu    sync.Mutex
+	next  uint64
+	conns map[string]*trackedConn
+
+	// onClose, if set, is called once for every connection that ends
+	onClose func(c *trackedConn)
+}
+
+func newConnTable() *connTable {
+	return &connTable{conns: make(map[string]*trackedConn)}
+}
+
+// trackedConn wraps the target side of a proxied connection. All traffic of
+// a tunnel passes through it, so it counts bytes in both directions.
+type trackedConn struct {
+	net.Conn
+	table     *connTable
+	id        string
+	requestID string
+	kind      string
+	client    string
+	target    string
+	started   time.Time
+	peer      io.Closer // client side, closed as well when the connection is killed
+	rx, tx    atomic.Int64
+	firstRx   sync.Once
+	once      sync.Once
+}
+
+// track registers a proxied connection opened for requestID. The returned
+// conn must be used in place of target; closing it removes the entry. client
+// may be nil when the client side isn't ours to close (e.g. SOCKS5).
+func (t *connTable) track(kind, requestID, clientAddr, targetAddr string, target net.Conn, client io.Closer) net.Conn {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.next++
+	c := &trackedConn{
+		Conn:      target,
+		table:     t,
+		id:        fmt.Sprintf("c%d", t.next),
+		requestID: requestID,
+		kind:      kind,
+		client:    clientAddr,
+		target:    targetAddr,
+		started:   time.Now(),
+		peer:      client,
+	}
+	t.conns[c.id] = c
+	return c
+}
+
+func (c *trackedConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.rx.Add(int64(n))
+	if n > 0 {
+		c.firstRx.Do(func() { latencies.observeTTFB(c.target, time.Since(c.started), c.requestID) })
+	}
+	return n, err
+}
+
+func (c *trackedConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.tx.Add(int64(n))
+	return n, err
+}
+
+func (c *trackedConn) Close() error {
+	c.once.Do(func() {
+		c.table.mu.Lock()
+		delete(c.table.conns, c.id)
+		c.table.mu.Unlock()
+		if c.table.onClose != nil {
+			c.table.onClose(c)
+		}
+	})
+	return c.Conn.Close()
+}
+
+// list returns a snapshot of all active connections, oldest first
+func (t *connTable) list() []ConnInfo {
+	t.mu.Lock()
+	conns := make([]*trackedConn, 0, len(t.conns))
+	for _, c := range t.conns {
+		conns = append(conns, c)
+	}
+	t.mu.Unlock()
+
+	sort.Slice(conns, func(i, j int) bool { return conns[i].started.Before(conns[j].started) })
+
+	infos := make([]ConnInfo, 0, len(conns))
+	for _, c := range conns {
+		infos = append(infos, ConnInfo{
+			ID:         c.id,
+			RequestID:  c.requestID,
+			Kind:       c.kind,
+			Client:     c.client,
+			Target:     c.target,
+			RxBytes:    c.rx.Load(),
+			TxBytes:    c.tx.Load(),
+			Started:    c.started.Format(time.RFC3339),
+			AgeSeconds: time.Since(c.started).Seconds(),
+		})
+	}
+	return infos
+}
+
+// count returns the number of active connections
+func (t *connTable) count() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.conns)
+}
+
+// countStartedBefore returns the number of active connections opened
+// before at
+func (t *connTable) countStartedBefore(at time.Time) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	n := 0
+	for _, c := range t.conns {
+		if c.started.Before(at) {
+			n++
+		}
+	}
+	return n
+}
+
+// kill forcibly closes a connection (both sides) and reports whether it existed
+func (t *connTable) kill(id string) bool {
+	t.mu.Lock()
+	c, ok := t.conns[id]
+	t.mu.Unlock()
+	if !ok {
+		return false
+	}
+
+	fmt.Fprintf(console, "[CONN] Killing %s %s (request %s): %s -> %s\n", c.id, c.kind, c.requestID, c.client, c.target)
+	c.Close()
+	if c.peer != nil {
+		c.peer.Close()
+	}
+	return true
+}
+
+// handleConnections lists active connections
+func handleConnections(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(connections.list())
+}
+
+// handleKillConnection terminates the connection named in the path
+func handleKillConnection(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if !connections.kill(id) {
+		http.Error(w, fmt.Sprintf("no active connection %q", id), http.StatusNotFound)
+		return
+	}
+	audit.record("kill_connection", "id", id)
+	w.WriteHeader(http.StatusNoContent)
+}
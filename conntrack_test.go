@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestConnTableTracksBytes(t *testing.T) {
+	table := newConnTable()
+
+	client, target := net.Pipe()
+	defer client.Close()
+	conn := table.track("forward", "r1", "127.0.0.1:50000", "data-node:9000", target, nil)
+
+	go func() {
+		buf := make([]byte, 5)
+		io.ReadFull(client, buf)
+		client.Write([]byte("pong!!"))
+	}()
+	conn.Write([]byte("ping!"))
+	buf := make([]byte, 6)
+	io.ReadFull(conn, buf)
+
+	infos := table.list()
+	if len(infos) != 1 {
+		t.Fatalf("Expected 1 connection, got %d", len(infos))
+	}
+	info := infos[0]
+	if info.Kind != "forward" || info.RequestID != "r1" || info.Target != "data-node:9000" || info.Client != "127.0.0.1:50000" {
+		t.Errorf("Unexpected connection info: %+v", info)
+	}
+	if info.TxBytes != 5 || info.RxBytes != 6 {
+		t.Errorf("Expected tx=5 rx=6, got tx=%d rx=%d", info.TxBytes, info.RxBytes)
+	}
+
+	conn.Close()
+	if table.count() != 0 {
+		t.Errorf("Expected closed connection to be removed, got %d", table.count())
+	}
+}
+
+func TestConnectionsEndpoints(t *testing.T) {
+	clientSide, clientPeer := net.Pipe()
+	targetSide, targetPeer := net.Pipe()
+	defer clientPeer.Close()
+	defer targetPeer.Close()
+
+	conn := connections.track("connect", "r2", "127.0.0.1:40000", "core:443", targetSide, clientSide)
+	defer conn.Close()
+	id := conn.(*trackedConn).id
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /connections", handleConnections)
+	mux.HandleFunc("DELETE /connections/{id}", handleKillConnection)
+
+	// The connection shows up in the listing
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "/connections", nil))
+	var infos []ConnInfo
+	if err := json.NewDecoder(w.Body).Decode(&infos); err != nil {
+		t.Fatalf("Failed to decode connections: %v", err)
+	}
+	found := false
+	for _, info := range infos {
+		found = found || info.ID == id
+	}
+	if !found {
+		t.Fatalf("Expected connection %s in %+v", id, infos)
+	}
+
+	// Killing it closes both sides
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("DELETE", "/connections/"+id, nil))
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("Expected status 204, got %d", w.Code)
+	}
+	if _, err := clientPeer.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("Expected client side to be closed, got %v", err)
+	}
+	if _, err := targetPeer.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("Expected target side to be closed, got %v", err)
+	}
+
+	// Killing it again is a 404
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("DELETE", "/connections/"+id, nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected status 404, got %d", w.Code)
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"tailscale.com/ipn"
+)
+
+// --- CONTAINER ---
+
+// envPrefix starts the environment variables that stand in for flags, e.g.
+// SIDECAR_AUTHKEY for -authkey or SIDECAR_ALIAS_PORTS for -alias-ports
+const envPrefix = "SIDECAR_"
+
+// envName returns the environment variable for a flag
+func envName(flagName string) string {
+	return envPrefix + strings.ToUpper(strings.NewReplacer("-", "_", ".", "_").Replace(flagName))
+}
+
+// flagsFromEnv sets every flag of fs that wasn't given on the command line
+// from its environment variable, so containers can be configured without
+// one. Command line flags win over the environment.
+func flagsFromEnv(fs *flag.FlagSet, lookup func(string) (string, bool)) error {
+	given := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) {
+		given[f.Name] = true
+		// A renamed flag given by either name is given by both
+		if a, ok := aliasFor(f.Name); ok {
+			given[a.Old], given[a.New] = true, true
+		}
+	})
+
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		if given[f.Name] || err != nil {
+			return
+		}
+		value, ok := lookup(envName(f.Name))
+		if !ok {
+			return
+		}
+		// The new name's variable wins over the old one's
+		if a, renamed := aliasFor(f.Name); renamed && a.Old == f.Name {
+			if _, set := lookup(envName(a.New)); set {
+				return
+			}
+		}
+		// Repeatable flags take a comma-separated list from one variable
+		values := []string{value}
+		if _, repeatable := f.Value.(*aliasFlag); repeatable {
+			values = strings.Split(value, ",")
+		}
+		for _, v := range values {
+			if setErr := fs.Set(f.Name, strings.TrimSpace(v)); setErr != nil {
+				err = fmt.Errorf("invalid %s: %w", envName(f.Name), setErr)
+				return
+			}
+		}
+	})
+	return err
+}
+
+// parseFlags parses the sidecar's command line, then fills the remaining
+// flags from SIDECAR_* variables
+func parseFlags(args []string) {
+	addFlagAliases(flag.CommandLine)
+	flag.CommandLine.Parse(args)
+	used, err := deprecatedFlags(flag.CommandLine, os.LookupEnv)
+	if err != nil {
+		log.Fatalf("!!! %v", err)
+	}
+	warnDeprecatedFlags(used, true)
+	if err := flagsFromEnv(flag.CommandLine, os.LookupEnv); err != nil {
+		log.Fatalf("!!! %v", err)
+	}
+}
+
+// runHealthcheck implements `sidecar healthcheck`, for use as a Docker
+// HEALTHCHECK: it exits 0 when the sidecar on the status port is connected
+// to the tailnet, 1 otherwise.
+func runHealthcheck(args []string, stdout io.Writer) error {
+	fs := flag.NewFlagSet("healthcheck", flag.ContinueOnError)
+	var (
+		port     = fs.String("statusport", "", "Status API port of the sidecar to check")
+		timeout  = fs.Duration("timeout", 5*time.Second, "Fail if the status API doesn't answer within this time")
+		langFlag = fs.String("lang", "", "Language of the output: 'en' or 'de' (default from the system locale)")
+	)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if err := flagsFromEnv(fs, os.LookupEnv); err != nil {
+		return err
+	}
+	if *port == "" {
+		return fmt.Errorf("healthcheck needs -statusport or %s", envName("statusport"))
+	}
+	lang, err := resolveLang(*langFlag)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+	state, err := backendState(ctx, "http://127.0.0.1:"+*port)
+	if err != nil {
+		return err
+	}
+	if state != ipn.Running.String() {
+		return errors.New(tr(lang, "cli.unhealthy", "state", state, "want", ipn.Running))
+	}
+	fmt.Fprintf(stdout, ">>> %s\n", tr(lang, "cli.healthy", "state", state))
+	return nil
+}
+
+// backendState asks a sidecar's status API for the node's backend state
+func backendState(ctx context.Context, base string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", base+apiPrefix+"/status", nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("status API unreachable: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("status API answered %s", resp.Status)
+	}
+	var status struct {
+		BackendState string `json:"backend_state"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		return "", fmt.Errorf("unreadable status: %w", err)
+	}
+	return status.BackendState, nil
+}
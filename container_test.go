@@ -0,0 +1,85 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestFlagsFromEnv(t *testing.T) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	var (
+		port    = fs.String("port", "8080", "")
+		mode    = fs.String("mode", "http", "")
+		nodelay = fs.Bool("nodelay", true, "")
+		ports   = fs.String("alias-ports", "80,443", "")
+		aliases aliasFlag
+	)
+	fs.Var(&aliases, "alias", "")
+	env := map[string]string{
+		"SIDECAR_PORT":        "9000",
+		"SIDECAR_MODE":        "socks5",
+		"SIDECAR_NODELAY":     "false",
+		"SIDECAR_ALIAS_PORTS": "5432",
+		"SIDECAR_ALIAS":       "data-node, core=127.0.1.10",
+	}
+	lookup := func(name string) (string, bool) {
+		v, ok := env[name]
+		return v, ok
+	}
+
+	fs.Parse([]string{"-mode", "echo"})
+	if err := flagsFromEnv(fs, lookup); err != nil {
+		t.Fatalf("flagsFromEnv failed: %v", err)
+	}
+	if *port != "9000" || *nodelay || *ports != "5432" {
+		t.Errorf("Expected flags from the environment, got port=%s nodelay=%v alias-ports=%s", *port, *nodelay, *ports)
+	}
+	if *mode != "echo" {
+		t.Errorf("Expected the command line to win, got mode=%s", *mode)
+	}
+	if len(aliases) != 2 {
+		t.Errorf("Expected 2 aliases from a comma-separated variable, got %v", aliases)
+	}
+
+	env["SIDECAR_NODELAY"] = "maybe"
+	fs = flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.Bool("nodelay", true, "")
+	if err := flagsFromEnv(fs, lookup); err == nil || !strings.Contains(err.Error(), "SIDECAR_NODELAY") {
+		t.Errorf("Expected an error naming SIDECAR_NODELAY, got %v", err)
+	}
+}
+
+func TestHealthcheck(t *testing.T) {
+	state := "Running"
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != apiPrefix+"/status" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(`{"schema_version":1,"backend_state":"` + state + `"}`))
+	}))
+	defer srv.Close()
+	_, port, _ := net.SplitHostPort(srv.Listener.Addr().String())
+
+	if err := runHealthcheck([]string{"-statusport", port}, io.Discard); err != nil {
+		t.Errorf("Expected a running sidecar to be healthy, got %v", err)
+	}
+	state = "NeedsLogin"
+	if err := runHealthcheck([]string{"-statusport", port}, io.Discard); err == nil {
+		t.Error("Expected a sidecar that needs login to be unhealthy")
+	}
+	srv.Close()
+	if err := runHealthcheck([]string{"-statusport", port}, io.Discard); err == nil {
+		t.Error("Expected an unreachable status API to be unhealthy")
+	}
+
+	t.Setenv("SIDECAR_STATUSPORT", "")
+	if err := runHealthcheck(nil, io.Discard); err == nil {
+		t.Error("Expected an error without a status port")
+	}
+}
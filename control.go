@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+)
+
+// --- CONTROL API ---
+
+// maintenance is toggled through /control/maintenance. While it is on, the
+// proxies, forwards and aliases refuse new connections but leave established
+// tunnels alone so they can drain.
+var maintenance atomic.Bool
+
+// MaintenanceStatus is the body of /control/maintenance requests and responses
+type MaintenanceStatus struct {
+	SchemaVersion     int  `json:"schema_version,omitempty"` // set in responses
+	Enabled           bool `json:"enabled"`
+	ActiveConnections int  `json:"active_connections"` // tunnels still draining
+}
+
+// setMaintenance switches maintenance mode and signals the change
+func setMaintenance(enabled bool) {
+	if maintenance.Swap(enabled) == enabled {
+		return
+	}
+	if enabled {
+		fmt.Fprintln(console, ">>> Maintenance mode ON: refusing new connections")
+	} else {
+		fmt.Fprintln(console, ">>> Maintenance mode OFF: accepting connections")
+	}
+	signal(SignalMaintenance, fmt.Sprintf("enabled=%v", enabled))
+	audit.record("maintenance", "enabled", fmt.Sprint(enabled))
+}
+
+// handleMaintenance reports (GET) or changes (POST) maintenance mode. The new
+// state comes from a JSON body or an ?enabled= query parameter.
+func handleMaintenance(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost, http.MethodPut:
+		var req MaintenanceStatus
+		if v := r.URL.Query().Get("enabled"); v != "" {
+			enabled, err := strconv.ParseBool(v)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("invalid enabled value %q", v), http.StatusBadRequest)
+				return
+			}
+			req.Enabled = enabled
+		} else if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, fmt.Sprintf("invalid request body: %v", err), http.StatusBadRequest)
+			return
+		}
+		setMaintenance(req.Enabled)
+	default:
+		http.Error(w, "only GET and POST allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(MaintenanceStatus{
+		SchemaVersion:     apiSchemaVersion,
+		Enabled:           maintenance.Load(),
+		ActiveConnections: connections.count(),
+	})
+}
+
+// reloader re-reads the config file for /control/reload. main sets it once
+// the router exists; until then reloads are refused.
+var reloader atomic.Pointer[func() (string, error)]
+
+// runReload runs reload and reports the outcome like the RELOAD command does
+func runReload(reload func() (string, error)) (string, error) {
+	details, err := reload()
+	if err != nil {
+		fmt.Fprintf(console, "!!! Reload failed: %v\n", err)
+		signal(SignalReloaded, fmt.Sprintf("ok=false error=%q", err.Error()))
+		audit.record("reload", "ok", "false", "error", err.Error())
+		return "", err
+	}
+	signal(SignalReloaded, "ok=true "+details)
+	audit.record("reload", "ok", "true", "result", details)
+	return details, nil
+}
+
+// ReloadResult is the response of /control/reload
+type ReloadResult struct {
+	SchemaVersion int    `json:"schema_version"`
+	Reloaded      string `json:"reloaded"` // what changed, as in @@SIDECAR:RELOADED@@
+}
+
+// handleReload re-reads the config file, like the RELOAD stdin command
+func handleReload(w http.ResponseWriter, r *http.Request) {
+	if !sameOrigin(r) {
+		http.Error(w, "cross-origin requests can't reload the sidecar", http.StatusForbidden)
+		return
+	}
+	reload := reloader.Load()
+	if reload == nil {
+		http.Error(w, "the sidecar is still starting", http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintln(console, ">>> Reload requested on the status API")
+	details, err := runReload(*reload)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ReloadResult{SchemaVersion: apiSchemaVersion, Reloaded: details})
+}
+
+// handleShutdown answers, then shuts the sidecar down like SHUTDOWN on stdin
+func handleShutdown(node io.Closer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !sameOrigin(r) {
+			http.Error(w, "cross-origin requests can't shut the sidecar down", http.StatusForbidden)
+			return
+		}
+		fmt.Fprintln(console, ">>> Shutdown requested on the status API")
+		w.WriteHeader(http.StatusAccepted)
+		http.NewResponseController(w).Flush()
+		shutdown("api", node)
+	}
+}
+
+// sameOrigin rejects requests a browser sends on behalf of another site, so
+// a web page can't reach the destructive control endpoints on loopback.
+// Clients that aren't browsers send no Origin and are let through. Only a
+// loopback Host counts, or a rebound name would pass as its own origin.
+func sameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	return origin == "" || loopbackHost(r.Host) && origin == "http://"+r.Host
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMaintenanceEndpoint(t *testing.T) {
+	defer maintenance.Store(false)
+
+	tests := []struct {
+		name        string
+		method      string
+		target      string
+		body        string
+		wantCode    int
+		wantEnabled bool
+	}{
+		{"enable via body", "POST", "/control/maintenance", `{"enabled": true}`, http.StatusOK, true},
+		{"query state", "GET", "/control/maintenance", "", http.StatusOK, true},
+		{"disable via query", "POST", "/control/maintenance?enabled=false", "", http.StatusOK, false},
+		{"bad value", "POST", "/control/maintenance?enabled=maybe", "", http.StatusBadRequest, false},
+		{"bad method", "DELETE", "/control/maintenance", "", http.StatusMethodNotAllowed, false},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			handleMaintenance(w, httptest.NewRequest(tc.method, tc.target, strings.NewReader(tc.body)))
+
+			if w.Code != tc.wantCode {
+				t.Fatalf("Expected status %d, got %d", tc.wantCode, w.Code)
+			}
+			if tc.wantCode != http.StatusOK {
+				return
+			}
+			var status MaintenanceStatus
+			if err := json.NewDecoder(w.Body).Decode(&status); err != nil {
+				t.Fatalf("Failed to decode response: %v", err)
+			}
+			if status.Enabled != tc.wantEnabled || maintenance.Load() != tc.wantEnabled {
+				t.Errorf("Expected enabled=%v, got response=%v flag=%v", tc.wantEnabled, status.Enabled, maintenance.Load())
+			}
+		})
+	}
+}
+
+func TestMaintenanceRejectsNewRequests(t *testing.T) {
+	defer maintenance.Store(false)
+	maintenance.Store(true)
+
+	proxy := &TailscaleProxy{
+		Transport: &MockRoundTripper{
+			RoundTripFunc: func(req *http.Request) (*http.Response, error) {
+				t.Error("Expected no upstream request during maintenance")
+				return nil, context.Canceled
+			},
+		},
+	}
+
+	for _, method := range []string{"GET", "CONNECT"} {
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, httptest.NewRequest(method, "http://core:8080/", nil))
+		if w.Code != http.StatusServiceUnavailable {
+			t.Errorf("%s: expected status 503, got %d", method, w.Code)
+		}
+	}
+
+	if _, ok := (admissionRules{}).Allow(context.Background(), nil); ok {
+		t.Error("Expected SOCKS5 requests to be refused during maintenance")
+	}
+}
+
+func TestReloadEndpoint(t *testing.T) {
+	defer reloader.Store(nil)
+
+	post := func(origin string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", "http://127.0.0.1:9090/control/reload", nil)
+		if origin != "" {
+			r.Header.Set("Origin", origin)
+		}
+		w := httptest.NewRecorder()
+		handleReload(w, r)
+		return w
+	}
+
+	if w := post(""); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected 503 before main set the reloader, got %d", w.Code)
+	}
+
+	var reloadErr error
+	reload := func() (string, error) { return "routes=2 services=1", reloadErr }
+	reloader.Store(&reload)
+	w := post("http://127.0.0.1:9090")
+	var res ReloadResult
+	json.NewDecoder(w.Body).Decode(&res)
+	if w.Code != http.StatusOK || res.Reloaded != "routes=2 services=1" {
+		t.Errorf("Expected a reload, got %d %+v", w.Code, res)
+	}
+
+	reloadErr = errors.New("routes[0]: invalid pattern")
+	if w := post(""); w.Code != http.StatusUnprocessableEntity || !strings.Contains(w.Body.String(), "invalid pattern") {
+		t.Errorf("Expected the config error, got %d %q", w.Code, w.Body)
+	}
+
+	// Pages on other sites can't reload or shut down the sidecar
+	if w := post("https://evil.example"); w.Code != http.StatusForbidden {
+		t.Errorf("Expected a cross-origin reload to be refused, got %d", w.Code)
+	}
+	w = httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "http://127.0.0.1:9090/control/shutdown", nil)
+	r.Header.Set("Origin", "https://evil.example")
+	handleShutdown(nil)(w, r)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Expected a cross-origin shutdown to be refused, got %d", w.Code)
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"tailscale.com/tailcfg"
+)
+
+// --- CONTROL SERVER CHECK ---
+
+// controlInfo is what a startup probe learned about the coordination server
+type controlInfo struct {
+	Headscale bool
+	Version   string // Headscale version, if it reports one
+}
+
+// checkControlServer probes a custom coordination server before the node
+// starts, so misconfigurations surface as actionable errors instead of an
+// Up() timeout a minute later.
+func checkControlServer(ctx context.Context, controlURL string) (controlInfo, error) {
+	base := strings.TrimSuffix(controlURL, "/")
+	client := &http.Client{Timeout: 10 * time.Second}
+	get := func(path string) (*http.Response, []byte, error) {
+		req, err := http.NewRequestWithContext(ctx, "GET", base+path, nil)
+		if err != nil {
+			return nil, nil, err
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return nil, nil, err
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+		return resp, body, err
+	}
+
+	var info controlInfo
+
+	// Headscale answers /health with {"status":"pass"}
+	if resp, body, err := get("/health"); err == nil && resp.StatusCode == http.StatusOK {
+		var health struct {
+			Status string `json:"status"`
+		}
+		if json.Unmarshal(body, &health) == nil && health.Status == "pass" {
+			info.Headscale = true
+		}
+	}
+	if info.Headscale {
+		if resp, body, err := get("/version"); err == nil && resp.StatusCode == http.StatusOK {
+			var v struct {
+				Version string `json:"version"`
+			}
+			if json.Unmarshal(body, &v) == nil {
+				info.Version = v.Version
+			}
+		}
+	}
+
+	resp, body, err := get(fmt.Sprintf("/key?v=%d", tailcfg.CurrentCapabilityVersion))
+	if err != nil {
+		return info, fmt.Errorf("cannot reach control server %s: %v (check -control-url and that it is reachable from this machine)", controlURL, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		msg := strings.TrimSpace(string(body))
+		if len(msg) > 200 {
+			msg = msg[:200]
+		}
+		return info, fmt.Errorf("control server %s answered /key with %s (%q); is -control-url the server's base URL and not an admin UI or a sub-path?", controlURL, resp.Status, msg)
+	}
+	var keys tailcfg.OverTLSPublicKeyResponse
+	if err := json.Unmarshal(body, &keys); err != nil {
+		return info, fmt.Errorf("control server %s did not return a machine key from /key (%v); is -control-url pointing at a Tailscale or Headscale server?", controlURL, err)
+	}
+	if keys.PublicKey.IsZero() {
+		if info.Headscale {
+			return info, fmt.Errorf("Headscale %s at %s does not offer the Noise protocol (ts2021) this client requires; upgrade Headscale to 0.23 or newer", info.Version, controlURL)
+		}
+		return info, fmt.Errorf("control server %s does not offer the Noise protocol (ts2021) this client requires", controlURL)
+	}
+	return info, nil
+}
+
+// upFailureHint explains the usual cause of an Up() timeout for the
+// detected control server.
+func (c controlInfo) upFailureHint() string {
+	if !c.Headscale {
+		return ""
+	}
+	return fmt.Sprintf("Headscale %s may not support this client's capability version %d; check the Headscale logs and upgrade Headscale if it rejects the client",
+		c.Version, tailcfg.CurrentCapabilityVersion)
+}
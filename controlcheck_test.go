@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/key"
+)
+
+// fakeControl serves /key, plus /health and /version when headscale is set
+func fakeControl(t *testing.T, headscale bool, noise bool) *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/key", func(w http.ResponseWriter, r *http.Request) {
+		resp := tailcfg.OverTLSPublicKeyResponse{LegacyPublicKey: key.NewMachine().Public()}
+		if noise {
+			resp.PublicKey = key.NewMachine().Public()
+		}
+		json.NewEncoder(w).Encode(resp)
+	})
+	if headscale {
+		mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(`{"status":"pass"}`))
+		})
+		mux.HandleFunc("/version", func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(`{"version":"v0.26.1"}`))
+		})
+	}
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestCheckControlServerDetectsHeadscale(t *testing.T) {
+	info, err := checkControlServer(context.Background(), fakeControl(t, true, true).URL)
+	if err != nil {
+		t.Fatalf("check failed: %v", err)
+	}
+	if !info.Headscale || info.Version != "v0.26.1" {
+		t.Errorf("Expected Headscale v0.26.1, got %+v", info)
+	}
+	if !strings.Contains(info.upFailureHint(), "capability version") {
+		t.Errorf("Expected a capability version hint, got %q", info.upFailureHint())
+	}
+
+	info, err = checkControlServer(context.Background(), fakeControl(t, false, true).URL)
+	if err != nil || info.Headscale || info.upFailureHint() != "" {
+		t.Errorf("Expected plain control server, got %+v, %v", info, err)
+	}
+}
+
+func TestCheckControlServerErrors(t *testing.T) {
+	if _, err := checkControlServer(context.Background(), fakeControl(t, true, false).URL); err == nil || !strings.Contains(err.Error(), "Noise") {
+		t.Errorf("Expected Noise protocol error, got %v", err)
+	}
+
+	notControl := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.NotFound(w, r)
+	}))
+	defer notControl.Close()
+	if _, err := checkControlServer(context.Background(), notControl.URL); err == nil || !strings.Contains(err.Error(), "404") {
+		t.Errorf("Expected /key status error, got %v", err)
+	}
+
+	if _, err := checkControlServer(context.Background(), "http://127.0.0.1:1"); err == nil || !strings.Contains(err.Error(), "cannot reach") {
+		t.Errorf("Expected unreachable error, got %v", err)
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// --- CONTROL TOKEN ---
+
+// The status API is only reachable from the machine, but on a shared
+// workstation that includes every user's processes and the untrusted
+// plugins sessions confine. Endpoints that change something or hand out
+// secrets therefore need a token the sidecar writes to its state directory
+// at startup, readable only by its own user (and so by the parent).
+
+// controlTokenFile is the token's name in the state directory
+const controlTokenFile = "control-token"
+
+// writeControlToken generates a fresh token and writes it to stateDir
+func writeControlToken(stateDir string) (token, path string, err error) {
+	token = rand.Text()
+	path = filepath.Join(stateDir, controlTokenFile)
+	if err := os.WriteFile(path, []byte(token+"\n"), 0o600); err != nil {
+		return "", "", err
+	}
+	// WriteFile keeps the mode of a file that already exists
+	if err := os.Chmod(path, 0o600); err != nil {
+		return "", "", err
+	}
+	return token, path, nil
+}
+
+// needsControlToken reports whether a request for path, with or without
+// apiPrefix, is guarded: every method but GET, HEAD and OPTIONS, except
+// DNS queries, which may be POSTed, and everything under /control/ and
+// /share/ and running commands on peers
+func needsControlToken(method, path string) bool {
+	path = strings.TrimPrefix(path, apiPrefix)
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+	default:
+		if path != "/dns-query" {
+			return true
+		}
+	}
+	if strings.HasPrefix(path, "/control/") || strings.HasPrefix(path, "/share/") {
+		return true
+	}
+	rest, ok := strings.CutPrefix(path, "/peers/")
+	return ok && strings.HasSuffix(rest, "/exec")
+}
+
+// withControlToken refuses guarded requests without the token as a Bearer
+// Authorization header
+func withControlToken(h http.Handler, token string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if needsControlToken(r.Method, r.URL.Path) {
+			given, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="sidecar"`)
+				http.Error(w, "this endpoint needs the token from "+controlTokenFile+" in the state directory", http.StatusUnauthorized)
+				return
+			}
+		}
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestControlToken(t *testing.T) {
+	dir := t.TempDir()
+	token, path, err := writeControlToken(dir)
+	if err != nil {
+		t.Fatalf("Failed to write the token: %v", err)
+	}
+	if data, _ := os.ReadFile(path); strings.TrimSpace(string(data)) != token {
+		t.Errorf("Expected the token in %s, got %q", path, data)
+	}
+	if info, err := os.Stat(path); err == nil && os.PathSeparator == '/' && info.Mode().Perm() != 0o600 {
+		t.Errorf("Expected the token to be readable by its owner only, got %v", info.Mode())
+	}
+
+	h := withControlToken(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), token)
+	for _, tc := range []struct {
+		method, path, auth string
+		want               int
+	}{
+		{"GET", "/status", "", http.StatusOK},
+		{"GET", "/api/v1/connections", "", http.StatusOK},
+		{"GET", "/control/sessions", "", http.StatusUnauthorized},
+		{"POST", "/api/v1/control/shutdown", "Bearer wrong", http.StatusUnauthorized},
+		{"POST", "/api/v1/peers/core/exec", "", http.StatusUnauthorized},
+		{"GET", "/api/v1/peers/core/timeline", "", http.StatusOK},
+		{"GET", "/share/get", "", http.StatusUnauthorized},
+		{"GET", "/api/v1/control/sessions", "Bearer " + token, http.StatusOK},
+		{"GET", "/fetch", "", http.StatusOK},
+		{"POST", "/fetch", "", http.StatusUnauthorized},
+		{"POST", "/api/v1/fetch", "Bearer wrong", http.StatusUnauthorized},
+		{"DELETE", "/fetch/t1", "", http.StatusUnauthorized},
+		{"DELETE", "/api/v1/connections/c1", "", http.StatusUnauthorized},
+		{"DELETE", "/connections/c1", "Bearer " + token, http.StatusOK},
+		{"POST", "/dns-query", "", http.StatusOK},
+		{"OPTIONS", "/fetch", "", http.StatusOK},
+	} {
+		req := httptest.NewRequest(tc.method, tc.path, nil)
+		if tc.auth != "" {
+			req.Header.Set("Authorization", tc.auth)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if w.Code != tc.want {
+			t.Errorf("%s %s with %q: expected %d, got %d", tc.method, tc.path, tc.auth, tc.want, w.Code)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"crypto/fips140"
+	"errors"
+	"fmt"
+	"os"
+	"runtime/debug"
+	"strings"
+)
+
+// --- CRYPTO POLICY ---
+
+// CryptoPolicy reports which implementation handles the sidecar's standard
+// library cryptography (TLS to control and DERP, OAuth, the status API's
+// clients), for deployments that must document FIPS-validated crypto.
+type CryptoPolicy struct {
+	Backend  string `json:"backend"`          // "go", "go-fips140" or "boringcrypto"
+	FIPS140  bool   `json:"fips140"`          // a FIPS 140 validated module is in use
+	Module   string `json:"module,omitempty"` // GOFIPS140 module the binary was built with, e.g. "v1.0.0"
+	Enforced bool   `json:"enforced"`         // GODEBUG fips140=only: non-approved algorithms fail
+	Required bool   `json:"required"`         // started with -require-fips
+	// WireGuard's ChaCha20-Poly1305 and Curve25519 are not FIPS-approved,
+	// so the tunnel itself is never covered, whatever the backend
+	Tunnel     string `json:"tunnel"`
+	TunnelFIPS bool   `json:"tunnel_fips"`
+}
+
+// cryptoReport is filled in at startup and served in /status
+var cryptoReport CryptoPolicy
+
+// errNotFIPS is returned by check when -require-fips can't be satisfied
+var errNotFIPS = errors.New("no FIPS 140 validated crypto module is active (build with GOFIPS140=v1.0.0, run with GODEBUG=fips140=on, or build with GOEXPERIMENT=boringcrypto)")
+
+// currentCryptoPolicy inspects the running binary
+func currentCryptoPolicy(required bool) CryptoPolicy {
+	p := CryptoPolicy{Backend: "go", Required: required, Tunnel: "wireguard"}
+	switch {
+	case boringEnabled():
+		p.Backend, p.FIPS140 = "boringcrypto", true
+	case fips140.Enabled():
+		p.Backend, p.FIPS140 = "go-fips140", true
+		p.Enforced = godebug("fips140") == "only"
+	}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, s := range info.Settings {
+			if s.Key == "GOFIPS140" && s.Value != "off" {
+				p.Module = s.Value
+			}
+		}
+	}
+	return p
+}
+
+// godebug returns the value of a GODEBUG setting, from the environment or
+// the binary's defaults
+func godebug(name string) string {
+	value := ""
+	settings := os.Getenv("GODEBUG")
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, s := range info.Settings {
+			if s.Key == "DefaultGODEBUG" {
+				settings = s.Value + "," + settings
+			}
+		}
+	}
+	// Later settings win, so the environment overrides the defaults
+	for _, kv := range strings.Split(settings, ",") {
+		if k, v, ok := strings.Cut(kv, "="); ok && k == name {
+			value = v
+		}
+	}
+	return value
+}
+
+// check fails closed when FIPS crypto is required but not in use
+func (p CryptoPolicy) check() error {
+	if p.Required && !p.FIPS140 {
+		return errNotFIPS
+	}
+	return nil
+}
+
+func (p CryptoPolicy) String() string {
+	s := p.Backend
+	if p.Module != "" {
+		s += " module " + p.Module
+	}
+	if p.Enforced {
+		s += ", enforced"
+	}
+	return fmt.Sprintf("%s (tunnel: %s, not FIPS-approved)", s, p.Tunnel)
+}
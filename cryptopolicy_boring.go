@@ -0,0 +1,10 @@
+//go:build boringcrypto
+
+package main
+
+import "crypto/boring"
+
+// boringEnabled reports whether BoringCrypto handles supported operations
+func boringEnabled() bool {
+	return boring.Enabled()
+}
@@ -0,0 +1,8 @@
+//go:build !boringcrypto
+
+package main
+
+// boringEnabled is always false without GOEXPERIMENT=boringcrypto.
+func boringEnabled() bool {
+	return false
+}
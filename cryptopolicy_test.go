@@ -0,0 +1,41 @@
+package main
+
+import (
+	"crypto/fips140"
+	"errors"
+	"testing"
+)
+
+func TestCryptoPolicy(t *testing.T) {
+	p := currentCryptoPolicy(true)
+	if p.Tunnel != "wireguard" || p.TunnelFIPS {
+		t.Errorf("Expected the tunnel to be reported as non-FIPS wireguard, got %+v", p)
+	}
+	if fips140.Enabled() || boringEnabled() {
+		// GOFIPS140, GODEBUG=fips140=on or BoringCrypto builds satisfy -require-fips
+		if !p.FIPS140 || p.check() != nil {
+			t.Errorf("Expected an active FIPS module to be reported, got %+v", p)
+		}
+		return
+	}
+	if p.Backend != "go" || p.FIPS140 {
+		t.Errorf("Expected the plain Go backend, got %+v", p)
+	}
+	if err := p.check(); !errors.Is(err, errNotFIPS) {
+		t.Errorf("Expected -require-fips to fail closed, got %v", err)
+	}
+	p.Required = false
+	if err := p.check(); err != nil {
+		t.Errorf("Expected no error when FIPS isn't required, got %v", err)
+	}
+}
+
+func TestGodebug(t *testing.T) {
+	t.Setenv("GODEBUG", "http2client=0,fips140=on,fips140=only")
+	if v := godebug("fips140"); v != "only" {
+		t.Errorf("Expected the last fips140 setting to win, got %q", v)
+	}
+	if v := godebug("missing"); v != "" {
+		t.Errorf("Expected an unset setting to be empty, got %q", v)
+	}
+}
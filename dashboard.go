@@ -0,0 +1,91 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// --- WEB DASHBOARD ---
+
+// dashboardHTML is the single-page dashboard served at / on the status port.
+// It only uses the status API, so anything it shows can be scripted too.
+//
+//go:embed dashboard.html
+var dashboardHTML []byte
+
+// handleDashboard serves the dashboard page
+func handleDashboard(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	// The page is only ever shown on its own, never framed by another site
+	w.Header().Set("X-Frame-Options", "DENY")
+	w.Write(dashboardHTML)
+}
+
+// recentErrorsSize is how many errors and warnings /errors remembers
+const recentErrorsSize = 50
+
+// ErrorEvent is one entry of /errors
+type ErrorEvent struct {
+	Time    string    `json:"time"`
+	Kind    string    `json:"kind"`           // error, warning, request_failed or alert
+	Code    ErrorCode `json:"code,omitempty"` // see ErrorCode, not set for warnings
+	Message string    `json:"message"`        // the signal's details, redacted
+}
+
+// errorKinds maps the signals worth showing on the dashboard to their kind
+var errorKinds = map[string]string{
+	SignalError:         "error",
+	SignalWarning:       "warning",
+	SignalRequestFailed: "request_failed",
+	SignalClockSkew:     "warning",
+	SignalAlert:         "alert",
+}
+
+// errorLog keeps the most recent error signals
+type errorLog struct {
+	mu      sync.Mutex
+	entries []ErrorEvent // oldest first
+}
+
+// recentErrors is fed by signal
+var recentErrors = &errorLog{}
+
+// record remembers sig if it is an error or warning
+func (l *errorLog) record(sig, details string) {
+	kind, ok := errorKinds[sig]
+	if !ok {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.entries) == recentErrorsSize {
+		l.entries = append(l.entries[:0], l.entries[1:]...)
+	}
+	l.entries = append(l.entries, ErrorEvent{
+		Time:    time.Now().UTC().Format(time.RFC3339),
+		Kind:    kind,
+		Code:    signalCode(details),
+		Message: details,
+	})
+}
+
+// list returns the remembered entries, newest first
+func (l *errorLog) list() []ErrorEvent {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	list := make([]ErrorEvent, len(l.entries))
+	for i, e := range l.entries {
+		list[len(list)-1-i] = e
+	}
+	return list
+}
+
+// handleRecentErrors serves the recent errors and warnings on the status API
+func handleRecentErrors(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(recentErrors.list())
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestDashboard(t *testing.T) {
+	w := httptest.NewRecorder()
+	handleDashboard(w, httptest.NewRequest("GET", "/", nil))
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/html") {
+		t.Errorf("Expected an HTML page, got %q", ct)
+	}
+	// The page only talks to the versioned status API
+	for _, want := range []string{`const api = "/api/v1"`, `"/control/reload"`, `"/control/shutdown"`, `get("/errors")`, `"/messages"`} {
+		if !strings.Contains(w.Body.String(), want) {
+			t.Errorf("Expected %q in the page", want)
+		}
+	}
+}
+
+func TestRecentErrors(t *testing.T) {
+	l := &errorLog{}
+	l.record(SignalConnected, "")
+	l.record(SignalWarning, "clock skew")
+	for i := 0; i < recentErrorsSize; i++ {
+		l.record(SignalError, fmt.Sprintf("error %d", i))
+	}
+	l.record(SignalRequestFailed, `code=ACL_DENIED id=r1 kind=connect target=gpu-node:8080 error="refused"`)
+
+	list := l.list()
+	if len(list) != recentErrorsSize {
+		t.Fatalf("Expected %d entries, got %d", recentErrorsSize, len(list))
+	}
+	if list[0].Kind != "request_failed" || list[0].Code != CodeACLDenied || list[1].Message != fmt.Sprintf("error %d", recentErrorsSize-1) {
+		t.Errorf("Expected newest first, got %+v", list[:2])
+	}
+	if last := list[len(list)-1]; last.Message != "error 1" {
+		t.Errorf("Expected the oldest entries to be dropped, got %+v", last)
+	}
+
+	defer func(saved *errorLog) { recentErrors = saved }(recentErrors)
+	recentErrors = l
+	w := httptest.NewRecorder()
+	handleRecentErrors(w, httptest.NewRequest("GET", "/errors", nil))
+	var got []ErrorEvent
+	if err := json.NewDecoder(w.Body).Decode(&got); err != nil || len(got) != recentErrorsSize {
+		t.Errorf("Expected the list on the API, got %d entries, %v", len(got), err)
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"time"
+)
+
+// --- DEBUG ENDPOINTS ---
+
+// processStart is when the process came up, for uptime in /debug/runtime
+var processStart = time.Now()
+
+// RuntimeStats is the body of /debug/runtime
+type RuntimeStats struct {
+	SchemaVersion int     `json:"schema_version"`
+	Goroutines    int     `json:"goroutines"`
+	GOMAXPROCS    int     `json:"gomaxprocs"`
+	UptimeSeconds float64 `json:"uptime_seconds"`
+	MemoryInUse   uint64  `json:"memory_in_use_bytes"`
+	HeapAlloc     uint64  `json:"heap_alloc_bytes"`
+	HeapObjects   uint64  `json:"heap_objects"`
+	NextGC        uint64  `json:"next_gc_bytes"`
+	NumGC         uint32  `json:"num_gc"`
+	PauseTotalMs  float64 `json:"gc_pause_total_ms"`
+	LastPauseMs   float64 `json:"gc_last_pause_ms"`
+	LastGC        string  `json:"last_gc"` // empty before the first collection
+	Tunnels       int     `json:"tunnels"`
+}
+
+// registerDebug adds pprof and runtime statistics to the status API. They
+// are only mounted with -debug, since profiles expose a lot about the process.
+// pprof stays at its standard, unversioned path where go tool pprof expects it.
+func registerDebug(mux apiMux) {
+	mux.ServeMux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.ServeMux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.ServeMux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.ServeMux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.ServeMux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.HandleFunc("GET /debug/runtime", handleRuntimeStats)
+}
+
+// runtimeStats collects goroutine and GC figures. ReadMemStats briefly stops
+// the world, which is fine for an endpoint polled by hand.
+func runtimeStats() RuntimeStats {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+
+	stats := RuntimeStats{
+		SchemaVersion: apiSchemaVersion,
+		Goroutines:    runtime.NumGoroutine(),
+		GOMAXPROCS:    runtime.GOMAXPROCS(0),
+		UptimeSeconds: time.Since(processStart).Seconds(),
+		MemoryInUse:   memoryInUse(),
+		HeapAlloc:     ms.HeapAlloc,
+		HeapObjects:   ms.HeapObjects,
+		NextGC:        ms.NextGC,
+		NumGC:         ms.NumGC,
+		PauseTotalMs:  millis(time.Duration(ms.PauseTotalNs)),
+		Tunnels:       connections.count(),
+	}
+	if ms.NumGC > 0 {
+		stats.LastPauseMs = millis(time.Duration(ms.PauseNs[(ms.NumGC+255)%256]))
+		stats.LastGC = time.Unix(0, int64(ms.LastGC)).UTC().Format(time.RFC3339)
+	}
+	return stats
+}
+
+// handleRuntimeStats serves goroutine, memory and GC statistics
+func handleRuntimeStats(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(runtimeStats())
+}
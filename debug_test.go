@@ -0,0 +1,32 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestDebugEndpoints(t *testing.T) {
+	mux := http.NewServeMux()
+	registerDebug(apiMux{mux})
+	runtime.GC()
+
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest("GET", "/debug/runtime", nil))
+	var stats RuntimeStats
+	if err := json.NewDecoder(rec.Body).Decode(&stats); err != nil {
+		t.Fatalf("Failed to decode runtime stats: %v", err)
+	}
+	if stats.Goroutines < 1 || stats.NumGC < 1 || stats.LastGC == "" || stats.HeapAlloc == 0 {
+		t.Errorf("Unexpected runtime stats %+v", stats)
+	}
+
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest("GET", "/debug/pprof/goroutine?debug=1", nil))
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "goroutine profile") {
+		t.Errorf("Expected a goroutine profile, got %d", rec.Code)
+	}
+}
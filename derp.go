@@ -0,0 +1,72 @@
+package main
+
+import (
+	"sort"
+	"time"
+
+	"tailscale.com/net/netcheck"
+	"tailscale.com/tailcfg"
+)
+
+// --- DERP ---
+
+// DERPRegionLatency is the measured round trip to one DERP region
+type DERPRegionLatency struct {
+	RegionID  int     `json:"region_id"`
+	Code      string  `json:"code"`
+	Name      string  `json:"name"`
+	LatencyMs float64 `json:"latency_ms"`
+}
+
+// DERPStatus describes the relay this node uses and how the candidates measured
+type DERPStatus struct {
+	HomeRegion        string              `json:"home_region"`      // region currently used as home
+	PreferredRegion   string              `json:"preferred_region"` // netcheck's pick, may lag behind home
+	Connected         bool                `json:"connected"`
+	ActiveConnections int                 `json:"active_connections"` // open DERP connections, home included
+	UDP               bool                `json:"udp"`                // false means all traffic is relayed
+	MeasuredAt        string              `json:"measured_at"`
+	Latencies         []DERPRegionLatency `json:"latencies"` // fastest first
+}
+
+// derpStatus combines the home region from the node status with the last
+// netcheck report. report and dm may be nil before the first measurement.
+func derpStatus(home string, report *netcheck.Report, dm *tailcfg.DERPMap, active int) DERPStatus {
+	st := DERPStatus{
+		HomeRegion:        home,
+		Connected:         home != "" && active > 0,
+		ActiveConnections: active,
+		Latencies:         []DERPRegionLatency{},
+	}
+	if report == nil {
+		return st
+	}
+
+	region := func(id int) (code, name string) {
+		if dm != nil {
+			if r := dm.Regions[id]; r != nil {
+				return r.RegionCode, r.RegionName
+			}
+		}
+		return "", ""
+	}
+
+	st.PreferredRegion, _ = region(report.PreferredDERP)
+	st.UDP = report.UDP
+	if !report.Now.IsZero() {
+		st.MeasuredAt = report.Now.Format(time.RFC3339)
+	}
+	for id, d := range report.RegionLatency {
+		code, name := region(id)
+		st.Latencies = append(st.Latencies, DERPRegionLatency{
+			RegionID:  id,
+			Code:      code,
+			Name:      name,
+			LatencyMs: float64(d) / float64(time.Millisecond),
+		})
+	}
+	sort.Slice(st.Latencies, func(i, j int) bool {
+		return st.Latencies[i].LatencyMs < st.Latencies[j].LatencyMs
+	})
+	return st
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"tailscale.com/net/netcheck"
+	"tailscale.com/tailcfg"
+)
+
+func TestDERPStatus(t *testing.T) {
+	dm := &tailcfg.DERPMap{Regions: map[int]*tailcfg.DERPRegion{
+		1:   {RegionID: 1, RegionCode: "nyc", RegionName: "New York City"},
+		4:   {RegionID: 4, RegionCode: "fra", RegionName: "Frankfurt"},
+		900: {RegionID: 900, RegionCode: "lab", RegionName: "Lab Relay"},
+	}}
+	report := &netcheck.Report{
+		Now:           time.Date(2026, 1, 19, 20, 30, 0, 0, time.UTC),
+		UDP:           true,
+		PreferredDERP: 900,
+		RegionLatency: map[int]time.Duration{
+			1:   90 * time.Millisecond,
+			4:   12 * time.Millisecond,
+			900: 3 * time.Millisecond,
+		},
+	}
+
+	st := derpStatus("fra", report, dm, 2)
+	if !st.Connected || st.HomeRegion != "fra" || st.PreferredRegion != "lab" {
+		t.Errorf("Unexpected home/preferred: %+v", st)
+	}
+	if len(st.Latencies) != 3 || st.Latencies[0].Code != "lab" || st.Latencies[2].Code != "nyc" {
+		t.Fatalf("Expected latencies sorted fastest first, got %+v", st.Latencies)
+	}
+	if st.Latencies[1].LatencyMs != 12 {
+		t.Errorf("Expected 12ms to fra, got %v", st.Latencies[1].LatencyMs)
+	}
+	if st.MeasuredAt != "2026-01-19T20:30:00Z" {
+		t.Errorf("Unexpected measured_at %q", st.MeasuredAt)
+	}
+
+	// Before the first netcheck there is nothing but the home region
+	if st := derpStatus("", nil, nil, 0); st.Connected || len(st.Latencies) != 0 {
+		t.Errorf("Expected empty status, got %+v", st)
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"tailscale.com/ipn"
+	"tailscale.com/tailcfg"
+	"tailscale.com/tsnet"
+)
+
+// --- CUSTOM DERP MAP ---
+
+// loadDERPMap reads a DERP map in Tailscale's JSON format from a file or an
+// http(s) URL. URLs are fetched over the regular network, before the node
+// is up.
+func loadDERPMap(src string) (*tailcfg.DERPMap, error) {
+	var data []byte
+	if strings.HasPrefix(src, "http://") || strings.HasPrefix(src, "https://") {
+		client := &http.Client{Timeout: 15 * time.Second}
+		resp, err := client.Get(src)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("fetching %s: %s", src, resp.Status)
+		}
+		if data, err = io.ReadAll(io.LimitReader(resp.Body, 1<<20)); err != nil {
+			return nil, err
+		}
+	} else {
+		var err error
+		if data, err = os.ReadFile(src); err != nil {
+			return nil, err
+		}
+	}
+
+	dm := &tailcfg.DERPMap{}
+	if err := json.Unmarshal(data, dm); err != nil {
+		return nil, fmt.Errorf("parsing DERP map: %w", err)
+	}
+	if len(dm.Regions) == 0 {
+		return nil, fmt.Errorf("DERP map has no regions")
+	}
+	for id, r := range dm.Regions {
+		if r == nil || r.RegionID != id {
+			return nil, fmt.Errorf("DERP region %d: RegionID must match its key", id)
+		}
+		if len(r.Nodes) == 0 {
+			return nil, fmt.Errorf("DERP region %d has no nodes", id)
+		}
+		for _, n := range r.Nodes {
+			if n.HostName == "" {
+				return nil, fmt.Errorf("DERP region %d: node %q has no HostName", id, n.Name)
+			}
+		}
+	}
+	return dm, nil
+}
+
+// pinDERPMap makes the node use dm instead of the map sent by control.
+// Control resends its map with every netmap, so dm is re-applied after
+// each one until ctx is done.
+func pinDERPMap(ctx context.Context, s *tsnet.Server, dm *tailcfg.DERPMap) error {
+	ms, ok := s.Sys().MagicSock.GetOK()
+	if !ok {
+		return fmt.Errorf("node has no magicsock")
+	}
+	lc, err := s.LocalClient()
+	if err != nil {
+		return err
+	}
+	watcher, err := lc.WatchIPNBus(ctx, ipn.NotifyInitialNetMap)
+	if err != nil {
+		return err
+	}
+	ms.SetDERPMap(dm)
+
+	go func() {
+		defer watcher.Close()
+		for {
+			n, err := watcher.Next()
+			if err != nil {
+				return
+			}
+			if n.NetMap != nil {
+				ms.SetDERPMap(dm)
+			}
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const testDERPMap = `{
+  "omitDefaultRegions": true,
+  "Regions": {
+    "900": {
+      "RegionID": 900,
+      "RegionCode": "lab",
+      "RegionName": "Lab Relay",
+      "Nodes": [{"Name": "900a", "RegionID": 900, "HostName": "derp.lab.example.com"}]
+    }
+  }
+}`
+
+func TestLoadDERPMap(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "derp.json")
+	os.WriteFile(path, []byte(testDERPMap), 0600)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(testDERPMap))
+	}))
+	defer server.Close()
+
+	for _, src := range []string{path, server.URL} {
+		dm, err := loadDERPMap(src)
+		if err != nil {
+			t.Fatalf("loadDERPMap(%s) failed: %v", src, err)
+		}
+		if !dm.OmitDefaultRegions || dm.Regions[900] == nil || dm.Regions[900].RegionCode != "lab" {
+			t.Errorf("Unexpected DERP map from %s: %+v", src, dm)
+		}
+	}
+}
+
+func TestLoadDERPMapValidation(t *testing.T) {
+	cases := map[string]string{
+		"empty":    `{"Regions": {}}`,
+		"mismatch": `{"Regions": {"900": {"RegionID": 901, "Nodes": [{"HostName": "a"}]}}}`,
+		"no nodes": `{"Regions": {"900": {"RegionID": 900}}}`,
+		"no host":  `{"Regions": {"900": {"RegionID": 900, "Nodes": [{"Name": "a"}]}}}`,
+		"not json": `regions: 900`,
+	}
+	for name, data := range cases {
+		path := filepath.Join(t.TempDir(), "derp.json")
+		os.WriteFile(path, []byte(data), 0600)
+		if _, err := loadDERPMap(path); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
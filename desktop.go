@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+)
+
+// --- DESKTOP NOTIFICATIONS ---
+
+// desktopSignals are what a desktop sink shows unless it lists signals
+var desktopSignals = []string{"ALERT"}
+
+// desktopScript shows a toast on Windows. Title and body come from the
+// environment, so nothing in them is parsed as PowerShell.
+const desktopScript = `[Windows.UI.Notifications.ToastNotificationManager, Windows.UI.Notifications, ContentType = WindowsRuntime] > $null
+$xml = [Windows.UI.Notifications.ToastNotificationManager]::GetTemplateContent([Windows.UI.Notifications.ToastTemplateType]::ToastText02)
+$text = $xml.GetElementsByTagName('text')
+$text.Item(0).AppendChild($xml.CreateTextNode($env:SIDECAR_TOAST_TITLE)) > $null
+$text.Item(1).AppendChild($xml.CreateTextNode($env:SIDECAR_TOAST_BODY)) > $null
+$toast = [Windows.UI.Notifications.ToastNotification]::new($xml)
+[Windows.UI.Notifications.ToastNotificationManager]::CreateToastNotifier('Arkitekt Sidecar').Show($toast)`
+
+// desktopCommand builds the command that shows a notification on goos
+func desktopCommand(ctx context.Context, goos, title, body string) (*exec.Cmd, error) {
+	switch goos {
+	case "linux", "freebsd", "openbsd", "netbsd":
+		return exec.CommandContext(ctx, "notify-send", "--app-name=arkitekt-sidecar", "--", title, body), nil
+	case "darwin":
+		script := fmt.Sprintf("display notification %s with title %s", appleScriptString(body), appleScriptString(title))
+		return exec.CommandContext(ctx, "osascript", "-e", script), nil
+	case "windows":
+		cmd := exec.CommandContext(ctx, "powershell", "-NoProfile", "-NonInteractive", "-Command", desktopScript)
+		cmd.Env = append(os.Environ(), "SIDECAR_TOAST_TITLE="+title, "SIDECAR_TOAST_BODY="+body)
+		return cmd, nil
+	}
+	return nil, errors.New("no desktop notifications on " + goos)
+}
+
+// appleScriptString quotes s as an AppleScript string literal
+func appleScriptString(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
+
+// desktopText is the title and body of the notification for ev
+func desktopText(ev Event) (title, body string) {
+	name := signalName(ev.Signal)
+	if name != "ALERT" {
+		return "Sidecar: " + name, ev.Details
+	}
+	// rule=db-offline state=firing when=peer_offline peer=lab-db offline ...
+	fields := map[string]string{}
+	for _, f := range strings.Fields(ev.Details) {
+		if k, v, ok := strings.Cut(f, "="); ok {
+			fields[k] = v
+		}
+	}
+	title = "Sidecar alert: " + fields["rule"]
+	if fields["state"] == "resolved" {
+		title = "Sidecar alert resolved: " + fields["rule"]
+	}
+	return title, ev.Details
+}
+
+// newDesktopSink shows every event as a desktop notification
+func newDesktopSink() (*asyncSink, error) {
+	if _, err := desktopCommand(context.Background(), runtime.GOOS, "", ""); err != nil {
+		return nil, err
+	}
+	return newAsyncSink("desktop", func(ctx context.Context, ev Event) error {
+		title, body := desktopText(ev)
+		cmd, err := desktopCommand(ctx, runtime.GOOS, title, body)
+		if err != nil {
+			return err
+		}
+		if out, err := cmd.CombinedOutput(); err != nil {
+			return fmt.Errorf("%s: %v %s", cmd.Path, err, strings.TrimSpace(string(out)))
+		}
+		return nil
+	}), nil
+}
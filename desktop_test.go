@@ -0,0 +1,36 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"testing"
+)
+
+func TestDesktopCommand(t *testing.T) {
+	ctx := context.Background()
+	cmd, err := desktopCommand(ctx, "linux", "Sidecar alert: db", "offline")
+	if err != nil || !slices.Equal(cmd.Args, []string{"notify-send", "--app-name=arkitekt-sidecar", "--", "Sidecar alert: db", "offline"}) {
+		t.Errorf("Unexpected Linux command %v, %v", cmd, err)
+	}
+	cmd, _ = desktopCommand(ctx, "darwin", `say "hi"`, `a\b`)
+	if want := `display notification "a\\b" with title "say \"hi\""`; cmd.Args[2] != want {
+		t.Errorf("Expected %q, got %q", want, cmd.Args[2])
+	}
+	cmd, _ = desktopCommand(ctx, "windows", "$(evil)", "body")
+	if !slices.Contains(cmd.Env, "SIDECAR_TOAST_TITLE=$(evil)") || slices.Contains(cmd.Args, "$(evil)") {
+		t.Errorf("Expected the title in the environment only, got %v", cmd.Args)
+	}
+	if _, err := desktopCommand(ctx, "plan9", "", ""); err == nil {
+		t.Errorf("Expected no notifications on plan9")
+	}
+}
+
+func TestDesktopText(t *testing.T) {
+	title, body := desktopText(Event{Signal: SignalAlert, Details: "rule=db state=resolved when=peer_offline peer=lab-db after=4m0s"})
+	if title != "Sidecar alert resolved: db" || body == "" {
+		t.Errorf("Unexpected notification %q %q", title, body)
+	}
+	if title, _ := desktopText(Event{Signal: SignalError, Details: "code=X"}); title != "Sidecar: ERROR" {
+		t.Errorf("Unexpected title %q", title)
+	}
+}
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
+
+	"tailscale.com/ipn/ipnstate"
+)
+
+// --- DIAGNOSE ---
+
+// diagnoseTimeout bounds a whole diagnosis; the dial gets what is left
+const diagnoseTimeout = 15 * time.Second
+
+// diagnoseProbeTimeout bounds the HTTP probe, so a port that waits for
+// the client to speak first doesn't use up the whole diagnosis
+const diagnoseProbeTimeout = 3 * time.Second
+
+// diagnosePeerList caps how many peer names a failed lookup suggests
+const diagnosePeerList = 5
+
+// diagnostics is nil until the proxies exist; /diagnose answers 503 before
+var diagnostics *diagnoser
+
+// DiagnoseStep is one check on the way to the target. Status is one of the
+// preflight results: pass, warn, fail or skip.
+type DiagnoseStep struct {
+	Name   string    `json:"name"` // resolve, peer, online, path, acl, dial, http
+	Status string    `json:"status"`
+	Code   ErrorCode `json:"code,omitempty"` // the code a request would fail with
+	Detail string    `json:"detail"`
+}
+
+// DiagnoseReport is the answer of /diagnose and `sidecar diagnose -json`
+type DiagnoseReport struct {
+	SchemaVersion int            `json:"schema_version"`
+	Target        string         `json:"target"`
+	Dialed        string         `json:"dialed,omitempty"` // after services and routes
+	Reachable     bool           `json:"reachable"`
+	Verdict       string         `json:"verdict"`
+	Steps         []DiagnoseStep `json:"steps"`
+}
+
+// diagnoser walks the path a proxied connection takes, stopping at the
+// first step that fails
+type diagnoser struct {
+	router *Router // services and routes
+	dialer Dialer  // the proxies' dialer, ACL detection included
+	status func(ctx context.Context) (*ipnstate.Status, error)
+	ping   func(ctx context.Context, ip netip.Addr) (*ipnstate.PingResult, error)
+}
+
+// diagnose runs the decision tree for target (host:port)
+func (d *diagnoser) diagnose(ctx context.Context, target string) DiagnoseReport {
+	ctx, cancel := context.WithTimeout(ctx, diagnoseTimeout)
+	defer cancel()
+
+	report := DiagnoseReport{SchemaVersion: apiSchemaVersion, Target: target}
+	add := func(name, status string, code ErrorCode, format string, args ...any) {
+		report.Steps = append(report.Steps, DiagnoseStep{Name: name, Status: status, Code: code, Detail: fmt.Sprintf(format, args...)})
+	}
+	fail := func(name string, code ErrorCode, verdict string, format string, args ...any) DiagnoseReport {
+		add(name, checkFail, code, format, args...)
+		report.Verdict = verdict
+		return report
+	}
+
+	// Services and routes decide what is dialed
+	addr, via := target, ""
+	if d.router != nil {
+		resolved, err := d.router.resolve(target)
+		if err != nil {
+			return fail("resolve", CodeConfigInvalid, fmt.Sprintf("%s names a service the config doesn't define.", target), "%v", err)
+		}
+		if resolved != target {
+			via = fmt.Sprintf("service → %s", resolved)
+		}
+		if rt, ok := d.router.match(resolved); ok {
+			_, port, _ := net.SplitHostPort(resolved)
+			first := rt.rule.Targets[0]
+			if _, _, err := net.SplitHostPort(first); err != nil {
+				first = net.JoinHostPort(first, port)
+			}
+			if first, err = d.router.resolve(first); err != nil {
+				return fail("resolve", CodeConfigInvalid, fmt.Sprintf("The route for %s names a service the config doesn't define.", rt.rule.Host), "%v", err)
+			}
+			via = fmt.Sprintf("route %s → %s (first of %d targets)", rt.rule.Host, first, len(rt.rule.Targets))
+			resolved = first
+		}
+		addr = resolved
+	}
+	report.Dialed = addr
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return fail("resolve", CodeConfigInvalid, fmt.Sprintf("%s is not host:port.", addr), "%v", err)
+	}
+
+	status, err := d.status(ctx)
+	if err != nil {
+		return fail("resolve", CodeTailnetFailed, "The sidecar can't read its own tailnet state; is it connected?", "%v", err)
+	}
+	var peer *ipnstate.PeerStatus
+	if ip, err := netip.ParseAddr(host); err == nil {
+		for _, p := range status.Peer {
+			if slices.Contains(p.TailscaleIPs, ip) {
+				peer = p
+				break
+			}
+		}
+		add("resolve", checkPass, "", "%s is an IP address%s", host, viaSuffix(via))
+	} else {
+		peer = findPeer(status, host)
+		if peer == nil || len(peer.TailscaleIPs) == 0 {
+			return fail("resolve", CodeDialFailed,
+				fmt.Sprintf("No node called %s is on this tailnet. Check the spelling and that the machine has joined the same tailnet.", host),
+				"no peer named %s%s; peers include %s", host, viaSuffix(via), peerNames(status))
+		}
+		add("resolve", checkPass, "", "%s is %s%s", host, peer.TailscaleIPs[0], viaSuffix(via))
+	}
+
+	if peer == nil {
+		return fail("peer", CodeDialFailed,
+			fmt.Sprintf("%s belongs to no peer this node can see. The address may be outside the tailnet, or ACLs hide the node from this one.", host),
+			"no peer has the address %s", host)
+	}
+	add("peer", checkPass, "", "%s (%s)", peer.HostName, peer.OS)
+
+	if !peer.Online {
+		seen := "never"
+		if !peer.LastSeen.IsZero() {
+			seen = peer.LastSeen.UTC().Format(time.RFC3339)
+		}
+		return fail("online", CodeTailnetTimeout,
+			fmt.Sprintf("%s is offline. Start it, or check its Tailscale client; it was last seen %s.", peer.HostName, seen),
+			"offline, last seen %s", seen)
+	}
+	add("online", checkPass, "", "online")
+
+	if d.ping != nil {
+		res, err := d.ping(ctx, peer.TailscaleIPs[0])
+		switch {
+		case err != nil:
+			return fail("path", CodeTailnetTimeout, fmt.Sprintf("%s is listed online, but no packets get through. Both machines may block UDP and the relays.", peer.HostName), "%v", err)
+		case res.Err != "":
+			return fail("path", CodeTailnetTimeout, fmt.Sprintf("%s is listed online, but no packets get through. Both machines may block UDP and the relays.", peer.HostName), "%s", res.Err)
+		case res.Endpoint != "":
+			add("path", checkPass, "", "direct via %s, %.1f ms", res.Endpoint, res.LatencySeconds*1000)
+		default:
+			add("path", checkWarn, "", "relayed via DERP %s, %.1f ms; a direct path would be faster", res.DERPRegionCode, res.LatencySeconds*1000)
+		}
+	}
+
+	start := time.Now()
+	conn, err := d.dialer.Dial(ctx, "tcp", addr)
+	took := time.Since(start)
+	switch {
+	case isACLDenied(err):
+		report.Steps = append(report.Steps, DiagnoseStep{Name: "acl", Status: checkFail, Code: CodeACLDenied, Detail: err.Error()})
+		report.Verdict = fmt.Sprintf("The tailnet ACLs don't let this node reach port %s on %s. Ask the tailnet admin to allow it.", port, peer.HostName)
+		return report
+	case err != nil && errors.Is(err, syscall.ECONNREFUSED):
+		add("acl", checkPass, "", "not rejected")
+		return fail("dial", CodeConnectionRefused,
+			fmt.Sprintf("%s is reachable, but nothing listens on port %s. Start the service, or check the port.", peer.HostName, port), "%v", err)
+	case err != nil:
+		add("acl", checkSkip, "", "no rejection seen")
+		return fail("dial", classifyError(err, CodeDialFailed),
+			fmt.Sprintf("%s doesn't answer on port %s. A firewall on that machine may drop the connection, or the service is hung.", peer.HostName, port), "%v", err)
+	}
+	defer conn.Close()
+	add("acl", checkPass, "", "allowed")
+	add("dial", checkPass, "", "connected in %.1f ms", millis(took))
+
+	report.Reachable = true
+	report.Verdict = fmt.Sprintf("%s is reachable.", addr)
+	if proto := probeHTTP(ctx, conn, host); proto != "" {
+		add("http", checkPass, "", "%s", proto)
+		report.Verdict = fmt.Sprintf("%s is reachable and answers HTTP (%s).", addr, proto)
+	} else {
+		add("http", checkSkip, "", "no HTTP answer; the port may speak another protocol")
+	}
+	return report
+}
+
+// viaSuffix appends how the address was found, if not as given
+func viaSuffix(via string) string {
+	if via == "" {
+		return ""
+	}
+	return " (" + via + ")"
+}
+
+// peerNames lists a few peer names, for a lookup that found none
+func peerNames(status *ipnstate.Status) string {
+	var names []string
+	for _, p := range status.Peer {
+		names = append(names, p.HostName)
+	}
+	if len(names) == 0 {
+		return "none"
+	}
+	slices.Sort(names)
+	if len(names) > diagnosePeerList {
+		names = append(names[:diagnosePeerList], "...")
+	}
+	return strings.Join(names, ", ")
+}
+
+// probeHTTP sends a HEAD request over conn and returns the status line, or
+// "" if the answer isn't HTTP
+func probeHTTP(ctx context.Context, conn net.Conn, host string) string {
+	deadline := time.Now().Add(diagnoseProbeTimeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	conn.SetDeadline(deadline)
+	req, _ := http.NewRequest(http.MethodHead, "http://"+host+"/", nil)
+	req.Header.Set("User-Agent", "arkitekt-sidecar/"+version+" diagnose")
+	if err := req.Write(conn); err != nil {
+		return ""
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		return ""
+	}
+	resp.Body.Close()
+	return resp.Status
+}
+
+// handleDiagnose serves /diagnose?target=host:port
+func handleDiagnose(w http.ResponseWriter, r *http.Request) {
+	target := r.URL.Query().Get("target")
+	if _, _, err := net.SplitHostPort(target); err != nil && !strings.HasPrefix(target, servicePrefix) {
+		http.Error(w, "target must be host:port", http.StatusBadRequest)
+		return
+	}
+	if diagnostics == nil {
+		http.Error(w, "the proxies are not running yet", http.StatusServiceUnavailable)
+		return
+	}
+	report := diagnostics.diagnose(r.Context(), target)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
+
+// runDiagnose implements `sidecar diagnose host:port`: it asks a running
+// sidecar why the target can or can't be reached, and prints the verdict,
+// the steps and the report as JSON to paste into a support request
+func runDiagnose(args []string, stdout io.Writer) error {
+	fs := flag.NewFlagSet("diagnose", flag.ContinueOnError)
+	var (
+		port   = fs.String("statusport", "", "Status API port of the sidecar that can't reach the target")
+		asJSON = fs.Bool("json", false, "Print only the JSON report")
+	)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if err := flagsFromEnv(fs, os.LookupEnv); err != nil {
+		return err
+	}
+	if *port == "" || fs.NArg() != 1 {
+		return fmt.Errorf("usage: diagnose -statusport N host:port (or set %s)", envName("statusport"))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), diagnoseTimeout+5*time.Second)
+	defer cancel()
+	u := "http://127.0.0.1:" + *port + apiPrefix + "/diagnose?target=" + url.QueryEscape(fs.Arg(0))
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("status API unreachable: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("status API answered %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	var report DiagnoseReport
+	if err := json.NewDecoder(resp.Body).Decode(&report); err != nil {
+		return fmt.Errorf("invalid report: %w", err)
+	}
+
+	if !*asJSON {
+		for _, s := range report.Steps {
+			fmt.Fprintf(stdout, "%-5s %-8s %s\n", strings.ToUpper(s.Status), s.Name, s.Detail)
+		}
+		if report.Reachable {
+			fmt.Fprintf(stdout, ">>> %s\n\n", report.Verdict)
+		} else {
+			fmt.Fprintf(stdout, "!!! %s\n\n", report.Verdict)
+		}
+	}
+	enc := json.NewEncoder(stdout)
+	enc.SetIndent("", "  ")
+	enc.Encode(report)
+	if !report.Reachable {
+		return fmt.Errorf("%s is not reachable", report.Target)
+	}
+	return nil
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/types/key"
+)
+
+// testDiagnoser knows one online peer, gpu-box, and one offline, old-pc
+func testDiagnoser(dial func(ctx context.Context, network, addr string) (net.Conn, error)) *diagnoser {
+	status := &ipnstate.Status{Peer: map[key.NodePublic]*ipnstate.PeerStatus{
+		key.NewNode().Public(): {HostName: "gpu-box", DNSName: "gpu-box.tail1234.ts.net.", OS: "linux", Online: true,
+			TailscaleIPs: []netip.Addr{netip.MustParseAddr("100.64.0.2")}},
+		key.NewNode().Public(): {HostName: "old-pc", OS: "windows", LastSeen: time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC),
+			TailscaleIPs: []netip.Addr{netip.MustParseAddr("100.64.0.3")}},
+	}}
+	router := newRouter(&MockDialer{DialFunc: dial}, []RouteRule{{Host: "models", PoolConfig: PoolConfig{Targets: []string{"gpu-box"}}}}, nil)
+	router.Services = map[string]string{"core": "gpu-box:8000"}
+	return &diagnoser{
+		router: router,
+		dialer: &MockDialer{DialFunc: dial},
+		status: func(ctx context.Context) (*ipnstate.Status, error) { return status, nil },
+		ping: func(ctx context.Context, ip netip.Addr) (*ipnstate.PingResult, error) {
+			return &ipnstate.PingResult{Endpoint: "192.168.1.20:41641", LatencySeconds: 0.002}, nil
+		},
+	}
+}
+
+// lastStep returns the name and status of the step the diagnosis ended on
+func lastStep(r DiagnoseReport) string {
+	s := r.Steps[len(r.Steps)-1]
+	return s.Name + "=" + s.Status
+}
+
+func TestDiagnose(t *testing.T) {
+	var dialed []string
+	d := testDiagnoser(func(ctx context.Context, network, addr string) (net.Conn, error) {
+		dialed = append(dialed, addr)
+		switch addr {
+		case "gpu-box:22":
+			return nil, fmt.Errorf("dial: %w", &aclDeniedError{Denial: ACLDenial{Source: "100.64.0.1", Destination: "100.64.0.2:22", Reason: "acl"}})
+		case "gpu-box:5432":
+			return nil, fmt.Errorf("dial: %w", syscall.ECONNREFUSED)
+		case "gpu-box:9999":
+			return nil, context.DeadlineExceeded
+		}
+		client, server := net.Pipe()
+		go func() {
+			// Answer like a web server
+			buf := make([]byte, 1024)
+			server.Read(buf)
+			server.Write([]byte("HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n"))
+			server.Close()
+		}()
+		return client, nil
+	})
+
+	for _, tc := range []struct {
+		target, last, code string
+		reachable          bool
+	}{
+		{"gpu-box:8080", "http=pass", "", true},
+		{"core:80", "http=pass", "", true},
+		{"models:8080", "http=pass", "", true},
+		{"nope:80", "resolve=fail", string(CodeDialFailed), false},
+		{"100.64.9.9:80", "peer=fail", string(CodeDialFailed), false},
+		{"old-pc:80", "online=fail", string(CodeTailnetTimeout), false},
+		{"gpu-box:22", "acl=fail", string(CodeACLDenied), false},
+		{"gpu-box:5432", "dial=fail", string(CodeConnectionRefused), false},
+		{"gpu-box:9999", "dial=fail", string(CodeTailnetTimeout), false},
+	} {
+		r := d.diagnose(context.Background(), tc.target)
+		if r.Reachable != tc.reachable || lastStep(r) != tc.last || string(r.Steps[len(r.Steps)-1].Code) != tc.code {
+			t.Errorf("%s: expected %s (code %q, reachable %v), got %+v", tc.target, tc.last, tc.code, tc.reachable, r)
+		}
+		if r.Verdict == "" {
+			t.Errorf("%s: expected a verdict", tc.target)
+		}
+	}
+	if dialed[1] != "gpu-box:8000" || dialed[2] != "gpu-box:8080" {
+		t.Errorf("Expected the service and route to be resolved, got %v", dialed)
+	}
+
+	// A path that only works through DERP is a warning, not a failure
+	d.ping = func(ctx context.Context, ip netip.Addr) (*ipnstate.PingResult, error) {
+		return &ipnstate.PingResult{DERPRegionCode: "fra", LatencySeconds: 0.04}, nil
+	}
+	if r := d.diagnose(context.Background(), "gpu-box:8080"); !r.Reachable || r.Steps[3].Status != checkWarn {
+		t.Errorf("Expected a relayed path to warn, got %+v", r.Steps)
+	}
+	d.ping = func(ctx context.Context, ip netip.Addr) (*ipnstate.PingResult, error) {
+		return nil, errors.New("timeout")
+	}
+	if r := d.diagnose(context.Background(), "gpu-box:8080"); r.Reachable || lastStep(r) != "path=fail" {
+		t.Errorf("Expected the path to fail, got %+v", r.Steps)
+	}
+}
+
+func TestRunDiagnose(t *testing.T) {
+	diagnostics = testDiagnoser(func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return nil, syscall.ECONNREFUSED
+	})
+	defer func() { diagnostics = nil }()
+	mux := http.NewServeMux()
+	apiMux{mux}.HandleFunc("GET /diagnose", handleDiagnose)
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+	_, port, _ := net.SplitHostPort(srv.Listener.Addr().String())
+
+	var out bytes.Buffer
+	err := runDiagnose([]string{"-statusport", port, "gpu-box:5432"}, &out)
+	if err == nil || !strings.Contains(err.Error(), "not reachable") {
+		t.Errorf("Expected an unreachable error, got %v", err)
+	}
+	for _, want := range []string{"PASS  online", "FAIL  dial", "!!! gpu-box is reachable, but nothing listens on port 5432", `"code": "CONNECTION_REFUSED"`} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("Expected %q in\n%s", want, out.String())
+		}
+	}
+
+	resp, err := http.Get(srv.URL + "/diagnose?target=gpu-box")
+	if err != nil {
+		t.Fatalf("GET failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected 400 without a port, got %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"reflect"
+	"time"
+	"unsafe"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+)
+
+// --- TAILNET DIALS ---
+
+// tailnetDialer applies the connect timeout, TCP keepalive and socket
+// settings to every connection the proxies, forwards and the HTTP transport
+// dial through the tailnet.
+type tailnetDialer struct {
+	Base      Dialer
+	Timeout   time.Duration // 0 waits as long as the caller's context allows
+	KeepAlive time.Duration // probe interval on idle connections, 0 disables
+	Sockets   socketTuning
+}
+
+func (d *tailnetDialer) Dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	if d.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d.Timeout)
+		defer cancel()
+	}
+	conn, err := d.Base.Dial(ctx, network, addr)
+	if err != nil {
+		if errors.Is(err, context.DeadlineExceeded) && d.Timeout > 0 {
+			return nil, fmt.Errorf("dial %s: no connection after %s: %w", addr, d.Timeout, err)
+		}
+		return nil, err
+	}
+	if d.KeepAlive > 0 {
+		if err := setKeepAlive(conn, d.KeepAlive); err != nil {
+			fmt.Fprintf(console, "[DIAL] %s: failed to enable keepalive: %v\n", addr, err)
+		}
+	}
+	if err := d.Sockets.apply(conn); err != nil {
+		fmt.Fprintf(console, "[DIAL] %s: failed to set socket options: %v\n", addr, err)
+	}
+	return conn, nil
+}
+
+// setKeepAlive makes an idle connection send a probe every period, so NAT
+// bindings along the path don't expire and a dead peer is noticed. Dials
+// over netstack return gVisor connections, everything else a net.TCPConn.
+func setKeepAlive(conn net.Conn, period time.Duration) error {
+	switch c := conn.(type) {
+	case *net.TCPConn:
+		if err := c.SetKeepAlive(true); err != nil {
+			return err
+		}
+		return c.SetKeepAlivePeriod(period)
+	case *gonet.TCPConn:
+		ep := gonetEndpoint(c)
+		if ep == nil {
+			return errors.New("netstack connection has no endpoint")
+		}
+		idle := tcpip.KeepaliveIdleOption(period)
+		if err := ep.SetSockOpt(&idle); err != nil {
+			return fmt.Errorf("%s", err)
+		}
+		interval := tcpip.KeepaliveIntervalOption(period)
+		if err := ep.SetSockOpt(&interval); err != nil {
+			return fmt.Errorf("%s", err)
+		}
+		ep.SocketOptions().SetKeepAlive(true)
+	}
+	return nil
+}
+
+// gonetEndpoint digs the gVisor endpoint out of a netstack connection.
+// gonet doesn't expose it, but keepalive can only be set on the endpoint.
+func gonetEndpoint(c *gonet.TCPConn) tcpip.Endpoint {
+	field := reflect.ValueOf(c).Elem().FieldByName("ep")
+	if !field.IsValid() {
+		return nil
+	}
+	ep, _ := reflect.NewAt(field.Type(), unsafe.Pointer(field.UnsafeAddr())).Elem().Interface().(tcpip.Endpoint)
+	return ep
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/waiter"
+)
+
+// fakeEndpoint records the socket options set on a netstack connection
+type fakeEndpoint struct {
+	tcpip.Endpoint
+	opts []tcpip.SettableSocketOption
+	so   tcpip.SocketOptions
+}
+
+func (e *fakeEndpoint) SetSockOpt(opt tcpip.SettableSocketOption) tcpip.Error {
+	e.opts = append(e.opts, opt)
+	return nil
+}
+
+func (e *fakeEndpoint) SocketOptions() *tcpip.SocketOptions {
+	return &e.so
+}
+
+func TestSetKeepAliveOnNetstackConn(t *testing.T) {
+	ep := &fakeEndpoint{}
+	ep.so.InitHandler(&tcpip.DefaultSocketOptionsHandler{}, nil, nil, nil)
+	conn := gonet.NewTCPConn(&waiter.Queue{}, ep)
+
+	if err := setKeepAlive(conn, 25*time.Second); err != nil {
+		t.Fatalf("setKeepAlive failed: %v", err)
+	}
+	if !ep.so.GetKeepAlive() {
+		t.Error("Expected keepalive to be enabled")
+	}
+	if len(ep.opts) != 2 {
+		t.Fatalf("Expected idle and interval options, got %v", ep.opts)
+	}
+	if idle, ok := ep.opts[0].(*tcpip.KeepaliveIdleOption); !ok || time.Duration(*idle) != 25*time.Second {
+		t.Errorf("Unexpected idle option %v", ep.opts[0])
+	}
+	if interval, ok := ep.opts[1].(*tcpip.KeepaliveIntervalOption); !ok || time.Duration(*interval) != 25*time.Second {
+		t.Errorf("Unexpected interval option %v", ep.opts[1])
+	}
+}
+
+func TestTailnetDialerTimeout(t *testing.T) {
+	d := &tailnetDialer{
+		Base: &MockDialer{
+			DialFunc: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				<-ctx.Done()
+				return nil, ctx.Err()
+			},
+		},
+		Timeout: 50 * time.Millisecond,
+	}
+
+	start := time.Now()
+	_, err := d.Dial(context.Background(), "tcp", "data-node:9000")
+	if err == nil || !strings.Contains(err.Error(), "no connection after 50ms") {
+		t.Errorf("Expected a timeout error, got %v", err)
+	}
+	if time.Since(start) > 2*time.Second {
+		t.Errorf("Expected the dial to give up after the timeout, took %v", time.Since(start))
+	}
+}
+
+func TestSetKeepAliveOnTCPConn(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer ln.Close()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer conn.Close()
+	if err := setKeepAlive(conn, 30*time.Second); err != nil {
+		t.Errorf("setKeepAlive failed: %v", err)
+	}
+}
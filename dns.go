@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"golang.org/x/net/dns/dnsmessage"
+	"tailscale.com/tsnet"
+)
+
+// --- DNS-OVER-HTTPS ---
+
+// dnsMessageContentType is the RFC 8484 media type for wire-format DNS messages
+const dnsMessageContentType = "application/dns-message"
+
+// maxDNSMessageSize bounds request bodies; DNS messages can't exceed 64KiB
+const maxDNSMessageSize = 65535
+
+// dnsQueryFunc resolves a single question and returns a wire-format response
+type dnsQueryFunc func(ctx context.Context, name, queryType string) ([]byte, error)
+
+// tsnetDNSQuery resolves through the embedded node's resolver, so MagicDNS
+// names and split DNS configured on the tailnet are answered.
+func tsnetDNSQuery(s *tsnet.Server) dnsQueryFunc {
+	return func(ctx context.Context, name, queryType string) ([]byte, error) {
+		lc, err := s.LocalClient()
+		if err != nil {
+			return nil, err
+		}
+		res, _, err := lc.QueryDNS(ctx, name, queryType)
+		return res, err
+	}
+}
+
+// dohHandler serves RFC 8484 DNS-over-HTTPS queries (GET ?dns= and POST)
+func dohHandler(query dnsQueryFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var msg []byte
+		switch r.Method {
+		case http.MethodGet:
+			b, err := base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns"))
+			if err != nil || len(b) == 0 {
+				http.Error(w, "missing or invalid 'dns' parameter", http.StatusBadRequest)
+				return
+			}
+			msg = b
+		case http.MethodPost:
+			if ct := r.Header.Get("Content-Type"); ct != dnsMessageContentType {
+				http.Error(w, fmt.Sprintf("unsupported content type %q", ct), http.StatusUnsupportedMediaType)
+				return
+			}
+			b, err := io.ReadAll(io.LimitReader(r.Body, maxDNSMessageSize+1))
+			if err != nil || len(b) == 0 || len(b) > maxDNSMessageSize {
+				http.Error(w, "invalid DNS message body", http.StatusBadRequest)
+				return
+			}
+			msg = b
+		default:
+			http.Error(w, "only GET and POST allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var p dnsmessage.Parser
+		header, err := p.Start(msg)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid DNS message: %v", err), http.StatusBadRequest)
+			return
+		}
+		questions, err := p.AllQuestions()
+		if err != nil || len(questions) != 1 {
+			http.Error(w, "DNS message must contain exactly one question", http.StatusBadRequest)
+			return
+		}
+		q := questions[0]
+
+		queryType := strings.TrimPrefix(q.Type.String(), "Type")
+		res, err := query(r.Context(), q.Name.String(), queryType)
+		if err != nil || len(res) < 2 {
+			fmt.Fprintf(console, "[DNS] Query %s %s failed: %v\n", queryType, q.Name, err)
+			res, err = dnsErrorResponse(header.ID, q, dnsmessage.RCodeServerFailure)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("failed to build DNS response: %v", err), http.StatusInternalServerError)
+				return
+			}
+		}
+
+		// The resolver doesn't know the client's ID, so answer with the one we were asked with
+		res[0], res[1] = byte(header.ID>>8), byte(header.ID)
+
+		w.Header().Set("Content-Type", dnsMessageContentType)
+		if ttl, ok := minAnswerTTL(res); ok {
+			w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", ttl))
+		}
+		w.Write(res)
+	}
+}
+
+// dnsErrorResponse builds an empty response to q carrying rcode
+func dnsErrorResponse(id uint16, q dnsmessage.Question, rcode dnsmessage.RCode) ([]byte, error) {
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{
+		ID:                 id,
+		Response:           true,
+		RecursionDesired:   true,
+		RecursionAvailable: true,
+		RCode:              rcode,
+	})
+	if err := b.StartQuestions(); err != nil {
+		return nil, err
+	}
+	if err := b.Question(q); err != nil {
+		return nil, err
+	}
+	return b.Finish()
+}
+
+// minAnswerTTL returns the smallest TTL among the answers in a DNS response
+func minAnswerTTL(res []byte) (uint32, bool) {
+	var p dnsmessage.Parser
+	if _, err := p.Start(res); err != nil {
+		return 0, false
+	}
+	if err := p.SkipAllQuestions(); err != nil {
+		return 0, false
+	}
+	answers, err := p.AllAnswers()
+	if err != nil || len(answers) == 0 {
+		return 0, false
+	}
+	ttl := answers[0].Header.TTL
+	for _, a := range answers[1:] {
+		ttl = min(ttl, a.Header.TTL)
+	}
+	return ttl, true
+}
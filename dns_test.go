@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// buildDNSQuery returns a wire-format A query for name
+func buildDNSQuery(t *testing.T, id uint16, name string) []byte {
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: id, RecursionDesired: true})
+	b.StartQuestions()
+	b.Question(dnsmessage.Question{
+		Name:  dnsmessage.MustNewName(name),
+		Type:  dnsmessage.TypeA,
+		Class: dnsmessage.ClassINET,
+	})
+	msg, err := b.Finish()
+	if err != nil {
+		t.Fatalf("Failed to build DNS query: %v", err)
+	}
+	return msg
+}
+
+// fakeDNSAnswer answers every question with 100.64.0.10 and the given TTL
+func fakeDNSAnswer(ttl uint32) dnsQueryFunc {
+	return func(ctx context.Context, name, queryType string) ([]byte, error) {
+		b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: 0, Response: true})
+		b.StartQuestions()
+		b.Question(dnsmessage.Question{Name: dnsmessage.MustNewName(name), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET})
+		b.StartAnswers()
+		b.AResource(dnsmessage.ResourceHeader{
+			Name:  dnsmessage.MustNewName(name),
+			Class: dnsmessage.ClassINET,
+			TTL:   ttl,
+		}, dnsmessage.AResource{A: [4]byte{100, 64, 0, 10}})
+		return b.Finish()
+	}
+}
+
+func parseDNSResponse(t *testing.T, body []byte) (dnsmessage.Header, []dnsmessage.Resource) {
+	var p dnsmessage.Parser
+	header, err := p.Start(body)
+	if err != nil {
+		t.Fatalf("Failed to parse DNS response: %v", err)
+	}
+	p.SkipAllQuestions()
+	answers, err := p.AllAnswers()
+	if err != nil {
+		t.Fatalf("Failed to parse DNS answers: %v", err)
+	}
+	return header, answers
+}
+
+func TestDoHGet(t *testing.T) {
+	var gotName, gotType string
+	handler := dohHandler(func(ctx context.Context, name, queryType string) ([]byte, error) {
+		gotName, gotType = name, queryType
+		return fakeDNSAnswer(60)(ctx, name, queryType)
+	})
+
+	query := base64.RawURLEncoding.EncodeToString(buildDNSQuery(t, 0xBEEF, "data-node.tailnet.ts.net."))
+	req := httptest.NewRequest("GET", "/dns-query?dns="+query, nil)
+	w := httptest.NewRecorder()
+	handler(w, req)
+
+	resp := w.Result()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", resp.StatusCode)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != dnsMessageContentType {
+		t.Errorf("Expected Content-Type %s, got %s", dnsMessageContentType, ct)
+	}
+	if cc := resp.Header.Get("Cache-Control"); cc != "max-age=60" {
+		t.Errorf("Expected Cache-Control 'max-age=60', got '%s'", cc)
+	}
+	if gotName != "data-node.tailnet.ts.net." || gotType != "A" {
+		t.Errorf("Expected query for A data-node.tailnet.ts.net., got %s %s", gotType, gotName)
+	}
+
+	body, _ := io.ReadAll(resp.Body)
+	header, answers := parseDNSResponse(t, body)
+	if header.ID != 0xBEEF {
+		t.Errorf("Expected response ID 0xBEEF, got %#x", header.ID)
+	}
+	if len(answers) != 1 {
+		t.Fatalf("Expected 1 answer, got %d", len(answers))
+	}
+}
+
+func TestDoHPost(t *testing.T) {
+	handler := dohHandler(fakeDNSAnswer(30))
+
+	req := httptest.NewRequest("POST", "/dns-query", bytes.NewReader(buildDNSQuery(t, 42, "core.")))
+	req.Header.Set("Content-Type", dnsMessageContentType)
+	w := httptest.NewRecorder()
+	handler(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", w.Code)
+	}
+	header, _ := parseDNSResponse(t, w.Body.Bytes())
+	if header.ID != 42 {
+		t.Errorf("Expected response ID 42, got %d", header.ID)
+	}
+}
+
+func TestDoHResolverFailure(t *testing.T) {
+	handler := dohHandler(func(ctx context.Context, name, queryType string) ([]byte, error) {
+		return nil, errors.New("resolver unavailable")
+	})
+
+	query := base64.RawURLEncoding.EncodeToString(buildDNSQuery(t, 7, "missing."))
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest("GET", "/dns-query?dns="+query, nil))
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", w.Code)
+	}
+	header, _ := parseDNSResponse(t, w.Body.Bytes())
+	if header.RCode != dnsmessage.RCodeServerFailure {
+		t.Errorf("Expected SERVFAIL, got %v", header.RCode)
+	}
+	if header.ID != 7 {
+		t.Errorf("Expected response ID 7, got %d", header.ID)
+	}
+}
+
+func TestDoHBadRequests(t *testing.T) {
+	handler := dohHandler(fakeDNSAnswer(60))
+
+	tests := []struct {
+		name     string
+		req      *http.Request
+		wantCode int
+	}{
+		{"missing dns param", httptest.NewRequest("GET", "/dns-query", nil), http.StatusBadRequest},
+		{"garbage dns param", httptest.NewRequest("GET", "/dns-query?dns=AAAA", nil), http.StatusBadRequest},
+		{"wrong content type", httptest.NewRequest("POST", "/dns-query", bytes.NewReader([]byte{0})), http.StatusUnsupportedMediaType},
+		{"wrong method", httptest.NewRequest("PUT", "/dns-query", nil), http.StatusMethodNotAllowed},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			handler(w, tc.req)
+			if w.Code != tc.wantCode {
+				t.Errorf("Expected status %d, got %d", tc.wantCode, w.Code)
+			}
+		})
+	}
+}
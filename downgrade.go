@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// --- CONNECT DOWNGRADE ---
+
+// Some clients send everything through CONNECT, plain HTTP to port 80
+// included. The tunnel hides those requests from the logs, response
+// headers and route rules the HTTP path applies. The sidecar looks at the
+// first bytes of a CONNECT to port 80 and, with -connect-downgrade, serves
+// plain HTTP it finds there as proxied requests instead.
+
+// connectSniffTimeout bounds the wait for the client's first bytes. A
+// protocol where the server speaks first is tunneled after it.
+const connectSniffTimeout = 3 * time.Second
+
+// connectDowngrade is -connect-downgrade
+var connectDowngrade bool
+
+// downgradeHints remembers the hosts a plain HTTP tunnel was logged for,
+// so the hint shows once per host
+var downgradeHints sync.Map
+
+// httpMethods are the request lines plain HTTP starts with
+var httpMethods = [][]byte{
+	[]byte("GET "), []byte("POST "), []byte("PUT "), []byte("HEAD "), []byte("DELETE "),
+	[]byte("PATCH "), []byte("OPTIONS "), []byte("TRACE "),
+}
+
+// sniffPlainHTTP reports whether the client's first bytes on conn are a
+// plain HTTP request line. TLS starts with a handshake record (0x16) and
+// never matches. Nothing is consumed from br.
+func sniffPlainHTTP(conn net.Conn, br *bufio.Reader) bool {
+	conn.SetReadDeadline(time.Now().Add(connectSniffTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+	first, err := br.Peek(1)
+	if err != nil || first[0] == 0x16 {
+		return false
+	}
+	// The longest method plus its space
+	head, _ := br.Peek(min(br.Buffered(), 8))
+	for _, m := range httpMethods {
+		if bytes.HasPrefix(head, m) || (len(head) < len(m) && bytes.HasPrefix(m, head) && len(head) >= 3) {
+			return true
+		}
+	}
+	return false
+}
+
+// bufferedConn reads what was peeked before the rest of the connection
+type bufferedConn struct {
+	net.Conn
+	br *bufio.Reader
+}
+
+func (c bufferedConn) Read(b []byte) (int, error) {
+	return c.br.Read(b)
+}
+
+// connListener hands out a single connection and closes once it is done
+type connListener struct {
+	conn net.Conn
+	once sync.Once
+	next chan net.Conn
+	done chan struct{}
+}
+
+func newConnListener(conn net.Conn) *connListener {
+	l := &connListener{conn: conn, next: make(chan net.Conn, 1), done: make(chan struct{})}
+	l.next <- conn
+	return l
+}
+
+func (l *connListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.next:
+		return c, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *connListener) Close() error {
+	l.once.Do(func() { close(l.done) })
+	return nil
+}
+
+func (l *connListener) Addr() net.Addr {
+	return l.conn.LocalAddr()
+}
+
+// serveDowngraded proxies the plain HTTP requests a client sends inside a
+// CONNECT to host as if they had been sent to the HTTP proxy, with the
+// session of the CONNECT. It returns once the client closes the connection.
+func (p *TailscaleProxy) serveDowngraded(conn net.Conn, br *bufio.Reader, connect *http.Request, host string) {
+	sess := sessionFrom(connect.Context())
+	ln := newConnListener(bufferedConn{conn, br})
+	srv := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			id := requestIDFor(r)
+			r = r.WithContext(withSession(withRequestID(r.Context(), id), sess))
+			w.Header().Set(requestIDHeader, id)
+			r.URL.Scheme, r.URL.Host = "http", host
+			r.RemoteAddr = connect.RemoteAddr
+			logRedacted("[%s] %s %s %s (in CONNECT %s)\n", r.RemoteAddr, id, r.Method, r.URL, requestID(connect.Context()))
+			p.handleHTTP(w, r)
+		}),
+		ReadHeaderTimeout: 30 * time.Second,
+		ConnState: func(c net.Conn, state http.ConnState) {
+			if state == http.StateClosed || state == http.StateHijacked {
+				ln.Close()
+			}
+		},
+		BaseContext: func(net.Listener) context.Context { return context.Background() },
+	}
+	srv.Serve(ln)
+}
+
+// hintDowngrade logs once per host that a tunnel carries plain HTTP
+func hintDowngrade(id, host string) {
+	if _, seen := downgradeHints.LoadOrStore(host, true); seen {
+		return
+	}
+	fmt.Fprintf(console, "[CONNECT] %s: the tunnel to %s carries plain HTTP; -connect-downgrade proxies such requests with logging, headers and routes\n", id, host)
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestSniffPlainHTTP(t *testing.T) {
+	for first, want := range map[string]bool{
+		"GET / HTTP/1.1\r\n":   true,
+		"OPTIONS * HTTP/1.1":   true,
+		"\x16\x03\x01\x02\x00": false,
+		"SSH-2.0-OpenSSH_9.6":  false,
+	} {
+		client, server := net.Pipe()
+		go client.Write([]byte(first))
+		br := bufio.NewReader(server)
+		if got := sniffPlainHTTP(server, br); got != want {
+			t.Errorf("Expected %v for %q, got %v", want, first, got)
+		}
+		// Nothing is consumed
+		if b, _ := br.Peek(1); b[0] != first[0] {
+			t.Errorf("Expected %q to stay buffered", first)
+		}
+		client.Close()
+		server.Close()
+	}
+}
+
+// connectThrough opens a CONNECT tunnel to host on p and returns the client side
+func connectThrough(t *testing.T, p *TailscaleProxy, host string) (net.Conn, *bufio.Reader, chan struct{}) {
+	client, server := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		req := httptest.NewRequest("CONNECT", "http://"+host, nil)
+		req.Host = host
+		req = req.WithContext(withRequestID(req.Context(), "connect-1"))
+		p.handleTunnel(&MockHijackRecorder{ResponseRecorder: httptest.NewRecorder(), ClientConn: server}, req)
+	}()
+	br := bufio.NewReader(client)
+	resp, err := http.ReadResponse(br, &http.Request{Method: "CONNECT"})
+	if err != nil || resp.StatusCode != 200 {
+		t.Fatalf("Expected the tunnel to open, got %v %v", resp, err)
+	}
+	return client, br, done
+}
+
+func TestConnectDowngrade(t *testing.T) {
+	var seen []string
+	targets := make(chan net.Conn, 1)
+	p := &TailscaleProxy{
+		Dialer: &MockDialer{DialFunc: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			client, server := net.Pipe()
+			targets <- server
+			return client, nil
+		}},
+		Transport: &MockRoundTripper{RoundTripFunc: func(req *http.Request) (*http.Response, error) {
+			seen = append(seen, req.URL.String())
+			return &http.Response{StatusCode: 200, Header: http.Header{}, Body: io.NopCloser(strings.NewReader("hello"))}, nil
+		}},
+	}
+
+	connectDowngrade = true
+	defer func() { connectDowngrade = false }()
+	out := captureStdout(t, func() {
+		client, br, done := connectThrough(t, p, "web:80")
+		<-targets
+		for range 2 {
+			io.WriteString(client, "GET /index.html HTTP/1.1\r\nHost: web\r\n\r\n")
+			resp, err := http.ReadResponse(br, nil)
+			if err != nil {
+				t.Fatalf("Expected a proxied response, got %v", err)
+			}
+			body, _ := io.ReadAll(resp.Body)
+			if string(body) != "hello" || resp.Header.Get(requestIDHeader) == "" {
+				t.Errorf("Unexpected response %d %q %v", resp.StatusCode, body, resp.Header)
+			}
+		}
+		client.Close()
+		<-done
+	})
+	if len(seen) != 2 || seen[0] != "http://web:80/index.html" {
+		t.Errorf("Expected both requests on the HTTP path, got %v", seen)
+	}
+	if !strings.Contains(out, "GET http://web:80/index.html (in CONNECT connect-1)") {
+		t.Errorf("Expected the requests to be logged, got %q", out)
+	}
+}
+
+func TestConnectPlainHTTPHint(t *testing.T) {
+	targets := make(chan net.Conn, 1)
+	p := &TailscaleProxy{Dialer: &MockDialer{DialFunc: func(ctx context.Context, network, addr string) (net.Conn, error) {
+		client, server := net.Pipe()
+		targets <- server
+		return client, nil
+	}}}
+	downgradeHints.Delete("hinted:80")
+
+	out := captureStdout(t, func() {
+		client, _, done := connectThrough(t, p, "hinted:80")
+		target := <-targets
+		request := "GET / HTTP/1.1\r\nHost: hinted\r\n\r\n"
+		go io.WriteString(client, request)
+		got := make([]byte, len(request))
+		if _, err := io.ReadFull(target, got); err != nil || string(got) != request {
+			t.Errorf("Expected the request to be tunneled unchanged, got %q %v", got, err)
+		}
+		client.Close()
+		target.Close()
+		<-done
+	})
+	if !strings.Contains(out, "the tunnel to hinted:80 carries plain HTTP; -connect-downgrade") {
+		t.Errorf("Expected a hint, got %q", out)
+	}
+}
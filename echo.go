@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// --- ECHO / SELFTEST ---
+
+// echoTCPPort is the classic echo port; tailnet listeners need no privileges.
+const echoTCPPort = "7"
+
+// EchoResponse is what the HTTP echo server returns for every request
+type EchoResponse struct {
+	Hostname   string              `json:"hostname"`
+	RemoteAddr string              `json:"remote_addr"`
+	Method     string              `json:"method"`
+	Path       string              `json:"path"`
+	Headers    map[string][]string `json:"headers"`
+	Body       string              `json:"body"`
+}
+
+// echoHandler answers every request with a description of itself.
+func echoHandler(hostname string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+		if err != nil {
+			http.Error(w, fmt.Sprintf("failed to read body: %v", err), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(EchoResponse{
+			Hostname:   hostname,
+			RemoteAddr: r.RemoteAddr,
+			Method:     r.Method,
+			Path:       r.URL.Path,
+			Headers:    r.Header,
+			Body:       string(body),
+		})
+	})
+}
+
+// serveEchoTCP writes back whatever each connection sends.
+func serveEchoTCP(ln net.Listener) error {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		go func() {
+			defer conn.Close()
+			fmt.Fprintf(console, "[ECHO] TCP from %s\n", conn.RemoteAddr())
+			io.Copy(conn, conn)
+		}()
+	}
+}
+
+// selftest checks TCP and HTTP echo against peer, which runs `-mode echo`.
+// Each step is reported on out; the first failure is returned.
+func selftest(ctx context.Context, d Dialer, peer, httpPort string, out io.Writer) error {
+	payload := make([]byte, 16)
+	rand.Read(payload)
+	token := hex.EncodeToString(payload)
+
+	// 1. Raw TCP round trip
+	start := time.Now()
+	conn, err := d.Dial(ctx, "tcp", net.JoinHostPort(peer, echoTCPPort))
+	if err != nil {
+		return fmt.Errorf("tcp: dial %s failed: %w", peer, err)
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if _, err := conn.Write([]byte(token)); err != nil {
+		return fmt.Errorf("tcp: write failed: %w", err)
+	}
+	got := make([]byte, len(token))
+	if _, err := io.ReadFull(conn, got); err != nil {
+		return fmt.Errorf("tcp: read failed: %w", err)
+	}
+	if string(got) != token {
+		return fmt.Errorf("tcp: echo mismatch")
+	}
+	fmt.Fprintf(out, "[SELFTEST] tcp %s:%s ok (rtt %s)\n", peer, echoTCPPort, time.Since(start).Round(time.Millisecond))
+
+	// 2. HTTP round trip
+	client := &http.Client{Transport: &http.Transport{DialContext: d.Dial}}
+	url := fmt.Sprintf("http://%s/selftest", net.JoinHostPort(peer, httpPort))
+	start = time.Now()
+	req, err := http.NewRequestWithContext(ctx, "POST", url, strings.NewReader(token))
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("http: %w", err)
+	}
+	defer resp.Body.Close()
+	var echo EchoResponse
+	if err := json.NewDecoder(resp.Body).Decode(&echo); err != nil {
+		return fmt.Errorf("http: %s did not answer like an echo server: %w", url, err)
+	}
+	if resp.StatusCode != http.StatusOK || !bytes.Equal([]byte(echo.Body), []byte(token)) {
+		return fmt.Errorf("http: echo mismatch (%s)", resp.Status)
+	}
+	fmt.Fprintf(out, "[SELFTEST] http %s ok, answered by %s (rtt %s)\n", url, echo.Hostname, time.Since(start).Round(time.Millisecond))
+	return nil
+}
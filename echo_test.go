@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSelftestAgainstEchoServers(t *testing.T) {
+	tcpLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer tcpLn.Close()
+	go serveEchoTCP(tcpLn)
+
+	httpServer := httptest.NewServer(echoHandler("echo-node"))
+	defer httpServer.Close()
+
+	// Route the echo ports of "echo-node" to the local servers
+	mockDialer := &MockDialer{
+		DialFunc: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			target := httpServer.Listener.Addr().String()
+			if addr == "echo-node:"+echoTCPPort {
+				target = tcpLn.Addr().String()
+			}
+			return net.Dial(network, target)
+		},
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var out bytes.Buffer
+	if err := selftest(ctx, mockDialer, "echo-node", "8080", &out); err != nil {
+		t.Fatalf("selftest failed: %v", err)
+	}
+	if !strings.Contains(out.String(), "tcp echo-node:7 ok") || !strings.Contains(out.String(), "answered by echo-node") {
+		t.Errorf("Unexpected report:\n%s", out.String())
+	}
+}
+
+func TestSelftestDetectsNonEchoPeer(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Write([]byte("something else entirely!!!!!!!!!"))
+			conn.Close()
+		}
+	}()
+
+	mockDialer := &MockDialer{
+		DialFunc: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return net.Dial(network, ln.Addr().String())
+		},
+	}
+	if err := selftest(context.Background(), mockDialer, "peer", "8080", &bytes.Buffer{}); err == nil || !strings.Contains(err.Error(), "tcp") {
+		t.Errorf("Expected tcp echo failure, got %v", err)
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+)
+
+// --- ERROR CODES ---
+
+// ErrorCode names the kind of a failure for the parent process. It is the
+// first field of every @@SIDECAR:ERROR@@ and @@SIDECAR:REQUEST_FAILED@@
+// line (code=BIND_IN_USE ...) and of /errors entries, so a parent can map
+// it to a remediation step instead of matching the English message.
+// Codes are never renamed; new ones may be added.
+type ErrorCode string
+
+const (
+	CodeAuthFailed          ErrorCode = "AUTH_FAILED"          // the auth key or OAuth client was rejected
+	CodeStateLocked         ErrorCode = "STATE_LOCKED"         // another sidecar uses the state directory
+	CodeBindInUse           ErrorCode = "BIND_IN_USE"          // a listen address is taken
+	CodeTailnetTimeout      ErrorCode = "TAILNET_TIMEOUT"      // the node or a peer didn't answer in time
+	CodeTailnetFailed       ErrorCode = "TAILNET_FAILED"       // the node could not start or connect
+	CodeControlUnreachable  ErrorCode = "CONTROL_UNREACHABLE"  // -control-url failed its check
+	CodeClockSkew           ErrorCode = "CLOCK_SKEW"           // the local clock is too far off
+	CodeACLDenied           ErrorCode = "ACL_DENIED"           // tailnet ACLs or shields up rejected a dial
+	CodeConnectionRefused   ErrorCode = "CONNECTION_REFUSED"   // nothing listens on the destination port
+	CodeDialFailed          ErrorCode = "DIAL_FAILED"          // any other failed dial
+	CodeSessionDenied       ErrorCode = "SESSION_DENIED"       // a session may not make the request
+	CodeOverloaded          ErrorCode = "OVERLOADED"           // -max-tunnels or -max-memory reached
+	CodeConfigInvalid       ErrorCode = "CONFIG_INVALID"       // a flag, the config file or a spec is wrong
+	CodeSecretUnavailable   ErrorCode = "SECRET_UNAVAILABLE"   // a keyring, file or env reference can't be read
+	CodePermissionDenied    ErrorCode = "PERMISSION_DENIED"    // the OS refused a file or port
+	CodeStorageFailed       ErrorCode = "STORAGE_FAILED"       // a state, audit, capture or cassette file failed
+	CodeListenFailed        ErrorCode = "LISTEN_FAILED"        // a listener or server stopped for another reason
+	CodeSystemProxyFailed   ErrorCode = "SYSTEM_PROXY_FAILED"  // -system-proxy could not be applied
+	CodeFIPSRequired        ErrorCode = "FIPS_REQUIRED"        // -require-fips without a FIPS module
+	CodeUnsupportedPlatform ErrorCode = "UNSUPPORTED_PLATFORM" // the feature needs another OS
+	CodeSelftestFailed      ErrorCode = "SELFTEST_FAILED"      // selftest found a broken path
+	CodeInternal            ErrorCode = "INTERNAL"             // anything else
+)
+
+// codedError is implemented by the sidecar's own errors that know their code
+type codedError interface {
+	code() ErrorCode
+}
+
+func (e *aclDeniedError) code() ErrorCode     { return CodeACLDenied }
+func (e *overloadError) code() ErrorCode      { return CodeOverloaded }
+func (e *sessionDeniedError) code() ErrorCode { return CodeSessionDenied }
+func (e *sessionAuthError) code() ErrorCode   { return CodeSessionDenied }
+
+// classifyError picks the code for err, or fallback if nothing more
+// specific is known
+func classifyError(err error, fallback ErrorCode) ErrorCode {
+	var coded codedError
+	var netErr net.Error
+	msg := strings.ToLower(fmt.Sprint(err))
+	switch {
+	case err == nil:
+		return fallback
+	case errors.As(err, &coded):
+		return coded.code()
+	case errors.Is(err, syscall.EADDRINUSE), strings.Contains(msg, "address already in use"),
+		strings.Contains(msg, "only one usage of each socket address"): // Windows
+		return CodeBindInUse
+	case errors.Is(err, errStateLocked):
+		return CodeStateLocked
+	case errors.Is(err, os.ErrPermission):
+		return CodePermissionDenied
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return CodeConnectionRefused
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return CodeTailnetTimeout
+	case strings.Contains(msg, "invalid key"), strings.Contains(msg, "key expired"),
+		strings.Contains(msg, "401 unauthorized"), strings.Contains(msg, "403 forbidden"):
+		return CodeAuthFailed
+	}
+	return fallback
+}
+
+// signalError emits @@SIDECAR:ERROR@@ with code as its first field
+func signalError(code ErrorCode, details string) {
+	signal(SignalError, fmt.Sprintf("code=%s %s", code, details))
+}
+
+// signalCode returns the code= field leading a signal's details, if any
+func signalCode(details string) ErrorCode {
+	field, _, _ := strings.Cut(details, " ")
+	code, ok := strings.CutPrefix(field, "code=")
+	if !ok {
+		return ""
+	}
+	return ErrorCode(code)
+}
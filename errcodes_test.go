@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestClassifyError(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	_, bindErr := net.Listen("tcp", ln.Addr().String())
+
+	tests := []struct {
+		name string
+		err  error
+		want ErrorCode
+	}{
+		{"bind", bindErr, CodeBindInUse},
+		{"acl", fmt.Errorf("dial: %w", &aclDeniedError{}), CodeACLDenied},
+		{"overloaded", &overloadError{reason: "tunnels"}, CodeOverloaded},
+		{"session", &sessionAuthError{}, CodeSessionDenied},
+		{"timeout", fmt.Errorf("tsnet.Up: %w", context.DeadlineExceeded), CodeTailnetTimeout},
+		{"permission", &fs.PathError{Op: "open", Path: "/state", Err: fs.ErrPermission}, CodePermissionDenied},
+		{"auth", errors.New("tsnet.Up: backend: invalid key: unable to validate API key"), CodeAuthFailed},
+		{"oauth", errors.New("minting auth key: 401 Unauthorized: bad secret"), CodeAuthFailed},
+		{"unknown", errors.New("something else"), CodeInternal},
+	}
+	for _, tt := range tests {
+		if got := classifyError(tt.err, CodeInternal); got != tt.want {
+			t.Errorf("%s: expected %s for %v, got %s", tt.name, tt.want, tt.err, got)
+		}
+	}
+}
+
+func TestSignalCodes(t *testing.T) {
+	out := captureStdout(t, func() {
+		signalError(CodeBindInUse, "http server failed: address already in use")
+		requestFailed("r1", "connect", "gpu-node:8080", &aclDeniedError{Denial: ACLDenial{Destination: "gpu-node:8080"}})
+	})
+	if !strings.Contains(out, SignalError+" code=BIND_IN_USE http server failed") {
+		t.Errorf("Expected the code first in the error signal, got %q", out)
+	}
+	if !strings.Contains(out, SignalRequestFailed+" code=ACL_DENIED id=r1 kind=connect") {
+		t.Errorf("Expected the code first in the request failure, got %q", out)
+	}
+
+	if got := signalCode("code=STATE_LOCKED tailnet start failed"); got != CodeStateLocked {
+		t.Errorf("Expected STATE_LOCKED, got %q", got)
+	}
+	if got := signalCode("overloaded reason=\"tunnels\""); got != "" {
+		t.Errorf("Expected no code for a warning, got %q", got)
+	}
+}
@@ -0,0 +1,491 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// --- EVENT SINKS ---
+
+// sinkQueueSize bounds the events waiting for a slow sink; beyond it new
+// events are dropped rather than holding up the proxy
+const sinkQueueSize = 256
+
+// sinkTimeout bounds one webhook request or broker write
+const sinkTimeout = 5 * time.Second
+
+// sinkDrainTimeout is how long shutdown waits for queued events to go out
+const sinkDrainTimeout = 2 * time.Second
+
+// Event is one signal as the sinks see it
+type Event struct {
+	Signal  string // @@SIDECAR:READY@@, ...
+	Details string // already redacted
+	Time    time.Time
+	bare    bool // signalled without details, printed without a trailing space
+}
+
+// EventSink receives every signal. Emit must not block for long; sinks that
+// talk to the network queue events and send them from their own goroutine.
+type EventSink interface {
+	Emit(ev Event)
+	// Close sends what is still queued, within sinkDrainTimeout
+	Close()
+}
+
+// eventBus fans signals out to the sinks
+type eventBus struct {
+	mu         sync.RWMutex
+	configured []EventSink // stdout until the config file's "events" replaces it
+	builtin    []EventSink // the /errors log and JSON-RPC, whatever is configured
+}
+
+// events is what signal emits to
+var events = &eventBus{
+	configured: []EventSink{stdoutSink{}},
+	builtin:    []EventSink{recentErrors},
+}
+
+func (b *eventBus) emit(ev Event) {
+	b.mu.RLock()
+	configured, builtin := b.configured, b.builtin
+	b.mu.RUnlock()
+	for _, s := range configured {
+		s.Emit(ev)
+	}
+	for _, s := range builtin {
+		s.Emit(ev)
+	}
+}
+
+// configure replaces the configured sinks, closing the old ones
+func (b *eventBus) configure(sinks []EventSink) {
+	b.mu.Lock()
+	old := b.configured
+	b.configured = sinks
+	b.mu.Unlock()
+	for _, s := range old {
+		s.Close()
+	}
+}
+
+// add installs a sink beside the configured ones
+func (b *eventBus) add(s EventSink) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.builtin = append(b.builtin, s)
+}
+
+// close drains every sink, for shutdown
+func (b *eventBus) close() {
+	b.mu.RLock()
+	sinks := slices.Concat(b.configured, b.builtin)
+	b.mu.RUnlock()
+	var wg sync.WaitGroup
+	for _, s := range sinks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.Close()
+		}()
+	}
+	wg.Wait()
+}
+
+// EventMessage is how the JSON sinks encode an event
+type EventMessage struct {
+	Signal   string    `json:"signal"` // READY, ERROR, ... without the @@SIDECAR: markers
+	Details  string    `json:"details,omitempty"`
+	Code     ErrorCode `json:"code,omitempty"` // the code= field of errors and failed requests
+	Hostname string    `json:"hostname,omitempty"`
+	Time     string    `json:"time"`
+}
+
+func eventMessage(ev Event, hostname string) []byte {
+	data, _ := json.Marshal(EventMessage{
+		Signal:   signalName(ev.Signal),
+		Details:  ev.Details,
+		Code:     signalCode(ev.Details),
+		Hostname: hostname,
+		Time:     ev.Time.UTC().Format(time.RFC3339Nano),
+	})
+	return data
+}
+
+// consoleWriter is where the sidecar prints its log lines and signals.
+// Writes are serialized so lines from different goroutines don't interleave,
+// and tests swap the destination instead of os.Stdout.
+type consoleWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+var console = &consoleWriter{w: os.Stdout}
+
+func (c *consoleWriter) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.w.Write(p)
+}
+
+// swap redirects the console to w and returns the previous destination
+func (c *consoleWriter) swap(w io.Writer) io.Writer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	prev := c.w
+	c.w = w
+	return prev
+}
+
+// stdoutSink prints the @@SIDECAR@@ magic words, as parents expect them
+type stdoutSink struct{}
+
+func (stdoutSink) Emit(ev Event) {
+	if ev.bare {
+		fmt.Fprintln(console, ev.Signal)
+	} else {
+		fmt.Fprintf(console, "%s %s\n", ev.Signal, ev.Details)
+	}
+}
+
+func (stdoutSink) Close() {}
+
+// jsonSink prints one EventMessage per line on stdout
+type jsonSink struct{ hostname string }
+
+func (s jsonSink) Emit(ev Event) {
+	console.Write(append(eventMessage(ev, s.hostname), '\n'))
+}
+
+func (jsonSink) Close() {}
+
+// Emit makes the /errors log a sink
+func (l *errorLog) Emit(ev Event) {
+	if !ev.bare {
+		l.record(ev.Signal, ev.Details)
+	}
+}
+
+func (l *errorLog) Close() {}
+
+// Emit makes JSON-RPC subscriptions a sink
+func (s *rpcServer) Emit(ev Event) {
+	s.notify(ev.Signal, ev.Details)
+}
+
+func (s *rpcServer) Close() {}
+
+// filteredSink passes on the listed signals only
+type filteredSink struct {
+	EventSink
+	signals []string // short names
+}
+
+func (f filteredSink) Emit(ev Event) {
+	if slices.Contains(f.signals, signalName(ev.Signal)) {
+		f.EventSink.Emit(ev)
+	}
+}
+
+// asyncSink queues events for a send function running on its own
+// goroutine, dropping them while the queue is full
+type asyncSink struct {
+	name    string
+	send    func(ctx context.Context, ev Event) error
+	queue   chan Event
+	done    chan struct{}
+	mu      sync.Mutex // guards closed, so Emit never sends on a closed queue
+	closed  bool
+	dropped atomic.Int64
+	failing atomic.Bool // the last send failed; logged once per outage
+}
+
+func newAsyncSink(name string, send func(ctx context.Context, ev Event) error) *asyncSink {
+	s := &asyncSink{name: name, send: send, queue: make(chan Event, sinkQueueSize), done: make(chan struct{})}
+	go s.run()
+	return s
+}
+
+func (s *asyncSink) Emit(ev Event) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return
+	}
+	select {
+	case s.queue <- ev:
+	default:
+		if s.dropped.Add(1) == 1 {
+			fmt.Fprintf(console, "[EVENTS] %s can't keep up, dropping events\n", s.name)
+		}
+	}
+}
+
+func (s *asyncSink) run() {
+	defer close(s.done)
+	for ev := range s.queue {
+		ctx, cancel := context.WithTimeout(context.Background(), sinkTimeout)
+		err := s.send(ctx, ev)
+		cancel()
+		// Not signalled: a warning about a failing sink would go to it too
+		if err != nil && !s.failing.Swap(true) {
+			fmt.Fprintf(console, "[EVENTS] %s failed: %v\n", s.name, err)
+		} else if err == nil && s.failing.Swap(false) {
+			fmt.Fprintf(console, "[EVENTS] %s is delivering again\n", s.name)
+		}
+	}
+}
+
+func (s *asyncSink) Close() {
+	s.mu.Lock()
+	if !s.closed {
+		s.closed = true
+		close(s.queue)
+	}
+	s.mu.Unlock()
+	select {
+	case <-s.done:
+	case <-time.After(sinkDrainTimeout):
+	}
+}
+
+// SinkConfig selects one event sink in the config file's "events" list.
+// Listing sinks replaces the default stdout sink, so list "stdout" too if
+// the parent reads the magic words.
+type SinkConfig struct {
+	Type     string            `json:"type"`               // stdout, json, unix, webhook, mqtt or desktop
+	Signals  []string          `json:"signals,omitempty"`  // READY, ERROR, ...; all if empty, ALERT for desktop
+	Path     string            `json:"path,omitempty"`     // unix: socket to serve events on
+	URL      string            `json:"url,omitempty"`      // webhook: endpoint; mqtt: tcp://host:1883
+	Headers  map[string]string `json:"headers,omitempty"`  // webhook: extra headers, values may be file:/env: references
+	Topic    string            `json:"topic,omitempty"`    // mqtt: defaults to arkitekt/sidecar/<hostname>
+	Username string            `json:"username,omitempty"` // mqtt
+	Password string            `json:"password,omitempty"` // mqtt, may be a file:/env: reference
+}
+
+func (c SinkConfig) validate() error {
+	switch c.Type {
+	case "stdout", "json", "desktop":
+	case "unix":
+		if c.Path == "" {
+			return errors.New("unix sinks need a path")
+		}
+	case "webhook":
+		u, err := url.Parse(c.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("webhook sinks need an http(s) url, got %q", c.URL)
+		}
+	case "mqtt":
+		u, err := url.Parse(c.URL)
+		if err != nil || (u.Scheme != "tcp" && u.Scheme != "mqtt") || u.Host == "" {
+			return fmt.Errorf("mqtt sinks need a tcp://host:port url, got %q", c.URL)
+		}
+		if strings.ContainsAny(c.Topic, "+#") {
+			return fmt.Errorf("mqtt topic %q must not contain wildcards", c.Topic)
+		}
+	default:
+		return fmt.Errorf("unknown sink type %q (use stdout, json, unix, webhook, mqtt or desktop)", c.Type)
+	}
+	return nil
+}
+
+// newSinks builds the configured sinks. Secrets in headers and passwords
+// are resolved here, so a missing one fails at startup.
+func newSinks(configs []SinkConfig, hostname string) ([]EventSink, error) {
+	var sinks []EventSink
+	fail := func(err error) ([]EventSink, error) {
+		for _, s := range sinks {
+			s.Close()
+		}
+		return nil, err
+	}
+	for i, c := range configs {
+		var sink EventSink
+		switch c.Type {
+		case "stdout":
+			sink = stdoutSink{}
+		case "json":
+			sink = jsonSink{hostname: hostname}
+		case "unix":
+			s, err := newUnixSink(c.Path, hostname)
+			if err != nil {
+				return fail(fmt.Errorf("events[%d]: %w", i, err))
+			}
+			sink = s
+		case "webhook":
+			headers := map[string]string{}
+			for k, v := range c.Headers {
+				resolved, err := resolveRef(v)
+				if err != nil {
+					return fail(fmt.Errorf("events[%d]: header %s: %w", i, k, err))
+				}
+				secrets.addLiteral(resolved)
+				headers[k] = resolved
+			}
+			sink = newWebhookSink(c.URL, headers, hostname)
+		case "mqtt":
+			password, err := resolveRef(c.Password)
+			if err != nil {
+				return fail(fmt.Errorf("events[%d]: password: %w", i, err))
+			}
+			secrets.addLiteral(password)
+			topic := c.Topic
+			if topic == "" {
+				topic = "arkitekt/sidecar/" + hostname
+			}
+			u, _ := url.Parse(c.URL)
+			sink = newMQTTSink(&mqttClient{
+				Addr:     u.Host,
+				ClientID: "arkitekt-sidecar-" + hostname,
+				Username: c.Username,
+				Password: password,
+			}, topic, hostname)
+		case "desktop":
+			s, err := newDesktopSink()
+			if err != nil {
+				return fail(fmt.Errorf("events[%d]: %w", i, err))
+			}
+			sink = s
+			if len(c.Signals) == 0 {
+				c.Signals = desktopSignals
+			}
+		}
+		if len(c.Signals) > 0 {
+			names := make([]string, len(c.Signals))
+			for j, name := range c.Signals {
+				names[j] = strings.ToUpper(signalName(name))
+			}
+			sink = filteredSink{sink, names}
+		}
+		sinks = append(sinks, sink)
+	}
+	return sinks, nil
+}
+
+// newWebhookSink POSTs every event as an EventMessage to url
+func newWebhookSink(target string, headers map[string]string, hostname string) *asyncSink {
+	client := &http.Client{Timeout: sinkTimeout}
+	return newAsyncSink("webhook "+redactURL(target), func(ctx context.Context, ev Event) error {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, target, bytes.NewReader(eventMessage(ev, hostname)))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			return fmt.Errorf("%s answered %s", redactURL(target), resp.Status)
+		}
+		return nil
+	})
+}
+
+// redactURL drops credentials and the query, which often carries a token
+func redactURL(s string) string {
+	u, err := url.Parse(s)
+	if err != nil {
+		return "webhook"
+	}
+	u.User, u.RawQuery = nil, ""
+	return u.String()
+}
+
+// unixSink serves events as EventMessage lines to every client connected
+// to a Unix socket. Clients that don't read miss events instead of
+// stalling the others.
+type unixSink struct {
+	ln       net.Listener
+	hostname string
+
+	mu      sync.Mutex
+	clients map[net.Conn]chan []byte
+}
+
+func newUnixSink(path, hostname string) (*unixSink, error) {
+	os.Remove(path) // a socket left over from a crash
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	// Events name hosts and errors; only this user may read them
+	if err := os.Chmod(path, 0o600); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	s := &unixSink{ln: ln, hostname: hostname, clients: map[net.Conn]chan []byte{}}
+	go s.accept()
+	return s, nil
+}
+
+func (s *unixSink) accept() {
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+		ch := make(chan []byte, sinkQueueSize)
+		s.mu.Lock()
+		s.clients[conn] = ch
+		s.mu.Unlock()
+		go func() {
+			defer conn.Close()
+			for line := range ch {
+				conn.SetWriteDeadline(time.Now().Add(sinkTimeout))
+				if _, err := conn.Write(line); err != nil {
+					s.drop(conn)
+					return
+				}
+			}
+		}()
+	}
+}
+
+func (s *unixSink) drop(conn net.Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if ch, ok := s.clients[conn]; ok {
+		close(ch)
+		delete(s.clients, conn)
+	}
+}
+
+func (s *unixSink) Emit(ev Event) {
+	line := append(eventMessage(ev, s.hostname), '\n')
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, ch := range s.clients {
+		select {
+		case ch <- line:
+		default:
+		}
+	}
+}
+
+func (s *unixSink) Close() {
+	s.ln.Close() // also removes the socket
+	s.mu.Lock()
+	for conn, ch := range s.clients {
+		close(ch)
+		delete(s.clients, conn)
+	}
+	s.mu.Unlock()
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// recordingSink keeps what it was given
+type recordingSink struct {
+	events chan Event
+	closed bool
+}
+
+func (s *recordingSink) Emit(ev Event) { s.events <- ev }
+func (s *recordingSink) Close()        { s.closed = true }
+
+func TestEventBus(t *testing.T) {
+	rec := &recordingSink{events: make(chan Event, 10)}
+	bus := &eventBus{configured: []EventSink{stdoutSink{}}}
+	bus.add(rec)
+
+	out := captureStdout(t, func() {
+		bus.emit(Event{Signal: SignalReady, Details: "http://127.0.0.1:8080", Time: time.Now()})
+		bus.emit(Event{Signal: SignalReady, Time: time.Now(), bare: true})
+	})
+	if out != SignalReady+" http://127.0.0.1:8080\n"+SignalReady+"\n" {
+		t.Errorf("Expected the magic words unchanged, got %q", out)
+	}
+	if len(rec.events) != 2 {
+		t.Errorf("Expected the added sink to see both events, got %d", len(rec.events))
+	}
+
+	// Configured sinks replace stdout; added ones stay
+	filtered := &recordingSink{events: make(chan Event, 10)}
+	sinks, err := newSinks([]SinkConfig{{Type: "json", Signals: []string{"error"}}}, "lab-pc")
+	if err != nil {
+		t.Fatalf("newSinks failed: %v", err)
+	}
+	bus.configure(append(sinks, filteredSink{filtered, []string{"HEARTBEAT"}}))
+	out = captureStdout(t, func() {
+		bus.emit(Event{Signal: SignalReady, Details: "x", Time: time.Now()})
+		bus.emit(Event{Signal: SignalError, Details: "code=tailnet_auth boom", Time: time.Now()})
+	})
+	var msg EventMessage
+	if err := json.Unmarshal([]byte(out), &msg); err != nil {
+		t.Fatalf("Expected one JSON line, got %q: %v", out, err)
+	}
+	if msg.Signal != "ERROR" || msg.Code != "tailnet_auth" || msg.Hostname != "lab-pc" {
+		t.Errorf("Unexpected message %+v", msg)
+	}
+	if len(filtered.events) != 0 || len(rec.events) != 4 {
+		t.Errorf("Expected the filter to drop both and the added sink to see both, got %d and %d", len(filtered.events), len(rec.events))
+	}
+
+	bus.close()
+	if !rec.closed || !filtered.closed {
+		t.Error("Expected close to reach every sink")
+	}
+}
+
+func TestSinkConfigValidate(t *testing.T) {
+	for _, c := range []SinkConfig{
+		{Type: "syslog"},
+		{Type: "unix"},
+		{Type: "webhook", URL: "ftp://example.com"},
+		{Type: "mqtt", URL: "http://broker:1883"},
+		{Type: "mqtt", URL: "tcp://broker:1883", Topic: "lab/#"},
+	} {
+		if err := c.validate(); err == nil {
+			t.Errorf("Expected %+v to be rejected", c)
+		}
+	}
+	cfg := &Config{Events: []SinkConfig{{Type: "stdout"}, {Type: "webhook"}}}
+	if err := cfg.validate(); err == nil || !strings.HasPrefix(err.Error(), "events[1]") {
+		t.Errorf("Expected an events[1] error, got %v", err)
+	}
+}
+
+func TestWebhookSink(t *testing.T) {
+	got := make(chan *http.Request, 1)
+	bodies := make(chan EventMessage, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var msg EventMessage
+		json.NewDecoder(r.Body).Decode(&msg)
+		got <- r
+		bodies <- msg
+	}))
+	defer srv.Close()
+
+	t.Setenv("SIDECAR_TEST_HOOK_TOKEN", "hook-token-123")
+	sinks, err := newSinks([]SinkConfig{{
+		Type:    "webhook",
+		URL:     srv.URL + "/hook?token=abc",
+		Headers: map[string]string{"Authorization": "env:SIDECAR_TEST_HOOK_TOKEN"},
+	}}, "lab-pc")
+	if err != nil {
+		t.Fatalf("newSinks failed: %v", err)
+	}
+	sinks[0].Emit(Event{Signal: SignalWarning, Details: "relay", Time: time.Now()})
+	sinks[0].Close()
+
+	r := <-got
+	if r.Method != http.MethodPost || r.Header.Get("Authorization") != "hook-token-123" || r.URL.Query().Get("token") != "abc" {
+		t.Errorf("Unexpected request %s %s %v", r.Method, r.URL, r.Header)
+	}
+	if msg := <-bodies; msg.Signal != "WARNING" || msg.Details != "relay" {
+		t.Errorf("Unexpected body %+v", msg)
+	}
+	if secrets.redact("hook-token-123") == "hook-token-123" {
+		t.Error("Expected the resolved header to be redacted from logs")
+	}
+	if got := redactURL(srv.URL + "/hook?token=abc"); strings.Contains(got, "abc") {
+		t.Errorf("Expected the query to be dropped, got %q", got)
+	}
+}
+
+func TestAsyncSinkDrops(t *testing.T) {
+	release := make(chan struct{})
+	s := newAsyncSink("test", func(ctx context.Context, ev Event) error {
+		<-release
+		return nil
+	})
+	out := captureStdout(t, func() {
+		for range sinkQueueSize + 2 {
+			s.Emit(Event{Signal: SignalHeartbeat})
+		}
+	})
+	if !strings.Contains(out, "can't keep up") || s.dropped.Load() == 0 {
+		t.Errorf("Expected a dropped warning, got %q", out)
+	}
+	close(release)
+	s.Close()
+	s.Emit(Event{Signal: SignalHeartbeat}) // after Close: ignored, no panic
+}
+
+func TestUnixSink(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.sock")
+	sinks, err := newSinks([]SinkConfig{{Type: "unix", Path: path}}, "lab-pc")
+	if err != nil {
+		t.Fatalf("newSinks failed: %v", err)
+	}
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer conn.Close()
+
+	// The client is registered by the accept loop; keep emitting until it is
+	lines := bufio.NewScanner(conn)
+	done := make(chan string, 1)
+	go func() {
+		if lines.Scan() {
+			done <- lines.Text()
+		}
+		close(done)
+	}()
+	var line string
+	deadline := time.After(5 * time.Second)
+wait:
+	for {
+		sinks[0].Emit(Event{Signal: SignalReady, Details: "up", Time: time.Now()})
+		select {
+		case line = <-done:
+			break wait
+		case <-time.After(10 * time.Millisecond):
+		case <-deadline:
+			t.Fatal("No event on the socket")
+		}
+	}
+	var msg EventMessage
+	if err := json.Unmarshal([]byte(line), &msg); err != nil || msg.Signal != "READY" {
+		t.Errorf("Unexpected line %q: %v", line, err)
+	}
+	sinks[0].Close()
+}
+
+// fakeBroker accepts one MQTT client and returns the packets it sent
+func fakeBroker(t *testing.T, returnCode byte) (string, chan []byte) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	packets := make(chan []byte, 10)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		for {
+			typ, err := r.ReadByte()
+			if err != nil {
+				close(packets)
+				return
+			}
+			n, mult := 0, 1
+			for {
+				b, _ := r.ReadByte()
+				n += int(b&0x7f) * mult
+				mult *= 128
+				if b&0x80 == 0 {
+					break
+				}
+			}
+			body := make([]byte, n)
+			io.ReadFull(r, body)
+			packets <- append([]byte{typ}, body...)
+			if typ == mqttConnect {
+				conn.Write([]byte{mqttConnack, 2, 0, returnCode})
+			}
+		}
+	}()
+	return ln.Addr().String(), packets
+}
+
+func TestMQTTSink(t *testing.T) {
+	addr, packets := fakeBroker(t, 0)
+	t.Setenv("SIDECAR_TEST_MQTT_PASSWORD", "broker-secret")
+	sinks, err := newSinks([]SinkConfig{{
+		Type:     "mqtt",
+		URL:      "tcp://" + addr,
+		Username: "lab",
+		Password: "env:SIDECAR_TEST_MQTT_PASSWORD",
+	}}, "lab-pc")
+	if err != nil {
+		t.Fatalf("newSinks failed: %v", err)
+	}
+	sinks[0].Emit(Event{Signal: SignalReady, Details: "up", Time: time.Now()})
+	sinks[0].Close()
+
+	connect := <-packets
+	if connect[0] != mqttConnect || !strings.Contains(string(connect), "MQTT") ||
+		!strings.Contains(string(connect), "arkitekt-sidecar-lab-pc") || !strings.Contains(string(connect), "broker-secret") {
+		t.Errorf("Unexpected CONNECT %q", connect)
+	}
+	publish := <-packets
+	topic := "arkitekt/sidecar/lab-pc"
+	if publish[0] != mqttPublish || string(publish[3:3+len(topic)]) != topic {
+		t.Fatalf("Unexpected PUBLISH %q", publish)
+	}
+	var msg EventMessage
+	if err := json.Unmarshal(publish[3+len(topic):], &msg); err != nil || msg.Signal != "READY" {
+		t.Errorf("Unexpected payload %q: %v", publish[3+len(topic):], err)
+	}
+	if disconnect := <-packets; len(disconnect) != 1 || disconnect[0] != mqttDisconnect {
+		t.Errorf("Expected DISCONNECT, got %q", disconnect)
+	}
+
+	// A refused connection is an error, not a silent success
+	addr, _ = fakeBroker(t, 5)
+	client := &mqttClient{Addr: addr, ClientID: "x"}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := client.publish(ctx, "t", []byte("{}")); err == nil || !strings.Contains(err.Error(), "return code 5") {
+		t.Errorf("Expected a refusal, got %v", err)
+	}
+}
+
+func TestMQTTPacketLength(t *testing.T) {
+	pkt := mqttPacket(mqttPublish, make([]byte, 321))
+	if pkt[1] != 0xc1 || pkt[2] != 0x02 || len(pkt) != 324 {
+		t.Errorf("Expected a two-byte remaining length, got % x", pkt[:3])
+	}
+}
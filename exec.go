@@ -0,0 +1,93 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	ossignal "os/signal"
+	"strings"
+	"syscall"
+)
+
+// --- EXEC ---
+
+// proxyEnvVars are set for a child started with `sidecar exec`. Both
+// spellings are needed: curl only reads the lowercase http_proxy, most
+// other tools prefer the uppercase names.
+var proxyEnvVars = []string{
+	"HTTP_PROXY", "HTTPS_PROXY", "ALL_PROXY",
+	"http_proxy", "https_proxy", "all_proxy",
+}
+
+// proxyEnv returns environ with every proxy variable replaced by proxyURL.
+func proxyEnv(environ []string, proxyURL string) []string {
+	env := make([]string, 0, len(environ)+len(proxyEnvVars))
+	for _, kv := range environ {
+		name, _, _ := strings.Cut(kv, "=")
+		replaced := false
+		for _, v := range proxyEnvVars {
+			if name == v {
+				replaced = true
+				break
+			}
+		}
+		if !replaced {
+			env = append(env, kv)
+		}
+	}
+	for _, v := range proxyEnvVars {
+		env = append(env, v+"="+proxyURL)
+	}
+	return env
+}
+
+// runChild runs command with env, passing through stdio and forwarding
+// SIGINT/SIGTERM, and returns its exit code. A command that cannot be
+// started returns 127 like a shell would.
+func runChild(command []string, env []string) int {
+	cmd := exec.Command(command[0], command[1:]...)
+	cmd.Env = env
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	if err := cmd.Start(); err != nil {
+		fmt.Fprintf(console, "!!! Failed to start %s: %v\n", command[0], err)
+		return 127
+	}
+
+	sigs := make(chan os.Signal, 1)
+	ossignal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	defer ossignal.Stop(sigs)
+	go func() {
+		for sig := range sigs {
+			cmd.Process.Signal(sig)
+		}
+	}()
+
+	err := cmd.Wait()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		if code := exitErr.ExitCode(); code >= 0 {
+			return code
+		}
+		return 1 // killed by a signal
+	}
+	if err != nil {
+		return 1
+	}
+	return 0
+}
+
+// execChild runs the `sidecar exec` command against the proxy at proxyURL,
+// then shuts the node down and exits with the child's exit code.
+func execChild(command []string, proxyURL string, node io.Closer) {
+	fmt.Fprintf(console, ">>> Running %s via %s\n", strings.Join(command, " "), proxyURL)
+	code := runChild(command, proxyEnv(os.Environ(), proxyURL))
+	signal(SignalShutdown, fmt.Sprintf("exit=%d", code))
+	events.close()
+	node.Close()
+	os.Exit(code)
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"runtime"
+	"slices"
+	"testing"
+)
+
+func TestProxyEnvReplacesProxyVars(t *testing.T) {
+	env := proxyEnv([]string{"PATH=/bin", "http_proxy=http://old:3128", "NO_PROXY=localhost"}, "http://127.0.0.1:8080")
+
+	for _, kv := range []string{"PATH=/bin", "NO_PROXY=localhost", "http_proxy=http://127.0.0.1:8080", "ALL_PROXY=http://127.0.0.1:8080"} {
+		if !slices.Contains(env, kv) {
+			t.Errorf("Expected %q in %v", kv, env)
+		}
+	}
+	if slices.Contains(env, "http_proxy=http://old:3128") {
+		t.Errorf("Expected old http_proxy to be replaced, got %v", env)
+	}
+}
+
+func TestRunChildForwardsExitCode(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("needs sh")
+	}
+	if code := runChild([]string{"sh", "-c", "exit 3"}, os.Environ()); code != 3 {
+		t.Errorf("Expected exit code 3, got %d", code)
+	}
+	if code := runChild([]string{"sh", "-c", `test "$HTTPS_PROXY" = http://proxy`}, proxyEnv(os.Environ(), "http://proxy")); code != 0 {
+		t.Errorf("Expected child to see HTTPS_PROXY, got exit code %d", code)
+	}
+	if _, err := exec.LookPath("sidecar-no-such-command"); err == nil {
+		t.Skip("unexpected command on PATH")
+	}
+	if code := runChild([]string{"sidecar-no-such-command"}, nil); code != 127 {
+		t.Errorf("Expected 127 for a missing command, got %d", code)
+	}
+}
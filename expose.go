@@ -0,0 +1,490 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"tailscale.com/tsnet"
+)
+
+// --- EXPOSE ---
+
+// ExposeRule publishes a local service on a port of this node's tailnet
+// address. HTTP services are reverse-proxied, so they learn who called from
+// the forwarding and identity headers; anything else can be passed through
+// as TCP with a PROXY protocol header instead.
+type ExposeRule struct {
+	Port          int      `json:"port"`                     // tailnet port
+	Target        string   `json:"target"`                   // local host:port, or dir:/path to serve a directory
+	ProxyProtocol string   `json:"proxy_protocol,omitempty"` // "v2" to pass TCP through with a PROXY protocol header instead of proxying HTTP
+	TLS           bool     `json:"tls,omitempty"`            // serve HTTPS with the node's tailnet certificate
+	HSTS          string   `json:"hsts,omitempty"`           // Strict-Transport-Security max-age of HTTPS responses, e.g. "8760h"
+	Path          string   `json:"path,omitempty"`           // URL path prefix sent to this target, "/" if empty
+	StripPrefix   bool     `json:"strip_prefix,omitempty"`   // remove path before passing requests on
+	Listing       bool     `json:"listing,omitempty"`        // list directories without an index.html (dir targets)
+	Allow         []string `json:"allow,omitempty"`          // tailnet hostnames, tags ("tag:ops") or login names; everyone if empty
+	Funnel        bool     `json:"funnel,omitempty"`         // also publish on the public internet with Tailscale Funnel
+	AllowPublic   bool     `json:"allow_public,omitempty"`   // confirms that funnel makes the service public
+}
+
+// funnelPorts are the ports Tailscale Funnel accepts
+var funnelPorts = []int{443, 8443, 10000}
+
+// dirTargetPrefix marks a target that is a local directory
+const dirTargetPrefix = "dir:"
+
+// dir is the directory a dir: target serves, "" for other targets
+func (r ExposeRule) dir() string {
+	dir, _ := strings.CutPrefix(r.Target, dirTargetPrefix)
+	if dir == r.Target {
+		return ""
+	}
+	return dir
+}
+
+// Identity headers sent to exposed HTTP services. Incoming copies are
+// dropped, so a caller can't claim to be someone else.
+const (
+	exposeLoginHeader = "Tailscale-User-Login" // as tailscale serve sends it
+	exposeNodeHeader  = "X-Sidecar-Peer"
+	exposeTagsHeader  = "X-Sidecar-Peer-Tags"
+)
+
+// exposePrefixHeader tells a target the path prefix that was stripped
+const exposePrefixHeader = "X-Forwarded-Prefix"
+
+// exposeDialTimeout bounds dials to local targets
+const exposeDialTimeout = 10 * time.Second
+
+func (r ExposeRule) validate() error {
+	if r.Port < 1 || r.Port > 65535 {
+		return fmt.Errorf("invalid port %d", r.Port)
+	}
+	if strings.HasPrefix(r.Target, dirTargetPrefix) {
+		if !filepath.IsAbs(r.dir()) {
+			return fmt.Errorf("target %q needs an absolute path", r.Target)
+		}
+		if r.ProxyProtocol != "" {
+			return errors.New("dir targets can't use proxy_protocol")
+		}
+	} else if _, _, err := net.SplitHostPort(r.Target); err != nil {
+		return fmt.Errorf("target must be host:port or dir:/path, got %q", r.Target)
+	} else if r.Listing {
+		return errors.New("listing needs a dir target")
+	}
+	if r.ProxyProtocol != "" && r.ProxyProtocol != ProxyProtocolV2 {
+		return fmt.Errorf("unknown proxy_protocol %q", r.ProxyProtocol)
+	}
+	if r.TLS && r.ProxyProtocol != "" {
+		return errors.New("tls and proxy_protocol can't be combined")
+	}
+	if r.Path != "" && !strings.HasPrefix(r.Path, "/") {
+		return fmt.Errorf("path %q must start with '/'", r.Path)
+	}
+	if r.StripPrefix && strings.TrimSuffix(r.Path, "/") == "" {
+		return errors.New("strip_prefix needs a path")
+	}
+	if r.ProxyProtocol != "" && r.Path != "" {
+		return errors.New("path and proxy_protocol can't be combined")
+	}
+	if r.Funnel {
+		switch {
+		case !r.AllowPublic:
+			return errors.New("funnel makes the service reachable from the internet; set allow_public to confirm")
+		case !slices.Contains(funnelPorts, r.Port):
+			return fmt.Errorf("funnel only works on ports 443, 8443 and 10000, not %d", r.Port)
+		case r.ProxyProtocol != "":
+			return errors.New("funnel and proxy_protocol can't be combined")
+		case len(r.Allow) > 0:
+			return errors.New("allow can't restrict callers from the internet; drop funnel or allow")
+		}
+	} else if r.AllowPublic {
+		return errors.New("allow_public needs funnel")
+	}
+	if r.HSTS != "" {
+		if !r.TLS && !r.Funnel {
+			return errors.New("hsts needs tls")
+		}
+		if d, err := time.ParseDuration(r.HSTS); err != nil || d <= 0 {
+			return fmt.Errorf("invalid hsts %q", r.HSTS)
+		}
+	}
+	return nil
+}
+
+// prefix is the rule's path without a trailing slash, "" for everything
+func (r ExposeRule) prefix() string {
+	return strings.TrimSuffix(r.Path, "/")
+}
+
+// serves reports whether the rule's path covers a request path
+func (r ExposeRule) serves(path string) bool {
+	p := r.prefix()
+	return p == "" || path == p || strings.HasPrefix(path, p+"/")
+}
+
+// Rules on the same port share a listener, so they have to agree on how
+// it is served, and their paths tell them apart.
+func validateExpose(rules []ExposeRule) error {
+	first := map[int]ExposeRule{}
+	paths := map[string]bool{}
+	for i, r := range rules {
+		if err := r.validate(); err != nil {
+			return fmt.Errorf("expose[%d]: %w", i, err)
+		}
+		key := fmt.Sprintf("%d%s", r.Port, r.prefix())
+		if paths[key] {
+			return fmt.Errorf("expose[%d]: port %d path %q is exposed twice", i, r.Port, r.Path)
+		}
+		paths[key] = true
+		if f, ok := first[r.Port]; ok && (f.ProxyProtocol != "" || r.ProxyProtocol != "" || f.TLS != r.TLS || f.HSTS != r.HSTS || f.Funnel != r.Funnel) {
+			return fmt.Errorf("expose[%d]: rules on port %d need the same tls, hsts and funnel, without proxy_protocol", i, r.Port)
+		} else if !ok {
+			first[r.Port] = r
+		}
+	}
+	return nil
+}
+
+// exposePorts groups the rules by port, in the order ports first appear
+func exposePorts(rules []ExposeRule) [][]ExposeRule {
+	var groups [][]ExposeRule
+	index := map[int]int{}
+	for _, r := range rules {
+		i, ok := index[r.Port]
+		if !ok {
+			i = len(groups)
+			index[r.Port] = i
+			groups = append(groups, nil)
+		}
+		groups[i] = append(groups[i], r)
+	}
+	return groups
+}
+
+// exposePaths sends each request to the rule with the longest path that
+// covers it
+func exposePaths(rules []ExposeRule, whois func(ctx context.Context, addr string) (execCaller, error)) http.Handler {
+	if len(rules) == 1 && rules[0].prefix() == "" {
+		return exposeTarget(rules[0], whois)
+	}
+	rules = slices.Clone(rules)
+	slices.SortStableFunc(rules, func(a, b ExposeRule) int { return len(b.prefix()) - len(a.prefix()) })
+	handlers := make([]http.Handler, len(rules))
+	for i, r := range rules {
+		handlers[i] = exposeTarget(r, whois)
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for i, rule := range rules {
+			if rule.serves(r.URL.Path) {
+				handlers[i].ServeHTTP(w, r)
+				return
+			}
+		}
+		http.Error(w, fmt.Sprintf("nothing is exposed at %s", r.URL.Path), http.StatusNotFound)
+	})
+}
+
+// exposeCallerKey carries the caller identified by exposeAuthorize
+type exposeCallerKey struct{}
+
+// authorized identifies the caller at addr and checks it against the
+// rule's allow list
+func (r ExposeRule) authorized(ctx context.Context, addr string, whois func(ctx context.Context, addr string) (execCaller, error)) (execCaller, error) {
+	caller, err := whois(ctx, addr)
+	if err != nil {
+		fmt.Fprintf(console, "[EXPOSE] Refusing %s on port %d%s: unknown caller: %v\n", addr, r.Port, cmp.Or(r.Path, "/"), err)
+		return execCaller{}, fmt.Errorf("unknown caller %s", addr)
+	}
+	if !caller.allowed(r.Allow) {
+		fmt.Fprintf(console, "[EXPOSE] Refusing %s on port %d%s: not in allow\n", caller, r.Port, cmp.Or(r.Path, "/"))
+		audit.record("denied", "by", "expose", "source", caller.String(), "port", strconv.Itoa(r.Port), "path", cmp.Or(r.Path, "/"))
+		return caller, fmt.Errorf("%s may not reach this service", caller)
+	}
+	return caller, nil
+}
+
+// exposeAuthorize refuses callers outside the rule's allow list before
+// anything reaches the target
+func exposeAuthorize(rule ExposeRule, whois func(ctx context.Context, addr string) (execCaller, error), next http.Handler) http.Handler {
+	if len(rule.Allow) == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		caller, err := rule.authorized(r.Context(), r.RemoteAddr, whois)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), exposeCallerKey{}, caller)))
+	})
+}
+
+// exposeTarget serves the rule's directory or proxies to its service, for
+// allowed callers
+func exposeTarget(rule ExposeRule, whois func(ctx context.Context, addr string) (execCaller, error)) http.Handler {
+	return exposeAuthorize(rule, whois, exposeBackend(rule, whois))
+}
+
+func exposeBackend(rule ExposeRule, whois func(ctx context.Context, addr string) (execCaller, error)) http.Handler {
+	if dir := rule.dir(); dir != "" {
+		prefix, files := rule.prefix(), exposeDir(dir, rule.Listing)
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// Relative links in the directory need the trailing slash
+			if prefix != "" && r.URL.Path == prefix {
+				http.Redirect(w, r, prefix+"/", http.StatusMovedPermanently)
+				return
+			}
+			http.StripPrefix(prefix, files).ServeHTTP(w, r)
+		})
+	}
+	return exposeHandler(rule, whois)
+}
+
+// exposeDir serves the files below dir, with range requests, and hides
+// dot files such as .git
+func exposeDir(dir string, listing bool) http.Handler {
+	files := http.FileServer(dirFS{http.Dir(dir), listing})
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, part := range strings.Split(r.URL.Path, "/") {
+			if strings.HasPrefix(part, ".") {
+				http.NotFound(w, r)
+				return
+			}
+		}
+		files.ServeHTTP(w, r)
+	})
+}
+
+// dirFS hides directories without an index.html unless listing is on
+type dirFS struct {
+	http.FileSystem
+	listing bool
+}
+
+func (fs dirFS) Open(name string) (http.File, error) {
+	f, err := fs.FileSystem.Open(name)
+	if err != nil || fs.listing {
+		return f, err
+	}
+	if st, err := f.Stat(); err == nil && st.IsDir() {
+		index, err := fs.FileSystem.Open(path.Join(name, "index.html"))
+		if err != nil {
+			f.Close()
+			return nil, os.ErrNotExist
+		}
+		index.Close()
+	}
+	return f, nil
+}
+
+// exposeHandler reverse-proxies requests from the tailnet to the rule's
+// target, telling it the caller's tailnet address and identity
+func exposeHandler(rule ExposeRule, whois func(ctx context.Context, addr string) (execCaller, error)) http.Handler {
+	target := &url.URL{Scheme: "http", Host: rule.Target}
+	proxy := &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			if rule.StripPrefix {
+				pr.Out.URL.Path = "/" + strings.TrimPrefix(strings.TrimPrefix(pr.In.URL.Path, rule.prefix()), "/")
+				pr.Out.URL.RawPath = ""
+			}
+			pr.SetURL(target)
+			pr.Out.Host = pr.In.Host
+			pr.SetXForwarded()
+			pr.Out.Header.Del(exposePrefixHeader)
+			if rule.StripPrefix {
+				pr.Out.Header.Set(exposePrefixHeader, rule.prefix())
+			}
+			pr.Out.Header.Set("Forwarded", forwardedHeader(pr.In))
+			for _, h := range []string{exposeLoginHeader, exposeNodeHeader, exposeTagsHeader} {
+				pr.Out.Header.Del(h)
+			}
+			if rule.Funnel {
+				// Public callers have no tailnet identity, and a service
+				// that trusts the headers shouldn't be on the internet
+				return
+			}
+			caller, known := pr.In.Context().Value(exposeCallerKey{}).(execCaller)
+			var err error
+			if !known {
+				caller, err = whois(pr.In.Context(), pr.In.RemoteAddr)
+			}
+			if err != nil {
+				fmt.Fprintf(console, "[EXPOSE] :%d: caller %s unknown: %v\n", rule.Port, pr.In.RemoteAddr, err)
+				return
+			}
+			pr.Out.Header.Set(exposeNodeHeader, caller.Host)
+			if caller.Login != "" {
+				pr.Out.Header.Set(exposeLoginHeader, caller.Login)
+			}
+			if len(caller.Tags) > 0 {
+				pr.Out.Header.Set(exposeTagsHeader, strings.Join(caller.Tags, ","))
+			}
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			fmt.Fprintf(console, "[EXPOSE] :%d: %s %s failed: %v\n", rule.Port, r.Method, r.URL.Path, err)
+			http.Error(w, fmt.Sprintf("%s is not answering", rule.Target), http.StatusBadGateway)
+		},
+	}
+	return proxy
+}
+
+// withHSTS adds the rule's Strict-Transport-Security header to responses
+func withHSTS(rule ExposeRule, next http.Handler) http.Handler {
+	if rule.HSTS == "" {
+		return next
+	}
+	d, _ := time.ParseDuration(rule.HSTS)
+	value := fmt.Sprintf("max-age=%d", int64(d.Seconds()))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Strict-Transport-Security", value)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// redirectRule is the HTTPS rule plain HTTP on port 80 is sent to: the
+// first one with tls, unless a rule exposes port 80 itself
+func redirectRule(rules []ExposeRule) (ExposeRule, bool) {
+	if slices.ContainsFunc(rules, func(r ExposeRule) bool { return r.Port == 80 }) {
+		return ExposeRule{}, false
+	}
+	i := slices.IndexFunc(rules, func(r ExposeRule) bool { return r.TLS })
+	if i < 0 {
+		return ExposeRule{}, false
+	}
+	return rules[i], true
+}
+
+// httpsRedirect sends requests to the same host and path over HTTPS on
+// the rule's port
+func httpsRedirect(rule ExposeRule) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := addrHost(r.Host)
+		if rule.Port != 443 {
+			host = net.JoinHostPort(host, strconv.Itoa(rule.Port))
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusPermanentRedirect)
+	})
+}
+
+// forwardedHeader is the RFC 7239 Forwarded header for a request from the
+// tailnet
+func forwardedHeader(r *http.Request) string {
+	proto := "http"
+	if r.TLS != nil {
+		proto = "https"
+	}
+	return fmt.Sprintf("for=%q;host=%q;proto=%s", r.RemoteAddr, r.Host, proto)
+}
+
+// serveExposeRaw passes connections from the tailnet through to the rule's
+// target, each one starting with a PROXY protocol v2 header
+func serveExposeRaw(ln net.Listener, rule ExposeRule, whois func(ctx context.Context, addr string) (execCaller, error)) error {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		go func() {
+			defer conn.Close()
+			if len(rule.Allow) > 0 {
+				if _, err := rule.authorized(context.Background(), conn.RemoteAddr().String(), whois); err != nil {
+					return
+				}
+			}
+			local, err := net.DialTimeout("tcp", rule.Target, exposeDialTimeout)
+			if err != nil {
+				fmt.Fprintf(console, "[EXPOSE] :%d: %s -> %s failed: %v\n", rule.Port, conn.RemoteAddr(), rule.Target, err)
+				return
+			}
+			defer local.Close()
+			if _, err := local.Write(proxyHeaderV2(conn.RemoteAddr().String(), conn.LocalAddr().String())); err != nil {
+				return
+			}
+			go io.Copy(local, conn)
+			io.Copy(conn, local)
+		}()
+	}
+}
+
+// tailnetListener is the part of tsnet.Server exposing needs
+type tailnetListener interface {
+	Listen(network, addr string) (net.Listener, error)
+	ListenTLS(network, addr string) (net.Listener, error)
+	ListenFunnel(network, addr string, opts ...tsnet.FunnelOption) (net.Listener, error)
+}
+
+// startExpose listens on the tailnet ports of the rules and serves them in
+// the background
+func startExpose(tn tailnetListener, rules []ExposeRule, whois func(ctx context.Context, addr string) (execCaller, error)) error {
+	for _, group := range exposePorts(rules) {
+		rule := group[0]
+		addr := fmt.Sprintf(":%d", rule.Port)
+		var ln net.Listener
+		var err error
+		switch {
+		case rule.Funnel:
+			ln, err = tn.ListenFunnel("tcp", addr)
+		case rule.TLS:
+			ln, err = tn.ListenTLS("tcp", addr)
+		default:
+			ln, err = tn.Listen("tcp", addr)
+		}
+		if err != nil {
+			return fmt.Errorf("expose port %d: %w", rule.Port, err)
+		}
+		if rule.ProxyProtocol == ProxyProtocolV2 {
+			fmt.Fprintf(console, ">>> Exposing %s on tailnet port %d (TCP with PROXY protocol v2)\n", rule.Target, rule.Port)
+			go serveExposeRaw(ln, rule, whois)
+			continue
+		}
+		scheme := "HTTP"
+		if rule.TLS {
+			scheme = "HTTPS"
+		}
+		if rule.Funnel {
+			scheme = "HTTPS, public through Funnel"
+			signal(SignalWarning, fmt.Sprintf("expose_public port=%d", rule.Port))
+		}
+		for _, r := range group {
+			if dir := r.dir(); dir != "" {
+				if st, err := os.Stat(dir); err != nil || !st.IsDir() {
+					ln.Close()
+					return fmt.Errorf("expose port %d: %s is not a directory", r.Port, dir)
+				}
+			}
+			fmt.Fprintf(console, ">>> Exposing %s on tailnet port %d%s (%s)\n", r.Target, r.Port, cmp.Or(r.Path, "/"), scheme)
+		}
+		go serveExpose(ln, rule.Port, withHSTS(rule, exposePaths(group, whois)))
+	}
+
+	if rule, ok := redirectRule(rules); ok {
+		ln, err := tn.Listen("tcp", ":80")
+		if err != nil {
+			return fmt.Errorf("expose HTTPS redirect: %w", err)
+		}
+		fmt.Fprintf(console, ">>> Redirecting tailnet port 80 to HTTPS on port %d\n", rule.Port)
+		go serveExpose(ln, 80, httpsRedirect(rule))
+	}
+	return nil
+}
+
+func serveExpose(ln net.Listener, port int, h http.Handler) {
+	if err := http.Serve(ln, h); err != nil && !errors.Is(err, net.ErrClosed) {
+		fmt.Fprintf(console, "!!! Expose on port %d stopped: %v\n", port, err)
+	}
+}
@@ -0,0 +1,379 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"tailscale.com/tsnet"
+)
+
+func TestValidateExpose(t *testing.T) {
+	for _, rules := range [][]ExposeRule{
+		{{Port: 0, Target: "127.0.0.1:3000"}},
+		{{Port: 80, Target: "3000"}},
+		{{Port: 80, Target: "127.0.0.1:3000", ProxyProtocol: "v1"}},
+		{{Port: 80, Target: "127.0.0.1:3000"}, {Port: 80, Target: "127.0.0.1:3001"}},
+	} {
+		if err := validateExpose(rules); err == nil {
+			t.Errorf("Expected %+v to be rejected", rules)
+		}
+	}
+}
+
+func TestExposeHandlerHeaders(t *testing.T) {
+	var got http.Header
+	var host string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got, host = r.Header.Clone(), r.Host
+		io.WriteString(w, "ok")
+	}))
+	defer backend.Close()
+
+	whois := func(ctx context.Context, addr string) (execCaller, error) {
+		if addr != "100.64.0.7:50312" {
+			return execCaller{}, errors.New("unknown")
+		}
+		return execCaller{Host: "laptop", Login: "anna@lab.example"}, nil
+	}
+	h := exposeHandler(ExposeRule{Port: 80, Target: backend.Listener.Addr().String()}, whois)
+
+	req := httptest.NewRequest("GET", "http://gpu-node/results", nil)
+	req.RemoteAddr = "100.64.0.7:50312"
+	req.Header.Set("X-Forwarded-For", "10.0.0.1")
+	req.Header.Set(exposeTagsHeader, "tag:admin")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != 200 || rec.Body.String() != "ok" {
+		t.Fatalf("Expected the backend's answer, got %d %q", rec.Code, rec.Body)
+	}
+	if host != "gpu-node" {
+		t.Errorf("Expected the original Host, got %q", host)
+	}
+	for name, want := range map[string]string{
+		"X-Forwarded-For":   "100.64.0.7",
+		"Forwarded":         `for="100.64.0.7:50312";host="gpu-node";proto=http`,
+		exposeLoginHeader:   "anna@lab.example",
+		exposeNodeHeader:    "laptop",
+		exposeTagsHeader:    "",
+		"X-Forwarded-Proto": "http",
+	} {
+		if got.Get(name) != want {
+			t.Errorf("Expected %s: %q, got %q", name, want, got.Get(name))
+		}
+	}
+
+	// Unknown callers get through without an identity
+	req = httptest.NewRequest("GET", "http://gpu-node/results", nil)
+	req.RemoteAddr = "100.64.0.9:1234"
+	req.Header.Set(exposeLoginHeader, "admin@lab.example")
+	captureStdout(t, func() { h.ServeHTTP(httptest.NewRecorder(), req) })
+	if got.Get(exposeLoginHeader) != "" || got.Get(exposeNodeHeader) != "" {
+		t.Errorf("Expected no identity for an unknown caller, got %v", got)
+	}
+}
+
+func TestExposeRawProxyProtocol(t *testing.T) {
+	local, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer local.Close()
+	got := make(chan string, 1)
+	go func() {
+		conn, err := local.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		br := bufio.NewReader(conn)
+		src, _, err := readProxyHeader(br)
+		if err != nil {
+			got <- err.Error()
+			return
+		}
+		line, _ := br.ReadString('\n')
+		got <- src.String() + " " + strings.TrimSpace(line)
+	}()
+
+	tailnet, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer tailnet.Close()
+	go serveExposeRaw(tailnet, ExposeRule{Port: 5432, Target: local.Addr().String(), ProxyProtocol: ProxyProtocolV2}, nil)
+
+	conn, err := net.Dial("tcp", tailnet.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	defer conn.Close()
+	io.WriteString(conn, "hello\n")
+	if want, at := conn.LocalAddr().String()+" hello", <-got; at != want {
+		t.Errorf("Expected %q at the target, got %q", want, at)
+	}
+}
+
+// fakeTailnet listens on loopback for every tailnet port
+type fakeTailnet struct {
+	calls     []string
+	listeners []net.Listener
+}
+
+func (f *fakeTailnet) listen(kind, addr string) (net.Listener, error) {
+	f.calls = append(f.calls, kind+" "+addr)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err == nil {
+		f.listeners = append(f.listeners, ln)
+	}
+	return ln, err
+}
+
+func (f *fakeTailnet) Listen(network, addr string) (net.Listener, error) {
+	return f.listen("tcp", addr)
+}
+
+func (f *fakeTailnet) ListenTLS(network, addr string) (net.Listener, error) {
+	return f.listen("tls", addr)
+}
+
+func (f *fakeTailnet) ListenFunnel(network, addr string, opts ...tsnet.FunnelOption) (net.Listener, error) {
+	return f.listen("funnel", addr)
+}
+
+func TestExposeTLS(t *testing.T) {
+	if err := validateExpose([]ExposeRule{{Port: 443, Target: "127.0.0.1:3000", HSTS: "8760h"}}); err == nil {
+		t.Errorf("Expected hsts without tls to be rejected")
+	}
+
+	tn := &fakeTailnet{}
+	captureStdout(t, func() {
+		err := startExpose(tn, []ExposeRule{{Port: 443, Target: "127.0.0.1:3000", TLS: true, HSTS: "8760h"}}, nil)
+		if err != nil {
+			t.Fatalf("startExpose failed: %v", err)
+		}
+	})
+	for _, ln := range tn.listeners {
+		defer ln.Close()
+	}
+	if strings.Join(tn.calls, ",") != "tls :443,tcp :80" {
+		t.Errorf("Expected HTTPS on 443 and a redirect on 80, got %v", tn.calls)
+	}
+
+	// A rule on port 80 keeps it
+	if _, ok := redirectRule([]ExposeRule{{Port: 443, TLS: true}, {Port: 80}}); ok {
+		t.Errorf("Expected no redirect when port 80 is exposed")
+	}
+
+	rec := httptest.NewRecorder()
+	httpsRedirect(ExposeRule{Port: 8443}).ServeHTTP(rec, httptest.NewRequest("POST", "http://gpu-node/api/upload?x=1", nil))
+	if rec.Code != http.StatusPermanentRedirect || rec.Header().Get("Location") != "https://gpu-node:8443/api/upload?x=1" {
+		t.Errorf("Unexpected redirect %d %q", rec.Code, rec.Header().Get("Location"))
+	}
+
+	rec = httptest.NewRecorder()
+	withHSTS(ExposeRule{HSTS: "8760h"}, http.NotFoundHandler()).ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	if got := rec.Header().Get("Strict-Transport-Security"); got != "max-age=31536000" {
+		t.Errorf("Unexpected HSTS header %q", got)
+	}
+}
+
+func TestExposePaths(t *testing.T) {
+	backend := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, name+" "+r.URL.RequestURI()+" "+r.Header.Get(exposePrefixHeader))
+		}))
+	}
+	api, viewer, app := backend("api"), backend("viewer"), backend("app")
+	defer api.Close()
+	defer viewer.Close()
+	defer app.Close()
+
+	rules := []ExposeRule{
+		{Port: 80, Target: app.Listener.Addr().String()},
+		{Port: 80, Path: "/api/", StripPrefix: true, Target: api.Listener.Addr().String()},
+		{Port: 80, Path: "/viewer", Target: viewer.Listener.Addr().String()},
+	}
+	if err := validateExpose(rules); err != nil {
+		t.Fatalf("Expected the rules to be valid, got %v", err)
+	}
+	whois := func(ctx context.Context, addr string) (execCaller, error) { return execCaller{Host: "laptop"}, nil }
+	h := exposePaths(exposePorts(rules)[0], whois)
+	for path, want := range map[string]string{
+		"/api/users?page=2": "api /users?page=2 /api",
+		"/api":              "api / /api",
+		"/viewer/img/1":     "viewer /viewer/img/1 ",
+		"/apix":             "app /apix ",
+		"/":                 "app / ",
+	} {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", "http://gpu-node"+path, nil))
+		if rec.Body.String() != want {
+			t.Errorf("Expected %s to reach %q, got %q", path, want, rec.Body)
+		}
+	}
+
+	for _, rules := range [][]ExposeRule{
+		{{Port: 80, Target: "127.0.0.1:1", Path: "/api"}, {Port: 80, Target: "127.0.0.1:2", Path: "/api/"}},
+		{{Port: 443, Target: "127.0.0.1:1", TLS: true}, {Port: 443, Target: "127.0.0.1:2", Path: "/api"}},
+		{{Port: 80, Target: "127.0.0.1:1", Path: "api"}},
+		{{Port: 80, Target: "127.0.0.1:1", StripPrefix: true}},
+	} {
+		if err := validateExpose(rules); err == nil {
+			t.Errorf("Expected %+v to be rejected", rules)
+		}
+	}
+}
+
+func TestExposeDir(t *testing.T) {
+	dir := t.TempDir()
+	os.MkdirAll(filepath.Join(dir, "stack", "raw"), 0o755)
+	os.MkdirAll(filepath.Join(dir, ".git"), 0o755)
+	os.WriteFile(filepath.Join(dir, "stack", "raw", "t0.tif"), []byte("0123456789"), 0o644)
+	os.WriteFile(filepath.Join(dir, ".git", "config"), []byte("secret"), 0o644)
+	os.WriteFile(filepath.Join(dir, "stack", "index.html"), []byte("<h1>stack</h1>"), 0o644)
+
+	rule := ExposeRule{Port: 80, Path: "/results", Target: "dir:" + dir}
+	if err := validateExpose([]ExposeRule{rule}); err != nil {
+		t.Fatalf("Expected a valid rule, got %v", err)
+	}
+	get := func(h http.Handler, path, rng string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "http://gpu-node"+path, nil)
+		if rng != "" {
+			req.Header.Set("Range", rng)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	h := exposePaths([]ExposeRule{rule}, nil)
+	if rec := get(h, "/results/stack/raw/t0.tif", "bytes=2-5"); rec.Code != http.StatusPartialContent || rec.Body.String() != "2345" {
+		t.Errorf("Expected a range of the file, got %d %q", rec.Code, rec.Body)
+	}
+	if rec := get(h, "/results/stack/", ""); rec.Body.String() != "<h1>stack</h1>" {
+		t.Errorf("Expected the index, got %d %q", rec.Code, rec.Body)
+	}
+	if rec := get(h, "/results/stack/raw/", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("Expected no listing by default, got %d", rec.Code)
+	}
+	if rec := get(h, "/results/.git/config", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("Expected dot files to be hidden, got %d", rec.Code)
+	}
+	if rec := get(h, "/results", ""); rec.Code != http.StatusMovedPermanently || rec.Header().Get("Location") != "/results/" {
+		t.Errorf("Expected a redirect to the directory, got %d %v", rec.Code, rec.Header())
+	}
+
+	rule.Listing = true
+	h = exposePaths([]ExposeRule{rule}, nil)
+	if rec := get(h, "/results/stack/raw/", ""); rec.Code != 200 || !strings.Contains(rec.Body.String(), "t0.tif") {
+		t.Errorf("Expected a listing, got %d %q", rec.Code, rec.Body)
+	}
+
+	for _, r := range []ExposeRule{
+		{Port: 80, Target: "dir:results"},
+		{Port: 80, Target: "127.0.0.1:3000", Listing: true},
+		{Port: 80, Target: "dir:" + dir, ProxyProtocol: ProxyProtocolV2},
+	} {
+		if err := r.validate(); err == nil {
+			t.Errorf("Expected %+v to be rejected", r)
+		}
+	}
+}
+
+func TestExposeAllow(t *testing.T) {
+	var got http.Header
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Clone()
+	}))
+	defer backend.Close()
+
+	calls := 0
+	whois := func(ctx context.Context, addr string) (execCaller, error) {
+		calls++
+		switch addr {
+		case "100.64.0.7:1":
+			return execCaller{Host: "laptop", Login: "anna@lab.example"}, nil
+		case "100.64.0.8:1":
+			return execCaller{Host: "ci-runner", Tags: []string{"tag:ci"}}, nil
+		case "100.64.0.9:1":
+			return execCaller{Host: "guest", Login: "bob@lab.example"}, nil
+		}
+		return execCaller{}, errors.New("no such peer")
+	}
+	h := exposePaths([]ExposeRule{{Port: 80, Target: backend.Listener.Addr().String(), Allow: []string{"anna@lab.example", "tag:ci"}}}, whois)
+
+	var out string
+	for addr, want := range map[string]int{"100.64.0.7:1": 200, "100.64.0.8:1": 200, "100.64.0.9:1": 403, "100.64.0.10:1": 403} {
+		got = nil
+		req := httptest.NewRequest("GET", "http://gpu-node/", nil)
+		req.RemoteAddr = addr
+		rec := httptest.NewRecorder()
+		out += captureStdout(t, func() { h.ServeHTTP(rec, req) })
+		if rec.Code != want || (want == 403) != (got == nil) {
+			t.Errorf("Expected %d for %s, got %d (backend reached: %v)", want, addr, rec.Code, got != nil)
+		}
+	}
+	if calls != 4 {
+		t.Errorf("Expected one WhoIs per request, got %d", calls)
+	}
+	if !strings.Contains(out, "Refusing guest (bob@lab.example) on port 80/: not in allow") {
+		t.Errorf("Expected the refusal to be logged, got %q", out)
+	}
+}
+
+func TestExposeFunnel(t *testing.T) {
+	for _, r := range []ExposeRule{
+		{Port: 443, Target: "127.0.0.1:3000", Funnel: true},
+		{Port: 80, Target: "127.0.0.1:3000", Funnel: true, AllowPublic: true},
+		{Port: 443, Target: "127.0.0.1:3000", Funnel: true, AllowPublic: true, Allow: []string{"tag:ops"}},
+		{Port: 443, Target: "127.0.0.1:3000", AllowPublic: true},
+	} {
+		if err := r.validate(); err == nil {
+			t.Errorf("Expected %+v to be rejected", r)
+		}
+	}
+
+	var got http.Header
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Clone()
+	}))
+	defer backend.Close()
+	rule := ExposeRule{Port: 443, Target: backend.Listener.Addr().String(), Funnel: true, AllowPublic: true}
+	if err := validateExpose([]ExposeRule{rule}); err != nil {
+		t.Fatalf("Expected a confirmed funnel rule to be valid, got %v", err)
+	}
+
+	// No identity headers, and the caller can't add its own
+	whois := func(ctx context.Context, addr string) (execCaller, error) {
+		return execCaller{Host: "laptop", Login: "anna@lab.example"}, nil
+	}
+	req := httptest.NewRequest("GET", "https://gpu-node.tail1234.ts.net/", nil)
+	req.RemoteAddr = "203.0.113.5:40000"
+	req.Header.Set(exposeLoginHeader, "admin@lab.example")
+	exposePaths([]ExposeRule{rule}, whois).ServeHTTP(httptest.NewRecorder(), req)
+	if got.Get(exposeLoginHeader) != "" || got.Get(exposeNodeHeader) != "" || got.Get("X-Forwarded-For") != "203.0.113.5" {
+		t.Errorf("Unexpected headers for a public caller: %v", got)
+	}
+
+	tn := &fakeTailnet{}
+	out := captureStdout(t, func() {
+		if err := startExpose(tn, []ExposeRule{rule}, whois); err != nil {
+			t.Fatalf("startExpose failed: %v", err)
+		}
+	})
+	for _, ln := range tn.listeners {
+		defer ln.Close()
+	}
+	if strings.Join(tn.calls, ",") != "funnel :443" || !strings.Contains(out, "@@SIDECAR:WARNING@@ expose_public port=443") {
+		t.Errorf("Expected a funnel listener and a warning, got %v %q", tn.calls, out)
+	}
+}
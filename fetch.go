@@ -0,0 +1,677 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// --- PARALLEL FETCH ---
+
+const (
+	fetchDefaultParallel = 8
+	fetchMaxParallel     = 32
+	fetchDefaultPartMB   = 16
+	fetchPartAttempts    = 3
+	fetchProgressEvery   = time.Second
+	fetchKeepFinished    = 100 // finished transfers listed before the oldest is dropped
+)
+
+// Transfer states
+const (
+	TransferRunning = "running"
+	TransferDone    = "done"
+	TransferFailed  = "failed"
+)
+
+// fetchDir is -fetch-dir, the only directory /fetch writes to
+var fetchDir string
+
+// errFetchCanceled is what a transfer stopped through DELETE reports
+var errFetchCanceled = errors.New("canceled")
+
+// Transfer describes a download started with /fetch
+type Transfer struct {
+	ID       string            `json:"id"`
+	URL      string            `json:"url"`
+	Dest     string            `json:"dest"`
+	State    string            `json:"state"`
+	Bytes    int64             `json:"bytes"`
+	Total    int64             `json:"total"` // -1 while unknown, or when the server doesn't send a length
+	Parts    int               `json:"parts"`
+	Parallel int               `json:"parallel"`
+	Started  time.Time         `json:"started"`
+	Finished *time.Time        `json:"finished,omitempty"`
+	RateBps  float64           `json:"rate_bps"`           // average bytes per second so far
+	Resumed  int64             `json:"resumed,omitempty"`  // bytes already on disk from an interrupted fetch
+	Checksum *TransferChecksum `json:"checksum,omitempty"` // once the file is complete
+	Error    string            `json:"error,omitempty"`
+}
+
+// TransferChecksum is the result of verifying a finished download
+type TransferChecksum struct {
+	Algorithm string `json:"algorithm"` // "sha256"
+	Actual    string `json:"actual"`
+	Expected  string `json:"expected,omitempty"`
+	Source    string `json:"source,omitempty"` // "request" (the sha256 parameter) or "server" (a digest header)
+	Verified  bool   `json:"verified"`
+}
+
+// result is "verified", "mismatch" or "unchecked", for events and logs
+func (c *TransferChecksum) result() string {
+	switch {
+	case c.Expected == "":
+		return "unchecked"
+	case c.Verified:
+		return "verified"
+	}
+	return "mismatch"
+}
+
+type transfer struct {
+	mu    sync.Mutex
+	info  Transfer
+	bytes atomic.Int64
+	stop  context.CancelFunc
+	done  chan struct{} // closed once the final event has been emitted
+}
+
+func (t *transfer) snapshot() Transfer {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	info := t.info
+	info.Bytes = t.bytes.Load()
+	end := time.Now()
+	if info.Finished != nil {
+		end = *info.Finished
+	}
+	if secs := end.Sub(info.Started).Seconds(); secs > 0 {
+		info.RateBps = float64(info.Bytes) / secs
+	}
+	return info
+}
+
+// event emits the transfer's progress as a TRANSFER signal
+func (t *transfer) event() {
+	info := t.snapshot()
+	details := fmt.Sprintf("id=%s state=%s bytes=%d total=%d", info.ID, info.State, info.Bytes, info.Total)
+	if info.Checksum != nil {
+		details += fmt.Sprintf(" checksum=%s sha256=%s", info.Checksum.result(), info.Checksum.Actual)
+	}
+	if info.Error != "" {
+		details += fmt.Sprintf(" error=%q", info.Error)
+	}
+	signal(SignalTransfer, details)
+}
+
+// fetchTable runs downloads for /fetch. Its transport dials through the
+// same chain as the proxy; each part request gets its own connection.
+type fetchTable struct {
+	transport http.RoundTripper // nil until the node is up
+
+	mu        sync.Mutex
+	transfers map[string]*transfer
+}
+
+var fetches = &fetchTable{transfers: map[string]*transfer{}}
+
+// fetchRequest holds the parameters of a /fetch call
+type fetchRequest struct {
+	url       *url.URL
+	dest      string
+	parallel  int
+	partSize  int64
+	overwrite bool
+	resume    bool   // continue a matching .part file
+	sha256    string // expected digest, lowercase hex
+}
+
+func parseFetchRequest(q url.Values) (fetchRequest, error) {
+	req := fetchRequest{parallel: fetchDefaultParallel, partSize: fetchDefaultPartMB << 20, resume: true}
+	u, err := url.Parse(q.Get("url"))
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return req, fmt.Errorf("url must be an http(s) URL, got %q", q.Get("url"))
+	}
+	req.url = u
+	if req.dest, err = fetchDest(q.Get("dest")); err != nil {
+		return req, err
+	}
+	if v := q.Get("parallel"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > fetchMaxParallel {
+			return req, fmt.Errorf("parallel must be between 1 and %d, got %q", fetchMaxParallel, v)
+		}
+		req.parallel = n
+	}
+	if v := q.Get("part_size_mb"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return req, fmt.Errorf("invalid part_size_mb %q", v)
+		}
+		req.partSize = int64(n) << 20
+	}
+	req.overwrite, _ = strconv.ParseBool(q.Get("overwrite"))
+	if v := q.Get("resume"); v != "" {
+		resume, err := strconv.ParseBool(v)
+		if err != nil {
+			return req, fmt.Errorf("invalid resume value %q", v)
+		}
+		req.resume = resume
+	}
+	if q.Has("blake3") {
+		return req, fmt.Errorf("blake3 checksums are not supported, use sha256")
+	}
+	if v := strings.ToLower(q.Get("sha256")); v != "" {
+		if sum, err := hex.DecodeString(v); err != nil || len(sum) != sha256.Size {
+			return req, fmt.Errorf("sha256 must be 64 hex digits, got %q", v)
+		}
+		req.sha256 = v
+	}
+	if _, err := os.Stat(req.dest); err == nil && !req.overwrite {
+		return req, fmt.Errorf("%s exists (pass overwrite=true to replace it)", req.dest)
+	}
+	return req, nil
+}
+
+// fetchDest resolves dest inside fetchDir. Relative paths are taken from
+// there; paths that leave it, directly or through a symlink, are refused,
+// and so are symlinks where the file or its .part files will be written.
+func fetchDest(dest string) (string, error) {
+	if fetchDir == "" {
+		return "", errors.New("/fetch needs -fetch-dir")
+	}
+	if dest == "" {
+		return "", errors.New("dest is required")
+	}
+	root, err := filepath.EvalSymlinks(fetchDir)
+	if err != nil {
+		return "", fmt.Errorf("-fetch-dir: %w", err)
+	}
+	if !filepath.IsAbs(dest) {
+		dest = filepath.Join(root, dest)
+	}
+	dest = filepath.Clean(dest)
+	parent, err := filepath.EvalSymlinks(filepath.Dir(dest))
+	if err != nil {
+		return "", fmt.Errorf("dest's directory: %w", err)
+	}
+	if rel, err := filepath.Rel(root, parent); err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("dest %s is outside -fetch-dir %s", dest, fetchDir)
+	}
+	dest = filepath.Join(parent, filepath.Base(dest))
+	for _, p := range []string{dest, dest + ".part", dest + ".part.json"} {
+		if info, err := os.Lstat(p); err == nil && info.Mode()&os.ModeSymlink != 0 {
+			return "", fmt.Errorf("%s is a symlink", p)
+		}
+	}
+	return dest, nil
+}
+
+// start begins a download in the background
+func (ft *fetchTable) start(req fetchRequest) *transfer {
+	ctx, cancel := context.WithCancel(context.Background())
+	t := &transfer{
+		info: Transfer{
+			ID:       newRequestID(),
+			URL:      req.url.Redacted(),
+			Dest:     req.dest,
+			State:    TransferRunning,
+			Total:    -1,
+			Parallel: req.parallel,
+			Started:  time.Now().UTC(),
+		},
+		stop: cancel,
+		done: make(chan struct{}),
+	}
+	ft.mu.Lock()
+	ft.transfers[t.info.ID] = t
+	ft.prune()
+	ft.mu.Unlock()
+
+	go func() {
+		defer close(t.done)
+		defer cancel()
+		progress := time.NewTicker(fetchProgressEvery)
+		defer progress.Stop()
+		done := make(chan error, 1)
+		go func() { done <- ft.download(ctx, t, req) }()
+		for {
+			select {
+			case <-progress.C:
+				t.event()
+			case err := <-done:
+				ft.finish(t, err)
+				return
+			}
+		}
+	}()
+	return t
+}
+
+func (ft *fetchTable) finish(t *transfer, err error) {
+	now := time.Now().UTC()
+	t.mu.Lock()
+	t.info.Finished = &now
+	t.info.State = TransferDone
+	if errors.Is(err, context.Canceled) {
+		err = errFetchCanceled
+	}
+	if err != nil {
+		t.info.State, t.info.Error = TransferFailed, err.Error()
+	}
+	t.mu.Unlock()
+	info := t.snapshot()
+	if err != nil {
+		logRedacted("[FETCH] %s %s failed after %d bytes: %v\n", info.ID, info.URL, info.Bytes, err)
+	} else {
+		logRedacted("[FETCH] %s %s -> %s: %d bytes in %v (%.1f MiB/s), sha256 %s\n", info.ID, info.URL, info.Dest, info.Bytes,
+			now.Sub(info.Started).Round(time.Millisecond), info.RateBps/(1<<20), info.Checksum.result())
+	}
+	t.event()
+}
+
+// prune drops the oldest finished transfers beyond fetchKeepFinished
+func (ft *fetchTable) prune() {
+	var finished []*transfer
+	for _, t := range ft.transfers {
+		if t.snapshot().Finished != nil {
+			finished = append(finished, t)
+		}
+	}
+	if len(finished) <= fetchKeepFinished {
+		return
+	}
+	slices.SortFunc(finished, func(a, b *transfer) int { return a.snapshot().Started.Compare(b.snapshot().Started) })
+	for _, t := range finished[:len(finished)-fetchKeepFinished] {
+		delete(ft.transfers, t.info.ID)
+	}
+}
+
+// fetchState is kept next to the .part file while a ranged download runs,
+// so a fetch of the same URL to the same dest continues where it stopped
+type fetchState struct {
+	URL      string `json:"url"`
+	ETag     string `json:"etag"`
+	Size     int64  `json:"size"`
+	PartSize int64  `json:"part_size"`
+	Done     []bool `json:"done"`
+
+	mu   sync.Mutex
+	path string
+}
+
+// loadFetchState reads the state for dest, if it describes the same download
+func loadFetchState(dest string, req fetchRequest) *fetchState {
+	data, err := os.ReadFile(dest + ".part.json")
+	if err != nil {
+		return nil
+	}
+	var st fetchState
+	if json.Unmarshal(data, &st) != nil || st.URL != req.url.String() || st.PartSize != req.partSize {
+		return nil
+	}
+	st.path = dest + ".part.json"
+	return &st
+}
+
+// matches reports whether the server still has the version the state was
+// started with. Without an ETag that can't be told, so nothing is resumed.
+func (st *fetchState) matches(etag string, size int64) bool {
+	return st != nil && st.ETag != "" && st.ETag == etag && st.Size == size && len(st.Done) == int((size+st.PartSize-1)/st.PartSize)
+}
+
+// markDone records a finished part
+func (st *fetchState) markDone(i int) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.Done[i] = true
+	data, err := json.Marshal(st)
+	if err != nil {
+		return err
+	}
+	tmp := st.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, st.path)
+}
+
+// download writes the object to a temporary file next to dest and renames
+// it into place once complete and verified. A ranged download that fails
+// leaves the .part file and its state behind to be resumed.
+func (ft *fetchTable) download(ctx context.Context, t *transfer, req fetchRequest) error {
+	tmp, statePath := req.dest+".part", req.dest+".part.json"
+	var st *fetchState
+	if req.resume {
+		st = loadFetchState(req.dest, req)
+	}
+	f, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+	keep := false
+	defer func() {
+		f.Close()
+		if !keep {
+			os.Remove(tmp) // no-op after the rename
+			os.Remove(statePath)
+		}
+	}()
+
+	// The first part tells whether the server takes ranges, the size, the
+	// version and possibly a digest of the whole object
+	first, err := http.NewRequestWithContext(ctx, "GET", req.url.String(), nil)
+	if err != nil {
+		return err
+	}
+	first.Header.Set("Range", fmt.Sprintf("bytes=0-%d", req.partSize-1))
+	first.Header.Set("X-Amz-Checksum-Mode", "ENABLED")
+	resp, err := ft.transport.RoundTrip(first)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	serverSum := serverSHA256(resp.Header)
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		// No range support: one stream it is, and nothing to resume
+		t.mu.Lock()
+		t.info.Total, t.info.Parts, t.info.Parallel = resp.ContentLength, 1, 1
+		t.mu.Unlock()
+		if err := f.Truncate(0); err != nil {
+			return err
+		}
+		if _, err := io.Copy(io.MultiWriter(f, countingWriter{&t.bytes}), resp.Body); err != nil {
+			return err
+		}
+	case http.StatusPartialContent:
+		size, ok := contentRangeSize(resp.Header.Get("Content-Range"))
+		if !ok {
+			return fmt.Errorf("unusable Content-Range %q", resp.Header.Get("Content-Range"))
+		}
+		etag := resp.Header.Get("ETag")
+		n := int((size + req.partSize - 1) / req.partSize)
+		if st.matches(etag, size) {
+			st.path = statePath
+		} else {
+			st = &fetchState{URL: req.url.String(), ETag: etag, Size: size, PartSize: req.partSize, Done: make([]bool, n), path: statePath}
+			if err := f.Truncate(0); err != nil {
+				return err
+			}
+		}
+		if err := f.Truncate(size); err != nil {
+			return err
+		}
+		keep = etag != "" // only a known version can be resumed
+
+		var missing []int
+		resumed := int64(0)
+		for i, done := range st.Done {
+			if done {
+				resumed += partRange(i, req.partSize, size)[1] - partRange(i, req.partSize, size)[0] + 1
+			} else {
+				missing = append(missing, i)
+			}
+		}
+		t.bytes.Add(resumed)
+		t.mu.Lock()
+		t.info.Total, t.info.Parts, t.info.Resumed = size, n, resumed
+		t.mu.Unlock()
+		if resumed > 0 {
+			fmt.Fprintf(console, "[FETCH] %s resuming at %d of %d bytes (%d of %d parts left)\n", t.info.ID, resumed, size, len(missing), n)
+		}
+
+		if !st.Done[0] {
+			if _, err := writePart(f, resp.Body, partRange(0, req.partSize, size), &t.bytes); err != nil {
+				return err
+			}
+			if err := st.markDone(0); err != nil {
+				return err
+			}
+			missing = missing[1:]
+		}
+		resp.Body.Close()
+		if err := ft.fetchRanges(ctx, t, req, st, missing, f); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("server answered %s", resp.Status)
+	}
+
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	keep = false
+	if err := t.verify(f, req.sha256, serverSum); err != nil {
+		return err
+	}
+	return os.Rename(tmp, req.dest)
+}
+
+// verify hashes the finished file and compares it with the expected
+// digest, from the request or else from the server
+func (t *transfer) verify(f *os.File, expected, fromServer string) error {
+	h := sha256.New()
+	if _, err := io.Copy(h, io.NewSectionReader(f, 0, 1<<62)); err != nil {
+		return err
+	}
+	c := &TransferChecksum{Algorithm: "sha256", Actual: hex.EncodeToString(h.Sum(nil))}
+	switch {
+	case expected != "":
+		c.Expected, c.Source = expected, "request"
+	case fromServer != "":
+		c.Expected, c.Source = fromServer, "server"
+	}
+	c.Verified = c.Expected != "" && c.Expected == c.Actual
+	t.mu.Lock()
+	t.info.Checksum = c
+	t.mu.Unlock()
+	if c.result() == "mismatch" {
+		return fmt.Errorf("sha256 mismatch: got %s, expected %s from the %s", c.Actual, c.Expected, c.Source)
+	}
+	return nil
+}
+
+// serverSHA256 returns the object's SHA-256 as lowercase hex from a
+// Repr-Digest (RFC 9530), Digest (RFC 3230) or S3 checksum header
+func serverSHA256(h http.Header) string {
+	var b64 string
+	if v := h.Get("Repr-Digest"); v != "" {
+		for _, item := range strings.Split(v, ",") {
+			if value, ok := strings.CutPrefix(strings.TrimSpace(item), "sha-256=:"); ok {
+				b64 = strings.TrimSuffix(value, ":")
+			}
+		}
+	}
+	if v := h.Get("Digest"); b64 == "" && v != "" {
+		for _, item := range strings.Split(v, ",") {
+			if k, value, ok := strings.Cut(strings.TrimSpace(item), "="); ok && strings.EqualFold(k, "sha-256") {
+				b64 = value
+			}
+		}
+	}
+	if b64 == "" {
+		// Multipart objects carry a checksum of checksums, "...-N"
+		if v := h.Get("X-Amz-Checksum-Sha256"); !strings.Contains(v, "-") {
+			b64 = v
+		}
+	}
+	sum, err := base64.StdEncoding.DecodeString(b64)
+	if err != nil || len(sum) != sha256.Size {
+		return ""
+	}
+	return hex.EncodeToString(sum)
+}
+
+// partRange returns the byte range of part i
+func partRange(i int, partSize, size int64) [2]int64 {
+	start := int64(i) * partSize
+	return [2]int64{start, min(start+partSize, size) - 1}
+}
+
+// fetchRanges downloads the missing parts with up to req.parallel requests
+// in flight, each written at its offset as it arrives
+func (ft *fetchTable) fetchRanges(ctx context.Context, t *transfer, req fetchRequest, st *fetchState, missing []int, f *os.File) error {
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for range min(req.parallel, len(missing)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				err := ft.fetchRange(ctx, t, req.url, st.ETag, partRange(i, st.PartSize, st.Size), f)
+				if err == nil {
+					err = st.markDone(i)
+				}
+				if err != nil {
+					cancel(err)
+					return
+				}
+			}
+		}()
+	}
+	for _, i := range missing {
+		select {
+		case next <- i:
+		case <-ctx.Done():
+		}
+	}
+	close(next)
+	wg.Wait()
+	return context.Cause(ctx)
+}
+
+// fetchRange downloads one range, retrying from the start of the range
+func (ft *fetchTable) fetchRange(ctx context.Context, t *transfer, u *url.URL, etag string, rg [2]int64, f *os.File) error {
+	var err error
+	for attempt := 0; attempt < fetchPartAttempts; attempt++ {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		var req *http.Request
+		req, err = http.NewRequestWithContext(ctx, "GET", u.String(), nil)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", rg[0], rg[1]))
+		if etag != "" {
+			req.Header.Set("If-Match", etag)
+		}
+		var resp *http.Response
+		if resp, err = ft.transport.RoundTrip(req); err != nil {
+			continue
+		}
+		if resp.StatusCode != http.StatusPartialContent {
+			resp.Body.Close()
+			return fmt.Errorf("range %d-%d: %s", rg[0], rg[1], resp.Status) // 412: the object changed
+		}
+		var n int64
+		n, err = writePart(f, resp.Body, rg, &t.bytes)
+		resp.Body.Close()
+		if err == nil {
+			return nil
+		}
+		t.bytes.Add(-n) // the retry starts the range over
+	}
+	return err
+}
+
+// writePart copies exactly the range's bytes from r to their offset in f,
+// adding them to counter as they arrive
+func writePart(f *os.File, r io.Reader, rg [2]int64, counter *atomic.Int64) (int64, error) {
+	want := rg[1] - rg[0] + 1
+	n, err := io.Copy(io.NewOffsetWriter(f, rg[0]), io.TeeReader(io.LimitReader(r, want), countingWriter{counter}))
+	if err == nil && n < want {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// countingWriter adds the length of every write to n
+type countingWriter struct{ n *atomic.Int64 }
+
+func (w countingWriter) Write(p []byte) (int, error) {
+	w.n.Add(int64(len(p)))
+	return len(p), nil
+}
+
+func (ft *fetchTable) list() []Transfer {
+	ft.mu.Lock()
+	defer ft.mu.Unlock()
+	list := make([]Transfer, 0, len(ft.transfers))
+	for _, t := range ft.transfers {
+		list = append(list, t.snapshot())
+	}
+	slices.SortFunc(list, func(a, b Transfer) int { return a.Started.Compare(b.Started) })
+	return list
+}
+
+func (ft *fetchTable) get(id string) *transfer {
+	ft.mu.Lock()
+	defer ft.mu.Unlock()
+	return ft.transfers[id]
+}
+
+// handleFetch starts a download (POST) or lists transfers (GET)
+func handleFetch(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(fetches.list())
+	case http.MethodPost:
+		if fetches.transport == nil {
+			http.Error(w, "not connected to the tailnet", http.StatusServiceUnavailable)
+			return
+		}
+		req, err := parseFetchRequest(r.URL.Query())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		t := fetches.start(req)
+		info := t.snapshot()
+		logRedacted("[FETCH] %s %s -> %s (%d parallel)\n", info.ID, info.URL, info.Dest, info.Parallel)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(info)
+	default:
+		http.Error(w, "only GET and POST allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleTransfer reports one transfer, or cancels it (DELETE)
+func handleTransfer(w http.ResponseWriter, r *http.Request) {
+	t := fetches.get(r.PathValue("id"))
+	if t == nil {
+		http.Error(w, "no such transfer", http.StatusNotFound)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodDelete:
+		t.stop()
+	default:
+		http.Error(w, "only GET and DELETE allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(t.snapshot())
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func waitTransfer(t *testing.T, tr *transfer) Transfer {
+	t.Helper()
+	select {
+	case <-tr.done:
+		return tr.snapshot()
+	case <-time.After(5 * time.Second):
+		t.Fatal("Transfer did not finish")
+		return Transfer{}
+	}
+}
+
+func TestFetchParallel(t *testing.T) {
+	object := make([]byte, 5<<20+123)
+	for i := range object {
+		object[i] = byte(rand.IntN(256))
+	}
+	var requests atomic.Int64
+	var noRanges atomic.Bool
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		if noRanges.Load() {
+			w.Write(object)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		http.ServeContent(w, r, "object", time.Time{}, bytes.NewReader(object))
+	}))
+	defer srv.Close()
+
+	ft := &fetchTable{transport: http.DefaultTransport, transfers: map[string]*transfer{}}
+	dest := filepath.Join(useFetchDir(t), "image.tif")
+	req, err := parseFetchRequest(url.Values{"url": {srv.URL + "/image.tif"}, "dest": {dest}, "parallel": {"4"}, "part_size_mb": {"1"}})
+	if err != nil {
+		t.Fatalf("parseFetchRequest failed: %v", err)
+	}
+	info := waitTransfer(t, ft.start(req))
+	if info.State != TransferDone || info.Bytes != int64(len(object)) || info.Total != int64(len(object)) || info.Parts != 6 {
+		t.Errorf("Unexpected transfer %+v", info)
+	}
+	if data, _ := os.ReadFile(dest); !bytes.Equal(data, object) {
+		t.Error("Expected the file to match the object")
+	}
+	if requests.Load() != 6 {
+		t.Errorf("Expected 6 range requests, got %d", requests.Load())
+	}
+	if _, err := os.Stat(dest + ".part"); !os.IsNotExist(err) {
+		t.Error("Expected the temporary file to be gone")
+	}
+
+	// An existing file needs overwrite=true
+	if _, err := parseFetchRequest(url.Values{"url": {srv.URL}, "dest": {dest}}); err == nil {
+		t.Error("Expected an existing dest to be refused")
+	}
+
+	// Servers without range support are read in one stream
+	noRanges.Store(true)
+	req, _ = parseFetchRequest(url.Values{"url": {srv.URL}, "dest": {dest}, "overwrite": {"true"}})
+	info = waitTransfer(t, ft.start(req))
+	if info.State != TransferDone || info.Parts != 1 {
+		t.Errorf("Unexpected transfer %+v", info)
+	}
+	if data, _ := os.ReadFile(dest); !bytes.Equal(data, object) {
+		t.Error("Expected the streamed file to match the object")
+	}
+	if len(ft.list()) != 2 {
+		t.Errorf("Expected 2 transfers listed, got %d", len(ft.list()))
+	}
+}
+
+// useFetchDir points -fetch-dir at a fresh directory for the test
+func useFetchDir(t *testing.T) string {
+	orig := fetchDir
+	fetchDir = t.TempDir()
+	t.Cleanup(func() { fetchDir = orig })
+	return fetchDir
+}
+
+func TestFetchDest(t *testing.T) {
+	if _, err := fetchDest("x"); err == nil {
+		t.Error("Expected /fetch to be refused without -fetch-dir")
+	}
+	dir := useFetchDir(t)
+	outside := t.TempDir()
+	os.Mkdir(filepath.Join(dir, "sub"), 0o755)
+	os.Symlink(outside, filepath.Join(dir, "escape"))
+	os.Symlink(filepath.Join(outside, "authorized_keys"), filepath.Join(dir, "keys"))
+
+	root, _ := filepath.EvalSymlinks(dir)
+	for dest, want := range map[string]string{
+		"stack.tif":                        filepath.Join(root, "stack.tif"),
+		"sub/stack.tif":                    filepath.Join(root, "sub", "stack.tif"),
+		filepath.Join(dir, "a", "..", "b"): filepath.Join(root, "b"),
+	} {
+		if got, err := fetchDest(dest); err != nil || got != want {
+			t.Errorf("fetchDest(%q) = %q, %v; want %q", dest, got, err, want)
+		}
+	}
+	for _, dest := range []string{
+		"",
+		"../x",
+		"sub/../../x",
+		filepath.Join(outside, "x"),
+		"escape/x",
+		"keys",
+		dir,
+	} {
+		if got, err := fetchDest(dest); err == nil {
+			t.Errorf("Expected %q to be refused, got %q", dest, got)
+		}
+	}
+}
+
+func TestFetchRequestValidation(t *testing.T) {
+	useFetchDir(t)
+	for _, q := range []url.Values{
+		{"url": {"ftp://host/x"}, "dest": {"x"}},
+		{"url": {"http://host/x"}, "dest": {"../x"}},
+		{"url": {"http://host/x"}, "dest": {"x"}, "parallel": {"100"}},
+		{"url": {"http://host/x"}, "dest": {"x"}, "part_size_mb": {"0"}},
+		{"url": {"http://host/x"}, "dest": {"x"}, "sha256": {"abc"}},
+		{"url": {"http://host/x"}, "dest": {"x"}, "blake3": {"abc"}},
+	} {
+		if _, err := parseFetchRequest(q); err == nil {
+			t.Errorf("Expected %v to be rejected", q)
+		}
+	}
+}
+
+func TestFetchFailure(t *testing.T) {
+	srv := httptest.NewServer(http.NotFoundHandler())
+	defer srv.Close()
+	ft := &fetchTable{transport: http.DefaultTransport, transfers: map[string]*transfer{}}
+	dest := filepath.Join(useFetchDir(t), "missing")
+	req, _ := parseFetchRequest(url.Values{"url": {srv.URL}, "dest": {dest}})
+	if info := waitTransfer(t, ft.start(req)); info.State != TransferFailed || info.Error == "" {
+		t.Errorf("Expected the transfer to fail, got %+v", info)
+	}
+	if _, err := os.Stat(dest + ".part"); !os.IsNotExist(err) {
+		t.Error("Expected the temporary file to be removed")
+	}
+}
+
+func TestFetchResume(t *testing.T) {
+	object := make([]byte, 4<<20+7)
+	for i := range object {
+		object[i] = byte(rand.IntN(256))
+	}
+	var requests, failures atomic.Int64
+	failures.Store(1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		// The part at 3 MiB fails once, like a dropped relay
+		if r.Header.Get("Range") == fmt.Sprintf("bytes=%d-%d", 3<<20, 4<<20-1) && failures.Add(-1) >= 0 {
+			http.Error(w, "relay lost", http.StatusBadGateway)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		http.ServeContent(w, r, "object", time.Time{}, bytes.NewReader(object))
+	}))
+	defer srv.Close()
+
+	ft := &fetchTable{transport: http.DefaultTransport, transfers: map[string]*transfer{}}
+	dest := filepath.Join(useFetchDir(t), "stack.tif")
+	sum := sha256.Sum256(object)
+	q := url.Values{"url": {srv.URL}, "dest": {dest}, "parallel": {"1"}, "part_size_mb": {"1"}, "sha256": {hex.EncodeToString(sum[:])}}
+	req, _ := parseFetchRequest(q)
+	if info := waitTransfer(t, ft.start(req)); info.State != TransferFailed {
+		t.Fatalf("Expected the first attempt to fail, got %+v", info)
+	}
+	if _, err := os.Stat(dest + ".part.json"); err != nil {
+		t.Fatalf("Expected the progress to be kept: %v", err)
+	}
+
+	requests.Store(0)
+	req, _ = parseFetchRequest(q)
+	info := waitTransfer(t, ft.start(req))
+	if info.State != TransferDone || info.Resumed != 3<<20 || info.Bytes != int64(len(object)) {
+		t.Errorf("Expected the second attempt to resume after 3 MiB, got %+v", info)
+	}
+	if info.Checksum == nil || !info.Checksum.Verified || info.Checksum.Source != "request" {
+		t.Errorf("Expected a verified checksum, got %+v", info.Checksum)
+	}
+	if requests.Load() != 3 {
+		t.Errorf("Expected the first part and the 2 missing ones to be requested, got %d", requests.Load())
+	}
+	if data, _ := os.ReadFile(dest); !bytes.Equal(data, object) {
+		t.Error("Expected the resumed file to match the object")
+	}
+	if _, err := os.Stat(dest + ".part.json"); !os.IsNotExist(err) {
+		t.Error("Expected the progress file to be removed")
+	}
+}
+
+func TestFetchChecksumMismatch(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// A digest of different content than what is served
+		w.Header().Set("Repr-Digest", "sha-256=:"+base64.StdEncoding.EncodeToString(make([]byte, 32))+":")
+		w.Write([]byte("payload"))
+	}))
+	defer srv.Close()
+
+	ft := &fetchTable{transport: http.DefaultTransport, transfers: map[string]*transfer{}}
+	dest := filepath.Join(useFetchDir(t), "payload")
+	req, _ := parseFetchRequest(url.Values{"url": {srv.URL}, "dest": {dest}})
+	info := waitTransfer(t, ft.start(req))
+	if info.State != TransferFailed || info.Checksum == nil || info.Checksum.Source != "server" || info.Checksum.result() != "mismatch" {
+		t.Errorf("Expected a checksum mismatch, got %+v %+v", info, info.Checksum)
+	}
+	if _, err := os.Stat(dest); !os.IsNotExist(err) {
+		t.Error("Expected no file at dest after a mismatch")
+	}
+}
+
+func TestServerSHA256(t *testing.T) {
+	sum := sha256.Sum256([]byte("hello"))
+	b64, want := base64.StdEncoding.EncodeToString(sum[:]), hex.EncodeToString(sum[:])
+	for _, h := range []http.Header{
+		{"Repr-Digest": {"sha-512=:AAAA:, sha-256=:" + b64 + ":"}},
+		{"Digest": {"SHA-256=" + b64}},
+		{"X-Amz-Checksum-Sha256": {b64}},
+	} {
+		if got := serverSHA256(h); got != want {
+			t.Errorf("serverSHA256(%v) = %q, want %q", h, got, want)
+		}
+	}
+	if got := serverSHA256(http.Header{"X-Amz-Checksum-Sha256": {b64 + "-3"}}); got != "" {
+		t.Errorf("Expected multipart checksums to be ignored, got %q", got)
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+)
+
+// --- FLAG ALIASES ---
+
+// flagAlias keeps a renamed flag working: the old name, on the command line
+// or as its SIDECAR_* variable, sets the new flag and warns
+type flagAlias struct {
+	Old, New string
+}
+
+// flagAliases lists the renamed flags. Old names stay until launcher
+// scripts have had a few releases of warnings.
+var flagAliases = []flagAlias{
+	{Old: "coordserver", New: "control-url"},
+}
+
+// aliasFor returns the alias whose old or new name is name
+func aliasFor(name string) (flagAlias, bool) {
+	for _, a := range flagAliases {
+		if a.Old == name || a.New == name {
+			return a, true
+		}
+	}
+	return flagAlias{}, false
+}
+
+// addFlagAliases registers the old names of fs's renamed flags, sharing
+// the new flags' values. Call it after defining the flags.
+func addFlagAliases(fs *flag.FlagSet) {
+	for _, a := range flagAliases {
+		if f := fs.Lookup(a.New); f != nil && fs.Lookup(a.Old) == nil {
+			fs.Var(f.Value, a.Old, "Deprecated: use -"+a.New)
+		}
+	}
+}
+
+// deprecatedFlags reports the old flag names used on fs's command line, or
+// by their variables in lookup if it isn't nil. Call it after fs.Parse and
+// before flagsFromEnv. Giving both names on the command line is an error,
+// since one would silently win.
+func deprecatedFlags(fs *flag.FlagSet, lookup func(string) (string, bool)) ([]flagAlias, error) {
+	given := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) { given[f.Name] = true })
+
+	var used []flagAlias
+	for _, a := range flagAliases {
+		if fs.Lookup(a.Old) == nil {
+			continue
+		}
+		switch {
+		case given[a.Old] && given[a.New]:
+			return nil, fmt.Errorf("-%s and -%s are the same flag; give only -%s", a.Old, a.New, a.New)
+		case given[a.Old]:
+			used = append(used, a)
+		case given[a.New] || lookup == nil:
+		default:
+			_, oldSet := lookup(envName(a.Old))
+			_, newSet := lookup(envName(a.New))
+			if oldSet && !newSet {
+				used = append(used, a)
+			}
+		}
+	}
+	return used, nil
+}
+
+// warnDeprecatedFlags logs each old name in use. With signals, it also
+// emits a WARNING that launchers can pick up, e.g.
+// "deprecated_flag flag=coordserver use=control-url".
+func warnDeprecatedFlags(used []flagAlias, signals bool) {
+	for _, a := range used {
+		log.Printf("!!! -%s (%s) is deprecated, use -%s (%s)", a.Old, envName(a.Old), a.New, envName(a.New))
+		if signals {
+			signal(SignalWarning, fmt.Sprintf("deprecated_flag flag=%s use=%s", a.Old, a.New))
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"strings"
+	"testing"
+)
+
+// aliasedFlags returns a flag set with -control-url and its old name
+func aliasedFlags() (*flag.FlagSet, *string) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	url := fs.String("control-url", "", "")
+	addFlagAliases(fs)
+	return fs, url
+}
+
+func TestFlagAliases(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		args       []string
+		env        map[string]string
+		want       string
+		deprecated bool
+	}{
+		{"new name", []string{"-control-url", "https://new"}, nil, "https://new", false},
+		{"old name", []string{"-coordserver", "https://old"}, nil, "https://old", true},
+		{"old variable", nil, map[string]string{"SIDECAR_COORDSERVER": "https://old"}, "https://old", true},
+		{"new variable wins", nil, map[string]string{"SIDECAR_COORDSERVER": "https://old", "SIDECAR_CONTROL_URL": "https://new"}, "https://new", false},
+		{"command line wins", []string{"-control-url", "https://flag"}, map[string]string{"SIDECAR_COORDSERVER": "https://old"}, "https://flag", false},
+		{"old name wins over new variable", []string{"-coordserver", "https://flag"}, map[string]string{"SIDECAR_CONTROL_URL": "https://new"}, "https://flag", true},
+	} {
+		fs, url := aliasedFlags()
+		lookup := testEnv(tc.env)
+		if err := fs.Parse(tc.args); err != nil {
+			t.Fatalf("%s: Parse failed: %v", tc.name, err)
+		}
+		used, err := deprecatedFlags(fs, lookup)
+		if err != nil {
+			t.Fatalf("%s: deprecatedFlags failed: %v", tc.name, err)
+		}
+		if err := flagsFromEnv(fs, lookup); err != nil {
+			t.Fatalf("%s: flagsFromEnv failed: %v", tc.name, err)
+		}
+		if *url != tc.want || (len(used) == 1) != tc.deprecated {
+			t.Errorf("%s: expected %s (deprecated %v), got %s (%v)", tc.name, tc.want, tc.deprecated, *url, used)
+		}
+	}
+
+	fs, _ := aliasedFlags()
+	fs.Parse([]string{"-coordserver", "a", "-control-url", "b"})
+	if _, err := deprecatedFlags(fs, nil); err == nil || !strings.Contains(err.Error(), "give only -control-url") {
+		t.Errorf("Expected both names to be rejected, got %v", err)
+	}
+}
+
+func TestWarnDeprecatedFlags(t *testing.T) {
+	out := captureStdout(t, func() {
+		warnDeprecatedFlags([]flagAlias{{Old: "coordserver", New: "control-url"}}, true)
+	})
+	if !strings.Contains(out, SignalWarning+" deprecated_flag flag=coordserver use=control-url") {
+		t.Errorf("Expected a deprecation warning, got %q", out)
+	}
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// --- PORT FORWARDS ---
+
+// ForwardRule exposes a pool of tailnet backends on a local port
+type ForwardRule struct {
+	Listen      string   `json:"listen"`                 // local address or bare port (binds 127.0.0.1)
+	AlsoListen  []string `json:"also_listen,omitempty"`  // more addresses or bare ports for the same targets
+	AcceptLoops int      `json:"accept_loops,omitempty"` // listeners per address, sharing it with SO_REUSEPORT (default 1)
+	Compress    string   `json:"compress,omitempty"`     // "zstd" to compress the tunnel when the target runs a sidecar
+	Multiplex   bool     `json:"multiplex,omitempty"`    // share one channel per target node when it runs a sidecar
+	PoolConfig
+}
+
+// maxAcceptLoops is far beyond what helps; more only costs file descriptors
+const maxAcceptLoops = 64
+
+// listenAddr returns the address to bind, defaulting to loopback for bare ports
+func (f ForwardRule) listenAddr() string {
+	return bindAddr(f.Listen)
+}
+
+// listenAddrs returns Listen followed by AlsoListen, as addresses to bind
+func (f ForwardRule) listenAddrs() []string {
+	addrs := []string{f.listenAddr()}
+	for _, l := range f.AlsoListen {
+		addrs = append(addrs, bindAddr(l))
+	}
+	return addrs
+}
+
+func bindAddr(listen string) string {
+	if !strings.Contains(listen, ":") {
+		return net.JoinHostPort("127.0.0.1", listen)
+	}
+	return listen
+}
+
+// validate checks a rule from the config file or the control API
+func (f ForwardRule) validate() error {
+	if f.Listen == "" {
+		return errors.New("listen is required")
+	}
+	if slices.Contains(f.AlsoListen, "") {
+		return errors.New("also_listen entries must not be empty")
+	}
+	addrs := f.listenAddrs()
+	for i, a := range addrs {
+		if slices.Contains(addrs[:i], a) {
+			return fmt.Errorf("%s is listed twice", a)
+		}
+	}
+	if f.AcceptLoops < 0 || f.AcceptLoops > maxAcceptLoops {
+		return fmt.Errorf("accept_loops must be between 0 and %d, got %d", maxAcceptLoops, f.AcceptLoops)
+	}
+	if f.AcceptLoops > 1 && !reusePortSupported {
+		return errors.New("accept_loops needs SO_REUSEPORT, which this platform lacks")
+	}
+	if f.Compress != "" && f.Compress != CompressZstd {
+		return fmt.Errorf("unknown compression %q", f.Compress)
+	}
+	if f.Compress != "" && f.Multiplex {
+		return errors.New("compress and multiplex can't be combined")
+	}
+	return f.PoolConfig.validate()
+}
+
+// ForwardStatus is one running forward in /control/forwards
+type ForwardStatus struct {
+	ForwardRule
+	Addr    string `json:"addr"`    // the bound address
+	Dynamic bool   `json:"dynamic"` // added through the control API, not the config file
+}
+
+// forwardTable keeps the running forwards by bound address, so the control
+// API can add and remove them while the sidecar runs
+type forwardTable struct {
+	dialer Dialer
+	online peerOnlineFunc
+
+	mu      sync.Mutex
+	running map[string]*runningForward
+}
+
+type runningForward struct {
+	rule    ForwardRule
+	lns     []net.Listener // AcceptLoops per address
+	dynamic bool
+}
+
+var errForwardExists = errors.New("already forwarded")
+
+// forwards is set once the router exists; until then the control API
+// refuses changes
+var forwards *forwardTable
+
+func newForwardTable(d Dialer, online peerOnlineFunc) *forwardTable {
+	return &forwardTable{dialer: d, online: online, running: map[string]*runningForward{}}
+}
+
+// startForwards binds every forward rule and balances accepted connections
+// across its targets.
+func startForwards(t *forwardTable, rules []ForwardRule) error {
+	for _, rule := range rules {
+		if _, err := t.start(rule, false); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// start binds one rule and returns its status
+func (t *forwardTable) start(rule ForwardRule, dynamic bool) (ForwardStatus, error) {
+	addr := rule.listenAddr()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	addrs := rule.listenAddrs()
+	for _, f := range t.running {
+		for _, a := range f.rule.listenAddrs() {
+			if slices.Contains(addrs, a) {
+				return ForwardStatus{}, fmt.Errorf("%s: %w", a, errForwardExists)
+			}
+		}
+	}
+	// The shared stats and channels only exist if set up at startup
+	if rule.Compress == CompressZstd && compression == nil {
+		return ForwardStatus{}, errors.New("compress needs a compressed forward in the config file or -zstd-server")
+	}
+	if rule.Multiplex && mux == nil {
+		return ForwardStatus{}, errors.New("multiplex needs a multiplexed forward in the config file or -mux-server")
+	}
+	lns, err := listenForward(addrs, rule.AcceptLoops)
+	if err != nil {
+		return ForwardStatus{}, err
+	}
+
+	pool := newPool(addr, rule.PoolConfig, t.online)
+	// Sidecar-to-sidecar tunnels resolve services themselves to find
+	// the node they talk to
+	var resolve func(string) (string, error)
+	if r, ok := t.dialer.(*Router); ok {
+		resolve = r.resolve
+	}
+	dialer := t.dialer
+	switch {
+	case rule.Compress == CompressZstd:
+		dialer = &zstdDialer{Base: t.dialer, resolve: resolve, counters: compression.counters(addr)}
+	case rule.Multiplex:
+		dialer = &muxDialer{Base: t.dialer, resolve: resolve, mux: mux}
+	}
+	for _, ln := range lns {
+		// Targets without a port are dialed on the port the client connected to
+		_, port, _ := net.SplitHostPort(ln.Addr().String())
+		go serveForward(ln, "forward", func(ctx context.Context) (net.Conn, error) {
+			return pool.Dial(ctx, dialer, "tcp", port)
+		})
+	}
+	t.running[addr] = &runningForward{rule: rule, lns: lns, dynamic: dynamic}
+
+	targets := strings.Join(append(rule.Targets, rule.Backup...), ",")
+	for _, a := range addrs {
+		if rule.AcceptLoops > 1 {
+			fmt.Fprintf(console, ">>> Forward %s -> %s (%d accept loops)\n", a, targets, rule.AcceptLoops)
+		} else {
+			fmt.Fprintf(console, ">>> Forward %s -> %s\n", a, targets)
+		}
+		listeners.add(ListenerInfo{Mode: "forward", Addr: a, Target: targets})
+		signal(SignalListening, fmt.Sprintf("mode=forward addr=%s targets=%s", a, targets))
+	}
+	return ForwardStatus{ForwardRule: rule, Addr: addr, Dynamic: dynamic}, nil
+}
+
+// listenForward binds loops listeners (at least one) to every address.
+// Several listeners on one address share it with SO_REUSEPORT, so a burst
+// of short connections is accepted by as many goroutines in parallel. If
+// any bind fails, the listeners opened so far are closed again.
+func listenForward(addrs []string, loops int) ([]net.Listener, error) {
+	listen := listenClients
+	if loops > 1 {
+		listen = listenClientsShared
+	}
+	var lns []net.Listener
+	for _, addr := range addrs {
+		for range max(loops, 1) {
+			ln, err := listen(addr)
+			if err != nil {
+				for _, l := range lns {
+					l.Close()
+				}
+				return nil, fmt.Errorf("failed to listen on %s: %w", addr, err)
+			}
+			lns = append(lns, ln)
+		}
+	}
+	return lns, nil
+}
+
+// stop closes the listeners of the forward bound to listen (an address or
+// bare port). Established connections are left alone.
+func (t *forwardTable) stop(listen string) (ForwardStatus, bool) {
+	if t == nil {
+		return ForwardStatus{}, false
+	}
+	addr := ForwardRule{Listen: listen}.listenAddr()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	f, ok := t.running[addr]
+	if !ok {
+		return ForwardStatus{}, false
+	}
+	for _, ln := range f.lns {
+		ln.Close()
+	}
+	delete(t.running, addr)
+	for _, a := range f.rule.listenAddrs() {
+		listeners.remove("forward", a)
+	}
+	fmt.Fprintf(console, ">>> Forward %s removed\n", addr)
+	return ForwardStatus{ForwardRule: f.rule, Addr: addr, Dynamic: f.dynamic}, true
+}
+
+// list returns the running forwards sorted by address
+func (t *forwardTable) list() []ForwardStatus {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	out := []ForwardStatus{}
+	for addr, f := range t.running {
+		out = append(out, ForwardStatus{ForwardRule: f.rule, Addr: addr, Dynamic: f.dynamic})
+	}
+	slices.SortFunc(out, func(a, b ForwardStatus) int { return strings.Compare(a.Addr, b.Addr) })
+	return out
+}
+
+// handleForwards serves /control/forwards: GET lists the running forwards,
+// POST starts one from a forward rule like those in the config file
+func handleForwards(w http.ResponseWriter, r *http.Request) {
+	t := forwards
+	if t == nil {
+		http.Error(w, "forwards are not ready yet", http.StatusServiceUnavailable)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(t.list())
+	case http.MethodPost:
+		var rule ForwardRule
+		if err := json.NewDecoder(r.Body).Decode(&rule); err != nil {
+			http.Error(w, fmt.Sprintf("invalid request body: %v", err), http.StatusBadRequest)
+			return
+		}
+		if err := rule.validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		st, err := t.start(rule, true)
+		if err != nil {
+			status := http.StatusBadRequest
+			if errors.Is(err, errForwardExists) || classifyError(err, "") == CodeBindInUse {
+				status = http.StatusConflict
+			}
+			http.Error(w, err.Error(), status)
+			return
+		}
+		audit.record("forward_add", "addr", st.Addr, "targets", strings.Join(rule.Targets, ","))
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(st)
+	default:
+		http.Error(w, "only GET and POST allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleForward serves DELETE /control/forwards/{listen}
+func handleForward(w http.ResponseWriter, r *http.Request) {
+	listen := r.PathValue("listen")
+	st, ok := forwards.stop(listen)
+	if !ok {
+		http.Error(w, fmt.Sprintf("no forward on %q", listen), http.StatusNotFound)
+		return
+	}
+	audit.record("forward_remove", "addr", st.Addr)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(st)
+}
+
+// serveForward accepts connections on ln and pipes each one to whatever dial
+// returns, listing them in the connection table under kind.
+func serveForward(ln net.Listener, kind string, dial func(ctx context.Context) (net.Conn, error)) {
+	for {
+		clientConn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		if maintenance.Load() {
+			fmt.Fprintf(console, "[FORWARD] %s: refusing %s, maintenance mode\n", ln.Addr(), clientConn.RemoteAddr())
+			clientConn.Close()
+			continue
+		}
+		if err := limits.admit(); err != nil {
+			fmt.Fprintf(console, "[FORWARD] %s: refusing %s, %v\n", ln.Addr(), clientConn.RemoteAddr(), err)
+			clientConn.Close()
+			continue
+		}
+		go func() {
+			defer clientConn.Close()
+
+			id := newRequestID()
+			ctx := withRequestID(withClientAddr(context.Background(), clientConn.RemoteAddr().String()), id)
+			targetConn, err := dial(ctx)
+			if err != nil {
+				fmt.Fprintf(console, "[FORWARD] %s: %s dial failed: %v\n", ln.Addr(), id, err)
+				requestFailed(id, kind, ln.Addr().String(), err)
+				return
+			}
+			target := targetConn.RemoteAddr().String()
+			if pc, ok := targetConn.(*poolConn); ok {
+				target = pc.backend.addr
+			}
+			targetConn = connections.track(kind, id, clientConn.RemoteAddr().String(), target, targetConn, clientConn)
+			defer targetConn.Close()
+
+			fmt.Fprintf(console, "[FORWARD] %s %s -> %s\n", id, clientConn.RemoteAddr(), target)
+			go io.Copy(targetConn, clientConn)
+			io.Copy(clientConn, targetConn)
+		}()
+	}
+}
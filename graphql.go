@@ -0,0 +1,415 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// --- GRAPHQL ---
+
+const (
+	maxGraphQLBody       = 1 << 20 // larger requests are proxied untouched
+	maxGraphQLErrorBody  = 64 << 10
+	maxPersistedQueries  = 1000 // per host; the cache starts over beyond this
+	maxGraphQLRetries    = 5
+	graphqlRetryInterval = 200 * time.Millisecond
+)
+
+// GraphQLRule is one entry of the graphql section of the config file. It
+// enables optimizations for a GraphQL endpoint reached over plain HTTP.
+type GraphQLRule struct {
+	Host             string `json:"host"`                        // host or host:port, as in mirrors
+	Path             string `json:"path,omitempty"`              // default "/graphql"
+	PersistedQueries bool   `json:"persisted_queries,omitempty"` // send known queries by hash only
+	Retries          int    `json:"retries,omitempty"`           // for queries failing in transport, not mutations
+}
+
+func (r *GraphQLRule) validate() error {
+	if r.Host == "" {
+		return fmt.Errorf("host is required")
+	}
+	if r.Path != "" && !strings.HasPrefix(r.Path, "/") {
+		return fmt.Errorf("path must start with '/', got %q", r.Path)
+	}
+	if r.Retries < 0 || r.Retries > maxGraphQLRetries {
+		return fmt.Errorf("retries must be between 0 and %d, got %d", maxGraphQLRetries, r.Retries)
+	}
+	return nil
+}
+
+// GraphQLStats is one endpoint's row in /stats/graphql
+type GraphQLStats struct {
+	Host          string `json:"host"`
+	Path          string `json:"path"`
+	Requests      int64  `json:"requests"`
+	Persisted     int64  `json:"persisted"`      // sent as hash only
+	BytesSaved    int64  `json:"bytes_saved"`    // query text not sent
+	Fallbacks     int64  `json:"fallbacks"`      // hash unknown to the server, resent in full
+	Retries       int64  `json:"retries"`        // transport errors retried
+	CachedQueries int    `json:"cached_queries"` // hashes the server is known to have
+	APQSupported  bool   `json:"apq_supported"`  // false once the server said it has no persisted queries
+}
+
+// graphqlEndpoint applies a rule. The server's persisted query cache is
+// mirrored by hash, with the query text, so clients sending full queries
+// every time only send them once over the tailnet.
+type graphqlEndpoint struct {
+	GraphQLRule
+
+	mu          sync.Mutex
+	known       map[string]string // hash -> query the server has registered
+	unsupported atomic.Bool
+
+	requests, persisted, saved, fallbacks, retries atomic.Int64
+}
+
+// graphqlEndpoints is nil unless the config has a graphql section
+type graphqlEndpoints []*graphqlEndpoint
+
+var graphql graphqlEndpoints
+
+func newGraphQLEndpoints(rules []GraphQLRule) graphqlEndpoints {
+	var eps graphqlEndpoints
+	for _, r := range rules {
+		if r.Path == "" {
+			r.Path = "/graphql"
+		}
+		eps = append(eps, &graphqlEndpoint{GraphQLRule: r, known: map[string]string{}})
+	}
+	return eps
+}
+
+// match returns the endpoint handling r, if any
+func (eps graphqlEndpoints) match(r *http.Request) *graphqlEndpoint {
+	if r.Method != http.MethodPost {
+		return nil
+	}
+	for _, ep := range eps {
+		if matchHost(ep.Host, r.URL.Host) && r.URL.Path == ep.Path {
+			return ep
+		}
+	}
+	return nil
+}
+
+func (eps graphqlEndpoints) stats() []GraphQLStats {
+	list := []GraphQLStats{}
+	for _, ep := range eps {
+		ep.mu.Lock()
+		cached := len(ep.known)
+		ep.mu.Unlock()
+		list = append(list, GraphQLStats{
+			Host:          ep.Host,
+			Path:          ep.Path,
+			Requests:      ep.requests.Load(),
+			Persisted:     ep.persisted.Load(),
+			BytesSaved:    ep.saved.Load(),
+			Fallbacks:     ep.fallbacks.Load(),
+			Retries:       ep.retries.Load(),
+			CachedQueries: cached,
+			APQSupported:  !ep.unsupported.Load(),
+		})
+	}
+	return list
+}
+
+// persistedQuery is the extension of Apollo's automatic persisted queries
+type persistedQuery struct {
+	Version    int    `json:"version"`
+	SHA256Hash string `json:"sha256Hash"`
+}
+
+// graphqlBody is a single GraphQL request. Fields the sidecar doesn't know
+// are passed through unchanged.
+type graphqlBody map[string]json.RawMessage
+
+func (b graphqlBody) str(key string) string {
+	var s string
+	json.Unmarshal(b[key], &s)
+	return s
+}
+
+// persistedHash returns the hash from the persistedQuery extension
+func (b graphqlBody) persistedHash() string {
+	var ext struct {
+		PersistedQuery *persistedQuery `json:"persistedQuery"`
+	}
+	if json.Unmarshal(b["extensions"], &ext) != nil || ext.PersistedQuery == nil {
+		return ""
+	}
+	return ext.PersistedQuery.SHA256Hash
+}
+
+// encode returns the body with or without the query text, always carrying
+// the persistedQuery extension for hash
+func (b graphqlBody) encode(query, hash string, withQuery bool) []byte {
+	out := graphqlBody{}
+	for k, v := range b {
+		out[k] = v
+	}
+	delete(out, "query")
+	if withQuery {
+		out["query"], _ = json.Marshal(query)
+	}
+	ext := map[string]json.RawMessage{}
+	json.Unmarshal(b["extensions"], &ext)
+	ext["persistedQuery"], _ = json.Marshal(persistedQuery{Version: 1, SHA256Hash: hash})
+	out["extensions"], _ = json.Marshal(ext)
+	data, _ := json.Marshal(out)
+	return data
+}
+
+func queryHash(query string) string {
+	sum := sha256.Sum256([]byte(query))
+	return hex.EncodeToString(sum[:])
+}
+
+// roundTrip sends r through rt with the endpoint's optimizations. Requests
+// it can't parse are sent as they are.
+func (ep *graphqlEndpoint) roundTrip(rt http.RoundTripper, r *http.Request) (*http.Response, error) {
+	ep.requests.Add(1)
+	if r.Body == nil || r.ContentLength > maxGraphQLBody {
+		return rt.RoundTrip(r)
+	}
+	original, err := io.ReadAll(io.LimitReader(r.Body, maxGraphQLBody+1))
+	r.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	if len(original) > maxGraphQLBody {
+		// Larger than announced; stream the rest after what was read
+		r.Body = io.NopCloser(io.MultiReader(bytes.NewReader(original), r.Body))
+		return rt.RoundTrip(r)
+	}
+
+	var body graphqlBody
+	if json.Unmarshal(original, &body) != nil || body == nil {
+		return ep.send(rt, r, original, false)
+	}
+	query, hash := body.str("query"), body.persistedHash()
+	idempotent := query != "" && graphqlOperation(query, body.str("operationName")) == "query"
+
+	if !ep.PersistedQueries || ep.unsupported.Load() {
+		return ep.send(rt, r, original, idempotent)
+	}
+	if query == "" && hash != "" {
+		// A client sending a hash the server forgot gets the query from us
+		ep.mu.Lock()
+		query = ep.known[hash]
+		ep.mu.Unlock()
+		idempotent = query != "" && graphqlOperation(query, body.str("operationName")) == "query"
+	}
+	if query == "" {
+		return ep.send(rt, r, original, false)
+	}
+	if hash == "" {
+		hash = queryHash(query)
+	}
+
+	ep.mu.Lock()
+	_, known := ep.known[hash]
+	ep.mu.Unlock()
+	if known {
+		resp, err := ep.send(rt, r, body.encode(query, hash, false), idempotent)
+		if err != nil {
+			return nil, err
+		}
+		switch persistedQueryError(resp) {
+		case "":
+			ep.persisted.Add(1)
+			ep.saved.Add(int64(len(query)))
+			return resp, nil
+		case "not_supported":
+			ep.unsupported.Store(true)
+			fmt.Fprintf(console, "[GRAPHQL] %s%s has no persisted queries, sending full queries\n", ep.Host, ep.Path)
+		}
+		resp.Body.Close()
+		ep.fallbacks.Add(1)
+		ep.forget(hash)
+	}
+
+	// Full query with its hash, which APQ servers register
+	resp, err := ep.send(rt, r, body.encode(query, hash, true), idempotent)
+	if err == nil && resp.StatusCode == http.StatusOK {
+		switch persistedQueryError(resp) {
+		case "":
+			ep.remember(hash, query)
+		case "not_supported":
+			ep.unsupported.Store(true)
+		}
+	}
+	return resp, err
+}
+
+// send round-trips a copy of r with body, retrying transport errors of
+// idempotent requests
+func (ep *graphqlEndpoint) send(rt http.RoundTripper, r *http.Request, body []byte, idempotent bool) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		req := r.Clone(r.Context())
+		req.Body = io.NopCloser(bytes.NewReader(body))
+		req.ContentLength = int64(len(body))
+		req.Header.Del("Content-Length")
+		resp, err := rt.RoundTrip(req)
+		if err == nil || !idempotent || attempt >= ep.Retries || !retryable(err) {
+			return resp, err
+		}
+		ep.retries.Add(1)
+		fmt.Fprintf(console, "[GRAPHQL] %s%s: retrying query after %v\n", ep.Host, ep.Path, err)
+		select {
+		case <-r.Context().Done():
+			return nil, err
+		case <-time.After(graphqlRetryInterval << attempt):
+		}
+	}
+}
+
+// retryable reports whether a transport error may go away on its own.
+// Policy denials and cancellations won't.
+func retryable(err error) bool {
+	return !isACLDenied(err) && !isSessionDenied(err) && !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded)
+}
+
+func (ep *graphqlEndpoint) remember(hash, query string) {
+	ep.mu.Lock()
+	defer ep.mu.Unlock()
+	if len(ep.known) >= maxPersistedQueries {
+		clear(ep.known)
+	}
+	ep.known[hash] = query
+}
+
+func (ep *graphqlEndpoint) forget(hash string) {
+	ep.mu.Lock()
+	defer ep.mu.Unlock()
+	delete(ep.known, hash)
+}
+
+// persistedQueryError peeks at a small response for the errors APQ servers
+// return: "not_found" when the hash isn't registered, "not_supported" when
+// the server has no persisted queries. The body stays readable.
+func persistedQueryError(resp *http.Response) string {
+	if resp.ContentLength > maxGraphQLErrorBody {
+		return ""
+	}
+	head, err := io.ReadAll(io.LimitReader(resp.Body, maxGraphQLErrorBody+1))
+	resp.Body = readCloser{io.MultiReader(bytes.NewReader(head), resp.Body), resp.Body}
+	if err != nil || len(head) > maxGraphQLErrorBody {
+		return ""
+	}
+	switch {
+	case bytes.Contains(head, []byte("PersistedQueryNotSupported")), bytes.Contains(head, []byte("PERSISTED_QUERY_NOT_SUPPORTED")):
+		return "not_supported"
+	case bytes.Contains(head, []byte("PersistedQueryNotFound")), bytes.Contains(head, []byte("PERSISTED_QUERY_NOT_FOUND")):
+		return "not_found"
+	}
+	return ""
+}
+
+// readCloser reads from one reader and closes another
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// graphqlOperation returns "query", "mutation" or "subscription" for the
+// operation a document runs: the one named name, or its only operation.
+// It returns "" when that can't be told.
+func graphqlOperation(doc, name string) string {
+	type op struct{ kind, name string }
+	var ops []op
+	depth, parens := 0, 0
+	pending := "" // definition keyword seen at the top level
+	named := false
+	for i := 0; i < len(doc); i++ {
+		c := doc[i]
+		switch {
+		case c == '#':
+			for i < len(doc) && doc[i] != '\n' {
+				i++
+			}
+		case c == '"':
+			if strings.HasPrefix(doc[i:], `"""`) {
+				end := strings.Index(doc[i+3:], `"""`)
+				if end < 0 {
+					return ""
+				}
+				i += end + 6
+				continue
+			}
+			for i++; i < len(doc) && doc[i] != '"'; i++ {
+				if doc[i] == '\\' {
+					i++
+				}
+			}
+		case c == '(':
+			parens++
+		case c == ')':
+			parens--
+		case c == '{' && parens == 0:
+			if depth == 0 && pending == "" {
+				ops = append(ops, op{kind: "query"}) // shorthand "{ ... }"
+			}
+			depth++
+			pending = ""
+		case c == '}' && parens == 0:
+			depth--
+		case depth == 0 && parens == 0 && isNameStart(c):
+			j := i
+			for j < len(doc) && isNameChar(doc[j]) {
+				j++
+			}
+			word := doc[i:j]
+			i = j - 1
+			switch {
+			case pending == "" && (word == "query" || word == "mutation" || word == "subscription"):
+				ops = append(ops, op{kind: word})
+				pending, named = word, false
+			case pending == "" && word == "fragment":
+				pending = word
+			case pending != "" && pending != "fragment" && !named:
+				ops[len(ops)-1].name, named = word, true
+			}
+		}
+	}
+	if name == "" {
+		if len(ops) == 1 {
+			return ops[0].kind
+		}
+		return ""
+	}
+	for _, o := range ops {
+		if o.name == name {
+			return o.kind
+		}
+	}
+	return ""
+}
+
+func isNameStart(c byte) bool {
+	return c == '_' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z'
+}
+
+func isNameChar(c byte) bool {
+	return isNameStart(c) || '0' <= c && c <= '9'
+}
+
+// handleGraphQLStats serves the per-endpoint counters on the status API
+func handleGraphQLStats(w http.ResponseWriter, r *http.Request) {
+	if graphql == nil {
+		http.Error(w, "no graphql section in the config", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(graphql.stats())
+}
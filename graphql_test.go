@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// apqServer answers like an Apollo server with automatic persisted queries
+type apqServer struct {
+	registered map[string]bool
+	bodies     []map[string]json.RawMessage
+	fail       int // transport errors before answering
+}
+
+func (s *apqServer) RoundTrip(req *http.Request) (*http.Response, error) {
+	if s.fail > 0 {
+		s.fail--
+		return nil, errors.New("connection reset by peer")
+	}
+	var body map[string]json.RawMessage
+	json.NewDecoder(req.Body).Decode(&body)
+	s.bodies = append(s.bodies, body)
+	hash := graphqlBody(body).persistedHash()
+	answer := `{"data":{"ok":true}}`
+	switch {
+	case body["query"] != nil && hash != "":
+		s.registered[hash] = true
+	case hash != "" && !s.registered[hash]:
+		answer = `{"errors":[{"message":"PersistedQueryNotFound","extensions":{"code":"PERSISTED_QUERY_NOT_FOUND"}}]}`
+	}
+	return &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: io.NopCloser(strings.NewReader(answer))}, nil
+}
+
+func TestGraphQLPersistedQueries(t *testing.T) {
+	server := &apqServer{registered: map[string]bool{}}
+	ep := newGraphQLEndpoints([]GraphQLRule{{Host: "core", PersistedQueries: true}})[0]
+	query := `query Me { me { id name } }`
+	send := func() string {
+		req := httptest.NewRequest("POST", "http://core/graphql", strings.NewReader(`{"query":"`+query+`","variables":{"a":1}}`))
+		resp, err := ep.roundTrip(server, req)
+		if err != nil {
+			t.Fatalf("roundTrip failed: %v", err)
+		}
+		data, _ := io.ReadAll(resp.Body)
+		return string(data)
+	}
+
+	if got := send(); got != `{"data":{"ok":true}}` {
+		t.Errorf("Unexpected first answer %s", got)
+	}
+	if server.bodies[0]["query"] == nil || graphqlBody(server.bodies[0]).persistedHash() != queryHash(query) {
+		t.Errorf("Expected the first request to register the query, got %v", server.bodies[0])
+	}
+	send()
+	if server.bodies[1]["query"] != nil || string(server.bodies[1]["variables"]) != `{"a":1}` {
+		t.Errorf("Expected the second request by hash only with its variables, got %v", server.bodies[1])
+	}
+
+	// The server forgot the hash: the full query is resent transparently
+	server.registered = map[string]bool{}
+	if got := send(); got != `{"data":{"ok":true}}` {
+		t.Errorf("Expected the fallback to answer, got %s", got)
+	}
+	if len(server.bodies) != 4 || server.bodies[3]["query"] == nil {
+		t.Errorf("Expected a hash-only attempt and a full resend, got %d requests", len(server.bodies))
+	}
+
+	st := graphqlEndpoints{ep}.stats()[0]
+	if st.Requests != 3 || st.Persisted != 1 || st.Fallbacks != 1 || st.BytesSaved != int64(len(query)) || st.CachedQueries != 1 {
+		t.Errorf("Unexpected stats %+v", st)
+	}
+}
+
+func TestGraphQLRetries(t *testing.T) {
+	ep := newGraphQLEndpoints([]GraphQLRule{{Host: "core", Retries: 2}})[0]
+
+	server := &apqServer{registered: map[string]bool{}, fail: 2}
+	req := httptest.NewRequest("POST", "http://core/graphql", strings.NewReader(`{"query":"{ me { id } }"}`))
+	if _, err := ep.roundTrip(server, req); err != nil {
+		t.Errorf("Expected a query to be retried, got %v", err)
+	}
+
+	server = &apqServer{registered: map[string]bool{}, fail: 1}
+	req = httptest.NewRequest("POST", "http://core/graphql", strings.NewReader(`{"query":"mutation Delete { delete(id: 1) }"}`))
+	if _, err := ep.roundTrip(server, req); err == nil {
+		t.Error("Expected a mutation not to be retried")
+	}
+	if ep.retries.Load() != 2 {
+		t.Errorf("Expected 2 retries, got %d", ep.retries.Load())
+	}
+}
+
+func TestGraphQLOperation(t *testing.T) {
+	for _, tc := range []struct{ doc, name, want string }{
+		{`{ me { id } }`, "", "query"},
+		{`query { me }`, "", "query"},
+		{`mutation Add($x: In = {a: "{"}) { add(x: $x) }`, "", "mutation"},
+		{`# mutation in a comment
+		  query Q { f(s: "mutation {") }`, "", "query"},
+		{`fragment F on User { id } query A { me { ...F } } mutation B { x }`, "B", "mutation"},
+		{`fragment F on User { id } query A { me { ...F } } mutation B { x }`, "A", "query"},
+		{`query A { a } query B { b }`, "", ""},
+		{`subscription S { events }`, "", "subscription"},
+		{`query Q { f(doc: """ mutation { } """) }`, "", "query"},
+	} {
+		if got := graphqlOperation(tc.doc, tc.name); got != tc.want {
+			t.Errorf("graphqlOperation(%q, %q) = %q, want %q", tc.doc, tc.name, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"runtime/debug"
+	"runtime/metrics"
+	"sync"
+)
+
+// --- GUARDRAILS ---
+
+// memoryResumeRatio is how far below -max-memory-mb usage has to fall before
+// new connections are accepted again, so the sidecar doesn't flap at the limit
+const memoryResumeRatio = 0.8
+
+// limits decides whether a new connection may be accepted. Both limits are
+// off until main configures them.
+var limits = &admission{memory: memoryInUse, active: connections.count}
+
+// admission rejects new connections when a runaway client has opened too
+// many tunnels or the process is running out of memory, instead of letting
+// it OOM on a user's workstation.
+type admission struct {
+	MaxTunnels int    // 0 = unlimited
+	MaxMemory  uint64 // bytes, 0 = unlimited
+
+	memory func() uint64 // current memory use of the process
+	active func() int    // currently open tunnels
+
+	mu         sync.Mutex
+	overMemory bool   // above MaxMemory and not yet back under the resume mark
+	warned     string // reason of the last warning, "" while healthy
+}
+
+// overloadError explains why a connection was rejected
+type overloadError struct {
+	reason string
+}
+
+func (e *overloadError) Error() string {
+	return "sidecar overloaded: " + e.reason
+}
+
+func (e *overloadError) localize(lang string) string {
+	return tr(lang, "client.overloaded", "reason", e.reason)
+}
+
+// admit returns an *overloadError if a new connection must be rejected
+func (a *admission) admit() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	reason := ""
+	if a.MaxMemory > 0 {
+		used := a.memory()
+		if used >= a.MaxMemory {
+			a.overMemory = true
+		} else if float64(used) < float64(a.MaxMemory)*memoryResumeRatio {
+			a.overMemory = false
+		}
+		if a.overMemory {
+			reason = fmt.Sprintf("memory use %d MB exceeds -max-memory-mb %d", used>>20, a.MaxMemory>>20)
+		}
+	}
+	if reason == "" && a.MaxTunnels > 0 {
+		if n := a.active(); n >= a.MaxTunnels {
+			reason = fmt.Sprintf("%d concurrent tunnels reached -max-concurrent-tunnels", n)
+		}
+	}
+
+	// Warn once when we start rejecting, not for every rejected connection
+	if reason != "" && a.warned == "" {
+		fmt.Fprintf(console, "!!! Rejecting new connections: %s\n", reason)
+		signal(SignalWarning, fmt.Sprintf("overloaded reason=%q", reason))
+	} else if reason == "" && a.warned != "" {
+		fmt.Fprintln(console, ">>> Load back under limits: accepting connections")
+	}
+	a.warned = reason
+
+	if reason != "" {
+		return &overloadError{reason: reason}
+	}
+	return nil
+}
+
+// setMemoryLimit also makes the GC work harder as usage approaches the
+// watermark, which often keeps the sidecar from reaching it at all
+func (a *admission) setMemoryLimit(mb int) {
+	a.MaxMemory = uint64(mb) << 20
+	debug.SetMemoryLimit(int64(a.MaxMemory))
+}
+
+// memoryInUse returns the memory the Go runtime has mapped and not returned
+// to the OS, the same measure the runtime's memory limit applies to
+func memoryInUse() uint64 {
+	samples := []metrics.Sample{
+		{Name: "/memory/classes/total:bytes"},
+		{Name: "/memory/classes/heap/released:bytes"},
+	}
+	metrics.Read(samples)
+	return samples[0].Value.Uint64() - samples[1].Value.Uint64()
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAdmissionTunnelLimit(t *testing.T) {
+	open := 0
+	a := &admission{MaxTunnels: 2, active: func() int { return open }}
+
+	for open = 0; open < 2; open++ {
+		if err := a.admit(); err != nil {
+			t.Fatalf("Expected tunnel %d to be admitted, got %v", open+1, err)
+		}
+	}
+	err := a.admit()
+	if err == nil || !strings.Contains(err.Error(), "2 concurrent tunnels") {
+		t.Errorf("Expected the third tunnel to be rejected, got %v", err)
+	}
+
+	open = 1
+	if err := a.admit(); err != nil {
+		t.Errorf("Expected admission once a tunnel closed, got %v", err)
+	}
+}
+
+func TestAdmissionMemoryWatermarks(t *testing.T) {
+	var used uint64
+	a := &admission{MaxMemory: 100 << 20, memory: func() uint64 { return used }, active: func() int { return 0 }}
+
+	for _, step := range []struct {
+		usedMB int
+		ok     bool
+	}{
+		{50, true},
+		{100, false}, // high watermark reached
+		{90, false},  // still above the resume mark
+		{79, true},   // below 80%
+		{95, true},
+	} {
+		used = uint64(step.usedMB) << 20
+		if err := a.admit(); (err == nil) != step.ok {
+			t.Errorf("At %d MB: expected admitted=%v, got %v", step.usedMB, step.ok, err)
+		}
+	}
+}
+
+func TestOverloadedProxyRejects(t *testing.T) {
+	saved := limits
+	defer func() { limits = saved }()
+	limits = &admission{MaxTunnels: 1, active: func() int { return 1 }}
+
+	proxy := &TailscaleProxy{Transport: &MockRoundTripper{
+		RoundTripFunc: func(req *http.Request) (*http.Response, error) {
+			t.Error("Expected no upstream request while overloaded")
+			return nil, nil
+		},
+	}}
+	rec := httptest.NewRecorder()
+	proxy.ServeHTTP(rec, httptest.NewRequest("GET", "http://data-node/", nil))
+	if rec.Code != http.StatusServiceUnavailable || !strings.Contains(rec.Body.String(), "overloaded") {
+		t.Errorf("Expected 503 overloaded, got %d %q", rec.Code, rec.Body.String())
+	}
+
+	if _, ok := (admissionRules{}).Allow(context.Background(), nil); ok {
+		t.Error("Expected SOCKS5 requests to be refused while overloaded")
+	}
+}
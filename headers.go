@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"golang.org/x/net/http/httpguts"
+)
+
+// --- RESPONSE HEADERS ---
+
+// HeaderRules change the headers of plain HTTP responses on a route, so
+// browser-based tools can talk to tailnet APIs that weren't built for
+// cross-origin use: add CORS headers, strip cookies the tool shouldn't keep.
+type HeaderRules struct {
+	Remove []string          `json:"remove,omitempty"` // dropped from the service's response
+	Set    map[string]string `json:"set,omitempty"`    // replace any value from the service
+	Add    map[string]string `json:"add,omitempty"`    // appended to the service's values
+}
+
+// protectedHeaders frame the response or identify the request; changing
+// them would break the proxy, not just the client
+var protectedHeaders = []string{"Content-Length", "Transfer-Encoding", "Connection", requestIDHeader}
+
+// validate checks names and values. Safe on nil rules.
+func (h *HeaderRules) validate() error {
+	if h == nil {
+		return nil
+	}
+	check := func(name string) error {
+		if !httpguts.ValidHeaderFieldName(name) {
+			return fmt.Errorf("invalid header name %q", name)
+		}
+		for _, p := range protectedHeaders {
+			if strings.EqualFold(name, p) {
+				return fmt.Errorf("%s can't be changed", p)
+			}
+		}
+		return nil
+	}
+	for _, name := range h.Remove {
+		if err := check(name); err != nil {
+			return err
+		}
+	}
+	for _, m := range []map[string]string{h.Set, h.Add} {
+		for name, value := range m {
+			if err := check(name); err != nil {
+				return err
+			}
+			if !httpguts.ValidHeaderFieldValue(value) {
+				return fmt.Errorf("invalid value for %s", name)
+			}
+		}
+	}
+	return nil
+}
+
+// apply removes, then sets, then adds. Safe on nil rules.
+func (h *HeaderRules) apply(header http.Header) {
+	if h == nil {
+		return
+	}
+	for _, name := range h.Remove {
+		header.Del(name)
+	}
+	for name, value := range h.Set {
+		header.Set(name, value)
+	}
+	for name, value := range h.Add {
+		header.Add(name, value)
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRouteResponseHeaders(t *testing.T) {
+	mockRT := &MockRoundTripper{
+		RoundTripFunc: func(req *http.Request) (*http.Response, error) {
+			h := make(http.Header)
+			h.Add("Set-Cookie", "session=abc")
+			h.Set("Access-Control-Allow-Origin", "https://other.example")
+			h.Set("Vary", "Accept-Encoding")
+			return &http.Response{StatusCode: 200, Body: io.NopCloser(strings.NewReader("OK")), Header: h}, nil
+		},
+	}
+	router := newRouter(&recordingDialer{}, []RouteRule{{
+		Host: "api",
+		ResponseHeaders: &HeaderRules{
+			Remove: []string{"set-cookie"},
+			Set:    map[string]string{"Access-Control-Allow-Origin": "http://localhost:3000"},
+			Add:    map[string]string{"Vary": "Origin"},
+		},
+		PoolConfig: PoolConfig{Targets: []string{"api"}},
+	}}, nil)
+	proxy := &TailscaleProxy{Transport: mockRT, Router: router}
+
+	w := httptest.NewRecorder()
+	proxy.handleHTTP(w, httptest.NewRequest("GET", "http://api:8000/items", nil))
+	h := w.Result().Header
+	if h.Get("Set-Cookie") != "" {
+		t.Errorf("Expected Set-Cookie to be stripped, got %q", h.Get("Set-Cookie"))
+	}
+	if got := h.Get("Access-Control-Allow-Origin"); got != "http://localhost:3000" {
+		t.Errorf("Expected the origin to be replaced, got %q", got)
+	}
+	if got := h.Values("Vary"); len(got) != 2 || got[1] != "Origin" {
+		t.Errorf("Expected Origin added to Vary, got %v", got)
+	}
+
+	// Other hosts keep the service's headers
+	w = httptest.NewRecorder()
+	proxy.handleHTTP(w, httptest.NewRequest("GET", "http://other:8000/", nil))
+	if w.Result().Header.Get("Set-Cookie") == "" {
+		t.Error("Expected Set-Cookie to pass for an unrouted host")
+	}
+
+	for _, rules := range []*HeaderRules{
+		{Remove: []string{"Content-Length"}},
+		{Set: map[string]string{"Bad Name": "x"}},
+		{Add: map[string]string{"X-Ok": "line\nbreak"}},
+	} {
+		if err := rules.validate(); err == nil {
+			t.Errorf("Expected %+v to be refused", rules)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// --- HEARTBEAT ---
+
+// heartbeatStateTimeout bounds how long a beat waits for the backend state.
+// A beat that can't get it reports state=unknown rather than going silent.
+const heartbeatStateTimeout = 5 * time.Second
+
+// traffic counts the bytes of every tailnet connection, plain HTTP included
+var traffic = &trafficCounter{}
+
+type trafficCounter struct {
+	rx, tx atomic.Int64
+}
+
+// countingDialer adds the traffic of the connections it dials to counter
+type countingDialer struct {
+	Base    Dialer
+	counter *trafficCounter
+}
+
+func (d *countingDialer) Dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	conn, err := d.Base.Dial(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	return &countingConn{Conn: conn, counter: d.counter}, nil
+}
+
+type countingConn struct {
+	net.Conn
+	counter *trafficCounter
+}
+
+func (c *countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.counter.rx.Add(int64(n))
+	return n, err
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.counter.tx.Add(int64(n))
+	return n, err
+}
+
+// heartbeat periodically tells the parent the sidecar is alive, so it can
+// detect a hung process even when nothing else is written to stdout
+type heartbeat struct {
+	Interval time.Duration
+	state    func(ctx context.Context) (string, error) // tailnet backend state
+	active   func() int                                // open connections
+	counter  *trafficCounter
+
+	seq            uint64
+	lastRx, lastTx int64
+}
+
+// beat returns the details of the next heartbeat signal. Bytes are counted
+// since the previous beat.
+func (h *heartbeat) beat(ctx context.Context) string {
+	ctx, cancel := context.WithTimeout(ctx, heartbeatStateTimeout)
+	state, err := h.state(ctx)
+	cancel()
+	if err != nil {
+		state = "unknown"
+	}
+
+	rx, tx := h.counter.rx.Load(), h.counter.tx.Load()
+	h.seq++
+	details := fmt.Sprintf("seq=%d state=%s connections=%d rx_bytes=%d tx_bytes=%d",
+		h.seq, state, h.active(), rx-h.lastRx, tx-h.lastTx)
+	h.lastRx, h.lastTx = rx, tx
+	return details
+}
+
+// run emits a heartbeat every Interval until ctx is done
+func (h *heartbeat) run(ctx context.Context) {
+	ticker := time.NewTicker(h.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			signal(SignalHeartbeat, h.beat(ctx))
+		}
+	}
+}
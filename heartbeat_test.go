@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+)
+
+func TestHeartbeatBeat(t *testing.T) {
+	counter := &trafficCounter{}
+	state, stateErr := "Running", error(nil)
+	hb := &heartbeat{
+		state:   func(ctx context.Context) (string, error) { return state, stateErr },
+		active:  func() int { return 2 },
+		counter: counter,
+	}
+
+	// Traffic through a counting dialer shows up in the next beat only
+	backend, remote := net.Pipe()
+	defer remote.Close()
+	d := &countingDialer{Base: &MockDialer{DialFunc: func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return backend, nil
+	}}, counter: counter}
+	conn, err := d.Dial(context.Background(), "tcp", "core:80")
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	go func() {
+		buf := make([]byte, 5)
+		io.ReadFull(remote, buf)
+		remote.Write([]byte("hi"))
+	}()
+	conn.Write([]byte("hello"))
+	io.ReadFull(conn, make([]byte, 2))
+
+	if got, want := hb.beat(context.Background()), "seq=1 state=Running connections=2 rx_bytes=2 tx_bytes=5"; got != want {
+		t.Errorf("Expected %q, got %q", want, got)
+	}
+	state, stateErr = "", errors.New("local API hung")
+	if got, want := hb.beat(context.Background()), "seq=2 state=unknown connections=2 rx_bytes=0 tx_bytes=0"; got != want {
+		t.Errorf("Expected %q, got %q", want, got)
+	}
+}
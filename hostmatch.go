@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// --- HOST PATTERNS ---
+
+// Allow lists and route hosts take more than exact names:
+//
+//	minio, minio:9000      the host on any port, or on that port
+//	*.data.ts.net[:port]   any name below data.ts.net
+//	100.64.0.0/10          any IP in the range
+//	re:^db-[0-9]+$         a regular expression for the host or host:port
+//	file:/etc/hosts.allow  the patterns in a file, one per line, # comments
+//	*                      everything
+//
+// They are compiled into a hostSet, so long lists don't cost a scan per
+// dial: names and wildcards are map lookups, ranges one lookup per prefix
+// length, and the regular expressions a single combined one.
+type hostSet struct {
+	any      bool
+	exact    map[string]bool     // "host" or "host:port", lowercase
+	suffixes map[string][]string // ".data.ts.net" -> ports, "" for any
+	prefixes map[int]map[netip.Prefix]bool
+	re       *regexp.Regexp
+}
+
+// Prefixes that mark the kinds of patterns
+const (
+	hostRegexPrefix = "re:"
+	hostFilePrefix  = "file:"
+)
+
+// compileHosts compiles a list of host patterns
+func compileHosts(patterns []string) (*hostSet, error) {
+	s := &hostSet{exact: map[string]bool{}, suffixes: map[string][]string{}, prefixes: map[int]map[netip.Prefix]bool{}}
+	var exprs []string
+	if err := s.add(patterns, &exprs, true); err != nil {
+		return nil, err
+	}
+	if len(exprs) > 0 {
+		re, err := regexp.Compile("^(?i:" + strings.Join(exprs, "|") + ")$")
+		if err != nil {
+			return nil, err
+		}
+		s.re = re
+	}
+	return s, nil
+}
+
+func (s *hostSet) add(patterns []string, exprs *[]string, files bool) error {
+	for _, p := range patterns {
+		switch {
+		case p == "*":
+			s.any = true
+		case strings.HasPrefix(p, hostFilePrefix):
+			if !files {
+				return fmt.Errorf("%q: files can't include other files", p)
+			}
+			lines, err := readHostFile(strings.TrimPrefix(p, hostFilePrefix))
+			if err != nil {
+				return err
+			}
+			if err := s.add(lines, exprs, false); err != nil {
+				return fmt.Errorf("%s: %w", p, err)
+			}
+		case strings.HasPrefix(p, hostRegexPrefix):
+			expr := strings.TrimPrefix(p, hostRegexPrefix)
+			if _, err := regexp.Compile(expr); err != nil {
+				return fmt.Errorf("%q: %w", p, err)
+			}
+			// Anchors are implied; strip the ones people write anyway
+			expr = strings.TrimSuffix(strings.TrimPrefix(expr, "^"), "$")
+			*exprs = append(*exprs, "(?:"+expr+")")
+		case strings.Contains(p, "/"):
+			prefix, err := netip.ParsePrefix(p)
+			if err != nil {
+				return fmt.Errorf("invalid range %q: %w", p, err)
+			}
+			prefix = prefix.Masked()
+			if s.prefixes[prefix.Bits()] == nil {
+				s.prefixes[prefix.Bits()] = map[netip.Prefix]bool{}
+			}
+			s.prefixes[prefix.Bits()][prefix] = true
+		case strings.HasPrefix(p, "*."):
+			host, port := splitPattern(strings.TrimPrefix(p, "*"))
+			if host == "." || strings.ContainsAny(host, "*") {
+				return fmt.Errorf("invalid wildcard %q", p)
+			}
+			s.suffixes[host] = append(s.suffixes[host], port)
+		case p == "" || strings.ContainsAny(p, "* "):
+			return fmt.Errorf("invalid host %q", p)
+		default:
+			s.exact[strings.ToLower(p)] = true
+		}
+	}
+	return nil
+}
+
+// splitPattern splits host[:port] into the lowercase host and the port
+func splitPattern(p string) (host, port string) {
+	if h, pt, err := net.SplitHostPort(p); err == nil {
+		return strings.ToLower(h), pt
+	}
+	return strings.ToLower(p), ""
+}
+
+// readHostFile reads the patterns of a file, skipping blank lines and
+// comments
+func readHostFile(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var lines []string
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line, _, _ := strings.Cut(sc.Text(), "#")
+		if line = strings.TrimSpace(line); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines, sc.Err()
+}
+
+// match reports whether addr, a host or host:port, is in the set. A nil
+// set matches nothing.
+func (s *hostSet) match(addr string) bool {
+	if s == nil {
+		return false
+	}
+	if s.any {
+		return true
+	}
+	host, port := splitPattern(addr)
+	if s.exact[host] || port != "" && s.exact[net.JoinHostPort(host, port)] {
+		return true
+	}
+	for i := range len(host) {
+		if host[i] != '.' {
+			continue
+		}
+		if ports, ok := s.suffixes[host[i:]]; ok && (slices.Contains(ports, "") || port != "" && slices.Contains(ports, port)) {
+			return true
+		}
+	}
+	if ip, err := netip.ParseAddr(host); err == nil && len(s.prefixes) > 0 {
+		ip = ip.Unmap()
+		for bits, set := range s.prefixes {
+			if p, err := ip.Prefix(bits); err == nil && set[p] {
+				return true
+			}
+		}
+	}
+	return s.re != nil && (s.re.MatchString(host) || port != "" && s.re.MatchString(net.JoinHostPort(host, port)))
+}
+
+// mustHosts compiles patterns that were validated already. If they no
+// longer compile, e.g. a file went away, they match nothing.
+func mustHosts(patterns []string) *hostSet {
+	s, err := compileHosts(patterns)
+	if err != nil {
+		fmt.Fprintf(console, "!!! Host patterns %v match nothing: %v\n", patterns, err)
+		return nil
+	}
+	return s
+}
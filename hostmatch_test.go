@@ -0,0 +1,100 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestHostSet(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "hosts.allow")
+	os.WriteFile(file, []byte("# GPU nodes\ngpu-1\n\n10.8.0.0/16 # lab subnet\n*.gpu.lab\n"), 0o644)
+
+	hosts, err := compileHosts([]string{
+		"core", "minio:9000", "*.data.ts.net", "*.tiles.ts.net:443",
+		"100.64.0.0/10", "fd7a:115c:a1e0::/48", "re:^db-[0-9]+$", "re:cache:63[0-9]{2}",
+		"file:" + file,
+	})
+	if err != nil {
+		t.Fatalf("Failed to compile: %v", err)
+	}
+	for _, tc := range []struct {
+		addr string
+		want bool
+	}{
+		{"core", true},
+		{"CORE:8080", true},
+		{"core-next:80", false},
+		{"minio:9000", true},
+		{"minio:9001", false},
+		{"nas.data.ts.net:445", true},
+		{"a.b.data.ts.net", true},
+		{"data.ts.net", false},
+		{"evildata.ts.net", false},
+		{"z.tiles.ts.net:443", true},
+		{"z.tiles.ts.net:80", false},
+		{"100.100.1.2:22", true},
+		{"100.128.0.1:22", false},
+		{"[fd7a:115c:a1e0::5]:80", true},
+		{"[::ffff:100.64.0.1]:80", true},
+		{"db-12:5432", true},
+		{"db-x:5432", false},
+		{"xdb-1", false},
+		{"cache:6379", true},
+		{"cache:7000", false},
+		{"gpu-1:8888", true},
+		{"10.8.3.4:80", true},
+		{"n1.gpu.lab", true},
+	} {
+		if got := hosts.match(tc.addr); got != tc.want {
+			t.Errorf("match(%q) = %v, want %v", tc.addr, got, tc.want)
+		}
+	}
+
+	if all, _ := compileHosts([]string{"*"}); !all.match("anything:1") {
+		t.Errorf("Expected * to match everything")
+	}
+	if (*hostSet)(nil).match("core") {
+		t.Errorf("Expected a nil set to match nothing")
+	}
+
+	nested := filepath.Join(dir, "nested")
+	os.WriteFile(nested, []byte("file:"+file+"\n"), 0o644)
+	for _, bad := range []string{"", "re:db-(", "10.0.0.0/33", "*.", "core*", "a b", "file:" + filepath.Join(dir, "missing"), "file:" + nested} {
+		if _, err := compileHosts([]string{bad}); err == nil {
+			t.Errorf("Expected %q to be rejected", bad)
+		}
+	}
+}
+
+func TestRouteHostPatterns(t *testing.T) {
+	router := newRouter(&MockDialer{}, []RouteRule{
+		{Host: "*.data.ts.net", PoolConfig: PoolConfig{Targets: []string{"gateway"}}},
+		{Host: "re:minio-[a-z]+", PoolConfig: PoolConfig{Targets: []string{"minio"}}},
+	}, nil)
+	for addr, want := range map[string]string{"nas.data.ts.net:445": "*.data.ts.net", "minio-eu:9000": "re:minio-[a-z]+"} {
+		if rt, ok := router.match(addr); !ok || rt.rule.Host != want {
+			t.Errorf("Expected %s to match route %s", addr, want)
+		}
+	}
+	if _, ok := router.match("minio:9000"); ok {
+		t.Errorf("Expected minio to match no route")
+	}
+	if err := (RouteRule{Host: "re:(", PoolConfig: PoolConfig{Targets: []string{"x"}}}).validate(); err == nil {
+		t.Errorf("Expected an invalid host pattern to be rejected")
+	}
+
+	table := &sessionTable{sessions: map[string]*session{}}
+	table.dialVia((&MockDialer{}).Dial)
+	s, err := table.create(SessionSpec{Allow: []string{"*.data.ts.net", "100.64.0.0/10"}})
+	if err != nil {
+		t.Fatalf("Failed to create session: %v", err)
+	}
+	if !s.allows("nas.data.ts.net:445") || !s.allows("100.64.0.7:80") || s.allows("minio:9000") {
+		t.Errorf("Expected the session to allow exactly its patterns")
+	}
+	if _, err := table.create(SessionSpec{Allow: []string{"re:("}}); err == nil {
+		t.Errorf("Expected an invalid allow pattern to be rejected")
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"tailscale.com/ipn"
+	"tailscale.com/ipn/ipnstate"
+)
+
+// --- RUNTIME RENAME ---
+
+// HostnameStatus is the body of /control/hostname requests and responses
+type HostnameStatus struct {
+	SchemaVersion int    `json:"schema_version,omitempty"` // set in responses
+	Hostname      string `json:"hostname"`
+	DNSName       string `json:"dns_name,omitempty"` // as assigned by control, set in responses
+}
+
+// prefsClient is the part of the local API renaming needs
+type prefsClient interface {
+	EditPrefs(ctx context.Context, mp *ipn.MaskedPrefs) (*ipn.Prefs, error)
+	StatusWithoutPeers(ctx context.Context) (*ipnstate.Status, error)
+}
+
+// validHostname accepts a single DNS label, which is what MagicDNS names are
+// made of
+func validHostname(name string) error {
+	if name == "" || len(name) > 63 {
+		return fmt.Errorf("hostname must be 1 to 63 characters")
+	}
+	if strings.HasPrefix(name, "-") || strings.HasSuffix(name, "-") {
+		return fmt.Errorf("hostname %q must not start or end with '-'", name)
+	}
+	for _, c := range name {
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-') {
+			return fmt.Errorf("hostname %q may only contain a-z, 0-9 and '-'", name)
+		}
+	}
+	return nil
+}
+
+// renameSettleTimeout is how long a rename waits for control to hand out the
+// new MagicDNS name before answering with the one the node still has. Some
+// control servers keep the first name (or one set by an admin) for good.
+var renameSettleTimeout = 10 * time.Second
+
+// currentName returns the node's status, after waiting for control to give
+// it a DNS name for want (if not empty)
+func currentName(ctx context.Context, lc prefsClient, want string) (*ipnstate.Status, error) {
+	ctx, cancel := context.WithTimeout(ctx, renameSettleTimeout)
+	defer cancel()
+	for {
+		status, err := lc.StatusWithoutPeers(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if want == "" || status.Self != nil && strings.HasPrefix(status.Self.DNSName, want+".") {
+			return status, nil
+		}
+		select {
+		case <-ctx.Done():
+			return status, nil
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
+// handleHostname reports (GET) or changes (POST) the node's tailnet
+// hostname. The orchestrator often only learns the final job name after the
+// sidecar has started. The new name comes from a JSON body or ?name=.
+func handleHostname(client func() (prefsClient, error), mesh *MeshRegistry) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		lc, err := client()
+		if err != nil {
+			http.Error(w, fmt.Sprintf("failed to get local client: %v", err), http.StatusInternalServerError)
+			return
+		}
+
+		renamed := ""
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPost, http.MethodPut:
+			var req HostnameStatus
+			if name := r.URL.Query().Get("name"); name != "" {
+				req.Hostname = name
+			} else if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				http.Error(w, fmt.Sprintf("invalid request body: %v", err), http.StatusBadRequest)
+				return
+			}
+			req.Hostname = strings.ToLower(req.Hostname)
+			if err := validHostname(req.Hostname); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			// Control re-registers the node under the new name and pushes
+			// the new MagicDNS entry to every peer
+			_, err := lc.EditPrefs(r.Context(), &ipn.MaskedPrefs{
+				Prefs:       ipn.Prefs{Hostname: req.Hostname},
+				HostnameSet: true,
+			})
+			if err != nil {
+				http.Error(w, fmt.Sprintf("rename failed: %v", err), http.StatusBadGateway)
+				return
+			}
+			renamed = req.Hostname
+			mesh.rename(req.Hostname)
+			fmt.Fprintf(console, ">>> Renamed node to '%s'\n", req.Hostname)
+			signal(SignalRenamed, fmt.Sprintf("hostname=%s", req.Hostname))
+			audit.record("rename", "hostname", req.Hostname)
+		default:
+			http.Error(w, "only GET and POST allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		status, err := currentName(r.Context(), lc, renamed)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("failed to get status: %v", err), http.StatusInternalServerError)
+			return
+		}
+		res := HostnameStatus{SchemaVersion: apiSchemaVersion}
+		if status.Self != nil {
+			res.Hostname = status.Self.HostName
+			res.DNSName = status.Self.DNSName
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(res)
+	}
+}
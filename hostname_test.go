@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"arkitekt.live/arkitekt-sidecar/testnet"
+)
+
+func TestValidHostname(t *testing.T) {
+	for name, ok := range map[string]bool{
+		"job-42":                true,
+		"a":                     true,
+		"":                      false,
+		"-job":                  false,
+		"job-":                  false,
+		"Job":                   false,
+		"job.example":           false,
+		strings.Repeat("a", 64): false,
+		strings.Repeat("a", 63): true,
+	} {
+		if err := validHostname(name); (err == nil) != ok {
+			t.Errorf("validHostname(%q) = %v, want ok=%v", name, err, ok)
+		}
+	}
+}
+
+func TestRenameAgainstTestTailnet(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping in-process tailnet test in short mode")
+	}
+	tn, err := testnet.Start("127.0.0.1:0", t.Logf)
+	if err != nil {
+		t.Fatalf("Failed to start test tailnet: %v", err)
+	}
+	defer tn.Close()
+
+	s := tn.Node("pending-job", t.TempDir(), func(format string, args ...any) {})
+	defer s.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+	if _, err := s.Up(ctx); err != nil {
+		t.Fatalf("Node failed to join: %v", err)
+	}
+
+	defer func(d time.Duration) { renameSettleTimeout = d }(renameSettleTimeout)
+	renameSettleTimeout = time.Second
+
+	mesh := newMeshRegistry("pending-job", nil)
+	handler := handleHostname(func() (prefsClient, error) { return s.LocalClient() }, mesh)
+
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest("POST", "/control/hostname", strings.NewReader(`{"hostname": "Job-42"}`)).WithContext(ctx))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var res HostnameStatus
+	if err := json.NewDecoder(w.Body).Decode(&res); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	// The test control server keeps the first DNS name, so only the
+	// hostname changes
+	if res.Hostname != "job-42" {
+		t.Errorf("Expected the node to be renamed to job-42, got %+v", res)
+	}
+	if got := mesh.announcement().Hostname; got != "job-42" {
+		t.Errorf("Expected mesh announcements under job-42, got %q", got)
+	}
+
+	w = httptest.NewRecorder()
+	handler(w, httptest.NewRequest("POST", "/control/hostname?name=bad_name", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400 for an invalid name, got %d", w.Code)
+	}
+}
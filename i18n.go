@@ -0,0 +1,318 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// --- LOCALIZATION ---
+
+// messages holds everything people read: the dashboard, the output of
+// `top`, `healthcheck` and the tray, and errors the proxies send to
+// clients. Placeholders are written {name}. Logs and IPC signals are parsed
+// by programs and stay English.
+var messages = map[string]map[string]string{
+	"en": {
+		// Errors sent to proxy clients, worded as they were before the
+		// catalog so clients matching on them keep working
+		"client.maintenance":      "Sidecar is in maintenance mode",
+		"client.overloaded":       "sidecar overloaded: {reason}",
+		"client.acl_denied":       "connection from {source} to {destination} denied by tailnet ACLs",
+		"client.shields_up":       "connection to {destination} refused: peer has shields up",
+		"client.session_denied":   "session {session} may not connect to {destination}: {reason}",
+		"client.session_required": "a session is required (set {header} or proxy credentials)",
+		"client.unknown_session":  "unknown session {session}",
+		"client.proxy_error":      "Proxy Error: {error}",
+		"client.body_limit":       "request body larger than {limit} bytes, the limit for {route}",
+		"client.type_blocked":     "uploads of {type} to {route} are blocked",
+
+		// Command line
+		"cli.healthy":          "Sidecar is {state}",
+		"cli.unhealthy":        "Sidecar is {state}, not {want}",
+		"cli.peers":            "PEERS ({online}/{total} online)",
+		"cli.tunnels":          "TUNNELS ({count} active)",
+		"cli.name":             "NAME",
+		"cli.path":             "PATH",
+		"cli.kind":             "KIND",
+		"cli.target":           "TARGET",
+		"cli.age":              "AGE",
+		"cli.offline":          "offline",
+		"cli.idle":             "idle",
+		"cli.direct":           "direct {address}",
+		"cli.relayed":          "DERP {region}",
+		"cli.no_derp":          "none",
+		"cli.unreachable":      "unreachable",
+		"cli.preflight_ok":     "All {count} checks passed",
+		"cli.preflight_failed": "{failed} of {count} checks failed",
+
+		// Tray icon
+		"tray.starting":  "Starting…",
+		"tray.connected": "Connected as {host} ({online} peers online)",
+		"tray.error":     "Error: {error}",
+		"tray.copy_url":  "Copy proxy URL",
+		"tray.dashboard": "Open dashboard",
+		"tray.quit":      "Quit",
+
+		// Dashboard
+		"dashboard.reload":              "Reload config",
+		"dashboard.maintenance":         "Maintenance",
+		"dashboard.end_maintenance":     "End maintenance",
+		"dashboard.shutdown":            "Shut down",
+		"dashboard.confirm_maintenance": "Refuse new connections until maintenance is ended?",
+		"dashboard.confirm_shutdown":    "Shut the sidecar down? It has to be started again by hand.",
+		"dashboard.done":                "done",
+		"dashboard.unreachable":         "unreachable",
+		"dashboard.in_maintenance":      "maintenance",
+		"dashboard.connection":          "Connection",
+		"dashboard.tailnet":             "Tailnet",
+		"dashboard.addresses":           "Addresses",
+		"dashboard.derp":                "Relay (DERP)",
+		"dashboard.derp_none":           "none",
+		"dashboard.derp_disconnected":   "{region} (disconnected)",
+		"dashboard.udp":                 "Direct UDP",
+		"dashboard.udp_yes":             "yes",
+		"dashboard.udp_no":              "no, traffic is relayed",
+		"dashboard.key_expiry":          "Key expires",
+		"dashboard.never":               "never",
+		"dashboard.peers":               "Peers ({online}/{total} online)",
+		"dashboard.no_peers":            "No peers",
+		"dashboard.name":                "Name",
+		"dashboard.path":                "Path",
+		"dashboard.last_seen":           "Last seen",
+		"dashboard.offline":             "offline",
+		"dashboard.direct":              "direct {address}",
+		"dashboard.relayed":             "relayed via {region}",
+		"dashboard.idle":                "idle",
+		"dashboard.now":                 "now",
+		"dashboard.seconds_ago":         "{n}s ago",
+		"dashboard.minutes_ago":         "{n}m ago",
+		"dashboard.hours_ago":           "{n}h ago",
+		"dashboard.tunnels":             "Active tunnels ({count})",
+		"dashboard.no_tunnels":          "No active tunnels",
+		"dashboard.kind":                "Kind",
+		"dashboard.target":              "Target",
+		"dashboard.client":              "Client",
+		"dashboard.traffic":             "Traffic",
+		"dashboard.age":                 "Age",
+		"dashboard.errors":              "Recent errors",
+		"dashboard.no_errors":           "No errors",
+		"dashboard.time":                "Time",
+		"dashboard.message":             "Message",
+	},
+	"de": {
+		"client.maintenance":      "Der Sidecar ist im Wartungsmodus",
+		"client.overloaded":       "Sidecar überlastet: {reason}",
+		"client.acl_denied":       "Verbindung von {source} zu {destination} durch die Tailnet-ACLs verweigert",
+		"client.shields_up":       "Verbindung zu {destination} abgelehnt: der Peer hat Shields Up aktiviert",
+		"client.session_denied":   "Sitzung {session} darf sich nicht mit {destination} verbinden: {reason}",
+		"client.session_required": "Eine Sitzung ist erforderlich ({header} oder Proxy-Zugangsdaten setzen)",
+		"client.unknown_session":  "Unbekannte Sitzung {session}",
+		"client.proxy_error":      "Proxy-Fehler: {error}",
+		"client.body_limit":       "Anfrage größer als {limit} Bytes, das Limit für {route}",
+		"client.type_blocked":     "Uploads vom Typ {type} zu {route} sind gesperrt",
+
+		"cli.healthy":          "Sidecar ist {state}",
+		"cli.unhealthy":        "Sidecar ist {state}, nicht {want}",
+		"cli.peers":            "PEERS ({online}/{total} online)",
+		"cli.tunnels":          "TUNNEL ({count} aktiv)",
+		"cli.name":             "NAME",
+		"cli.path":             "PFAD",
+		"cli.kind":             "ART",
+		"cli.target":           "ZIEL",
+		"cli.age":              "ALTER",
+		"cli.offline":          "offline",
+		"cli.idle":             "inaktiv",
+		"cli.direct":           "direkt {address}",
+		"cli.relayed":          "DERP {region}",
+		"cli.no_derp":          "keiner",
+		"cli.unreachable":      "nicht erreichbar",
+		"cli.preflight_ok":     "Alle {count} Prüfungen bestanden",
+		"cli.preflight_failed": "{failed} von {count} Prüfungen fehlgeschlagen",
+
+		"tray.starting":  "Startet…",
+		"tray.connected": "Verbunden als {host} ({online} Peers online)",
+		"tray.error":     "Fehler: {error}",
+		"tray.copy_url":  "Proxy-URL kopieren",
+		"tray.dashboard": "Dashboard öffnen",
+		"tray.quit":      "Beenden",
+
+		"dashboard.reload":              "Konfiguration neu laden",
+		"dashboard.maintenance":         "Wartung",
+		"dashboard.end_maintenance":     "Wartung beenden",
+		"dashboard.shutdown":            "Beenden",
+		"dashboard.confirm_maintenance": "Neue Verbindungen ablehnen, bis die Wartung beendet wird?",
+		"dashboard.confirm_shutdown":    "Den Sidecar beenden? Er muss danach von Hand neu gestartet werden.",
+		"dashboard.done":                "erledigt",
+		"dashboard.unreachable":         "nicht erreichbar",
+		"dashboard.in_maintenance":      "Wartung",
+		"dashboard.connection":          "Verbindung",
+		"dashboard.tailnet":             "Tailnet",
+		"dashboard.addresses":           "Adressen",
+		"dashboard.derp":                "Relay (DERP)",
+		"dashboard.derp_none":           "keiner",
+		"dashboard.derp_disconnected":   "{region} (getrennt)",
+		"dashboard.udp":                 "Direktes UDP",
+		"dashboard.udp_yes":             "ja",
+		"dashboard.udp_no":              "nein, der Verkehr läuft über Relays",
+		"dashboard.key_expiry":          "Schlüssel läuft ab",
+		"dashboard.never":               "nie",
+		"dashboard.peers":               "Peers ({online}/{total} online)",
+		"dashboard.no_peers":            "Keine Peers",
+		"dashboard.name":                "Name",
+		"dashboard.path":                "Pfad",
+		"dashboard.last_seen":           "Zuletzt gesehen",
+		"dashboard.offline":             "offline",
+		"dashboard.direct":              "direkt {address}",
+		"dashboard.relayed":             "über Relay {region}",
+		"dashboard.idle":                "inaktiv",
+		"dashboard.now":                 "jetzt",
+		"dashboard.seconds_ago":         "vor {n} s",
+		"dashboard.minutes_ago":         "vor {n} min",
+		"dashboard.hours_ago":           "vor {n} h",
+		"dashboard.tunnels":             "Aktive Tunnel ({count})",
+		"dashboard.no_tunnels":          "Keine aktiven Tunnel",
+		"dashboard.kind":                "Art",
+		"dashboard.target":              "Ziel",
+		"dashboard.client":              "Client",
+		"dashboard.traffic":             "Datenverkehr",
+		"dashboard.age":                 "Alter",
+		"dashboard.errors":              "Letzte Fehler",
+		"dashboard.no_errors":           "Keine Fehler",
+		"dashboard.time":                "Zeit",
+		"dashboard.message":             "Meldung",
+	},
+}
+
+// defaultLang is the language when a client doesn't ask for one: -lang, or
+// the system locale
+var defaultLang = "en"
+
+// supportedLang returns the catalog language for a tag like "de-AT" or
+// "de_DE.UTF-8", and false if there is none
+func supportedLang(tag string) (string, bool) {
+	parts := strings.FieldsFunc(strings.ToLower(tag), func(r rune) bool {
+		return r == '-' || r == '_' || r == '.' || r == ' '
+	})
+	if len(parts) == 0 {
+		return "", false
+	}
+	_, ok := messages[parts[0]]
+	return parts[0], ok
+}
+
+// systemLang reads the language from the POSIX locale variables, falling
+// back to English
+func systemLang(lookup func(string) (string, bool)) string {
+	for _, name := range []string{"LC_ALL", "LC_MESSAGES", "LANG"} {
+		if v, ok := lookup(name); ok && v != "" {
+			if lang, ok := supportedLang(v); ok {
+				return lang
+			}
+			break
+		}
+	}
+	return "en"
+}
+
+// negotiateLang picks the best supported language from an Accept-Language
+// header, or fallback
+func negotiateLang(header, fallback string) string {
+	type choice struct {
+		lang string
+		q    float64
+	}
+	var choices []choice
+	for _, part := range strings.Split(header, ",") {
+		tag, params, _ := strings.Cut(part, ";")
+		if strings.TrimSpace(tag) == "" {
+			continue
+		}
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			q, _ = strconv.ParseFloat(v, 64)
+		}
+		if lang, ok := supportedLang(tag); ok && q > 0 {
+			choices = append(choices, choice{lang, q})
+		}
+	}
+	if len(choices) == 0 {
+		return fallback
+	}
+	slices.SortStableFunc(choices, func(a, b choice) int { return cmp.Compare(b.q, a.q) })
+	return choices[0].lang
+}
+
+// clientLang is the language of messages for the client sending r
+func clientLang(r *http.Request) string {
+	return negotiateLang(r.Header.Get("Accept-Language"), defaultLang)
+}
+
+// tr looks up key in lang, falling back to English, and fills in the
+// placeholders from name/value pairs
+func tr(lang, key string, args ...any) string {
+	text, ok := messages[lang][key]
+	if !ok {
+		text = messages["en"][key]
+	}
+	if len(args) == 0 {
+		return text
+	}
+	pairs := make([]string, 0, len(args))
+	for i := 0; i+1 < len(args); i += 2 {
+		pairs = append(pairs, "{"+fmt.Sprint(args[i])+"}", fmt.Sprint(args[i+1]))
+	}
+	return strings.NewReplacer(pairs...).Replace(text)
+}
+
+// localizedError is an error with a message for people
+type localizedError interface {
+	localize(lang string) string
+}
+
+// clientMessage is what a proxy client is told about err
+func clientMessage(err error, lang string) string {
+	var le localizedError
+	if errors.As(err, &le) {
+		return le.localize(lang)
+	}
+	return err.Error()
+}
+
+// handleMessages serves the dashboard's strings in the language the
+// browser asks for
+func handleMessages(w http.ResponseWriter, r *http.Request) {
+	lang := negotiateLang(r.URL.Query().Get("lang"), clientLang(r))
+	catalog := map[string]string{}
+	for key := range messages["en"] {
+		if name, ok := strings.CutPrefix(key, "dashboard."); ok {
+			catalog[name] = tr(lang, key)
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		SchemaVersion int               `json:"schema_version"`
+		Lang          string            `json:"lang"`
+		Messages      map[string]string `json:"messages"`
+	}{apiSchemaVersion, lang, catalog})
+}
+
+// resolveLang validates a -lang value; empty means the system locale
+func resolveLang(value string) (string, error) {
+	if value == "" {
+		return systemLang(os.LookupEnv), nil
+	}
+	lang, ok := supportedLang(value)
+	if !ok {
+		langs := slices.Sorted(maps.Keys(messages))
+		return "", fmt.Errorf("unsupported language %q (supported: %s)", value, strings.Join(langs, ", "))
+	}
+	return lang, nil
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestCatalogComplete(t *testing.T) {
+	placeholders := regexp.MustCompile(`\{\w+\}`)
+	for lang, catalog := range messages {
+		for key, en := range messages["en"] {
+			text, ok := catalog[key]
+			if !ok {
+				t.Errorf("%s: missing %s", lang, key)
+				continue
+			}
+			want := placeholders.FindAllString(en, -1)
+			got := placeholders.FindAllString(text, -1)
+			slices.Sort(want)
+			slices.Sort(got)
+			if !slices.Equal(want, got) {
+				t.Errorf("%s: %s has placeholders %v, English has %v", lang, key, got, want)
+			}
+		}
+		for key := range catalog {
+			if _, ok := messages["en"][key]; !ok {
+				t.Errorf("%s: %s is not in the English catalog", lang, key)
+			}
+		}
+	}
+}
+
+func TestLanguageSelection(t *testing.T) {
+	tests := []struct {
+		header, fallback, want string
+	}{
+		{"de-DE,de;q=0.9,en;q=0.8", "en", "de"},
+		{"fr-FR,en;q=0.5,de;q=0.7", "en", "de"},
+		{"fr, it", "de", "de"},
+		{"de;q=0", "en", "en"},
+		{"", "de", "de"},
+		{"EN-us", "de", "en"},
+	}
+	for _, tc := range tests {
+		if got := negotiateLang(tc.header, tc.fallback); got != tc.want {
+			t.Errorf("negotiateLang(%q, %q) = %q, want %q", tc.header, tc.fallback, got, tc.want)
+		}
+	}
+
+	env := func(vars map[string]string) func(string) (string, bool) {
+		return func(name string) (string, bool) {
+			v, ok := vars[name]
+			return v, ok
+		}
+	}
+	if got := systemLang(env(map[string]string{"LANG": "de_DE.UTF-8"})); got != "de" {
+		t.Errorf("Expected de from LANG, got %s", got)
+	}
+	if got := systemLang(env(map[string]string{"LC_ALL": "C.UTF-8", "LANG": "de_DE.UTF-8"})); got != "en" {
+		t.Errorf("Expected LC_ALL to win and fall back to en, got %s", got)
+	}
+	if _, err := resolveLang("fr"); err == nil || !strings.Contains(err.Error(), "de, en") {
+		t.Errorf("Expected an error listing the languages, got %v", err)
+	}
+	if got, _ := resolveLang("de-AT"); got != "de" {
+		t.Errorf("Expected de for de-AT, got %s", got)
+	}
+}
+
+func TestLocalizedClientErrors(t *testing.T) {
+	denied := fmt.Errorf("dial: %w", &aclDeniedError{Denial: ACLDenial{Source: "lab-pc", Destination: "data-node:5432"}})
+	if got := clientMessage(denied, "en"); got != "connection from lab-pc to data-node:5432 denied by tailnet ACLs" {
+		t.Errorf("Expected the English text to be unchanged, got %q", got)
+	}
+	if got := clientMessage(denied, "de"); got != "Verbindung von lab-pc zu data-node:5432 durch die Tailnet-ACLs verweigert" {
+		t.Errorf("Unexpected German text %q", got)
+	}
+	if got := clientMessage(&sessionAuthError{id: "job-7"}, "de"); got != `Unbekannte Sitzung "job-7"` {
+		t.Errorf("Unexpected German text %q", got)
+	}
+	if got := clientMessage(context.Canceled, "de"); got != "context canceled" {
+		t.Errorf("Expected other errors as they are, got %q", got)
+	}
+	if got := tr("de", "no.such.key"); got != "" {
+		t.Errorf("Expected nothing for an unknown key, got %q", got)
+	}
+
+	// Browsers asking for German get it; other clients the sidecar's language
+	defer maintenance.Store(false)
+	maintenance.Store(true)
+	proxy := &TailscaleProxy{}
+	r := httptest.NewRequest("GET", "http://core:8080/", nil)
+	r.Header.Set("Accept-Language", "de-DE,de;q=0.9")
+	w := httptest.NewRecorder()
+	proxy.ServeHTTP(w, r)
+	if body := strings.TrimSpace(w.Body.String()); body != "Der Sidecar ist im Wartungsmodus" {
+		t.Errorf("Expected the German maintenance text, got %q", body)
+	}
+}
+
+func TestMessagesEndpoint(t *testing.T) {
+	r := httptest.NewRequest("GET", "/messages", nil)
+	r.Header.Set("Accept-Language", "de")
+	w := httptest.NewRecorder()
+	handleMessages(w, r)
+	var res struct {
+		Lang     string            `json:"lang"`
+		Messages map[string]string `json:"messages"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&res); err != nil {
+		t.Fatal(err)
+	}
+	if res.Lang != "de" || res.Messages["shutdown"] != "Beenden" {
+		t.Errorf("Expected German dashboard strings, got %s %v", res.Lang, res.Messages["shutdown"])
+	}
+	if _, ok := res.Messages["client.maintenance"]; ok {
+		t.Error("Expected only the dashboard's strings")
+	}
+
+	w = httptest.NewRecorder()
+	handleMessages(w, httptest.NewRequest("GET", "/messages?lang=en", http.NoBody))
+	if !strings.Contains(w.Body.String(), `"lang":"en"`) {
+		t.Errorf("Expected ?lang to win, got %s", w.Body)
+	}
+}
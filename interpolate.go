@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// --- CONFIG INTERPOLATION ---
+
+// expandVars replaces ${NAME} and ${NAME:-fallback} in s with environment
+// variables, so one config file can serve a whole fleet. The fallback is
+// used when NAME is unset or empty, as in a shell. A variable without a
+// fallback must be set. $${ is a literal ${, and a bare $ is left alone so
+// passwords don't need escaping.
+func expandVars(s string, lookup func(string) (string, bool)) (string, error) {
+	var out strings.Builder
+	for {
+		i := strings.Index(s, "${")
+		if i < 0 {
+			out.WriteString(s)
+			return out.String(), nil
+		}
+		if i > 0 && s[i-1] == '$' {
+			out.WriteString(s[:i-1] + "${")
+			s = s[i+2:]
+			continue
+		}
+		end := strings.IndexByte(s[i:], '}')
+		if end < 0 {
+			return "", fmt.Errorf("unclosed ${ in %q", s)
+		}
+		name, fallback, hasFallback := strings.Cut(s[i+2:i+end], ":-")
+		if !validVarName(name) {
+			return "", fmt.Errorf("invalid variable name %q", name)
+		}
+		value, ok := lookup(name)
+		switch {
+		case hasFallback && value == "":
+			value = fallback
+		case !ok:
+			return "", fmt.Errorf("${%s} is not set and has no default", name)
+		}
+		out.WriteString(s[:i] + value)
+		s = s[i+end+1:]
+	}
+}
+
+// validVarName accepts the names a shell would
+func validVarName(name string) bool {
+	if name == "" || (name[0] >= '0' && name[0] <= '9') {
+		return false
+	}
+	for _, r := range name {
+		if r != '_' && (r < 'a' || r > 'z') && (r < 'A' || r > 'Z') && (r < '0' || r > '9') {
+			return false
+		}
+	}
+	return true
+}
+
+// interpolate expands variables in every string of doc (decoded with
+// UseNumber). A string where s expects a number or true/false, such as
+// "percent": "${MIRROR_PERCENT:-10}", is converted after expanding, so
+// numeric settings can vary per machine too.
+func interpolate(doc any, s *jsonSchema, path string, lookup func(string) (string, bool)) (any, error) {
+	at := func() string {
+		if path == "" {
+			return "config"
+		}
+		return path
+	}
+	switch v := doc.(type) {
+	case string:
+		expanded, err := expandVars(v, lookup)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", at(), err)
+		}
+		if s == nil || expanded == v {
+			return expanded, nil
+		}
+		switch s.Type {
+		case "integer", "number":
+			if _, err := strconv.ParseFloat(expanded, 64); err != nil {
+				return nil, fmt.Errorf("%s: expected a number, %q expands to %q", at(), v, expanded)
+			}
+			return json.Number(expanded), nil
+		case "boolean":
+			b, err := strconv.ParseBool(expanded)
+			if err != nil {
+				return nil, fmt.Errorf("%s: expected true or false, %q expands to %q", at(), v, expanded)
+			}
+			return b, nil
+		}
+		return expanded, nil
+	case []any:
+		var items *jsonSchema
+		if s != nil {
+			items = s.Items
+		}
+		for i, item := range v {
+			expanded, err := interpolate(item, items, fmt.Sprintf("%s[%d]", path, i), lookup)
+			if err != nil {
+				return nil, err
+			}
+			v[i] = expanded
+		}
+	case map[string]any:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			// Fields the schema doesn't know are left for checkSchema to report
+			var prop *jsonSchema
+			if s != nil {
+				prop = s.Properties[k]
+				if values, isMap := s.AdditionalProperties.(*jsonSchema); isMap {
+					prop = values
+				}
+			}
+			expanded, err := interpolate(v[k], prop, joinPath(path, k), lookup)
+			if err != nil {
+				return nil, err
+			}
+			v[k] = expanded
+		}
+	}
+	return doc, nil
+}
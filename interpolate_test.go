@@ -0,0 +1,77 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// testEnv is a lookup over a fixed set of variables
+func testEnv(vars map[string]string) func(string) (string, bool) {
+	return func(name string) (string, bool) {
+		v, ok := vars[name]
+		return v, ok
+	}
+}
+
+func TestExpandVars(t *testing.T) {
+	lookup := testEnv(map[string]string{"LAB": "imaging", "EMPTY": ""})
+	for _, tc := range []struct {
+		in, want string
+	}{
+		{"core-${LAB}", "core-imaging"},
+		{"${LAB}-${LAB}", "imaging-imaging"},
+		{"${MISSING:-fallback}", "fallback"},
+		{"${EMPTY:-fallback}", "fallback"},
+		{"${EMPTY}", ""},
+		{"${MISSING:-}", ""},
+		{"pa$$word $LAB", "pa$$word $LAB"},
+		{"$${LAB}", "${LAB}"},
+	} {
+		got, err := expandVars(tc.in, lookup)
+		if err != nil || got != tc.want {
+			t.Errorf("%q: expected %q, got %q, %v", tc.in, tc.want, got, err)
+		}
+	}
+	for _, bad := range []string{"${MISSING}", "${LAB", "${}", "${1X}", "${LAB-x}"} {
+		if _, err := expandVars(bad, lookup); err == nil {
+			t.Errorf("Expected %q to be rejected", bad)
+		}
+	}
+}
+
+func TestConfigInterpolation(t *testing.T) {
+	lookup := testEnv(map[string]string{"LAB_CORE": "core-b2", "MIRROR_PERCENT": "25", "NODE_USER": "alice"})
+	var cfg Config
+	err := decodeChecked([]byte(`{
+		"mirrors": [{"host": "${LAB_CORE}", "target": "${LAB_CORE}-next", "percent": "${MIRROR_PERCENT:-10}"}],
+		"forwards": [{"listen": "${FORWARD_PORT:-9000}", "targets": ["data-${LAB_CORE}:9000"]}],
+		"services": {"core": "${LAB_CORE}:8000"},
+		"users": {"allow": ["${NODE_USER}"]}
+	}`), &cfg, lookup)
+	if err != nil {
+		t.Fatalf("decodeChecked failed: %v", err)
+	}
+	m := cfg.Mirrors[0]
+	if m.Host != "core-b2" || m.Target != "core-b2-next" || m.Percent != 25 {
+		t.Errorf("Unexpected mirror %+v", m)
+	}
+	if cfg.Forwards[0].Listen != "9000" || cfg.Forwards[0].Targets[0] != "data-core-b2:9000" {
+		t.Errorf("Unexpected forward %+v", cfg.Forwards[0])
+	}
+	if cfg.Services["core"] != "core-b2:8000" || cfg.Users.Allow[0] != "alice" {
+		t.Errorf("Unexpected services %v or users %v", cfg.Services, cfg.Users)
+	}
+
+	for _, tc := range []struct {
+		doc, want string
+	}{
+		{`{"routes": [{"host": "${ROUTE_HOST}", "targets": ["a"]}]}`, "routes[0].host: ${ROUTE_HOST} is not set"},
+		{`{"mirrors": [{"host": "a", "target": "b", "percent": "${NODE_USER}"}]}`, `mirrors[0].percent: expected a number, "${NODE_USER}" expands to "alice"`},
+		{`{"mirrors": [{"host": "a", "target": "b", "percent": "10"}]}`, "mirrors[0].percent: expected a number, got a string"},
+	} {
+		err := decodeChecked([]byte(tc.doc), &Config{}, lookup)
+		if err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("%s: expected %q, got %v", tc.doc, tc.want, err)
+		}
+	}
+}
@@ -0,0 +1,344 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// --- JSON-RPC OVER STDIO ---
+
+// ipcJSONRPC is the -ipc value that enables JSON-RPC 2.0 on stdin/stdout
+const ipcJSONRPC = "stdio-jsonrpc"
+
+// rpcMaxLine bounds one request line; forward rules are the largest params
+const rpcMaxLine = 1 << 20
+
+// JSON-RPC 2.0 error codes; -32000 is ours, from the implementation range
+const (
+	rpcParseError     = -32700
+	rpcInvalidRequest = -32600
+	rpcMethodNotFound = -32601
+	rpcInvalidParams  = -32602
+	rpcInternalError  = -32603
+	rpcNotReady       = -32000 // the sidecar hasn't got that far yet
+)
+
+// rpc is nil unless -ipc stdio-jsonrpc is set. Signals reach its
+// subscribers as "event" notifications.
+var rpc *rpcServer
+
+// rpcServer speaks JSON-RPC 2.0, one message per line, for launchers that
+// would rather call methods than write magic words. Requests come in on
+// stdin; responses and notifications are written to stdout as single lines
+// starting with {"jsonrpc", between the log lines and signals, which keep
+// going as before.
+type rpcServer struct {
+	out io.Writer
+
+	mu       sync.Mutex // serializes writes to out and guards the rest
+	status   func(ctx context.Context) (any, error)
+	shutdown func(reason string)
+	subs     map[string][]string // subscription -> signal names, nil = all
+	nextSub  int
+}
+
+func newRPCServer(out io.Writer) *rpcServer {
+	return &rpcServer{out: out, subs: map[string][]string{}}
+}
+
+// attach supplies what status and shutdown need once the node exists;
+// until then they answer rpcNotReady
+func (s *rpcServer) attach(status func(ctx context.Context) (any, error), shutdown func(reason string)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.status, s.shutdown = status, shutdown
+}
+
+type rpcRequest struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id,omitempty"` // absent for notifications
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params,omitempty"`
+}
+
+type rpcResponse struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"`
+	Result  any             `json:"result,omitempty"`
+	Error   *rpcError       `json:"error,omitempty"`
+}
+
+type rpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *rpcError) Error() string { return e.Message }
+
+// RPCEvent is the params of an "event" notification
+type RPCEvent struct {
+	Subscription string `json:"subscription"`
+	Signal       string `json:"signal"` // READY, ERROR, ... without the @@SIDECAR: markers
+	Details      string `json:"details,omitempty"`
+	Time         string `json:"time"`
+}
+
+// serve handles requests until r is closed. A parent closing stdin does
+// not stop the sidecar.
+func (s *rpcServer) serve(r io.Reader) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64<<10), rpcMaxLine)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		if reply := s.handleLine(line); reply != nil {
+			s.write(reply)
+		}
+	}
+}
+
+// handleLine answers one request or batch; nil if nothing is to be sent
+func (s *rpcServer) handleLine(line []byte) any {
+	if line[0] != '[' {
+		var req rpcRequest
+		if err := json.Unmarshal(line, &req); err != nil {
+			return rpcResponse{JSONRPC: "2.0", ID: json.RawMessage("null"), Error: &rpcError{rpcParseError, "parse error: " + err.Error()}}
+		}
+		return s.handle(req)
+	}
+
+	var batch []json.RawMessage
+	if err := json.Unmarshal(line, &batch); err != nil {
+		return rpcResponse{JSONRPC: "2.0", ID: json.RawMessage("null"), Error: &rpcError{rpcParseError, "parse error: " + err.Error()}}
+	}
+	if len(batch) == 0 {
+		return rpcResponse{JSONRPC: "2.0", ID: json.RawMessage("null"), Error: &rpcError{rpcInvalidRequest, "empty batch"}}
+	}
+	var replies []any
+	for _, raw := range batch {
+		var req rpcRequest
+		if err := json.Unmarshal(raw, &req); err != nil {
+			replies = append(replies, rpcResponse{JSONRPC: "2.0", ID: json.RawMessage("null"), Error: &rpcError{rpcInvalidRequest, "invalid request"}})
+			continue
+		}
+		if reply := s.handle(req); reply != nil {
+			replies = append(replies, reply)
+		}
+	}
+	if len(replies) == 0 {
+		return nil
+	}
+	return replies
+}
+
+// handle runs one request. Notifications (no id) get no response.
+func (s *rpcServer) handle(req rpcRequest) any {
+	notification := len(req.ID) == 0
+	if req.JSONRPC != "2.0" || req.Method == "" {
+		if notification {
+			return nil
+		}
+		return rpcResponse{JSONRPC: "2.0", ID: req.ID, Error: &rpcError{rpcInvalidRequest, `invalid request: jsonrpc must be "2.0" and method set`}}
+	}
+
+	result, err := s.call(req.Method, req.Params)
+	if req.Method == "shutdown" && err == nil {
+		// Answer first; shutdown doesn't return
+		if !notification {
+			s.write(rpcResponse{JSONRPC: "2.0", ID: req.ID, Result: result})
+		}
+		s.mu.Lock()
+		stop := s.shutdown
+		s.mu.Unlock()
+		stop("jsonrpc")
+		return nil
+	}
+	if notification {
+		return nil
+	}
+	resp := rpcResponse{JSONRPC: "2.0", ID: req.ID, Result: result}
+	if err != nil {
+		var rerr *rpcError
+		if !errors.As(err, &rerr) {
+			rerr = &rpcError{rpcInternalError, err.Error()}
+		}
+		resp.Result, resp.Error = nil, rerr
+	}
+	return resp
+}
+
+// call dispatches a method. Methods without a useful result return true,
+// since a response needs either a result or an error.
+func (s *rpcServer) call(method string, params json.RawMessage) (any, error) {
+	switch method {
+	case "status":
+		s.mu.Lock()
+		status := s.status
+		s.mu.Unlock()
+		if status == nil {
+			return nil, &rpcError{rpcNotReady, "the node is not running yet"}
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), stdinStatusTimeout)
+		defer cancel()
+		return status(ctx)
+
+	case "shutdown":
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if s.shutdown == nil {
+			return nil, &rpcError{rpcNotReady, "the node is not running yet"}
+		}
+		return true, nil
+
+	case "reload":
+		reload := reloader.Load()
+		if reload == nil {
+			return nil, &rpcError{rpcNotReady, "the config is not loaded yet"}
+		}
+		details, err := runReload(*reload)
+		if err != nil {
+			return nil, err
+		}
+		return ReloadResult{SchemaVersion: apiSchemaVersion, Reloaded: details}, nil
+
+	case "forwards.list":
+		if forwards == nil {
+			return nil, &rpcError{rpcNotReady, "forwards are not ready yet"}
+		}
+		return forwards.list(), nil
+
+	case "forwards.add":
+		if forwards == nil {
+			return nil, &rpcError{rpcNotReady, "forwards are not ready yet"}
+		}
+		var rule ForwardRule
+		if err := decodeParams(params, &rule); err != nil {
+			return nil, err
+		}
+		if err := rule.validate(); err != nil {
+			return nil, &rpcError{rpcInvalidParams, err.Error()}
+		}
+		st, err := forwards.start(rule, true)
+		if err != nil {
+			return nil, err
+		}
+		audit.record("forward_add", "addr", st.Addr, "targets", strings.Join(rule.Targets, ","))
+		return st, nil
+
+	case "forwards.remove":
+		var p struct {
+			Listen string `json:"listen"`
+		}
+		if err := decodeParams(params, &p); err != nil {
+			return nil, err
+		}
+		st, ok := forwards.stop(p.Listen)
+		if !ok {
+			return nil, &rpcError{rpcInvalidParams, fmt.Sprintf("no forward on %q", p.Listen)}
+		}
+		audit.record("forward_remove", "addr", st.Addr)
+		return st, nil
+
+	case "events.subscribe":
+		var p struct {
+			Signals []string `json:"signals"` // READY, ERROR, ...; empty = all
+		}
+		if len(params) > 0 {
+			if err := decodeParams(params, &p); err != nil {
+				return nil, err
+			}
+		}
+		for i, name := range p.Signals {
+			p.Signals[i] = strings.ToUpper(signalName(name))
+		}
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.nextSub++
+		id := strconv.Itoa(s.nextSub)
+		s.subs[id] = p.Signals
+		return map[string]string{"subscription": id}, nil
+
+	case "events.unsubscribe":
+		var p struct {
+			Subscription string `json:"subscription"`
+		}
+		if err := decodeParams(params, &p); err != nil {
+			return nil, err
+		}
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if _, ok := s.subs[p.Subscription]; !ok {
+			return nil, &rpcError{rpcInvalidParams, fmt.Sprintf("no subscription %q", p.Subscription)}
+		}
+		delete(s.subs, p.Subscription)
+		return true, nil
+	}
+	return nil, &rpcError{rpcMethodNotFound, fmt.Sprintf("method %q not found", method)}
+}
+
+// decodeParams reads by-name params into v
+func decodeParams(params json.RawMessage, v any) error {
+	if len(params) == 0 || params[0] != '{' {
+		return &rpcError{rpcInvalidParams, "params must be an object"}
+	}
+	dec := json.NewDecoder(bytes.NewReader(params))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return &rpcError{rpcInvalidParams, "invalid params: " + err.Error()}
+	}
+	return nil
+}
+
+// notify sends a signal to the matching subscriptions. Safe on a nil server.
+func (s *rpcServer) notify(sig, details string) {
+	if s == nil {
+		return
+	}
+	name := signalName(sig)
+	now := time.Now().UTC().Format(time.RFC3339Nano)
+	s.mu.Lock()
+	var events []RPCEvent
+	for id, signals := range s.subs {
+		if signals == nil || slices.Contains(signals, name) {
+			events = append(events, RPCEvent{Subscription: id, Signal: name, Details: details, Time: now})
+		}
+	}
+	s.mu.Unlock()
+	slices.SortFunc(events, func(a, b RPCEvent) int { return strings.Compare(a.Subscription, b.Subscription) })
+	for _, ev := range events {
+		s.write(struct {
+			JSONRPC string   `json:"jsonrpc"`
+			Method  string   `json:"method"`
+			Params  RPCEvent `json:"params"`
+		}{"2.0", "event", ev})
+	}
+}
+
+// write sends one message as a single line
+func (s *rpcServer) write(msg any) {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.out.Write(append(data, '\n'))
+}
+
+// signalName strips the @@SIDECAR:...@@ markers
+func signalName(sig string) string {
+	name := strings.TrimPrefix(sig, "@@SIDECAR:")
+	return strings.TrimSuffix(name, "@@")
+}
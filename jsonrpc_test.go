@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+// rpcLines decodes every JSON line in out
+func rpcLines(t *testing.T, out string) []map[string]any {
+	t.Helper()
+	var msgs []map[string]any
+	for _, line := range strings.Split(strings.TrimSpace(out), "\n") {
+		if !strings.HasPrefix(line, `{"jsonrpc"`) && !strings.HasPrefix(line, `[`) {
+			continue
+		}
+		if strings.HasPrefix(line, "[") {
+			var batch []map[string]any
+			if err := json.Unmarshal([]byte(line), &batch); err != nil {
+				t.Fatalf("Invalid batch line %q: %v", line, err)
+			}
+			msgs = append(msgs, batch...)
+			continue
+		}
+		var msg map[string]any
+		if err := json.Unmarshal([]byte(line), &msg); err != nil {
+			t.Fatalf("Invalid line %q: %v", line, err)
+		}
+		msgs = append(msgs, msg)
+	}
+	return msgs
+}
+
+func TestJSONRPC(t *testing.T) {
+	var out bytes.Buffer
+	s := newRPCServer(&out)
+
+	// Before the node runs, status isn't available yet
+	s.serve(strings.NewReader(`{"jsonrpc":"2.0","id":1,"method":"status"}` + "\n"))
+	msgs := rpcLines(t, out.String())
+	if len(msgs) != 1 || msgs[0]["error"].(map[string]any)["code"] != float64(rpcNotReady) {
+		t.Fatalf("Expected a not-ready error, got %v", msgs)
+	}
+
+	var stopped string
+	s.attach(func(ctx context.Context) (any, error) {
+		return StatusResponse{SchemaVersion: apiSchemaVersion, BackendState: "Running"}, nil
+	}, func(reason string) { stopped = reason })
+
+	out.Reset()
+	s.serve(strings.NewReader(strings.Join([]string{
+		`{"jsonrpc":"2.0","id":2,"method":"status"}`,
+		`{"jsonrpc":"2.0","id":"sub","method":"events.subscribe","params":{"signals":["READY","@@SIDECAR:ERROR@@"]}}`,
+		`{"jsonrpc":"2.0","id":3,"method":"frobnicate"}`,
+		`{"jsonrpc":"2.0","method":"status"}`,
+		`not json`,
+		`[{"jsonrpc":"2.0","id":4,"method":"events.subscribe"},{"jsonrpc":"2.0","id":5,"method":"forwards.remove","params":[1]}]`,
+	}, "\n")))
+	msgs = rpcLines(t, out.String())
+	if len(msgs) != 6 {
+		t.Fatalf("Expected 6 responses (none for the notification), got %d: %s", len(msgs), out.String())
+	}
+	if msgs[0]["id"] != float64(2) || msgs[0]["result"].(map[string]any)["backend_state"] != "Running" {
+		t.Errorf("Expected the status, got %v", msgs[0])
+	}
+	if msgs[1]["id"] != "sub" || msgs[1]["result"].(map[string]any)["subscription"] != "1" {
+		t.Errorf("Expected subscription 1, got %v", msgs[1])
+	}
+	for i, code := range map[int]int{2: rpcMethodNotFound, 3: rpcParseError, 5: rpcInvalidParams} {
+		if msgs[i]["error"].(map[string]any)["code"] != float64(code) {
+			t.Errorf("Expected error %d in response %d, got %v", code, i, msgs[i])
+		}
+	}
+
+	// Subscription 1 only gets READY and ERROR, 2 gets everything
+	out.Reset()
+	s.notify(SignalReady, "http://127.0.0.1:8080")
+	s.notify(SignalHeartbeat, "seq=1")
+	msgs = rpcLines(t, out.String())
+	if len(msgs) != 3 {
+		t.Fatalf("Expected 3 events, got %s", out.String())
+	}
+	ev := msgs[0]["params"].(map[string]any)
+	if msgs[0]["method"] != "event" || ev["subscription"] != "1" || ev["signal"] != "READY" || ev["details"] != "http://127.0.0.1:8080" {
+		t.Errorf("Expected READY for subscription 1, got %v", msgs[0])
+	}
+	if msgs[2]["params"].(map[string]any)["signal"] != "HEARTBEAT" {
+		t.Errorf("Expected HEARTBEAT for subscription 2 only, got %v", msgs[2])
+	}
+
+	out.Reset()
+	s.serve(strings.NewReader(`{"jsonrpc":"2.0","id":6,"method":"events.unsubscribe","params":{"subscription":"2"}}` + "\n" +
+		`{"jsonrpc":"2.0","id":7,"method":"shutdown"}` + "\n"))
+	s.notify(SignalHeartbeat, "seq=2")
+	msgs = rpcLines(t, out.String())
+	if len(msgs) != 2 || msgs[0]["result"] != true || msgs[1]["id"] != float64(7) {
+		t.Errorf("Expected the unsubscribe and shutdown answers and no event, got %s", out.String())
+	}
+	if stopped != "jsonrpc" {
+		t.Errorf("Expected shutdown for jsonrpc, got %q", stopped)
+	}
+
+	var nilServer *rpcServer
+	nilServer.notify(SignalReady, "")
+}
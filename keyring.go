@@ -0,0 +1,53 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// --- KEYRING ---
+
+// keyringPrefix marks an -authkey value as a profile name in the OS keychain.
+const keyringPrefix = "keyring:"
+
+// keyringService is the service/target name auth keys are stored under.
+const keyringService = "arkitekt-sidecar"
+
+// resolveAuthKey looks up the auth key stored for 'keyring:<profile>'
+// values. Other values go through resolveRef, so 'file:' and 'env:' work too.
+func resolveAuthKey(value string) (string, error) {
+	profile, ok := strings.CutPrefix(value, keyringPrefix)
+	if !ok {
+		return resolveRef(value)
+	}
+	if profile == "" {
+		return "", fmt.Errorf("missing profile name in %q", value)
+	}
+	key, err := keyringGet(profile)
+	if err != nil {
+		return "", fmt.Errorf("keyring profile %q: %w", profile, err)
+	}
+	return key, nil
+}
+
+// runKeyringCommand implements `sidecar keyring set <profile>`, reading the
+// auth key from stdin so it never shows up in the process list.
+func runKeyringCommand(args []string, stdin io.Reader) error {
+	if len(args) != 2 || args[0] != "set" || args[1] == "" {
+		return fmt.Errorf("usage: keyring set <profile> < keyfile")
+	}
+	line, err := bufio.NewReader(stdin).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return err
+	}
+	key := strings.TrimSpace(line)
+	if key == "" {
+		return fmt.Errorf("no auth key on stdin")
+	}
+	if err := keyringSet(args[1], key); err != nil {
+		return fmt.Errorf("keyring profile %q: %w", args[1], err)
+	}
+	return nil
+}
@@ -0,0 +1,34 @@
+//go:build darwin
+
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+	"syscall"
+)
+
+// keyringGet reads a generic password from the login Keychain.
+func keyringGet(profile string) (string, error) {
+	out, err := exec.Command("security", "find-generic-password", "-s", keyringService, "-a", profile, "-w").Output()
+	if err != nil {
+		return "", fmt.Errorf("not found in Keychain: %w", err)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// keyringSet stores (or updates) a generic password in the login Keychain.
+// With -w last and no value, security prompts for the password and its
+// confirmation instead of taking it on the command line. It reads them from
+// the terminal if it has one, so it runs in a session of its own and gets
+// them on stdin.
+func keyringSet(profile, key string) error {
+	cmd := exec.Command("security", "add-generic-password", "-U", "-s", keyringService, "-a", profile, "-w")
+	cmd.Stdin = strings.NewReader(key + "\n" + key + "\n")
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("security: %v: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
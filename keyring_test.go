@@ -0,0 +1,27 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestResolveAuthKeyPassesPlainKeys(t *testing.T) {
+	key, err := resolveAuthKey("tskey-auth-abc123")
+	if err != nil || key != "tskey-auth-abc123" {
+		t.Fatalf("Expected plain key unchanged, got %q, %v", key, err)
+	}
+	if _, err := resolveAuthKey("keyring:"); err == nil {
+		t.Fatal("Expected error for empty profile")
+	}
+}
+
+func TestKeyringCommandUsage(t *testing.T) {
+	for _, args := range [][]string{nil, {"get", "prod"}, {"set"}, {"set", ""}} {
+		if err := runKeyringCommand(args, strings.NewReader("tskey\n")); err == nil {
+			t.Errorf("Expected usage error for %v", args)
+		}
+	}
+	if err := runKeyringCommand([]string{"set", "prod"}, strings.NewReader("\n")); err == nil {
+		t.Error("Expected error for empty stdin")
+	}
+}
@@ -0,0 +1,34 @@
+//go:build !darwin && !windows
+
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// keyringGet looks the key up through the Secret Service (GNOME Keyring,
+// KWallet) using libsecret's secret-tool.
+func keyringGet(profile string) (string, error) {
+	out, err := exec.Command("secret-tool", "lookup", "service", keyringService, "profile", profile).Output()
+	if err != nil {
+		return "", fmt.Errorf("not found in Secret Service (secret-tool): %w", err)
+	}
+	key := strings.TrimSpace(string(out))
+	if key == "" {
+		return "", fmt.Errorf("not found in Secret Service")
+	}
+	return key, nil
+}
+
+// keyringSet stores the key in the Secret Service; secret-tool reads the
+// secret from stdin.
+func keyringSet(profile, key string) error {
+	cmd := exec.Command("secret-tool", "store", "--label", keyringService+" "+profile, "service", keyringService, "profile", profile)
+	cmd.Stdin = strings.NewReader(key)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("secret-tool: %v: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	ossignal "os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// --- KUBERNETES ---
+
+// readyFile is written when the sidecar signals READY and removed as soon as
+// it starts shutting down, for exec readiness probes (`test -f`)
+var readyFile string
+
+// writeReadyFile atomically writes the proxy URL to path
+func writeReadyFile(path, proxyURL string) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".ready-*")
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintln(tmp, proxyURL); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	tmp.Close()
+	return os.Rename(tmp.Name(), path)
+}
+
+// removeReadyFile marks the sidecar as not ready
+func removeReadyFile(path string) {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		fmt.Fprintf(console, "!!! Failed to remove ready file %s: %v\n", path, err)
+	}
+}
+
+// resolveRef reads values that are references to where they are kept:
+// "file:/path" for mounted secrets and "env:NAME" for variables set from a
+// fieldRef. Anything else is returned as is.
+func resolveRef(value string) (string, error) {
+	if path, ok := strings.CutPrefix(value, "file:"); ok {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimSpace(string(data)), nil
+	}
+	if name, ok := strings.CutPrefix(value, "env:"); ok {
+		v, ok := os.LookupEnv(name)
+		if !ok || v == "" {
+			return "", fmt.Errorf("environment variable %s is not set", name)
+		}
+		return v, nil
+	}
+	return value, nil
+}
+
+// drain waits until count reports no open connections or grace has passed,
+// and returns how many are still open
+func drain(count func() int, grace, every time.Duration) int {
+	deadline := time.Now().Add(grace)
+	for {
+		n := count()
+		if n == 0 || !time.Now().Before(deadline) {
+			return n
+		}
+		time.Sleep(min(every, time.Until(deadline)))
+	}
+}
+
+// terminations receives SIGTERM and SIGINT, and stop requests from the
+// Windows service manager, which sends no signals
+var terminations = make(chan os.Signal, 2)
+
+// handleTermination shuts down cleanly on SIGTERM or SIGINT. The ready file
+// goes first so no new traffic is routed here, then open connections get up
+// to grace to finish, which should be shorter than the pod's
+// terminationGracePeriodSeconds. A second signal exits right away.
+func handleTermination(grace time.Duration, node io.Closer) {
+	sigs := terminations
+	ossignal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-sigs
+		fmt.Fprintf(console, ">>> Received %v, shutting down\n", sig)
+		if readyFile != "" {
+			removeReadyFile(readyFile)
+		}
+		if grace > 0 {
+			go func() {
+				<-sigs
+				shutdown("forced", node)
+			}()
+			if open := connections.count(); open > 0 {
+				fmt.Fprintf(console, ">>> Waiting up to %v for %d open connections\n", grace, open)
+			}
+			if left := drain(connections.count, grace, 100*time.Millisecond); left > 0 {
+				fmt.Fprintf(console, "!!! Closing %d connections still open after %v\n", left, grace)
+			}
+		}
+		shutdown(sig.String(), node)
+	}()
+}
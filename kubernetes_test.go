@@ -0,0 +1,69 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestResolveRef(t *testing.T) {
+	dir := t.TempDir()
+	secret := filepath.Join(dir, "authkey")
+	os.WriteFile(secret, []byte("tskey-auth-abc\n"), 0o600)
+	t.Setenv("POD_NAME", "worker-7")
+
+	for value, want := range map[string]string{
+		"plain":          "plain",
+		"file:" + secret: "tskey-auth-abc",
+		"env:POD_NAME":   "worker-7",
+	} {
+		got, err := resolveRef(value)
+		if err != nil || got != want {
+			t.Errorf("resolveRef(%q) = %q, %v; want %q", value, got, err, want)
+		}
+	}
+	for _, value := range []string{"file:" + filepath.Join(dir, "missing"), "env:NOT_SET_ANYWHERE"} {
+		if _, err := resolveRef(value); err == nil {
+			t.Errorf("Expected an error for %q", value)
+		}
+	}
+}
+
+func TestReadyFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ready")
+	if err := writeReadyFile(path, "http://127.0.0.1:8080"); err != nil {
+		t.Fatalf("writeReadyFile failed: %v", err)
+	}
+	if data, _ := os.ReadFile(path); string(data) != "http://127.0.0.1:8080\n" {
+		t.Errorf("Unexpected ready file contents %q", data)
+	}
+	removeReadyFile(path)
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("Expected the ready file to be removed, got %v", err)
+	}
+	removeReadyFile(path) // already gone is fine
+}
+
+func TestDrain(t *testing.T) {
+	var open atomic.Int64
+	open.Store(2)
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		open.Store(0)
+	}()
+	count := func() int { return int(open.Load()) }
+	if left := drain(count, time.Second, 5*time.Millisecond); left != 0 {
+		t.Errorf("Expected connections to drain, %d left", left)
+	}
+
+	open.Store(3)
+	start := time.Now()
+	if left := drain(count, 30*time.Millisecond, 5*time.Millisecond); left != 3 {
+		t.Errorf("Expected 3 connections left after the grace period, got %d", left)
+	}
+	if time.Since(start) > 500*time.Millisecond {
+		t.Errorf("Drain overran its grace period: %v", time.Since(start))
+	}
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// --- DESTINATION LATENCY ---
+
+// latencyWindow is how many recent samples per destination the percentiles
+// are computed over, so they follow a path that is getting worse
+const latencyWindow = 512
+
+// maxDestinations bounds how many destinations are tracked; the one seen
+// least recently is dropped to make room
+const maxDestinations = 256
+
+// latencies collects dial and time-to-first-byte samples for every tailnet
+// destination the proxies talk to
+var latencies = newLatencyStats()
+
+// LatencySummary describes the recent samples of one measurement
+type LatencySummary struct {
+	Count  int64   `json:"count"`  // samples since startup
+	Errors int64   `json:"errors"` // failed dials since startup (dial only)
+	P50ms  float64 `json:"p50_ms"`
+	P95ms  float64 `json:"p95_ms"`
+	P99ms  float64 `json:"p99_ms"`
+	MaxMs  float64 `json:"max_ms"`
+	// SlowestRequestID names the request behind MaxMs, to look up in the logs
+	SlowestRequestID string `json:"slowest_request_id,omitempty"`
+}
+
+// DestinationStats is one entry of /stats/destinations
+type DestinationStats struct {
+	Destination string         `json:"destination"`
+	Dial        LatencySummary `json:"dial"`
+	TTFB        LatencySummary `json:"ttfb"`
+	LastSeen    string         `json:"last_seen"`
+}
+
+type latencySample struct {
+	d         time.Duration
+	requestID string
+}
+
+// latencySeries keeps a ring of the most recent samples plus lifetime totals
+type latencySeries struct {
+	ring   []latencySample
+	next   int
+	count  int64
+	errors int64
+	sum    time.Duration
+}
+
+func (s *latencySeries) add(d time.Duration, requestID string) {
+	sample := latencySample{d: d, requestID: requestID}
+	if len(s.ring) < latencyWindow {
+		s.ring = append(s.ring, sample)
+	} else {
+		s.ring[s.next] = sample
+		s.next = (s.next + 1) % latencyWindow
+	}
+	s.count++
+	s.sum += d
+}
+
+// summary computes nearest-rank percentiles over the window
+func (s *latencySeries) summary() LatencySummary {
+	sum := LatencySummary{Count: s.count, Errors: s.errors}
+	if len(s.ring) == 0 {
+		return sum
+	}
+	sorted := slices.Clone(s.ring)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].d < sorted[j].d })
+	rank := func(q float64) float64 {
+		i := int(math.Ceil(q*float64(len(sorted)))) - 1
+		return millis(sorted[max(i, 0)].d)
+	}
+	slowest := sorted[len(sorted)-1]
+	sum.P50ms, sum.P95ms, sum.P99ms = rank(0.50), rank(0.95), rank(0.99)
+	sum.MaxMs = millis(slowest.d)
+	sum.SlowestRequestID = slowest.requestID
+	return sum
+}
+
+func millis(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+type destinationSeries struct {
+	dial, ttfb latencySeries
+	lastSeen   time.Time
+}
+
+type latencyStats struct {
+	mu    sync.Mutex
+	dests map[string]*destinationSeries
+	// Lifetime totals over every destination, evicted ones included
+	dials, dialErrors int64
+}
+
+func newLatencyStats() *latencyStats {
+	return &latencyStats{dests: make(map[string]*destinationSeries)}
+}
+
+// series returns the entry for dest, creating it (and evicting the stalest
+// entry if needed). Must be called with mu held.
+func (l *latencyStats) series(dest string) *destinationSeries {
+	ds, ok := l.dests[dest]
+	if !ok {
+		if len(l.dests) >= maxDestinations {
+			var stalest string
+			for name, other := range l.dests {
+				if stalest == "" || other.lastSeen.Before(l.dests[stalest].lastSeen) {
+					stalest = name
+				}
+			}
+			delete(l.dests, stalest)
+		}
+		ds = &destinationSeries{}
+		l.dests[dest] = ds
+	}
+	ds.lastSeen = time.Now()
+	return ds
+}
+
+// observeDial records how long a dial to dest took, or that it failed
+func (l *latencyStats) observeDial(dest string, d time.Duration, requestID string, err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	ds := l.series(dest)
+	l.dials++
+	if err != nil {
+		l.dialErrors++
+		ds.dial.errors++
+		return
+	}
+	ds.dial.add(d, requestID)
+}
+
+// dialTotals returns how many dials were made since startup and how many
+// of them failed
+func (l *latencyStats) dialTotals() (dials, failed int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.dials, l.dialErrors
+}
+
+// observeTTFB records the time from sending a request (or opening a tunnel)
+// to the first byte coming back from dest
+func (l *latencyStats) observeTTFB(dest string, d time.Duration, requestID string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.series(dest).ttfb.add(d, requestID)
+}
+
+// urlDest is the destination a request URL is dialed as, host:port with
+// the scheme's default port if it names none, so TTFB samples land on the
+// same destination as the dials
+func urlDest(u *url.URL) string {
+	if u.Port() != "" {
+		return u.Host
+	}
+	port := "80"
+	if u.Scheme == "https" {
+		port = "443"
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
+
+// list returns the stats of every destination, sorted by name
+func (l *latencyStats) list() []DestinationStats {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	stats := make([]DestinationStats, 0, len(l.dests))
+	for name, ds := range l.dests {
+		stats = append(stats, DestinationStats{
+			Destination: name,
+			Dial:        ds.dial.summary(),
+			TTFB:        ds.ttfb.summary(),
+			LastSeen:    ds.lastSeen.UTC().Format(time.RFC3339),
+		})
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Destination < stats[j].Destination })
+	return stats
+}
+
+// writeMetrics renders the stats in the Prometheus text format
+func (l *latencyStats) writeMetrics(w io.Writer) {
+	type series struct {
+		name, help string
+		get        func(*destinationSeries) *latencySeries
+	}
+	all := []series{
+		{"sidecar_dial_seconds", "Time to establish a tailnet connection, per destination.", func(ds *destinationSeries) *latencySeries { return &ds.dial }},
+		{"sidecar_ttfb_seconds", "Time to the first byte from a tailnet destination.", func(ds *destinationSeries) *latencySeries { return &ds.ttfb }},
+	}
+
+	l.mu.Lock()
+	names := make([]string, 0, len(l.dests))
+	for name := range l.dests {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	for _, m := range all {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s summary\n", m.name, m.help, m.name)
+		for _, name := range names {
+			s := m.get(l.dests[name])
+			sum := s.summary()
+			label := fmt.Sprintf("destination=%q", name)
+			for _, q := range []struct {
+				q  string
+				ms float64
+			}{{"0.5", sum.P50ms}, {"0.95", sum.P95ms}, {"0.99", sum.P99ms}} {
+				fmt.Fprintf(&b, "%s{%s,quantile=%q} %g\n", m.name, label, q.q, q.ms/1000)
+			}
+			fmt.Fprintf(&b, "%s_sum{%s} %g\n", m.name, label, s.sum.Seconds())
+			fmt.Fprintf(&b, "%s_count{%s} %d\n", m.name, label, s.count)
+		}
+	}
+	b.WriteString("# HELP sidecar_dial_errors_total Failed tailnet dials, per destination.\n# TYPE sidecar_dial_errors_total counter\n")
+	for _, name := range names {
+		fmt.Fprintf(&b, "sidecar_dial_errors_total{destination=%q} %d\n", name, l.dests[name].dial.errors)
+	}
+	l.mu.Unlock()
+
+	io.WriteString(w, b.String())
+}
+
+// timedDialer records the latency of every dial it makes in latencies
+type timedDialer struct {
+	Base  Dialer
+	stats *latencyStats
+}
+
+func (d *timedDialer) Dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	start := time.Now()
+	conn, err := d.Base.Dial(ctx, network, addr)
+	d.stats.observeDial(addr, time.Since(start), requestID(ctx), err)
+	return conn, err
+}
+
+// handleDestinationStats serves the latency summary of every destination
+func handleDestinationStats(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(latencies.list())
+}
+
+// handleMetrics serves the latency metrics for Prometheus
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	latencies.writeMetrics(w)
+}
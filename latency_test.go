@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLatencyPercentiles(t *testing.T) {
+	stats := newLatencyStats()
+	for i := 1; i <= 100; i++ {
+		stats.observeTTFB("data-node:9000", time.Duration(i)*time.Millisecond, "fast")
+	}
+	stats.observeTTFB("data-node:9000", 900*time.Millisecond, "slow-one")
+
+	list := stats.list()
+	if len(list) != 1 {
+		t.Fatalf("Expected 1 destination, got %d", len(list))
+	}
+	ttfb := list[0].TTFB
+	if ttfb.Count != 101 || ttfb.P50ms != 51 || ttfb.P95ms != 96 || ttfb.P99ms != 100 {
+		t.Errorf("Unexpected percentiles %+v", ttfb)
+	}
+	if ttfb.MaxMs != 900 || ttfb.SlowestRequestID != "slow-one" {
+		t.Errorf("Expected the slowest sample to be named, got %+v", ttfb)
+	}
+}
+
+func TestLatencyWindowForgetsOldSamples(t *testing.T) {
+	stats := newLatencyStats()
+	for i := 0; i < latencyWindow; i++ {
+		stats.observeDial("core:443", time.Second, "", nil)
+	}
+	for i := 0; i < latencyWindow; i++ {
+		stats.observeDial("core:443", time.Millisecond, "", nil)
+	}
+	dial := stats.list()[0].Dial
+	if dial.Count != 2*latencyWindow || dial.P99ms != 1 {
+		t.Errorf("Expected only recent samples in the percentiles, got %+v", dial)
+	}
+}
+
+func TestTimedDialerAndMetrics(t *testing.T) {
+	stats := newLatencyStats()
+	d := &timedDialer{
+		Base: &MockDialer{
+			DialFunc: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				if addr == "down-node:80" {
+					return nil, errors.New("unreachable")
+				}
+				client, _ := net.Pipe()
+				return client, nil
+			},
+		},
+		stats: stats,
+	}
+	ctx := withRequestID(context.Background(), "abc123")
+	if conn, err := d.Dial(ctx, "tcp", "data-node:9000"); err == nil {
+		conn.Close()
+	}
+	d.Dial(ctx, "tcp", "down-node:80")
+
+	list := stats.list()
+	if len(list) != 2 || list[0].Dial.Count != 1 || list[0].Dial.SlowestRequestID != "abc123" || list[1].Dial.Errors != 1 {
+		t.Errorf("Unexpected stats %+v", list)
+	}
+
+	var b strings.Builder
+	stats.writeMetrics(&b)
+	for _, want := range []string{
+		"# TYPE sidecar_dial_seconds summary",
+		`sidecar_dial_seconds{destination="data-node:9000",quantile="0.99"}`,
+		`sidecar_dial_seconds_count{destination="data-node:9000"} 1`,
+		`sidecar_dial_errors_total{destination="down-node:80"} 1`,
+		"# TYPE sidecar_ttfb_seconds summary",
+	} {
+		if !strings.Contains(b.String(), want) {
+			t.Errorf("Expected %q in metrics:\n%s", want, b.String())
+		}
+	}
+}
+
+func TestLatencyStatsEvictsStalest(t *testing.T) {
+	stats := newLatencyStats()
+	stats.observeDial("first:1", time.Millisecond, "", nil)
+	time.Sleep(time.Millisecond)
+	for i := 0; i < maxDestinations; i++ {
+		stats.observeDial(net.JoinHostPort("node", string(rune('a'+i%26))+strings.Repeat("x", i/26)), time.Millisecond, "", nil)
+	}
+	if len(stats.dests) != maxDestinations {
+		t.Errorf("Expected %d destinations, got %d", maxDestinations, len(stats.dests))
+	}
+	if _, ok := stats.dests["first:1"]; ok {
+		t.Error("Expected the least recently seen destination to be evicted")
+	}
+}
+
+func TestURLDest(t *testing.T) {
+	for raw, want := range map[string]string{
+		"http://core/api":          "core:80",
+		"https://core/api":         "core:443",
+		"http://core:8080/":        "core:8080",
+		"http://[fd7a::1]/":        "[fd7a::1]:80",
+		"https://minio.lab:9000/x": "minio.lab:9000",
+	} {
+		u, _ := url.Parse(raw)
+		if got := urlDest(u); got != want {
+			t.Errorf("urlDest(%s) = %s, want %s", raw, got, want)
+		}
+	}
+}
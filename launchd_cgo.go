@@ -0,0 +1,42 @@
+//go:build darwin && cgo
+
+package main
+
+/*
+#include <errno.h>
+#include <launch.h>
+#include <stdlib.h>
+*/
+import "C"
+
+import (
+	"net"
+	"syscall"
+	"unsafe"
+)
+
+// launchdListeners takes over the sockets launchd bound for the job's
+// Sockets entry named launchdSocketName. Outside launchd, or without that
+// entry, there are none.
+func launchdListeners() ([]net.Listener, error) {
+	name := C.CString(launchdSocketName)
+	defer C.free(unsafe.Pointer(name))
+	var fds *C.int
+	var count C.size_t
+	if rc := C.launch_activate_socket(name, &fds, &count); rc != 0 {
+		if rc == C.ENOENT || rc == C.ESRCH {
+			return nil, nil
+		}
+		return nil, syscall.Errno(rc)
+	}
+	defer C.free(unsafe.Pointer(fds))
+	var lns []net.Listener
+	for _, fd := range unsafe.Slice(fds, int(count)) {
+		ln, err := fileListener(uintptr(fd))
+		if err != nil {
+			return nil, err
+		}
+		lns = append(lns, ln)
+	}
+	return lns, nil
+}
@@ -0,0 +1,10 @@
+//go:build !darwin || !cgo
+
+package main
+
+import "net"
+
+// launchdListeners needs cgo on macOS; LISTEN_FDS works without it
+func launchdListeners() ([]net.Listener, error) {
+	return nil, nil
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"tailscale.com/ipn"
+	"tailscale.com/tsnet"
+	"tailscale.com/types/logger"
+)
+
+// --- LOGOUT ---
+
+// tsnetStateFiles are what tsnet keeps in the state directory. The sidecar's
+// own files there, like captures, are left alone.
+var tsnetStateFiles = []string{
+	"tailscaled.state",
+	"tailscaled.log.conf",
+	"tailscaled.log1.txt",
+	"tailscaled.log2.txt",
+	"certs",
+}
+
+// LogoutResult is the body of /control/logout responses
+type LogoutResult struct {
+	SchemaVersion int      `json:"schema_version"`
+	LoggedOut     bool     `json:"logged_out"` // false if the node wasn't logged in
+	Removed       []string `json:"removed"`    // state files deleted from the state directory
+}
+
+// clearState deletes the tsnet state in dir and returns what it removed
+func clearState(dir string) ([]string, error) {
+	removed := []string{}
+	for _, name := range tsnetStateFiles {
+		path := filepath.Join(dir, name)
+		if _, err := os.Lstat(path); errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err := os.RemoveAll(path); err != nil {
+			return removed, err
+		}
+		removed = append(removed, name)
+	}
+	return removed, nil
+}
+
+// logout removes the node from the tailnet, stops it and deletes its state
+// so the machine can be decommissioned cleanly
+func logout(ctx context.Context, s *tsnet.Server, dir string) (LogoutResult, error) {
+	res := LogoutResult{SchemaVersion: apiSchemaVersion}
+	lc, err := s.LocalClient()
+	if err != nil {
+		return res, err
+	}
+	st, err := lc.StatusWithoutPeers(ctx)
+	if err != nil {
+		return res, err
+	}
+	if st.BackendState == ipn.Running.String() || st.BackendState == ipn.Starting.String() {
+		if err := lc.Logout(ctx); err != nil {
+			return res, fmt.Errorf("logout failed: %w", err)
+		}
+		res.LoggedOut = true
+	}
+	s.Close()
+	res.Removed, err = clearState(dir)
+	return res, err
+}
+
+// handleLogout logs the running sidecar out, then shuts it down
+func handleLogout(s *tsnet.Server, dir string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(console, ">>> Logout requested on the status API")
+		res, err := logout(r.Context(), s, dir)
+		if err != nil {
+			audit.record("logout", "ok", "false", "error", err.Error())
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		audit.record("logout", "ok", "true")
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(res)
+		http.NewResponseController(w).Flush()
+		shutdown("logout", s)
+	}
+}
+
+// runLogout implements `sidecar logout`, which brings the node in a state
+// directory up just long enough to log it out
+func runLogout(args []string, stdout io.Writer) error {
+	fs := flag.NewFlagSet("logout", flag.ContinueOnError)
+	var (
+		stateDir = fs.String("statedir", "", "State directory of the node (defaults to current working directory)")
+		coord    = fs.String("control-url", "", "Coordination Server URL the node is registered with")
+		timeout  = fs.Duration("timeout", 30*time.Second, "Give up if control can't be reached within this time")
+	)
+	addFlagAliases(fs)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	used, err := deprecatedFlags(fs, nil)
+	if err != nil {
+		return err
+	}
+	warnDeprecatedFlags(used, false)
+	dir := *stateDir
+	if dir == "" {
+		cwd, err := os.Getwd()
+		if err != nil {
+			return err
+		}
+		dir = cwd
+	}
+	if _, err := os.Stat(filepath.Join(dir, "tailscaled.state")); err != nil {
+		return fmt.Errorf("no tailnet state in %s", dir)
+	}
+
+	s := &tsnet.Server{Dir: dir, ControlURL: *coord, Logf: logger.Discard}
+	defer s.Close()
+	if err := s.Start(); err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+	if err := waitForBackend(ctx, s); err != nil {
+		return err
+	}
+	res, err := logout(ctx, s, dir)
+	if err != nil {
+		return err
+	}
+	if res.LoggedOut {
+		fmt.Fprintf(stdout, ">>> Logged out of the tailnet\n")
+	} else {
+		fmt.Fprintf(stdout, ">>> Node was not logged in\n")
+	}
+	fmt.Fprintf(stdout, ">>> Removed %v from %s\n", res.Removed, dir)
+	return nil
+}
+
+// waitForBackend waits until the node has loaded its state and either
+// connected or found it needs a login
+func waitForBackend(ctx context.Context, s *tsnet.Server) error {
+	lc, err := s.LocalClient()
+	if err != nil {
+		return err
+	}
+	for {
+		st, err := lc.StatusWithoutPeers(ctx)
+		if err == nil && (st.BackendState == ipn.Running.String() || st.BackendState == ipn.NeedsLogin.String()) {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("node did not come up: %w", ctx.Err())
+		case <-time.After(250 * time.Millisecond):
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"arkitekt.live/arkitekt-sidecar/testnet"
+)
+
+func TestClearStateKeepsSidecarFiles(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"tailscaled.state", "tailscaled.log1.txt", "captures/core.jsonl", "certs/node.crt"} {
+		path := filepath.Join(dir, name)
+		os.MkdirAll(filepath.Dir(path), 0700)
+		if err := os.WriteFile(path, []byte("x"), 0600); err != nil {
+			t.Fatalf("Failed to write %s: %v", name, err)
+		}
+	}
+
+	removed, err := clearState(dir)
+	if err != nil {
+		t.Fatalf("clearState failed: %v", err)
+	}
+	if want := []string{"tailscaled.state", "tailscaled.log1.txt", "certs"}; !slices.Equal(removed, want) {
+		t.Errorf("Expected %v removed, got %v", want, removed)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "captures", "core.jsonl")); err != nil {
+		t.Errorf("Expected captures to be kept: %v", err)
+	}
+}
+
+func TestLogoutAgainstTestTailnet(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping in-process tailnet test in short mode")
+	}
+	tn, err := testnet.Start("127.0.0.1:0", t.Logf)
+	if err != nil {
+		t.Fatalf("Failed to start test tailnet: %v", err)
+	}
+	defer tn.Close()
+
+	// Keep the state on disk like a real sidecar does
+	dir := t.TempDir()
+	s := tn.Node("decommissioned", dir, func(format string, args ...any) {})
+	s.Store = nil
+	defer s.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+	if _, err := s.Up(ctx); err != nil {
+		t.Fatalf("Node failed to join: %v", err)
+	}
+
+	res, err := logout(ctx, s, dir)
+	if err != nil {
+		t.Fatalf("Logout failed: %v", err)
+	}
+	if !res.LoggedOut || !slices.Contains(res.Removed, "tailscaled.state") {
+		t.Errorf("Unexpected logout result %+v", res)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "tailscaled.state")); !os.IsNotExist(err) {
+		t.Errorf("Expected the state file to be gone, got %v", err)
+	}
+}
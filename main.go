@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bufio"
 	"context"
 	"encoding/json"
 	"flag"
@@ -9,9 +10,20 @@ import (
 	"log"
 	"net"
 	"net/http"
+	"net/http/httptrace"
+	"net/netip"
 	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"time"
 	"github.com/armon/go-socks5"
+	"tailscale.com/ipn"
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/tailcfg"
 	"tailscale.com/tsnet"
 )
 
@@ -22,26 +34,61 @@ var (
 // Magic words for IPC signaling to parent process
 // These can be parsed by a governing process (e.g., Python script) to track state
 const (
-	SignalStarting      = "@@SIDECAR:STARTING@@"
-	SignalConnecting    = "@@SIDECAR:CONNECTING@@"
-	SignalConnected     = "@@SIDECAR:CONNECTED@@"
-	SignalListening     = "@@SIDECAR:LISTENING@@"
-	SignalReady         = "@@SIDECAR:READY@@"
-	SignalError         = "@@SIDECAR:ERROR@@"
-	SignalShutdown      = "@@SIDECAR:SHUTDOWN@@"
-	SignalAuthRequired  = "@@SIDECAR:AUTH_REQUIRED@@"
+	SignalStarting       = "@@SIDECAR:STARTING@@"
+	SignalConnecting     = "@@SIDECAR:CONNECTING@@"
+	SignalConnected      = "@@SIDECAR:CONNECTED@@"
+	SignalListening      = "@@SIDECAR:LISTENING@@"
+	SignalReady          = "@@SIDECAR:READY@@"
+	SignalError          = "@@SIDECAR:ERROR@@"
+	SignalShutdown       = "@@SIDECAR:SHUTDOWN@@"
+	SignalAuthRequired   = "@@SIDECAR:AUTH_REQUIRED@@"
+	SignalFailover       = "@@SIDECAR:FAILOVER@@"
+	SignalFailback       = "@@SIDECAR:FAILBACK@@"
+	SignalMaintenance    = "@@SIDECAR:MAINTENANCE@@"
+	SignalRequestFailed  = "@@SIDECAR:REQUEST_FAILED@@"
+	SignalWarning        = "@@SIDECAR:WARNING@@"
+	SignalManifest       = "@@SIDECAR:MANIFEST@@"
+	SignalHeartbeat      = "@@SIDECAR:HEARTBEAT@@"
+	SignalReloaded       = "@@SIDECAR:RELOADED@@"
+	SignalStatus         = "@@SIDECAR:STATUS@@"
+	SignalRenamed        = "@@SIDECAR:RENAMED@@"
+	SignalTransfer       = "@@SIDECAR:TRANSFER@@"
+	SignalClockSkew      = "@@SIDECAR:CLOCK_SKEW@@"
+	SignalNetworkChanged = "@@SIDECAR:NETWORK_CHANGED@@"
+	SignalAlert          = "@@SIDECAR:ALERT@@"
 )
 
 // signal emits a magic word signal for IPC
 func signal(sig string, details ...string) {
+	ev := Event{Signal: sig, Time: time.Now(), bare: len(details) == 0}
 	if len(details) > 0 {
-		fmt.Printf("%s %s\n", sig, details[0])
-	} else {
-		fmt.Println(sig)
+		ev.Details = secrets.redact(details[0])
 	}
+	events.emit(ev)
 }
 
 func main() {
+	// The Windows service manager starts `sidecar service run ... -- flags`
+	if len(os.Args) > 2 && os.Args[1] == "service" && os.Args[2] == "run" {
+		if err := runService(os.Args[3:], sidecarMain); err != nil {
+			log.Fatalf("!!! %v", err)
+		}
+		return
+	}
+
+	// The tray icon has to own the main thread (macOS), so the sidecar runs
+	// beside it
+	if trayRequested(os.Args[1:], os.LookupEnv) {
+		tray = &trayState{lang: systemLang(os.LookupEnv)}
+		if err := runTray(tray, sidecarMain); err != nil {
+			log.Fatalf("!!! %v", err)
+		}
+		return
+	}
+	sidecarMain()
+}
+
+func sidecarMain() {
 	var (
 		authKey     string
 		controlURL  string
@@ -50,43 +97,567 @@ func main() {
 		stateDir    string
 		mode        string
 		statusPort  string
+		statusCORS  string
+		proxyFrom   string
 		verbose     bool
+		aliasSpecs  aliasFlag
+		aliasPorts  string
+		configPath  string
+		configProfile string
+		upgrade     bool
+		timelineInt time.Duration
+		captureFor  string
+		captureDir  string
+		captureMax  int64
+		setSysProxy bool
+		oauthID     string
+		oauthSecret string
+		advertTags  string
+		derpMapSrc  string
+		testPeer    string
+		speedServe  bool
+		meshOn      bool
+		dialTimeout time.Duration
+		keepAlive   time.Duration
+		noDelay     bool
+		readBuffer  int
+		writeBuffer int
+		backlog     int
+		acceptRate  float64
+		acceptBurst int
+		maxTunnels  int
+		maxMemoryMB int
+		debugOn     bool
+		chaosSpec   string
+		recordPath  string
+		replayPath  string
+		beatEvery   time.Duration
+		metricsPush string
+		metricsTags string
+		metricsTok  string
+		metricsInt  time.Duration
+		netCheck    time.Duration
+		stdinCtl    bool
+		ipcMode     string
+		needSession bool
+		auditPath   string
+		auditKey    string
+		needFIPS    bool
+		readyPath   string
+		gracePeriod time.Duration
+		zstdServe   bool
+		muxServe    bool
+		trayOn      bool
+		lang        string
 	)
 
-	flag.StringVar(&authKey, "authkey", "", "Tailscale Auth Key")
-	flag.StringVar(&controlURL, "coordserver", "", "Coordination Server URL")
+	// Secrets never reach stderr, whoever logs them
+	log.SetOutput(redactingWriter{os.Stderr, secrets})
+
+	flag.StringVar(&authKey, "authkey", "", "Tailscale Auth Key, or 'keyring:<profile>' to read it from the OS keychain")
+	flag.StringVar(&controlURL, "control-url", "", "Coordination Server URL (formerly -coordserver)")
 	flag.StringVar(&hostname, "hostname", "ts-proxy", "Hostname in the Tailnet")
 	flag.StringVar(&port, "port", "8080", "Port to listen on")
 	flag.StringVar(&stateDir, "statedir", "", "State directory (defaults to current working directory)")
-	flag.StringVar(&mode, "mode", "http", "Proxy mode: 'http' or 'socks5'")
+	flag.StringVar(&mode, "mode", "http", "Proxy mode: 'http', 'socks5', 'transparent', 'sni', 'echo' or 'node' (tailnet and status API only)")
 	flag.StringVar(&statusPort, "statusport", "", "Port for status API (disabled if empty)")
+	flag.StringVar(&statusCORS, "status-cors", "", "Comma-separated browser origins allowed to call the status API, e.g. 'https://app.arkitekt.live'")
 	flag.BoolVar(&verbose, "verbose", false, "Enable verbose logging")
-	flag.Parse()
+	flag.Var(&aliasSpecs, "alias", "Loopback alias for a tailnet host: 'host' or 'host=127.0.1.x' (repeatable)")
+	flag.StringVar(&aliasPorts, "alias-ports", "80,443", "Ports forwarded for each alias, e.g. '80,443,8000-8010'")
+	flag.StringVar(&configPath, "config", "", "Path to a JSON config file with routing rules (optional)")
+	flag.StringVar(&configProfile, "profile", "", "Profile of the -config file to apply, e.g. 'lab-a'")
+	flag.StringVar(&captureFor, "capture", "", "Comma-separated target hosts whose proxied traffic is recorded for debugging")
+	flag.StringVar(&captureDir, "capture-dir", "", "Directory for capture files (defaults to <statedir>/captures)")
+	flag.Int64Var(&captureMax, "capture-max-mb", 10, "Maximum size of each capture file in MB")
+	flag.StringVar(&oauthID, "oauth-client-id", "", "Tailscale OAuth client ID used to mint auth keys")
+	flag.StringVar(&oauthSecret, "oauth-client-secret", "", "Tailscale OAuth client secret (or 'keyring:<profile>'); mints a short-lived auth key at startup")
+	flag.StringVar(&advertTags, "advertise-tags", "", "Comma-separated ACL tags for this node, e.g. 'tag:sidecar' (required with OAuth)")
+	flag.StringVar(&derpMapSrc, "derp-map", "", "Custom DERP map (JSON file or http(s) URL) used instead of the one from control")
+	flag.StringVar(&testPeer, "peer", "", "Peer running '-mode echo' to validate against (selftest only)")
+	flag.BoolVar(&speedServe, "speedtest-server", false, "Serve the speedtest companion endpoint on tailnet port 9901")
+	flag.StringVar(&lang, "lang", "", "Language of the dashboard, tray and errors sent to clients: 'en' or 'de' (default from the system locale)")
+	flag.BoolVar(&trayOn, "tray", false, "Show a system tray icon with the connection state (builds with -tags tray)")
+	flag.BoolVar(&zstdServe, "zstd-server", false, "Accept zstd-compressed tunnels to announced services from other sidecars on tailnet port 9905")
+	flag.BoolVar(&muxServe, "mux-server", false, "Accept multiplexed channels to announced services from other sidecars on tailnet port 9906")
+	flag.BoolVar(&meshOn, "mesh", false, "Exchange announced services with other sidecars over the tailnet (port 9902)")
+	flag.DurationVar(&dialTimeout, "dial-timeout", 30*time.Second, "Give up on tailnet connections that aren't established within this time (0 = no limit)")
+	flag.DurationVar(&keepAlive, "keepalive", 30*time.Second, "TCP keepalive interval for tailnet connections, keeps idle ones from dying at NATs (0 = off)")
+	flag.BoolVar(&noDelay, "nodelay", true, "Disable Nagle's algorithm (TCP_NODELAY) on client and tailnet connections")
+	flag.IntVar(&readBuffer, "read-buffer", 0, "Socket receive buffer in bytes for client and tailnet connections (0 = default)")
+	flag.IntVar(&writeBuffer, "write-buffer", 0, "Socket send buffer in bytes for client and tailnet connections (0 = default)")
+	flag.IntVar(&backlog, "listen-backlog", 0, "Listen queue length for local client listeners, capped by the OS (somaxconn) (0 = OS default)")
+	flag.Float64Var(&acceptRate, "accept-rate", 0, "Accept at most this many client connections per second, the rest wait in the listen backlog (0 = unlimited)")
+	flag.IntVar(&acceptBurst, "accept-burst", 0, "Connections accepted at once before -accept-rate applies (default: one second's worth)")
+	flag.IntVar(&maxTunnels, "max-concurrent-tunnels", 0, "Reject new connections while this many tunnels are open (0 = unlimited)")
+	flag.IntVar(&maxMemoryMB, "max-memory-mb", 0, "Reject new connections above this memory use in MB, until it drops below 80% (0 = unlimited)")
+	flag.BoolVar(&debugOn, "debug", false, "Serve /debug/pprof/* and /debug/runtime on the status API")
+	flag.StringVar(&chaosSpec, "chaos", "", "Inject faults into tailnet connections for testing, e.g. 'latency=200ms,loss=1%,bandwidth=10mbps,fail=5%,reset=1%'")
+	flag.StringVar(&recordPath, "record", "", "Append proxied plain HTTP exchanges to this cassette file for later -replay")
+	flag.StringVar(&replayPath, "replay", "", "Serve recorded exchanges from this cassette file instead of joining the tailnet (for tests)")
+	flag.BoolVar(&stdinCtl, "stdin-commands", false, "Accept SHUTDOWN, RELOAD and STATUS commands on stdin (not with exec)")
+	flag.StringVar(&ipcMode, "ipc", "", "'stdio-jsonrpc' to also speak JSON-RPC 2.0 on stdin/stdout, besides the @@SIDECAR@@ signals (not with exec)")
+	flag.DurationVar(&beatEvery, "heartbeat", 0, "Emit a @@SIDECAR:HEARTBEAT@@ event at this interval, e.g. '10s' (0 = off)")
+	flag.StringVar(&metricsPush, "metrics-push", "", "Push metrics to statsd://host:port, influx://host:port (UDP) or influx+https://host:port/api/v2/write?org=...&bucket=...")
+	flag.DurationVar(&metricsInt, "metrics-interval", 10*time.Second, "How often -metrics-push sends")
+	flag.StringVar(&metricsTags, "metrics-tags", "", "Tags added to pushed metrics, e.g. 'lab=imaging,site=b2'")
+	flag.StringVar(&metricsTok, "metrics-token", "", "InfluxDB API token for -metrics-push (file:/path or env:NAME also work)")
+	flag.DurationVar(&netCheck, "network-check", 2*time.Second, "Look for network changes (Wi-Fi, docking) at this interval and reconnect right away (0 = off)")
+	flag.DurationVar(&timelineInt, "peer-timeline", 30*time.Second, "Sample every peer's path and RTT at this interval for /peers/{name}/timeline (0 = off)")
+	flag.BoolVar(&needSession, "require-session", false, "Refuse HTTP and SOCKS5 clients that don't name a session created via /control/sessions")
+	flag.BoolVar(&connectDowngrade, "connect-downgrade", false, "Proxy plain HTTP sent through CONNECT to port 80 like other HTTP requests, with logging, headers and routes")
+	flag.BoolVar(&acceptProxyHeader, "proxy-protocol", false, "Expect a PROXY protocol v1 or v2 header from a local load balancer on every client connection")
+	flag.StringVar(&proxyFrom, "proxy-protocol-from", defaultProxyHeaderFrom, "Comma-separated addresses and ranges of the balancers -proxy-protocol accepts headers from; other clients are refused")
+	flag.StringVar(&fetchDir, "fetch-dir", "", "Directory /fetch downloads into; /fetch is refused without it")
+	flag.StringVar(&readyPath, "ready-file", "", "Write this file on READY and remove it on shutdown, for exec readiness probes")
+	flag.BoolVar(&upgrade, "upgrade", false, "Take over the listeners of the sidecar running on the same -statedir, which drains and exits (Unix)")
+	flag.DurationVar(&gracePeriod, "grace-period", 0, "On SIGTERM, wait up to this long for open connections before exiting (keep below the pod's grace period)")
+	flag.BoolVar(&needFIPS, "require-fips", false, "Refuse to start unless a FIPS 140 validated crypto module (GOFIPS140 or BoringCrypto) is active")
+	flag.StringVar(&auditPath, "audit-log", "", "Append hash-chained control-plane events (reloads, logins, denials) to this file")
+	flag.StringVar(&auditKey, "audit-key", "", "File with the key the audit log's chain is keyed with, created if missing (default audit-key in -statedir)")
+	flag.BoolVar(&setSysProxy, "set-system-proxy", false, "Register as the OS proxy while running and revert on shutdown")
+
+	// `sidecar keyring set <profile>` stores an auth key in the OS keychain
+	if len(os.Args) > 1 && os.Args[1] == "keyring" {
+		if err := runKeyringCommand(os.Args[2:], os.Stdin); err != nil {
+			log.Fatalf("!!! %v", err)
+		}
+		fmt.Fprintf(console, ">>> Stored auth key for profile '%s'\n", os.Args[3])
+		return
+	}
+
+	// `sidecar mint-key -server URL -user NAME` creates a Headscale pre-auth key
+	if len(os.Args) > 1 && os.Args[1] == "mint-key" {
+		if err := runMintKey(os.Args[2:], os.Stdout); err != nil {
+			log.Fatalf("!!! %v", err)
+		}
+		return
+	}
+
+	// `sidecar logout -statedir DIR` removes a node from the tailnet for good
+	if len(os.Args) > 1 && os.Args[1] == "logout" {
+		if err := runLogout(os.Args[2:], os.Stdout); err != nil {
+			log.Fatalf("!!! %v", err)
+		}
+		return
+	}
+
+	// `sidecar healthcheck -statusport N` exits 0 while the sidecar is connected
+	if len(os.Args) > 1 && os.Args[1] == "healthcheck" {
+		if err := runHealthcheck(os.Args[2:], os.Stdout); err != nil {
+			log.Fatalf("!!! %v", err)
+		}
+		return
+	}
+
+	// `sidecar top -statusport N` shows a live dashboard of a running sidecar
+	if len(os.Args) > 1 && os.Args[1] == "top" {
+		if err := runTop(os.Args[2:], os.Stdout); err != nil {
+			log.Fatalf("!!! %v", err)
+		}
+		return
+	}
+
+	// `sidecar diagnose -statusport N host:port` explains why a target can't be reached
+	if len(os.Args) > 1 && os.Args[1] == "diagnose" {
+		if err := runDiagnose(os.Args[2:], os.Stdout); err != nil {
+			log.Fatalf("!!! %v", err)
+		}
+		return
+	}
+
+	// `sidecar service install -- [flags]` runs the sidecar as a Windows service or launchd job
+	if len(os.Args) > 1 && os.Args[1] == "service" {
+		if err := runServiceCommand(os.Args[2:], os.Stdout); err != nil {
+			log.Fatalf("!!! %v", err)
+		}
+		return
+	}
+
+	// `sidecar config schema` prints the config file's JSON Schema
+	if len(os.Args) > 1 && os.Args[1] == "config" {
+		if err := runConfigCommand(os.Args[2:], os.Stdout); err != nil {
+			log.Fatalf("!!! %v", err)
+		}
+		return
+	}
+
+	// `sidecar preflight [flags]` checks what a start would need, without starting
+	if len(os.Args) > 1 && os.Args[1] == "preflight" {
+		if err := runPreflight(os.Args[2:], os.Stdout); err != nil {
+			log.Fatalf("!!! %v", err)
+		}
+		return
+	}
+
+	// `sidecar testnet` runs a throwaway control server and relay for CI
+	if len(os.Args) > 1 && os.Args[1] == "testnet" {
+		if err := runTestnet(os.Args[2:]); err != nil {
+			log.Fatalf("!!! %v", err)
+		}
+		return
+	}
+
+	// `sidecar selftest -peer NODE [flags]` validates a deployment end-to-end
+	selftestMode := len(os.Args) > 1 && os.Args[1] == "selftest"
+
+	// `sidecar exec [flags] -- command args...` runs command against the proxy
+	var execArgs []string
+	if selftestMode {
+		parseFlags(os.Args[2:])
+		if testPeer == "" {
+			log.Fatalf("!!! Usage: %s selftest -peer NODE [flags]", os.Args[0])
+		}
+	} else if len(os.Args) > 1 && os.Args[1] == "exec" {
+		parseFlags(os.Args[2:])
+		execArgs = flag.Args()
+		if len(execArgs) == 0 {
+			log.Fatalf("!!! Usage: %s exec [flags] -- command [args...]", os.Args[0])
+		}
+		if mode != "http" && mode != "socks5" {
+			log.Fatalf("!!! exec needs -mode http or socks5, got '%s'", mode)
+		}
+		if setSysProxy {
+			log.Fatalf("!!! -set-system-proxy cannot be combined with exec")
+		}
+	} else {
+		parseFlags(os.Args[1:])
+	}
+	if l, err := resolveLang(lang); err != nil {
+		log.Fatalf("!!! -lang: %v", err)
+	} else {
+		defaultLang = l
+	}
+	// Sockets bound for us by systemd or launchd, e.g. port 80 on 127.0.0.1
+	if addrs, err := inherited.load(os.LookupEnv); err != nil {
+		signalError(CodeListenFailed, fmt.Sprintf("socket activation: %v", err))
+		log.Fatalf("!!! Failed to take over activated sockets: %v", err)
+	} else if len(addrs) > 0 {
+		fmt.Fprintf(console, ">>> Using socket-activated listeners on %s\n", strings.Join(addrs, ", "))
+	}
+	if trayOn && tray == nil {
+		log.Fatalf("!!! -tray only works when running the sidecar, not with subcommands")
+	}
+	if setSysProxy && mode != "http" && mode != "socks5" {
+		log.Fatalf("!!! -set-system-proxy needs -mode http or socks5")
+	}
+	switch {
+	case ipcMode != "" && ipcMode != ipcJSONRPC:
+		log.Fatalf("!!! Unknown -ipc '%s'. Use '%s'", ipcMode, ipcJSONRPC)
+	case ipcMode == ipcJSONRPC && (stdinCtl || execArgs != nil):
+		log.Fatalf("!!! -ipc %s reads stdin, it can't be combined with -stdin-commands or exec", ipcJSONRPC)
+	case ipcMode == ipcJSONRPC:
+		// Up before anything is signalled, so events can be subscribed early
+		rpc = newRPCServer(console)
+		events.add(rpc)
+		go rpc.serve(os.Stdin)
+	}
+	corsOrigins, err := parseCORSOrigins(statusCORS)
+	if err != nil {
+		log.Fatalf("!!! -status-cors: %v", err)
+	}
+	pushTarget, err := parseMetricsPush(metricsPush, metricsTags, metricsTok)
+	if err != nil {
+		log.Fatalf("!!! -metrics-push: %v", err)
+	}
+	if pushTarget != nil && metricsInt <= 0 {
+		log.Fatalf("!!! -metrics-interval must be positive")
+	}
+	if acceptProxyHeader {
+		if proxyHeaderFrom, err = compileHosts(strings.Split(proxyFrom, ",")); err != nil {
+			log.Fatalf("!!! -proxy-protocol-from: %v", err)
+		}
+	}
+	if backlog < 0 || acceptRate < 0 || acceptBurst < 0 {
+		signalError(CodeConfigInvalid, "negative -listen-backlog, -accept-rate or -accept-burst")
+		log.Fatalf("!!! -listen-backlog, -accept-rate and -accept-burst must not be negative")
+	}
+	if backlog > 0 && !backlogSupported {
+		signalError(CodeUnsupportedPlatform, "-listen-backlog is not supported on this platform")
+		log.Fatalf("!!! -listen-backlog is not supported on this platform")
+	}
+	if fetchDir != "" {
+		if info, err := os.Stat(fetchDir); err != nil || !info.IsDir() {
+			log.Fatalf("!!! -fetch-dir %s is not a directory", fetchDir)
+		}
+	}
+	if mode == "node" && statusPort == "" && !selftestMode {
+		log.Fatalf("!!! -mode node needs -statusport, it serves nothing else")
+	}
+
+	build := currentBuild()
+	fmt.Fprintf(console, "Arkitekt Sidecar %s\n", build)
+	signal(SignalStarting, build.String())
+
+	// Deployments that must document FIPS-validated crypto fail closed here
+	cryptoReport = currentCryptoPolicy(needFIPS)
+	fmt.Fprintf(console, ">>> Crypto: %s\n", cryptoReport)
+	if err := cryptoReport.check(); err != nil {
+		signalError(CodeFIPSRequired, "fips_required")
+		log.Fatalf("!!! %v", err)
+	}
+
+	// Kubernetes mounts secrets as files and passes pod fields as env vars
+	if name, err := resolveRef(hostname); err != nil {
+		signalError(classifyError(err, CodeSecretUnavailable), fmt.Sprintf("hostname lookup failed: %v", err))
+		log.Fatalf("!!! Failed to read hostname: %v", err)
+	} else {
+		hostname = name
+	}
+	if readyPath != "" {
+		readyFile = readyPath
+		removeReadyFile(readyFile) // left over from a previous run
+		onExit(func() { removeReadyFile(readyFile) })
+	}
+
+	if configProfile != "" && configPath == "" {
+		signalError(CodeConfigInvalid, "-profile needs -config")
+		log.Fatalf("!!! -profile needs -config")
+	}
+	cfg := &Config{}
+	if configPath != "" {
+		loaded, err := loadConfig(configPath, configProfile)
+		if err != nil {
+			signalError(CodeConfigInvalid, fmt.Sprintf("invalid config: %v", err))
+			log.Fatalf("!!! Failed to load config: %v", err)
+		}
+		cfg = loaded
+	}
+	if err := secrets.addPatterns(cfg.Redact); err != nil {
+		signalError(CodeConfigInvalid, fmt.Sprintf("invalid config: %v", err))
+		log.Fatalf("!!! Failed to load config: %v", err)
+	}
+
+	// Where signals go besides the /errors log and JSON-RPC
+	if len(cfg.Events) > 0 {
+		sinks, err := newSinks(cfg.Events, hostname)
+		if err != nil {
+			signalError(classifyError(err, CodeConfigInvalid), fmt.Sprintf("failed to start event sinks: %v", err))
+			log.Fatalf("!!! Failed to start event sinks: %v", err)
+		}
+		events.configure(sinks)
+		fmt.Fprintf(console, ">>> Emitting events to %d sinks\n", len(sinks))
+	}
+
+	// Which local accounts may use the proxies on a shared workstation
+	if cfg.Users != nil {
+		if runtime.GOOS != "linux" {
+			signalError(CodeUnsupportedPlatform, "users policy needs Linux")
+			log.Fatalf("!!! %v", errUIDUnsupported)
+		}
+		policy, err := newUserPolicy(cfg.Users)
+		if err != nil {
+			signalError(CodeConfigInvalid, fmt.Sprintf("invalid config: %v", err))
+			log.Fatalf("!!! Failed to load config: %v", err)
+		}
+		users = policy
+		fmt.Fprintf(console, ">>> Identifying local users (%d allowed, %d denied)\n", len(policy.allow), len(policy.deny))
+	}
+
+	// A recorded tailnet for deterministic tests, no credentials needed
+	if replayPath != "" {
+		c, err := loadCassette(replayPath)
+		if err != nil {
+			signalError(CodeConfigInvalid, fmt.Sprintf("invalid cassette: %v", err))
+			log.Fatalf("!!! Failed to load cassette: %v", err)
+		}
+		addr := fmt.Sprintf("127.0.0.1:%s", port)
+		fmt.Fprintf(console, ">>> Replaying %s on %s (no tailnet)\n", replayPath, addr)
+		if err := serveReplay(c, mode, addr); err != nil {
+			signalError(classifyError(err, CodeInternal), fmt.Sprintf("replay failed: %v", err))
+			log.Fatalf("!!! Replay failed: %v", err)
+		}
+		return
+	}
+
+	// Simulated bad network for testing client retry logic
+	var chaos *ChaosConfig
+	if chaosSpec != "" {
+		c, err := parseChaos(chaosSpec)
+		if err != nil {
+			signalError(CodeConfigInvalid, fmt.Sprintf("invalid chaos spec: %v", err))
+			log.Fatalf("!!! %v", err)
+		}
+		chaos = &c
+		fmt.Fprintf(console, ">>> CHAOS MODE: injecting faults into tailnet connections (%s)\n", c)
+	}
+
+	// -authkey keyring:<profile> reads the key from the OS keychain
+	if key, err := resolveAuthKey(authKey); err != nil {
+		signalError(classifyError(err, CodeSecretUnavailable), fmt.Sprintf("auth key lookup failed: %v", err))
+		log.Fatalf("!!! Failed to read auth key: %v", err)
+	} else {
+		authKey = key
+		secrets.addLiteral(authKey)
+	}
+
+	var tags []string
+	if advertTags != "" {
+		tags = strings.Split(advertTags, ",")
+	}
+
+	// OAuth clients mint a short-lived, single-use key instead
+	var minter *authKeyMinter
+	if oauthSecret != "" {
+		secret, err := resolveAuthKey(oauthSecret)
+		if err != nil {
+			signalError(classifyError(err, CodeSecretUnavailable), fmt.Sprintf("oauth secret lookup failed: %v", err))
+			log.Fatalf("!!! Failed to read OAuth client secret: %v", err)
+		}
+		secrets.addLiteral(secret)
+		minter = &authKeyMinter{ClientID: oauthID, ClientSecret: secret, Tags: tags}
+		mintCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		key, err := minter.mint(mintCtx)
+		cancel()
+		if err != nil {
+			signalError(classifyError(err, CodeAuthFailed), fmt.Sprintf("oauth mint failed: %v", err))
+			log.Fatalf("!!! Failed to mint auth key: %v", err)
+		}
+		fmt.Fprintln(console, ">>> Minted a short-lived auth key from the OAuth client")
+		authKey = key
+	}
 
-	fmt.Printf("Arkitekt Sidecar %s\n", version)
-	signal(SignalStarting, version)
+	// Self-hosted relays for deployments that can't reach Tailscale's DERPs
+	var derpMap *tailcfg.DERPMap
+	if derpMapSrc != "" {
+		dm, err := loadDERPMap(derpMapSrc)
+		if err != nil {
+			signalError(CodeConfigInvalid, fmt.Sprintf("invalid DERP map: %v", err))
+			log.Fatalf("!!! Failed to load DERP map: %v", err)
+		}
+		derpMap = dm
+		fmt.Fprintf(console, ">>> Using custom DERP map from %s (%d regions)\n", derpMapSrc, len(dm.Regions))
+	}
+
+	// Catch a misconfigured or incompatible coordination server early
+	var control controlInfo
+	if controlURL != "" {
+		checkCtx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+		info, err := checkControlServer(checkCtx, controlURL)
+		cancel()
+		if err != nil {
+			signalError(classifyError(err, CodeControlUnreachable), fmt.Sprintf("control server check failed: %v", err))
+			log.Fatalf("!!! %v", err)
+		}
+		control = info
+		if info.Headscale {
+			fmt.Fprintf(console, ">>> Control server is Headscale %s\n", info.Version)
+		}
+	}
 
 	// 1. Setup State Directory (prevents re-login on restart)
 	if stateDir == "" {
 		cwd, err := os.Getwd()
 		if err != nil {
-			signal(SignalError, fmt.Sprintf("failed to get cwd: %v", err))
+			signalError(classifyError(err, CodeStorageFailed), fmt.Sprintf("failed to get cwd: %v", err))
 			log.Fatalf("!!! Failed to get current working directory: %v", err)
 		}
 		stateDir = cwd
 	}
 	if err := os.MkdirAll(stateDir, 0700); err != nil {
-		signal(SignalError, fmt.Sprintf("failed to create state dir: %v", err))
+		signalError(classifyError(err, CodeStorageFailed), fmt.Sprintf("failed to create state dir: %v", err))
 		log.Fatalf("!!! Failed to create state directory: %v", err)
 	}
+	// -upgrade takes the listeners of the sidecar running on this state and
+	// waits for it to drain and exit
+	if upgrade {
+		addrs, err := takeOver(stateDir, max(gracePeriod, upgradeDrain)+30*time.Second)
+		switch {
+		case err == errNoUpgradeSource:
+			fmt.Fprintf(console, ">>> No running sidecar in %s to upgrade, starting normally\n", stateDir)
+		case err == errUpgradeUnsupported:
+			signalError(CodeUnsupportedPlatform, err.Error())
+			log.Fatalf("!!! %v", err)
+		case err != nil:
+			signalError(classifyError(err, CodeListenFailed), fmt.Sprintf("upgrade failed: %v", err))
+			log.Fatalf("!!! Upgrade failed: %v", err)
+		default:
+			fmt.Fprintf(console, ">>> Took over %d listeners from the previous sidecar\n", len(addrs))
+		}
+	}
+	// Two nodes sharing one state would keep kicking each other off the tailnet
+	releaseState, err := lockStateDir(stateDir)
+	if err != nil {
+		signalError(classifyError(err, CodeStorageFailed), fmt.Sprintf("failed to lock state dir: %v", err))
+		log.Fatalf("!!! Failed to lock state directory: %v", err)
+	}
+	defer releaseState()
+
+	// Tamper-evident record of control-plane actions for regulated labs
+	if auditPath != "" {
+		if auditKey == "" {
+			auditKey = filepath.Join(stateDir, auditKeyFile)
+		}
+		key, err := loadAuditKey(auditKey)
+		if err != nil {
+			signalError(classifyError(err, CodeStorageFailed), fmt.Sprintf("failed to load audit key: %v", err))
+			log.Fatalf("!!! Failed to load audit key: %v", err)
+		}
+		a, err := openAuditLog(auditPath, key)
+		if err != nil {
+			signalError(classifyError(err, CodeStorageFailed), fmt.Sprintf("failed to open audit log: %v", err))
+			log.Fatalf("!!! Failed to open audit log: %v", err)
+		}
+		audit = a
+		audit.record("start", "version", version, "hostname", hostname, "mode", mode, "config", configPath,
+			"forwards", strconv.Itoa(len(cfg.Forwards)), "routes", strconv.Itoa(len(cfg.Routes)))
+		fmt.Fprintf(console, ">>> Auditing control-plane actions into %s\n", auditPath)
+	}
+
+	// Arkitekt core's service token, attached for local tools
+	if cfg.ServiceToken != nil {
+		t, err := newServiceTokens(cfg.ServiceToken, stateDir)
+		if err != nil {
+			signalError(classifyError(err, CodeStorageFailed), fmt.Sprintf("failed to load service token: %v", err))
+			log.Fatalf("!!! Failed to load service token: %v", err)
+		}
+		serviceToken = t
+		if st := t.status(); st.Present {
+			fmt.Fprintf(console, ">>> Attaching service token %s to requests for %s\n", st.Fingerprint, strings.Join(st.Hosts, ", "))
+		} else {
+			fmt.Fprintf(console, ">>> No service token in %s yet, set one via /control/service-token\n", t.path)
+		}
+	}
+
+	// Debug capture of proxied traffic (opt-in)
+	var capture *Capture
+	if captureFor != "" {
+		if captureDir == "" {
+			captureDir = filepath.Join(stateDir, "captures")
+		}
+		c, err := newCapture(strings.Split(captureFor, ","), captureDir, captureMax<<20)
+		if err != nil {
+			signalError(classifyError(err, CodeStorageFailed), fmt.Sprintf("failed to create capture dir: %v", err))
+			log.Fatalf("!!! Failed to create capture directory: %v", err)
+		}
+		capture = c
+		connections.onClose = func(c *trackedConn) {
+			capture.recordTunnel(c.kind, c.requestID, c.client, c.target, c.started, c.tx.Load(), c.rx.Load())
+		}
+		fmt.Fprintf(console, ">>> Capturing traffic for %s into %s\n", captureFor, captureDir)
+	}
+
+	// Exchanges recorded here can be served again with -replay
+	var recorder *cassetteRecorder
+	if recordPath != "" {
+		r, err := newCassetteRecorder(recordPath)
+		if err != nil {
+			signalError(classifyError(err, CodeStorageFailed), fmt.Sprintf("failed to open cassette: %v", err))
+			log.Fatalf("!!! Failed to open cassette: %v", err)
+		}
+		recorder = r
+		fmt.Fprintf(console, ">>> Recording plain HTTP exchanges into %s\n", recordPath)
+	}
 
 	// 2. Configure the embedded Tailscale Node
 	s := &tsnet.Server{
-		Hostname:   hostname,
-		AuthKey:    authKey,
-		ControlURL: controlURL,
-		Dir:        stateDir,
+		Hostname:      hostname,
+		AuthKey:       authKey,
+		ControlURL:    controlURL,
+		Dir:           stateDir,
+		AdvertiseTags: tags,
 		Logf: func(format string, args ...any) {
+			aclDenials.observeLog(format, args...)
 			if verbose {
 				log.Printf("[Tailscale] "+format, args...)
 			}
@@ -94,76 +665,597 @@ func main() {
 	}
 	defer s.Close()
 
+	if derpMap != nil {
+		if err := s.Start(); err != nil {
+			signalError(classifyError(err, CodeTailnetFailed), fmt.Sprintf("tailnet start failed: %v", err))
+			log.Fatalf("!!! Failed to start Tailscale node: %v", err)
+		}
+		if err := pinDERPMap(context.Background(), s, derpMap); err != nil {
+			signalError(classifyError(err, CodeTailnetFailed), fmt.Sprintf("DERP map setup failed: %v", err))
+			log.Fatalf("!!! Failed to apply DERP map: %v", err)
+		}
+	}
+
+	// A bad clock makes the handshake with control fail without saying why
+	clockServer := controlURL
+	if clockServer == "" {
+		clockServer = ipn.DefaultControlURL
+	}
+	clock = &clockMonitor{server: clockServer}
+	go clock.run(context.Background())
+
 	// Wait for the node to come online
-	fmt.Printf(">>> Starting Tailscale Node '%s'...\n", hostname)
+	fmt.Fprintf(console, ">>> Starting Tailscale Node '%s'...\n", hostname)
 	signal(SignalConnecting, hostname)
 	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
 	defer cancel()
 	
 	status, err := s.Up(ctx)
 	if err != nil {
-		signal(SignalError, fmt.Sprintf("tailnet connection failed: %v", err))
+		if hint := control.upFailureHint(); hint != "" {
+			err = fmt.Errorf("%w (%s)", err, hint)
+		}
+		code := classifyError(err, CodeTailnetFailed)
+		if hint := clock.upFailureHint(); hint != "" {
+			err = fmt.Errorf("%w (%s)", err, hint)
+			code = CodeClockSkew
+		}
+		signalError(code, fmt.Sprintf("tailnet connection failed: %v", err))
 		log.Fatalf("!!! Failed to connect to Tailnet: %v", err)
 	}
-	fmt.Println(">>> Tailscale is Online!")
+	fmt.Fprintln(console, ">>> Tailscale is Online!")
 	signal(SignalConnected, fmt.Sprintf("ips=%v", status.TailscaleIPs))
+	audit.record("login", "hostname", hostname, "ips", fmt.Sprint(status.TailscaleIPs))
+
+	if minter != nil {
+		go reauthOnExpiry(context.Background(), s, minter)
+	}
+
+	// Periodic liveness events for the parent process
+	if beatEvery > 0 {
+		lc, err := s.LocalClient()
+		if err != nil {
+			signalError(classifyError(err, CodeTailnetFailed), fmt.Sprintf("local client failed: %v", err))
+			log.Fatalf("!!! Failed to get local client: %v", err)
+		}
+		hb := &heartbeat{
+			Interval: beatEvery,
+			state: func(ctx context.Context) (string, error) {
+				st, err := lc.StatusWithoutPeers(ctx)
+				if err != nil {
+					return "", err
+				}
+				return st.BackendState, nil
+			},
+			active:  connections.count,
+			counter: traffic,
+		}
+		go hb.run(context.Background())
+	}
+
+	// Metrics for monitoring that can't scrape a workstation's /metrics
+	if pushTarget != nil {
+		go newMetricsPusher(pushTarget, metricsInt, hostname).run(context.Background())
+		fmt.Fprintf(console, ">>> Pushing metrics to %s every %s\n", pushTarget, metricsInt)
+	}
+
+	// Companion endpoint for peers running /peers/{name}/speedtest
+	if speedServe {
+		ln, err := s.Listen("tcp", ":"+speedtestPort)
+		if err != nil {
+			signalError(classifyError(err, CodeListenFailed), fmt.Sprintf("speedtest listener failed: %v", err))
+			log.Fatalf("!!! Failed to listen on tailnet port %s: %v", speedtestPort, err)
+		}
+		fmt.Fprintf(console, ">>> Speedtest companion on tailnet port %s\n", speedtestPort)
+		go http.Serve(ln, speedtestHandler())
+	}
+
+	if selftestMode {
+		testCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		err := selftest(testCtx, s, testPeer, port, console)
+		cancel()
+		s.Close()
+		if err != nil {
+			signalError(CodeSelftestFailed, fmt.Sprintf("selftest failed: %v", err))
+			log.Fatalf("!!! Selftest against %s failed: %v", testPeer, err)
+		}
+		fmt.Fprintf(console, ">>> Selftest against %s passed\n", testPeer)
+		return
+	}
+
+	// Allowlisted commands other sidecars may run on this node
+	if cfg.RemoteExec != nil {
+		ln, err := s.Listen("tcp", ":"+remoteExecPort)
+		if err != nil {
+			signalError(classifyError(err, CodeListenFailed), fmt.Sprintf("remote exec listener failed: %v", err))
+			log.Fatalf("!!! Failed to listen on tailnet port %s: %v", remoteExecPort, err)
+		}
+		fmt.Fprintf(console, ">>> Remote exec on tailnet port %s (%d commands)\n", remoteExecPort, len(cfg.RemoteExec.Commands))
+		go http.Serve(ln, remoteExecHandler(cfg.RemoteExec, tsnetWhoIs(s)))
+	}
+
+	// Inbox for snippets other sidecars share with this node
+	if cfg.Share != nil {
+		if cfg.Share.TTL != "" {
+			inbox.TTL, _ = time.ParseDuration(cfg.Share.TTL)
+		}
+		ln, err := s.Listen("tcp", ":"+sharePort)
+		if err != nil {
+			signalError(classifyError(err, CodeListenFailed), fmt.Sprintf("share listener failed: %v", err))
+			log.Fatalf("!!! Failed to listen on tailnet port %s: %v", sharePort, err)
+		}
+		fmt.Fprintf(console, ">>> Snippet inbox on tailnet port %s (kept for %s)\n", sharePort, inbox.TTL)
+		go http.Serve(ln, shareHandler(cfg.Share, inbox, tsnetWhoIs(s)))
+	}
+
+	// Local services published on this node's tailnet address
+	if len(cfg.Expose) > 0 {
+		if err := startExpose(s, cfg.Expose, tsnetWhoIs(s)); err != nil {
+			signalError(classifyError(err, CodeListenFailed), fmt.Sprintf("expose listener failed: %v", err))
+			log.Fatalf("!!! Failed to expose local services: %v", err)
+		}
+	}
+
+	// Tunnels from other sidecars only reach announced ports
+	var announced []int
+	for _, svc := range cfg.Announce {
+		announced = append(announced, svc.Port)
+	}
+
+	// Compressed tunnels between sidecars, counted in /stats/compression
+	if zstdServe || slices.ContainsFunc(cfg.Forwards, func(f ForwardRule) bool { return f.Compress != "" }) {
+		compression = newCompressionStats()
+	}
+	if zstdServe {
+		ln, err := s.Listen("tcp", ":"+compressPort)
+		if err != nil {
+			signalError(classifyError(err, CodeListenFailed), fmt.Sprintf("zstd listener failed: %v", err))
+			log.Fatalf("!!! Failed to listen on tailnet port %s: %v", compressPort, err)
+		}
+		fmt.Fprintf(console, ">>> Compressed tunnels on tailnet port %s (%d services announced)\n", compressPort, len(announced))
+		go serveCompressed(ln, announced, compression.counters("inbound"))
+	}
+
+	// Multiplexed channels between sidecars, counted in /stats/mux
+	if muxServe || slices.ContainsFunc(cfg.Forwards, func(f ForwardRule) bool { return f.Multiplex }) {
+		mux = newMultiplexer()
+	}
+	if muxServe {
+		ln, err := s.Listen("tcp", ":"+muxPort)
+		if err != nil {
+			signalError(classifyError(err, CodeListenFailed), fmt.Sprintf("mux listener failed: %v", err))
+			log.Fatalf("!!! Failed to listen on tailnet port %s: %v", muxPort, err)
+		}
+		fmt.Fprintf(console, ">>> Multiplexed channels on tailnet port %s (%d services announced)\n", muxPort, len(announced))
+		go serveMux(ln, announced, mux.peer("inbound"))
+	}
+
+	// Services this sidecar announces, and those of the other sidecars
+	mesh := newMeshRegistry(hostname, cfg.Announce)
+	// Optional features other sidecars may rely on, reported in the handshake
+	features := []string{}
+	if speedServe {
+		features = append(features, "speedtest")
+	}
+	if statusPort != "" {
+		features = append(features, "status")
+	}
+	if debugOn {
+		features = append(features, "debug")
+	}
+	if chaos != nil {
+		features = append(features, "chaos")
+	}
+	if cfg.RemoteExec != nil {
+		features = append(features, "exec")
+	}
+	if cfg.Share != nil {
+		features = append(features, "share")
+	}
+	if zstdServe {
+		features = append(features, "zstd")
+	}
+	if muxServe {
+		features = append(features, "mux")
+	}
+	mesh.describe(mode, features)
+	if meshOn {
+		ln, err := s.Listen("tcp", ":"+meshPort)
+		if err != nil {
+			signalError(classifyError(err, CodeListenFailed), fmt.Sprintf("mesh listener failed: %v", err))
+			log.Fatalf("!!! Failed to listen on tailnet port %s: %v", meshPort, err)
+		}
+		go http.Serve(ln, mesh.handler())
+		go mesh.run(context.Background(), s)
+		fmt.Fprintf(console, ">>> Mesh registry on tailnet port %s (%d services announced)\n", meshPort, len(cfg.Announce))
+	}
 
 	// Start status API if enabled
+	controlTok := ""
 	if statusPort != "" {
-		go startStatusServer(s, statusPort)
+		token, tokenPath, err := writeControlToken(stateDir)
+		if err != nil {
+			signalError(classifyError(err, CodeStorageFailed), fmt.Sprintf("failed to write the control token: %v", err))
+			log.Fatalf("!!! Failed to write the control token: %v", err)
+		}
+		controlTok = token
+		fmt.Fprintf(console, ">>> Control API token in %s\n", tokenPath)
+		listeners.add(ListenerInfo{Mode: "status", Addr: "127.0.0.1:" + statusPort})
+		go startStatusServer(s, statusPort, stateDir, controlTok, mesh, debugOn, corsOrigins)
 	}
 
 	// 3. Create the Proxy Handler
+	// Route rules sit between every proxy and the Tailscale Dialer
+	presence := newPeerPresence(s)
+	// Reject connections rather than run a workstation out of memory
+	limits.MaxTunnels = maxTunnels
+	if maxMemoryMB > 0 {
+		limits.setMemoryLimit(maxMemoryMB)
+	}
+
+	clientSockets = socketTuning{NoDelay: noDelay, ReadBuffer: readBuffer, WriteBuffer: writeBuffer}
+	// Connection storms wait in a long backlog and are accepted at a pace
+	listenBacklog = backlog
+	if acceptRate > 0 {
+		pacer = newAcceptPacer(acceptRate, acceptBurst)
+	}
+	var tailnet Dialer = &tailnetDialer{Base: s, Timeout: dialTimeout, KeepAlive: keepAlive, Sockets: clientSockets}
+	if chaos != nil {
+		tailnet = &chaosDialer{Base: tailnet, Config: *chaos}
+	}
+	tailnet = &countingDialer{Base: tailnet, counter: traffic}
+	// The busiest destinations keep a few connections ready
+	if cfg.Prewarm != nil {
+		prewarm = newPrewarmer(tailnet, cfg.Prewarm)
+		tailnet = prewarm
+		go prewarm.run(context.Background())
+	}
+	// ACL rejections fail dials right away instead of timing out
+	guard := &aclDialer{Base: &timedDialer{Base: tailnet, stats: latencies}, Lookup: presence.IP, monitor: aclDenials}
+	router := newRouter(guard, cfg.Routes, presence.Online)
+	router.Services = cfg.Services
+	routing = router
+	// Sessions confine proxy clients to their own allowlist and quota
+	sessions.Required = needSession
+	dialer := &sessionDialer{Base: router}
+	sessions.dialVia(dialer.Dial)
+	if err := startPolicies(sessions, cfg.Policies, router, cfg.Routes); err != nil {
+		signalError(CodeConfigInvalid, err.Error())
+		log.Fatalf("!!! %v", err)
+	}
+
+	// `sidecar diagnose` walks the path the proxies take to a target
+	diagnostics = &diagnoser{
+		router: router,
+		dialer: guard,
+		status: func(ctx context.Context) (*ipnstate.Status, error) {
+			lc, err := s.LocalClient()
+			if err != nil {
+				return nil, err
+			}
+			return lc.Status(ctx)
+		},
+		ping: func(ctx context.Context, ip netip.Addr) (*ipnstate.PingResult, error) {
+			lc, err := s.LocalClient()
+			if err != nil {
+				return nil, err
+			}
+			return lc.Ping(ctx, ip, tailcfg.PingDisco)
+		},
+	}
+
+	// Path changes and round trips of the last hour, per peer
+	if timelineInt > 0 {
+		timelines = &peerTimelines{Interval: timelineInt, status: diagnostics.status, ping: diagnostics.ping}
+		go timelines.run(context.Background())
+	}
+
+	// Peers offline or relayed for too long, too many failed dials
+	if cfg.Alerts != nil && len(cfg.Alerts.Rules) > 0 {
+		alerts = newAlertMonitor(cfg.Alerts, diagnostics.status)
+		go alerts.run(context.Background())
+	}
+
 	// We create a custom HTTP transport that uses the Tailscale Dialer
 	tsTransport := &http.Transport{
-		DialContext: s.Dial, // <--- THE MAGIC: Dials via Tailscale
+		DialContext: dialer.Dial, // <--- THE MAGIC: Dials via Tailscale
+	}
+
+	// GraphQL endpoints get persisted queries and retries
+	if len(cfg.GraphQL) > 0 {
+		graphql = newGraphQLEndpoints(cfg.GraphQL)
+	}
+
+	// /fetch dials like the proxy, one connection per part in flight
+	fetchTransport := &http.Transport{DialContext: dialer.Dial, MaxIdleConnsPerHost: fetchMaxParallel}
+	fetches.transport = fetchTransport
+
+	// Uploads kept while their host can't be reached, sent again once it can
+	if len(cfg.Queue) > 0 {
+		q, err := newOutbox(cfg.Queue, filepath.Join(stateDir, "queue"), tsTransport)
+		if err != nil {
+			signalError(classifyError(err, CodeStorageFailed), fmt.Sprintf("failed to open queue: %v", err))
+			log.Fatalf("!!! Failed to open queue directory: %v", err)
+		}
+		queue = q
+		if n := q.pending(); n > 0 {
+			fmt.Fprintf(console, ">>> %d queued requests from the last run\n", n)
+		}
+		go queue.run(context.Background())
+		queue.kick()
+	}
+
+	// Roaming leaves the node and pooled connections on dead paths
+	if netCheck > 0 {
+		lc, err := s.LocalClient()
+		if err != nil {
+			signalError(classifyError(err, CodeTailnetFailed), fmt.Sprintf("local client failed: %v", err))
+			log.Fatalf("!!! Failed to get local client: %v", err)
+		}
+		netwatch = &networkWatcher{Interval: netCheck, state: currentNetwork}
+		netwatch.onChange(func(ctx context.Context) {
+			if err := lc.DebugAction(ctx, "rebind"); err != nil {
+				fmt.Fprintf(console, "[NET] Rebinding the tailnet sockets failed: %v\n", err)
+			}
+			prewarm.reset()
+			mux.reset()
+			queue.kick()
+			tsTransport.CloseIdleConnections()
+			fetchTransport.CloseIdleConnections()
+		})
+		go netwatch.run(context.Background())
+	}
+
+	// S3-compatible endpoints get large buffers and parallel range downloads
+	if len(cfg.S3) > 0 {
+		s3 = newS3Endpoints(cfg.S3, dialer.Dial)
 	}
 
 	proxy := &TailscaleProxy{
-		Dialer:    s,
+		Dialer:    dialer,
 		Transport: tsTransport,
+		Mirrors:   cfg.Mirrors,
+		Router:    router,
+		Capture:   capture,
+		Recorder:  recorder,
+	}
+
+	// Loopback aliases run alongside the proxy, whatever the mode
+	if len(aliasSpecs) > 0 {
+		aliases, err := parseAliases(aliasSpecs)
+		if err != nil {
+			signalError(CodeConfigInvalid, fmt.Sprintf("invalid alias: %v", err))
+			log.Fatalf("!!! Invalid alias: %v", err)
+		}
+		ports, err := parsePorts(aliasPorts)
+		if err != nil {
+			signalError(CodeConfigInvalid, fmt.Sprintf("invalid alias ports: %v", err))
+			log.Fatalf("!!! Invalid alias ports: %v", err)
+		}
+		if err := startAliases(router, aliases, ports); err != nil {
+			signalError(classifyError(err, CodeListenFailed), fmt.Sprintf("alias listener failed: %v", err))
+			log.Fatalf("!!! Failed to start aliases: %v", err)
+		}
+	}
+
+	// Port forwards from the config file, balanced across their targets.
+	// More can be added through /control/forwards.
+	forwards = newForwardTable(router, presence.Online)
+	if err := startForwards(forwards, cfg.Forwards); err != nil {
+		signalError(classifyError(err, CodeListenFailed), fmt.Sprintf("forward listener failed: %v", err))
+		log.Fatalf("!!! Failed to start forwards: %v", err)
+	}
+
+	// Routes and services can be reloaded on stdin and the status API
+	reload := func() (string, error) {
+		if configPath == "" {
+			return "", fmt.Errorf("no -config file to reload")
+		}
+		loaded, err := loadConfig(configPath, configProfile)
+		if err != nil {
+			return "", err
+		}
+		router.reload(loaded.Routes, loaded.Services)
+		reloadPolicies(sessions, loaded.Policies, loaded.Routes, loaded.Services)
+		if t := sniRoutes.Load(); t != nil {
+			t.reload(loaded.SNI)
+		}
+		fmt.Fprintf(console, ">>> Reloaded %s: %d routes, %d services (forwards, mirrors and announcements need a restart)\n", configPath, len(loaded.Routes), len(loaded.Services))
+		return fmt.Sprintf("routes=%d services=%d", len(loaded.Routes), len(loaded.Services)), nil
+	}
+	reloader.Store(&reload)
+
+	// Control commands from a parent that owns our stdin. exec hands stdin
+	// to the child, so the two don't mix.
+	if stdinCtl && execArgs == nil {
+		cmds := &stdinCommands{
+			Shutdown: func(reason string) { shutdown(reason, s) },
+			Reload:   reload,
+			Status: func(ctx context.Context) (any, error) {
+				return tailnetStatus(ctx, s, mesh)
+			},
+		}
+		go cmds.run(os.Stdin)
+	}
+	if rpc != nil {
+		rpc.attach(func(ctx context.Context) (any, error) {
+			return tailnetStatus(ctx, s, mesh)
+		}, func(reason string) { shutdown(reason, s) })
+	}
+
+	// The tray icon shows the node's state and quits like SHUTDOWN
+	dashboard := ""
+	if statusPort != "" {
+		dashboard = "http://127.0.0.1:" + statusPort + "/#token=" + controlTok
+	}
+	tray.attach(defaultLang, dashboard, func(ctx context.Context) (StatusResponse, error) {
+		return tailnetStatus(ctx, s, mesh)
+	}, func() { shutdown("tray", s) })
+
+	// SIGTERM drains and shuts down cleanly; exec forwards signals to its child
+	if execArgs == nil {
+		handleTermination(gracePeriod, s)
+	}
+
+	// A new binary started with -upgrade takes the listeners from here
+	if execArgs == nil {
+		handover, err := serveUpgrades(stateDir, func() { drainForUpgrade(gracePeriod, s) })
+		if err != nil {
+			fmt.Fprintf(console, "!!! Upgrades with -upgrade disabled: %v\n", err)
+		} else if handover != nil {
+			onExit(func() { handover.Close() })
+		}
 	}
 
 	// 4. Start the Server based on mode
 	addr := fmt.Sprintf("127.0.0.1:%s", port)
+	manifest := newManifest(mode, hostname, stateDir, statusPort, status)
 
 	switch mode {
 	case "http":
-		fmt.Printf(">>> HTTP Proxy listening on %s\n", addr)
-		fmt.Printf(">>> Configure your apps to use HTTP Proxy: %s\n", addr)
+		fmt.Fprintf(console, ">>> HTTP Proxy listening on %s\n", addr)
+		fmt.Fprintf(console, ">>> Configure your apps to use HTTP Proxy: %s\n", addr)
+		ln, err := listenClients(addr)
+		if err != nil {
+			signalError(classifyError(err, CodeListenFailed), fmt.Sprintf("http server failed: %v", err))
+			log.Fatal(err)
+		}
+		listeners.add(ListenerInfo{Mode: "http", Addr: addr})
 		signal(SignalListening, fmt.Sprintf("mode=http addr=%s", addr))
-		signal(SignalReady, fmt.Sprintf("http://%s", addr))
-		if err := http.ListenAndServe(addr, proxy); err != nil {
-			signal(SignalError, fmt.Sprintf("http server failed: %v", err))
+		signalReady(manifest, fmt.Sprintf("http://%s", addr))
+		if len(execArgs) > 0 {
+			go execChild(execArgs, fmt.Sprintf("http://%s", addr), s)
+		}
+		if setSysProxy {
+			if err := startSystemProxy("http", addr); err != nil {
+				signalError(classifyError(err, CodeSystemProxyFailed), fmt.Sprintf("system proxy setup failed: %v", err))
+				log.Fatalf("!!! Failed to set system proxy: %v", err)
+			}
+		}
+		if err := http.Serve(ln, proxy); err != nil {
+			signalError(classifyError(err, CodeListenFailed), fmt.Sprintf("http server failed: %v", err))
 			log.Fatal(err)
 		}
 
 	case "socks5":
-		fmt.Printf(">>> SOCKS5 Proxy listening on %s\n", addr)
-		fmt.Printf(">>> Configure your apps to use SOCKS5 Proxy: %s\n", addr)
+		fmt.Fprintf(console, ">>> SOCKS5 Proxy listening on %s\n", addr)
+		fmt.Fprintf(console, ">>> Configure your apps to use SOCKS5 Proxy: %s\n", addr)
 
 		// Create SOCKS5 server with Tailscale dialer
 		conf := &socks5.Config{
 			Dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
-				fmt.Printf("[SOCKS5] Dialing %s via Tailscale\n", addr)
-				return s.Dial(ctx, network, addr)
+				id := requestID(ctx)
+				fmt.Fprintf(console, "[SOCKS5] %s: dialing %s via Tailscale\n", id, addr)
+				conn, err := dialer.Dial(ctx, network, addr)
+				if err != nil {
+					requestFailed(id, "socks5", addr, err)
+					return nil, err
+				}
+				clientAddr, _ := ctx.Value(clientAddrKey{}).(string)
+				return connections.track("socks5", id, clientAddr, addr, conn, nil), nil
 			},
+			Resolver:    tailnetResolver{},
+			Rewriter:    clientAddrRewriter{},
+			Rules:       admissionRules{},
+			AuthMethods: socksAuth(sessions),
 		}
 		socks5Server, err := socks5.New(conf)
 		if err != nil {
-			signal(SignalError, fmt.Sprintf("socks5 server creation failed: %v", err))
+			signalError(classifyError(err, CodeInternal), fmt.Sprintf("socks5 server creation failed: %v", err))
 			log.Fatalf("!!! Failed to create SOCKS5 server: %v", err)
 		}
+		ln, err := listenClients(addr)
+		if err != nil {
+			signalError(classifyError(err, CodeListenFailed), fmt.Sprintf("socks5 server failed: %v", err))
+			log.Fatal(err)
+		}
+		listeners.add(ListenerInfo{Mode: "socks5", Addr: addr})
 		signal(SignalListening, fmt.Sprintf("mode=socks5 addr=%s", addr))
-		signal(SignalReady, fmt.Sprintf("socks5://%s", addr))
-		if err := socks5Server.ListenAndServe("tcp", addr); err != nil {
-			signal(SignalError, fmt.Sprintf("socks5 server failed: %v", err))
+		signalReady(manifest, fmt.Sprintf("socks5://%s", addr))
+		if len(execArgs) > 0 {
+			// socks5h so the child leaves name resolution to the tailnet
+			go execChild(execArgs, fmt.Sprintf("socks5h://%s", addr), s)
+		}
+		if setSysProxy {
+			if err := startSystemProxy("socks5", addr); err != nil {
+				signalError(classifyError(err, CodeSystemProxyFailed), fmt.Sprintf("system proxy setup failed: %v", err))
+				log.Fatalf("!!! Failed to set system proxy: %v", err)
+			}
+		}
+		if err := socks5Server.Serve(ln); err != nil {
+			signalError(classifyError(err, CodeListenFailed), fmt.Sprintf("socks5 server failed: %v", err))
+			log.Fatal(err)
+		}
+
+	case "transparent":
+		fmt.Fprintf(console, ">>> Transparent Proxy listening on %s\n", addr)
+		fmt.Fprintf(console, ">>> Redirect traffic here with iptables REDIRECT (Linux) or pf rdr (macOS)\n")
+		ln, err := listenClients(addr)
+		if err != nil {
+			signalError(classifyError(err, CodeListenFailed), fmt.Sprintf("transparent listener failed: %v", err))
+			log.Fatalf("!!! Failed to listen on %s: %v", addr, err)
+		}
+		listeners.add(ListenerInfo{Mode: "transparent", Addr: addr})
+		signal(SignalListening, fmt.Sprintf("mode=transparent addr=%s", addr))
+		signalReady(manifest, fmt.Sprintf("tcp://%s", addr))
+		if err := serveTransparent(ln, router, originalDst); err != nil {
+			signalError(classifyError(err, CodeListenFailed), fmt.Sprintf("transparent server failed: %v", err))
 			log.Fatal(err)
 		}
 
+	case "sni":
+		fmt.Fprintf(console, ">>> SNI Proxy listening on %s\n", addr)
+		fmt.Fprintf(console, ">>> Point TLS clients here; each connection goes where its server name leads\n")
+		ln, err := listenClients(addr)
+		if err != nil {
+			signalError(classifyError(err, CodeListenFailed), fmt.Sprintf("sni listener failed: %v", err))
+			log.Fatalf("!!! Failed to listen on %s: %v", addr, err)
+		}
+		table := &sniTable{rules: cfg.SNI}
+		sniRoutes.Store(table)
+		listeners.add(ListenerInfo{Mode: "sni", Addr: addr})
+		signal(SignalListening, fmt.Sprintf("mode=sni addr=%s rules=%d", addr, len(cfg.SNI)))
+		signalReady(manifest, fmt.Sprintf("tcp://%s", addr))
+		if err := serveSNI(ln, router, table); err != nil {
+			signalError(classifyError(err, CodeListenFailed), fmt.Sprintf("sni server failed: %v", err))
+			log.Fatal(err)
+		}
+
+	case "echo":
+		// Echo servers listen on the tailnet, not on localhost
+		tcpLn, err := s.Listen("tcp", ":"+echoTCPPort)
+		if err != nil {
+			signalError(classifyError(err, CodeListenFailed), fmt.Sprintf("echo listener failed: %v", err))
+			log.Fatalf("!!! Failed to listen on tailnet port %s: %v", echoTCPPort, err)
+		}
+		go serveEchoTCP(tcpLn)
+		httpLn, err := s.Listen("tcp", ":"+port)
+		if err != nil {
+			signalError(classifyError(err, CodeListenFailed), fmt.Sprintf("echo listener failed: %v", err))
+			log.Fatalf("!!! Failed to listen on tailnet port %s: %v", port, err)
+		}
+		fmt.Fprintf(console, ">>> Echo server on tailnet: tcp %s:%s, http %s:%s\n", hostname, echoTCPPort, hostname, port)
+		listeners.add(ListenerInfo{Mode: "echo", Addr: net.JoinHostPort(hostname, echoTCPPort)})
+		listeners.add(ListenerInfo{Mode: "echo", Addr: net.JoinHostPort(hostname, port)})
+		signal(SignalListening, fmt.Sprintf("mode=echo tcp=%s http=%s", echoTCPPort, port))
+		signalReady(manifest, fmt.Sprintf("http://%s:%s", hostname, port))
+		if err := http.Serve(httpLn, echoHandler(hostname)); err != nil {
+			signalError(classifyError(err, CodeListenFailed), fmt.Sprintf("echo server failed: %v", err))
+			log.Fatal(err)
+		}
+
+	case "node":
+		// Only the node and the status API; forwards come and go through
+		// /control/forwards
+		statusURL := fmt.Sprintf("http://127.0.0.1:%s%s", statusPort, apiPrefix)
+		fmt.Fprintf(console, ">>> Node-only mode, no proxy. Control API: %s\n", statusURL)
+		signal(SignalListening, fmt.Sprintf("mode=node status=%s", statusURL))
+		signalReady(manifest, statusURL)
+		select {}
+
 	default:
-		signal(SignalError, fmt.Sprintf("unknown mode: %s", mode))
-		log.Fatalf("!!! Unknown mode '%s'. Use 'http' or 'socks5'", mode)
+		signalError(CodeConfigInvalid, fmt.Sprintf("unknown mode: %s", mode))
+		log.Fatalf("!!! Unknown mode '%s'. Use 'http', 'socks5', 'transparent', 'sni', 'echo' or 'node'", mode)
 	}
 }
 
@@ -184,101 +1276,289 @@ type PeerStatus struct {
 	LastHandshake  string   `json:"last_handshake"`
 }
 
+// NodeInfo is metadata about this node that the parent needs for display
+// and policy decisions
+type NodeInfo struct {
+	KeyExpiry      string   `json:"key_expiry"` // empty if the key does not expire
+	Tailnet        string   `json:"tailnet"`
+	Tags           []string `json:"tags"`
+	MagicDNSSuffix string   `json:"magic_dns_suffix"`
+	ControlURL     string   `json:"control_url"` // coordination server actually in use
+}
+
 // StatusResponse is the full status response
 type StatusResponse struct {
+	SchemaVersion int         `json:"schema_version"`
 	Self       PeerStatus   `json:"self"`
+	Node       NodeInfo     `json:"node"`
+	DERP       DERPStatus   `json:"derp"`
 	Peers      []PeerStatus `json:"peers"`
+	Sidecars   []SidecarInfo `json:"sidecars"` // peers answering the mesh handshake (-mesh)
+	Crypto     CryptoPolicy `json:"crypto"`
 	BackendState string     `json:"backend_state"`
 }
 
-func startStatusServer(s *tsnet.Server, port string) {
-	mux := http.NewServeMux()
-	
-	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
-		lc, err := s.LocalClient()
-		if err != nil {
-			http.Error(w, fmt.Sprintf("failed to get local client: %v", err), http.StatusInternalServerError)
-			return
+// nodeInfo collects self metadata from the node status and prefs
+func nodeInfo(status *ipnstate.Status, prefs *ipn.Prefs) NodeInfo {
+	info := NodeInfo{Tags: []string{}}
+	if status.Self != nil {
+		if status.Self.KeyExpiry != nil {
+			info.KeyExpiry = status.Self.KeyExpiry.Format(time.RFC3339)
 		}
+		if status.Self.Tags != nil {
+			info.Tags = status.Self.Tags.AsSlice()
+		}
+	}
+	if status.CurrentTailnet != nil {
+		info.Tailnet = status.CurrentTailnet.Name
+		info.MagicDNSSuffix = status.CurrentTailnet.MagicDNSSuffix
+	}
+	info.ControlURL = ipn.DefaultControlURL
+	if prefs != nil && prefs.ControlURL != "" {
+		info.ControlURL = prefs.ControlURL
+	}
+	return info
+}
 
-		status, err := lc.Status(r.Context())
-		if err != nil {
-			http.Error(w, fmt.Sprintf("failed to get status: %v", err), http.StatusInternalServerError)
-			return
+// tailnetStatus builds the /status response, also used for STATUS on stdin
+func tailnetStatus(ctx context.Context, s *tsnet.Server, mesh *MeshRegistry) (StatusResponse, error) {
+	lc, err := s.LocalClient()
+	if err != nil {
+		return StatusResponse{}, fmt.Errorf("failed to get local client: %w", err)
+	}
+
+	status, err := lc.Status(ctx)
+	if err != nil {
+		return StatusResponse{}, fmt.Errorf("failed to get status: %w", err)
+	}
+
+	prefs, err := lc.GetPrefs(ctx)
+	if err != nil {
+		return StatusResponse{}, fmt.Errorf("failed to get prefs: %w", err)
+	}
+
+	response := StatusResponse{
+		SchemaVersion: apiSchemaVersion,
+		BackendState: status.BackendState,
+		Node:         nodeInfo(status, prefs),
+		Sidecars:     mesh.sidecars(),
+		Crypto:       cryptoReport,
+	}
+
+	// DERP home region and the latest netcheck measurements
+	home := ""
+	if status.Self != nil {
+		home = status.Self.Relay
+	}
+	derpMap, _ := lc.CurrentDERPMap(ctx)
+	if ms, ok := s.Sys().MagicSock.GetOK(); ok {
+		response.DERP = derpStatus(home, ms.GetLastNetcheckReport(ctx), derpMap, ms.DERPs())
+	} else {
+		response.DERP = derpStatus(home, nil, derpMap, 0)
+	}
+
+	// Self info
+	if status.Self != nil {
+		ips := make([]string, len(status.Self.TailscaleIPs))
+		for i, ip := range status.Self.TailscaleIPs {
+			ips[i] = ip.String()
 		}
+		response.Self = PeerStatus{
+			Name:         status.Self.DNSName,
+			HostName:     status.Self.HostName,
+			TailscaleIPs: ips,
+			Online:       status.Self.Online,
+		}
+	}
 
-		response := StatusResponse{
-			BackendState: status.BackendState,
+	// Peer info
+	for _, peer := range status.Peer {
+		ips := make([]string, len(peer.TailscaleIPs))
+		for i, ip := range peer.TailscaleIPs {
+			ips[i] = ip.String()
 		}
 
-		// Self info
-		if status.Self != nil {
-			ips := make([]string, len(status.Self.TailscaleIPs))
-			for i, ip := range status.Self.TailscaleIPs {
-				ips[i] = ip.String()
-			}
-			response.Self = PeerStatus{
-				Name:         status.Self.DNSName,
-				HostName:     status.Self.HostName,
-				TailscaleIPs: ips,
-				Online:       status.Self.Online,
-			}
+		// Determine if connection is direct
+		// If CurAddr is empty or starts with "127.3." it's relayed through DERP
+		isDirect := peer.CurAddr != "" && peer.Relay == ""
+
+		relayedVia := ""
+		if peer.Relay != "" {
+			relayedVia = peer.Relay
 		}
 
-		// Peer info
-		for _, peer := range status.Peer {
-			ips := make([]string, len(peer.TailscaleIPs))
-			for i, ip := range peer.TailscaleIPs {
-				ips[i] = ip.String()
-			}
+		lastSeen := ""
+		if !peer.LastSeen.IsZero() {
+			lastSeen = peer.LastSeen.Format(time.RFC3339)
+		}
 
-			// Determine if connection is direct
-			// If CurAddr is empty or starts with "127.3." it's relayed through DERP
-			isDirect := peer.CurAddr != "" && peer.Relay == ""
+		lastHandshake := ""
+		if !peer.LastHandshake.IsZero() {
+			lastHandshake = peer.LastHandshake.Format(time.RFC3339)
+		}
 
-			relayedVia := ""
-			if peer.Relay != "" {
-				relayedVia = peer.Relay
-			}
+		response.Peers = append(response.Peers, PeerStatus{
+			Name:          peer.DNSName,
+			HostName:      peer.HostName,
+			TailscaleIPs:  ips,
+			Online:        peer.Online,
+			Direct:        isDirect,
+			RelayedVia:    relayedVia,
+			CurAddr:       peer.CurAddr,
+			RxBytes:       peer.RxBytes,
+			TxBytes:       peer.TxBytes,
+			LastSeen:      lastSeen,
+			LastHandshake: lastHandshake,
+		})
+	}
 
-			lastSeen := ""
-			if !peer.LastSeen.IsZero() {
-				lastSeen = peer.LastSeen.Format(time.RFC3339)
-			}
+	return response, nil
+}
 
-			lastHandshake := ""
-			if !peer.LastHandshake.IsZero() {
-				lastHandshake = peer.LastHandshake.Format(time.RFC3339)
-			}
+func startStatusServer(s *tsnet.Server, port, stateDir, token string, mesh *MeshRegistry, debug bool, corsOrigins []string) {
+	mux := http.NewServeMux()
+	// Routes live under /api/v1/ and, for older clients, at their bare paths
+	api := apiMux{mux}
 
-			response.Peers = append(response.Peers, PeerStatus{
-				Name:          peer.DNSName,
-				HostName:      peer.HostName,
-				TailscaleIPs:  ips,
-				Online:        peer.Online,
-				Direct:        isDirect,
-				RelayedVia:    relayedVia,
-				CurAddr:       peer.CurAddr,
-				RxBytes:       peer.RxBytes,
-				TxBytes:       peer.TxBytes,
-				LastSeen:      lastSeen,
-				LastHandshake: lastHandshake,
-			})
+	api.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		response, err := tailnetStatus(r.Context(), s, mesh)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
 		}
 
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(response)
 	})
 
+	// DNS-over-HTTPS (RFC 8484) resolving via the tailnet
+	api.HandleFunc("/dns-query", dohHandler(tsnetDNSQuery(s)))
+
+	// Drain the sidecar before rotating it
+	api.HandleFunc("/control/maintenance", handleMaintenance)
+
+	// Sends the offline queue's requests right away
+	api.HandleFunc("POST /control/queue/flush", handleQueueFlush)
+
+	// Port forwards added and removed while running
+	api.HandleFunc("/control/forwards", handleForwards)
+	api.HandleFunc("DELETE /control/forwards/{listen}", handleForward)
+
+	// Rename the node once the orchestrator knows the job name
+	api.HandleFunc("/control/hostname", handleHostname(func() (prefsClient, error) { return s.LocalClient() }, mesh))
+
+	// Rotate the token attached to requests for Arkitekt core
+	api.HandleFunc("/control/service-token", handleServiceToken)
+
+	// Sessions confining untrusted jobs to an allowlist and quota
+	api.HandleFunc("/control/sessions", handleSessions)
+	api.HandleFunc("/control/sessions/{id}", handleSession)
+
+	// Decommission: log out, delete the node's state and exit
+	api.HandleFunc("POST /control/logout", handleLogout(s, stateDir))
+
+	// Re-read the config file and shut down, like RELOAD and SHUTDOWN on stdin
+	api.HandleFunc("POST /control/reload", handleReload)
+	api.HandleFunc("POST /control/shutdown", handleShutdown(s))
+
+	// Active tunnels, and a way to kill stuck ones
+	api.HandleFunc("GET /connections", handleConnections)
+	api.HandleFunc("DELETE /connections/{id}", handleKillConnection)
+
+	// Aggregated service catalog of all sidecars in the mesh
+	api.HandleFunc("GET /services", mesh.handleServices)
+
+	// Dial and time-to-first-byte percentiles per tailnet destination
+	api.HandleFunc("GET /stats/destinations", handleDestinationStats)
+	api.HandleFunc("GET /metrics", handleMetrics)
+
+	// Hash-chained log of control-plane actions, with -audit-log
+	api.HandleFunc("GET /audit", handleAudit)
+	api.HandleFunc("GET /audit/verify", handleAuditVerify)
+
+	// Connections and traffic per local user, with a users section
+	api.HandleFunc("GET /stats/users", handleUserStats)
+
+	// Persisted queries and retries per GraphQL endpoint
+	api.HandleFunc("GET /stats/graphql", handleGraphQLStats)
+
+	// Parallel range downloads per S3 endpoint
+	api.HandleFunc("GET /stats/s3", handleS3Stats)
+
+	// Compression ratios of zstd tunnels between sidecars
+	api.HandleFunc("GET /stats/compression", handleCompressionStats)
+
+	// Channels and streams per peer for multiplexed forwards
+	api.HandleFunc("GET /stats/mux", handleMuxStats)
+
+	// Ready connections to the busiest destinations
+	api.HandleFunc("GET /stats/prewarm", handlePrewarmStats)
+
+	// Listen backlog, accept pacing and the kernel's dropped connections
+	api.HandleFunc("GET /stats/accept", handleAcceptStats)
+
+	// Requests waiting for their host in the offline queue
+	api.HandleFunc("GET /stats/queue", handleQueueStats)
+
+	// Large downloads over parallel tailnet connections, written to disk
+	api.HandleFunc("/fetch", handleFetch)
+	api.HandleFunc("/fetch/{id}", handleTransfer)
+
+	// Recent connections rejected by the destination's ACLs
+	api.HandleFunc("GET /acl/denials", handleACLDenials)
+
+	// Services and routes in effect, and a dry run of where a host would go
+	api.HandleFunc("GET /routes", handleRoutes)
+	api.HandleFunc("GET /routes/test", handleRouteTest)
+
+	// Why a target can or can't be reached, step by step
+	api.HandleFunc("GET /diagnose", handleDiagnose)
+
+	// Throughput and latency to a peer running -speedtest-server
+	api.HandleFunc("GET /peers/{name}/speedtest", handleSpeedtest(s))
+
+	// Allowlisted maintenance commands on a peer running remote_exec
+	api.HandleFunc("POST /peers/{name}/exec", handlePeerExec(s))
+
+	// What the path to a peer did over the last hour
+	api.HandleFunc("GET /peers/{name}/timeline", handlePeerTimeline)
+
+	// Small snippets (tokens, config) sent to and received from peers
+	api.HandleFunc("POST /share/put", handleSharePut(s))
+	api.HandleFunc("/share/get", handleShareGet(inbox))
+
+	// Profiling and runtime statistics for field debugging (opt-in)
+	if debug {
+		registerDebug(api)
+	}
+
+	// The dashboard's strings in the browser's language
+	api.HandleFunc("GET /messages", handleMessages)
+
+	// Alert conditions that hold now
+	api.HandleFunc("GET /alerts", handleAlerts)
+
+	// Errors and warnings signalled recently, newest first
+	api.HandleFunc("GET /errors", handleRecentErrors)
+
+	// Version, commit and library versions of this binary
+	api.HandleFunc("GET /version", handleVersion)
+
 	// Simple health check
-	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+	api.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
 		w.Write([]byte("OK"))
 	})
 
+	// Dashboard for people without curl, outside the versioned API
+	mux.HandleFunc("GET /{$}", handleDashboard)
+
 	statusAddr := fmt.Sprintf("127.0.0.1:%s", port)
-	fmt.Printf(">>> Status API listening on http://%s/status\n", statusAddr)
-	if err := http.ListenAndServe(statusAddr, mux); err != nil {
+	fmt.Fprintf(console, ">>> Status API listening on http://%s%s/status\n", statusAddr, apiPrefix)
+	if len(corsOrigins) > 0 {
+		fmt.Fprintf(console, ">>> Status API accepts browser requests from %s\n", strings.Join(corsOrigins, ", "))
+	}
+	if err := http.ListenAndServe(statusAddr, withSchemaVersion(withCORS(withControlToken(mux, token), corsOrigins))); err != nil {
 		log.Printf("Status server failed: %v", err)
 	}
 }
@@ -292,11 +1572,38 @@ type Dialer interface {
 type TailscaleProxy struct {
 	Dialer    Dialer
 	Transport http.RoundTripper
+	Mirrors   []MirrorRule // optional shadow traffic rules for plain HTTP
+	Router    *Router      // optional, pins plain HTTP requests on sticky routes
+	Capture   *Capture     // optional debug recording of exchanges
+	Recorder  *cassetteRecorder // optional, writes exchanges for -replay
 }
 
 func (p *TailscaleProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// Every request gets an ID that shows up in logs, responses and IPC events
+	id := requestIDFor(r)
+	r = r.WithContext(withRequestID(r.Context(), id))
+	w.Header().Set(requestIDHeader, id)
+
 	// Log the request
-	fmt.Printf("[%s] %s %s\n", r.RemoteAddr, r.Method, r.URL)
+	logRedacted("[%s] %s %s %s\n", r.RemoteAddr, id, r.Method, r.URL)
+
+	// Jobs with a session only reach what the session allows
+	sess, err := sessions.fromRequest(r)
+	if err != nil {
+		w.Header().Set("Proxy-Authenticate", `Basic realm="sidecar"`)
+		http.Error(w, clientMessage(err, clientLang(r)), http.StatusProxyAuthRequired)
+		return
+	}
+	r = r.WithContext(withSession(r.Context(), sess))
+
+	if maintenance.Load() {
+		http.Error(w, tr(clientLang(r), "client.maintenance"), http.StatusServiceUnavailable)
+		return
+	}
+	if err := limits.admit(); err != nil {
+		http.Error(w, clientMessage(err, clientLang(r)), http.StatusServiceUnavailable)
+		return
+	}
 
 	if r.Method == http.MethodConnect {
 		p.handleTunnel(w, r)
@@ -310,25 +1617,135 @@ func (p *TailscaleProxy) handleHTTP(w http.ResponseWriter, r *http.Request) {
 	// Construct the upstream request
 	// r.RequestURI is technically not allowed to be set in client requests
 	r.RequestURI = "" 
+
+	// Pass the ID on so the tailnet service can log it too
+	id := requestID(r.Context())
+	r.Header.Set(requestIDHeader, id)
+
+	// Uploads the route doesn't allow never leave the machine
+	var capped *cappedBody
+	rule, routed := p.Router.ruleFor(r)
+	if routed {
+		var allowed bool
+		if capped, allowed = limitUpload(w, r, rule); !allowed {
+			return
+		}
+	}
+
+	// Start recording before anything reads the body
+	rec := p.Capture.startHTTP(r)
+	cas := p.Recorder.start(r)
+
+	// Fire off a shadow copy first; it buffers the body we're about to send
+	p.mirror(r)
 	
-	// Use the transport that dials via Tailscale
-	resp, err := p.Transport.RoundTrip(r)
+	// Routes may present another virtual host and speak TLS upstream.
+	// Sticky routes choose their backend per request, not per connection.
+	var pin *stickyPin
+	sni := ""
+	if p.Router != nil {
+		sni = p.Router.rewrite(r)
+		pin, _ = p.Router.pin(r)
+	}
+
+	// Time to first byte, from the request going out on a connection. The
+	// hooks run on the transport's goroutines.
+	var sent atomic.Pointer[time.Time]
+	dest := urlDest(r.URL)
+	r = r.WithContext(httptrace.WithClientTrace(r.Context(), &httptrace.ClientTrace{
+		WroteRequest: func(httptrace.WroteRequestInfo) {
+			now := time.Now()
+			sent.Store(&now)
+		},
+		GotFirstResponseByte: func() {
+			if at := sent.Load(); at != nil {
+				latencies.observeTTFB(dest, time.Since(*at), id)
+			}
+		},
+	}))
+
+	// Uploads to queued hosts are buffered before credentials go on, so they
+	// can be kept on disk while the tailnet is down
+	held := queue.hold(r)
+	if held != nil && held.behind && queue.enqueue(w, held) {
+		// Earlier requests to the host are still waiting, keep the order
+		return
+	}
+
+	// Credentials for Arkitekt core go on last, so mirrors and cassettes never see them
+	serviceToken.apply(r)
+
+	// Use the transport that dials via Tailscale: the session's own if any,
+	// else the one tuned for an S3 endpoint
+	transport := p.Transport
+	bucket := s3.match(r)
+	if sess := sessionFrom(r.Context()); sess != nil {
+		transport = sess.transport
+	} else if bucket != nil && bucket.transport != nil {
+		transport = bucket.transport
+	}
+	if sni != "" {
+		transport = withSNI(transport, sni)
+	}
+	var resp *http.Response
+	var err error
+	if ep := graphql.match(r); ep != nil {
+		resp, err = ep.roundTrip(transport, r)
+	} else if bucket != nil {
+		resp, err = bucket.roundTrip(transport, r)
+	} else {
+		resp, err = transport.RoundTrip(r)
+	}
+	if pin != nil {
+		pin.pool.report(pin.backend, err)
+	}
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Proxy Error: %v", err), http.StatusBadGateway)
+		rec.finish(nil, err)
+		logRedacted("[%s] %s %s failed: %v\n", r.RemoteAddr, id, r.URL, err)
+		if held != nil && retryable(err) && queue.enqueue(w, held) {
+			queue.kick()
+			return
+		}
+		if capped != nil && capped.exceeded {
+			refuseUpload(w, r, rule, http.StatusRequestEntityTooLarge)
+			return
+		}
+		requestFailed(id, "http", r.URL.Host, err)
+		msg := tr(clientLang(r), "client.proxy_error", "error", clientMessage(err, clientLang(r)))
+		if isACLDenied(err) || isSessionDenied(err) {
+			http.Error(w, msg, http.StatusForbidden)
+			return
+		}
+		http.Error(w, msg, http.StatusBadGateway)
 		return
 	}
 	defer resp.Body.Close()
 
 	// Copy Headers
 	for k, vv := range resp.Header {
+		if k == requestIDHeader {
+			continue // ours wins over one echoed by the service
+		}
 		for _, v := range vv {
 			w.Header().Add(k, v)
 		}
 	}
+	if routed {
+		rule.ResponseHeaders.apply(w.Header())
+	}
+	if pin != nil && pin.cookie != nil {
+		w.Header().Add("Set-Cookie", pin.cookie.String())
+	}
 	w.WriteHeader(resp.StatusCode)
 
 	// Copy Body
-	io.Copy(w, resp.Body)
+	if bucket != nil {
+		io.CopyBuffer(w, cas.responseBody(rec.responseBody(resp.Body)), make([]byte, bucket.buffer))
+	} else {
+		io.Copy(w, cas.responseBody(rec.responseBody(resp.Body)))
+	}
+	rec.finish(resp, nil)
+	cas.finish(resp)
 }
 
 // handleTunnel proxies HTTPS requests using the CONNECT method
@@ -347,18 +1764,43 @@ func (p *TailscaleProxy) handleTunnel(w http.ResponseWriter, r *http.Request) {
 	defer clientConn.Close()
 
 	// 2. Dial the destination via Tailscale
-	targetConn, err := p.Dialer.Dial(context.Background(), "tcp", r.Host)
+	id := requestID(r.Context())
+	ctx := withRequestID(withClientAddr(context.Background(), r.RemoteAddr), id)
+	ctx = withSession(ctx, sessionFrom(r.Context()))
+	targetConn, err := p.Dialer.Dial(ctx, "tcp", r.Host)
 	if err != nil {
-		fmt.Printf("Dial failed: %v\n", err)
-		clientConn.Write([]byte("HTTP/1.1 502 Bad Gateway\r\n\r\n"))
+		fmt.Fprintf(console, "[%s] %s Dial failed: %v\n", r.RemoteAddr, id, err)
+		requestFailed(id, "connect", r.Host, err)
+		if isACLDenied(err) || isSessionDenied(err) {
+			msg := clientMessage(err, clientLang(r))
+			fmt.Fprintf(clientConn, "HTTP/1.1 403 Forbidden\r\n%s: %s\r\nContent-Type: text/plain; charset=utf-8\r\nContent-Length: %d\r\n\r\n%s", requestIDHeader, id, len(msg), msg)
+			return
+		}
+		fmt.Fprintf(clientConn, "HTTP/1.1 502 Bad Gateway\r\n%s: %s\r\n\r\n", requestIDHeader, id)
 		return
 	}
+	targetConn = connections.track("connect", id, r.RemoteAddr, r.Host, targetConn, clientConn)
 	defer targetConn.Close()
 
 	// 3. Tell client the tunnel is established
-	clientConn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n"))
+	fmt.Fprintf(clientConn, "HTTP/1.1 200 Connection Established\r\n%s: %s\r\n\r\n", requestIDHeader, id)
+
+	// 4. Plain HTTP to port 80 can take the HTTP path instead
+	var client io.Reader = clientConn
+	if _, port, _ := net.SplitHostPort(r.Host); port == "80" {
+		br := bufio.NewReader(clientConn)
+		client = br
+		if sniffPlainHTTP(clientConn, br) {
+			if connectDowngrade {
+				targetConn.Close()
+				p.serveDowngraded(clientConn, br, r, r.Host)
+				return
+			}
+			hintDowngrade(id, r.Host)
+		}
+	}
 
-	// 4. Pipe data in both directions
-	go io.Copy(targetConn, clientConn)
+	// 5. Pipe data in both directions
+	go io.Copy(targetConn, client)
 	io.Copy(clientConn, targetConn)
 }
\ No newline at end of file
@@ -10,13 +10,15 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"net/url"
-	"os"
 	"strings"
 	"testing"
 	"time"
 
-	"github.com/joho/godotenv"
+	"arkitekt.live/arkitekt-sidecar/testnet"
+	"tailscale.com/ipn"
+	"tailscale.com/ipn/ipnstate"
 	"tailscale.com/tsnet"
+	"tailscale.com/types/views"
 )
 
 // MockDialer implements the Dialer interface
@@ -80,58 +82,59 @@ func (m *MockHijackRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
 	return m.ClientConn, bufio.NewReadWriter(bufio.NewReader(m.ClientConn), bufio.NewWriter(m.ClientConn)), nil
 }
 
-// skipOnCI skips the test if running on GitHub Actions
-func skipOnCI(t *testing.T) {
-	if os.Getenv("GITHUB_ACTIONS") == "true" || os.Getenv("CI") == "true" {
-		t.Skip("Skipping integration test on CI")
+// joinTestTailnet starts an in-process test tailnet and brings up a node
+// for each hostname on it; everything is torn down when the test ends
+func joinTestTailnet(t *testing.T, hostnames ...string) []*tsnet.Server {
+	if testing.Short() {
+		t.Skip("Skipping in-process tailnet test in short mode")
 	}
-}
 
-// loadTestEnv loads environment variables from .env file
-func loadTestEnv(t *testing.T) (coordServer, authKey, testServer string) {
-	if err := godotenv.Load(); err != nil {
-		t.Fatalf("Failed to load .env file: %v", err)
+	tn, err := testnet.Start("127.0.0.1:0", t.Logf)
+	if err != nil {
+		t.Fatalf("Failed to start test tailnet: %v", err)
 	}
+	t.Cleanup(tn.Close)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
 
-	coordServer = strings.Trim(os.Getenv("TEST_COORD_SERVER"), "\" ")
-	authKey = strings.Trim(os.Getenv("TEST_AUTH_KEY"), "\" ")
-	testServer = strings.Trim(os.Getenv("TEST_SERVER"), "\" ")
+	var nodes []*tsnet.Server
+	for _, hostname := range hostnames {
+		s := tn.Node(hostname, t.TempDir(), func(format string, args ...any) {})
+		t.Cleanup(func() { s.Close() })
+		if _, err := s.Up(ctx); err != nil {
+			t.Fatalf("Node %s failed to join: %v", hostname, err)
+		}
+		nodes = append(nodes, s)
+	}
+	return nodes
+}
 
-	if coordServer == "" || authKey == "" || testServer == "" {
-		t.Fatal("TEST_COORD_SERVER, TEST_AUTH_KEY, and TEST_SERVER must be set in .env")
+// serveTestEcho serves the echo handler on port 80 of a tailnet node and
+// returns the node's Tailscale IP
+func serveTestEcho(t *testing.T, s *tsnet.Server) string {
+	ln, err := s.Listen("tcp", ":80")
+	if err != nil {
+		t.Fatalf("Failed to listen on the tailnet: %v", err)
 	}
+	t.Cleanup(func() { ln.Close() })
+	go http.Serve(ln, echoHandler(s.Hostname))
 
-	return coordServer, authKey, testServer
+	ip4, _ := s.TailscaleIPs()
+	return ip4.String()
 }
 
 // TestIntegrationTailscaleConnection tests that we can connect to the Tailscale network
 func TestIntegrationTailscaleConnection(t *testing.T) {
-	skipOnCI(t)
-
-	coordServer, authKey, _ := loadTestEnv(t)
+	s := joinTestTailnet(t, "test-integration")[0]
 
-	// Create temporary state directory for test
-	stateDir, err := os.MkdirTemp("", "tsnet-test-*")
+	lc, err := s.LocalClient()
 	if err != nil {
-		t.Fatalf("Failed to create temp dir: %v", err)
-	}
-	defer os.RemoveAll(stateDir)
-
-	s := &tsnet.Server{
-		Hostname:   "test-integration",
-		AuthKey:    authKey,
-		ControlURL: coordServer,
-		Dir:        stateDir,
-		Logf:       func(format string, args ...any) {},
+		t.Fatalf("Failed to get local client: %v", err)
 	}
-	defer s.Close()
-
-	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
-	defer cancel()
-
-	status, err := s.Up(ctx)
+	status, err := lc.Status(context.Background())
 	if err != nil {
-		t.Fatalf("Failed to connect to Tailnet: %v", err)
+		t.Fatalf("Failed to get status: %v", err)
 	}
 
 	if status.BackendState != "Running" {
@@ -143,38 +146,14 @@ func TestIntegrationTailscaleConnection(t *testing.T) {
 
 // TestIntegrationDialServer tests that we can dial a server on the Tailnet
 func TestIntegrationDialServer(t *testing.T) {
-	skipOnCI(t)
-
-	coordServer, authKey, testServer := loadTestEnv(t)
-
-	// Create temporary state directory for test
-	stateDir, err := os.MkdirTemp("", "tsnet-test-dial-*")
-	if err != nil {
-		t.Fatalf("Failed to create temp dir: %v", err)
-	}
-	defer os.RemoveAll(stateDir)
-
-	s := &tsnet.Server{
-		Hostname:   "test-dial",
-		AuthKey:    authKey,
-		ControlURL: coordServer,
-		Dir:        stateDir,
-		Logf:       func(format string, args ...any) {},
-	}
-	defer s.Close()
-
-	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
-	defer cancel()
-
-	if _, err := s.Up(ctx); err != nil {
-		t.Fatalf("Failed to connect to Tailnet: %v", err)
-	}
+	nodes := joinTestTailnet(t, "test-server", "test-dial")
+	testServer := serveTestEcho(t, nodes[0])
 
 	// Try to dial the test server
 	dialCtx, dialCancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer dialCancel()
 
-	conn, err := s.Dial(dialCtx, "tcp", fmt.Sprintf("%s:80", testServer))
+	conn, err := nodes[1].Dial(dialCtx, "tcp", fmt.Sprintf("%s:80", testServer))
 	if err != nil {
 		t.Fatalf("Failed to dial %s:80 via Tailscale: %v", testServer, err)
 	}
@@ -185,32 +164,9 @@ func TestIntegrationDialServer(t *testing.T) {
 
 // TestIntegrationHTTPProxy tests the HTTP proxy functionality against the test server
 func TestIntegrationHTTPProxy(t *testing.T) {
-	skipOnCI(t)
-
-	coordServer, authKey, testServer := loadTestEnv(t)
-
-	// Create temporary state directory for test
-	stateDir, err := os.MkdirTemp("", "tsnet-test-proxy-*")
-	if err != nil {
-		t.Fatalf("Failed to create temp dir: %v", err)
-	}
-	defer os.RemoveAll(stateDir)
-
-	s := &tsnet.Server{
-		Hostname:   "test-proxy",
-		AuthKey:    authKey,
-		ControlURL: coordServer,
-		Dir:        stateDir,
-		Logf:       func(format string, args ...any) {},
-	}
-	defer s.Close()
-
-	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
-	defer cancel()
-
-	if _, err := s.Up(ctx); err != nil {
-		t.Fatalf("Failed to connect to Tailnet: %v", err)
-	}
+	nodes := joinTestTailnet(t, "test-server", "test-proxy")
+	testServer := serveTestEcho(t, nodes[0])
+	s := nodes[1]
 
 	// Create the proxy with Tailscale transport
 	tsTransport := &http.Transport{
@@ -244,8 +200,12 @@ func TestIntegrationHTTPProxy(t *testing.T) {
 	body, _ := io.ReadAll(resp.Body)
 	t.Logf("Response from %s: status=%d, body length=%d", testServer, resp.StatusCode, len(body))
 
-	if resp.StatusCode >= 500 {
-		t.Errorf("Expected successful response, got status %d", resp.StatusCode)
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected status 200, got %d", resp.StatusCode)
+	}
+	var echo EchoResponse
+	if err := json.Unmarshal(body, &echo); err != nil || echo.Hostname != "test-server" {
+		t.Errorf("Expected the echo of test-server, got %s (%v)", body, err)
 	}
 }
 
@@ -356,6 +316,37 @@ func TestStatusResponseJSON(t *testing.T) {
 	}
 }
 
+func TestNodeInfo(t *testing.T) {
+	expiry := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	tags := views.SliceOf([]string{"tag:sidecar"})
+	status := &ipnstate.Status{
+		Self: &ipnstate.PeerStatus{KeyExpiry: &expiry, Tags: &tags},
+		CurrentTailnet: &ipnstate.TailnetStatus{
+			Name:           "arkitekt.org",
+			MagicDNSSuffix: "tail1234.ts.net",
+		},
+	}
+
+	info := nodeInfo(status, &ipn.Prefs{ControlURL: "https://hs.example.com"})
+	if info.KeyExpiry != "2026-03-01T12:00:00Z" {
+		t.Errorf("Expected key expiry, got '%s'", info.KeyExpiry)
+	}
+	if info.Tailnet != "arkitekt.org" || info.MagicDNSSuffix != "tail1234.ts.net" {
+		t.Errorf("Unexpected tailnet info: %+v", info)
+	}
+	if len(info.Tags) != 1 || info.Tags[0] != "tag:sidecar" {
+		t.Errorf("Expected tags [tag:sidecar], got %v", info.Tags)
+	}
+	if info.ControlURL != "https://hs.example.com" {
+		t.Errorf("Expected control URL from prefs, got '%s'", info.ControlURL)
+	}
+
+	// Without prefs the default control server is in use
+	if info := nodeInfo(&ipnstate.Status{}, &ipn.Prefs{}); info.ControlURL != ipn.DefaultControlURL || info.KeyExpiry != "" {
+		t.Errorf("Unexpected defaults: %+v", info)
+	}
+}
+
 func TestStatusResponseDirectDetection(t *testing.T) {
 	tests := []struct {
 		name       string
@@ -402,32 +393,8 @@ func TestStatusResponseDirectDetection(t *testing.T) {
 
 // TestIntegrationStatusAPI tests the status API with a real Tailscale connection
 func TestIntegrationStatusAPI(t *testing.T) {
-	skipOnCI(t)
-
-	coordServer, authKey, _ := loadTestEnv(t)
-
-	// Create temporary state directory for test
-	stateDir, err := os.MkdirTemp("", "tsnet-test-status-*")
-	if err != nil {
-		t.Fatalf("Failed to create temp dir: %v", err)
-	}
-	defer os.RemoveAll(stateDir)
-
-	s := &tsnet.Server{
-		Hostname:   "test-status-api",
-		AuthKey:    authKey,
-		ControlURL: coordServer,
-		Dir:        stateDir,
-		Logf:       func(format string, args ...any) {},
-	}
-	defer s.Close()
-
-	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
-	defer cancel()
-
-	if _, err := s.Up(ctx); err != nil {
-		t.Fatalf("Failed to connect to Tailnet: %v", err)
-	}
+	s := joinTestTailnet(t, "test-status-api")[0]
+	stateDir := t.TempDir()
 
 	// Start status server on a random port
 	listener, err := net.Listen("tcp", "127.0.0.1:0")
@@ -441,7 +408,7 @@ func TestIntegrationStatusAPI(t *testing.T) {
 	_, port, _ := net.SplitHostPort(statusAddr)
 
 	// Start status server in background
-	go startStatusServer(s, port)
+	go startStatusServer(s, port, stateDir, "test-token", newMeshRegistry("", nil), false, nil)
 
 	// Give the server time to start
 	time.Sleep(100 * time.Millisecond)
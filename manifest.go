@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+
+	"tailscale.com/ipn/ipnstate"
+)
+
+// --- STARTUP MANIFEST ---
+
+// ListenerInfo describes one local (or, for echo, tailnet) listener
+type ListenerInfo struct {
+	Mode   string `json:"mode"` // http, socks5, transparent, echo, alias, forward, node or status
+	Addr   string `json:"addr"`
+	Target string `json:"target,omitempty"` // tailnet destination of aliases and forwards
+}
+
+// Manifest is everything a parent process needs once the sidecar is ready.
+// It is emitted once, right before READY, so the parent doesn't have to piece
+// the setup together from the other signals.
+type Manifest struct {
+	SchemaVersion    int            `json:"schema_version"`
+	Version          string         `json:"version"`
+	PID              int            `json:"pid"`
+	Mode             string         `json:"mode"`
+	ProxyURL         string         `json:"proxy_url"` // same as the READY payload
+	Hostname         string         `json:"hostname"`
+	DNSName          string         `json:"dns_name"`
+	TailscaleIPs     []string       `json:"tailscale_ips"`
+	StatusURL        string         `json:"status_url"`                   // empty without -statusport
+	ControlTokenFile string         `json:"control_token_file,omitempty"` // token the control endpoints need
+	StateDir         string         `json:"state_dir"`
+	Replay           bool           `json:"replay,omitempty"`
+	Listeners        []ListenerInfo `json:"listeners"`
+}
+
+// listeners collects every listener as it is opened, for the manifest
+var listeners listenerRegistry
+
+type listenerRegistry struct {
+	mu   sync.Mutex
+	list []ListenerInfo
+}
+
+func (r *listenerRegistry) add(l ListenerInfo) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.list = append(r.list, l)
+}
+
+// remove drops a listener that was closed while running
+func (r *listenerRegistry) remove(mode, addr string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.list = slices.DeleteFunc(r.list, func(l ListenerInfo) bool { return l.Mode == mode && l.Addr == addr })
+}
+
+func (r *listenerRegistry) snapshot() []ListenerInfo {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]ListenerInfo{}, r.list...)
+}
+
+// newManifest fills in the process and node details; status is nil in
+// replay mode, which never joins a tailnet
+func newManifest(mode, hostname, stateDir, statusPort string, status *ipnstate.Status) Manifest {
+	m := Manifest{
+		SchemaVersion: apiSchemaVersion,
+		Version:       version,
+		PID:           os.Getpid(),
+		Mode:          mode,
+		Hostname:      hostname,
+		StateDir:      stateDir,
+		TailscaleIPs:  []string{},
+	}
+	if statusPort != "" {
+		m.StatusURL = fmt.Sprintf("http://127.0.0.1:%s%s/status", statusPort, apiPrefix)
+		m.ControlTokenFile = filepath.Join(stateDir, controlTokenFile)
+	}
+	if status != nil {
+		for _, ip := range status.TailscaleIPs {
+			m.TailscaleIPs = append(m.TailscaleIPs, ip.String())
+		}
+		if status.Self != nil {
+			m.DNSName = status.Self.DNSName
+		}
+	}
+	return m
+}
+
+// signalReady emits the manifest and then READY with proxyURL
+func signalReady(m Manifest, proxyURL string) {
+	m.ProxyURL = proxyURL
+	m.Listeners = listeners.snapshot()
+	data, err := json.Marshal(m)
+	if err == nil {
+		signal(SignalManifest, string(data))
+	}
+	if readyFile != "" {
+		if err := writeReadyFile(readyFile, proxyURL); err != nil {
+			fmt.Fprintf(console, "!!! Failed to write ready file %s: %v\n", readyFile, err)
+		}
+	}
+	tray.setProxyURL(proxyURL)
+	signal(SignalReady, proxyURL)
+}
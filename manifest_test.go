@@ -0,0 +1,53 @@
+package main
+
+import (
+	"encoding/json"
+	"net/netip"
+	"os"
+	"strings"
+	"testing"
+
+	"tailscale.com/ipn/ipnstate"
+)
+
+func TestSignalReadyManifest(t *testing.T) {
+	saved := listeners.snapshot()
+	defer func() { listeners.list = saved }()
+	listeners.list = nil
+	listeners.add(ListenerInfo{Mode: "alias", Addr: "127.0.1.1:80", Target: "core:80"})
+	listeners.add(ListenerInfo{Mode: "http", Addr: "127.0.0.1:8080"})
+
+	status := &ipnstate.Status{
+		TailscaleIPs: []netip.Addr{netip.MustParseAddr("100.64.0.1")},
+		Self:         &ipnstate.PeerStatus{DNSName: "my-proxy.sidecar.test."},
+	}
+	m := newManifest("http", "my-proxy", "/var/lib/sidecar", "9090", status)
+
+	out := captureStdout(t, func() { signalReady(m, "http://127.0.0.1:8080") })
+
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	if len(lines) != 2 || lines[1] != SignalReady+" http://127.0.0.1:8080" {
+		t.Fatalf("Expected manifest then READY, got %q", lines)
+	}
+	payload, ok := strings.CutPrefix(lines[0], SignalManifest+" ")
+	if !ok {
+		t.Fatalf("Expected a manifest line, got %q", lines[0])
+	}
+	var got Manifest
+	if err := json.Unmarshal([]byte(payload), &got); err != nil {
+		t.Fatalf("Manifest is not valid JSON: %v", err)
+	}
+	if got.PID != os.Getpid() || got.ProxyURL != "http://127.0.0.1:8080" || got.Hostname != "my-proxy" ||
+		got.DNSName != "my-proxy.sidecar.test." || got.StateDir != "/var/lib/sidecar" {
+		t.Errorf("Unexpected manifest %+v", got)
+	}
+	if got.StatusURL != "http://127.0.0.1:9090/api/v1/status" {
+		t.Errorf("Expected the versioned status URL, got %q", got.StatusURL)
+	}
+	if len(got.TailscaleIPs) != 1 || got.TailscaleIPs[0] != "100.64.0.1" {
+		t.Errorf("Expected tailscale IPs [100.64.0.1], got %v", got.TailscaleIPs)
+	}
+	if len(got.Listeners) != 2 || got.Listeners[0].Target != "core:80" {
+		t.Errorf("Expected both listeners, got %+v", got.Listeners)
+	}
+}
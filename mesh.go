@@ -0,0 +1,323 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"tailscale.com/tsnet"
+)
+
+// --- MESH REGISTRY ---
+
+// meshPort is the well-known tailnet port sidecars publish their services on
+const meshPort = "9902"
+
+const (
+	meshPollInterval = 30 * time.Second
+	meshEntryTTL     = 3 * meshPollInterval
+)
+
+// ServiceAnnouncement is a service this sidecar's node offers to the mesh
+type ServiceAnnouncement struct {
+	Name     string `json:"name"`
+	Port     int    `json:"port"`
+	Protocol string `json:"protocol,omitempty"` // informational, e.g. "http"
+}
+
+// meshAnnouncement is what GET /mesh/v1/services returns on the tailnet
+type meshAnnouncement struct {
+	Hostname string                `json:"hostname"`
+	Services []ServiceAnnouncement `json:"services"`
+}
+
+// supportedModes are the -mode values this build can run in
+var supportedModes = []string{"http", "socks5", "transparent", "sni", "echo", "node"}
+
+// meshHello is the handshake GET /mesh/v1/hello returns: who a sidecar is
+// and what it can do, so a deployment can be inspected from any node
+type meshHello struct {
+	meshAnnouncement
+	Version        string   `json:"version"`
+	Mode           string   `json:"mode"`
+	SupportedModes []string `json:"supported_modes"`
+	Features       []string `json:"features"` // optional features turned on, e.g. "speedtest"
+}
+
+// SidecarInfo is one peer sidecar in /status
+type SidecarInfo struct {
+	Hostname       string                `json:"hostname"`
+	IP             string                `json:"ip"`
+	Version        string                `json:"version"` // empty for sidecars without the handshake
+	Mode           string                `json:"mode"`
+	SupportedModes []string              `json:"supported_modes"`
+	Features       []string              `json:"features"`
+	Services       []ServiceAnnouncement `json:"services"`
+	LastSeen       string                `json:"last_seen"`
+}
+
+// CatalogEntry is one service in the aggregated /services catalog
+type CatalogEntry struct {
+	Name     string `json:"name"`
+	Host     string `json:"host"`
+	Address  string `json:"address"` // host:port to dial through the proxy
+	Protocol string `json:"protocol,omitempty"`
+	Local    bool   `json:"local"`
+	LastSeen string `json:"last_seen"`
+}
+
+type meshPeer struct {
+	hello meshHello // only the announcement for sidecars without the handshake
+	seen  time.Time
+}
+
+// MeshRegistry publishes this sidecar's services and collects those of the
+// other sidecars by polling their well-known endpoint.
+type MeshRegistry struct {
+	mu       sync.Mutex
+	self     meshAnnouncement
+	mode     string
+	features []string
+	peers    map[string]*meshPeer // keyed by Tailscale IP
+}
+
+func newMeshRegistry(hostname string, services []ServiceAnnouncement) *MeshRegistry {
+	if services == nil {
+		services = []ServiceAnnouncement{}
+	}
+	return &MeshRegistry{
+		self:     meshAnnouncement{Hostname: hostname, Services: services},
+		features: []string{},
+		peers:    map[string]*meshPeer{},
+	}
+}
+
+// describe sets the mode and features this sidecar reports in its handshake
+func (m *MeshRegistry) describe(mode string, features []string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.mode, m.features = mode, features
+}
+
+// hello returns this sidecar's handshake
+func (m *MeshRegistry) hello() meshHello {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return meshHello{
+		meshAnnouncement: m.self,
+		Version:          version,
+		Mode:             m.mode,
+		SupportedModes:   supportedModes,
+		Features:         m.features,
+	}
+}
+
+// handler serves this sidecar's announcement to other sidecars
+func (m *MeshRegistry) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /mesh/v1/services", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(m.announcement())
+	})
+	mux.HandleFunc("GET /mesh/v1/hello", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(m.hello())
+	})
+	return mux
+}
+
+// poll fetches the handshakes of the given peer IPs. Peers that are not
+// sidecars (or have the mesh disabled) simply fail and are skipped.
+func (m *MeshRegistry) poll(ctx context.Context, client *http.Client, ips []string) {
+	var wg sync.WaitGroup
+	for _, ip := range ips {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			base := "http://" + net.JoinHostPort(ip, meshPort)
+			var hello meshHello
+			status, err := meshGet(ctx, client, base+"/mesh/v1/hello", &hello)
+			if status == http.StatusNotFound {
+				// Sidecars from before the handshake only announce services
+				status, err = meshGet(ctx, client, base+"/mesh/v1/services", &hello.meshAnnouncement)
+			}
+			if err != nil || status != http.StatusOK {
+				return
+			}
+			m.mu.Lock()
+			m.peers[ip] = &meshPeer{hello: hello, seen: time.Now()}
+			m.mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	m.mu.Lock()
+	for ip, p := range m.peers {
+		if time.Since(p.seen) > meshEntryTTL {
+			delete(m.peers, ip)
+		}
+	}
+	m.mu.Unlock()
+}
+
+// meshGet fetches url into v and returns the HTTP status
+func meshGet(ctx context.Context, client *http.Client, url string, v any) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return resp.StatusCode, nil
+	}
+	return resp.StatusCode, json.NewDecoder(resp.Body).Decode(v)
+}
+
+// sidecars lists the peer sidecars found by polling, sorted by hostname
+func (m *MeshRegistry) sidecars() []SidecarInfo {
+	m.mu.Lock()
+	infos := make([]SidecarInfo, 0, len(m.peers))
+	for ip, p := range m.peers {
+		infos = append(infos, SidecarInfo{
+			Hostname:       p.hello.Hostname,
+			IP:             ip,
+			Version:        p.hello.Version,
+			Mode:           p.hello.Mode,
+			SupportedModes: p.hello.SupportedModes,
+			Features:       p.hello.Features,
+			Services:       p.hello.Services,
+			LastSeen:       p.seen.Format(time.RFC3339),
+		})
+	}
+	m.mu.Unlock()
+
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Hostname < infos[j].Hostname })
+	return infos
+}
+
+// run polls all online peers until ctx is done
+func (m *MeshRegistry) run(ctx context.Context, s *tsnet.Server) {
+	client := &http.Client{
+		Transport: &http.Transport{DialContext: s.Dial},
+		Timeout:   5 * time.Second,
+	}
+	for {
+		if lc, err := s.LocalClient(); err == nil {
+			if status, err := lc.Status(ctx); err == nil {
+				var ips []string
+				for _, peer := range status.Peer {
+					if peer.Online && len(peer.TailscaleIPs) > 0 {
+						ips = append(ips, peer.TailscaleIPs[0].String())
+					}
+				}
+				m.poll(ctx, client, ips)
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(meshPollInterval):
+		}
+	}
+}
+
+// announcement returns what this sidecar currently publishes
+func (m *MeshRegistry) announcement() meshAnnouncement {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.self
+}
+
+// rename publishes the services under a new hostname after the node was
+// renamed at runtime
+func (m *MeshRegistry) rename(hostname string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.self.Hostname = hostname
+}
+
+// catalog lists local and discovered services, sorted by name and host
+func (m *MeshRegistry) catalog() []CatalogEntry {
+	now := time.Now().Format(time.RFC3339)
+	entries := []CatalogEntry{}
+	self := m.announcement()
+	for _, svc := range self.Services {
+		entries = append(entries, CatalogEntry{
+			Name:     svc.Name,
+			Host:     self.Hostname,
+			Address:  net.JoinHostPort(self.Hostname, strconv.Itoa(svc.Port)),
+			Protocol: svc.Protocol,
+			Local:    true,
+			LastSeen: now,
+		})
+	}
+
+	m.mu.Lock()
+	for _, p := range m.peers {
+		for _, svc := range p.hello.Services {
+			entries = append(entries, CatalogEntry{
+				Name:     svc.Name,
+				Host:     p.hello.Hostname,
+				Address:  net.JoinHostPort(p.hello.Hostname, strconv.Itoa(svc.Port)),
+				Protocol: svc.Protocol,
+				LastSeen: p.seen.Format(time.RFC3339),
+			})
+		}
+	}
+	m.mu.Unlock()
+
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Name != entries[j].Name {
+			return entries[i].Name < entries[j].Name
+		}
+		return entries[i].Host < entries[j].Host
+	})
+	return entries
+}
+
+// handleServices serves the aggregated catalog on the status API
+func (m *MeshRegistry) handleServices(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(m.catalog())
+}
+
+// dialAnnounced connects to an announced port on this host's loopback
+// interface, where the services of a sidecar's node run. Tunnels from other
+// sidecars may reach nothing else.
+func dialAnnounced(ctx context.Context, ports []int, port string) (net.Conn, error) {
+	n, err := strconv.Atoi(port)
+	if err != nil || !slices.Contains(ports, n) {
+		return nil, fmt.Errorf("port %s is not announced", port)
+	}
+	var d net.Dialer
+	return d.DialContext(ctx, "tcp", net.JoinHostPort("127.0.0.1", port))
+}
+
+// validateAnnouncements checks the announce section of the config
+func validateAnnouncements(services []ServiceAnnouncement) error {
+	seen := map[string]bool{}
+	for i, svc := range services {
+		if svc.Name == "" {
+			return fmt.Errorf("announce[%d]: name is required", i)
+		}
+		if svc.Port < 1 || svc.Port > 65535 {
+			return fmt.Errorf("announce[%d]: port must be in 1-65535, got %d", i, svc.Port)
+		}
+		if seen[svc.Name] {
+			return fmt.Errorf("announce[%d]: duplicate service %q", i, svc.Name)
+		}
+		seen[svc.Name] = true
+	}
+	return nil
+}
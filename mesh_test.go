@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestMeshRegistryAggregatesPeers(t *testing.T) {
+	remote := newMeshRegistry("data-node", []ServiceAnnouncement{{Name: "minio", Port: 9000, Protocol: "http"}})
+	server := httptest.NewServer(remote.handler())
+	defer server.Close()
+	notSidecar := httptest.NewServer(http.NotFoundHandler())
+	defer notSidecar.Close()
+
+	// Every peer IP dials the test server listening for it
+	targets := map[string]string{
+		"100.64.0.10": server.Listener.Addr().String(),
+		"100.64.0.11": notSidecar.Listener.Addr().String(),
+	}
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			host, _, _ := net.SplitHostPort(addr)
+			return net.Dial(network, targets[host])
+		},
+	}}
+
+	local := newMeshRegistry("core", []ServiceAnnouncement{{Name: "graphql", Port: 8080}})
+	local.poll(context.Background(), client, []string{"100.64.0.10", "100.64.0.11"})
+
+	rec := httptest.NewRecorder()
+	local.handleServices(rec, httptest.NewRequest("GET", "/services", nil))
+	var catalog []CatalogEntry
+	if err := json.NewDecoder(rec.Body).Decode(&catalog); err != nil {
+		t.Fatalf("Failed to decode catalog: %v", err)
+	}
+	if len(catalog) != 2 {
+		t.Fatalf("Expected 2 services, got %+v", catalog)
+	}
+	if catalog[0].Name != "graphql" || !catalog[0].Local || catalog[0].Address != "core:8080" {
+		t.Errorf("Unexpected local entry %+v", catalog[0])
+	}
+	if catalog[1].Name != "minio" || catalog[1].Local || catalog[1].Address != "data-node:9000" || catalog[1].Protocol != "http" {
+		t.Errorf("Unexpected remote entry %+v", catalog[1])
+	}
+}
+
+func TestValidateAnnouncements(t *testing.T) {
+	bad := [][]ServiceAnnouncement{
+		{{Port: 80}},
+		{{Name: "web", Port: 0}},
+		{{Name: "web", Port: 80}, {Name: "web", Port: 81}},
+	}
+	for _, services := range bad {
+		if err := validateAnnouncements(services); err == nil {
+			t.Errorf("Expected error for %+v", services)
+		}
+	}
+}
+
+func TestMeshHandshake(t *testing.T) {
+	current := newMeshRegistry("gpu-node", []ServiceAnnouncement{{Name: "inference", Port: 8000}})
+	current.describe("socks5", []string{"speedtest"})
+	currentSrv := httptest.NewServer(current.handler())
+	defer currentSrv.Close()
+
+	// A sidecar from before the handshake only serves /mesh/v1/services
+	legacy := newMeshRegistry("old-node", []ServiceAnnouncement{{Name: "minio", Port: 9000}})
+	legacyMux := http.NewServeMux()
+	legacyMux.HandleFunc("GET /mesh/v1/services", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(legacy.announcement())
+	})
+	legacySrv := httptest.NewServer(legacyMux)
+	defer legacySrv.Close()
+
+	targets := map[string]string{
+		"100.64.0.20": currentSrv.Listener.Addr().String(),
+		"100.64.0.21": legacySrv.Listener.Addr().String(),
+	}
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			host, _, _ := net.SplitHostPort(addr)
+			return net.Dial(network, targets[host])
+		},
+	}}
+
+	local := newMeshRegistry("core", nil)
+	local.poll(context.Background(), client, []string{"100.64.0.20", "100.64.0.21"})
+
+	sidecars := local.sidecars()
+	if len(sidecars) != 2 {
+		t.Fatalf("Expected 2 sidecars, got %+v", sidecars)
+	}
+	gpu, old := sidecars[0], sidecars[1]
+	if gpu.Hostname != "gpu-node" || gpu.IP != "100.64.0.20" || gpu.Version != version || gpu.Mode != "socks5" ||
+		len(gpu.SupportedModes) != len(supportedModes) || len(gpu.Features) != 1 || len(gpu.Services) != 1 {
+		t.Errorf("Unexpected handshake %+v", gpu)
+	}
+	if old.Hostname != "old-node" || old.Version != "" || len(old.Services) != 1 {
+		t.Errorf("Unexpected legacy sidecar %+v", old)
+	}
+}
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// --- PUSHED METRICS ---
+
+// metricsPacketSize keeps UDP datagrams under a typical MTU
+const metricsPacketSize = 1432
+
+// metricsTimeout bounds one push
+const metricsTimeout = 5 * time.Second
+
+// metricsTarget is where -metrics-push sends: StatsD over UDP, or InfluxDB
+// line protocol over UDP or HTTP
+type metricsTarget struct {
+	format string // statsd or influx
+	addr   string // host:port for UDP
+	url    string // write endpoint for HTTP
+	token  string // sent as "Authorization: Token ..." to InfluxDB
+	tags   [][2]string
+}
+
+// parseMetricsPush reads -metrics-push, -metrics-tags and -metrics-token.
+// An empty spec means no pushing.
+func parseMetricsPush(spec, tags, token string) (*metricsTarget, error) {
+	if spec == "" {
+		return nil, nil
+	}
+	u, err := url.Parse(spec)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("expected statsd://host:port, influx://host:port or influx+http(s)://host:port/write, got %q", spec)
+	}
+	t := &metricsTarget{}
+	switch u.Scheme {
+	case "statsd", "influx":
+		if _, _, err := net.SplitHostPort(u.Host); err != nil {
+			return nil, fmt.Errorf("%s needs host:port, got %q", u.Scheme, u.Host)
+		}
+		t.format, t.addr = u.Scheme, u.Host
+	case "influx+http", "influx+https":
+		t.format = "influx"
+		u.Scheme = strings.TrimPrefix(u.Scheme, "influx+")
+		t.url = u.String()
+	default:
+		return nil, fmt.Errorf("unknown scheme %q (use statsd, influx, influx+http or influx+https)", u.Scheme)
+	}
+	if token != "" {
+		if t.url == "" {
+			return nil, fmt.Errorf("-metrics-token needs an influx+http(s) target")
+		}
+		resolved, err := resolveRef(token)
+		if err != nil {
+			return nil, fmt.Errorf("-metrics-token: %w", err)
+		}
+		secrets.addLiteral(resolved)
+		t.token = resolved
+	}
+	for pair := range strings.SplitSeq(tags, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		k, v, ok := strings.Cut(pair, "=")
+		if !ok || k == "" || v == "" {
+			return nil, fmt.Errorf("-metrics-tags: expected key=value, got %q", pair)
+		}
+		t.tags = append(t.tags, [2]string{k, v})
+	}
+	return t, nil
+}
+
+// String names the target without the token or query
+func (t *metricsTarget) String() string {
+	if t.url != "" {
+		return redactURL(t.url)
+	}
+	return t.format + "://" + t.addr
+}
+
+// metricsPusher sends the connection, traffic and latency figures every
+// Interval, for monitoring that can't scrape /metrics on a workstation
+type metricsPusher struct {
+	Interval time.Duration
+	target   *metricsTarget
+	active   func() int // open connections
+	counter  *trafficCounter
+	stats    *latencyStats
+	client   *http.Client
+
+	lastRx, lastTx int64
+	lastDials      map[string][2]int64 // destination -> dial count and errors at the last push
+	failing        bool
+}
+
+// newMetricsPusher tags everything with host=hostname unless -metrics-tags
+// names a host already
+func newMetricsPusher(target *metricsTarget, interval time.Duration, hostname string) *metricsPusher {
+	if !slices.ContainsFunc(target.tags, func(t [2]string) bool { return t[0] == "host" }) {
+		target.tags = append([][2]string{{"host", hostname}}, target.tags...)
+	}
+	return &metricsPusher{
+		Interval:  interval,
+		target:    target,
+		active:    connections.count,
+		counter:   traffic,
+		stats:     latencies,
+		client:    &http.Client{Timeout: metricsTimeout},
+		lastDials: map[string][2]int64{},
+	}
+}
+
+// metricPoint is one value. Counters are pushed to StatsD as the change
+// since the last push and to InfluxDB as the running total.
+type metricPoint struct {
+	name    string
+	tags    [][2]string
+	value   float64
+	total   int64 // counters: running total
+	counter bool
+}
+
+// collect takes a snapshot and advances the counters' baselines
+func (p *metricsPusher) collect() []metricPoint {
+	rx, tx := p.counter.rx.Load(), p.counter.tx.Load()
+	points := []metricPoint{
+		{name: "connections", value: float64(p.active())},
+		{name: "rx_bytes", value: float64(rx - p.lastRx), total: rx, counter: true},
+		{name: "tx_bytes", value: float64(tx - p.lastTx), total: tx, counter: true},
+	}
+	p.lastRx, p.lastTx = rx, tx
+
+	for _, d := range p.stats.list() {
+		tags := [][2]string{{"destination", d.Destination}}
+		last := p.lastDials[d.Destination]
+		points = append(points,
+			metricPoint{name: "dials", tags: tags, value: float64(d.Dial.Count - last[0]), total: d.Dial.Count, counter: true},
+			metricPoint{name: "dial_errors", tags: tags, value: float64(d.Dial.Errors - last[1]), total: d.Dial.Errors, counter: true},
+		)
+		for _, q := range []struct {
+			name string
+			s    LatencySummary
+		}{{"dial_ms", d.Dial}, {"ttfb_ms", d.TTFB}} {
+			if q.s.Count == 0 {
+				continue
+			}
+			points = append(points,
+				metricPoint{name: q.name + ".p50", tags: tags, value: q.s.P50ms},
+				metricPoint{name: q.name + ".p95", tags: tags, value: q.s.P95ms},
+				metricPoint{name: q.name + ".p99", tags: tags, value: q.s.P99ms},
+			)
+		}
+		p.lastDials[d.Destination] = [2]int64{d.Dial.Count, d.Dial.Errors}
+	}
+	return points
+}
+
+// encodeStatsD renders points as StatsD lines with DogStatsD-style tags,
+// which Telegraf and the Datadog agent understand
+func encodeStatsD(points []metricPoint, common [][2]string) []string {
+	lines := make([]string, 0, len(points))
+	for _, pt := range points {
+		typ := "g"
+		if pt.counter {
+			typ = "c"
+		}
+		line := fmt.Sprintf("sidecar.%s:%s|%s", pt.name, strconv.FormatFloat(pt.value, 'f', -1, 64), typ)
+		if tags := slices.Concat(common, pt.tags); len(tags) > 0 {
+			parts := make([]string, len(tags))
+			for i, t := range tags {
+				parts[i] = t[0] + ":" + t[1]
+			}
+			line += "|#" + strings.Join(parts, ",")
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+// encodeInflux renders points as InfluxDB line protocol, one line per
+// measurement and tag set: sidecar for the totals, sidecar_destination
+// per destination
+func encodeInflux(points []metricPoint, common [][2]string, now time.Time) []string {
+	type series struct {
+		key    string
+		fields []string
+	}
+	var all []*series
+	byKey := map[string]*series{}
+	for _, pt := range points {
+		measurement := "sidecar"
+		if len(pt.tags) > 0 {
+			measurement = "sidecar_destination"
+		}
+		var key strings.Builder
+		key.WriteString(measurement)
+		for _, t := range slices.Concat(common, pt.tags) {
+			key.WriteString("," + influxEscape(t[0]) + "=" + influxEscape(t[1]))
+		}
+		s := byKey[key.String()]
+		if s == nil {
+			s = &series{key: key.String()}
+			byKey[s.key] = s
+			all = append(all, s)
+		}
+		field := strings.ReplaceAll(pt.name, ".", "_")
+		if pt.counter {
+			s.fields = append(s.fields, fmt.Sprintf("%s=%di", field, pt.total))
+		} else {
+			s.fields = append(s.fields, field+"="+strconv.FormatFloat(pt.value, 'f', -1, 64))
+		}
+	}
+	lines := make([]string, len(all))
+	for i, s := range all {
+		lines[i] = fmt.Sprintf("%s %s %d", s.key, strings.Join(s.fields, ","), now.UnixNano())
+	}
+	return lines
+}
+
+// influxEscape escapes commas, spaces and equals signs in keys and tags
+func influxEscape(s string) string {
+	return strings.NewReplacer(",", `\,`, " ", `\ `, "=", `\=`).Replace(s)
+}
+
+// push sends one snapshot
+func (p *metricsPusher) push(ctx context.Context) error {
+	points := p.collect()
+	var lines []string
+	if p.target.format == "statsd" {
+		lines = encodeStatsD(points, p.target.tags)
+	} else {
+		lines = encodeInflux(points, p.target.tags, time.Now())
+	}
+
+	if p.target.url != "" {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.target.url, strings.NewReader(strings.Join(lines, "\n")+"\n"))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+		if p.target.token != "" {
+			req.Header.Set("Authorization", "Token "+p.target.token)
+		}
+		resp, err := p.client.Do(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			return fmt.Errorf("%s answered %s", p.target, resp.Status)
+		}
+		return nil
+	}
+
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "udp", p.target.addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	var packet bytes.Buffer
+	flush := func() error {
+		if packet.Len() == 0 {
+			return nil
+		}
+		_, err := conn.Write(packet.Bytes())
+		packet.Reset()
+		return err
+	}
+	for _, line := range lines {
+		if packet.Len() > 0 && packet.Len()+1+len(line) > metricsPacketSize {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+		if packet.Len() > 0 {
+			packet.WriteByte('\n')
+		}
+		packet.WriteString(line)
+	}
+	return flush()
+}
+
+// run pushes every Interval until ctx is done. Failures are logged once
+// until a push succeeds again.
+func (p *metricsPusher) run(ctx context.Context) {
+	ticker := time.NewTicker(p.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			pushCtx, cancel := context.WithTimeout(ctx, metricsTimeout)
+			err := p.push(pushCtx)
+			cancel()
+			switch {
+			case err != nil && !p.failing:
+				p.failing = true
+				fmt.Fprintf(console, "[METRICS] Pushing to %s failed: %v\n", p.target, err)
+			case err == nil && p.failing:
+				p.failing = false
+				fmt.Fprintf(console, "[METRICS] Pushing to %s again\n", p.target)
+			}
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseMetricsPush(t *testing.T) {
+	if target, err := parseMetricsPush("", "", ""); target != nil || err != nil {
+		t.Errorf("Expected no target for an empty spec, got %v, %v", target, err)
+	}
+	target, err := parseMetricsPush("influx+https://influx.lab:8086/api/v2/write?org=lab&bucket=sidecar", "lab=imaging, site=b2", "tok")
+	if err != nil {
+		t.Fatalf("parseMetricsPush failed: %v", err)
+	}
+	if target.format != "influx" || target.url != "https://influx.lab:8086/api/v2/write?org=lab&bucket=sidecar" || len(target.tags) != 2 {
+		t.Errorf("Unexpected target %+v", target)
+	}
+	if target.String() != "https://influx.lab:8086/api/v2/write" {
+		t.Errorf("Expected the query hidden, got %s", target)
+	}
+	for _, bad := range [][3]string{
+		{"graphite://host:2003", "", ""},
+		{"statsd://host", "", ""},
+		{"statsd://host:8125", "lab", ""},
+		{"statsd://host:8125", "", "tok"},
+	} {
+		if _, err := parseMetricsPush(bad[0], bad[1], bad[2]); err == nil {
+			t.Errorf("Expected %q to be rejected", bad)
+		}
+	}
+}
+
+// pusherWithStats returns a pusher over fresh stats with one destination
+func pusherWithStats(target *metricsTarget) *metricsPusher {
+	p := newMetricsPusher(target, time.Second, "lab-pc")
+	p.active = func() int { return 3 }
+	p.counter = &trafficCounter{}
+	p.counter.rx.Add(1000)
+	p.stats = newLatencyStats()
+	p.stats.observeDial("data-node:9000", 4*time.Millisecond, "", nil)
+	p.stats.observeDial("data-node:9000", 0, "", io.EOF)
+	return p
+}
+
+func TestMetricsPushStatsD(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket failed: %v", err)
+	}
+	defer pc.Close()
+
+	p := pusherWithStats(&metricsTarget{format: "statsd", addr: pc.LocalAddr().String(), tags: [][2]string{{"lab", "imaging"}}})
+	if err := p.push(context.Background()); err != nil {
+		t.Fatalf("push failed: %v", err)
+	}
+	buf := make([]byte, 64<<10)
+	pc.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := pc.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("No packet: %v", err)
+	}
+	got := string(buf[:n])
+	for _, want := range []string{
+		"sidecar.connections:3|g|#host:lab-pc,lab:imaging",
+		"sidecar.rx_bytes:1000|c|#host:lab-pc,lab:imaging",
+		"sidecar.dial_errors:1|c|#host:lab-pc,lab:imaging,destination:data-node:9000",
+		"sidecar.dial_ms.p95:4|g|#host:lab-pc,lab:imaging,destination:data-node:9000",
+	} {
+		if !strings.Contains(got, want+"\n") && !strings.HasSuffix(got, want) {
+			t.Errorf("Expected %q in\n%s", want, got)
+		}
+	}
+
+	// Counters go out as the change since the last push
+	lines := encodeStatsD(p.collect(), nil)
+	if lines[1] != "sidecar.rx_bytes:0|c" {
+		t.Errorf("Expected no new bytes, got %q", lines[1])
+	}
+}
+
+func TestMetricsPushInflux(t *testing.T) {
+	bodies := make(chan string, 1)
+	var auth string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth = r.Header.Get("Authorization")
+		body, _ := io.ReadAll(r.Body)
+		bodies <- string(body)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	p := pusherWithStats(&metricsTarget{format: "influx", url: srv.URL + "/api/v2/write", token: "tok", tags: [][2]string{{"site", "b 2"}}})
+	if err := p.push(context.Background()); err != nil {
+		t.Fatalf("push failed: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(<-bodies), "\n")
+	if auth != "Token tok" || len(lines) != 2 {
+		t.Fatalf("Expected two lines with the token, got %q: %q", auth, lines)
+	}
+	if !strings.HasPrefix(lines[0], `sidecar,host=lab-pc,site=b\ 2 connections=3,rx_bytes=1000i,tx_bytes=0i `) {
+		t.Errorf("Unexpected totals line %q", lines[0])
+	}
+	if !strings.HasPrefix(lines[1], `sidecar_destination,host=lab-pc,site=b\ 2,destination=data-node:9000 dials=1i,dial_errors=1i,dial_ms_p50=4,dial_ms_p95=4,dial_ms_p99=4 `) {
+		t.Errorf("Unexpected destination line %q", lines[1])
+	}
+
+	srv.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+	})
+	if err := p.push(context.Background()); err == nil || !strings.Contains(err.Error(), "401") {
+		t.Errorf("Expected a 401 error, got %v", err)
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// --- HEADSCALE KEY MINTING ---
+
+// preAuthKeyRequest describes the key `sidecar mint-key` asks Headscale for
+type preAuthKeyRequest struct {
+	User       string
+	Reusable   bool
+	Ephemeral  bool
+	Expiration time.Duration
+	Tags       []string
+}
+
+// headscaleAPI is a minimal client for the Headscale REST API (/api/v1)
+type headscaleAPI struct {
+	Server string
+	APIKey string
+	Client *http.Client
+}
+
+func (h *headscaleAPI) do(ctx context.Context, method, path string, in, out any) error {
+	var body io.Reader
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(b)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, strings.TrimSuffix(h.Server, "/")+path, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+h.APIKey)
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := h.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		if resp.StatusCode == http.StatusUnauthorized {
+			return fmt.Errorf("%s %s: %s (check the API key, create one with 'headscale apikeys create')", method, path, resp.Status)
+		}
+		return fmt.Errorf("%s %s: %s: %s", method, path, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// userID resolves a user name to its numeric ID; IDs are returned as is.
+func (h *headscaleAPI) userID(ctx context.Context, user string) (string, error) {
+	if _, err := strconv.ParseUint(user, 10, 64); err == nil {
+		return user, nil
+	}
+	var list struct {
+		Users []struct {
+			ID   string `json:"id"`
+			Name string `json:"name"`
+		} `json:"users"`
+	}
+	if err := h.do(ctx, "GET", "/api/v1/user", nil, &list); err != nil {
+		return "", err
+	}
+	for _, u := range list.Users {
+		if u.Name == user {
+			return u.ID, nil
+		}
+	}
+	return "", fmt.Errorf("no Headscale user named %q", user)
+}
+
+// mintPreAuthKey creates a pre-auth key and returns its secret.
+func (h *headscaleAPI) mintPreAuthKey(ctx context.Context, r preAuthKeyRequest) (string, error) {
+	id, err := h.userID(ctx, r.User)
+	if err != nil {
+		return "", err
+	}
+	in := map[string]any{
+		"user":       id,
+		"reusable":   r.Reusable,
+		"ephemeral":  r.Ephemeral,
+		"expiration": time.Now().Add(r.Expiration).UTC().Format(time.RFC3339),
+	}
+	if len(r.Tags) > 0 {
+		in["aclTags"] = r.Tags
+	}
+	var out struct {
+		PreAuthKey struct {
+			Key string `json:"key"`
+		} `json:"preAuthKey"`
+	}
+	if err := h.do(ctx, "POST", "/api/v1/preauthkey", in, &out); err != nil {
+		return "", err
+	}
+	if out.PreAuthKey.Key == "" {
+		return "", fmt.Errorf("Headscale returned no key")
+	}
+	return out.PreAuthKey.Key, nil
+}
+
+// runMintKey implements `sidecar mint-key`, printing only the key to stdout
+// so it can be captured by provisioning scripts.
+func runMintKey(args []string, stdout io.Writer) error {
+	fs := flag.NewFlagSet("mint-key", flag.ContinueOnError)
+	var (
+		server  = fs.String("server", "", "Headscale server URL (required)")
+		apiKey  = fs.String("api-key", os.Getenv("HEADSCALE_API_KEY"), "Headscale API key, or 'keyring:<profile>' (defaults to $HEADSCALE_API_KEY)")
+		user    = fs.String("user", "", "User (namespace) name or ID the key belongs to (required)")
+		reuse   = fs.Bool("reusable", false, "Allow the key to register more than one node")
+		ephem   = fs.Bool("ephemeral", false, "Register nodes as ephemeral")
+		expires = fs.Duration("expiration", time.Hour, "How long the key stays valid")
+		tags    = fs.String("tags", "", "Comma-separated ACL tags for nodes registered with the key")
+	)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *server == "" || *user == "" || *apiKey == "" {
+		return fmt.Errorf("usage: mint-key -server URL -user NAME [-api-key KEY] [-reusable] [-ephemeral] [-expiration 1h] [-tags tag:a,tag:b]")
+	}
+	key, err := resolveAuthKey(*apiKey)
+	if err != nil {
+		return err
+	}
+
+	req := preAuthKeyRequest{User: *user, Reusable: *reuse, Ephemeral: *ephem, Expiration: *expires}
+	if *tags != "" {
+		req.Tags = strings.Split(*tags, ",")
+	}
+	h := &headscaleAPI{Server: *server, APIKey: key, Client: &http.Client{Timeout: 30 * time.Second}}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	secret, err := h.mintPreAuthKey(ctx, req)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(stdout, secret)
+	return nil
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMintKeyAgainstHeadscale(t *testing.T) {
+	var created map[string]any
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/v1/user", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"users":[{"id":"1","name":"default"},{"id":"7","name":"arkitekt"}]}`))
+	})
+	mux.HandleFunc("POST /api/v1/preauthkey", func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&created)
+		w.Write([]byte(`{"preAuthKey":{"user":"7","id":"3","key":"hskey-auth-minted"}}`))
+	})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer api-secret" {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	var out bytes.Buffer
+	err := runMintKey([]string{"-server", server.URL, "-api-key", "api-secret", "-user", "arkitekt", "-reusable", "-tags", "tag:sidecar"}, &out)
+	if err != nil {
+		t.Fatalf("mint-key failed: %v", err)
+	}
+	if strings.TrimSpace(out.String()) != "hskey-auth-minted" {
+		t.Errorf("Expected only the key on stdout, got %q", out.String())
+	}
+	if created["user"] != "7" || created["reusable"] != true || created["ephemeral"] != false {
+		t.Errorf("Unexpected request %v", created)
+	}
+	if tags, _ := created["aclTags"].([]any); len(tags) != 1 || tags[0] != "tag:sidecar" {
+		t.Errorf("Expected aclTags [tag:sidecar], got %v", created["aclTags"])
+	}
+
+	err = runMintKey([]string{"-server", server.URL, "-api-key", "wrong", "-user", "7"}, &out)
+	if err == nil || !strings.Contains(err.Error(), "API key") {
+		t.Errorf("Expected API key hint, got %v", err)
+	}
+	err = runMintKey([]string{"-server", server.URL, "-api-key", "api-secret", "-user", "nobody"}, &out)
+	if err == nil || !strings.Contains(err.Error(), "nobody") {
+		t.Errorf("Expected unknown user error, got %v", err)
+	}
+}
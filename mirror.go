@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// --- REQUEST MIRRORING ---
+
+// maxMirrorBodySize is the largest request body we buffer for a mirror copy.
+// Bigger (or streaming) uploads are proxied normally but not mirrored.
+const maxMirrorBodySize = 1 << 20
+
+// mirrorTimeout bounds how long a fire-and-forget mirror request may run
+const mirrorTimeout = 30 * time.Second
+
+// MirrorRule copies a percentage of plain HTTP requests for Host to Target.
+// Mirrored responses are discarded; the client only ever sees the primary.
+type MirrorRule struct {
+	Host    string  `json:"host"`    // requested host, with or without port
+	Target  string  `json:"target"`  // tailnet host[:port] that receives the copies
+	Percent float64 `json:"percent"` // share of matching requests to mirror (0-100]
+}
+
+// matchHost reports whether a requested host:port matches a rule host.
+// A rule without a port matches any port on that host.
+func matchHost(ruleHost, requested string) bool {
+	if strings.EqualFold(ruleHost, requested) {
+		return true
+	}
+	host, _, err := net.SplitHostPort(requested)
+	return err == nil && strings.EqualFold(ruleHost, host)
+}
+
+// mirrorTarget picks the mirror destination for r, if any rule matches and
+// the request falls inside its sampled percentage.
+func (p *TailscaleProxy) mirrorTarget(r *http.Request) (string, bool) {
+	for _, m := range p.Mirrors {
+		if !matchHost(m.Host, r.URL.Host) {
+			continue
+		}
+		if rand.Float64()*100 >= m.Percent {
+			return "", false
+		}
+		target := m.Target
+		if _, _, err := net.SplitHostPort(target); err != nil {
+			// Keep the original port when the rule only names a host
+			if _, port, err := net.SplitHostPort(r.URL.Host); err == nil {
+				target = net.JoinHostPort(target, port)
+			}
+		}
+		return target, true
+	}
+	return "", false
+}
+
+// mirror sends a copy of r to the matching mirror target in the background.
+// It must run before r is proxied, since it buffers (and replaces) r.Body.
+func (p *TailscaleProxy) mirror(r *http.Request) {
+	target, ok := p.mirrorTarget(r)
+	if !ok {
+		return
+	}
+
+	var body []byte
+	if r.Body != nil && r.Body != http.NoBody {
+		if r.ContentLength < 0 || r.ContentLength > maxMirrorBodySize {
+			return
+		}
+		b, err := io.ReadAll(r.Body)
+		r.Body.Close()
+		r.Body = io.NopCloser(bytes.NewReader(b))
+		if err != nil {
+			return
+		}
+		body = b
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), mirrorTimeout)
+	shadow := r.Clone(ctx)
+	shadow.URL.Host = target
+	shadow.Host = ""
+	shadow.RequestURI = ""
+	shadow.Header.Set("X-Sidecar-Mirror", "1")
+	shadow.Body = io.NopCloser(bytes.NewReader(body))
+	if body == nil {
+		shadow.Body = http.NoBody
+	}
+
+	go func() {
+		defer cancel()
+		resp, err := p.Transport.RoundTrip(shadow)
+		if err != nil {
+			logRedacted("[MIRROR] %s %s -> %s failed: %v\n", shadow.Method, r.URL, target, err)
+			return
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		logRedacted("[MIRROR] %s %s -> %s (%d)\n", shadow.Method, r.URL, target, resp.StatusCode)
+	}()
+}
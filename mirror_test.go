@@ -0,0 +1,97 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMatchHost(t *testing.T) {
+	tests := []struct {
+		rule, requested string
+		want            bool
+	}{
+		{"core", "core", true},
+		{"core", "core:8080", true},
+		{"core:8080", "core:8080", true},
+		{"core:8080", "core:9090", false},
+		{"CORE", "core:80", true},
+		{"core", "core-next:80", false},
+	}
+	for _, tc := range tests {
+		if got := matchHost(tc.rule, tc.requested); got != tc.want {
+			t.Errorf("matchHost(%q, %q) = %v, want %v", tc.rule, tc.requested, got, tc.want)
+		}
+	}
+}
+
+func TestMirrorRequest(t *testing.T) {
+	type seen struct {
+		host, body, mirrorHeader string
+	}
+	requests := make(chan seen, 2)
+
+	mockRT := &MockRoundTripper{
+		RoundTripFunc: func(req *http.Request) (*http.Response, error) {
+			body, _ := io.ReadAll(req.Body)
+			requests <- seen{req.URL.Host, string(body), req.Header.Get("X-Sidecar-Mirror")}
+			return &http.Response{
+				StatusCode: 200,
+				Body:       io.NopCloser(strings.NewReader("OK")),
+				Header:     make(http.Header),
+			}, nil
+		},
+	}
+
+	proxy := &TailscaleProxy{
+		Transport: mockRT,
+		Mirrors:   []MirrorRule{{Host: "core", Target: "core-next", Percent: 100}},
+	}
+
+	req := httptest.NewRequest("POST", "http://core:8080/graphql", strings.NewReader(`{"query":"{ me }"}`))
+	w := httptest.NewRecorder()
+	proxy.handleHTTP(w, req)
+
+	if w.Code != 200 {
+		t.Fatalf("Expected status 200, got %d", w.Code)
+	}
+
+	got := map[string]seen{}
+	for i := 0; i < 2; i++ {
+		select {
+		case s := <-requests:
+			got[s.host] = s
+		case <-time.After(2 * time.Second):
+			t.Fatalf("Timed out waiting for request %d", i+1)
+		}
+	}
+
+	primary, ok := got["core:8080"]
+	if !ok || primary.body != `{"query":"{ me }"}` || primary.mirrorHeader != "" {
+		t.Errorf("Unexpected primary request: %+v", primary)
+	}
+	shadow, ok := got["core-next:8080"]
+	if !ok || shadow.body != `{"query":"{ me }"}` || shadow.mirrorHeader != "1" {
+		t.Errorf("Unexpected mirrored request: %+v", shadow)
+	}
+}
+
+func TestMirrorSkipsUnmatchedHosts(t *testing.T) {
+	proxy := &TailscaleProxy{
+		Mirrors: []MirrorRule{{Host: "core", Target: "core-next", Percent: 100}},
+	}
+
+	req := httptest.NewRequest("GET", "http://minio:9000/bucket", nil)
+	if _, ok := proxy.mirrorTarget(req); ok {
+		t.Error("Expected no mirror target for unmatched host")
+	}
+
+	req = httptest.NewRequest("GET", "http://core:8080/", nil)
+	target, ok := proxy.mirrorTarget(req)
+	if !ok || target != "core-next:8080" {
+		t.Errorf("Expected mirror target core-next:8080, got %q (ok=%v)", target, ok)
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+// --- MQTT PUBLISHER ---
+
+// mqttClient publishes at QoS 0 over MQTT 3.1.1, which is all an event
+// sink needs. It isn't safe for concurrent use; the sink's goroutine owns it.
+type mqttClient struct {
+	Addr     string // host:port
+	ClientID string
+	Username string
+	Password string
+
+	dialer func(ctx context.Context, network, addr string) (net.Conn, error) // net.Dialer when nil
+	conn   net.Conn
+}
+
+const (
+	mqttConnect    = 1 << 4
+	mqttConnack    = 2 << 4
+	mqttPublish    = 3 << 4
+	mqttDisconnect = 14 << 4
+)
+
+// connect dials the broker and waits for its CONNACK
+func (c *mqttClient) connect(ctx context.Context) error {
+	dial := c.dialer
+	if dial == nil {
+		dial = (&net.Dialer{}).DialContext
+	}
+	conn, err := dial(ctx, "tcp", c.Addr)
+	if err != nil {
+		return err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	// Clean session, no keep-alive: we only publish, and reconnect on error
+	var flags byte = 0x02
+	payload := mqttString(c.ClientID)
+	if c.Username != "" {
+		flags |= 0x80
+		payload = append(payload, mqttString(c.Username)...)
+		if c.Password != "" {
+			flags |= 0x40
+			payload = append(payload, mqttString(c.Password)...)
+		}
+	}
+	body := append(mqttString("MQTT"), 4, flags, 0, 0)
+	body = append(body, payload...)
+	if _, err := conn.Write(mqttPacket(mqttConnect, body)); err != nil {
+		conn.Close()
+		return err
+	}
+
+	var ack [4]byte
+	if _, err := io.ReadFull(conn, ack[:]); err != nil {
+		conn.Close()
+		return fmt.Errorf("no CONNACK from %s: %w", c.Addr, err)
+	}
+	if ack[0] != mqttConnack || ack[1] != 2 {
+		conn.Close()
+		return fmt.Errorf("unexpected reply from %s", c.Addr)
+	}
+	if ack[3] != 0 {
+		conn.Close()
+		return fmt.Errorf("%s refused the connection (return code %d)", c.Addr, ack[3])
+	}
+	conn.SetDeadline(time.Time{})
+	c.conn = conn
+	return nil
+}
+
+// publish sends payload to topic, connecting first if needed. A failed
+// write drops the connection, so the next event reconnects.
+func (c *mqttClient) publish(ctx context.Context, topic string, payload []byte) error {
+	if c.conn == nil {
+		if err := c.connect(ctx); err != nil {
+			return err
+		}
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		c.conn.SetWriteDeadline(deadline)
+	}
+	body := append(mqttString(topic), payload...)
+	if _, err := c.conn.Write(mqttPacket(mqttPublish, body)); err != nil {
+		c.conn.Close()
+		c.conn = nil
+		return err
+	}
+	return nil
+}
+
+// close says goodbye to the broker
+func (c *mqttClient) close() {
+	if c.conn == nil {
+		return
+	}
+	c.conn.SetWriteDeadline(time.Now().Add(time.Second))
+	c.conn.Write([]byte{mqttDisconnect, 0})
+	c.conn.Close()
+	c.conn = nil
+}
+
+// mqttString is a length-prefixed UTF-8 string
+func mqttString(s string) []byte {
+	return append(binary.BigEndian.AppendUint16(nil, uint16(len(s))), s...)
+}
+
+// mqttPacket adds the fixed header: type and the remaining length as a
+// variable-length integer
+func mqttPacket(typ byte, body []byte) []byte {
+	pkt := []byte{typ}
+	n := len(body)
+	for {
+		b := byte(n % 128)
+		n /= 128
+		if n > 0 {
+			b |= 0x80
+		}
+		pkt = append(pkt, b)
+		if n == 0 {
+			break
+		}
+	}
+	return append(pkt, body...)
+}
+
+// newMQTTSink publishes every event as an EventMessage to topic
+func newMQTTSink(client *mqttClient, topic, hostname string) EventSink {
+	s := newAsyncSink("mqtt "+client.Addr, func(ctx context.Context, ev Event) error {
+		return client.publish(ctx, topic, eventMessage(ev, hostname))
+	})
+	return &mqttSink{asyncSink: s, client: client}
+}
+
+// mqttSink disconnects once the queue is drained
+type mqttSink struct {
+	*asyncSink
+	client *mqttClient
+}
+
+func (s *mqttSink) Close() {
+	s.asyncSink.Close()
+	select {
+	case <-s.asyncSink.done:
+		s.client.close()
+	default: // still sending; the client belongs to that goroutine
+	}
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+// --- MULTIPLEXED CHANNELS ---
+
+// muxPort is the well-known tailnet port sidecars accept multiplexed
+// channels on
+const muxPort = "9906"
+
+const (
+	// muxRetryAfter is how long a peer without a channel is dialed directly
+	// before asking again
+	muxRetryAfter = time.Minute
+	// muxPingAfter checks an idle channel, so a dead one is replaced
+	muxPingAfter = 30 * time.Second
+)
+
+// MuxStats is one peer in /stats/mux
+type MuxStats struct {
+	Peer        string `json:"peer"`
+	Connected   bool   `json:"connected"`    // a channel is open right now
+	Channels    int64  `json:"channels"`     // tailnet connections opened for channels
+	Streams     int64  `json:"streams"`      // forwarded connections carried
+	OpenStreams int64  `json:"open_streams"` // carried right now
+	Fallbacks   int64  `json:"fallbacks"`    // dialed directly, the peer had no channel
+}
+
+// muxPeer is the channel to one peer node
+type muxPeer struct {
+	mu       sync.Mutex                       // held while dialing, so concurrent first streams share the channel
+	cc       atomic.Pointer[http2.ClientConn] // nil while there is none
+	noneTill time.Time                        // the peer offered no channel, dial directly until then
+
+	channels, streams, open, fallbacks atomic.Int64
+}
+
+// multiplexer carries the connections of multiplexed forwards as streams
+// of one HTTP/2 connection per peer node, so only the first connection
+// pays for a tailnet dial. Peers that aren't sidecars get direct dials.
+type multiplexer struct {
+	transport *http2.Transport
+
+	mu    sync.Mutex
+	peers map[string]*muxPeer // keyed by tailnet host, "inbound" for -mux-server
+	now   func() time.Time    // time.Now outside of tests
+}
+
+// mux is nil unless a forward multiplexes or -mux-server is set
+var mux *multiplexer
+
+func newMultiplexer() *multiplexer {
+	return &multiplexer{
+		transport: &http2.Transport{AllowHTTP: true, ReadIdleTimeout: muxPingAfter},
+		peers:     map[string]*muxPeer{},
+		now:       time.Now,
+	}
+}
+
+func (m *multiplexer) peer(host string) *muxPeer {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	p, ok := m.peers[host]
+	if !ok {
+		p = &muxPeer{}
+		m.peers[host] = p
+	}
+	return p
+}
+
+// channel returns the open channel to host, dialing one if needed. It
+// returns nil while host is known to offer none.
+func (m *multiplexer) channel(ctx context.Context, d Dialer, host string) (*http2.ClientConn, *muxPeer) {
+	p := m.peer(host)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if cc := p.cc.Load(); cc != nil && cc.CanTakeNewRequest() {
+		return cc, p
+	}
+	if m.now().Before(p.noneTill) {
+		return nil, p
+	}
+	var cc *http2.ClientConn
+	conn, err := d.Dial(ctx, "tcp", net.JoinHostPort(host, muxPort))
+	if err == nil {
+		if cc, err = m.transport.NewClientConn(conn); err != nil {
+			conn.Close()
+		}
+	}
+	p.cc.Store(cc)
+	if err != nil {
+		if ctx.Err() == nil {
+			p.noneTill = m.now().Add(muxRetryAfter)
+			fmt.Fprintf(console, "[MUX] %s: no channel (%v), dialing directly for %s\n", host, err, muxRetryAfter)
+		}
+		return nil, p
+	}
+	p.channels.Add(1)
+	fmt.Fprintf(console, "[MUX] Channel to %s open\n", host)
+	return cc, p
+}
+
+// drop forgets cc after it failed, unless it was already replaced
+func (m *multiplexer) drop(p *muxPeer, cc *http2.ClientConn) {
+	p.cc.CompareAndSwap(cc, nil)
+	cc.Close()
+}
+
+// open starts a stream to port on the channel
+func (m *multiplexer) open(ctx context.Context, cc *http2.ClientConn, port string) (*muxStream, error) {
+	pr, pw := io.Pipe()
+	req := &http.Request{
+		Method:        "CONNECT",
+		URL:           &url.URL{Host: net.JoinHostPort("localhost", port)},
+		Host:          net.JoinHostPort("localhost", port),
+		Header:        http.Header{},
+		Body:          pr,
+		ContentLength: -1,
+	}
+	resp, err := cc.RoundTrip(req.WithContext(context.WithoutCancel(ctx)))
+	if err != nil {
+		pw.Close()
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		resp.Body.Close()
+		pw.Close()
+		return nil, &muxRefused{strings.TrimSpace(string(msg))}
+	}
+	return &muxStream{body: resp.Body, w: pw}, nil
+}
+
+// muxRefused is the serving sidecar declining a stream, e.g. for a port it
+// doesn't announce
+type muxRefused struct{ reason string }
+
+func (e *muxRefused) Error() string { return "refused by peer: " + e.reason }
+
+// muxDialer dials through the multiplexer, falling back to Base
+type muxDialer struct {
+	Base    Dialer
+	resolve func(addr string) (string, error) // service references, nil without a router
+	mux     *multiplexer
+}
+
+func (d *muxDialer) Dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	target := addr
+	if d.resolve != nil {
+		resolved, err := d.resolve(addr)
+		if err != nil {
+			return nil, err
+		}
+		target = resolved
+	}
+	host, port, err := net.SplitHostPort(target)
+	if err != nil {
+		return d.Base.Dial(ctx, network, target)
+	}
+	// One retry covers a channel that died since its last stream
+	for attempt := 0; attempt < 2; attempt++ {
+		cc, p := d.mux.channel(ctx, d.Base, host)
+		if cc == nil {
+			p.fallbacks.Add(1)
+			break
+		}
+		s, err := d.mux.open(ctx, cc, port)
+		if err == nil {
+			p.streams.Add(1)
+			p.open.Add(1)
+			s.peer, s.local, s.remote = p, &muxAddr{"local"}, &muxAddr{target}
+			return s, nil
+		}
+		var refused *muxRefused
+		if errors.As(err, &refused) {
+			// The service may still be reachable without the peer's help
+			fmt.Fprintf(console, "[MUX] %s: %v, dialing directly\n", target, err)
+			p.fallbacks.Add(1)
+			break
+		}
+		d.mux.drop(p, cc)
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+	}
+	return d.Base.Dial(ctx, network, target)
+}
+
+// muxStream is one forwarded connection inside a channel
+type muxStream struct {
+	body          io.ReadCloser
+	w             *io.PipeWriter
+	peer          *muxPeer
+	local, remote net.Addr
+	once          sync.Once
+}
+
+func (s *muxStream) Read(b []byte) (int, error)  { return s.body.Read(b) }
+func (s *muxStream) Write(b []byte) (int, error) { return s.w.Write(b) }
+
+func (s *muxStream) Close() error {
+	s.once.Do(func() {
+		s.w.Close()
+		s.body.Close()
+		s.peer.open.Add(-1)
+	})
+	return nil
+}
+
+func (s *muxStream) LocalAddr() net.Addr  { return s.local }
+func (s *muxStream) RemoteAddr() net.Addr { return s.remote }
+
+// Streams have no deadlines of their own; the channel pings idle peers
+func (s *muxStream) SetDeadline(time.Time) error      { return nil }
+func (s *muxStream) SetReadDeadline(time.Time) error  { return nil }
+func (s *muxStream) SetWriteDeadline(time.Time) error { return nil }
+
+// muxAddr names the ends of a stream
+type muxAddr struct{ addr string }
+
+func (a *muxAddr) Network() string { return "mux" }
+func (a *muxAddr) String() string  { return a.addr }
+
+// stats returns the per-peer counters, ordered by peer
+func (m *multiplexer) stats() []MuxStats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	list := make([]MuxStats, 0, len(m.peers))
+	for host, p := range m.peers {
+		cc := p.cc.Load()
+		list = append(list, MuxStats{
+			Peer:        host,
+			Connected:   cc != nil && !cc.State().Closed,
+			Channels:    p.channels.Load(),
+			Streams:     p.streams.Load(),
+			OpenStreams: p.open.Load(),
+			Fallbacks:   p.fallbacks.Load(),
+		})
+	}
+	slices.SortFunc(list, func(a, b MuxStats) int { return strings.Compare(a.Peer, b.Peer) })
+	return list
+}
+
+// serveMux accepts channels from other sidecars and connects their streams
+// to the announced services
+func serveMux(ln net.Listener, ports []int, counters *muxPeer) {
+	srv := &http2.Server{}
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "CONNECT" {
+			http.Error(w, "only CONNECT streams", http.StatusMethodNotAllowed)
+			return
+		}
+		_, port, _ := net.SplitHostPort(r.Host)
+		local, err := dialAnnounced(r.Context(), ports, port)
+		if err != nil {
+			fmt.Fprintf(console, "[MUX] Refusing stream from %s: %v\n", r.RemoteAddr, err)
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		defer local.Close()
+		counters.streams.Add(1)
+		counters.open.Add(1)
+		defer counters.open.Add(-1)
+
+		w.WriteHeader(http.StatusOK)
+		rc := http.NewResponseController(w)
+		rc.Flush()
+		go func() {
+			io.Copy(local, r.Body)
+			if tc, ok := local.(*net.TCPConn); ok {
+				tc.CloseWrite()
+			}
+		}()
+		io.Copy(flushWriter{w, rc}, local)
+	})
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		counters.channels.Add(1)
+		fmt.Fprintf(console, "[MUX] Channel from %s\n", conn.RemoteAddr())
+		go srv.ServeConn(conn, &http2.ServeConnOpts{Handler: handler})
+	}
+}
+
+// flushWriter sends every write to the peer right away
+type flushWriter struct {
+	w  io.Writer
+	rc *http.ResponseController
+}
+
+func (f flushWriter) Write(p []byte) (int, error) {
+	n, err := f.w.Write(p)
+	if err == nil {
+		err = f.rc.Flush()
+	}
+	return n, err
+}
+
+// handleMuxStats serves the per-peer channel counters on the status API
+func handleMuxStats(w http.ResponseWriter, r *http.Request) {
+	if mux == nil {
+		http.Error(w, "no multiplexed forwards and no -mux-server", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(mux.stats())
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestMultiplexedForward(t *testing.T) {
+	echoPort := startEcho(t)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer ln.Close()
+	m := newMultiplexer()
+	go serveMux(ln, []int{echoPort}, m.peer("inbound"))
+
+	var channelDials atomic.Int64
+	base := &MockDialer{DialFunc: func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if _, port, _ := net.SplitHostPort(addr); port == muxPort {
+			channelDials.Add(1)
+			return net.Dial("tcp", ln.Addr().String())
+		}
+		return nil, errors.New("direct dial")
+	}}
+	d := &muxDialer{Base: base, mux: m}
+	target := "data-node:" + strconv.Itoa(echoPort)
+
+	// Many small streams share one tailnet connection
+	for i := 0; i < 20; i++ {
+		conn, err := d.Dial(context.Background(), "tcp", target)
+		if err != nil {
+			t.Fatalf("Dial %d failed: %v", i, err)
+		}
+		msg := fmt.Sprintf("stream %d", i)
+		if _, err := conn.Write([]byte(msg)); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+		buf := make([]byte, len(msg))
+		if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != msg {
+			t.Fatalf("Expected echo %q, got %q, %v", msg, buf, err)
+		}
+		if conn.RemoteAddr().String() != target {
+			t.Errorf("Expected remote address %s, got %s", target, conn.RemoteAddr())
+		}
+		conn.Close()
+	}
+	if n := channelDials.Load(); n != 1 {
+		t.Errorf("Expected 1 tailnet dial for 20 streams, got %d", n)
+	}
+
+	stats := m.stats()
+	if len(stats) != 2 || stats[0].Peer != "data-node" || stats[1].Peer != "inbound" {
+		t.Fatalf("Unexpected stats %+v", stats)
+	}
+	if st := stats[0]; !st.Connected || st.Channels != 1 || st.Streams != 20 || st.OpenStreams != 0 {
+		t.Errorf("Unexpected peer stats %+v", st)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for m.stats()[1].OpenStreams != 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if st := m.stats()[1]; st.Channels != 1 || st.Streams != 20 || st.OpenStreams != 0 {
+		t.Errorf("Unexpected inbound stats %+v", st)
+	}
+
+	// The serving sidecar refuses ports it doesn't announce, which are
+	// dialed directly instead
+	if _, err := d.Dial(context.Background(), "tcp", "data-node:1"); err == nil || err.Error() != "direct dial" {
+		t.Errorf("Expected a direct dial to an unannounced port, got %v", err)
+	}
+	if st := m.stats()[0]; st.Fallbacks != 1 || st.Channels != 1 {
+		t.Errorf("Expected the refusal to fall back on the same channel, got %+v", st)
+	}
+}
+
+func TestMultiplexFallback(t *testing.T) {
+	var dialed []string
+	base := &MockDialer{DialFunc: func(ctx context.Context, network, addr string) (net.Conn, error) {
+		dialed = append(dialed, addr)
+		if _, port, _ := net.SplitHostPort(addr); port == muxPort {
+			return nil, errors.New("connection refused")
+		}
+		client, _ := net.Pipe()
+		return client, nil
+	}}
+	m := newMultiplexer()
+	now := time.Now()
+	m.now = func() time.Time { return now }
+	d := &muxDialer{Base: base, mux: m}
+
+	for i := 0; i < 2; i++ {
+		conn, err := d.Dial(context.Background(), "tcp", "plain-node:5432")
+		if err != nil {
+			t.Fatalf("Expected a direct connection, got %v", err)
+		}
+		conn.Close()
+	}
+	// The peer isn't asked again for a channel until muxRetryAfter passed
+	want := []string{"plain-node:9906", "plain-node:5432", "plain-node:5432"}
+	if fmt.Sprint(dialed) != fmt.Sprint(want) {
+		t.Errorf("Expected dials %v, got %v", want, dialed)
+	}
+	now = now.Add(muxRetryAfter)
+	d.Dial(context.Background(), "tcp", "plain-node:5432")
+	if len(dialed) != 5 || dialed[3] != "plain-node:9906" {
+		t.Errorf("Expected another channel attempt after %s, got %v", muxRetryAfter, dialed)
+	}
+	if st := m.stats()[0]; st.Fallbacks != 3 || st.Channels != 0 {
+		t.Errorf("Unexpected stats %+v", st)
+	}
+}
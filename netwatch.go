@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"tailscale.com/net/netmon"
+)
+
+// --- NETWORK CHANGES ---
+
+// networkState is what the sidecar watches to notice roaming: the
+// interface carrying the default route and the machine's addresses
+type networkState struct {
+	Interface string
+	Addresses []string // sorted
+}
+
+func (s networkState) String() string {
+	iface := s.Interface
+	if iface == "" {
+		iface = "none"
+	}
+	return fmt.Sprintf("interface=%s addresses=%s", iface, strings.Join(s.Addresses, ","))
+}
+
+func (s networkState) equal(o networkState) bool {
+	return s.Interface == o.Interface && slices.Equal(s.Addresses, o.Addresses)
+}
+
+// currentNetwork reads the network state from the OS
+func currentNetwork() (networkState, error) {
+	addrs, _, err := netmon.LocalAddresses()
+	if err != nil {
+		return networkState{}, err
+	}
+	// Not every platform can tell; the addresses still change on roaming
+	iface, _ := netmon.DefaultRouteInterface()
+	st := networkState{Interface: iface}
+	for _, a := range addrs {
+		st.Addresses = append(st.Addresses, a.String())
+	}
+	slices.Sort(st.Addresses)
+	return st, nil
+}
+
+// networkWatcher polls the network state. When it changes (a laptop
+// switching Wi-Fi, docking, a VPN coming up), it tells the parent and
+// runs the reconnect hooks, so tunnels recover within seconds instead of
+// waiting minutes for dead paths to time out.
+type networkWatcher struct {
+	Interval time.Duration
+	state    func() (networkState, error) // currentNetwork outside of tests
+
+	mu    sync.Mutex
+	hooks []func(ctx context.Context)
+	last  networkState
+	seen  bool // last is set
+}
+
+// netwatch is nil unless -network-check is above zero
+var netwatch *networkWatcher
+
+// onChange registers a hook run after every change. Safe on a nil watcher.
+func (w *networkWatcher) onChange(hook func(ctx context.Context)) {
+	if w == nil {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.hooks = append(w.hooks, hook)
+}
+
+// check reads the state once and reacts if it changed since the last
+// call. The first call only records the state.
+func (w *networkWatcher) check(ctx context.Context) bool {
+	st, err := w.state()
+	if err != nil {
+		return false
+	}
+	w.mu.Lock()
+	prev, seen := w.last, w.seen
+	w.last, w.seen = st, true
+	if !seen || st.equal(prev) {
+		w.mu.Unlock()
+		return false
+	}
+	hooks := slices.Clone(w.hooks)
+	w.mu.Unlock()
+
+	fmt.Fprintf(console, ">>> [NET] Network changed (%s -> %s), reconnecting\n", prev, st)
+	signal(SignalNetworkChanged, st.String())
+	for _, hook := range hooks {
+		hook(ctx)
+	}
+	return true
+}
+
+// run checks every Interval until ctx is done
+func (w *networkWatcher) run(ctx context.Context) {
+	ticker := time.NewTicker(w.Interval)
+	defer ticker.Stop()
+	w.check(ctx)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			w.check(ctx)
+		}
+	}
+}
+
+// reset closes the ready connections, which most likely went over the old
+// network. Warming starts over on the next round.
+func (p *prewarmer) reset() {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, d := range p.dests {
+		for _, ic := range d.idle {
+			ic.conn.Close()
+		}
+		d.idle = nil
+		d.coldUntil = time.Time{}
+	}
+}
+
+// reset closes every channel, so the next stream dials a fresh one, and
+// retries peers that had none
+func (m *multiplexer) reset() {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, p := range m.peers {
+		if cc := p.cc.Swap(nil); cc != nil {
+			cc.Close()
+		}
+		p.mu.Lock()
+		p.noneTill = time.Time{}
+		p.mu.Unlock()
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNetworkWatcher(t *testing.T) {
+	state := networkState{Interface: "wlan0", Addresses: []string{"192.168.1.20"}}
+	w := &networkWatcher{state: func() (networkState, error) { return state, nil }}
+	hooks := 0
+	w.onChange(func(ctx context.Context) { hooks++ })
+
+	if w.check(context.Background()) || w.check(context.Background()) {
+		t.Fatal("Expected no change on the first checks")
+	}
+	state = networkState{Interface: "eth0", Addresses: []string{"10.0.0.7", "192.168.1.20"}}
+	out := captureStdout(t, func() {
+		if !w.check(context.Background()) {
+			t.Error("Expected the change to be noticed")
+		}
+	})
+	if !strings.Contains(out, SignalNetworkChanged+" interface=eth0 addresses=10.0.0.7,192.168.1.20") {
+		t.Errorf("Expected a NETWORK_CHANGED signal, got %q", out)
+	}
+	if hooks != 1 {
+		t.Errorf("Expected the hooks to run once, ran %d times", hooks)
+	}
+	if w.check(context.Background()) || hooks != 1 {
+		t.Error("Expected no change without a new state")
+	}
+
+	var none *networkWatcher
+	none.onChange(func(ctx context.Context) {})
+}
+
+func TestPrewarmReset(t *testing.T) {
+	p := newPrewarmer(nil, &PrewarmConfig{})
+	client, server := net.Pipe()
+	defer server.Close()
+	p.dests["gpu-node:8080"] = &warmDest{
+		warm:      true,
+		idle:      []idleConn{{conn: client, since: time.Now()}},
+		coldUntil: time.Now().Add(time.Minute),
+	}
+	p.reset()
+	d := p.dests["gpu-node:8080"]
+	if len(d.idle) != 0 || !d.coldUntil.IsZero() || !d.warm {
+		t.Errorf("Expected the ready connections to be dropped and the destination kept warm, got %+v", d)
+	}
+	if _, err := client.Write([]byte("x")); err == nil {
+		t.Error("Expected the ready connection to be closed")
+	}
+
+	var none *prewarmer
+	none.reset()
+	var noMux *multiplexer
+	noMux.reset()
+}
+
+func TestMultiplexerReset(t *testing.T) {
+	m := newMultiplexer()
+	p := m.peer("gpu-node")
+	p.noneTill = time.Now().Add(time.Minute)
+	m.reset()
+	if !p.noneTill.IsZero() || p.cc.Load() != nil {
+		t.Errorf("Expected the peer to be retried, got %+v", p)
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2/clientcredentials"
+	"tailscale.com/ipn"
+	"tailscale.com/tsnet"
+)
+
+// --- OAUTH AUTH KEYS ---
+
+const (
+	defaultTailscaleAPI = "https://api.tailscale.com"
+	mintedKeyExpiry     = 10 * time.Minute
+)
+
+// authKeyMinter creates single-use, pre-authorized, tagged auth keys from a
+// Tailscale OAuth client (scope auth_keys) instead of a long-lived key.
+type authKeyMinter struct {
+	ClientID     string
+	ClientSecret string
+	BaseURL      string
+	Tags         []string
+}
+
+// mint requests a fresh auth key that expires after mintedKeyExpiry.
+func (m *authKeyMinter) mint(ctx context.Context) (string, error) {
+	if len(m.Tags) == 0 {
+		return "", fmt.Errorf("OAuth auth keys need at least one tag (-advertise-tags)")
+	}
+	base := strings.TrimSuffix(m.BaseURL, "/")
+	if base == "" {
+		base = defaultTailscaleAPI
+	}
+	creds := clientcredentials.Config{
+		ClientID:     m.ClientID,
+		ClientSecret: m.ClientSecret,
+		TokenURL:     base + "/api/v2/oauth/token",
+	}
+
+	var body bytes.Buffer
+	json.NewEncoder(&body).Encode(map[string]any{
+		"capabilities": map[string]any{
+			"devices": map[string]any{
+				"create": map[string]any{
+					"reusable":      false,
+					"ephemeral":     false,
+					"preauthorized": true,
+					"tags":          m.Tags,
+				},
+			},
+		},
+		"expirySeconds": int64(mintedKeyExpiry / time.Second),
+	})
+	req, err := http.NewRequestWithContext(ctx, "POST", base+"/api/v2/tailnet/-/keys", &body)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := creds.Client(ctx).Do(req)
+	if err != nil {
+		return "", fmt.Errorf("minting auth key: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return "", fmt.Errorf("minting auth key: %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	var key struct {
+		Key string `json:"key"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&key); err != nil {
+		return "", fmt.Errorf("minting auth key: %w", err)
+	}
+	if key.Key == "" {
+		return "", fmt.Errorf("minting auth key: empty key in response")
+	}
+	secrets.addLiteral(key.Key)
+	return key.Key, nil
+}
+
+// reauthOnExpiry watches the node state and logs in again with a freshly
+// minted key whenever control asks for a new login (e.g. node key expiry).
+func reauthOnExpiry(ctx context.Context, s *tsnet.Server, m *authKeyMinter) {
+	lc, err := s.LocalClient()
+	if err != nil {
+		fmt.Fprintf(console, "!!! OAuth re-auth disabled: %v\n", err)
+		return
+	}
+	watcher, err := lc.WatchIPNBus(ctx, 0)
+	if err != nil {
+		fmt.Fprintf(console, "!!! OAuth re-auth disabled: %v\n", err)
+		return
+	}
+	defer watcher.Close()
+
+	for {
+		n, err := watcher.Next()
+		if err != nil {
+			return
+		}
+		if n.State == nil || *n.State != ipn.NeedsLogin {
+			continue
+		}
+		fmt.Fprintln(console, ">>> Node needs login, minting a new auth key")
+		key, err := m.mint(ctx)
+		if err != nil {
+			signal(SignalAuthRequired, fmt.Sprintf("oauth mint failed: %v", err))
+			continue
+		}
+		if err := lc.Start(ctx, ipn.Options{AuthKey: key}); err != nil {
+			fmt.Fprintf(console, "!!! Re-auth failed: %v\n", err)
+			continue
+		}
+		if err := lc.StartLoginInteractive(ctx); err != nil {
+			fmt.Fprintf(console, "!!! Re-auth failed: %v\n", err)
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAuthKeyMinter(t *testing.T) {
+	var created map[string]any
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v2/oauth/token", func(w http.ResponseWriter, r *http.Request) {
+		if id, secret, _ := r.BasicAuth(); id != "client" || secret != "tskey-client-secret" {
+			http.Error(w, "bad client", http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"access_token":"token","token_type":"Bearer","expires_in":3600}`))
+	})
+	mux.HandleFunc("POST /api/v2/tailnet/-/keys", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer token" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		json.NewDecoder(r.Body).Decode(&created)
+		w.Write([]byte(`{"id":"k1","key":"tskey-auth-minted"}`))
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	m := &authKeyMinter{ClientID: "client", ClientSecret: "tskey-client-secret", BaseURL: server.URL, Tags: []string{"tag:sidecar"}}
+	key, err := m.mint(context.Background())
+	if err != nil {
+		t.Fatalf("mint failed: %v", err)
+	}
+	if key != "tskey-auth-minted" {
+		t.Fatalf("Expected minted key, got %q", key)
+	}
+	if created["expirySeconds"] != float64(600) {
+		t.Errorf("Expected a 10 minute expiry, got %v", created["expirySeconds"])
+	}
+	create := created["capabilities"].(map[string]any)["devices"].(map[string]any)["create"].(map[string]any)
+	if create["reusable"] != false || create["preauthorized"] != true {
+		t.Errorf("Expected single-use preauthorized key, got %v", create)
+	}
+
+	m.Tags = nil
+	if _, err := m.mint(context.Background()); err == nil {
+		t.Error("Expected error without tags")
+	}
+}
@@ -0,0 +1,442 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// --- OFFLINE QUEUE ---
+
+const (
+	maxQueuedBody       = 8 << 20 // larger uploads are never queued
+	outboxRetryInterval = 10 * time.Second
+	outboxFlushTimeout  = 30 * time.Second
+)
+
+// QueueRule is one entry of the queue section of the config file. POST
+// and PUT requests to the host are kept on disk while the tailnet is down
+// and sent again once it is back.
+type QueueRule struct {
+	Host       string `json:"host"`                  // host or host:port, as in mirrors
+	PathPrefix string `json:"path_prefix,omitempty"` // only requests below this path, default all
+	MaxAge     string `json:"max_age,omitempty"`     // requests waiting longer are dropped, default 24h
+	MaxMB      int64  `json:"max_mb,omitempty"`      // disk space for the host's queue, default 64
+	// Queue every POST, not only those with an Idempotency-Key header.
+	// Only for endpoints where a request sent twice does no harm.
+	AllPosts bool `json:"all_posts,omitempty"`
+}
+
+func (r *QueueRule) validate() error {
+	if r.Host == "" {
+		return fmt.Errorf("host is required")
+	}
+	if r.PathPrefix != "" && !strings.HasPrefix(r.PathPrefix, "/") {
+		return fmt.Errorf("path_prefix must start with '/', got %q", r.PathPrefix)
+	}
+	if r.MaxAge != "" {
+		if d, err := time.ParseDuration(r.MaxAge); err != nil || d <= 0 {
+			return fmt.Errorf("invalid max_age %q", r.MaxAge)
+		}
+	}
+	if r.MaxMB < 0 {
+		return fmt.Errorf("max_mb must not be negative, got %d", r.MaxMB)
+	}
+	return nil
+}
+
+// OutboxStats is one rule's row in /stats/queue
+type OutboxStats struct {
+	Host       string `json:"host"`
+	PathPrefix string `json:"path_prefix,omitempty"`
+	Pending    int    `json:"pending"`          // requests waiting
+	Bytes      int64  `json:"bytes"`            // their size on disk
+	Oldest     string `json:"oldest,omitempty"` // when the oldest was queued
+	Queued     int64  `json:"queued"`           // requests kept since startup
+	Delivered  int64  `json:"delivered"`        // sent again successfully
+	Expired    int64  `json:"expired"`          // dropped after max_age
+	Rejected   int64  `json:"rejected"`         // not kept, the queue was full
+}
+
+// queuedRequest is one request waiting in a rule's queue
+type queuedRequest struct {
+	path   string // the request in wire format
+	id     string // request ID it was proxied with
+	queued time.Time
+	size   int64
+}
+
+// outboxQueue is the queue of one rule, oldest first
+type outboxQueue struct {
+	QueueRule
+	maxAge   time.Duration
+	maxBytes int64
+
+	entries []queuedRequest
+	bytes   int64
+
+	queued, delivered, expired, rejected atomic.Int64
+}
+
+// outbox stores requests for queued hosts while they can't be reached and
+// sends them in order once they can. Requests survive restarts in the
+// state directory.
+type outbox struct {
+	dir       string
+	transport http.RoundTripper
+	queues    []*outboxQueue
+
+	mu      sync.Mutex // guards the queues' entries
+	sending sync.Mutex // one delivery round at a time
+	kicks   chan struct{}
+	seq     atomic.Int64
+	now     func() time.Time // time.Now outside of tests
+}
+
+// queue is nil unless the config has a queue section
+var queue *outbox
+
+// newOutbox opens the queue directory and picks up the requests a previous
+// run left. Requests no rule matches anymore are deleted.
+func newOutbox(rules []QueueRule, dir string, transport http.RoundTripper) (*outbox, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	o := &outbox{dir: dir, transport: transport, kicks: make(chan struct{}, 1), now: time.Now}
+	for _, r := range rules {
+		q := &outboxQueue{QueueRule: r, maxAge: 24 * time.Hour, maxBytes: 64 << 20}
+		if r.MaxAge != "" {
+			q.maxAge, _ = time.ParseDuration(r.MaxAge)
+		}
+		if r.MaxMB > 0 {
+			q.maxBytes = r.MaxMB << 20
+		}
+		o.queues = append(o.queues, q)
+	}
+
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range files { // sorted by name, which starts with the time queued
+		path := filepath.Join(dir, f.Name())
+		stamp, _, ok := strings.Cut(f.Name(), "-")
+		nanos, err := strconv.ParseInt(stamp, 10, 64)
+		if !ok || err != nil || !strings.HasSuffix(f.Name(), ".http") {
+			continue
+		}
+		req, err := readQueued(path)
+		var q *outboxQueue
+		if err == nil {
+			q = o.match(req)
+		}
+		if q == nil {
+			fmt.Fprintf(console, "[QUEUE] Dropping %s, no queue rule matches it\n", f.Name())
+			os.Remove(path)
+			continue
+		}
+		info, _ := f.Info()
+		q.entries = append(q.entries, queuedRequest{path: path, id: req.Header.Get(requestIDHeader), queued: time.Unix(0, nanos), size: info.Size()})
+		q.bytes += info.Size()
+	}
+	return o, nil
+}
+
+// match returns the queue for r, if a rule covers it
+func (o *outbox) match(r *http.Request) *outboxQueue {
+	for _, q := range o.queues {
+		if matchHost(q.Host, r.URL.Host) && strings.HasPrefix(r.URL.Path, q.PathPrefix) {
+			return q
+		}
+	}
+	return nil
+}
+
+// heldRequest is a request buffered so it can be stored if sending fails
+type heldRequest struct {
+	queue  *outboxQueue
+	req    *http.Request // a copy without the service token
+	body   []byte
+	behind bool // earlier requests for the queue are still waiting
+}
+
+// hold buffers the body of a request that may have to be queued. It is
+// called before credentials are added, so they never reach the disk.
+// Safe on a nil outbox.
+func (o *outbox) hold(r *http.Request) *heldRequest {
+	if o == nil || (r.Method != http.MethodPost && r.Method != http.MethodPut) || sessionFrom(r.Context()) != nil {
+		return nil
+	}
+	q := o.match(r)
+	if q == nil || (r.Method == http.MethodPost && !q.AllPosts && r.Header.Get("Idempotency-Key") == "") {
+		return nil
+	}
+	if r.ContentLength > maxQueuedBody {
+		return nil
+	}
+	var body []byte
+	if r.Body != nil {
+		var err error
+		body, err = io.ReadAll(io.LimitReader(r.Body, maxQueuedBody+1))
+		if err != nil {
+			r.Body = io.NopCloser(io.MultiReader(bytes.NewReader(body), r.Body))
+			return nil
+		}
+		if len(body) > maxQueuedBody {
+			// Larger than announced; stream the rest after what was read
+			r.Body = io.NopCloser(io.MultiReader(bytes.NewReader(body), r.Body))
+			return nil
+		}
+		r.Body.Close()
+		r.Body = io.NopCloser(bytes.NewReader(body))
+	}
+	held := &heldRequest{queue: q, req: r.Clone(context.Background()), body: body}
+	for _, h := range []string{"Proxy-Authorization", "Proxy-Connection"} {
+		held.req.Header.Del(h)
+	}
+	o.mu.Lock()
+	held.behind = len(q.entries) > 0
+	o.mu.Unlock()
+	return held
+}
+
+// QueuedResponse is the body of the 202 a client gets for a queued request
+type QueuedResponse struct {
+	Queued    bool   `json:"queued"`
+	RequestID string `json:"request_id"`
+	Pending   int    `json:"pending"` // requests waiting for the host, this one included
+}
+
+// enqueue stores h and answers the client with 202 Accepted. It returns
+// false, writing nothing, if the queue is full.
+func (o *outbox) enqueue(w http.ResponseWriter, h *heldRequest) bool {
+	q := h.queue
+	size := int64(len(h.body)) + 1024 // the header, roughly
+	o.mu.Lock()
+	if q.bytes+size > q.maxBytes {
+		o.mu.Unlock()
+		q.rejected.Add(1)
+		signal(SignalWarning, fmt.Sprintf("queue_full host=%s", q.Host))
+		return false
+	}
+	now := o.now()
+	name := fmt.Sprintf("%019d-%06d.http", now.UnixNano(), o.seq.Add(1)%1000000)
+	path := filepath.Join(o.dir, name)
+	if err := writeQueued(path, h.req, h.body); err != nil {
+		o.mu.Unlock()
+		fmt.Fprintf(console, "[QUEUE] Failed to store a request for %s: %v\n", q.Host, err)
+		return false
+	}
+	if info, err := os.Stat(path); err == nil {
+		size = info.Size()
+	}
+	id := h.req.Header.Get(requestIDHeader)
+	q.entries = append(q.entries, queuedRequest{path: path, id: id, queued: now, size: size})
+	q.bytes += size
+	pending := len(q.entries)
+	o.mu.Unlock()
+	q.queued.Add(1)
+
+	fmt.Fprintf(console, "[QUEUE] %s %s %s queued, %d waiting for %s\n", id, h.req.Method, h.req.URL, pending, q.Host)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(QueuedResponse{Queued: true, RequestID: id, Pending: pending})
+	return true
+}
+
+// writeQueued stores a request in HTTP wire format, atomically
+func writeQueued(path string, r *http.Request, body []byte) error {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%s %s HTTP/1.1\r\nHost: %s\r\n", r.Method, r.URL.RequestURI(), r.URL.Host)
+	r.Header.Del("Content-Length")
+	r.Header.Del("Transfer-Encoding")
+	r.Header.Write(&buf)
+	fmt.Fprintf(&buf, "Content-Length: %d\r\n\r\n", len(body))
+	buf.Write(body)
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, buf.Bytes(), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// readQueued loads a stored request, ready to be sent
+func readQueued(path string) (*http.Request, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(data)))
+	if err != nil {
+		return nil, err
+	}
+	req.URL.Scheme, req.URL.Host = "http", req.Host
+	req.RequestURI = ""
+	return req, nil
+}
+
+// kick starts a delivery round soon. Safe on a nil outbox.
+func (o *outbox) kick() {
+	if o == nil {
+		return
+	}
+	select {
+	case o.kicks <- struct{}{}:
+	default:
+	}
+}
+
+// run delivers queued requests every outboxRetryInterval, or when kicked
+func (o *outbox) run(ctx context.Context) {
+	ticker := time.NewTicker(outboxRetryInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-o.kicks:
+		}
+		o.deliver(ctx)
+	}
+}
+
+// deliver sends every queue's requests in order, stopping at a queue's
+// first one that still can't be sent. Requests past max_age are dropped.
+func (o *outbox) deliver(ctx context.Context) (delivered int) {
+	o.sending.Lock()
+	defer o.sending.Unlock()
+	for _, q := range o.queues {
+		for {
+			o.mu.Lock()
+			if len(q.entries) == 0 {
+				o.mu.Unlock()
+				break
+			}
+			e := q.entries[0]
+			o.mu.Unlock()
+
+			if o.now().Sub(e.queued) > q.maxAge {
+				o.remove(q, e)
+				q.expired.Add(1)
+				signal(SignalWarning, fmt.Sprintf("queue_expired host=%s id=%s", q.Host, e.id))
+				continue
+			}
+			if !o.send(ctx, q, e) {
+				break
+			}
+			delivered++
+		}
+	}
+	return delivered
+}
+
+// send delivers one request. Any response counts, as the service got it.
+func (o *outbox) send(ctx context.Context, q *outboxQueue, e queuedRequest) bool {
+	req, err := readQueued(e.path)
+	if err != nil {
+		fmt.Fprintf(console, "[QUEUE] Dropping unreadable %s: %v\n", filepath.Base(e.path), err)
+		o.remove(q, e)
+		return true
+	}
+	req = req.WithContext(ctx)
+	serviceToken.apply(req)
+	resp, err := o.transport.RoundTrip(req)
+	if err != nil {
+		return false
+	}
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	resp.Body.Close()
+	o.remove(q, e)
+	q.delivered.Add(1)
+	fmt.Fprintf(console, "[QUEUE] %s %s %s delivered after %s: %s\n", e.id, req.Method, req.URL, o.now().Sub(e.queued).Round(time.Second), resp.Status)
+	return true
+}
+
+// remove deletes e, the head of q
+func (o *outbox) remove(q *outboxQueue, e queuedRequest) {
+	os.Remove(e.path)
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if i := slices.IndexFunc(q.entries, func(x queuedRequest) bool { return x.path == e.path }); i >= 0 {
+		q.entries = slices.Delete(q.entries, i, i+1)
+		q.bytes -= e.size
+	}
+}
+
+func (o *outbox) stats() []OutboxStats {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	list := []OutboxStats{}
+	for _, q := range o.queues {
+		st := OutboxStats{
+			Host:       q.Host,
+			PathPrefix: q.PathPrefix,
+			Pending:    len(q.entries),
+			Bytes:      q.bytes,
+			Queued:     q.queued.Load(),
+			Delivered:  q.delivered.Load(),
+			Expired:    q.expired.Load(),
+			Rejected:   q.rejected.Load(),
+		}
+		if len(q.entries) > 0 {
+			st.Oldest = q.entries[0].queued.UTC().Format(time.RFC3339)
+		}
+		list = append(list, st)
+	}
+	return list
+}
+
+func (o *outbox) pending() int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	n := 0
+	for _, q := range o.queues {
+		n += len(q.entries)
+	}
+	return n
+}
+
+// handleQueueStats serves the per-rule counters on the status API
+func handleQueueStats(w http.ResponseWriter, r *http.Request) {
+	if queue == nil {
+		http.Error(w, "no queue section in the config", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(queue.stats())
+}
+
+// FlushResult is the body of /control/queue/flush responses
+type FlushResult struct {
+	SchemaVersion int `json:"schema_version"`
+	Delivered     int `json:"delivered"`
+	Pending       int `json:"pending"` // still waiting, their hosts are unreachable
+}
+
+// handleQueueFlush sends the queued requests right away
+func handleQueueFlush(w http.ResponseWriter, r *http.Request) {
+	if queue == nil {
+		http.Error(w, "no queue section in the config", http.StatusNotFound)
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), outboxFlushTimeout)
+	defer cancel()
+	res := FlushResult{SchemaVersion: apiSchemaVersion, Delivered: queue.deliver(ctx)}
+	res.Pending = queue.pending()
+	audit.record("queue_flush", "delivered", strconv.Itoa(res.Delivered), "pending", strconv.Itoa(res.Pending))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
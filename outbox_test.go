@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// flakyUpstream fails in transport while down, else records what it got
+type flakyUpstream struct {
+	mu     sync.Mutex
+	down   bool
+	bodies []string
+}
+
+func (u *flakyUpstream) RoundTrip(req *http.Request) (*http.Response, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.down {
+		return nil, errors.New("dial tcp: connection timed out")
+	}
+	data, _ := io.ReadAll(req.Body)
+	u.bodies = append(u.bodies, req.Method+" "+req.URL.String()+" "+string(data)+" "+req.Header.Get("Proxy-Authorization"))
+	return &http.Response{StatusCode: http.StatusCreated, Status: "201 Created", Header: http.Header{}, Body: io.NopCloser(strings.NewReader("ok"))}, nil
+}
+
+func TestOfflineQueue(t *testing.T) {
+	defer func(saved *outbox) { queue = saved }(queue)
+	upstream := &flakyUpstream{down: true}
+	dir := t.TempDir()
+	q, err := newOutbox([]QueueRule{{Host: "core", PathPrefix: "/metrics"}}, dir, upstream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	queue = q
+	proxy := &TailscaleProxy{Transport: upstream}
+	post := func(path, body string, idempotent bool) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "http://core"+path, strings.NewReader(body))
+		req.Header.Set("Proxy-Authorization", "Basic c2VjcmV0")
+		if idempotent {
+			req.Header.Set("Idempotency-Key", body)
+		}
+		w := httptest.NewRecorder()
+		proxy.handleHTTP(w, req)
+		return w
+	}
+
+	if w := post("/metrics", "m1", true); w.Code != http.StatusAccepted {
+		t.Fatalf("Expected the upload to be queued, got %d %s", w.Code, w.Body)
+	}
+	if w := post("/metrics", "m2", false); w.Code != http.StatusBadGateway {
+		t.Errorf("Expected a POST without Idempotency-Key to fail, got %d", w.Code)
+	}
+	if w := post("/login", "x", true); w.Code != http.StatusBadGateway {
+		t.Errorf("Expected paths outside the prefix to fail, got %d", w.Code)
+	}
+
+	// Back online, but the waiting request goes first
+	upstream.mu.Lock()
+	upstream.down = false
+	upstream.mu.Unlock()
+	w := post("/metrics", "m3", true)
+	var queued QueuedResponse
+	json.NewDecoder(w.Body).Decode(&queued)
+	if w.Code != http.StatusAccepted || queued.Pending != 2 {
+		t.Errorf("Expected the upload to queue behind the first one, got %d %+v", w.Code, queued)
+	}
+
+	// A restart picks the queue up from disk
+	q, err = newOutbox([]QueueRule{{Host: "core", PathPrefix: "/metrics"}}, dir, upstream)
+	if err != nil || q.pending() != 2 {
+		t.Fatalf("Expected 2 queued requests after a restart, got %d, %v", q.pending(), err)
+	}
+	if n := q.deliver(context.Background()); n != 2 {
+		t.Errorf("Expected 2 deliveries, got %d", n)
+	}
+	want := []string{"POST http://core/metrics m1 ", "POST http://core/metrics m3 "}
+	if strings.Join(upstream.bodies, "|") != strings.Join(want, "|") {
+		t.Errorf("Expected %q in order and without proxy credentials, got %q", want, upstream.bodies)
+	}
+	if files, _ := os.ReadDir(dir); len(files) != 0 {
+		t.Errorf("Expected the queue directory to be empty, got %d files", len(files))
+	}
+	st := q.stats()[0]
+	if st.Pending != 0 || st.Delivered != 2 {
+		t.Errorf("Unexpected stats %+v", st)
+	}
+}
+
+func TestOfflineQueueLimits(t *testing.T) {
+	upstream := &flakyUpstream{down: true}
+	q, err := newOutbox([]QueueRule{{Host: "core", MaxAge: "1h", MaxMB: 1, AllPosts: true}}, t.TempDir(), upstream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	q.now = func() time.Time { return now }
+	hold := func(body string) *heldRequest {
+		return q.hold(httptest.NewRequest("POST", "http://core/upload", strings.NewReader(body)))
+	}
+
+	out := captureStdout(t, func() {
+		if !q.enqueue(httptest.NewRecorder(), hold("small")) {
+			t.Error("Expected a small request to be queued")
+		}
+		if q.enqueue(httptest.NewRecorder(), hold(strings.Repeat("x", 1<<20))) {
+			t.Error("Expected the queue to be full")
+		}
+	})
+	if !strings.Contains(out, SignalWarning+" queue_full host=core") {
+		t.Errorf("Expected a queue_full warning, got %q", out)
+	}
+	if h := q.hold(httptest.NewRequest("GET", "http://core/upload", nil)); h != nil {
+		t.Error("Expected GET requests not to be held")
+	}
+
+	now = now.Add(2 * time.Hour)
+	upstream.down = false
+	out = captureStdout(t, func() { q.deliver(context.Background()) })
+	if !strings.Contains(out, SignalWarning+" queue_expired host=core") || len(upstream.bodies) != 0 {
+		t.Errorf("Expected the old request to expire unsent, got %q, sent %v", out, upstream.bodies)
+	}
+	if err := (&QueueRule{Host: "core", MaxAge: "soon"}).validate(); err == nil {
+		t.Error("Expected an invalid max_age to be rejected")
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+
+	"tailscale.com/tsnet"
+)
+
+// --- PEER PRESENCE ---
+
+// peerPresenceTTL is how long a fetched peer list is trusted before the next
+// lookup refreshes it from the local node.
+const peerPresenceTTL = 5 * time.Second
+
+// peerPresence answers "is this tailnet host online?" from a cached copy of
+// the node's peer list, so pools can skip offline peers without waiting for
+// a dial to time out. Pools ask while holding their lock, so lookups never
+// wait for the local node: a stale list is refreshed in the background and
+// answers come from the copy at hand.
+type peerPresence struct {
+	s *tsnet.Server
+
+	mu         sync.Mutex
+	fetched    time.Time
+	refreshing bool
+	online     map[string]bool // replaced on refresh, never modified
+	ips        map[string]netip.Addr
+}
+
+func newPeerPresence(s *tsnet.Server) *peerPresence {
+	pp := &peerPresence{s: s, refreshing: true}
+	go pp.refresh()
+	return pp
+}
+
+// Online implements peerOnlineFunc. Hosts are matched by hostname, MagicDNS
+// name (short or fully qualified) and Tailscale IP. Until the first peer
+// list arrives, every host is unknown.
+func (pp *peerPresence) Online(host string) (online, known bool) {
+	peers, _ := pp.snapshot()
+	online, known = peers[strings.ToLower(strings.TrimSuffix(host, "."))]
+	return online, known
+}
+
+// IP returns the Tailscale IP of a peer by hostname or MagicDNS name
+func (pp *peerPresence) IP(host string) (netip.Addr, bool) {
+	_, ips := pp.snapshot()
+	ip, ok := ips[strings.ToLower(strings.TrimSuffix(host, "."))]
+	return ip, ok
+}
+
+// snapshot returns the current peer list and starts a refresh if it is
+// older than peerPresenceTTL
+func (pp *peerPresence) snapshot() (map[string]bool, map[string]netip.Addr) {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+	if !pp.refreshing && time.Since(pp.fetched) > peerPresenceTTL {
+		pp.refreshing = true
+		go pp.refresh()
+	}
+	return pp.online, pp.ips
+}
+
+// refresh reloads the peer list without holding pp.mu; on failure the
+// previous list is kept until the next attempt.
+func (pp *peerPresence) refresh() {
+	defer func() {
+		pp.mu.Lock()
+		pp.fetched = time.Now()
+		pp.refreshing = false
+		pp.mu.Unlock()
+	}()
+
+	lc, err := pp.s.LocalClient()
+	if err != nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	status, err := lc.Status(ctx)
+	if err != nil {
+		return
+	}
+
+	online := make(map[string]bool)
+	ips := make(map[string]netip.Addr)
+	for _, peer := range status.Peer {
+		names := []string{peer.HostName}
+		if dnsName := strings.TrimSuffix(peer.DNSName, "."); dnsName != "" {
+			short, _, _ := strings.Cut(dnsName, ".")
+			names = append(names, dnsName, short)
+		}
+		for _, ip := range peer.TailscaleIPs {
+			names = append(names, ip.String())
+		}
+		for _, name := range names {
+			if name != "" {
+				online[strings.ToLower(name)] = peer.Online
+				if len(peer.TailscaleIPs) > 0 {
+					ips[strings.ToLower(name)] = peer.TailscaleIPs[0]
+				}
+			}
+		}
+	}
+	pp.mu.Lock()
+	pp.online = online
+	pp.ips = ips
+	pp.mu.Unlock()
+}
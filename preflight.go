@@ -0,0 +1,381 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"tailscale.com/ipn"
+	"tailscale.com/net/stun"
+	"tailscale.com/tailcfg"
+)
+
+// --- PREFLIGHT ---
+
+// Preflight check results
+const (
+	checkPass = "pass"
+	checkWarn = "warn" // works, but not as well as it could
+	checkFail = "fail" // the sidecar would not start
+	checkSkip = "skip" // nothing to check with these flags
+)
+
+// PreflightCheck is one line of the preflight report
+type PreflightCheck struct {
+	Name   string    `json:"name"`
+	Status string    `json:"status"`         // pass, warn, fail or skip
+	Code   ErrorCode `json:"code,omitempty"` // the error code a start would fail with
+	Detail string    `json:"detail"`
+}
+
+// PreflightReport is the output of `sidecar preflight -json`
+type PreflightReport struct {
+	SchemaVersion int              `json:"schema_version"`
+	OK            bool             `json:"ok"` // no check failed
+	Checks        []PreflightCheck `json:"checks"`
+}
+
+// preflightOptions are the flags of the start the checks are for
+type preflightOptions struct {
+	stateDir    string
+	ports       map[string]string // check name to port
+	controlURL  string            // empty for Tailscale's
+	authKey     string
+	oauthSecret string
+	derpMap     string
+	timeout     time.Duration // per network check
+}
+
+// runPreflight implements `sidecar preflight`: it checks what a start with
+// the same flags needs, so the parent can show what is wrong before it
+// launches the sidecar for real. It fails if any check fails.
+func runPreflight(args []string, stdout io.Writer) error {
+	fs := flag.NewFlagSet("preflight", flag.ContinueOnError)
+	var (
+		authKey     = fs.String("authkey", "", "Auth key the sidecar will start with, or 'keyring:<profile>'")
+		oauthSecret = fs.String("oauth-client-secret", "", "OAuth client secret the sidecar will mint its key with")
+		controlURL  = fs.String("control-url", "", "Coordination Server URL")
+		port        = fs.String("port", "8080", "Proxy port the sidecar will listen on")
+		statusPort  = fs.String("statusport", "", "Status API port the sidecar will listen on")
+		stateDir    = fs.String("statedir", "", "State directory (defaults to current working directory)")
+		derpMap     = fs.String("derp-map", "", "Custom DERP map (JSON file or http(s) URL) for the UDP check")
+		timeout     = fs.Duration("timeout", 10*time.Second, "Time limit of each network check")
+		asJSON      = fs.Bool("json", false, "Print the report as JSON")
+		langFlag    = fs.String("lang", "", "Language of the output: 'en' or 'de' (default from the system locale)")
+	)
+	addFlagAliases(fs)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	used, err := deprecatedFlags(fs, os.LookupEnv)
+	if err != nil {
+		return err
+	}
+	warnDeprecatedFlags(used, false)
+	if err := flagsFromEnv(fs, os.LookupEnv); err != nil {
+		return err
+	}
+	lang, err := resolveLang(*langFlag)
+	if err != nil {
+		return err
+	}
+	if *stateDir == "" {
+		if *stateDir, err = os.Getwd(); err != nil {
+			return err
+		}
+	}
+	opts := preflightOptions{
+		stateDir:    *stateDir,
+		ports:       map[string]string{"port": *port},
+		controlURL:  *controlURL,
+		authKey:     *authKey,
+		oauthSecret: *oauthSecret,
+		derpMap:     *derpMap,
+		timeout:     *timeout,
+	}
+	if *statusPort != "" {
+		opts.ports["statusport"] = *statusPort
+	}
+
+	report := preflight(context.Background(), opts)
+	if *asJSON {
+		enc := json.NewEncoder(stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(report)
+	} else {
+		failed := 0
+		for _, c := range report.Checks {
+			fmt.Fprintf(stdout, "%-5s %-12s %s\n", strings.ToUpper(c.Status), c.Name, c.Detail)
+			if c.Status == checkFail {
+				failed++
+			}
+		}
+		if failed == 0 {
+			fmt.Fprintf(stdout, ">>> %s\n", tr(lang, "cli.preflight_ok", "count", len(report.Checks)))
+		} else {
+			fmt.Fprintf(stdout, "!!! %s\n", tr(lang, "cli.preflight_failed", "failed", failed, "count", len(report.Checks)))
+		}
+	}
+	if !report.OK {
+		return errors.New("preflight failed")
+	}
+	return nil
+}
+
+// preflight runs all checks in the order a start would hit them
+func preflight(ctx context.Context, opts preflightOptions) PreflightReport {
+	report := PreflightReport{SchemaVersion: apiSchemaVersion, OK: true}
+	add := func(c PreflightCheck) {
+		if c.Status == checkFail {
+			report.OK = false
+		}
+		report.Checks = append(report.Checks, c)
+	}
+
+	add(checkStateDir(opts.stateDir))
+	for _, name := range []string{"port", "statusport"} {
+		if p, ok := opts.ports[name]; ok {
+			add(checkPort(name, p))
+		}
+	}
+	add(checkAuthKey(opts))
+
+	controlURL := opts.controlURL
+	if controlURL == "" {
+		controlURL = ipn.DefaultControlURL
+	}
+	netCtx, cancel := context.WithTimeout(ctx, opts.timeout)
+	add(checkControl(netCtx, controlURL))
+	cancel()
+	netCtx, cancel = context.WithTimeout(ctx, opts.timeout)
+	add(checkClock(netCtx, controlURL))
+	cancel()
+	netCtx, cancel = context.WithTimeout(ctx, opts.timeout)
+	add(checkUDP(netCtx, opts.derpMap))
+	cancel()
+	return report
+}
+
+// checkStateDir makes sure the node can keep its state and no other
+// sidecar uses it
+func checkStateDir(dir string) PreflightCheck {
+	c := PreflightCheck{Name: "state_dir"}
+	fail := func(err error) PreflightCheck {
+		c.Status, c.Code, c.Detail = checkFail, classifyError(err, CodeStorageFailed), err.Error()
+		return c
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fail(err)
+	}
+	probe, err := os.CreateTemp(dir, ".preflight-*")
+	if err != nil {
+		return fail(err)
+	}
+	probe.Close()
+	os.Remove(probe.Name())
+	release, err := lockStateDir(dir)
+	if err != nil {
+		return fail(err)
+	}
+	release()
+
+	c.Status, c.Detail = checkPass, fmt.Sprintf("%s is writable and not in use", dir)
+	if _, err := os.Stat(filepath.Join(dir, "tailscaled.state")); err == nil {
+		c.Detail += ", node state present"
+	}
+	return c
+}
+
+// checkPort binds the port the way the sidecar's listeners do. Ports below
+// 1024 also say what lets the sidecar bind them.
+func checkPort(name, port string) PreflightCheck {
+	c := PreflightCheck{Name: name}
+	addr := "127.0.0.1:" + port
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		c.Status, c.Code, c.Detail = checkFail, classifyError(err, CodeListenFailed), explainBind(addr, err).Error()
+		return c
+	}
+	ln.Close()
+	c.Status, c.Detail = checkPass, fmt.Sprintf("%s is free", addr)
+	if n, _ := strconv.Atoi(port); n > 0 && n < 1024 {
+		if ok, why := privilegedPortAccess(n); ok {
+			c.Detail += " (" + why + ")"
+		}
+	}
+	return c
+}
+
+// authKeyFormat matches Tailscale auth keys and OAuth client secrets, with
+// the optional ?ephemeral=...&preauthorized=... attributes of the latter
+var authKeyFormat = regexp.MustCompile(`^tskey-([a-z]+-)?[0-9A-Za-z]+-[0-9A-Za-z]+(\?.*)?$`)
+
+// headscaleKeyFormat matches Headscale pre-auth keys, old and new
+var headscaleKeyFormat = regexp.MustCompile(`^(hskey-auth-\S+|[0-9a-f]{48})$`)
+
+// checkAuthKey catches keys that control would reject before they are sent
+func checkAuthKey(opts preflightOptions) PreflightCheck {
+	c := PreflightCheck{Name: "auth_key"}
+	if opts.oauthSecret != "" {
+		if _, err := resolveAuthKey(opts.oauthSecret); err != nil {
+			c.Status, c.Code, c.Detail = checkFail, CodeSecretUnavailable, fmt.Sprintf("OAuth client secret: %v", err)
+			return c
+		}
+		c.Status, c.Detail = checkPass, "a key is minted from the OAuth client at startup"
+		return c
+	}
+	if opts.authKey == "" {
+		if _, err := os.Stat(filepath.Join(opts.stateDir, "tailscaled.state")); err == nil {
+			c.Status, c.Detail = checkSkip, "no auth key, the node logs in with its saved state"
+			return c
+		}
+		c.Status, c.Detail = checkWarn, "no auth key and no saved state: the node will wait for an interactive login"
+		return c
+	}
+	key, err := resolveAuthKey(opts.authKey)
+	if err != nil {
+		c.Status, c.Code, c.Detail = checkFail, CodeSecretUnavailable, err.Error()
+		return c
+	}
+	switch {
+	case strings.TrimSpace(key) != key || strings.ContainsAny(key, " \t\r\n"):
+		c.Status, c.Code, c.Detail = checkFail, CodeAuthFailed, "auth key contains whitespace"
+	case authKeyFormat.MatchString(key):
+		c.Status, c.Detail = checkPass, "looks like a Tailscale auth key"
+	case headscaleKeyFormat.MatchString(key):
+		c.Status, c.Detail = checkPass, "looks like a Headscale pre-auth key"
+	case opts.controlURL != "":
+		// Other control servers may have their own formats
+		c.Status, c.Detail = checkWarn, "unknown auth key format, control will decide"
+	default:
+		c.Status, c.Code, c.Detail = checkFail, CodeAuthFailed, "not a Tailscale auth key (expected tskey-auth-...)"
+	}
+	return c
+}
+
+// checkControl runs the same probe as a start with -control-url
+func checkControl(ctx context.Context, controlURL string) PreflightCheck {
+	c := PreflightCheck{Name: "control"}
+	info, err := checkControlServer(ctx, controlURL)
+	if err != nil {
+		c.Status, c.Code, c.Detail = checkFail, classifyError(err, CodeControlUnreachable), err.Error()
+		return c
+	}
+	c.Status, c.Detail = checkPass, controlURL+" is reachable"
+	if info.Headscale {
+		c.Detail = fmt.Sprintf("Headscale %s at %s is reachable", info.Version, controlURL)
+	}
+	return c
+}
+
+// checkClock compares the local clock with the control server's
+func checkClock(ctx context.Context, controlURL string) PreflightCheck {
+	c := PreflightCheck{Name: "clock"}
+	offset, err := clockOffset(ctx, controlURL)
+	if err != nil {
+		c.Status, c.Detail = checkSkip, fmt.Sprintf("cannot compare with control: %v", err)
+		return c
+	}
+	if offset.Abs() > maxClockSkew {
+		c.Status, c.Code = checkFail, CodeClockSkew
+		c.Detail = describeOffset(offset) + "; fix the system time (NTP)"
+		return c
+	}
+	c.Status, c.Detail = checkPass, fmt.Sprintf("within %s of control", offset.Abs().Round(time.Second))
+	return c
+}
+
+// checkUDP asks the DERP regions' STUN servers for this machine's public
+// address. Without UDP the node still works, but relays everything.
+func checkUDP(ctx context.Context, derpMapSrc string) PreflightCheck {
+	c := PreflightCheck{Name: "udp"}
+	if derpMapSrc == "" {
+		derpMapSrc = ipn.DefaultControlURL + "/derpmap/default"
+	}
+	dm, err := loadDERPMap(derpMapSrc)
+	if err != nil {
+		c.Status, c.Detail = checkSkip, fmt.Sprintf("no DERP map: %v", err)
+		return c
+	}
+	region, addr, rtt, err := stunProbe(ctx, dm)
+	if err != nil {
+		c.Status, c.Detail = checkWarn, fmt.Sprintf("no STUN reply (%v): peers will be reached through DERP relays only", err)
+		return c
+	}
+	c.Status = checkPass
+	c.Detail = fmt.Sprintf("STUN in %s answered in %s, public address %s", region, rtt.Round(time.Millisecond), addr)
+	return c
+}
+
+// stunProbe sends a STUN request to one node of every region and returns
+// the first answer
+func stunProbe(ctx context.Context, dm *tailcfg.DERPMap) (region string, addr netip.AddrPort, rtt time.Duration, err error) {
+	pc, err := net.ListenPacket("udp4", ":0")
+	if err != nil {
+		return "", addr, 0, err
+	}
+	defer pc.Close()
+
+	start := time.Now()
+	sent := map[stun.TxID]string{}
+	for _, id := range dm.RegionIDs() {
+		r := dm.Regions[id]
+		for _, n := range r.Nodes {
+			if n.STUNPort < 0 {
+				continue
+			}
+			host := n.HostName
+			if ip, err := netip.ParseAddr(n.IPv4); err == nil {
+				host = ip.String()
+			} else if n.IPv4 != "" {
+				continue // "none" disables IPv4
+			}
+			port := n.STUNPort
+			if port == 0 {
+				port = 3478
+			}
+			ua, err := net.ResolveUDPAddr("udp4", net.JoinHostPort(host, strconv.Itoa(port)))
+			if err != nil {
+				continue
+			}
+			tx := stun.NewTxID()
+			if _, err := pc.WriteTo(stun.Request(tx), ua); err != nil {
+				continue
+			}
+			sent[tx] = r.RegionCode
+			break
+		}
+	}
+	if len(sent) == 0 {
+		return "", addr, 0, errors.New("no STUN servers")
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		pc.SetReadDeadline(deadline)
+	}
+	buf := make([]byte, 1500)
+	for {
+		n, _, err := pc.ReadFrom(buf)
+		if err != nil {
+			return "", addr, 0, err
+		}
+		tx, addr, err := stun.ParseResponse(buf[:n])
+		if err != nil {
+			continue
+		}
+		if region, ok := sent[tx]; ok {
+			return region, addr, time.Since(start), nil
+		}
+	}
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// --- CONNECTION PRE-WARMING ---
+
+const (
+	prewarmWindow   = 5 * time.Minute // dials counted when ranking destinations
+	prewarmInterval = 5 * time.Second
+	prewarmBackoff  = time.Minute // a destination whose warm dial failed is left cold this long
+	prewarmTimeout  = 10 * time.Second
+)
+
+// PrewarmConfig is the prewarm section of the config file. The busiest
+// destinations get a few idle tailnet connections kept ready, so requests
+// from the UI don't wait for a dial.
+type PrewarmConfig struct {
+	Destinations int    `json:"destinations,omitempty"` // how many of the busiest destinations, default 5
+	Connections  int    `json:"connections,omitempty"`  // idle connections per destination, default 2
+	MinDials     int    `json:"min_dials,omitempty"`    // dials in the last 5 minutes before a destination is warmed, default 3
+	MaxIdle      string `json:"max_idle,omitempty"`     // idle connections are replaced after this, default 30s
+}
+
+func (c *PrewarmConfig) validate() error {
+	if c.Destinations < 0 || c.Connections < 0 || c.MinDials < 0 {
+		return fmt.Errorf("prewarm: destinations, connections and min_dials must not be negative")
+	}
+	if c.Connections > 16 {
+		return fmt.Errorf("prewarm.connections: at most 16 per destination, got %d", c.Connections)
+	}
+	if c.MaxIdle != "" {
+		if d, err := time.ParseDuration(c.MaxIdle); err != nil || d <= 0 {
+			return fmt.Errorf("prewarm.max_idle: invalid duration %q", c.MaxIdle)
+		}
+	}
+	return nil
+}
+
+// PrewarmStats is one destination in /stats/prewarm
+type PrewarmStats struct {
+	Destination string `json:"destination"`
+	RecentDials int    `json:"recent_dials"` // in the last 5 minutes
+	Warm        bool   `json:"warm"`         // among the destinations kept ready
+	Idle        int    `json:"idle"`         // connections ready right now
+	Hits        int64  `json:"hits"`         // dials served by a ready connection
+	Misses      int64  `json:"misses"`       // dials to a warm destination that found none ready
+}
+
+type idleConn struct {
+	conn  net.Conn
+	since time.Time
+}
+
+// warmDest is what the prewarmer knows about one destination
+type warmDest struct {
+	dials        []time.Time // within prewarmWindow, oldest first
+	idle         []idleConn  // oldest first
+	warm         bool
+	dialing      int
+	coldUntil    time.Time
+	hits, misses int64
+}
+
+// prewarmer ranks destinations by recent dials and keeps connections to the
+// busiest ones ready. Dials it can't serve go to Base.
+type prewarmer struct {
+	Base         Dialer
+	destinations int
+	connections  int
+	minDials     int
+	maxIdle      time.Duration
+
+	mu    sync.Mutex
+	dests map[string]*warmDest
+	now   func() time.Time // time.Now outside of tests
+}
+
+// prewarm is nil unless the config has a prewarm section
+var prewarm *prewarmer
+
+func newPrewarmer(base Dialer, cfg *PrewarmConfig) *prewarmer {
+	p := &prewarmer{
+		Base:         base,
+		destinations: cfg.Destinations,
+		connections:  cfg.Connections,
+		minDials:     cfg.MinDials,
+		maxIdle:      30 * time.Second,
+		dests:        map[string]*warmDest{},
+		now:          time.Now,
+	}
+	if p.destinations == 0 {
+		p.destinations = 5
+	}
+	if p.connections == 0 {
+		p.connections = 2
+	}
+	if p.minDials == 0 {
+		p.minDials = 3
+	}
+	if cfg.MaxIdle != "" {
+		p.maxIdle, _ = time.ParseDuration(cfg.MaxIdle)
+	}
+	return p
+}
+
+func (p *prewarmer) Dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	if network != "tcp" {
+		return p.Base.Dial(ctx, network, addr)
+	}
+	for retry := false; ; retry = true {
+		conn, ok := p.take(addr, !retry)
+		if !ok {
+			return p.Base.Dial(ctx, network, addr)
+		}
+		if live, ok := probe(conn); ok {
+			p.mu.Lock()
+			p.dests[addr].hits++
+			p.mu.Unlock()
+			return live, nil
+		}
+	}
+}
+
+// take pops the newest ready connection to addr, recording the dial first
+// unless it retries after a dead connection
+func (p *prewarmer) take(addr string, record bool) (net.Conn, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := p.now()
+	d, ok := p.dests[addr]
+	if !ok {
+		d = &warmDest{}
+		p.dests[addr] = d
+	}
+	if record {
+		d.dials = append(d.dials, now)
+	}
+	for n := len(d.idle); n > 0; n = len(d.idle) {
+		ic := d.idle[n-1]
+		d.idle = d.idle[:n-1]
+		if now.Sub(ic.since) < p.maxIdle {
+			return ic.conn, true
+		}
+		ic.conn.Close()
+	}
+	if d.warm {
+		d.misses++
+	}
+	return nil, false
+}
+
+// probe checks that the peer hasn't closed an idle connection. A server
+// that spoke first (a banner) keeps its byte.
+func probe(conn net.Conn) (net.Conn, bool) {
+	var b [1]byte
+	conn.SetReadDeadline(time.Now().Add(-time.Second))
+	n, err := conn.Read(b[:])
+	conn.SetReadDeadline(time.Time{})
+	if n == 1 {
+		return &prefixConn{Conn: conn, prefix: b[:1]}, true
+	}
+	var ne net.Error
+	if errors.As(err, &ne) && ne.Timeout() {
+		return conn, true
+	}
+	conn.Close()
+	return nil, false
+}
+
+// prefixConn returns bytes read ahead before reading from the connection
+type prefixConn struct {
+	net.Conn
+	prefix []byte
+}
+
+func (c *prefixConn) Read(b []byte) (int, error) {
+	if len(c.prefix) > 0 {
+		n := copy(b, c.prefix)
+		c.prefix = c.prefix[n:]
+		return n, nil
+	}
+	return c.Conn.Read(b)
+}
+
+// warm reranks the destinations, drops stale connections and tops up the
+// busiest destinations' ready connections
+func (p *prewarmer) warm(ctx context.Context) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := p.now()
+
+	var ranked []string
+	for addr, d := range p.dests {
+		cut := 0
+		for cut < len(d.dials) && now.Sub(d.dials[cut]) > prewarmWindow {
+			cut++
+		}
+		d.dials = d.dials[cut:]
+		for len(d.idle) > 0 && now.Sub(d.idle[0].since) >= p.maxIdle {
+			d.idle[0].conn.Close()
+			d.idle = d.idle[1:]
+		}
+		if len(d.dials) >= p.minDials {
+			ranked = append(ranked, addr)
+		} else if len(d.dials) == 0 && len(d.idle) == 0 && d.dialing == 0 {
+			delete(p.dests, addr)
+		}
+	}
+	slices.SortFunc(ranked, func(a, b string) int {
+		if n := len(p.dests[b].dials) - len(p.dests[a].dials); n != 0 {
+			return n
+		}
+		return strings.Compare(a, b)
+	})
+	hot := map[string]bool{}
+	for _, addr := range ranked[:min(len(ranked), p.destinations)] {
+		hot[addr] = true
+	}
+
+	for addr, d := range p.dests {
+		d.warm = hot[addr]
+		if !d.warm {
+			for _, ic := range d.idle {
+				ic.conn.Close()
+			}
+			d.idle = nil
+			continue
+		}
+		if now.Before(d.coldUntil) {
+			continue
+		}
+		for need := p.connections - len(d.idle) - d.dialing; need > 0; need-- {
+			d.dialing++
+			go p.dialWarm(ctx, addr)
+		}
+	}
+}
+
+// dialWarm opens one ready connection to addr
+func (p *prewarmer) dialWarm(ctx context.Context, addr string) {
+	ctx, cancel := context.WithTimeout(ctx, prewarmTimeout)
+	defer cancel()
+	conn, err := p.Base.Dial(ctx, "tcp", addr)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	d, ok := p.dests[addr]
+	if ok {
+		d.dialing--
+	}
+	switch {
+	case err != nil:
+		if ok {
+			d.coldUntil = p.now().Add(prewarmBackoff)
+		}
+		fmt.Fprintf(console, "[PREWARM] %s: %v, retrying in %s\n", addr, err, prewarmBackoff)
+	case !ok || !d.warm:
+		conn.Close()
+	default:
+		d.idle = append(d.idle, idleConn{conn: conn, since: p.now()})
+	}
+}
+
+// run rewarms every prewarmInterval until ctx is done
+func (p *prewarmer) run(ctx context.Context) {
+	ticker := time.NewTicker(prewarmInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			p.warm(ctx)
+		}
+	}
+}
+
+// stats lists the destinations dialed recently, busiest first
+func (p *prewarmer) stats() []PrewarmStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	list := make([]PrewarmStats, 0, len(p.dests))
+	for addr, d := range p.dests {
+		list = append(list, PrewarmStats{
+			Destination: addr,
+			RecentDials: len(d.dials),
+			Warm:        d.warm,
+			Idle:        len(d.idle),
+			Hits:        d.hits,
+			Misses:      d.misses,
+		})
+	}
+	slices.SortFunc(list, func(a, b PrewarmStats) int {
+		if n := b.RecentDials - a.RecentDials; n != 0 {
+			return n
+		}
+		return strings.Compare(a.Destination, b.Destination)
+	})
+	return list
+}
+
+// handlePrewarmStats serves the pre-warming state on the status API
+func handlePrewarmStats(w http.ResponseWriter, r *http.Request) {
+	if prewarm == nil {
+		http.Error(w, "no prewarm section in the config", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(prewarm.stats())
+}
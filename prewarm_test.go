@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPrewarmer(t *testing.T) {
+	var mu sync.Mutex
+	var dials []string
+	var servers []net.Conn
+	base := &MockDialer{DialFunc: func(ctx context.Context, network, addr string) (net.Conn, error) {
+		client, server := net.Pipe()
+		mu.Lock()
+		defer mu.Unlock()
+		dials = append(dials, addr)
+		servers = append(servers, server)
+		return client, nil
+	}}
+	dialCount := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(dials)
+	}
+	p := newPrewarmer(base, &PrewarmConfig{Destinations: 1, Connections: 2, MinDials: 2})
+	now := time.Now()
+	p.now = func() time.Time { return now }
+	waitIdle := func(addr string, want int) {
+		t.Helper()
+		deadline := time.Now().Add(2 * time.Second)
+		for time.Now().Before(deadline) {
+			for _, st := range p.stats() {
+				if st.Destination == addr && st.Idle == want {
+					return
+				}
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+		t.Fatalf("Expected %d idle connections to %s, got %+v", want, addr, p.stats())
+	}
+
+	// The busiest destination above min_dials is warmed, the other isn't
+	for _, addr := range []string{"ui-backend:8080", "ui-backend:8080", "ui-backend:8080", "db:5432", "db:5432"} {
+		conn, err := p.Dial(context.Background(), "tcp", addr)
+		if err != nil {
+			t.Fatalf("Dial failed: %v", err)
+		}
+		conn.Close()
+	}
+	p.warm(context.Background())
+	waitIdle("ui-backend:8080", 2)
+	if n := dialCount(); n != 7 {
+		t.Errorf("Expected 5 dials plus 2 warm ones, got %d", n)
+	}
+
+	conn, err := p.Dial(context.Background(), "tcp", "ui-backend:8080")
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	if n := dialCount(); n != 7 {
+		t.Errorf("Expected a ready connection to be used, got %d dials", n)
+	}
+	conn.Close()
+
+	// A connection the server closed is skipped
+	mu.Lock()
+	servers[5].Close()
+	servers[6].Close()
+	mu.Unlock()
+	if _, err := p.Dial(context.Background(), "tcp", "ui-backend:8080"); err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	if n := dialCount(); n != 8 {
+		t.Errorf("Expected a fresh dial after the ready connection died, got %d dials", n)
+	}
+
+	st := p.stats()[0]
+	if st.Destination != "ui-backend:8080" || !st.Warm || st.RecentDials != 5 || st.Hits != 1 || st.Misses != 1 {
+		t.Errorf("Unexpected stats %+v", st)
+	}
+
+	// Destinations cool down once their dials leave the window
+	p.warm(context.Background())
+	waitIdle("ui-backend:8080", 2)
+	now = now.Add(prewarmWindow + time.Second)
+	p.warm(context.Background())
+	if list := p.stats(); len(list) != 0 {
+		t.Errorf("Expected every destination to be forgotten, got %+v", list)
+	}
+}
+
+func TestProbeKeepsBanner(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	go server.Write([]byte("SSH-2.0-OpenSSH\r\n"))
+	time.Sleep(10 * time.Millisecond)
+
+	conn, ok := probe(client)
+	if !ok {
+		t.Fatal("Expected a live connection")
+	}
+	defer conn.Close()
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "SSH-" {
+		t.Errorf("Expected the banner to be intact, got %q, %v", buf, err)
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"slices"
+	"strconv"
+	"sync"
+)
+
+// --- PRIVILEGED PORTS ---
+
+// Apps that insist on http://127.0.0.1:80 or :443 need a listener the
+// sidecar, running as a normal user, may not be allowed to bind. Either the
+// binary gets the right to (setcap on Linux), or a service manager binds
+// the port and passes the socket on: systemd's LISTEN_FDS, which other
+// supervisors speak too, or launchd's Sockets. An -upgrade passes sockets
+// the same way.
+
+// launchdSocketName is the key under Sockets in a launchd job whose
+// sockets the sidecar takes over
+const launchdSocketName = "Listeners"
+
+// inheritedSet holds the listeners passed in by socket activation, by the
+// address they are bound to. listenClients takes them instead of binding.
+type inheritedSet struct {
+	mu  sync.Mutex
+	lns []*inheritedListener
+}
+
+var inherited = &inheritedSet{}
+
+// inheritedListener is shared by every accept loop of its address, and
+// leaves the set once closed, since it can't be bound again
+type inheritedListener struct {
+	net.Listener
+	set *inheritedSet
+}
+
+func (l *inheritedListener) Close() error {
+	l.set.mu.Lock()
+	l.set.lns = slices.DeleteFunc(l.set.lns, func(o *inheritedListener) bool { return o == l })
+	l.set.mu.Unlock()
+	return l.Listener.Close()
+}
+
+// load takes over the sockets passed by systemd (LISTEN_FDS, when
+// LISTEN_PID is this process) and launchd, and returns their addresses.
+// The variables are removed so commands run by exec don't see them.
+func (s *inheritedSet) load(lookup func(string) (string, bool)) ([]string, error) {
+	var lns []net.Listener
+	if n, ok := lookup("LISTEN_FDS"); ok {
+		pid, hasPID := lookup("LISTEN_PID")
+		count, err := strconv.Atoi(n)
+		if err != nil || count < 0 {
+			return nil, fmt.Errorf("invalid LISTEN_FDS %q", n)
+		}
+		if !hasPID || pid == strconv.Itoa(os.Getpid()) {
+			// Passed descriptors start after stdin, stdout and stderr
+			for fd := 3; fd < 3+count; fd++ {
+				ln, err := fileListener(uintptr(fd))
+				if err != nil {
+					return nil, fmt.Errorf("LISTEN_FDS descriptor %d: %w", fd, err)
+				}
+				lns = append(lns, ln)
+			}
+		}
+		for _, name := range []string{"LISTEN_FDS", "LISTEN_PID", "LISTEN_FDNAMES"} {
+			os.Unsetenv(name)
+		}
+	}
+	fromLaunchd, err := launchdListeners()
+	if err != nil {
+		return nil, fmt.Errorf("launchd socket %q: %w", launchdSocketName, err)
+	}
+	lns = append(lns, fromLaunchd...)
+
+	var addrs []string
+	for _, ln := range lns {
+		s.add(ln)
+		addrs = append(addrs, ln.Addr().String())
+	}
+	return addrs, nil
+}
+
+// add makes ln available to listenClients for its address
+func (s *inheritedSet) add(ln net.Listener) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lns = append(s.lns, &inheritedListener{Listener: ln, set: s})
+}
+
+// fileListener turns a passed descriptor into a listener
+func fileListener(fd uintptr) (net.Listener, error) {
+	f := os.NewFile(fd, "socket-"+strconv.Itoa(int(fd)))
+	if f == nil {
+		return nil, errors.New("not a valid descriptor")
+	}
+	defer f.Close() // FileListener holds a copy
+	return net.FileListener(f)
+}
+
+// take returns the inherited listener bound to addr, or nil
+func (s *inheritedSet) take(addr string) net.Listener {
+	want, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, ln := range s.lns {
+		got, ok := ln.Addr().(*net.TCPAddr)
+		if ok && got.Port == want.Port && got.IP.Equal(want.IP) {
+			return ln
+		}
+	}
+	return nil
+}
+
+// explainBind adds what to do to a bind refused for a port below 1024
+func explainBind(addr string, err error) error {
+	if err == nil || !errors.Is(err, os.ErrPermission) {
+		return err
+	}
+	_, p, _ := net.SplitHostPort(addr)
+	if port, _ := strconv.Atoi(p); port == 0 || port >= 1024 {
+		return err
+	}
+	return fmt.Errorf("%w; %s", err, privilegedPortAdvice())
+}
@@ -0,0 +1,18 @@
+//go:build darwin
+
+package main
+
+import "os"
+
+// privilegedPortAccess reports whether this process may bind port. Since
+// macOS 10.14 anyone may bind any port; older versions need root.
+func privilegedPortAccess(port int) (bool, string) {
+	if os.Geteuid() == 0 {
+		return true, "running as root"
+	}
+	return true, "macOS 10.14 and later let anyone bind ports below 1024"
+}
+
+func privilegedPortAdvice() string {
+	return "run the sidecar as a launchd daemon, or let launchd bind the port and pass it in the job's Sockets under \"" + launchdSocketName + "\""
+}
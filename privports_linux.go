@@ -0,0 +1,62 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// capNetBindService is the bit of CAP_NET_BIND_SERVICE in CapEff
+const capNetBindService = 10
+
+// unprivilegedPortStart reads the lowest port anyone may bind (1024
+// unless lowered)
+func unprivilegedPortStart() int {
+	data, err := os.ReadFile("/proc/sys/net/ipv4/ip_unprivileged_port_start")
+	if err != nil {
+		return 1024
+	}
+	start, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return 1024
+	}
+	return start
+}
+
+// hasCapability reports whether bit is in the effective capabilities of
+// the process, as listed in /proc/self/status
+func hasCapability(status string, bit uint) bool {
+	for line := range strings.SplitSeq(status, "\n") {
+		if hex, ok := strings.CutPrefix(line, "CapEff:"); ok {
+			caps, err := strconv.ParseUint(strings.TrimSpace(hex), 16, 64)
+			return err == nil && caps&(1<<bit) != 0
+		}
+	}
+	return false
+}
+
+// privilegedPortAccess reports whether this process may bind port, and why
+func privilegedPortAccess(port int) (bool, string) {
+	if start := unprivilegedPortStart(); port >= start {
+		return true, fmt.Sprintf("net.ipv4.ip_unprivileged_port_start is %d", start)
+	}
+	if os.Geteuid() == 0 {
+		return true, "running as root"
+	}
+	if status, err := os.ReadFile("/proc/self/status"); err == nil && hasCapability(string(status), capNetBindService) {
+		return true, "CAP_NET_BIND_SERVICE is set"
+	}
+	return false, "ports below " + strconv.Itoa(unprivilegedPortStart()) + " need root or CAP_NET_BIND_SERVICE"
+}
+
+func privilegedPortAdvice() string {
+	exe, err := os.Executable()
+	if err != nil {
+		exe = "arkitekt-sidecar"
+	}
+	return fmt.Sprintf("give the binary the right with 'sudo setcap cap_net_bind_service=+ep %s', "+
+		"lower net.ipv4.ip_unprivileged_port_start, or pass the socket with systemd socket activation", exe)
+}
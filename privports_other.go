@@ -0,0 +1,23 @@
+//go:build !linux && !darwin
+
+package main
+
+import (
+	"os"
+	"runtime"
+)
+
+// privilegedPortAccess reports whether this process may bind port
+func privilegedPortAccess(port int) (bool, string) {
+	switch {
+	case runtime.GOOS == "windows":
+		return true, "Windows has no privileged ports"
+	case os.Geteuid() == 0:
+		return true, "running as root"
+	}
+	return false, "ports below 1024 need root"
+}
+
+func privilegedPortAdvice() string {
+	return "run the sidecar as root, or let a supervisor bind the port and pass it with LISTEN_FDS"
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestInheritedListeners(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	set := &inheritedSet{}
+	set.lns = []*inheritedListener{{Listener: ln, set: set}}
+	port := ln.Addr().(*net.TCPAddr).Port
+
+	if set.take(fmt.Sprintf("127.0.0.2:%d", port)) != nil || set.take("127.0.0.1:1") != nil {
+		t.Errorf("Expected other addresses not to match")
+	}
+	got := set.take(fmt.Sprintf("127.0.0.1:%d", port))
+	if got == nil || set.take(fmt.Sprintf("127.0.0.1:%d", port)) != got {
+		t.Fatalf("Expected the listener for every accept loop")
+	}
+	got.Close()
+	if set.take(fmt.Sprintf("127.0.0.1:%d", port)) != nil {
+		t.Errorf("Expected a closed listener to leave the set")
+	}
+
+	// Descriptors meant for another process are left alone
+	t.Setenv("LISTEN_FDS", "1")
+	t.Setenv("LISTEN_PID", "1")
+	addrs, err := set.load(os.LookupEnv)
+	if err != nil || len(addrs) != 0 {
+		t.Errorf("Expected nothing loaded, got %v, %v", addrs, err)
+	}
+	if _, ok := os.LookupEnv("LISTEN_FDS"); ok {
+		t.Errorf("Expected LISTEN_FDS to be removed")
+	}
+	if _, err := set.load(testEnv(map[string]string{"LISTEN_FDS": "x"})); err == nil {
+		t.Errorf("Expected an invalid LISTEN_FDS to be rejected")
+	}
+}
+
+func TestExplainBind(t *testing.T) {
+	denied := &net.OpError{Op: "listen", Net: "tcp", Err: os.NewSyscallError("bind", syscall.EACCES)}
+	err := explainBind("127.0.0.1:80", denied)
+	if err == nil || !strings.Contains(err.Error(), privilegedPortAdvice()) {
+		t.Errorf("Expected advice for port 80, got %v", err)
+	}
+	if classifyError(err, CodeListenFailed) != CodePermissionDenied {
+		t.Errorf("Expected the code to survive, got %s", classifyError(err, CodeListenFailed))
+	}
+	if err := explainBind("127.0.0.1:8080", denied); err != denied {
+		t.Errorf("Expected no advice for port 8080, got %v", err)
+	}
+	inUse := &net.OpError{Op: "listen", Net: "tcp", Err: os.NewSyscallError("bind", syscall.EADDRINUSE)}
+	if err := explainBind("127.0.0.1:80", inUse); err != inUse {
+		t.Errorf("Expected no advice for a port in use, got %v", err)
+	}
+}
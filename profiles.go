@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// --- CONFIG INCLUDES AND PROFILES ---
+
+// maxIncludeDepth bounds nested includes
+const maxIncludeDepth = 8
+
+// readConfigDoc reads a config file and the files it includes. Included
+// files are merged first, in order, and the including file over them, so a
+// lab's file only holds what differs from the shared one.
+func readConfigDoc(path string, lookup func(string) (string, bool), chain []string) (map[string]any, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	if slices.Contains(chain, abs) {
+		return nil, fmt.Errorf("%s includes itself (%s)", path, strings.Join(append(chain, abs), " -> "))
+	}
+	if len(chain) >= maxIncludeDepth {
+		return nil, fmt.Errorf("%s: includes nested deeper than %d", path, maxIncludeDepth)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	doc, err := parseChecked(data, lookup)
+	if err != nil {
+		if len(chain) > 0 {
+			return nil, fmt.Errorf("%s: %w", path, err) // name the included file
+		}
+		return nil, err
+	}
+
+	includes, _ := doc["include"].([]any)
+	delete(doc, "include")
+	merged := map[string]any{}
+	for _, inc := range includes {
+		name, _ := inc.(string)
+		if !filepath.IsAbs(name) {
+			name = filepath.Join(filepath.Dir(path), name)
+		}
+		included, err := readConfigDoc(name, lookup, append(chain, abs))
+		if err != nil {
+			return nil, err
+		}
+		mergeDoc(merged, included)
+	}
+	mergeDoc(merged, doc)
+	return merged, nil
+}
+
+// mergeDoc merges src over dst. Objects are merged key by key; lists and
+// values replace what was there, so a profile's routes are its routes. An
+// explicit null resets a setting.
+func mergeDoc(dst, src map[string]any) {
+	for k, v := range src {
+		sub, isObj := v.(map[string]any)
+		base, baseObj := dst[k].(map[string]any)
+		if isObj && baseObj {
+			mergeDoc(base, sub)
+			continue
+		}
+		dst[k] = v
+	}
+}
+
+// applyProfile merges the named profile, and the ones it extends, over doc
+// and drops the profiles section. An empty name only drops it.
+func applyProfile(doc map[string]any, name string) error {
+	profiles, _ := doc["profiles"].(map[string]any)
+	delete(doc, "profiles")
+	if name == "" {
+		return nil
+	}
+	var stack []map[string]any
+	var seen []string
+	for next, from := name, ""; next != ""; {
+		if slices.Contains(seen, next) {
+			return fmt.Errorf("profile %q extends itself (%s)", name, strings.Join(append(seen, next), " -> "))
+		}
+		p, ok := profiles[next].(map[string]any)
+		if !ok {
+			if from == "" {
+				return fmt.Errorf("unknown profile %q (the config has %s)", name, profileNames(profiles))
+			}
+			return fmt.Errorf("profiles.%s: extends unknown profile %q", from, next)
+		}
+		seen = append(seen, next)
+		stack = append(stack, p)
+		from = next
+		next, _ = p["extends"].(string)
+	}
+	// The most basic profile goes first
+	for _, p := range slices.Backward(stack) {
+		p = maps.Clone(p)
+		delete(p, "extends")
+		mergeDoc(doc, p)
+	}
+	return nil
+}
+
+// profileNames lists the profiles for an error message
+func profileNames(profiles map[string]any) string {
+	if len(profiles) == 0 {
+		return "none"
+	}
+	return strings.Join(slices.Sorted(maps.Keys(profiles)), ", ")
+}
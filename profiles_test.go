@@ -0,0 +1,69 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestConfigIncludesAndProfiles(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatalf("Failed to write %s: %v", name, err)
+		}
+		return path
+	}
+	write("common.json", `{
+		"services": {"core": "arkitekt-core:8000", "minio": "minio:9000"},
+		"redact": ["secret-[a-z]+"],
+		"routes": [{"host": "workers", "targets": ["worker-1"]}]
+	}`)
+	path := write("lab.json", `{
+		"include": ["common.json"],
+		"services": {"minio": "minio-b2:9000"},
+		"profiles": {
+			"gpu": {"routes": [{"host": "workers", "targets": ["gpu-1", "gpu-2"]}]},
+			"lab-b": {"extends": "gpu", "services": {"core": "core-b:8000"}, "redact": null}
+		}
+	}`)
+
+	cfg, err := loadConfig(path, "")
+	if err != nil {
+		t.Fatalf("loadConfig failed: %v", err)
+	}
+	if cfg.Services["core"] != "arkitekt-core:8000" || cfg.Services["minio"] != "minio-b2:9000" || len(cfg.Redact) != 1 {
+		t.Errorf("Expected the include merged under the file, got %+v", cfg)
+	}
+
+	cfg, err = loadConfig(path, "lab-b")
+	if err != nil {
+		t.Fatalf("loadConfig failed: %v", err)
+	}
+	if cfg.Services["core"] != "core-b:8000" || cfg.Services["minio"] != "minio-b2:9000" {
+		t.Errorf("Expected the profile merged over the file, got %v", cfg.Services)
+	}
+	if len(cfg.Routes) != 1 || len(cfg.Routes[0].Targets) != 2 || cfg.Redact != nil {
+		t.Errorf("Expected lists replaced and null to reset, got %+v", cfg)
+	}
+
+	for _, tc := range []struct {
+		content, profile, want string
+	}{
+		{`{}`, "lab-a", `unknown profile "lab-a" (the config has none)`},
+		{`{"profiles": {"a": {"extends": "b"}}}`, "a", `profiles.a: extends unknown profile "b"`},
+		{`{"profiles": {"a": {"extends": "b"}, "b": {"extends": "a"}}}`, "a", "a -> b -> a"},
+		{`{"profiles": {"a": {"include": ["x.json"]}}}`, "a", `profiles.a: unknown field "include"`},
+		{`{"include": ["lab.json"], "profiles": {"b": {}}}`, "", "includes itself"},
+		{`{"include": ["broken.json"]}`, "", "broken.json: routes: expected a list"},
+		{`{"include": ["missing.json"]}`, "", "missing.json"},
+	} {
+		write("broken.json", `{"routes": {}}`)
+		_, err := loadConfig(write("lab.json", tc.content), tc.profile)
+		if err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("%s with %q: expected %q, got %v", tc.content, tc.profile, tc.want, err)
+		}
+	}
+}
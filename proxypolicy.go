@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+)
+
+// --- PROXY POLICIES ---
+
+// ProxyPolicy is a session defined in the config file instead of created
+// by the parent. Applications select it with their SOCKS5 user name (or
+// proxy credentials), so several of them can share one proxy port with
+// their own routes and limits. With a secret, the name alone isn't enough.
+type ProxyPolicy struct {
+	Allow          []string    `json:"allow,omitempty"`           // host patterns, see compileHosts; everything if empty
+	Routes         []RouteRule `json:"routes,omitempty"`          // tried before the top-level routes
+	QuotaBytes     int64       `json:"quota_bytes,omitempty"`     // both directions since startup, 0 = unlimited
+	MaxConnections int         `json:"max_connections,omitempty"` // open at once, 0 = unlimited
+	Secret         string      `json:"secret,omitempty"`          // password clients must give with the name; none if empty
+}
+
+func validatePolicies(policies map[string]ProxyPolicy) error {
+	for name, p := range policies {
+		if !validRequestID(name) {
+			return fmt.Errorf("policies: invalid name %q (letters, digits, '-', '_' or '.')", name)
+		}
+		if p.QuotaBytes < 0 || p.MaxConnections < 0 {
+			return fmt.Errorf("policies.%s: quota_bytes and max_connections can't be negative", name)
+		}
+		if _, err := compileHosts(p.Allow); err != nil {
+			return fmt.Errorf("policies.%s.allow: %w", name, err)
+		}
+		for i, r := range p.Routes {
+			if err := r.validate(); err != nil {
+				return fmt.Errorf("policies.%s.routes[%d]: %w", name, i, err)
+			}
+		}
+	}
+	return nil
+}
+
+// policyRoutes puts a policy's routes in front of the top-level ones
+func policyRoutes(p ProxyPolicy, routes []RouteRule) []RouteRule {
+	return append(slices.Clone(p.Routes), routes...)
+}
+
+// startPolicies adds a session for every policy, dialing through a router
+// of its own built on top of router
+func startPolicies(t *sessionTable, policies map[string]ProxyPolicy, router *Router, routes []RouteRule) error {
+	names := make([]string, 0, len(policies))
+	for name := range policies {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		p := policies[name]
+		allow := p.Allow
+		if len(allow) == 0 {
+			allow = []string{"*"}
+		}
+		s, err := t.create(SessionSpec{ID: name, Allow: allow, QuotaBytes: p.QuotaBytes, MaxConnections: p.MaxConnections})
+		if err != nil {
+			return fmt.Errorf("policy %s: %w", name, err)
+		}
+		s.secret = p.Secret
+		router.mu.RLock()
+		services := router.Services
+		router.mu.RUnlock()
+		s.router = newRouter(router.Base, policyRoutes(p, routes), router.online)
+		s.router.Services = services
+		fmt.Fprintf(console, ">>> Policy %s: %d routes of its own, allow=%v\n", name, len(p.Routes), allow)
+	}
+	return nil
+}
+
+// reloadPolicies applies reloaded routes and services to the policies that
+// are still in the config. New or removed policies need a restart.
+func reloadPolicies(t *sessionTable, policies map[string]ProxyPolicy, routes []RouteRule, services map[string]string) {
+	for name, p := range policies {
+		if s := t.get(name); s != nil && s.router != nil {
+			s.router.reload(policyRoutes(p, routes), services)
+		}
+	}
+}
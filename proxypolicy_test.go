@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestValidatePolicies(t *testing.T) {
+	for _, policies := range []map[string]ProxyPolicy{
+		{"bad name": {}},
+		{"imaging": {QuotaBytes: -1}},
+		{"imaging": {Routes: []RouteRule{{Host: "minio"}}}},
+	} {
+		if err := validatePolicies(policies); err == nil {
+			t.Errorf("Expected %+v to be rejected", policies)
+		}
+	}
+}
+
+func TestProxyPolicies(t *testing.T) {
+	var dialed []string
+	base := &MockDialer{DialFunc: func(ctx context.Context, network, addr string) (net.Conn, error) {
+		dialed = append(dialed, addr)
+		client, server := net.Pipe()
+		go io.Copy(io.Discard, server)
+		return client, nil
+	}}
+	top := []RouteRule{{Host: "minio:9000", PoolConfig: PoolConfig{Targets: []string{"minio-1:9000"}}}}
+	router := newRouter(base, top, nil)
+	d := &sessionDialer{Base: router}
+	table := &sessionTable{sessions: map[string]*session{}}
+	table.dialVia(d.Dial)
+
+	policies := map[string]ProxyPolicy{
+		"imaging": {Routes: []RouteRule{{Host: "minio:9000", PoolConfig: PoolConfig{Targets: []string{"minio-fast:9000"}}}}, MaxConnections: 64},
+		"plugins": {Allow: []string{"data-node"}, Secret: "s3cret"},
+	}
+	captureStdout(t, func() {
+		if err := startPolicies(table, policies, router, top); err != nil {
+			t.Fatalf("startPolicies failed: %v", err)
+		}
+	})
+	dial := func(policy, addr string) error {
+		conn, err := d.Dial(withSession(context.Background(), table.get(policy)), "tcp", addr)
+		if err == nil {
+			conn.Close()
+		}
+		return err
+	}
+
+	// The policy's routes come first, the top-level ones still apply to the rest
+	if err := dial("imaging", "minio:9000"); err != nil || dialed[len(dialed)-1] != "minio-fast:9000" {
+		t.Errorf("Expected the imaging route, got %v %v", dialed, err)
+	}
+	if err := dial("plugins", "minio:9000"); !isSessionDenied(err) {
+		t.Errorf("Expected plugins to be limited to its allow list, got %v", err)
+	}
+	if err := dial("plugins", "data-node:80"); err != nil || dialed[len(dialed)-1] != "data-node:80" {
+		t.Errorf("Expected data-node to be allowed, got %v %v", dialed, err)
+	}
+	if conn, err := d.Dial(context.Background(), "tcp", "minio:9000"); err != nil || dialed[len(dialed)-1] != "minio-1:9000" {
+		t.Errorf("Expected clients without a policy to use the top-level route, got %v %v", dialed, err)
+	} else {
+		conn.Close()
+	}
+	if !table.Valid("imaging", "") || !table.get("imaging").status().Policy {
+		t.Errorf("Expected the policy to be a valid SOCKS5 user")
+	}
+	if table.Valid("plugins", "") || !table.Valid("plugins", "s3cret") {
+		t.Errorf("Expected a policy with a secret to need it as the password")
+	}
+
+	// Reloads replace the routes of the policies still in the config
+	reloadPolicies(table, map[string]ProxyPolicy{"imaging": {}}, nil, nil)
+	if err := dial("imaging", "minio:9000"); err != nil || dialed[len(dialed)-1] != "minio:9000" {
+		t.Errorf("Expected the reloaded routes, got %v %v", dialed, err)
+	}
+
+	// Policies can't be deleted through the API
+	old := sessions
+	sessions = table
+	defer func() { sessions = old }()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/control/sessions/{id}", handleSession)
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest("DELETE", "/control/sessions/imaging", nil))
+	if rec.Code != http.StatusForbidden || !strings.Contains(rec.Body.String(), "policy") || table.get("imaging") == nil {
+		t.Errorf("Expected deleting a policy to be refused, got %d %s", rec.Code, rec.Body)
+	}
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// --- PROXY PROTOCOL ---
+
+// A local load balancer in front of the sidecar hides the client's address
+// behind its own. With -proxy-protocol it sends a PROXY protocol header
+// (v1 or v2) first, and the sidecar takes the client address from there.
+// Routes with proxy_protocol pass it on to tailnet services the same way.
+
+// ProxyProtocolV2 is the only version routes send
+const ProxyProtocolV2 = "v2"
+
+// proxyHeaderTimeout bounds the wait for the header of a client connection
+const proxyHeaderTimeout = 5 * time.Second
+
+// acceptProxyHeader is -proxy-protocol
+var acceptProxyHeader bool
+
+// defaultProxyHeaderFrom is where headers are accepted from unless
+// -proxy-protocol-from says otherwise: a balancer on the same machine
+const defaultProxyHeaderFrom = "127.0.0.0/8,::1"
+
+// proxyHeaderFrom is -proxy-protocol-from, compiled. Anyone else could
+// claim any client address, so their connections are closed.
+var proxyHeaderFrom *hostSet
+
+// proxySigV2 starts every v2 header
+var proxySigV2 = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// errNoProxyHeader is returned for client connections that don't start
+// with a PROXY protocol header
+var errNoProxyHeader = errors.New("no PROXY protocol header")
+
+// readProxyHeader reads a v1 or v2 header from br. It returns the client
+// and destination addresses, or nil ones for a header that carries none
+// (v1 UNKNOWN, v2 LOCAL or an address family other than TCP).
+func readProxyHeader(br *bufio.Reader) (src, dst net.Addr, err error) {
+	if sig, err := br.Peek(len(proxySigV2)); err == nil && bytes.Equal(sig, proxySigV2) {
+		return readProxyHeaderV2(br)
+	}
+	if start, err := br.Peek(6); err != nil || string(start) != "PROXY " {
+		return nil, nil, errNoProxyHeader
+	}
+	return readProxyHeaderV1(br)
+}
+
+func readProxyHeaderV1(br *bufio.Reader) (net.Addr, net.Addr, error) {
+	// A v1 line is at most 107 bytes including CRLF
+	var line []byte
+	for len(line) < 107 {
+		b, err := br.ReadByte()
+		if err != nil {
+			return nil, nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	text, ok := strings.CutSuffix(string(line), "\r\n")
+	if !ok {
+		return nil, nil, errors.New("PROXY v1 header too long")
+	}
+	fields := strings.Fields(text)
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, nil, fmt.Errorf("malformed PROXY v1 header %q", text)
+	}
+	src, err1 := v1Addr(fields[2], fields[4])
+	dst, err2 := v1Addr(fields[3], fields[5])
+	if err := errors.Join(err1, err2); err != nil {
+		return nil, nil, fmt.Errorf("malformed PROXY v1 header %q: %w", text, err)
+	}
+	return src, dst, nil
+}
+
+func v1Addr(ip, port string) (net.Addr, error) {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return nil, err
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, err
+	}
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(addr, uint16(p))), nil
+}
+
+func readProxyHeaderV2(br *bufio.Reader) (net.Addr, net.Addr, error) {
+	var head [16]byte
+	if _, err := io.ReadFull(br, head[:]); err != nil {
+		return nil, nil, err
+	}
+	if head[12]>>4 != 2 {
+		return nil, nil, fmt.Errorf("unsupported PROXY protocol version %d", head[12]>>4)
+	}
+	body := make([]byte, binary.BigEndian.Uint16(head[14:]))
+	if _, err := io.ReadFull(br, body); err != nil {
+		return nil, nil, err
+	}
+	if head[12]&0x0f == 0 {
+		// LOCAL: the balancer's own connection, e.g. a health check
+		return nil, nil, nil
+	}
+	var size int
+	switch head[13] {
+	case 0x11: // TCP over IPv4
+		size = 4
+	case 0x21: // TCP over IPv6
+		size = 16
+	default:
+		return nil, nil, nil
+	}
+	if len(body) < 2*size+4 {
+		return nil, nil, errors.New("PROXY v2 header too short for its addresses")
+	}
+	srcIP, _ := netip.AddrFromSlice(body[:size])
+	dstIP, _ := netip.AddrFromSlice(body[size : 2*size])
+	srcPort := binary.BigEndian.Uint16(body[2*size:])
+	dstPort := binary.BigEndian.Uint16(body[2*size+2:])
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(srcIP, srcPort)),
+		net.TCPAddrFromAddrPort(netip.AddrPortFrom(dstIP, dstPort)), nil
+}
+
+// proxyHeaderV2 builds the v2 header for a connection from client to
+// target. Without two addresses of the same family it is a LOCAL header.
+func proxyHeaderV2(client, target string) []byte {
+	h := append([]byte(nil), proxySigV2...)
+	src, err1 := netip.ParseAddrPort(client)
+	dst, err2 := netip.ParseAddrPort(target)
+	if err1 != nil || err2 != nil {
+		return append(h, 0x20, 0x00, 0, 0)
+	}
+	srcIP, dstIP := src.Addr().Unmap(), dst.Addr().Unmap()
+	if srcIP.Is4() && dstIP.Is4() {
+		h = append(h, 0x21, 0x11, 0, 12)
+		h = append(h, srcIP.AsSlice()...)
+		h = append(h, dstIP.AsSlice()...)
+	} else {
+		s, d := srcIP.As16(), dstIP.As16()
+		h = append(h, 0x21, 0x21, 0, 36)
+		h = append(h, s[:]...)
+		h = append(h, d[:]...)
+	}
+	h = binary.BigEndian.AppendUint16(h, src.Port())
+	return binary.BigEndian.AppendUint16(h, dst.Port())
+}
+
+// sendProxyHeader writes the v2 header for the client dialing through ctx
+// to a freshly dialed tailnet connection
+func sendProxyHeader(ctx context.Context, conn net.Conn) error {
+	client, _ := ctx.Value(clientAddrKey{}).(string)
+	_, err := conn.Write(proxyHeaderV2(client, conn.RemoteAddr().String()))
+	return err
+}
+
+// proxyConn is a client connection behind a load balancer. The header is
+// read on first use, so a slow balancer doesn't hold up Accept.
+type proxyConn struct {
+	net.Conn
+	br       *bufio.Reader
+	once     sync.Once
+	src, dst net.Addr
+	err      error
+}
+
+func (c *proxyConn) init() {
+	c.once.Do(func() {
+		c.Conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+		c.src, c.dst, c.err = readProxyHeader(c.br)
+		c.Conn.SetReadDeadline(time.Time{})
+		if c.err != nil {
+			fmt.Fprintf(console, "!!! Dropping %s: %v\n", c.Conn.RemoteAddr(), c.err)
+			c.Conn.Close()
+		}
+	})
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) {
+	if c.init(); c.err != nil {
+		return 0, c.err
+	}
+	return c.br.Read(b)
+}
+
+// RemoteAddr is the client's address from the header
+func (c *proxyConn) RemoteAddr() net.Addr {
+	if c.init(); c.src != nil {
+		return c.src
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// LocalAddr is the address the client connected to, from the header
+func (c *proxyConn) LocalAddr() net.Addr {
+	if c.init(); c.dst != nil {
+		return c.dst
+	}
+	return c.Conn.LocalAddr()
+}
+
+// NetConn returns the balancer's socket
+func (c *proxyConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// proxyListener expects a PROXY protocol header on every connection, and
+// only takes connections from the balancers in from
+type proxyListener struct {
+	net.Listener
+	from *hostSet
+}
+
+func (l proxyListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		if !l.from.match(conn.RemoteAddr().String()) {
+			fmt.Fprintf(console, "!!! Dropping %s: PROXY protocol headers are only accepted from -proxy-protocol-from\n", conn.RemoteAddr())
+			conn.Close()
+			continue
+		}
+		return &proxyConn{Conn: conn, br: bufio.NewReader(conn)}, nil
+	}
+}
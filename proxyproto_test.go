@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadProxyHeader(t *testing.T) {
+	for _, tc := range []struct {
+		header   string
+		src, dst string
+	}{
+		{"PROXY TCP4 192.0.2.10 127.0.0.1 50312 8080\r\n", "192.0.2.10:50312", "127.0.0.1:8080"},
+		{"PROXY TCP6 2001:db8::1 ::1 50312 8080\r\n", "[2001:db8::1]:50312", "[::1]:8080"},
+		{"PROXY UNKNOWN\r\n", "", ""},
+		{string(proxyHeaderV2("192.0.2.10:50312", "100.64.0.7:443")), "192.0.2.10:50312", "100.64.0.7:443"},
+		{string(proxyHeaderV2("[2001:db8::1]:50312", "100.64.0.7:443")), "[2001:db8::1]:50312", "100.64.0.7:443"},
+		{string(proxyHeaderV2("@", "100.64.0.7:443")), "", ""},
+	} {
+		br := bufio.NewReader(strings.NewReader(tc.header + "GET /"))
+		src, dst, err := readProxyHeader(br)
+		if err != nil {
+			t.Errorf("Failed to read %q: %v", tc.header, err)
+			continue
+		}
+		if tc.src == "" && (src != nil || dst != nil) {
+			t.Errorf("Expected no addresses from %q, got %v %v", tc.header, src, dst)
+		} else if tc.src != "" && (src.String() != tc.src || dst.String() != tc.dst) {
+			t.Errorf("Expected %s -> %s from %q, got %v -> %v", tc.src, tc.dst, tc.header, src, dst)
+		}
+		if rest, _ := io.ReadAll(br); string(rest) != "GET /" {
+			t.Errorf("Expected the header to be consumed exactly, %q is left", rest)
+		}
+	}
+
+	for _, header := range []string{
+		"GET / HTTP/1.1\r\n",
+		"PROXY TCP4 192.0.2.10 127.0.0.1 50312\r\n",
+		"PROXY TCP4 192.0.2.10 127.0.0.1 50312 8080" + strings.Repeat(" ", 100) + "\r\n",
+	} {
+		if _, _, err := readProxyHeader(bufio.NewReader(strings.NewReader(header))); err == nil {
+			t.Errorf("Expected %q to be rejected", header)
+		}
+	}
+}
+
+func TestProxyListener(t *testing.T) {
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	ln := proxyListener{inner, mustHosts([]string{"127.0.0.0/8", "::1"})}
+	defer ln.Close()
+
+	go func() {
+		conn, err := net.Dial("tcp", inner.Addr().String())
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.WriteString(conn, "PROXY TCP4 192.0.2.10 127.0.0.1 50312 8080\r\nhello")
+		io.ReadAll(conn)
+	}()
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatalf("Failed to accept: %v", err)
+	}
+	defer conn.Close()
+	if got := conn.RemoteAddr().String(); got != "192.0.2.10:50312" {
+		t.Errorf("Expected the client address from the header, got %s", got)
+	}
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "hello" {
+		t.Errorf("Expected the data after the header, got %q %v", buf, err)
+	}
+	if unwrapConn(conn) == conn {
+		t.Errorf("Expected the balancer's socket under the connection")
+	}
+}
+
+func TestProxyListenerRefusesUntrusted(t *testing.T) {
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	ln := proxyListener{inner, mustHosts([]string{"10.0.0.5"})}
+	defer ln.Close()
+
+	conn, err := net.Dial("tcp", inner.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	defer conn.Close()
+	io.WriteString(conn, "PROXY TCP4 192.0.2.10 127.0.0.1 50312 8080\r\nhello")
+
+	// Accept runs and returns within the capture, so its log line does too
+	var accepted net.Conn
+	out := captureStdout(t, func() {
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			accepted, _ = ln.Accept()
+		}()
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		if _, err := conn.Read(make([]byte, 1)); err == nil {
+			t.Errorf("Expected a connection from outside -proxy-protocol-from to be closed")
+		}
+		ln.Close()
+		<-done
+	})
+	if !strings.Contains(out, "only accepted from -proxy-protocol-from") {
+		t.Errorf("Expected the refusal to be logged, got %q", out)
+	}
+	if accepted != nil {
+		accepted.Close()
+		t.Errorf("Expected no connection to be accepted, got one from %s", accepted.RemoteAddr())
+	}
+}
+
+func TestRouteSendsProxyHeader(t *testing.T) {
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer target.Close()
+	got := make(chan string, 1)
+	go func() {
+		conn, err := target.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		src, _, err := readProxyHeader(bufio.NewReader(conn))
+		if err != nil {
+			got <- err.Error()
+			return
+		}
+		got <- src.String()
+	}()
+
+	base := &MockDialer{DialFunc: func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return net.Dial("tcp", target.Addr().String())
+	}}
+	router := newRouter(base, []RouteRule{{Host: "ingress", ProxyProtocol: ProxyProtocolV2, PoolConfig: PoolConfig{Targets: []string{"ingress-1"}}}}, nil)
+	conn, err := router.Dial(withClientAddr(context.Background(), "192.0.2.10:50312"), "tcp", "ingress:443")
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer conn.Close()
+	if src := <-got; src != "192.0.2.10:50312" {
+		t.Errorf("Expected the client address in the header, got %s", src)
+	}
+
+	if err := (RouteRule{Host: "ingress", ProxyProtocol: "v1"}).validate(); err == nil {
+		t.Errorf("Expected proxy_protocol v1 to be rejected")
+	}
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/armon/go-socks5"
+)
+
+// --- RECORD AND REPLAY ---
+
+// maxRecordedBody is the largest request or response body kept in a
+// cassette; exchanges with bigger bodies are proxied but not recorded
+const maxRecordedBody = 16 << 20
+
+// CassetteEntry is one recorded plain HTTP exchange. Cassettes are JSON
+// Lines files, one entry per line, so they diff well in a test fixture.
+type CassetteEntry struct {
+	Method     string      `json:"method"`
+	Host       string      `json:"host"`
+	URI        string      `json:"uri"`
+	BodySHA256 string      `json:"body_sha256,omitempty"` // request body, if any
+	Status     int         `json:"status"`
+	Header     http.Header `json:"header"`
+	Body       []byte      `json:"body"`
+}
+
+// key identifies the request an entry answers. withHost is false for the
+// fallback lookup that ignores the Host header.
+func (e CassetteEntry) key(withHost bool) string {
+	host := ""
+	if withHost {
+		host = strings.ToLower(e.Host)
+	}
+	return strings.Join([]string{e.Method, host, e.URI, e.BodySHA256}, " ")
+}
+
+// cassetteRecorder appends proxied exchanges to a cassette file
+type cassetteRecorder struct {
+	mu  sync.Mutex
+	f   *os.File
+	enc *json.Encoder
+}
+
+func newCassetteRecorder(path string) (*cassetteRecorder, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &cassetteRecorder{f: f, enc: json.NewEncoder(f)}, nil
+}
+
+// recording is one exchange being recorded
+type recording struct {
+	rec     *cassetteRecorder
+	entry   CassetteEntry
+	reqBody limitedBuffer
+	resBody limitedBuffer
+}
+
+// limitedBuffer keeps up to limit bytes (maxRecordedBody if 0) and notes if
+// there was more
+type limitedBuffer struct {
+	bytes.Buffer
+	limit    int
+	overflow bool
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	limit := b.limit
+	if limit == 0 {
+		limit = maxRecordedBody
+	}
+	if b.Len()+len(p) > limit {
+		b.overflow = true
+		return len(p), nil
+	}
+	return b.Buffer.Write(p)
+}
+
+// start begins recording r. It tees the request body, so it must be called
+// before r is sent upstream. A nil recorder records nothing.
+func (c *cassetteRecorder) start(r *http.Request) *recording {
+	if c == nil {
+		return nil
+	}
+	rec := &recording{rec: c, entry: CassetteEntry{Method: r.Method, Host: r.URL.Host, URI: r.URL.RequestURI()}}
+	if r.Body != nil && r.Body != http.NoBody {
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.TeeReader(r.Body, &rec.reqBody), r.Body}
+	}
+	return rec
+}
+
+// responseBody tees the upstream response body into the recording
+func (rec *recording) responseBody(body io.Reader) io.Reader {
+	if rec == nil {
+		return body
+	}
+	return io.TeeReader(body, &rec.resBody)
+}
+
+// finish writes the exchange once the response has been relayed. Failed
+// exchanges aren't recorded; a replay answers them with a 502 anyway.
+func (rec *recording) finish(resp *http.Response) {
+	if rec == nil || resp == nil {
+		return
+	}
+	if rec.reqBody.overflow || rec.resBody.overflow {
+		fmt.Fprintf(console, "[RECORD] %s %s%s: body larger than %d bytes, not recorded\n", rec.entry.Method, rec.entry.Host, rec.entry.URI, maxRecordedBody)
+		return
+	}
+	rec.entry.BodySHA256 = bodyHash(rec.reqBody.Bytes())
+	rec.entry.Status = resp.StatusCode
+	rec.entry.Header = resp.Header
+	rec.entry.Body = rec.resBody.Bytes()
+
+	rec.rec.mu.Lock()
+	defer rec.rec.mu.Unlock()
+	if err := rec.rec.enc.Encode(rec.entry); err != nil {
+		fmt.Fprintf(console, "[RECORD] Failed to write cassette: %v\n", err)
+	}
+}
+
+func bodyHash(body []byte) string {
+	if len(body) == 0 {
+		return ""
+	}
+	sum := sha256.Sum256(body)
+	return hex.EncodeToString(sum[:])
+}
+
+// cassette answers requests from recorded exchanges. Identical requests get
+// their recorded responses in order; once those run out the last repeats.
+type cassette struct {
+	mu     sync.Mutex
+	byKey  map[string][]CassetteEntry
+	served map[string]int
+}
+
+func loadCassette(path string) (*cassette, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	c := &cassette{byKey: make(map[string][]CassetteEntry), served: make(map[string]int)}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	for n := 1; ; n++ {
+		var e CassetteEntry
+		if err := dec.Decode(&e); errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("%s: entry %d: %w", path, n, err)
+		}
+		for _, withHost := range []bool{true, false} {
+			c.byKey[e.key(withHost)] = append(c.byKey[e.key(withHost)], e)
+		}
+	}
+	return c, nil
+}
+
+// lookup returns the next recorded response for a request
+func (c *cassette) lookup(want CassetteEntry) (CassetteEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, withHost := range []bool{true, false} {
+		key := want.key(withHost)
+		entries := c.byKey[key]
+		if len(entries) == 0 {
+			continue
+		}
+		i := min(c.served[key], len(entries)-1)
+		c.served[key]++
+		return entries[i], true
+	}
+	return CassetteEntry{}, false
+}
+
+// ServeHTTP plays the part of every tailnet service
+func (c *cassette) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	want := CassetteEntry{Method: r.Method, Host: r.Host, URI: r.URL.RequestURI(), BodySHA256: bodyHash(body)}
+	e, ok := c.lookup(want)
+	if !ok {
+		fmt.Fprintf(console, "[REPLAY] No recorded exchange for %s %s%s\n", r.Method, r.Host, want.URI)
+		http.Error(w, fmt.Sprintf("no recorded exchange for %s %s%s", r.Method, r.Host, want.URI), http.StatusBadGateway)
+		return
+	}
+	for k, vv := range e.Header {
+		if k == "Content-Length" || k == "Transfer-Encoding" {
+			continue
+		}
+		for _, v := range vv {
+			w.Header().Add(k, v)
+		}
+	}
+	w.WriteHeader(e.Status)
+	w.Write(e.Body)
+}
+
+// replayDialer is a fake tailnet: every dial reaches the cassette's HTTP
+// server over an in-memory pipe, whatever the address
+type replayDialer struct {
+	ln *pipeListener
+}
+
+func newReplayDialer(c *cassette) *replayDialer {
+	ln := newPipeListener()
+	go http.Serve(ln, c)
+	return &replayDialer{ln: ln}
+}
+
+func (d *replayDialer) Dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	return d.ln.Dial(ctx, network, addr)
+}
+
+// pipeListener is a net.Listener whose connections are in-memory pipes
+type pipeListener struct {
+	conns chan net.Conn
+	once  sync.Once
+	done  chan struct{}
+}
+
+func newPipeListener() *pipeListener {
+	return &pipeListener{conns: make(chan net.Conn), done: make(chan struct{})}
+}
+
+func (l *pipeListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *pipeListener) Close() error {
+	l.once.Do(func() { close(l.done) })
+	return nil
+}
+
+func (l *pipeListener) Addr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}
+}
+
+// Dial hands the server side of a new pipe to Accept
+func (l *pipeListener) Dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	client, server := net.Pipe()
+	select {
+	case l.conns <- pipeConn{server}:
+		return pipeConn{client}, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// pipeConn reports TCP addresses, which the SOCKS5 server insists on
+type pipeConn struct {
+	net.Conn
+}
+
+func (pipeConn) LocalAddr() net.Addr  { return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1} }
+func (pipeConn) RemoteAddr() net.Addr { return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 2} }
+
+// serveReplay runs the proxy against a cassette instead of the tailnet, so
+// downstream projects can test against the sidecar without credentials
+func serveReplay(c *cassette, mode, addr string) error {
+	d := newReplayDialer(c)
+	ln, err := listenClients(addr)
+	if err != nil {
+		return err
+	}
+	manifest := newManifest(mode, "", "", "", nil)
+	manifest.Replay = true
+
+	switch mode {
+	case "http":
+		listeners.add(ListenerInfo{Mode: "http", Addr: addr})
+		signal(SignalListening, fmt.Sprintf("mode=http addr=%s replay=true", addr))
+		signalReady(manifest, fmt.Sprintf("http://%s", addr))
+		return http.Serve(ln, &TailscaleProxy{Dialer: d, Transport: &http.Transport{DialContext: d.Dial}})
+	case "socks5":
+		server, err := socks5.New(&socks5.Config{
+			Dial:     d.Dial,
+			Resolver: tailnetResolver{},
+			Rewriter: clientAddrRewriter{},
+			Rules:    admissionRules{},
+		})
+		if err != nil {
+			return err
+		}
+		listeners.add(ListenerInfo{Mode: "socks5", Addr: addr})
+		signal(SignalListening, fmt.Sprintf("mode=socks5 addr=%s replay=true", addr))
+		signalReady(manifest, fmt.Sprintf("socks5://%s", addr))
+		return server.Serve(ln)
+	}
+	return fmt.Errorf("replay needs -mode http or socks5, got '%s'", mode)
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRecordAndReplay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "session.cassette")
+	recorder, err := newCassetteRecorder(path)
+	if err != nil {
+		t.Fatalf("Failed to open cassette: %v", err)
+	}
+
+	calls := 0
+	live := &TailscaleProxy{
+		Recorder: recorder,
+		Transport: &MockRoundTripper{
+			RoundTripFunc: func(req *http.Request) (*http.Response, error) {
+				calls++
+				body, _ := io.ReadAll(req.Body)
+				reply := req.Method + " " + req.URL.Path + " #" + string(rune('0'+calls)) + " " + string(body)
+				return &http.Response{
+					StatusCode: 201,
+					Header:     http.Header{"Content-Type": {"text/plain"}},
+					Body:       io.NopCloser(strings.NewReader(reply)),
+				}, nil
+			},
+		},
+	}
+	for _, req := range []*http.Request{
+		httptest.NewRequest("GET", "http://data-node:9000/jobs", nil),
+		httptest.NewRequest("GET", "http://data-node:9000/jobs", nil),
+		httptest.NewRequest("POST", "http://data-node:9000/jobs", strings.NewReader(`{"id":1}`)),
+	} {
+		live.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	c, err := loadCassette(path)
+	if err != nil {
+		t.Fatalf("Failed to load cassette: %v", err)
+	}
+	d := newReplayDialer(c)
+	replay := &TailscaleProxy{Dialer: d, Transport: &http.Transport{DialContext: d.Dial}}
+
+	for _, tc := range []struct {
+		method, url, body string
+		wantCode          int
+		wantBody          string
+	}{
+		{"GET", "http://data-node:9000/jobs", "", 201, "GET /jobs #1 "},
+		{"GET", "http://data-node:9000/jobs", "", 201, "GET /jobs #2 "},
+		{"GET", "http://data-node:9000/jobs", "", 201, "GET /jobs #2 "}, // the last one repeats
+		{"POST", "http://data-node:9000/jobs", `{"id":1}`, 201, `POST /jobs #3 {"id":1}`},
+		{"POST", "http://data-node:9000/jobs", `{"id":2}`, 502, "no recorded exchange"},
+		{"GET", "http://other-node/missing", "", 502, "no recorded exchange"},
+	} {
+		rec := httptest.NewRecorder()
+		replay.ServeHTTP(rec, httptest.NewRequest(tc.method, tc.url, strings.NewReader(tc.body)))
+		if rec.Code != tc.wantCode || !strings.Contains(rec.Body.String(), tc.wantBody) {
+			t.Errorf("%s %s: expected %d %q, got %d %q", tc.method, tc.url, tc.wantCode, tc.wantBody, rec.Code, rec.Body.String())
+		}
+		if tc.wantCode == 201 && rec.Header().Get("Content-Type") != "text/plain" {
+			t.Errorf("%s %s: expected recorded headers to be replayed, got %v", tc.method, tc.url, rec.Header())
+		}
+	}
+}
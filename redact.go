@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// --- SECRET REDACTION ---
+
+// redactedText replaces every secret the redactor finds
+const redactedText = "[REDACTED]"
+
+// sensitiveHeaders never have their values logged or captured
+var sensitiveHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie", "X-Api-Key"}
+
+// redaction is a pattern and what its matches are replaced with ($1 keeps
+// the first group, e.g. the name in "token=...")
+type redaction struct {
+	re   *regexp.Regexp
+	repl string
+}
+
+// defaultRedactions cover the secrets that show up in a sidecar's output:
+// Tailscale keys, HTTP credentials, passwords in URLs and token parameters
+var defaultRedactions = []redaction{
+	{regexp.MustCompile(`tskey-[A-Za-z0-9_-]+`), "tskey-" + redactedText},
+	{regexp.MustCompile(`(?i)\b(bearer|basic|token)\s+[A-Za-z0-9._~+/=-]{8,}`), "$1 " + redactedText},
+	{regexp.MustCompile(`(?i)\b((?:proxy-)?authorization|cookie|set-cookie|x-api-key)(\s*[:=]\s*)[^\r\n]+`), "$1$2" + redactedText},
+	{regexp.MustCompile(`(://[^:/@\s]+:)[^@/\s]+@`), "$1" + redactedText + "@"},
+	{regexp.MustCompile(`(?i)([?&](?:access_token|refresh_token|id_token|token|api_key|apikey|key|secret|client_secret|password|passwd|auth|sig|signature)=)[^&\s#"]+`), "$1" + redactedText},
+}
+
+// redactor scrubs secrets from text before it is logged, signalled or
+// captured. Besides the patterns it knows the literal secrets the sidecar
+// was started with, so they are caught in any context.
+type redactor struct {
+	mu       sync.RWMutex
+	patterns []redaction
+	literals []string
+}
+
+// secrets is applied to IPC signals, the log package, request logs and
+// debug captures
+var secrets = &redactor{patterns: defaultRedactions}
+
+// addLiteral makes the redactor replace value wherever it appears
+func (r *redactor) addLiteral(value string) {
+	if len(value) < 8 {
+		return // too short to tell apart from ordinary text
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.literals = append(r.literals, value)
+}
+
+// addPatterns adds regular expressions whose whole matches are redacted
+func (r *redactor) addPatterns(exprs []string) error {
+	var added []redaction
+	for _, expr := range exprs {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return fmt.Errorf("invalid redact pattern %q: %w", expr, err)
+		}
+		added = append(added, redaction{re: re, repl: redactedText})
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.patterns = append(r.patterns, added...)
+	return nil
+}
+
+// redact returns s with every secret replaced
+func (r *redactor) redact(s string) string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, lit := range r.literals {
+		s = strings.ReplaceAll(s, lit, redactedText)
+	}
+	for _, p := range r.patterns {
+		s = p.re.ReplaceAllString(s, p.repl)
+	}
+	return s
+}
+
+// redactHeader returns a copy of h with sensitive values replaced
+func redactHeader(h http.Header) http.Header {
+	h = h.Clone()
+	for _, name := range sensitiveHeaders {
+		if len(h.Values(name)) > 0 {
+			h.Set(name, redactedText)
+		}
+	}
+	return h
+}
+
+// redactingWriter redacts everything written through it. Each Write is
+// redacted on its own, which suits the log package's one-line writes.
+type redactingWriter struct {
+	w io.Writer
+	r *redactor
+}
+
+func (w redactingWriter) Write(p []byte) (int, error) {
+	if _, err := io.WriteString(w.w, w.r.redact(string(p))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// logRedacted prints a log line after redacting it, for lines carrying
+// client-supplied URLs or upstream errors
+func logRedacted(format string, args ...any) {
+	fmt.Fprint(console, secrets.redact(fmt.Sprintf(format, args...)))
+}
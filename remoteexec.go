@@ -0,0 +1,272 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os/exec"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"tailscale.com/tailcfg"
+	"tailscale.com/tsnet"
+)
+
+// --- REMOTE EXEC RELAY ---
+
+// remoteExecPort is the well-known tailnet port sidecars accept allowlisted
+// commands from other sidecars on
+const remoteExecPort = "9903"
+
+const (
+	remoteExecDefaultTimeout = time.Minute
+	remoteExecMaxOutput      = 64 << 10 // per stream, the rest is dropped
+)
+
+// RemoteExecConfig is the remote_exec section of the config file: the only
+// commands peers may run on this node, and who may run them
+type RemoteExecConfig struct {
+	Allow    []string        `json:"allow"` // tailnet hostnames, tags ("tag:ops") or login names
+	Commands []RemoteCommand `json:"commands"`
+}
+
+// RemoteCommand is a named command line. Callers only pick the name, they
+// can't pass arguments.
+type RemoteCommand struct {
+	Name    string   `json:"name"`
+	Command []string `json:"command"`           // run directly, not through a shell
+	Timeout string   `json:"timeout,omitempty"` // default 1m
+}
+
+// ExecRequest is the body of exec requests on both the status API and the
+// peer's tailnet port
+type ExecRequest struct {
+	Command string `json:"command"`
+}
+
+// ExecResult reports how a remote command went
+type ExecResult struct {
+	SchemaVersion int     `json:"schema_version,omitempty"` // set on the status API
+	Peer          string  `json:"peer,omitempty"`           // set on the status API
+	Command       string  `json:"command"`
+	ExitCode      int     `json:"exit_code"` // -1 if the command couldn't run or timed out
+	Stdout        string  `json:"stdout"`
+	Stderr        string  `json:"stderr"`
+	Truncated     bool    `json:"truncated"` // output beyond 64 KiB per stream was dropped
+	TimedOut      bool    `json:"timed_out"`
+	DurationMs    float64 `json:"duration_ms"`
+}
+
+func (c *RemoteExecConfig) validate() error {
+	if len(c.Allow) == 0 {
+		return fmt.Errorf("remote_exec.allow: at least one caller is required")
+	}
+	seen := map[string]bool{}
+	for i, cmd := range c.Commands {
+		if cmd.Name == "" || len(cmd.Command) == 0 {
+			return fmt.Errorf("remote_exec.commands[%d]: name and command are required", i)
+		}
+		if seen[cmd.Name] {
+			return fmt.Errorf("remote_exec.commands[%d]: duplicate command %q", i, cmd.Name)
+		}
+		seen[cmd.Name] = true
+		if cmd.Timeout != "" {
+			if d, err := time.ParseDuration(cmd.Timeout); err != nil || d <= 0 {
+				return fmt.Errorf("remote_exec.commands[%d]: invalid timeout %q", i, cmd.Timeout)
+			}
+		}
+	}
+	return nil
+}
+
+// execCaller is who sent an exec request, as the tailnet knows them
+type execCaller struct {
+	Host  string // MagicDNS name, assigned by control; never the name the node reports
+	Tags  []string
+	Login string
+}
+
+func (c execCaller) String() string {
+	if c.Login != "" {
+		return c.Host + " (" + c.Login + ")"
+	}
+	return c.Host
+}
+
+// allowed reports whether any allow entry names the caller's host (its
+// MagicDNS name, in full or the first label), one of its tags or its user
+func (c execCaller) allowed(allow []string) bool {
+	short, _, _ := strings.Cut(c.Host, ".")
+	for _, a := range allow {
+		if c.Host != "" && (strings.EqualFold(a, c.Host) || strings.EqualFold(a, short)) || slices.Contains(c.Tags, a) || c.Login != "" && strings.EqualFold(a, c.Login) {
+			return true
+		}
+	}
+	return false
+}
+
+// tsnetWhoIs identifies the tailnet node behind a remote address
+func tsnetWhoIs(s *tsnet.Server) func(ctx context.Context, addr string) (execCaller, error) {
+	return func(ctx context.Context, addr string) (execCaller, error) {
+		lc, err := s.LocalClient()
+		if err != nil {
+			return execCaller{}, err
+		}
+		who, err := lc.WhoIs(ctx, addr)
+		if err != nil {
+			return execCaller{}, err
+		}
+		return callerFromNode(who.Node, who.UserProfile), nil
+	}
+}
+
+// callerFromNode builds the caller from what control says about a node.
+// The hostname in its Hostinfo is whatever the node reports about itself,
+// so any peer could claim an allowed one; the MagicDNS name can't be.
+func callerFromNode(node *tailcfg.Node, profile *tailcfg.UserProfile) execCaller {
+	caller := execCaller{Host: strings.TrimSuffix(node.Name, "."), Tags: node.Tags}
+	if !node.IsTagged() && profile != nil {
+		caller.Login = profile.LoginName
+	}
+	return caller
+}
+
+// remoteExecHandler runs allowlisted commands for allowed peers. It is
+// served on remoteExecPort, so only tailnet nodes can reach it, and every
+// caller is identified by the tailnet rather than by a secret.
+func remoteExecHandler(cfg *RemoteExecConfig, whois func(ctx context.Context, addr string) (execCaller, error)) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /exec/v1/run", func(w http.ResponseWriter, r *http.Request) {
+		caller, err := whois(r.Context(), r.RemoteAddr)
+		if err != nil {
+			http.Error(w, "unknown caller", http.StatusForbidden)
+			return
+		}
+		var req ExecRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, fmt.Sprintf("invalid request body: %v", err), http.StatusBadRequest)
+			return
+		}
+		if !caller.allowed(cfg.Allow) {
+			fmt.Fprintf(console, "[EXEC] Refusing %q from %s: not in remote_exec.allow\n", req.Command, caller)
+			audit.record("denied", "by", "remote_exec", "source", caller.String(), "command", req.Command)
+			http.Error(w, fmt.Sprintf("%s may not run commands here", caller), http.StatusForbidden)
+			return
+		}
+		i := slices.IndexFunc(cfg.Commands, func(c RemoteCommand) bool { return c.Name == req.Command })
+		if i < 0 {
+			http.Error(w, fmt.Sprintf("unknown command %q", req.Command), http.StatusNotFound)
+			return
+		}
+
+		fmt.Fprintf(console, "[EXEC] %s runs %q\n", caller, req.Command)
+		res := runRemoteCommand(r.Context(), cfg.Commands[i])
+		fmt.Fprintf(console, "[EXEC] %q finished with exit code %d after %.0fms\n", req.Command, res.ExitCode, res.DurationMs)
+		audit.record("remote_exec", "caller", caller.String(), "command", req.Command, "exit_code", strconv.Itoa(res.ExitCode))
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(res)
+	})
+	return mux
+}
+
+// runRemoteCommand runs cmd with its timeout and collects its output
+func runRemoteCommand(ctx context.Context, cmd RemoteCommand) ExecResult {
+	timeout := remoteExecDefaultTimeout
+	if cmd.Timeout != "" {
+		timeout, _ = time.ParseDuration(cmd.Timeout)
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	stdout := &limitedBuffer{limit: remoteExecMaxOutput}
+	stderr := &limitedBuffer{limit: remoteExecMaxOutput}
+	c := exec.CommandContext(ctx, cmd.Command[0], cmd.Command[1:]...)
+	c.Stdout, c.Stderr = stdout, stderr
+
+	start := time.Now()
+	err := c.Run()
+	res := ExecResult{
+		Command:    cmd.Name,
+		Stdout:     stdout.String(),
+		Stderr:     stderr.String(),
+		Truncated:  stdout.overflow || stderr.overflow,
+		DurationMs: millis(time.Since(start)),
+	}
+	var exitErr *exec.ExitError
+	switch {
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		res.ExitCode, res.TimedOut = -1, true
+	case errors.As(err, &exitErr):
+		res.ExitCode = exitErr.ExitCode()
+	case err != nil:
+		res.ExitCode = -1
+		res.Stderr += err.Error()
+	}
+	return res
+}
+
+// handlePeerExec serves POST /peers/{name}/exec on the status API: it
+// relays the request to the peer's sidecar and returns its result
+func handlePeerExec(s *tsnet.Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req ExecRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Command == "" {
+			http.Error(w, `body must be {"command": "<name>"}`, http.StatusBadRequest)
+			return
+		}
+
+		lc, err := s.LocalClient()
+		if err != nil {
+			http.Error(w, fmt.Sprintf("failed to get local client: %v", err), http.StatusInternalServerError)
+			return
+		}
+		status, err := lc.Status(r.Context())
+		if err != nil {
+			http.Error(w, fmt.Sprintf("failed to get status: %v", err), http.StatusInternalServerError)
+			return
+		}
+		name := r.PathValue("name")
+		peer := findPeer(status, name)
+		if peer == nil || len(peer.TailscaleIPs) == 0 {
+			http.Error(w, fmt.Sprintf("no peer named %q", name), http.StatusNotFound)
+			return
+		}
+
+		body, _ := json.Marshal(req)
+		url := "http://" + net.JoinHostPort(peer.TailscaleIPs[0].String(), remoteExecPort) + "/exec/v1/run"
+		preq, _ := http.NewRequestWithContext(r.Context(), "POST", url, bytes.NewReader(body))
+		preq.Header.Set("Content-Type", "application/json")
+		client := &http.Client{Transport: &http.Transport{DialContext: s.Dial}}
+		fmt.Fprintf(console, "[EXEC] Asking %s to run %q\n", peer.HostName, req.Command)
+		resp, err := client.Do(preq)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("exec on %s failed: %v (does its config have remote_exec?)", peer.HostName, err), http.StatusBadGateway)
+			return
+		}
+		defer resp.Body.Close()
+
+		// Refusals from the peer are passed through as they are
+		if resp.StatusCode != http.StatusOK {
+			w.Header().Set("Content-Type", resp.Header.Get("Content-Type"))
+			w.WriteHeader(resp.StatusCode)
+			io.Copy(w, io.LimitReader(resp.Body, remoteExecMaxOutput))
+			return
+		}
+		var res ExecResult
+		if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+			http.Error(w, fmt.Sprintf("invalid answer from %s: %v", peer.HostName, err), http.StatusBadGateway)
+			return
+		}
+		res.SchemaVersion = apiSchemaVersion
+		res.Peer = peer.HostName
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(res)
+	}
+}
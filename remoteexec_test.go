@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strings"
+	"testing"
+
+	"tailscale.com/tailcfg"
+)
+
+func TestRemoteExecHandler(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("needs sh")
+	}
+	cfg := &RemoteExecConfig{
+		Allow: []string{"tag:ops", "core"},
+		Commands: []RemoteCommand{
+			{Name: "clear-cache", Command: []string{"sh", "-c", "echo cleared; echo warn >&2"}},
+			{Name: "fail", Command: []string{"sh", "-c", "exit 3"}},
+			{Name: "hang", Command: []string{"sleep", "5"}, Timeout: "50ms"},
+		},
+	}
+	callers := map[string]execCaller{
+		"100.64.0.1:1000": {Host: "core.tail1234.ts.net"},
+		"100.64.0.2:1000": {Host: "worker", Tags: []string{"tag:ops"}},
+		"100.64.0.3:1000": {Host: "laptop", Login: "alice@example.com"},
+		// Reports "core" as its hostname, but control named it core-1
+		"100.64.0.4:1000": callerFromNode(&tailcfg.Node{Name: "core-1.tail1234.ts.net.", Hostinfo: (&tailcfg.Hostinfo{Hostname: "core"}).View()}, nil),
+	}
+	handler := remoteExecHandler(cfg, func(ctx context.Context, addr string) (execCaller, error) {
+		return callers[addr], nil
+	})
+
+	run := func(from, command string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/exec/v1/run", strings.NewReader(`{"command":"`+command+`"}`))
+		req.RemoteAddr = from
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+	result := func(w *httptest.ResponseRecorder) ExecResult {
+		t.Helper()
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+		var res ExecResult
+		if err := json.NewDecoder(w.Body).Decode(&res); err != nil {
+			t.Fatalf("Failed to decode result: %v", err)
+		}
+		return res
+	}
+
+	if res := result(run("100.64.0.1:1000", "clear-cache")); res.ExitCode != 0 || res.Stdout != "cleared\n" || res.Stderr != "warn\n" {
+		t.Errorf("Unexpected result %+v", res)
+	}
+	if res := result(run("100.64.0.2:1000", "fail")); res.ExitCode != 3 {
+		t.Errorf("Expected exit code 3 for a tagged caller, got %+v", res)
+	}
+	if res := result(run("100.64.0.1:1000", "hang")); !res.TimedOut || res.ExitCode != -1 {
+		t.Errorf("Expected a timeout, got %+v", res)
+	}
+	if w := run("100.64.0.3:1000", "clear-cache"); w.Code != http.StatusForbidden {
+		t.Errorf("Expected status 403 for a caller not in allow, got %d", w.Code)
+	}
+	if w := run("100.64.0.4:1000", "clear-cache"); w.Code != http.StatusForbidden {
+		t.Errorf("Expected status 403 for a peer reporting an allowed hostname, got %d", w.Code)
+	}
+	if w := run("100.64.0.1:1000", "rm-rf"); w.Code != http.StatusNotFound {
+		t.Errorf("Expected status 404 for an unknown command, got %d", w.Code)
+	}
+}
+
+func TestRemoteExecConfigValidation(t *testing.T) {
+	bad := []RemoteExecConfig{
+		{Commands: []RemoteCommand{{Name: "a", Command: []string{"true"}}}},
+		{Allow: []string{"core"}, Commands: []RemoteCommand{{Name: "a"}}},
+		{Allow: []string{"core"}, Commands: []RemoteCommand{{Name: "a", Command: []string{"true"}}, {Name: "a", Command: []string{"true"}}}},
+		{Allow: []string{"core"}, Commands: []RemoteCommand{{Name: "a", Command: []string{"true"}, Timeout: "soon"}}},
+	}
+	for _, cfg := range bad {
+		if err := cfg.validate(); err == nil {
+			t.Errorf("Expected error for %+v", cfg)
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+)
+
+// --- REQUEST IDS ---
+
+// requestIDHeader carries the request ID upstream on plain HTTP requests and
+// back to the client on every proxy response, including errors
+const requestIDHeader = "X-Sidecar-Request-Id"
+
+// maxRequestIDLen bounds IDs supplied by clients
+const maxRequestIDLen = 64
+
+type requestIDKey struct{}
+
+// newRequestID returns a random 16 character hex ID
+func newRequestID() string {
+	var b [8]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// requestIDFor returns the ID an application already put on r, so it can
+// correlate with its own logs, or a fresh one.
+func requestIDFor(r *http.Request) string {
+	if id := r.Header.Get(requestIDHeader); validRequestID(id) {
+		return id
+	}
+	return newRequestID()
+}
+
+// validRequestID accepts short IDs made of letters, digits, '-', '_' and '.',
+// which are safe to put in logs and IPC lines unquoted
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLen {
+		return false
+	}
+	for _, c := range id {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '-', c == '_', c == '.':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// withRequestID records the ID of the request a dial is made for
+func withRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// requestID returns the ID recorded by withRequestID, if any
+func requestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// requestFailed tells the parent process that a proxied request or tunnel
+// could not be established, so it can match the failure an application
+// reports to the sidecar's logs. The code tells ACL denials, refused ports
+// and timeouts apart.
+func requestFailed(id, kind, target string, err error) {
+	signal(SignalRequestFailed, fmt.Sprintf("code=%s id=%s kind=%s target=%s error=%q",
+		classifyError(err, CodeDialFailed), id, kind, target, err.Error()))
+}
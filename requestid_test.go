@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRequestIDPropagation(t *testing.T) {
+	var upstreamID string
+	proxy := &TailscaleProxy{
+		Transport: &MockRoundTripper{
+			RoundTripFunc: func(req *http.Request) (*http.Response, error) {
+				upstreamID = req.Header.Get(requestIDHeader)
+				if req.URL.Host == "down-node" {
+					return nil, errors.New("connection refused")
+				}
+				return &http.Response{StatusCode: 200, Header: http.Header{}, Body: http.NoBody}, nil
+			},
+		},
+	}
+
+	rec := httptest.NewRecorder()
+	proxy.ServeHTTP(rec, httptest.NewRequest("GET", "http://data-node/", nil))
+	id := rec.Header().Get(requestIDHeader)
+	if len(id) != 16 || upstreamID != id {
+		t.Errorf("Expected the same generated ID upstream and in the response, got %q and %q", upstreamID, id)
+	}
+
+	// IDs chosen by the application are kept
+	req := httptest.NewRequest("GET", "http://down-node/", nil)
+	req.Header.Set(requestIDHeader, "job-42.upload")
+	rec = httptest.NewRecorder()
+	proxy.ServeHTTP(rec, req)
+	if rec.Code != http.StatusBadGateway || rec.Header().Get(requestIDHeader) != "job-42.upload" {
+		t.Errorf("Expected 502 carrying the client's ID, got %d %q", rec.Code, rec.Header().Get(requestIDHeader))
+	}
+
+	// ...unless they aren't safe to log
+	req = httptest.NewRequest("GET", "http://data-node/", nil)
+	req.Header.Set(requestIDHeader, "bad id\n")
+	rec = httptest.NewRecorder()
+	proxy.ServeHTTP(rec, req)
+	if got := rec.Header().Get(requestIDHeader); got == "bad id\n" || !validRequestID(got) {
+		t.Errorf("Expected an invalid client ID to be replaced, got %q", got)
+	}
+}
+
+func TestRequestIDOnTunnelFailure(t *testing.T) {
+	var dialID string
+	proxy := &TailscaleProxy{
+		Dialer: &MockDialer{
+			DialFunc: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				dialID = requestID(ctx)
+				return nil, errors.New("no route")
+			},
+		},
+	}
+	server := httptest.NewServer(proxy)
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", server.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to connect to proxy: %v", err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("CONNECT data-node:443 HTTP/1.1\r\nHost: data-node:443\r\n\r\n"))
+
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatalf("Failed to read response: %v", err)
+	}
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Errorf("Expected 502, got %d", resp.StatusCode)
+	}
+	if id := resp.Header.Get(requestIDHeader); id == "" || id != dialID {
+		t.Errorf("Expected the dial's request ID %q in the response, got %q", dialID, id)
+	}
+}
+
+func TestValidRequestID(t *testing.T) {
+	for id, want := range map[string]bool{
+		"a1b2c3":                true,
+		"job-42_retry.1":        true,
+		"":                      false,
+		"has space":             false,
+		"quote\"":               false,
+		strings.Repeat("x", 65): false,
+	} {
+		if got := validRequestID(id); got != want {
+			t.Errorf("validRequestID(%q) = %v, want %v", id, got, want)
+		}
+	}
+}
@@ -0,0 +1,25 @@
+//go:build !windows
+
+package main
+
+import (
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// reusePortSupported: Linux spreads connections across the sockets sharing
+// a port, the BSDs and macOS accept it too
+const reusePortSupported = true
+
+// setReusePort is a net.ListenConfig Control function enabling SO_REUSEPORT
+func setReusePort(network, address string, c syscall.RawConn) error {
+	var opErr error
+	err := c.Control(func(fd uintptr) {
+		opErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+	})
+	if err != nil {
+		return err
+	}
+	return opErr
+}
@@ -0,0 +1,14 @@
+package main
+
+import (
+	"errors"
+	"syscall"
+)
+
+// reusePortSupported: Windows has no SO_REUSEPORT, and SO_REUSEADDR there
+// lets another process steal the port
+const reusePortSupported = false
+
+func setReusePort(network, address string, c syscall.RawConn) error {
+	return errors.New("SO_REUSEPORT is not supported on Windows")
+}
@@ -0,0 +1,377 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// --- ROUTING ---
+
+// RouteRule sends proxied connections for Host to a pool of tailnet backends
+// instead of dialing Host itself.
+type RouteRule struct {
+	Host          string `json:"host"`                     // requested host, with or without port, or a host pattern (see compileHosts)
+	RewriteHost   string `json:"rewrite_host,omitempty"`   // Host header of plain HTTP requests sent to the targets
+	SNI           string `json:"sni,omitempty"`            // send plain HTTP requests over TLS with this server name
+	ProxyProtocol string `json:"proxy_protocol,omitempty"` // "v2" to tell the targets the client's address in a PROXY protocol header
+	UploadLimits
+	ResponseHeaders *HeaderRules `json:"response_headers,omitempty"` // changes to plain HTTP responses
+	PoolConfig
+}
+
+// validate checks the options beyond the pool
+func (r RouteRule) validate() error {
+	if r.Host == "" {
+		return errors.New("host is required")
+	}
+	if _, err := compileHosts([]string{r.Host}); err != nil {
+		return fmt.Errorf("host: %w", err)
+	}
+	if r.RewriteHost != "" && !validHostHeader(r.RewriteHost) {
+		return fmt.Errorf("invalid rewrite_host %q", r.RewriteHost)
+	}
+	if r.SNI != "" && (!validHostHeader(r.SNI) || strings.Contains(r.SNI, ":")) {
+		return fmt.Errorf("invalid sni %q (a host name without port)", r.SNI)
+	}
+	if r.ProxyProtocol != "" && r.ProxyProtocol != ProxyProtocolV2 {
+		return fmt.Errorf("unknown proxy_protocol %q", r.ProxyProtocol)
+	}
+	if err := r.UploadLimits.validate(); err != nil {
+		return err
+	}
+	if err := r.ResponseHeaders.validate(); err != nil {
+		return fmt.Errorf("response_headers: %w", err)
+	}
+	return r.PoolConfig.validate()
+}
+
+// validHostHeader accepts host or host:port, without spaces or paths
+func validHostHeader(s string) bool {
+	return !strings.ContainsAny(s, " /\\?#@")
+}
+
+// servicePrefix marks a pool target that names a service instead of a host
+const servicePrefix = "service:"
+
+// Router is a Dialer that applies route rules on top of a base Dialer. It sits
+// under the HTTP transport, CONNECT tunnels and SOCKS5 alike.
+type Router struct {
+	Base     Dialer
+	Services map[string]string // service name -> tailnet host:port
+
+	mu     sync.RWMutex // guards Services and routes once the proxy runs
+	routes []route
+	online peerOnlineFunc
+}
+
+type route struct {
+	rule  RouteRule
+	pool  *Pool
+	hosts *hostSet // rule.Host compiled
+}
+
+func newRouter(base Dialer, rules []RouteRule, online peerOnlineFunc) *Router {
+	r := &Router{Base: base, online: online}
+	r.routes = r.build(rules)
+	return r
+}
+
+func (r *Router) build(rules []RouteRule) []route {
+	var routes []route
+	for _, rule := range rules {
+		routes = append(routes, route{rule: rule, pool: newPool(rule.Host, rule.PoolConfig, r.online), hosts: mustHosts([]string{rule.Host})})
+	}
+	return routes
+}
+
+// reload replaces the route rules and services. Connections already dialed
+// through the old pools are left alone.
+func (r *Router) reload(rules []RouteRule, services map[string]string) {
+	routes := r.build(rules)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.routes = routes
+	r.Services = services
+}
+
+// match returns the first route whose host matches addr
+func (r *Router) match(addr string) (*route, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for i := range r.routes {
+		if r.routes[i].hosts.match(addr) {
+			return &r.routes[i], true
+		}
+	}
+	return nil, false
+}
+
+// rewrite applies rewrite_host and sni of the route matching a plain HTTP
+// request. It returns the server name to use for TLS to the upstream, or
+// "" to send the request as it is. Tunnels carry the client's own Host
+// header and TLS, so neither applies to them.
+func (r *Router) rewrite(req *http.Request) (sni string) {
+	rule, ok := r.ruleFor(req)
+	if !ok {
+		return ""
+	}
+	if rule.RewriteHost != "" {
+		req.Host = rule.RewriteHost
+	}
+	if rule.SNI != "" {
+		req.URL.Scheme = "https"
+	}
+	return rule.SNI
+}
+
+// ruleFor returns the rule of the route matching a plain HTTP request
+func (r *Router) ruleFor(req *http.Request) (RouteRule, bool) {
+	if r == nil {
+		return RouteRule{}, false
+	}
+	target, err := r.resolve(req.URL.Host)
+	if err != nil {
+		return RouteRule{}, false
+	}
+	rt, ok := r.match(target)
+	if !ok {
+		return RouteRule{}, false
+	}
+	return rt.rule, true
+}
+
+// sniTransports caches a clone of each transport per server name, so TLS
+// sessions and idle connections are reused across requests
+var sniTransports sync.Map // sniKey -> *http.Transport
+
+type sniKey struct {
+	base *http.Transport
+	sni  string
+}
+
+// withSNI returns base set up to present sni and verify the upstream's
+// certificate against it. Other round trippers are returned unchanged.
+func withSNI(base http.RoundTripper, sni string) http.RoundTripper {
+	t, ok := base.(*http.Transport)
+	if !ok {
+		return base
+	}
+	key := sniKey{t, sni}
+	if cached, ok := sniTransports.Load(key); ok {
+		return cached.(*http.Transport)
+	}
+	clone := t.Clone()
+	if clone.TLSClientConfig == nil {
+		clone.TLSClientConfig = &tls.Config{}
+	}
+	clone.TLSClientConfig.ServerName = sni
+	cached, _ := sniTransports.LoadOrStore(key, clone)
+	return cached.(*http.Transport)
+}
+
+// resolve replaces a service reference with the service's host:port. Both
+// "service:<name>" and a bare service name as host (any port) refer to it.
+func (r *Router) resolve(addr string) (string, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if name, ok := strings.CutPrefix(addr, servicePrefix); ok {
+		target, found := r.Services[name]
+		if !found {
+			return "", fmt.Errorf("unknown service %q", name)
+		}
+		return target, nil
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	if target, ok := r.Services[strings.ToLower(host)]; ok {
+		return target, nil
+	}
+	return addr, nil
+}
+
+// baseDialer dials through Base after resolving service references, so
+// pool targets may name services too.
+type baseDialer struct{ r *Router }
+
+func (d baseDialer) Dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	addr, err := d.r.resolve(addr)
+	if err != nil {
+		return nil, err
+	}
+	return d.r.Base.Dial(ctx, network, addr)
+}
+
+func (r *Router) Dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	addr, err := r.resolve(addr)
+	if err != nil {
+		return nil, err
+	}
+	rt, ok := r.match(addr)
+	if !ok {
+		return r.Base.Dial(ctx, network, addr)
+	}
+	_, port, _ := net.SplitHostPort(addr)
+	conn, err := rt.pool.Dial(ctx, baseDialer{r}, network, port)
+	if err != nil {
+		return nil, fmt.Errorf("route %s: %w", rt.rule.Host, err)
+	}
+	if rt.rule.ProxyProtocol == ProxyProtocolV2 {
+		if err := sendProxyHeader(ctx, conn); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("route %s: PROXY header: %w", rt.rule.Host, err)
+		}
+	}
+	return conn, nil
+}
+
+// routing is the proxies' router, for /routes; nil until they run
+var routing *Router
+
+// RouteStatus is one route of /routes, in matching order
+type RouteStatus struct {
+	Index int `json:"index"` // position in the config's routes; the first match wins
+	RouteRule
+	FailedOver bool            `json:"failed_over"` // traffic is on the backup targets
+	Backends   []BackendStatus `json:"backends"`
+}
+
+// RouteTable is the answer of /routes
+type RouteTable struct {
+	SchemaVersion int               `json:"schema_version"`
+	Services      map[string]string `json:"services"`
+	Routes        []RouteStatus     `json:"routes"`
+}
+
+// table describes the services and routes in effect, reloads included
+func (r *Router) table() RouteTable {
+	r.mu.RLock()
+	services := r.Services
+	routes := r.routes
+	r.mu.RUnlock()
+
+	t := RouteTable{SchemaVersion: apiSchemaVersion, Services: map[string]string{}, Routes: []RouteStatus{}}
+	for name, target := range services {
+		t.Services[name] = target
+	}
+	for i, rt := range routes {
+		rt.pool.mu.Lock()
+		failedOver := rt.pool.failedOver
+		rt.pool.mu.Unlock()
+		t.Routes = append(t.Routes, RouteStatus{Index: i, RouteRule: rt.rule, FailedOver: failedOver, Backends: rt.pool.status()})
+	}
+	return t
+}
+
+// RouteTest is the answer of /routes/test: what a connection to Host would
+// do, without dialing
+type RouteTest struct {
+	SchemaVersion int        `json:"schema_version"`
+	Host          string     `json:"host"`
+	Service       string     `json:"service,omitempty"`  // the service Host named, if any
+	Resolved      string     `json:"resolved,omitempty"` // Host after services
+	Action        string     `json:"action"`             // route, direct or reject
+	Route         *int       `json:"route,omitempty"`    // index of the matching route
+	Rule          *RouteRule `json:"rule,omitempty"`
+	Order         []string   `json:"order,omitempty"` // backends in the order the next dial tries them
+	Explanation   string     `json:"explanation"`
+}
+
+// test evaluates addr like Dial does. client stands in for the client IP
+// of sticky pools.
+func (r *Router) test(addr, client string) RouteTest {
+	res := RouteTest{SchemaVersion: apiSchemaVersion, Host: addr}
+	resolved, err := r.resolve(addr)
+	if err != nil {
+		res.Action = "reject"
+		res.Explanation = fmt.Sprintf("Connections fail: %v.", err)
+		return res
+	}
+	res.Resolved = resolved
+	if resolved != addr {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			host = addr
+		}
+		res.Service = strings.TrimPrefix(strings.ToLower(host), servicePrefix)
+	}
+
+	r.mu.RLock()
+	var (
+		index = -1
+		rt    route
+	)
+	for i := range r.routes {
+		if r.routes[i].hosts.match(resolved) {
+			index, rt = i, r.routes[i]
+			break
+		}
+	}
+	r.mu.RUnlock()
+	if index < 0 {
+		res.Action = "direct"
+		res.Explanation = fmt.Sprintf("No route matches; %s is dialed on the tailnet as it is.", resolved)
+		return res
+	}
+
+	res.Action = "route"
+	res.Route, res.Rule = &index, &rt.rule
+	key := ""
+	if rt.pool.sticky != "" {
+		key = client
+	}
+	_, port, _ := net.SplitHostPort(resolved)
+	var tried []string
+	for _, b := range rt.pool.peek(key) {
+		target := b.addr
+		if _, _, err := net.SplitHostPort(target); err != nil && port != "" {
+			target = net.JoinHostPort(target, port)
+		}
+		res.Order = append(res.Order, target)
+		note := ""
+		switch {
+		case b.backup && rt.pool.isDown(b):
+			note = " (backup, down)"
+		case b.backup:
+			note = " (backup)"
+		case rt.pool.isDown(b):
+			note = " (down)"
+		}
+		tried = append(tried, target+note)
+	}
+	res.Explanation = fmt.Sprintf("Route %d (%s) tries %s.", index, rt.rule.Host, strings.Join(tried, ", then "))
+	return res
+}
+
+// handleRoutes serves the services and routes in effect
+func handleRoutes(w http.ResponseWriter, r *http.Request) {
+	if routing == nil {
+		http.Error(w, "the proxies are not running yet", http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(routing.table())
+}
+
+// handleRouteTest serves /routes/test?host=name:port, a dry run of routing
+func handleRouteTest(w http.ResponseWriter, r *http.Request) {
+	host := r.URL.Query().Get("host")
+	if host == "" {
+		http.Error(w, "host is required, e.g. ?host=core:443", http.StatusBadRequest)
+		return
+	}
+	if routing == nil {
+		http.Error(w, "the proxies are not running yet", http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(routing.test(host, r.URL.Query().Get("client")))
+}
@@ -0,0 +1,438 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRouterRoutesMatchingHosts(t *testing.T) {
+	d := &recordingDialer{}
+	router := newRouter(d, []RouteRule{
+		{Host: "workers", PoolConfig: PoolConfig{Targets: []string{"w1", "w2"}}},
+	}, nil)
+
+	for _, addr := range []string{"workers:8000", "workers:8000", "minio:9000"} {
+		conn, err := router.Dial(context.Background(), "tcp", addr)
+		if err != nil {
+			t.Fatalf("Dial %s failed: %v", addr, err)
+		}
+		conn.Close()
+	}
+
+	want := []string{"w1:8000", "w2:8000", "minio:9000"}
+	for i := range want {
+		if d.dialed[i] != want[i] {
+			t.Fatalf("Expected dials %v, got %v", want, d.dialed)
+		}
+	}
+}
+
+func TestForwardBalancesConnections(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer ln.Close()
+
+	mockDialer := &MockDialer{
+		DialFunc: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			client, server := net.Pipe()
+			go func() {
+				server.Write([]byte(addr))
+				server.Close()
+			}()
+			return client, nil
+		},
+	}
+
+	pool := newPool("test", PoolConfig{Targets: []string{"w1:9000", "w2:9000"}}, nil)
+	go serveForward(ln, "forward", func(ctx context.Context) (net.Conn, error) {
+		return pool.Dial(ctx, mockDialer, "tcp", "")
+	})
+
+	var targets []string
+	for i := 0; i < 2; i++ {
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatalf("Failed to dial forward: %v", err)
+		}
+		b, _ := io.ReadAll(conn)
+		conn.Close()
+		targets = append(targets, string(b))
+	}
+
+	if targets[0] != "w1:9000" || targets[1] != "w2:9000" {
+		t.Errorf("Expected connections to w1:9000 then w2:9000, got %v", targets)
+	}
+}
+
+func TestRouterResolvesServices(t *testing.T) {
+	d := &recordingDialer{}
+	router := newRouter(d, []RouteRule{
+		{Host: "workers", PoolConfig: PoolConfig{Targets: []string{"service:minio", "w2:9000"}}},
+	}, nil)
+	router.Services = map[string]string{
+		"minio":   "data-node:9000",
+		"graphql": "arkitekt-core:8080",
+		"jobs":    "workers:7000",
+	}
+
+	for _, addr := range []string{"minio:80", "graphql:443", "service:minio", "jobs:80", "minio-other:80"} {
+		conn, err := router.Dial(context.Background(), "tcp", addr)
+		if err != nil {
+			t.Fatalf("Dial %s failed: %v", addr, err)
+		}
+		conn.Close()
+	}
+
+	// "jobs" resolves to a routed host whose first target is itself a service
+	want := []string{"data-node:9000", "arkitekt-core:8080", "data-node:9000", "data-node:9000", "minio-other:80"}
+	for i := range want {
+		if d.dialed[i] != want[i] {
+			t.Fatalf("Expected dials %v, got %v", want, d.dialed)
+		}
+	}
+
+	if _, err := router.Dial(context.Background(), "tcp", "service:unknown"); err == nil {
+		t.Fatal("Expected error for unknown service")
+	}
+}
+
+func TestRouterReload(t *testing.T) {
+	d := &recordingDialer{}
+	router := newRouter(d, []RouteRule{
+		{Host: "workers", PoolConfig: PoolConfig{Targets: []string{"w1"}}},
+	}, nil)
+
+	router.reload([]RouteRule{
+		{Host: "workers", PoolConfig: PoolConfig{Targets: []string{"w9"}}},
+	}, map[string]string{"minio": "data-node:9000"})
+
+	for _, addr := range []string{"workers:8000", "minio:80"} {
+		conn, err := router.Dial(context.Background(), "tcp", addr)
+		if err != nil {
+			t.Fatalf("Dial %s failed: %v", addr, err)
+		}
+		conn.Close()
+	}
+	want := []string{"w9:8000", "data-node:9000"}
+	for i := range want {
+		if d.dialed[i] != want[i] {
+			t.Fatalf("Expected dials %v, got %v", want, d.dialed)
+		}
+	}
+}
+
+func TestControlForwards(t *testing.T) {
+	free, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	addr := free.Addr().String()
+	_, port, _ := net.SplitHostPort(addr)
+	free.Close()
+
+	mockDialer := &MockDialer{
+		DialFunc: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			client, server := net.Pipe()
+			go func() {
+				server.Write([]byte(addr))
+				server.Close()
+			}()
+			return client, nil
+		},
+	}
+	saved := forwards
+	defer func() { forwards = saved }()
+	forwards = newForwardTable(mockDialer, nil)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/control/forwards", handleForwards)
+	mux.HandleFunc("DELETE /control/forwards/{listen}", handleForward)
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	post := func(body string) int {
+		resp, err := http.Post(srv.URL+"/control/forwards", "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("POST failed: %v", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if code := post(`{"listen": "` + port + `", "targets": ["lab-db:5432"]}`); code != http.StatusCreated {
+		t.Fatalf("Expected 201, got %d", code)
+	}
+	if code := post(`{"listen": "` + addr + `", "targets": ["lab-db:5432"]}`); code != http.StatusConflict {
+		t.Errorf("Expected 409 for a second forward on %s, got %d", addr, code)
+	}
+	if code := post(`{"listen": "9000"}`); code != http.StatusBadRequest {
+		t.Errorf("Expected 400 without targets, got %d", code)
+	}
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Failed to dial forward: %v", err)
+	}
+	b, _ := io.ReadAll(conn)
+	conn.Close()
+	if string(b) != "lab-db:5432" {
+		t.Errorf("Expected the connection forwarded to lab-db:5432, got %q", b)
+	}
+
+	resp, err := http.Get(srv.URL + "/control/forwards")
+	if err != nil {
+		t.Fatalf("GET failed: %v", err)
+	}
+	var list []ForwardStatus
+	json.NewDecoder(resp.Body).Decode(&list)
+	resp.Body.Close()
+	if len(list) != 1 || list[0].Addr != addr || !list[0].Dynamic {
+		t.Errorf("Expected one dynamic forward on %s, got %+v", addr, list)
+	}
+
+	req, _ := http.NewRequest(http.MethodDelete, srv.URL+"/control/forwards/"+port, nil)
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("DELETE failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", resp.StatusCode)
+	}
+	if c, err := net.Dial("tcp", addr); err == nil {
+		c.Close()
+		t.Errorf("Expected %s to be closed after DELETE", addr)
+	}
+	resp, _ = http.DefaultClient.Do(req)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected 404 for a removed forward, got %d", resp.StatusCode)
+	}
+}
+
+func TestForwardTargetWithoutPort(t *testing.T) {
+	free, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	addr := free.Addr().String()
+	_, port, _ := net.SplitHostPort(addr)
+	free.Close()
+
+	table := newForwardTable(&MockDialer{
+		DialFunc: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			client, server := net.Pipe()
+			go func() {
+				server.Write([]byte(addr))
+				server.Close()
+			}()
+			return client, nil
+		},
+	}, nil)
+	if _, err := table.start(ForwardRule{Listen: port, PoolConfig: PoolConfig{Targets: []string{"lab-db"}}}, true); err != nil {
+		t.Fatalf("Failed to start forward: %v", err)
+	}
+	defer table.stop(addr)
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Failed to dial forward: %v", err)
+	}
+	b, _ := io.ReadAll(conn)
+	conn.Close()
+	if want := net.JoinHostPort("lab-db", port); string(b) != want {
+		t.Errorf("Expected the connection forwarded to %s, got %q", want, b)
+	}
+}
+
+func TestForwardAcceptLoops(t *testing.T) {
+	if !reusePortSupported {
+		t.Skip("no SO_REUSEPORT on this platform")
+	}
+	var addrs []string
+	for range 2 {
+		free, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("Failed to listen: %v", err)
+		}
+		addrs = append(addrs, free.Addr().String())
+		free.Close()
+	}
+
+	mockDialer := &MockDialer{
+		DialFunc: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			client, server := net.Pipe()
+			go func() {
+				server.Write([]byte(addr))
+				server.Close()
+			}()
+			return client, nil
+		},
+	}
+	table := newForwardTable(mockDialer, nil)
+	rule := ForwardRule{Listen: addrs[0], AlsoListen: []string{addrs[1]}, AcceptLoops: 3,
+		PoolConfig: PoolConfig{Targets: []string{"tiles:8090"}}}
+	if err := rule.validate(); err != nil {
+		t.Fatalf("validate failed: %v", err)
+	}
+	if _, err := table.start(rule, false); err != nil {
+		t.Fatalf("start failed: %v", err)
+	}
+	if n := len(table.running[addrs[0]].lns); n != 6 {
+		t.Errorf("Expected 3 listeners on each of 2 addresses, got %d", n)
+	}
+
+	for i := range 20 {
+		conn, err := net.Dial("tcp", addrs[i%2])
+		if err != nil {
+			t.Fatalf("Failed to dial %s: %v", addrs[i%2], err)
+		}
+		b, _ := io.ReadAll(conn)
+		conn.Close()
+		if string(b) != "tiles:8090" {
+			t.Fatalf("Expected the connection forwarded to tiles:8090, got %q", b)
+		}
+	}
+
+	if _, err := table.start(ForwardRule{Listen: "9999", AlsoListen: []string{addrs[1]},
+		PoolConfig: PoolConfig{Targets: []string{"x:1"}}}, true); !errors.Is(err, errForwardExists) {
+		t.Errorf("Expected a rule reusing %s to be refused, got %v", addrs[1], err)
+	}
+	table.stop(addrs[0])
+	for _, a := range addrs {
+		if c, err := net.Dial("tcp", a); err == nil {
+			c.Close()
+			t.Errorf("Expected %s to be closed after stop", a)
+		}
+	}
+
+	if err := (ForwardRule{Listen: "80", AlsoListen: []string{"127.0.0.1:80"},
+		PoolConfig: PoolConfig{Targets: []string{"x:1"}}}).validate(); err == nil {
+		t.Error("Expected an address listed twice to be refused")
+	}
+}
+
+func TestRouteRewriteHostAndSNI(t *testing.T) {
+	var sni string
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Host)
+	}))
+	upstream.TLS = &tls.Config{GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		sni = hello.ServerName
+		return nil, nil
+	}}
+	upstream.StartTLS()
+	defer upstream.Close()
+
+	// Every route target is the TLS server, as if it were the ingress's tailnet IP
+	base := &MockDialer{DialFunc: func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return net.Dial("tcp", upstream.Listener.Addr().String())
+	}}
+	router := newRouter(base, []RouteRule{
+		{Host: "ingress", RewriteHost: "grafana.lab.internal", SNI: "example.com",
+			PoolConfig: PoolConfig{Targets: []string{"100.64.0.5"}}},
+	}, nil)
+	transport := &http.Transport{
+		DialContext:     router.Dial,
+		TLSClientConfig: upstream.Client().Transport.(*http.Transport).TLSClientConfig.Clone(),
+	}
+	proxy := &TailscaleProxy{Dialer: router, Transport: transport, Router: router}
+
+	w := httptest.NewRecorder()
+	proxy.handleHTTP(w, httptest.NewRequest("GET", "http://ingress/api/health", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body)
+	}
+	if w.Body.String() != "grafana.lab.internal" {
+		t.Errorf("Expected Host grafana.lab.internal at the upstream, got %q", w.Body)
+	}
+	if sni != "example.com" {
+		t.Errorf("Expected SNI example.com, got %q", sni)
+	}
+	if withSNI(transport, "example.com") != withSNI(transport, "example.com") {
+		t.Error("Expected the SNI transport to be reused")
+	}
+
+	for _, rule := range []RouteRule{
+		{Host: "ingress", RewriteHost: "a b", PoolConfig: PoolConfig{Targets: []string{"x"}}},
+		{Host: "ingress", SNI: "example.com:443", PoolConfig: PoolConfig{Targets: []string{"x"}}},
+	} {
+		if err := rule.validate(); err == nil {
+			t.Errorf("Expected %+v to be refused", rule)
+		}
+	}
+}
+
+func TestRouteTableAndTest(t *testing.T) {
+	router := newRouter(&recordingDialer{}, []RouteRule{
+		{Host: "workers", RewriteHost: "workers.internal", PoolConfig: PoolConfig{Targets: []string{"w1", "w2:9000"}, Backup: []string{"spare"}}},
+		{Host: "workers:22", PoolConfig: PoolConfig{Targets: []string{"never"}}},
+	}, func(host string) (bool, bool) { return host != "w1", true })
+	router.Services = map[string]string{"jobs": "workers:7000"}
+	routing = router
+	defer func() { routing = nil }()
+
+	mux := http.NewServeMux()
+	apiMux{mux}.HandleFunc("GET /routes", handleRoutes)
+	apiMux{mux}.HandleFunc("GET /routes/test", handleRouteTest)
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	var table RouteTable
+	resp, err := http.Get(srv.URL + "/api/v1/routes")
+	if err != nil {
+		t.Fatalf("GET /routes failed: %v", err)
+	}
+	json.NewDecoder(resp.Body).Decode(&table)
+	resp.Body.Close()
+	if table.Services["jobs"] != "workers:7000" || len(table.Routes) != 2 || table.Routes[0].RewriteHost != "workers.internal" {
+		t.Fatalf("Unexpected table %+v", table)
+	}
+	if b := table.Routes[0].Backends; len(b) != 3 || b[0].Available || !b[1].Available || !b[2].Backup {
+		t.Errorf("Expected w1 offline and spare as backup, got %+v", b)
+	}
+
+	test := func(host string) RouteTest {
+		t.Helper()
+		resp, err := http.Get(srv.URL + "/routes/test?host=" + host)
+		if err != nil {
+			t.Fatalf("GET /routes/test failed: %v", err)
+		}
+		defer resp.Body.Close()
+		var res RouteTest
+		json.NewDecoder(resp.Body).Decode(&res)
+		return res
+	}
+
+	// The first matching route wins; the offline target goes last
+	res := test("jobs:80")
+	if res.Action != "route" || res.Service != "jobs" || res.Resolved != "workers:7000" || *res.Route != 0 {
+		t.Fatalf("Unexpected result %+v", res)
+	}
+	if strings.Join(res.Order, ",") != "w2:9000,spare:7000,w1:7000" || !strings.Contains(res.Explanation, "spare:7000 (backup)") {
+		t.Errorf("Unexpected order %v: %s", res.Order, res.Explanation)
+	}
+	if res := test("minio:9000"); res.Action != "direct" || res.Route != nil {
+		t.Errorf("Expected a direct dial, got %+v", res)
+	}
+	if res := test("service:nope"); res.Action != "reject" || !strings.Contains(res.Explanation, "unknown service") {
+		t.Errorf("Expected a rejection, got %+v", res)
+	}
+
+	// A dry run doesn't take a turn
+	if router.routes[0].pool.next != 0 {
+		t.Error("Expected the round-robin position to be untouched")
+	}
+	if resp, _ := http.Get(srv.URL + "/routes/test"); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected 400 without host, got %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// --- S3 PROFILES ---
+
+const (
+	s3DefaultParallel = 4
+	s3DefaultPartMB   = 8
+	s3DefaultMinMB    = 64
+	s3DefaultBufferKB = 1024
+	s3MaxParallel     = 16
+
+	// s3ContinueTimeout is how long an upload waits for the server's
+	// "100 Continue" before sending the body anyway
+	s3ContinueTimeout = 5 * time.Second
+)
+
+// S3Profile is one entry of the s3 section of the config file. It tunes
+// plain HTTP traffic to an S3-compatible endpoint such as MinIO.
+type S3Profile struct {
+	Host       string `json:"host"`                   // host or host:port, as in mirrors
+	Parallel   int    `json:"parallel,omitempty"`     // range requests in flight per download, default 4 (1 disables)
+	PartSizeMB int    `json:"part_size_mb,omitempty"` // size of each range request, default 8
+	MinSizeMB  int    `json:"min_size_mb,omitempty"`  // objects below this are fetched in one piece, default 64
+	BufferKB   int    `json:"buffer_kb,omitempty"`    // socket read/write buffers, default 1024
+}
+
+func (p *S3Profile) validate() error {
+	if p.Host == "" {
+		return fmt.Errorf("host is required")
+	}
+	if p.Parallel < 0 || p.Parallel > s3MaxParallel {
+		return fmt.Errorf("parallel must be between 1 and %d, got %d", s3MaxParallel, p.Parallel)
+	}
+	if p.PartSizeMB < 0 || p.MinSizeMB < 0 || p.BufferKB < 0 {
+		return fmt.Errorf("sizes must not be negative")
+	}
+	return nil
+}
+
+// S3Stats is one endpoint's row in /stats/s3
+type S3Stats struct {
+	Host      string `json:"host"`
+	Downloads int64  `json:"downloads"` // GETs fanned out over range requests
+	Parts     int64  `json:"parts"`
+	Bytes     int64  `json:"bytes"`
+}
+
+// s3Endpoint applies a profile. Its transport has large buffers and waits
+// for "100 Continue" end to end, so an upload the server rejects never
+// crosses the tailnet.
+type s3Endpoint struct {
+	host      string
+	parallel  int
+	partSize  int64
+	minSize   int64
+	buffer    int
+	transport *http.Transport // nil without a dialer, as in tests
+
+	downloads, parts, bytes atomic.Int64
+}
+
+type s3Endpoints []*s3Endpoint
+
+// s3 is nil unless the config has an s3 section
+var s3 s3Endpoints
+
+func newS3Endpoints(profiles []S3Profile, dial func(ctx context.Context, network, addr string) (net.Conn, error)) s3Endpoints {
+	var eps s3Endpoints
+	for _, p := range profiles {
+		ep := &s3Endpoint{
+			host:     p.Host,
+			parallel: cmp.Or(p.Parallel, s3DefaultParallel),
+			partSize: int64(cmp.Or(p.PartSizeMB, s3DefaultPartMB)) << 20,
+			minSize:  int64(cmp.Or(p.MinSizeMB, s3DefaultMinMB)) << 20,
+			buffer:   cmp.Or(p.BufferKB, s3DefaultBufferKB) << 10,
+		}
+		if dial != nil {
+			ep.transport = &http.Transport{
+				DialContext:           dial,
+				ReadBufferSize:        ep.buffer,
+				WriteBufferSize:       ep.buffer,
+				ExpectContinueTimeout: s3ContinueTimeout,
+				MaxIdleConnsPerHost:   ep.parallel,
+			}
+		}
+		eps = append(eps, ep)
+	}
+	return eps
+}
+
+// match returns the endpoint for r's host, if any
+func (eps s3Endpoints) match(r *http.Request) *s3Endpoint {
+	for _, ep := range eps {
+		if matchHost(ep.host, r.URL.Host) {
+			return ep
+		}
+	}
+	return nil
+}
+
+func (eps s3Endpoints) stats() []S3Stats {
+	list := []S3Stats{}
+	for _, ep := range eps {
+		list = append(list, S3Stats{Host: ep.host, Downloads: ep.downloads.Load(), Parts: ep.parts.Load(), Bytes: ep.bytes.Load()})
+	}
+	return list
+}
+
+// roundTrip sends r through rt. Plain GETs of large objects are split into
+// range requests that run in parallel over separate tailnet connections,
+// since a single stream over DERP is slow; the client still gets one 200
+// response with the parts in order.
+func (ep *s3Endpoint) roundTrip(rt http.RoundTripper, r *http.Request) (*http.Response, error) {
+	if !ep.splittable(r) {
+		return rt.RoundTrip(r)
+	}
+
+	// The first part tells the object's size and version
+	first := r.Clone(r.Context())
+	first.Header.Set("Range", fmt.Sprintf("bytes=0-%d", ep.partSize-1))
+	resp, err := rt.RoundTrip(first)
+	if err != nil || resp.StatusCode != http.StatusPartialContent {
+		return resp, err // 200: the server ignored the range and sends everything
+	}
+	size, ok := contentRangeSize(resp.Header.Get("Content-Range"))
+	if !ok {
+		resp.Body.Close()
+		return rt.RoundTrip(r)
+	}
+
+	var rest [][2]int64 // byte ranges after the first part
+	switch {
+	case size <= ep.partSize:
+	case size < ep.minSize || ep.parallel == 1:
+		rest = append(rest, [2]int64{ep.partSize, size - 1})
+	default:
+		for start := ep.partSize; start < size; start += ep.partSize {
+			rest = append(rest, [2]int64{start, min(start+ep.partSize, size) - 1})
+		}
+	}
+
+	out := &http.Response{
+		Status:        "200 OK",
+		StatusCode:    http.StatusOK,
+		Proto:         resp.Proto,
+		ProtoMajor:    resp.ProtoMajor,
+		ProtoMinor:    resp.ProtoMinor,
+		Header:        resp.Header.Clone(),
+		ContentLength: size,
+		Request:       r,
+	}
+	out.Header.Del("Content-Range")
+	out.Header.Set("Content-Length", strconv.FormatInt(size, 10))
+	if len(rest) == 0 {
+		out.Body = resp.Body
+		return out, nil
+	}
+
+	// Later parts must come from the same version of the object
+	etag := resp.Header.Get("ETag")
+	if len(rest) > 1 {
+		ep.downloads.Add(1)
+		ep.parts.Add(int64(len(rest) + 1))
+		ep.bytes.Add(size)
+		fmt.Fprintf(console, "[S3] GET %s%s: %d MiB in %d parts, %d in parallel\n", r.URL.Host, r.URL.Path, size>>20, len(rest)+1, ep.parallel)
+	}
+	ctx, cancel := context.WithCancel(r.Context())
+	pr, pw := io.Pipe()
+	out.Body = cancelOnClose{pr, cancel}
+	go ep.fetchParts(ctx, rt, r, etag, resp.Body, rest, pw)
+	return out, nil
+}
+
+// splittable reports whether r is a plain GET of a whole object
+func (ep *s3Endpoint) splittable(r *http.Request) bool {
+	if r.Method != http.MethodGet || r.Header.Get("Range") != "" || r.Header.Get("If-Range") != "" {
+		return false
+	}
+	// Listings and other sub-resources are small and not rangeable
+	for k := range r.URL.Query() {
+		// Presigned URLs and versions still name a whole object
+		if !strings.HasPrefix(strings.ToLower(k), "x-amz-") && k != "versionId" && k != "AWSAccessKeyId" && k != "Signature" && k != "Expires" {
+			return false
+		}
+	}
+	return true
+}
+
+// fetchParts streams the first part's body and then the other ranges in
+// order into w, keeping up to ep.parallel requests in flight
+func (ep *s3Endpoint) fetchParts(ctx context.Context, rt http.RoundTripper, r *http.Request, etag string, first io.ReadCloser, rest [][2]int64, w *io.PipeWriter) {
+	type part struct {
+		data []byte
+		err  error
+	}
+	slots := make(chan struct{}, ep.parallel)
+	results := make([]chan part, len(rest))
+	for i := range results {
+		results[i] = make(chan part, 1)
+	}
+
+	// Parts start in order, each holding a slot until it has been written
+	go func() {
+		for i, rg := range rest {
+			select {
+			case slots <- struct{}{}:
+			case <-ctx.Done():
+				results[i] <- part{err: ctx.Err()}
+				continue
+			}
+			go func() {
+				data, err := ep.fetchRange(ctx, rt, r, etag, rg)
+				results[i] <- part{data, err}
+			}()
+		}
+	}()
+
+	_, err := io.Copy(w, first)
+	first.Close()
+	for _, res := range results {
+		if err != nil {
+			break
+		}
+		p := <-res
+		if err = p.err; err == nil {
+			_, err = w.Write(p.data)
+		}
+		<-slots
+	}
+	if err != nil {
+		logRedacted("[S3] GET %s%s failed: %v\n", r.URL.Host, r.URL.Path, err)
+	}
+	w.CloseWithError(err)
+}
+
+// fetchRange downloads one range, trying once more on failure
+func (ep *s3Endpoint) fetchRange(ctx context.Context, rt http.RoundTripper, r *http.Request, etag string, rg [2]int64) ([]byte, error) {
+	var err error
+	for attempt := 0; attempt < 2; attempt++ {
+		req := r.Clone(ctx)
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", rg[0], rg[1]))
+		if etag != "" {
+			req.Header.Set("If-Match", etag)
+		}
+		var resp *http.Response
+		if resp, err = rt.RoundTrip(req); err != nil {
+			if ctx.Err() != nil {
+				return nil, err
+			}
+			continue // a dropped tailnet connection is worth another try
+		}
+		if resp.StatusCode != http.StatusPartialContent {
+			resp.Body.Close()
+			// 412: the object changed since the first part
+			return nil, fmt.Errorf("range %d-%d: %s", rg[0], rg[1], resp.Status)
+		}
+		data := make([]byte, rg[1]-rg[0]+1)
+		_, err = io.ReadFull(resp.Body, data)
+		resp.Body.Close()
+		if err == nil || ctx.Err() != nil {
+			return data, err
+		}
+	}
+	return nil, err
+}
+
+// contentRangeSize returns the total size from "bytes 0-99/1234"
+func contentRangeSize(header string) (int64, bool) {
+	_, total, ok := strings.Cut(header, "/")
+	if !ok || !strings.HasPrefix(header, "bytes ") {
+		return 0, false
+	}
+	size, err := strconv.ParseInt(total, 10, 64)
+	return size, err == nil && size > 0
+}
+
+// cancelOnClose stops the part downloads when the client goes away
+type cancelOnClose struct {
+	*io.PipeReader
+	cancel context.CancelFunc
+}
+
+func (c cancelOnClose) Close() error {
+	c.cancel()
+	return c.PipeReader.Close()
+}
+
+// handleS3Stats serves the per-endpoint counters on the status API
+func handleS3Stats(w http.ResponseWriter, r *http.Request) {
+	if s3 == nil {
+		http.Error(w, "no s3 section in the config", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s3.stats())
+}
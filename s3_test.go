@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestS3ParallelDownload(t *testing.T) {
+	object := make([]byte, 10500)
+	for i := range object {
+		object[i] = byte(rand.IntN(256))
+	}
+	var ranges atomic.Int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Range") != "" {
+			ranges.Add(1)
+		}
+		w.Header().Set("ETag", `"v1"`)
+		http.ServeContent(w, r, "object", time.Time{}, bytes.NewReader(object))
+	}))
+	defer srv.Close()
+
+	ep := newS3Endpoints([]S3Profile{{Host: "127.0.0.1", Parallel: 3}}, nil)[0]
+	ep.partSize, ep.minSize = 1000, 2000
+
+	resp, err := ep.roundTrip(http.DefaultTransport, httptest.NewRequest("GET", srv.URL+"/bucket/object", nil))
+	if err != nil {
+		t.Fatalf("roundTrip failed: %v", err)
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatalf("Reading the body failed: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK || resp.ContentLength != int64(len(object)) || resp.Header.Get("Content-Range") != "" {
+		t.Errorf("Expected a plain 200 for the whole object, got %d with length %d", resp.StatusCode, resp.ContentLength)
+	}
+	if !bytes.Equal(body, object) {
+		t.Error("Expected the parts to be reassembled in order")
+	}
+	if ranges.Load() != 11 || ep.parts.Load() != 11 || ep.downloads.Load() != 1 {
+		t.Errorf("Expected 11 range requests, got %d (%d parts counted)", ranges.Load(), ep.parts.Load())
+	}
+
+	// Below min_size the rest comes in one request
+	ranges.Store(0)
+	ep.minSize = 1 << 20
+	resp, _ = ep.roundTrip(http.DefaultTransport, httptest.NewRequest("GET", srv.URL+"/bucket/object", nil))
+	body, _ = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !bytes.Equal(body, object) || ranges.Load() != 2 {
+		t.Errorf("Expected the object in 2 requests, got %d", ranges.Load())
+	}
+
+	// Listings, client ranges and uploads pass through
+	for _, req := range []*http.Request{
+		httptest.NewRequest("GET", srv.URL+"/bucket?list-type=2", nil),
+		httptest.NewRequest("PUT", srv.URL+"/bucket/object", strings.NewReader("x")),
+	} {
+		if ep.splittable(req) {
+			t.Errorf("Expected %s %s not to be split", req.Method, req.URL)
+		}
+	}
+	ranged := httptest.NewRequest("GET", srv.URL+"/bucket/object", nil)
+	ranged.Header.Set("Range", "bytes=0-9")
+	if ep.splittable(ranged) {
+		t.Error("Expected a client's own range request not to be split")
+	}
+	if !ep.splittable(httptest.NewRequest("GET", srv.URL+"/bucket/object?X-Amz-Signature=abc&X-Amz-Expires=60", nil)) {
+		t.Error("Expected a presigned GET to be split")
+	}
+}
+
+func TestS3ObjectChanged(t *testing.T) {
+	var version atomic.Int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Every request sees a new version of the object
+		w.Header().Set("ETag", fmt.Sprintf(`"v%d"`, version.Add(1)))
+		http.ServeContent(w, r, "object", time.Time{}, bytes.NewReader(make([]byte, 5000)))
+	}))
+	defer srv.Close()
+
+	ep := newS3Endpoints([]S3Profile{{Host: "127.0.0.1"}}, nil)[0]
+	ep.partSize, ep.minSize = 1000, 2000
+	resp, err := ep.roundTrip(http.DefaultTransport, httptest.NewRequest("GET", srv.URL+"/bucket/object", nil))
+	if err != nil {
+		t.Fatalf("roundTrip failed: %v", err)
+	}
+	defer resp.Body.Close()
+	if _, err := io.ReadAll(resp.Body); err == nil || !strings.Contains(err.Error(), "412") {
+		t.Errorf("Expected the download to fail when the object changes, got %v", err)
+	}
+}
+
+func TestContentRangeSize(t *testing.T) {
+	if size, ok := contentRangeSize("bytes 0-999/10500"); !ok || size != 10500 {
+		t.Errorf("Expected 10500, got %d", size)
+	}
+	for _, h := range []string{"", "bytes 0-999/*", "items 0-1/2"} {
+		if _, ok := contentRangeSize(h); ok {
+			t.Errorf("Expected %q to be rejected", h)
+		}
+	}
+}
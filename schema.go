@@ -0,0 +1,343 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"reflect"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// --- CONFIG SCHEMA ---
+
+// jsonSchema is the subset of JSON Schema (draft 2020-12) the config needs
+type jsonSchema struct {
+	Schema      string                 `json:"$schema,omitempty"`
+	Title       string                 `json:"title,omitempty"`
+	Description string                 `json:"description,omitempty"`
+	Type        string                 `json:"type"`
+	Properties  map[string]*jsonSchema `json:"properties,omitempty"`
+	Required    []string               `json:"required,omitempty"`
+	// false for structs, whose unknown fields are rejected, or the schema
+	// of a map's values
+	AdditionalProperties any         `json:"additionalProperties,omitempty"`
+	Items                *jsonSchema `json:"items,omitempty"`
+	Enum                 []string    `json:"enum,omitempty"`
+}
+
+// configDocs describes the config file's sections, for form editors
+var configDocs = map[string]string{
+	"mirrors":       "Copies of a share of requests sent to a second target",
+	"forwards":      "Local ports forwarded to tailnet targets",
+	"routes":        "Requested hosts sent to pools of tailnet backends",
+	"announce":      "Services announced to other sidecars",
+	"services":      "Service names and the tailnet host:port they stand for",
+	"remote_exec":   "Commands peers may run on this node",
+	"share":         "Who may send snippets to this node",
+	"users":         "Local accounts allowed to use the proxies (Linux)",
+	"redact":        "Extra regular expressions scrubbed from logs",
+	"service_token": "Credentials attached to requests for Arkitekt core",
+	"graphql":       "Persisted queries and retries per GraphQL endpoint",
+	"s3":            "Tuning for S3-compatible endpoints (MinIO)",
+	"prewarm":       "Ready connections to the busiest destinations",
+	"queue":         "Uploads kept while their host is unreachable",
+	"events":        "Where signals go; stdout if empty",
+	"alerts":        "Conditions that fire ALERT signals once they hold for a while",
+	"policies":      "Sessions selected by SOCKS5 user name, with their own routes and limits",
+	"sni":           "TLS server names and the tailnet targets -mode sni passes them to",
+	"expose":        "Local services published on this node's tailnet address",
+	"include":       "Files merged in first, relative to this one",
+	"profiles":      "Named settings merged over the rest when selected with -profile",
+}
+
+// configEnums lists the values of fields that take one of a few words,
+// keyed by type and JSON name. validate checks them on load.
+var configEnums = map[string][]string{
+	"PoolConfig.balance":        {BalanceRoundRobin, BalanceLeastConn},
+	"RouteRule.proxy_protocol":  {ProxyProtocolV2},
+	"ExposeRule.proxy_protocol": {ProxyProtocolV2},
+	"PoolConfig.sticky":         {"client_ip", "cookie"},
+	"ForwardRule.compress":      {"zstd"},
+	"SinkConfig.type":           {"stdout", "json", "unix", "webhook", "mqtt", "desktop"},
+	"AlertRule.when":            {AlertPeerOffline, AlertPeerRelayed, AlertErrorRate},
+}
+
+// configSchema returns the schema of the config file. It is generated from
+// the Config type, so it can't drift: fields without omitempty are required.
+func configSchema() *jsonSchema {
+	s := schemaFor(reflect.TypeFor[Config]())
+	s.Schema = "https://json-schema.org/draft/2020-12/schema"
+	s.Title = "Arkitekt sidecar config"
+
+	// include and profiles are resolved before the rest is decoded. A
+	// profile may set anything but these two.
+	profile := &jsonSchema{Type: "object", Properties: maps.Clone(s.Properties), AdditionalProperties: false}
+	profile.Properties["extends"] = &jsonSchema{Type: "string", Description: "Profile this one builds on"}
+	s.Properties["include"] = &jsonSchema{Type: "array", Items: &jsonSchema{Type: "string"}}
+	s.Properties["profiles"] = &jsonSchema{Type: "object", AdditionalProperties: profile}
+	for name, doc := range configDocs {
+		s.Properties[name].Description = doc
+	}
+	return s
+}
+
+func schemaFor(t reflect.Type) *jsonSchema {
+	switch t.Kind() {
+	case reflect.Pointer:
+		return schemaFor(t.Elem())
+	case reflect.String:
+		return &jsonSchema{Type: "string"}
+	case reflect.Bool:
+		return &jsonSchema{Type: "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return &jsonSchema{Type: "integer"}
+	case reflect.Float32, reflect.Float64:
+		return &jsonSchema{Type: "number"}
+	case reflect.Slice, reflect.Array:
+		return &jsonSchema{Type: "array", Items: schemaFor(t.Elem())}
+	case reflect.Map:
+		return &jsonSchema{Type: "object", AdditionalProperties: schemaFor(t.Elem())}
+	case reflect.Struct:
+		s := &jsonSchema{Type: "object", Properties: map[string]*jsonSchema{}, AdditionalProperties: false}
+		addFields(s, t)
+		sort.Strings(s.Required)
+		return s
+	}
+	panic(fmt.Sprintf("no schema for %s", t))
+}
+
+// addFields adds the JSON fields of struct t to s, flattening embedded ones
+func addFields(s *jsonSchema, t reflect.Type) {
+	for i := range t.NumField() {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" || (!f.IsExported() && !f.Anonymous) {
+			continue
+		}
+		name, opts, _ := strings.Cut(tag, ",")
+		if f.Anonymous && name == "" {
+			addFields(s, f.Type)
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		prop := schemaFor(f.Type)
+		prop.Enum = configEnums[t.Name()+"."+name]
+		s.Properties[name] = prop
+		if !strings.Contains(opts, "omitempty") {
+			s.Required = append(s.Required, name)
+		}
+	}
+}
+
+// checkSchema reports the first place doc (decoded with UseNumber) doesn't
+// fit s, by its path in the file. Types and unknown fields are checked
+// here; required fields and enums are left to the config's validate, whose
+// messages say more about what is missing.
+func checkSchema(doc any, s *jsonSchema, path string) error {
+	at := func() string {
+		if path == "" {
+			return "config"
+		}
+		return path
+	}
+	if doc == nil {
+		return nil // null is the zero value, as for encoding/json
+	}
+	switch s.Type {
+	case "string":
+		if _, ok := doc.(string); !ok {
+			return fmt.Errorf("%s: expected a string, got %s", at(), jsonKind(doc))
+		}
+	case "boolean":
+		if _, ok := doc.(bool); !ok {
+			return fmt.Errorf("%s: expected true or false, got %s", at(), jsonKind(doc))
+		}
+	case "integer":
+		n, ok := doc.(json.Number)
+		if _, err := n.Int64(); !ok || err != nil {
+			return fmt.Errorf("%s: expected a whole number, got %s", at(), jsonKind(doc))
+		}
+	case "number":
+		if _, ok := doc.(json.Number); !ok {
+			return fmt.Errorf("%s: expected a number, got %s", at(), jsonKind(doc))
+		}
+	case "array":
+		list, ok := doc.([]any)
+		if !ok {
+			return fmt.Errorf("%s: expected a list, got %s", at(), jsonKind(doc))
+		}
+		for i, item := range list {
+			if err := checkSchema(item, s.Items, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+				return err
+			}
+		}
+	case "object":
+		obj, ok := doc.(map[string]any)
+		if !ok {
+			return fmt.Errorf("%s: expected an object, got %s", at(), jsonKind(doc))
+		}
+		keys := make([]string, 0, len(obj))
+		for k := range obj {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			sub := joinPath(path, k)
+			prop, known := s.Properties[k]
+			if !known {
+				values, isMap := s.AdditionalProperties.(*jsonSchema)
+				if !isMap {
+					return fmt.Errorf("%s: unknown field %q%s", at(), k, didYouMean(k, s.Properties))
+				}
+				prop = values
+			}
+			if err := checkSchema(obj[k], prop, sub); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// joinPath appends a field to a path like routes[1].targets
+func joinPath(path, field string) string {
+	if path == "" {
+		return field
+	}
+	return path + "." + field
+}
+
+// didYouMean suggests a known field for a misspelled one
+func didYouMean(field string, props map[string]*jsonSchema) string {
+	names := make([]string, 0, len(props))
+	for name := range props {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if editDistance(field, name) <= 2 {
+			return fmt.Sprintf(" (did you mean %q?)", name)
+		}
+	}
+	return ""
+}
+
+// editDistance is the Levenshtein distance of a and b
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur := make([]int, len(b)+1)
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev = cur
+	}
+	return prev[len(b)]
+}
+
+// jsonKind names the type of a decoded JSON value
+func jsonKind(v any) string {
+	switch v.(type) {
+	case string:
+		return "a string"
+	case bool:
+		return "true or false"
+	case json.Number:
+		return "a number"
+	case []any:
+		return "a list"
+	case map[string]any:
+		return "an object"
+	}
+	return "null"
+}
+
+// decodeChecked decodes a config file on its own, without includes or a
+// profile, into cfg
+func decodeChecked(data []byte, cfg *Config, lookup func(string) (string, bool)) error {
+	doc, err := parseChecked(data, lookup)
+	if err != nil {
+		return err
+	}
+	delete(doc, "profiles")
+	return decodeDoc(doc, cfg)
+}
+
+// parseChecked parses data, expands ${VARIABLES} with lookup and checks the
+// result against the config schema. Syntax errors name the line and column.
+func parseChecked(data []byte, lookup func(string) (string, bool)) (map[string]any, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var doc any
+	if err := dec.Decode(&doc); err != nil {
+		var syntax *json.SyntaxError
+		if errors.As(err, &syntax) {
+			line, col := lineCol(data, syntax.Offset)
+			return nil, fmt.Errorf("line %d, column %d: %w", line, col, err)
+		}
+		return nil, err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, errors.New("unexpected content after the config object")
+	}
+	schema := configSchema()
+	doc, err := interpolate(doc, schema, "", lookup)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkSchema(doc, schema, ""); err != nil {
+		return nil, err
+	}
+	obj, _ := doc.(map[string]any)
+	if obj == nil {
+		obj = map[string]any{} // a file that is just null
+	}
+	return obj, nil
+}
+
+// decodeDoc decodes a checked document into cfg
+func decodeDoc(doc map[string]any, cfg *Config) error {
+	data, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	strict := json.NewDecoder(bytes.NewReader(data))
+	strict.DisallowUnknownFields()
+	return strict.Decode(cfg)
+}
+
+// lineCol turns the offset of a syntax error, which is just past the
+// offending byte, into its 1-based line and column
+func lineCol(data []byte, offset int64) (int, int) {
+	before := data[:max(0, min(int(offset)-1, len(data)))]
+	line := bytes.Count(before, []byte("\n")) + 1
+	col := len(before) - bytes.LastIndexByte(before, '\n')
+	return line, col
+}
+
+// runConfigCommand implements `sidecar config schema`
+func runConfigCommand(args []string, stdout io.Writer) error {
+	commands := []string{"schema"}
+	if len(args) == 0 || !slices.Contains(commands, args[0]) {
+		return fmt.Errorf("usage: config %s", strings.Join(commands, "|"))
+	}
+	enc := json.NewEncoder(stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(configSchema())
+}
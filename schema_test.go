@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestConfigSchema(t *testing.T) {
+	s := configSchema()
+	if s.AdditionalProperties != false {
+		t.Errorf("Expected unknown top-level fields to be rejected")
+	}
+	// Every field of Config is described
+	cfg := reflect.TypeFor[Config]()
+	for i := range cfg.NumField() {
+		name, _, _ := strings.Cut(cfg.Field(i).Tag.Get("json"), ",")
+		if prop := s.Properties[name]; prop == nil || prop.Description == "" {
+			t.Errorf("Expected %s in the schema with a description", name)
+		}
+	}
+	route := s.Properties["routes"].Items
+	if !slices.Contains(route.Required, "host") || !slices.Contains(route.Properties["balance"].Enum, BalanceLeastConn) {
+		t.Errorf("Unexpected route schema %+v", route)
+	}
+	if route.Properties["targets"].Type != "array" {
+		t.Errorf("Expected the embedded pool fields to be flattened, got %+v", route.Properties)
+	}
+	if _, ok := s.Properties["services"].AdditionalProperties.(*jsonSchema); !ok {
+		t.Errorf("Expected services to be a map")
+	}
+}
+
+// noEnv is a lookup with no variables set
+func noEnv(string) (string, bool) { return "", false }
+
+func TestDecodeChecked(t *testing.T) {
+	for _, tc := range []struct {
+		doc, want string
+	}{
+		{`{"routes": [{"host": "a", "targets": ["b"]}, {"host": "c", "targets": "d"}]}`, "routes[1].targets: expected a list, got a string"},
+		{`{"forwards": [{"listne": "9000"}]}`, `forwards[0]: unknown field "listne" (did you mean "listen"?)`},
+		{`{"graphql": [{"host": "core", "retries": 1.5}]}`, "graphql[0].retries: expected a whole number, got a number"},
+		{`{"services": {"core": 8000}}`, "services.core: expected a string, got a number"},
+		{`{"routes": []`, "unexpected EOF"},
+		{"{\n  \"routes\": [],\n}", "line 3, column 1:"},
+		{`{} {}`, "unexpected content after the config object"},
+		{`[]`, "config: expected an object, got a list"},
+	} {
+		var cfg Config
+		err := decodeChecked([]byte(tc.doc), &cfg, noEnv)
+		if err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("%s: expected %q, got %v", tc.doc, tc.want, err)
+		}
+	}
+
+	var cfg Config
+	if err := decodeChecked([]byte(`{"routes": [{"host": "a", "targets": ["b"], "sticky": null}]}`), &cfg, noEnv); err != nil {
+		t.Fatalf("decodeChecked failed: %v", err)
+	}
+	if len(cfg.Routes) != 1 || cfg.Routes[0].Targets[0] != "b" {
+		t.Errorf("Unexpected config %+v", cfg)
+	}
+}
+
+func TestRunConfigCommand(t *testing.T) {
+	var out bytes.Buffer
+	if err := runConfigCommand([]string{"schema"}, &out); err != nil {
+		t.Fatalf("config schema failed: %v", err)
+	}
+	var doc map[string]any
+	if err := json.Unmarshal(out.Bytes(), &doc); err != nil {
+		t.Fatalf("Expected JSON, got %v", err)
+	}
+	if doc["$schema"] == nil || doc["properties"] == nil {
+		t.Errorf("Unexpected schema %s", out.String())
+	}
+	if err := runConfigCommand(nil, &out); err == nil {
+		t.Errorf("Expected a usage error")
+	}
+}
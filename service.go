@@ -0,0 +1,182 @@
+package main
+
+import (
+	"encoding/xml"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+)
+
+// --- OS SERVICES ---
+
+// serviceStopTimeout bounds how long stop waits for the sidecar to exit
+const serviceStopTimeout = 30 * time.Second
+
+// serviceSpec is a sidecar registered with the OS service manager: a
+// Windows service or a launchd agent (a daemon when installed as root)
+type serviceSpec struct {
+	Name   string
+	Exe    string
+	Dir    string   // working directory, so relative paths in Args keep working
+	LogDir string   // stdout and stderr go to <LogDir>/<Name>.log
+	Args   []string // the sidecar's flags
+}
+
+var serviceNameRE = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+// runServiceCommand implements `sidecar service install|uninstall|start|stop`.
+// install registers the sidecar with the flags after --, e.g.
+// `sidecar service install -- -authkey file:/etc/sidecar/key -control-url URL`.
+func runServiceCommand(args []string, stdout io.Writer) error {
+	commands := []string{"install", "uninstall", "start", "stop"}
+	if len(args) == 0 || !slices.Contains(commands, args[0]) {
+		return fmt.Errorf("usage: service %s [-name NAME] [-log-dir DIR] [-- sidecar flags]", strings.Join(commands, "|"))
+	}
+	fs := flag.NewFlagSet("service "+args[0], flag.ContinueOnError)
+	var (
+		name   = fs.String("name", "arkitekt-sidecar", "Name of the service, to install several side by side")
+		logDir = fs.String("log-dir", "", "Directory for the service's log file (default "+defaultServiceLogDir()+")")
+	)
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+	if !serviceNameRE.MatchString(*name) {
+		return fmt.Errorf("invalid service name %q", *name)
+	}
+	if args[0] != "install" {
+		if fs.NArg() > 0 {
+			return fmt.Errorf("service %s takes no sidecar flags", args[0])
+		}
+		switch args[0] {
+		case "uninstall":
+			err := uninstallService(*name)
+			if err == nil {
+				fmt.Fprintf(stdout, ">>> Uninstalled service %s\n", *name)
+			}
+			return err
+		case "start":
+			return startService(*name)
+		default:
+			return stopService(*name)
+		}
+	}
+
+	spec := serviceSpec{Name: *name, LogDir: *logDir, Args: fs.Args()}
+	if spec.LogDir == "" {
+		spec.LogDir = defaultServiceLogDir()
+	}
+	var err error
+	if spec.Exe, err = os.Executable(); err != nil {
+		return err
+	}
+	if spec.Dir, err = os.Getwd(); err != nil {
+		return err
+	}
+	if spec.LogDir, err = filepath.Abs(spec.LogDir); err != nil {
+		return err
+	}
+	if key := plainAuthKey(spec.Args); key != "" {
+		fmt.Fprintf(stdout, "!!! %s is stored in the service definition in plain text; consider file:<path>\n", key)
+	}
+	if err := os.MkdirAll(spec.LogDir, 0755); err != nil {
+		return err
+	}
+	where, err := installService(spec)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, ">>> Installed service %s (%s), logging to %s\n", spec.Name, where, filepath.Join(spec.LogDir, spec.Name+".log"))
+	return nil
+}
+
+// plainAuthKey names the secret flag in args given as a literal value
+// rather than a reference, or returns ""
+func plainAuthKey(args []string) string {
+	for i, arg := range args {
+		name, value, hasValue := strings.Cut(strings.TrimLeft(arg, "-"), "=")
+		if !strings.HasPrefix(arg, "-") || (name != "authkey" && name != "oauth-client-secret") {
+			continue
+		}
+		if !hasValue && i+1 < len(args) {
+			value = args[i+1]
+		}
+		if !strings.HasPrefix(value, "keyring:") && !strings.HasPrefix(value, "file:") && !strings.HasPrefix(value, "env:") {
+			return "-" + name
+		}
+	}
+	return ""
+}
+
+// serviceRunArgs is the command line the Windows service manager starts:
+// `sidecar service run` redirects the output and hands the flags on
+func serviceRunArgs(spec serviceSpec) []string {
+	return append([]string{"service", "run", "-name", spec.Name, "-log-dir", spec.LogDir, "-dir", spec.Dir, "--"}, spec.Args...)
+}
+
+// parseServiceRun reads the arguments of `sidecar service run`
+func parseServiceRun(args []string) (spec serviceSpec, err error) {
+	fs := flag.NewFlagSet("service run", flag.ContinueOnError)
+	fs.StringVar(&spec.Name, "name", "arkitekt-sidecar", "")
+	fs.StringVar(&spec.LogDir, "log-dir", "", "")
+	fs.StringVar(&spec.Dir, "dir", "", "")
+	if err := fs.Parse(args); err != nil {
+		return spec, err
+	}
+	if spec.LogDir == "" || spec.Dir == "" {
+		return spec, errors.New("service run is started by the service manager; use service install")
+	}
+	spec.Args = fs.Args()
+	return spec, nil
+}
+
+// launchdLabel is the launchd job of a service
+func launchdLabel(name string) string {
+	return "live.arkitekt." + name
+}
+
+// launchdPlist is the job definition of a service. The job starts at load
+// and is restarted when it fails, but not after a clean stop.
+func launchdPlist(spec serviceSpec) []byte {
+	esc := func(s string) string {
+		var b strings.Builder
+		xml.EscapeText(&b, []byte(s))
+		return b.String()
+	}
+	var args strings.Builder
+	for _, a := range append([]string{spec.Exe}, spec.Args...) {
+		args.WriteString("\t\t<string>" + esc(a) + "</string>\n")
+	}
+	logFile := esc(filepath.Join(spec.LogDir, spec.Name+".log"))
+	return []byte(`<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+<dict>
+	<key>Label</key>
+	<string>` + esc(launchdLabel(spec.Name)) + `</string>
+	<key>ProgramArguments</key>
+	<array>
+` + args.String() + `	</array>
+	<key>WorkingDirectory</key>
+	<string>` + esc(spec.Dir) + `</string>
+	<key>RunAtLoad</key>
+	<true/>
+	<key>KeepAlive</key>
+	<dict>
+		<key>SuccessfulExit</key>
+		<false/>
+	</dict>
+	<key>StandardOutPath</key>
+	<string>` + logFile + `</string>
+	<key>StandardErrorPath</key>
+	<string>` + logFile + `</string>
+</dict>
+</plist>
+`)
+}
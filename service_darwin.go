@@ -0,0 +1,89 @@
+//go:build darwin
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// launchdTarget is where a service's job lives: a daemon in the system
+// domain when installed as root, else an agent of the user
+func launchdTarget(name string) (plist, domain string) {
+	file := launchdLabel(name) + ".plist"
+	if os.Geteuid() == 0 {
+		return filepath.Join("/Library/LaunchDaemons", file), "system"
+	}
+	home, _ := os.UserHomeDir()
+	return filepath.Join(home, "Library", "LaunchAgents", file), fmt.Sprintf("gui/%d", os.Getuid())
+}
+
+func defaultServiceLogDir() string {
+	if os.Geteuid() == 0 {
+		return "/Library/Logs/arkitekt-sidecar"
+	}
+	home, _ := os.UserHomeDir()
+	return filepath.Join(home, "Library", "Logs", "arkitekt-sidecar")
+}
+
+// launchctl runs launchctl and returns its output as the error
+func launchctl(args ...string) error {
+	out, err := exec.Command("launchctl", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("launchctl %s: %v: %s", args[0], err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// installService writes the job and loads it, which starts it
+func installService(spec serviceSpec) (string, error) {
+	plist, domain := launchdTarget(spec.Name)
+	if _, err := os.Stat(plist); err == nil {
+		return "", fmt.Errorf("service %s already exists (%s); uninstall it first", spec.Name, plist)
+	}
+	if err := os.MkdirAll(filepath.Dir(plist), 0755); err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(plist, launchdPlist(spec), 0644); err != nil {
+		return "", err
+	}
+	if err := launchctl("bootstrap", domain, plist); err != nil {
+		os.Remove(plist)
+		return "", err
+	}
+	kind := "launchd agent"
+	if domain == "system" {
+		kind = "launchd daemon"
+	}
+	return kind + " " + launchdLabel(spec.Name), nil
+}
+
+func uninstallService(name string) error {
+	plist, domain := launchdTarget(name)
+	if _, err := os.Stat(plist); errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("service %s is not installed", name)
+	}
+	// Not being loaded is fine; the file goes either way
+	launchctl("bootout", domain+"/"+launchdLabel(name))
+	return os.Remove(plist)
+}
+
+func startService(name string) error {
+	_, domain := launchdTarget(name)
+	return launchctl("kickstart", domain+"/"+launchdLabel(name))
+}
+
+// stopService sends SIGTERM; the job stays down since it exited cleanly
+func stopService(name string) error {
+	_, domain := launchdTarget(name)
+	return launchctl("kill", "SIGTERM", domain+"/"+launchdLabel(name))
+}
+
+// runService is only used by Windows services
+func runService(args []string, sidecar func()) error {
+	return errors.New("service run is only used by Windows services")
+}
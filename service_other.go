@@ -0,0 +1,22 @@
+//go:build !windows && !darwin
+
+package main
+
+import "errors"
+
+var errNoServiceManager = errors.New("services are installed on Windows and macOS; on Linux, run the sidecar from a systemd unit or container")
+
+func defaultServiceLogDir() string { return "" }
+
+func installService(spec serviceSpec) (string, error) { return "", errNoServiceManager }
+
+func uninstallService(name string) error { return errNoServiceManager }
+
+func startService(name string) error { return errNoServiceManager }
+
+func stopService(name string) error { return errNoServiceManager }
+
+// runService is only used by Windows services
+func runService(args []string, sidecar func()) error {
+	return errors.New("service run is only used by Windows services")
+}
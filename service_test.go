@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestServiceRunArgs(t *testing.T) {
+	spec := serviceSpec{Name: "lab-a", Dir: `C:\Users\lab`, LogDir: `C:\ProgramData\arkitekt-sidecar\logs`, Args: []string{"-control-url", "https://hs", "-name", "x"}}
+	args := serviceRunArgs(spec)
+	if args[0] != "service" || args[1] != "run" {
+		t.Fatalf("Unexpected args %q", args)
+	}
+	got, err := parseServiceRun(args[2:])
+	if err != nil {
+		t.Fatalf("parseServiceRun failed: %v", err)
+	}
+	if got.Name != spec.Name || got.Dir != spec.Dir || got.LogDir != spec.LogDir || !slices.Equal(got.Args, spec.Args) {
+		t.Errorf("Expected %+v back, got %+v", spec, got)
+	}
+	if _, err := parseServiceRun([]string{"-name", "x"}); err == nil {
+		t.Errorf("Expected service run without -dir to be rejected")
+	}
+}
+
+func TestLaunchdPlist(t *testing.T) {
+	spec := serviceSpec{Name: "lab-a", Exe: "/Applications/Sidecar/sidecar", Dir: "/Users/lab", LogDir: "/Users/lab/Library/Logs/arkitekt-sidecar",
+		Args: []string{"-control-url", "https://hs?a=1&b=2", "-hostname", "<lab>"}}
+	plist := launchdPlist(spec)
+
+	// Well-formed, with the arguments in order
+	dec := xml.NewDecoder(bytes.NewReader(plist))
+	var strs []string
+	var in bool
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Invalid plist: %v\n%s", err, plist)
+		}
+		switch tok := tok.(type) {
+		case xml.StartElement:
+			in = tok.Name.Local == "string"
+		case xml.CharData:
+			if in {
+				strs = append(strs, string(tok))
+			}
+		case xml.EndElement:
+			in = false
+		}
+	}
+	want := []string{"live.arkitekt.lab-a", spec.Exe, "-control-url", "https://hs?a=1&b=2", "-hostname", "<lab>", "/Users/lab",
+		"/Users/lab/Library/Logs/arkitekt-sidecar/lab-a.log", "/Users/lab/Library/Logs/arkitekt-sidecar/lab-a.log"}
+	if !slices.Equal(strs, want) {
+		t.Errorf("Expected strings %q, got %q", want, strs)
+	}
+	if !strings.Contains(string(plist), "<key>SuccessfulExit</key>\n\t\t<false/>") {
+		t.Errorf("Expected the job to stay down after a clean stop:\n%s", plist)
+	}
+}
+
+func TestPlainAuthKey(t *testing.T) {
+	for _, tc := range []struct {
+		args []string
+		want string
+	}{
+		{[]string{"-authkey", "tskey-abc"}, "-authkey"},
+		{[]string{"--authkey=tskey-abc"}, "-authkey"},
+		{[]string{"-oauth-client-secret", "tskey-client-x"}, "-oauth-client-secret"},
+		{[]string{"-authkey", "file:/etc/sidecar/key"}, ""},
+		{[]string{"-authkey=keyring:lab"}, ""},
+		{[]string{"-hostname", "authkey"}, ""},
+	} {
+		if got := plainAuthKey(tc.args); got != tc.want {
+			t.Errorf("%q: expected %q, got %q", tc.args, tc.want, got)
+		}
+	}
+}
+
+func TestRunServiceCommandUsage(t *testing.T) {
+	for _, args := range [][]string{nil, {"restart"}, {"install", "-name", "../x"}, {"stop", "--", "-port", "1"}} {
+		if err := runServiceCommand(args, io.Discard); err == nil {
+			t.Errorf("Expected %q to be rejected", args)
+		}
+	}
+}
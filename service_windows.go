@@ -0,0 +1,175 @@
+//go:build windows
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/windows"
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+// defaultServiceLogDir is under ProgramData, which the service can write
+func defaultServiceLogDir() string {
+	base := os.Getenv("ProgramData")
+	if base == "" {
+		base = `C:\ProgramData`
+	}
+	return filepath.Join(base, "arkitekt-sidecar", "logs")
+}
+
+// installService creates an automatic service that is restarted when it
+// fails, and starts it
+func installService(spec serviceSpec) (string, error) {
+	m, err := mgr.Connect()
+	if err != nil {
+		return "", fmt.Errorf("cannot reach the service manager (run as administrator): %w", err)
+	}
+	defer m.Disconnect()
+	if s, err := m.OpenService(spec.Name); err == nil {
+		s.Close()
+		return "", fmt.Errorf("service %s already exists; uninstall it first", spec.Name)
+	}
+	s, err := m.CreateService(spec.Name, spec.Exe, mgr.Config{
+		DisplayName:      "Arkitekt sidecar (" + spec.Name + ")",
+		Description:      "Connects Arkitekt apps to the lab's tailnet",
+		StartType:        mgr.StartAutomatic,
+		DelayedAutoStart: true,
+	}, serviceRunArgs(spec)...)
+	if err != nil {
+		return "", err
+	}
+	defer s.Close()
+	if err := s.SetRecoveryActions([]mgr.RecoveryAction{{Type: mgr.ServiceRestart, Delay: 5 * time.Second}}, uint32((24 * time.Hour).Seconds())); err != nil {
+		return "", err
+	}
+	return "Windows service", s.Start()
+}
+
+func uninstallService(name string) error {
+	m, s, err := openService(name)
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+	defer s.Close()
+	if err := waitStopped(s); err != nil {
+		return err
+	}
+	return s.Delete()
+}
+
+func startService(name string) error {
+	m, s, err := openService(name)
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+	defer s.Close()
+	return s.Start()
+}
+
+func stopService(name string) error {
+	m, s, err := openService(name)
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+	defer s.Close()
+	return waitStopped(s)
+}
+
+func openService(name string) (*mgr.Mgr, *mgr.Service, error) {
+	m, err := mgr.Connect()
+	if err != nil {
+		return nil, nil, fmt.Errorf("cannot reach the service manager (run as administrator): %w", err)
+	}
+	s, err := m.OpenService(name)
+	if err != nil {
+		m.Disconnect()
+		return nil, nil, fmt.Errorf("service %s: %w", name, err)
+	}
+	return m, s, nil
+}
+
+// waitStopped asks a running service to stop and waits until it has
+func waitStopped(s *mgr.Service) error {
+	st, err := s.Query()
+	if err != nil {
+		return err
+	}
+	if st.State == svc.Stopped {
+		return nil
+	}
+	if _, err := s.Control(svc.Stop); err != nil && !errors.Is(err, windows.ERROR_SERVICE_NOT_ACTIVE) {
+		return err
+	}
+	deadline := time.Now().Add(serviceStopTimeout)
+	for st.State != svc.Stopped {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("service %s did not stop within %v", s.Name, serviceStopTimeout)
+		}
+		time.Sleep(300 * time.Millisecond)
+		if st, err = s.Query(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runService is `sidecar service run`, as started by the service manager.
+// The sidecar's output goes to the log file, and a stop request shuts it
+// down like SIGTERM.
+func runService(args []string, sidecar func()) error {
+	spec, err := parseServiceRun(args)
+	if err != nil {
+		return err
+	}
+	if err := os.Chdir(spec.Dir); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(spec.LogDir, 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(filepath.Join(spec.LogDir, spec.Name+".log"), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	os.Stdout, os.Stderr = f, f
+	console.swap(f)
+	log.SetOutput(f)
+	os.Args = append([]string{os.Args[0]}, spec.Args...)
+	return svc.Run(spec.Name, serviceHandler{sidecar})
+}
+
+type serviceHandler struct{ sidecar func() }
+
+func (h serviceHandler) Execute(args []string, requests <-chan svc.ChangeRequest, status chan<- svc.Status) (bool, uint32) {
+	status <- svc.Status{State: svc.StartPending}
+	go h.sidecar()
+	status <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}
+	for req := range requests {
+		switch req.Cmd {
+		case svc.Interrogate:
+			status <- req.CurrentStatus
+		case svc.Stop, svc.Shutdown:
+			status <- svc.Status{State: svc.StopPending}
+			select {
+			case terminations <- syscall.SIGTERM:
+			default:
+			}
+			// The sidecar exits once it has shut down; this only ends one
+			// that is stuck starting
+			time.Sleep(serviceStopTimeout)
+			return false, 0
+		}
+	}
+	return false, 0
+}
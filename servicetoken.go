@@ -0,0 +1,250 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// --- SERVICE TOKEN ---
+
+// serviceTokenFile is where the token is kept in the state directory
+const serviceTokenFile = "service-token"
+
+// maxServiceTokenSize bounds tokens sent to /control/service-token
+const maxServiceTokenSize = 16 << 10
+
+// ServiceTokenConfig is the service_token section of the config file: the
+// hosts, usually Arkitekt core, whose plain HTTP requests carry the
+// sidecar's service token so local tools don't need their own credentials
+type ServiceTokenConfig struct {
+	Hosts  []string `json:"hosts"`            // host or host:port, as in mirrors
+	Header string   `json:"header,omitempty"` // default "Authorization"
+	Scheme string   `json:"scheme,omitempty"` // prefix of the value, default "Bearer" for Authorization
+}
+
+func (c *ServiceTokenConfig) validate() error {
+	if len(c.Hosts) == 0 {
+		return fmt.Errorf("service_token.hosts: at least one host is required")
+	}
+	for i, h := range c.Hosts {
+		if h == "" {
+			return fmt.Errorf("service_token.hosts[%d]: empty host", i)
+		}
+	}
+	if c.Header != "" && strings.ContainsAny(c.Header, " :\r\n") {
+		return fmt.Errorf("service_token.header: invalid header name %q", c.Header)
+	}
+	return nil
+}
+
+// ServiceTokenStatus describes the token without revealing it
+type ServiceTokenStatus struct {
+	SchemaVersion int        `json:"schema_version"`
+	Hosts         []string   `json:"hosts"`
+	Header        string     `json:"header"`
+	Present       bool       `json:"present"`
+	Fingerprint   string     `json:"fingerprint,omitempty"` // first 12 hex digits of its SHA-256
+	UpdatedAt     *time.Time `json:"updated_at,omitempty"`
+	ExpiresAt     *time.Time `json:"expires_at,omitempty"` // from the "exp" claim of JWTs
+	Expired       bool       `json:"expired"`
+}
+
+// serviceTokens attaches the token to requests for the configured hosts.
+// The token itself is issued and signed by Arkitekt core; the sidecar only
+// keeps it in the state directory and swaps it when it is rotated.
+type serviceTokens struct {
+	hosts          []string
+	header, scheme string
+	path           string
+
+	mu      sync.RWMutex
+	token   string
+	updated time.Time
+	now     func() time.Time // time.Now outside of tests
+}
+
+// serviceToken is nil unless the config has a service_token section
+var serviceToken *serviceTokens
+
+// newServiceTokens loads the token from stateDir, if one was stored
+func newServiceTokens(cfg *ServiceTokenConfig, stateDir string) (*serviceTokens, error) {
+	t := &serviceTokens{
+		hosts:  cfg.Hosts,
+		header: http.CanonicalHeaderKey(cfg.Header),
+		scheme: cfg.Scheme,
+		path:   filepath.Join(stateDir, serviceTokenFile),
+		now:    time.Now,
+	}
+	if t.header == "" {
+		t.header = "Authorization"
+	}
+	if t.scheme == "" && t.header == "Authorization" {
+		t.scheme = "Bearer"
+	}
+
+	data, err := os.ReadFile(t.path)
+	if os.IsNotExist(err) {
+		return t, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(t.path)
+	if err != nil {
+		return nil, err
+	}
+	t.token, t.updated = strings.TrimSpace(string(data)), info.ModTime()
+	secrets.addLiteral(t.token)
+	return t, nil
+}
+
+// rotate stores a new token, replacing the file atomically. An empty token
+// removes it.
+func (t *serviceTokens) rotate(token string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if token == "" {
+		if err := os.Remove(t.path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		t.token, t.updated = "", t.now()
+		return nil
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(t.path), ".service-token-*")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.WriteString(token + "\n")
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), t.path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	secrets.addLiteral(token)
+	t.token, t.updated = token, t.now()
+	return nil
+}
+
+// apply adds the token to r if it targets a configured host and doesn't
+// carry credentials of its own. It does nothing on a nil *serviceTokens.
+func (t *serviceTokens) apply(r *http.Request) bool {
+	if t == nil || r.Header.Get(t.header) != "" {
+		return false
+	}
+	matched := false
+	for _, h := range t.hosts {
+		if matchHost(h, r.URL.Host) {
+			matched = true
+			break
+		}
+	}
+	if !matched {
+		return false
+	}
+	t.mu.RLock()
+	token := t.token
+	t.mu.RUnlock()
+	if token == "" {
+		return false
+	}
+	if t.scheme != "" {
+		token = t.scheme + " " + token
+	}
+	r.Header.Set(t.header, token)
+	return true
+}
+
+func (t *serviceTokens) status() ServiceTokenStatus {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	st := ServiceTokenStatus{SchemaVersion: apiSchemaVersion, Hosts: t.hosts, Header: t.header}
+	if t.token == "" {
+		return st
+	}
+	sum := sha256.Sum256([]byte(t.token))
+	st.Present, st.Fingerprint = true, hex.EncodeToString(sum[:6])
+	updated := t.updated.UTC()
+	st.UpdatedAt = &updated
+	if exp, ok := jwtExpiry(t.token); ok {
+		st.ExpiresAt = &exp
+		st.Expired = !t.now().Before(exp)
+	}
+	return st
+}
+
+// jwtExpiry reads the "exp" claim of a JWT without verifying it, which is
+// core's job
+func jwtExpiry(token string) (time.Time, bool) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return time.Time{}, false
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return time.Time{}, false
+	}
+	var claims struct {
+		Exp int64 `json:"exp"`
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil || claims.Exp == 0 {
+		return time.Time{}, false
+	}
+	return time.Unix(claims.Exp, 0).UTC(), true
+}
+
+// handleServiceToken reports (GET), rotates (PUT/POST, the token as the
+// body) or removes (DELETE) the service token
+func handleServiceToken(w http.ResponseWriter, r *http.Request) {
+	if serviceToken == nil {
+		http.Error(w, "no service_token section in the config", http.StatusNotFound)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut, http.MethodPost:
+		data, err := io.ReadAll(io.LimitReader(r.Body, maxServiceTokenSize+1))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		token := strings.TrimSpace(string(data))
+		if token == "" || len(data) > maxServiceTokenSize || strings.ContainsAny(token, " \r\n") {
+			http.Error(w, "body must be a single token", http.StatusBadRequest)
+			return
+		}
+		if err := serviceToken.rotate(token); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprintf(console, ">>> Service token rotated (%s)\n", serviceToken.status().Fingerprint)
+		audit.record("service_token_rotate", "fingerprint", serviceToken.status().Fingerprint)
+	case http.MethodDelete:
+		if err := serviceToken.rotate(""); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprintln(console, ">>> Service token removed")
+		audit.record("service_token_remove")
+	default:
+		http.Error(w, "only GET, PUT, POST and DELETE allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(serviceToken.status())
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServiceTokenApply(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, serviceTokenFile), []byte("first-token\n"), 0o600)
+	tokens, err := newServiceTokens(&ServiceTokenConfig{Hosts: []string{"arkitekt-core"}}, dir)
+	if err != nil {
+		t.Fatalf("newServiceTokens failed: %v", err)
+	}
+
+	req := httptest.NewRequest("GET", "http://arkitekt-core:8000/graphql", nil)
+	if !tokens.apply(req) || req.Header.Get("Authorization") != "Bearer first-token" {
+		t.Errorf("Expected the stored token on core requests, got %q", req.Header.Get("Authorization"))
+	}
+	other := httptest.NewRequest("GET", "http://data-node/", nil)
+	if tokens.apply(other) || other.Header.Get("Authorization") != "" {
+		t.Error("Expected no token for other hosts")
+	}
+	own := httptest.NewRequest("GET", "http://arkitekt-core/", nil)
+	own.Header.Set("Authorization", "Bearer mine")
+	if tokens.apply(own) || own.Header.Get("Authorization") != "Bearer mine" {
+		t.Error("Expected a client's own credentials to be kept")
+	}
+
+	if err := tokens.rotate("second-token"); err != nil {
+		t.Fatalf("rotate failed: %v", err)
+	}
+	if data, _ := os.ReadFile(tokens.path); string(data) != "second-token\n" {
+		t.Errorf("Expected the rotated token on disk, got %q", data)
+	}
+	req = httptest.NewRequest("GET", "http://arkitekt-core/", nil)
+	tokens.apply(req)
+	if req.Header.Get("Authorization") != "Bearer second-token" {
+		t.Errorf("Expected the rotated token, got %q", req.Header.Get("Authorization"))
+	}
+
+	if err := tokens.rotate(""); err != nil {
+		t.Fatalf("removing the token failed: %v", err)
+	}
+	if tokens.apply(httptest.NewRequest("GET", "http://arkitekt-core/", nil)) {
+		t.Error("Expected no token after removal")
+	}
+
+	var none *serviceTokens
+	if none.apply(req) {
+		t.Error("Expected a nil store to do nothing")
+	}
+}
+
+func TestServiceTokenHandler(t *testing.T) {
+	orig := serviceToken
+	defer func() { serviceToken = orig }()
+	tokens, _ := newServiceTokens(&ServiceTokenConfig{Hosts: []string{"core"}, Header: "x-service-token"}, t.TempDir())
+	now := time.Date(2026, 1, 19, 20, 30, 0, 0, time.UTC)
+	tokens.now = func() time.Time { return now }
+	serviceToken = tokens
+
+	claims := base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"svc","exp":1768858200}`)) // 2026-01-19T21:30:00Z
+	jwt := "eyJhbGciOiJFUzI1NiJ9." + claims + ".c2ln"
+	w := httptest.NewRecorder()
+	handleServiceToken(w, httptest.NewRequest("PUT", "/control/service-token", strings.NewReader(jwt+"\n")))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body)
+	}
+	if strings.Contains(w.Body.String(), jwt) {
+		t.Error("Expected the token not to be echoed")
+	}
+	var st ServiceTokenStatus
+	json.NewDecoder(w.Body).Decode(&st)
+	if !st.Present || st.Header != "X-Service-Token" || st.ExpiresAt == nil || st.Expired {
+		t.Errorf("Unexpected status %+v", st)
+	}
+
+	req := httptest.NewRequest("GET", "http://core/", nil)
+	tokens.apply(req)
+	if req.Header.Get("X-Service-Token") != jwt {
+		t.Errorf("Expected the raw token without scheme in a custom header, got %q", req.Header.Get("X-Service-Token"))
+	}
+
+	w = httptest.NewRecorder()
+	handleServiceToken(w, httptest.NewRequest("PUT", "/control/service-token", strings.NewReader("two tokens")))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400 for a malformed token, got %d", w.Code)
+	}
+}
@@ -0,0 +1,461 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// --- SESSIONS ---
+
+// sessionHeader names the session a proxied HTTP request belongs to, as
+// <id>:<secret>. Proxy credentials (http://<id>:<secret>@127.0.0.1:8080)
+// work as well.
+const sessionHeader = "X-Sidecar-Session"
+
+// errQuotaExceeded is what a session's connections fail with once it has
+// used up its quota
+var errQuotaExceeded = errors.New("session quota exceeded")
+
+// SessionSpec is the body of POST /control/sessions: what one job may reach
+// and how much it may transfer
+type SessionSpec struct {
+	ID             string   `json:"id,omitempty"`              // generated if empty
+	Allow          []string `json:"allow"`                     // host patterns, see compileHosts; "*" allows everything
+	QuotaBytes     int64    `json:"quota_bytes,omitempty"`     // both directions, 0 = unlimited
+	MaxConnections int      `json:"max_connections,omitempty"` // open at once, 0 = unlimited
+}
+
+// SessionStatus reports a session and its usage so far
+type SessionStatus struct {
+	SchemaVersion int `json:"schema_version,omitempty"`
+	SessionSpec
+	Created          time.Time `json:"created"`
+	BytesUsed        int64     `json:"bytes_used"`
+	OpenConnections  int       `json:"open_connections"`
+	TotalConnections int64     `json:"total_connections"`
+	Denied           int64     `json:"denied"`           // dials refused by allow, quota or max_connections
+	Policy           bool      `json:"policy,omitempty"` // defined in the config's policies
+	Secret           string    `json:"secret,omitempty"` // only in the answer to POST, never listed
+}
+
+// sessionDeniedError is returned by dials a session may not make
+type sessionDeniedError struct {
+	session, addr, reason string
+}
+
+func (e *sessionDeniedError) Error() string {
+	return fmt.Sprintf("session %s may not connect to %s: %s", e.session, e.addr, e.reason)
+}
+
+func (e *sessionDeniedError) localize(lang string) string {
+	return tr(lang, "client.session_denied", "session", e.session, "destination", e.addr, "reason", e.reason)
+}
+
+// sessionAuthError is a proxy request naming an unknown session, or none
+// while sessions are required
+type sessionAuthError struct {
+	id string // empty if none was named
+}
+
+func (e *sessionAuthError) Error() string {
+	if e.id == "" {
+		return fmt.Sprintf("a session is required (set %s or proxy credentials)", sessionHeader)
+	}
+	return fmt.Sprintf("unknown session %q", e.id)
+}
+
+func (e *sessionAuthError) localize(lang string) string {
+	if e.id == "" {
+		return tr(lang, "client.session_required", "header", sessionHeader)
+	}
+	return tr(lang, "client.unknown_session", "session", fmt.Sprintf("%q", e.id))
+}
+
+// isSessionDenied reports whether err comes from a dial refused by a session
+func isSessionDenied(err error) bool {
+	var denied *sessionDeniedError
+	return errors.As(err, &denied)
+}
+
+type session struct {
+	spec      SessionSpec
+	secret    string   // the password clients name the session with; "" for none
+	allow     *hostSet // spec.Allow compiled
+	created   time.Time
+	transport *http.Transport // plain HTTP connections aren't pooled across sessions
+	router    *Router         // a policy's routes; nil for sessions the parent created
+
+	used   atomic.Int64
+	total  atomic.Int64
+	denied atomic.Int64
+
+	mu     sync.Mutex
+	open   map[*sessionConn]bool
+	closed bool
+}
+
+// authenticates reports whether password is the session's secret
+func (s *session) authenticates(password string) bool {
+	return s.secret == "" || subtle.ConstantTimeCompare([]byte(password), []byte(s.secret)) == 1
+}
+
+// allows reports whether the session may connect to addr
+func (s *session) allows(addr string) bool {
+	return s.allow.match(addr)
+}
+
+func (s *session) status() SessionStatus {
+	s.mu.Lock()
+	open := len(s.open)
+	s.mu.Unlock()
+	return SessionStatus{
+		SessionSpec:      s.spec,
+		Created:          s.created,
+		BytesUsed:        s.used.Load(),
+		OpenConnections:  open,
+		TotalConnections: s.total.Load(),
+		Denied:           s.denied.Load(),
+		Policy:           s.router != nil,
+	}
+}
+
+// sessionTable holds the sessions the parent created. With Required set,
+// the HTTP and SOCKS5 proxies refuse clients that don't name one, so an
+// untrusted plugin only ever sees what its session allows.
+type sessionTable struct {
+	Required bool
+
+	mu       sync.RWMutex
+	sessions map[string]*session
+	dial     func(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+var sessions = &sessionTable{sessions: map[string]*session{}}
+
+type sessionKey struct{}
+
+// withSession records the session a dial is made for
+func withSession(ctx context.Context, s *session) context.Context {
+	if s == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, sessionKey{}, s)
+}
+
+// sessionFrom returns the session recorded by withSession, if any
+func sessionFrom(ctx context.Context) *session {
+	s, _ := ctx.Value(sessionKey{}).(*session)
+	return s
+}
+
+// dialVia sets what the HTTP transports of new sessions connect with, the
+// proxy's own dialer
+func (t *sessionTable) dialVia(dial func(ctx context.Context, network, addr string) (net.Conn, error)) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.dial = dial
+}
+
+// create adds a session
+func (t *sessionTable) create(spec SessionSpec) (*session, error) {
+	if spec.ID == "" {
+		spec.ID = newRequestID()
+	}
+	if !validRequestID(spec.ID) {
+		return nil, fmt.Errorf("invalid session id %q (letters, digits, '-', '_' or '.')", spec.ID)
+	}
+	if len(spec.Allow) == 0 {
+		return nil, fmt.Errorf("allow must name at least one host (or \"*\")")
+	}
+	allow, err := compileHosts(spec.Allow)
+	if err != nil {
+		return nil, fmt.Errorf("allow: %w", err)
+	}
+	if spec.QuotaBytes < 0 || spec.MaxConnections < 0 {
+		return nil, fmt.Errorf("quota_bytes and max_connections can't be negative")
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.dial == nil {
+		return nil, fmt.Errorf("sessions need -mode http or socks5")
+	}
+	if _, ok := t.sessions[spec.ID]; ok {
+		return nil, fmt.Errorf("session %q already exists", spec.ID)
+	}
+	s := &session{
+		spec:      spec,
+		secret:    rand.Text(),
+		allow:     allow,
+		created:   time.Now(),
+		transport: &http.Transport{DialContext: t.dial},
+		open:      map[*sessionConn]bool{},
+	}
+	t.sessions[spec.ID] = s
+	return s, nil
+}
+
+func (t *sessionTable) get(id string) *session {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.sessions[id]
+}
+
+// remove ends a session and cuts its open connections
+func (t *sessionTable) remove(id string) (*session, bool) {
+	t.mu.Lock()
+	s, ok := t.sessions[id]
+	delete(t.sessions, id)
+	t.mu.Unlock()
+	if !ok {
+		return nil, false
+	}
+	s.mu.Lock()
+	s.closed = true
+	conns := make([]*sessionConn, 0, len(s.open))
+	for c := range s.open {
+		conns = append(conns, c)
+	}
+	s.mu.Unlock()
+	for _, c := range conns {
+		c.Close()
+	}
+	s.transport.CloseIdleConnections()
+	return s, true
+}
+
+func (t *sessionTable) list() []SessionStatus {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	list := make([]SessionStatus, 0, len(t.sessions))
+	for _, s := range t.sessions {
+		list = append(list, s.status())
+	}
+	slices.SortFunc(list, func(a, b SessionStatus) int { return a.Created.Compare(b.Created) })
+	return list
+}
+
+// fromRequest returns the session a proxy request names in sessionHeader
+// or its Proxy-Authorization credentials. Naming an unknown session or the
+// wrong secret is an error, and so is naming none while sessions are
+// required.
+func (t *sessionTable) fromRequest(r *http.Request) (*session, error) {
+	id, secret, _ := strings.Cut(r.Header.Get(sessionHeader), ":")
+	if id == "" {
+		id, secret = proxyCredentials(r.Header.Get("Proxy-Authorization"))
+	}
+	r.Header.Del(sessionHeader)
+	if id == "" {
+		if t.Required {
+			return nil, &sessionAuthError{}
+		}
+		return nil, nil
+	}
+	r.Header.Del("Proxy-Authorization")
+	s := t.get(id)
+	if s == nil || !s.authenticates(secret) {
+		return nil, &sessionAuthError{id: id}
+	}
+	return s, nil
+}
+
+// proxyCredentials returns the user name and password of Basic proxy
+// credentials
+func proxyCredentials(auth string) (user, password string) {
+	encoded, ok := strings.CutPrefix(auth, "Basic ")
+	if !ok {
+		return "", ""
+	}
+	decoded, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", ""
+	}
+	user, password, _ = strings.Cut(string(decoded), ":")
+	return user, password
+}
+
+// Valid makes the table a SOCKS5 credential store: the user name is the
+// session ID and the password its secret
+func (t *sessionTable) Valid(user, password string) bool {
+	s := t.get(user)
+	return s != nil && s.authenticates(password)
+}
+
+// sessionDialer enforces the allowlist, connection limit and quota of the
+// session a dial is made for. Dials without a session pass through.
+type sessionDialer struct {
+	Base Dialer
+}
+
+func (d *sessionDialer) Dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	s := sessionFrom(ctx)
+	if s == nil {
+		return d.Base.Dial(ctx, network, addr)
+	}
+	if err := s.admit(addr); err != nil {
+		s.denied.Add(1)
+		fmt.Fprintf(console, "[SESSION] %v\n", err)
+		audit.record("denied", "by", "session", "session", s.spec.ID, "destination", addr, "reason", err.reason)
+		return nil, err
+	}
+	base := d.Base
+	if s.router != nil {
+		base = s.router
+	}
+	conn, err := base.Dial(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	sc := &sessionConn{Conn: conn, session: s}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		conn.Close()
+		return nil, &sessionDeniedError{session: s.spec.ID, addr: addr, reason: "session ended"}
+	}
+	s.open[sc] = true
+	s.total.Add(1)
+	return sc, nil
+}
+
+// admit checks a new connection to addr against the session's limits
+func (s *session) admit(addr string) *sessionDeniedError {
+	deny := func(reason string) *sessionDeniedError {
+		return &sessionDeniedError{session: s.spec.ID, addr: addr, reason: reason}
+	}
+	if !s.allows(addr) {
+		return deny("not in its allow list")
+	}
+	if q := s.spec.QuotaBytes; q > 0 && s.used.Load() >= q {
+		return deny(errQuotaExceeded.Error())
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return deny("session ended")
+	}
+	if m := s.spec.MaxConnections; m > 0 && len(s.open) >= m {
+		return deny(fmt.Sprintf("%d connections open", len(s.open)))
+	}
+	return nil
+}
+
+// sessionConn charges its traffic to a session and is cut when the
+// session's quota runs out
+type sessionConn struct {
+	net.Conn
+	session *session
+	once    sync.Once
+}
+
+// charge adds n bytes to the session and reports whether it is over quota
+func (c *sessionConn) charge(n int) bool {
+	used := c.session.used.Add(int64(n))
+	if q := c.session.spec.QuotaBytes; q > 0 && used > q {
+		fmt.Fprintf(console, "[SESSION] %s used up its quota of %d bytes\n", c.session.spec.ID, q)
+		signal(SignalWarning, fmt.Sprintf("session_quota id=%s bytes=%d", c.session.spec.ID, q))
+		c.Close()
+		return true
+	}
+	return false
+}
+
+func (c *sessionConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if c.charge(n) {
+		return n, errQuotaExceeded
+	}
+	return n, err
+}
+
+func (c *sessionConn) Write(b []byte) (int, error) {
+	if c.charge(len(b)) {
+		return 0, errQuotaExceeded
+	}
+	return c.Conn.Write(b)
+}
+
+func (c *sessionConn) Close() error {
+	c.once.Do(func() {
+		c.session.mu.Lock()
+		delete(c.session.open, c)
+		c.session.mu.Unlock()
+	})
+	return c.Conn.Close()
+}
+
+// handleSessions serves /control/sessions: GET lists the sessions and
+// POST creates one
+func handleSessions(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(sessions.list())
+	case http.MethodPost:
+		var spec SessionSpec
+		if err := json.NewDecoder(r.Body).Decode(&spec); err != nil {
+			http.Error(w, fmt.Sprintf("invalid request body: %v", err), http.StatusBadRequest)
+			return
+		}
+		s, err := sessions.create(spec)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		fmt.Fprintf(console, ">>> Session %s created (allow=%s)\n", s.spec.ID, strings.Join(s.spec.Allow, ","))
+		audit.record("session_create", "session", s.spec.ID, "allow", strings.Join(s.spec.Allow, ","),
+			"quota_bytes", fmt.Sprint(s.spec.QuotaBytes), "max_connections", fmt.Sprint(s.spec.MaxConnections))
+		st := s.status()
+		st.SchemaVersion = apiSchemaVersion
+		st.Secret = s.secret
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(st)
+	default:
+		http.Error(w, "only GET and POST allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleSession serves GET and DELETE /control/sessions/{id}. Deleting a
+// session cuts its open connections and returns its final usage.
+func handleSession(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	var s *session
+	switch r.Method {
+	case http.MethodGet:
+		s = sessions.get(id)
+	case http.MethodDelete:
+		if s = sessions.get(id); s != nil && s.router != nil {
+			http.Error(w, fmt.Sprintf("%s is a policy from the config file", id), http.StatusForbidden)
+			return
+		}
+		s, _ = sessions.remove(id)
+		if s != nil {
+			fmt.Fprintf(console, ">>> Session %s ended after %d bytes\n", id, s.used.Load())
+			audit.record("session_delete", "session", id, "bytes_used", fmt.Sprint(s.used.Load()))
+		}
+	default:
+		http.Error(w, "only GET and DELETE allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if s == nil {
+		http.Error(w, fmt.Sprintf("no session %q", id), http.StatusNotFound)
+		return
+	}
+	st := s.status()
+	st.SchemaVersion = apiSchemaVersion
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(st)
+}
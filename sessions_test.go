@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestSessionDialer(t *testing.T) {
+	base := &MockDialer{DialFunc: func(ctx context.Context, network, addr string) (net.Conn, error) {
+		client, server := net.Pipe()
+		go io.Copy(io.Discard, server)
+		return client, nil
+	}}
+	d := &sessionDialer{Base: base}
+	table := &sessionTable{sessions: map[string]*session{}}
+	table.dialVia(d.Dial)
+
+	s, err := table.create(SessionSpec{ID: "job-1", Allow: []string{"data-node", "db:5432"}, QuotaBytes: 10, MaxConnections: 1})
+	if err != nil {
+		t.Fatalf("Failed to create session: %v", err)
+	}
+	ctx := withSession(context.Background(), s)
+
+	if _, err := d.Dial(ctx, "tcp", "db:6379"); !isSessionDenied(err) {
+		t.Errorf("Expected a port outside the allow list to be denied, got %v", err)
+	}
+	conn, err := d.Dial(ctx, "tcp", "data-node:9000")
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	if _, err := d.Dial(ctx, "tcp", "db:5432"); !isSessionDenied(err) {
+		t.Errorf("Expected max_connections to deny a second connection, got %v", err)
+	}
+
+	// 12 bytes exceed the quota of 10, which cuts the connection
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	if _, err := conn.Write([]byte("world!!")); !errors.Is(err, errQuotaExceeded) {
+		t.Errorf("Expected the quota to cut the connection, got %v", err)
+	}
+	if _, err := d.Dial(ctx, "tcp", "db:5432"); !isSessionDenied(err) {
+		t.Errorf("Expected dials to be denied once the quota is used up, got %v", err)
+	}
+
+	st := s.status()
+	if st.BytesUsed != 12 || st.OpenConnections != 0 || st.TotalConnections != 1 || st.Denied != 3 {
+		t.Errorf("Unexpected usage %+v", st)
+	}
+
+	// Dials without a session aren't restricted
+	if conn, err := d.Dial(context.Background(), "tcp", "anything:1"); err != nil {
+		t.Errorf("Expected a dial without session to pass, got %v", err)
+	} else {
+		conn.Close()
+	}
+}
+
+func TestSessionRequired(t *testing.T) {
+	orig := sessions
+	sessions = &sessionTable{Required: true, sessions: map[string]*session{}}
+	defer func() { sessions = orig }()
+
+	offline := &MockDialer{DialFunc: func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return nil, errors.New("offline")
+	}}
+	proxy := &TailscaleProxy{Dialer: offline}
+	serve := func(header string) int {
+		req := httptest.NewRequest("GET", "http://data-node/", nil)
+		if header != "" {
+			req.Header.Set(sessionHeader, header)
+		}
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, req)
+		return w.Code
+	}
+	if code := serve(""); code != http.StatusProxyAuthRequired {
+		t.Errorf("Expected status 407 without a session, got %d", code)
+	}
+	if code := serve("nope"); code != http.StatusProxyAuthRequired {
+		t.Errorf("Expected status 407 for an unknown session, got %d", code)
+	}
+
+	sessions.dialVia(offline.Dial)
+	s, err := sessions.create(SessionSpec{ID: "job-1", Allow: []string{"*"}})
+	if err != nil {
+		t.Fatalf("Failed to create session: %v", err)
+	}
+	if code := serve("job-1"); code != http.StatusProxyAuthRequired {
+		t.Errorf("Expected status 407 for a session ID without its secret, got %d", code)
+	}
+	if code := serve("job-1:wrong"); code != http.StatusProxyAuthRequired {
+		t.Errorf("Expected status 407 for the wrong secret, got %d", code)
+	}
+	if code := serve("job-1:" + s.secret); code == http.StatusProxyAuthRequired {
+		t.Errorf("Expected the session's secret to be accepted")
+	}
+	if sessions.Valid("job-1", "") || !sessions.Valid("job-1", s.secret) {
+		t.Errorf("Expected SOCKS5 credentials to need the secret")
+	}
+
+	if user, password := proxyCredentials("Basic am9iLTE6eA=="); user != "job-1" || password != "x" {
+		t.Errorf("Expected job-1:x from proxy credentials, got %q %q", user, password)
+	}
+}
+
+func TestSessionSecretOnlyOnCreate(t *testing.T) {
+	orig := sessions
+	sessions = &sessionTable{sessions: map[string]*session{}}
+	defer func() { sessions = orig }()
+	sessions.dialVia((&MockDialer{}).Dial)
+
+	var created, listed []SessionStatus
+	captureStdout(t, func() {
+		w := httptest.NewRecorder()
+		handleSessions(w, httptest.NewRequest("POST", "/control/sessions", strings.NewReader(`{"id": "job-7", "allow": ["data-node"]}`)))
+		var st SessionStatus
+		json.NewDecoder(w.Body).Decode(&st)
+		created = append(created, st)
+
+		w = httptest.NewRecorder()
+		handleSessions(w, httptest.NewRequest("GET", "/control/sessions", nil))
+		json.NewDecoder(w.Body).Decode(&listed)
+	})
+	if created[0].Secret == "" || created[0].Secret != sessions.get("job-7").secret {
+		t.Errorf("Expected the secret in the answer to POST, got %+v", created[0])
+	}
+	if len(listed) != 1 || listed[0].Secret != "" {
+		t.Errorf("Expected the list to leave out secrets, got %+v", listed)
+	}
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"tailscale.com/tsnet"
+)
+
+// --- SNIPPET SHARING ---
+
+// sharePort is the well-known tailnet port sidecars accept snippets on
+const sharePort = "9904"
+
+const (
+	shareMaxSize    = 64 << 10 // bytes per snippet
+	shareMaxEntries = 100      // the oldest snippet is dropped beyond this
+	shareDefaultTTL = time.Hour
+)
+
+// validShareKey keeps snippet keys usable in URLs and log lines
+var validShareKey = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,63}$`)
+
+// ShareConfig is the share section of the config file: who may leave
+// snippets in this node's inbox, and for how long they are kept
+type ShareConfig struct {
+	Allow []string `json:"allow"`         // tailnet hostnames, tags ("tag:lab") or login names
+	TTL   string   `json:"ttl,omitempty"` // default 1h
+}
+
+func (c *ShareConfig) validate() error {
+	if len(c.Allow) == 0 {
+		return fmt.Errorf("share.allow: at least one sender is required")
+	}
+	if c.TTL != "" {
+		if d, err := time.ParseDuration(c.TTL); err != nil || d <= 0 {
+			return fmt.Errorf("share.ttl: invalid duration %q", c.TTL)
+		}
+	}
+	return nil
+}
+
+// SnippetInfo describes a snippet in the inbox without its content
+type SnippetInfo struct {
+	Key      string    `json:"key"`
+	From     string    `json:"from"`
+	Size     int       `json:"size"`
+	Received time.Time `json:"received"`
+	Expires  time.Time `json:"expires"`
+}
+
+type snippet struct {
+	SnippetInfo
+	data        []byte
+	contentType string
+}
+
+// shareInbox holds the snippets other sidecars sent to this one. It only
+// lives in memory, so nothing shared survives a restart.
+type shareInbox struct {
+	TTL time.Duration
+
+	mu       sync.Mutex
+	snippets map[string]*snippet
+	now      func() time.Time // time.Now outside of tests
+}
+
+// inbox is only served on the tailnet when the config has a share section;
+// until then it stays empty
+var inbox = newShareInbox(shareDefaultTTL)
+
+func newShareInbox(ttl time.Duration) *shareInbox {
+	return &shareInbox{TTL: ttl, snippets: map[string]*snippet{}, now: time.Now}
+}
+
+// prune drops expired snippets; the caller holds mu
+func (b *shareInbox) prune() {
+	now := b.now()
+	for key, s := range b.snippets {
+		if !now.Before(s.Expires) {
+			delete(b.snippets, key)
+		}
+	}
+}
+
+// put stores a snippet, replacing one with the same key
+func (b *shareInbox) put(key, from, contentType string, data []byte) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.prune()
+	if _, ok := b.snippets[key]; !ok && len(b.snippets) >= shareMaxEntries {
+		oldest := ""
+		for k, s := range b.snippets {
+			if oldest == "" || s.Received.Before(b.snippets[oldest].Received) {
+				oldest = k
+			}
+		}
+		delete(b.snippets, oldest)
+	}
+	now := b.now()
+	b.snippets[key] = &snippet{
+		SnippetInfo: SnippetInfo{Key: key, From: from, Size: len(data), Received: now, Expires: now.Add(b.TTL)},
+		data:        data,
+		contentType: contentType,
+	}
+}
+
+// get returns the snippet stored under key
+func (b *shareInbox) get(key string) (*snippet, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.prune()
+	s, ok := b.snippets[key]
+	return s, ok
+}
+
+// remove deletes the snippet stored under key
+func (b *shareInbox) remove(key string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	_, ok := b.snippets[key]
+	delete(b.snippets, key)
+	return ok
+}
+
+// list returns the snippets in the inbox, newest first
+func (b *shareInbox) list() []SnippetInfo {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.prune()
+	infos := make([]SnippetInfo, 0, len(b.snippets))
+	for _, s := range b.snippets {
+		infos = append(infos, s.SnippetInfo)
+	}
+	slices.SortFunc(infos, func(a, b SnippetInfo) int { return b.Received.Compare(a.Received) })
+	return infos
+}
+
+// readSnippet reads a request body, refusing anything over shareMaxSize
+func readSnippet(w http.ResponseWriter, r *http.Request) ([]byte, bool) {
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, shareMaxSize))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("snippet too large (max %d KiB)", shareMaxSize>>10), http.StatusRequestEntityTooLarge)
+		return nil, false
+	}
+	return data, true
+}
+
+// shareHandler accepts snippets from allowed peers on sharePort. Like
+// remote exec, senders are identified by the tailnet rather than a secret.
+func shareHandler(cfg *ShareConfig, box *shareInbox, whois func(ctx context.Context, addr string) (execCaller, error)) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("PUT /share/v1/{key}", func(w http.ResponseWriter, r *http.Request) {
+		caller, err := whois(r.Context(), r.RemoteAddr)
+		if err != nil {
+			http.Error(w, "unknown sender", http.StatusForbidden)
+			return
+		}
+		key := r.PathValue("key")
+		if !caller.allowed(cfg.Allow) {
+			fmt.Fprintf(console, "[SHARE] Refusing %q from %s: not in share.allow\n", key, caller)
+			http.Error(w, fmt.Sprintf("%s may not share snippets with this node", caller), http.StatusForbidden)
+			return
+		}
+		if !validShareKey.MatchString(key) {
+			http.Error(w, fmt.Sprintf("invalid key %q", key), http.StatusBadRequest)
+			return
+		}
+		data, ok := readSnippet(w, r)
+		if !ok {
+			return
+		}
+		box.put(key, caller.Host, r.Header.Get("Content-Type"), data)
+		// Only the size is logged, snippets are often secrets
+		fmt.Fprintf(console, "[SHARE] Received %q from %s (%d bytes)\n", key, caller, len(data))
+		w.WriteHeader(http.StatusNoContent)
+	})
+	return mux
+}
+
+// handleSharePut serves POST /share/put?peer=NAME&key=KEY on the status API:
+// it sends the request body to the peer's inbox
+func handleSharePut(s *tsnet.Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name, key := r.URL.Query().Get("peer"), r.URL.Query().Get("key")
+		if name == "" || !validShareKey.MatchString(key) {
+			http.Error(w, "peer and key are required (key: letters, digits, '.', '_' or '-')", http.StatusBadRequest)
+			return
+		}
+		data, ok := readSnippet(w, r)
+		if !ok {
+			return
+		}
+
+		lc, err := s.LocalClient()
+		if err != nil {
+			http.Error(w, fmt.Sprintf("failed to get local client: %v", err), http.StatusInternalServerError)
+			return
+		}
+		status, err := lc.Status(r.Context())
+		if err != nil {
+			http.Error(w, fmt.Sprintf("failed to get status: %v", err), http.StatusInternalServerError)
+			return
+		}
+		peer := findPeer(status, name)
+		if peer == nil || len(peer.TailscaleIPs) == 0 {
+			http.Error(w, fmt.Sprintf("no peer named %q", name), http.StatusNotFound)
+			return
+		}
+
+		url := "http://" + net.JoinHostPort(peer.TailscaleIPs[0].String(), sharePort) + "/share/v1/" + key
+		preq, _ := http.NewRequestWithContext(r.Context(), "PUT", url, bytes.NewReader(data))
+		if ct := r.Header.Get("Content-Type"); ct != "" {
+			preq.Header.Set("Content-Type", ct)
+		}
+		client := &http.Client{Transport: &http.Transport{DialContext: s.Dial}}
+		resp, err := client.Do(preq)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("sharing with %s failed: %v (does its config have share?)", peer.HostName, err), http.StatusBadGateway)
+			return
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusNoContent {
+			w.Header().Set("Content-Type", resp.Header.Get("Content-Type"))
+			w.WriteHeader(resp.StatusCode)
+			io.Copy(w, io.LimitReader(resp.Body, shareMaxSize))
+			return
+		}
+		fmt.Fprintf(console, "[SHARE] Sent %q to %s (%d bytes)\n", key, peer.HostName, len(data))
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// handleShareGet serves GET and DELETE /share/get on the status API. With
+// ?key= it returns that snippet as sent, without it the inbox as JSON.
+func handleShareGet(box *shareInbox) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.URL.Query().Get("key")
+		if key == "" {
+			if r.Method != http.MethodGet {
+				http.Error(w, "key is required", http.StatusBadRequest)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(box.list())
+			return
+		}
+
+		switch r.Method {
+		case http.MethodGet:
+			s, ok := box.get(key)
+			if !ok {
+				http.Error(w, fmt.Sprintf("no snippet %q", key), http.StatusNotFound)
+				return
+			}
+			// curl -d labels everything as a form, which a snippet isn't
+			if s.contentType != "" && !strings.HasPrefix(s.contentType, "application/x-www-form-urlencoded") {
+				w.Header().Set("Content-Type", s.contentType)
+			} else {
+				w.Header().Set("Content-Type", "application/octet-stream")
+			}
+			w.Header().Set("X-Sidecar-Share-From", s.From)
+			w.Write(s.data)
+		case http.MethodDelete:
+			if !box.remove(key) {
+				http.Error(w, fmt.Sprintf("no snippet %q", key), http.StatusNotFound)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	}
+}
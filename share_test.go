@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestShareInbox(t *testing.T) {
+	now := time.Date(2026, 1, 19, 20, 0, 0, 0, time.UTC)
+	box := newShareInbox(10 * time.Minute)
+	box.now = func() time.Time { return now }
+
+	cfg := &ShareConfig{Allow: []string{"core", "tag:lab"}}
+	callers := map[string]execCaller{
+		"100.64.0.1:1000": {Host: "core"},
+		"100.64.0.2:1000": {Host: "laptop", Login: "alice@example.com"},
+	}
+	handler := shareHandler(cfg, box, func(ctx context.Context, addr string) (execCaller, error) {
+		return callers[addr], nil
+	})
+	send := func(from, key, body string) int {
+		req := httptest.NewRequest("PUT", "/share/v1/"+key, strings.NewReader(body))
+		req.RemoteAddr = from
+		req.Header.Set("Content-Type", "text/plain")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	if code := send("100.64.0.1:1000", "token", "s3cr3t"); code != http.StatusNoContent {
+		t.Fatalf("Expected status 204, got %d", code)
+	}
+	if code := send("100.64.0.2:1000", "token", "evil"); code != http.StatusForbidden {
+		t.Errorf("Expected status 403 for a sender not in allow, got %d", code)
+	}
+	if code := send("100.64.0.1:1000", "big", strings.Repeat("x", shareMaxSize+1)); code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected status 413 for an oversized snippet, got %d", code)
+	}
+
+	get := handleShareGet(box)
+	w := httptest.NewRecorder()
+	get(w, httptest.NewRequest("GET", "/share/get?key=token", nil))
+	if w.Code != http.StatusOK || w.Body.String() != "s3cr3t" || w.Header().Get("X-Sidecar-Share-From") != "core" {
+		t.Errorf("Unexpected snippet: %d %q %v", w.Code, w.Body.String(), w.Header())
+	}
+
+	w = httptest.NewRecorder()
+	get(w, httptest.NewRequest("GET", "/share/get", nil))
+	var infos []SnippetInfo
+	if err := json.NewDecoder(w.Body).Decode(&infos); err != nil {
+		t.Fatalf("Failed to decode inbox: %v", err)
+	}
+	if len(infos) != 1 || infos[0].Key != "token" || infos[0].Size != 6 {
+		t.Errorf("Unexpected inbox %+v", infos)
+	}
+
+	// Snippets disappear after the TTL
+	now = now.Add(10 * time.Minute)
+	w = httptest.NewRecorder()
+	get(w, httptest.NewRequest("GET", "/share/get?key=token", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected status 404 for an expired snippet, got %d", w.Code)
+	}
+
+	send("100.64.0.1:1000", "config", "{}")
+	w = httptest.NewRecorder()
+	get(w, httptest.NewRequest("DELETE", "/share/get?key=config", nil))
+	if w.Code != http.StatusNoContent || len(box.list()) != 0 {
+		t.Errorf("Expected the snippet to be deleted, got %d and %+v", w.Code, box.list())
+	}
+}
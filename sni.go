@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// --- SNI MODE ---
+
+// SNIRule sends TLS connections for a server name to a tailnet target.
+// The sidecar never terminates TLS, so certificates stay with the service.
+type SNIRule struct {
+	ServerName string `json:"server_name"` // exact name, or *.domain for any name below domain
+	Target     string `json:"target"`      // tailnet host:port or service name with port
+}
+
+func (r SNIRule) validate() error {
+	name := strings.TrimPrefix(r.ServerName, "*.")
+	if name == "" || strings.ContainsAny(name, "*:/ ") {
+		return fmt.Errorf("invalid server_name %q (a host name, optionally starting with '*.')", r.ServerName)
+	}
+	if _, _, err := net.SplitHostPort(r.Target); err != nil {
+		return fmt.Errorf("target must be host:port, got %q", r.Target)
+	}
+	return nil
+}
+
+// matches reports whether the rule covers a server name
+func (r SNIRule) matches(name string) bool {
+	if domain, ok := strings.CutPrefix(r.ServerName, "*."); ok {
+		return len(name) > len(domain)+1 && strings.HasSuffix(strings.ToLower(name), "."+strings.ToLower(domain))
+	}
+	return strings.EqualFold(r.ServerName, name)
+}
+
+// sniHelloTimeout bounds the wait for a client's ClientHello
+const sniHelloTimeout = 10 * time.Second
+
+// errNoServerName is returned for ClientHellos without SNI
+var errNoServerName = errors.New("the ClientHello carries no server name")
+
+// errHelloRead stops the TLS handshake once the ClientHello is parsed
+var errHelloRead = errors.New("hello read")
+
+// sniTable holds the SNI rules, which a reload replaces
+type sniTable struct {
+	mu    sync.RWMutex
+	rules []SNIRule
+}
+
+// sniRoutes is the rule table of -mode sni, nil in other modes
+var sniRoutes atomic.Pointer[sniTable]
+
+func (t *sniTable) reload(rules []SNIRule) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.rules = rules
+}
+
+// target picks the destination for a server name: the first matching
+// rule's target, or the name itself on port 443
+func (t *sniTable) target(name string) string {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	for _, r := range t.rules {
+		if r.matches(name) {
+			return r.Target
+		}
+	}
+	return net.JoinHostPort(name, "443")
+}
+
+// helloConn lets crypto/tls read a ClientHello from a connection without
+// answering it
+type helloConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c helloConn) Read(b []byte) (int, error)  { return c.r.Read(b) }
+func (c helloConn) Write(b []byte) (int, error) { return 0, io.ErrClosedPipe }
+func (c helloConn) Close() error                { return nil }
+
+// readServerName reads the ClientHello on conn and returns its server name
+// along with the bytes read, which the target has to see first
+func readServerName(conn net.Conn) (string, []byte, error) {
+	var hello bytes.Buffer
+	var name string
+	conn.SetReadDeadline(time.Now().Add(sniHelloTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+	err := tls.Server(helloConn{conn, io.TeeReader(conn, &hello)}, &tls.Config{
+		GetConfigForClient: func(h *tls.ClientHelloInfo) (*tls.Config, error) {
+			name = h.ServerName
+			return nil, errHelloRead
+		},
+	}).Handshake()
+	if !errors.Is(err, errHelloRead) {
+		return "", nil, fmt.Errorf("no TLS ClientHello: %w", err)
+	}
+	if name == "" {
+		return "", nil, errNoServerName
+	}
+	return name, hello.Bytes(), nil
+}
+
+// serveSNI accepts TLS connections on ln, reads the server name each one
+// asks for and dials the target the rules in t pick for it through the
+// tailnet, passing the still encrypted stream through.
+func serveSNI(ln net.Listener, d Dialer, t *sniTable) error {
+	for {
+		clientConn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		if maintenance.Load() || limits.admit() != nil {
+			clientConn.Close()
+			continue
+		}
+		go func() {
+			defer clientConn.Close()
+
+			name, hello, err := readServerName(clientConn)
+			if err != nil {
+				fmt.Fprintf(console, "[SNI] %s: %v\n", clientConn.RemoteAddr(), err)
+				return
+			}
+			target := t.target(name)
+
+			id := newRequestID()
+			ctx := withRequestID(withClientAddr(context.Background(), clientConn.RemoteAddr().String()), id)
+			targetConn, err := d.Dial(ctx, "tcp", target)
+			if err != nil {
+				fmt.Fprintf(console, "[SNI] %s: dial %s for %s failed: %v\n", id, target, name, err)
+				requestFailed(id, "sni", target, err)
+				return
+			}
+			targetConn = connections.track("sni", id, clientConn.RemoteAddr().String(), target, targetConn, clientConn)
+			defer targetConn.Close()
+
+			fmt.Fprintf(console, "[SNI] %s %s -> %s (%s)\n", id, clientConn.RemoteAddr(), target, name)
+			go io.Copy(targetConn, io.MultiReader(bytes.NewReader(hello), clientConn))
+			io.Copy(clientConn, targetConn)
+		}()
+	}
+}
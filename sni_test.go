@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestSNIRules(t *testing.T) {
+	for _, r := range []SNIRule{
+		{ServerName: "", Target: "grafana:443"},
+		{ServerName: "*.", Target: "grafana:443"},
+		{ServerName: "a.*.lab", Target: "grafana:443"},
+		{ServerName: "grafana.lab", Target: "grafana"},
+	} {
+		if err := r.validate(); err == nil {
+			t.Errorf("Expected %+v to be rejected", r)
+		}
+	}
+
+	table := &sniTable{rules: []SNIRule{
+		{ServerName: "grafana.lab.example", Target: "grafana:3000"},
+		{ServerName: "*.lab.example", Target: "ingress:443"},
+	}}
+	for name, want := range map[string]string{
+		"grafana.lab.example": "grafana:3000",
+		"Minio.Lab.Example":   "ingress:443",
+		"a.b.lab.example":     "ingress:443",
+		"lab.example":         "lab.example:443",
+		"data-node":           "data-node:443",
+	} {
+		if got := table.target(name); got != want {
+			t.Errorf("Expected %s to go to %s, got %s", name, want, got)
+		}
+	}
+}
+
+func TestServeSNI(t *testing.T) {
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "served "+r.TLS.ServerName)
+	}))
+	defer upstream.Close()
+
+	dialed := make(chan string, 1)
+	d := &MockDialer{DialFunc: func(ctx context.Context, network, addr string) (net.Conn, error) {
+		dialed <- addr
+		return net.Dial("tcp", upstream.Listener.Addr().String())
+	}}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer ln.Close()
+
+	out := captureStdout(t, func() {
+		go serveSNI(ln, d, &sniTable{rules: []SNIRule{{ServerName: "*.lab.example", Target: "ingress:443"}}})
+
+		client := &http.Client{Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return net.Dial("tcp", ln.Addr().String())
+			},
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		}}
+		resp, err := client.Get("https://grafana.lab.example/")
+		if err != nil {
+			t.Fatalf("Expected the request to pass through, got %v", err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		// The upstream terminated TLS itself, with the client's server name
+		if string(body) != "served grafana.lab.example" {
+			t.Errorf("Unexpected response %q", body)
+		}
+		if addr := <-dialed; addr != "ingress:443" {
+			t.Errorf("Expected the rule's target, got %s", addr)
+		}
+
+		// Plain text isn't TLS
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatalf("Failed to dial: %v", err)
+		}
+		io.WriteString(conn, "GET / HTTP/1.1\r\nHost: grafana\r\n\r\n")
+		if n, _ := conn.Read(make([]byte, 1)); n != 0 {
+			t.Errorf("Expected plain text connections to be closed")
+		}
+		conn.Close()
+	})
+	if !strings.Contains(out, "-> ingress:443 (grafana.lab.example)") || !strings.Contains(out, "no TLS ClientHello") {
+		t.Errorf("Expected the connections to be logged, got %q", out)
+	}
+}
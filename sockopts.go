@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+)
+
+// --- SOCKET TUNING ---
+
+// socketTuning holds the TCP options applied to connections on both sides
+// of the proxy. Interactive protocols want NoDelay; high-latency DERP paths
+// need bigger buffers to fill the pipe.
+type socketTuning struct {
+	NoDelay     bool
+	ReadBuffer  int // bytes, 0 keeps the OS (or netstack) default
+	WriteBuffer int // bytes, 0 keeps the OS (or netstack) default
+}
+
+// clientSockets is applied to every connection accepted from local clients
+var clientSockets = socketTuning{NoDelay: true}
+
+// apply sets the options on a local or netstack TCP connection. Other
+// connection types are left alone.
+func (t socketTuning) apply(conn net.Conn) error {
+	switch c := conn.(type) {
+	case *net.TCPConn:
+		if err := c.SetNoDelay(t.NoDelay); err != nil {
+			return err
+		}
+		if t.ReadBuffer > 0 {
+			if err := c.SetReadBuffer(t.ReadBuffer); err != nil {
+				return err
+			}
+		}
+		if t.WriteBuffer > 0 {
+			return c.SetWriteBuffer(t.WriteBuffer)
+		}
+	case *gonet.TCPConn:
+		ep := gonetEndpoint(c)
+		if ep == nil {
+			return errors.New("netstack connection has no endpoint")
+		}
+		ops := ep.SocketOptions()
+		ops.SetDelayOption(!t.NoDelay)
+		if t.ReadBuffer > 0 {
+			ops.SetReceiveBufferSize(int64(t.ReadBuffer), true)
+		}
+		if t.WriteBuffer > 0 {
+			ops.SetSendBufferSize(int64(t.WriteBuffer), true)
+		}
+	}
+	return nil
+}
+
+// tunedListener applies clientSockets to every accepted connection
+type tunedListener struct {
+	net.Listener
+}
+
+func (l tunedListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	clientSockets.apply(conn)
+	return conn, nil
+}
+
+// listenClients binds a local TCP listener for client connections, or
+// takes the socket-activated one for addr. With a users policy,
+// connections from refused local users are dropped.
+func listenClients(addr string) (net.Listener, error) {
+	if ln := inherited.take(addr); ln != nil {
+		return wrapClients(ln, nil)
+	}
+	ln, err := net.Listen("tcp", addr)
+	return wrapClients(ln, explainBind(addr, err))
+}
+
+// listenClientsShared is listenClients with SO_REUSEPORT, so several
+// listeners can bind addr and the kernel spreads connections across them.
+// A socket-activated listener is shared by accepting on it in parallel.
+func listenClientsShared(addr string) (net.Listener, error) {
+	if ln := inherited.take(addr); ln != nil {
+		return wrapClients(ln, nil)
+	}
+	lc := net.ListenConfig{Control: setReusePort}
+	ln, err := lc.Listen(context.Background(), "tcp", addr)
+	return wrapClients(ln, explainBind(addr, err))
+}
+
+func wrapClients(ln net.Listener, err error) (net.Listener, error) {
+	if err != nil {
+		return nil, err
+	}
+	ln = handovers.track(ln)
+	if listenBacklog > 0 {
+		if err := setBacklog(ln, listenBacklog); err != nil {
+			ln.Close()
+			return nil, fmt.Errorf("failed to set the listen backlog: %w", err)
+		}
+	}
+	if pacer != nil {
+		ln = pacedListener{ln, pacer}
+	}
+	ln = tunedListener{ln}
+	if users != nil {
+		ln = userListener{ln, users}
+	}
+	if acceptProxyHeader {
+		ln = proxyListener{ln, proxyHeaderFrom}
+	}
+	return ln, nil
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/waiter"
+)
+
+func TestSocketTuningOnNetstackConn(t *testing.T) {
+	ep := &fakeEndpoint{}
+	ep.so.InitHandler(&tcpip.DefaultSocketOptionsHandler{}, nil, nil, nil)
+	ep.so.SetDelayOption(true)
+	conn := gonet.NewTCPConn(&waiter.Queue{}, ep)
+
+	tuning := socketTuning{NoDelay: true, ReadBuffer: 4 << 20, WriteBuffer: 2 << 20}
+	if err := tuning.apply(conn); err != nil {
+		t.Fatalf("apply failed: %v", err)
+	}
+	if ep.so.GetDelayOption() {
+		t.Error("Expected Nagle's algorithm to be disabled")
+	}
+	if got := ep.so.GetReceiveBufferSize(); got != 4<<20 {
+		t.Errorf("Expected a 4 MiB receive buffer, got %d", got)
+	}
+	if got := ep.so.GetSendBufferSize(); got != 2<<20 {
+		t.Errorf("Expected a 2 MiB send buffer, got %d", got)
+	}
+}
+
+func TestListenClientsTunesAcceptedConns(t *testing.T) {
+	ln, err := listenClients("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer ln.Close()
+
+	go func() {
+		if c, err := net.Dial("tcp", ln.Addr().String()); err == nil {
+			c.Write([]byte("hi"))
+			c.Close()
+		}
+	}()
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatalf("Accept failed: %v", err)
+	}
+	defer conn.Close()
+	if _, ok := conn.(*net.TCPConn); !ok {
+		t.Errorf("Expected the accepted conn to stay a *net.TCPConn, got %T", conn)
+	}
+	buf := make([]byte, 2)
+	if _, err := conn.Read(buf); err != nil || string(buf) != "hi" {
+		t.Errorf("Expected to read from the tuned conn, got %q (%v)", buf, err)
+	}
+}
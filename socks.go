@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"net"
+
+	"github.com/armon/go-socks5"
+)
+
+// --- SOCKS5 HELPERS ---
+
+// tailnetResolver leaves hostnames unresolved so they reach the tailnet
+// dialer (and route rules) as names. The default resolver asks the host's
+// DNS, which doesn't know MagicDNS names.
+type tailnetResolver struct{}
+
+func (tailnetResolver) Resolve(ctx context.Context, name string) (context.Context, net.IP, error) {
+	return ctx, nil, nil
+}
+
+// clientAddrRewriter records the SOCKS client's address, a fresh request ID
+// and the session named by the user name in the dial context without
+// changing the destination, so sticky pools can pin by client IP.
+type clientAddrRewriter struct{}
+
+func (clientAddrRewriter) Rewrite(ctx context.Context, req *socks5.Request) (context.Context, *socks5.AddrSpec) {
+	ctx = withRequestID(withClientAddr(ctx, req.RemoteAddr.Address()), newRequestID())
+	if req.AuthContext != nil && req.AuthContext.Method == socks5.UserPassAuth {
+		ctx = withSession(ctx, sessions.get(req.AuthContext.Payload["Username"]))
+	}
+	return ctx, req.DestAddr
+}
+
+// socksAuth offers user name authentication for sessions. While sessions
+// are required it is the only method, otherwise clients may skip it.
+func socksAuth(t *sessionTable) []socks5.Authenticator {
+	userPass := socks5.UserPassAuthenticator{Credentials: t}
+	if t.Required {
+		return []socks5.Authenticator{userPass}
+	}
+	return []socks5.Authenticator{socks5.NoAuthAuthenticator{}, userPass}
+}
+
+// admissionRules refuses new SOCKS5 requests while maintenance mode is on or
+// the sidecar is overloaded, which the client sees as a "not allowed by
+// ruleset" reply.
+type admissionRules struct{}
+
+func (admissionRules) Allow(ctx context.Context, req *socks5.Request) (context.Context, bool) {
+	if maintenance.Load() {
+		return ctx, false
+	}
+	return ctx, limits.admit() == nil
+}
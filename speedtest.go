@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/tsnet"
+)
+
+// --- SPEEDTEST ---
+
+// speedtestPort is the tailnet port of the speedtest companion endpoint
+const speedtestPort = "9901"
+
+const (
+	speedtestPings      = 5
+	speedtestMaxSeconds = 30
+	speedtestChunk      = 64 << 10
+)
+
+// SpeedtestResult reports throughput and latency to a peer
+type SpeedtestResult struct {
+	SchemaVersion int     `json:"schema_version"`
+	Peer          string  `json:"peer"`
+	Path          string  `json:"path"` // "direct" or "derp"
+	RelayedVia    string  `json:"relayed_via"`
+	CurAddr       string  `json:"current_address"`
+	Seconds       int     `json:"seconds"` // per direction
+	LatencyMinMs  float64 `json:"latency_min_ms"`
+	LatencyAvgMs  float64 `json:"latency_avg_ms"`
+	DownloadMbps  float64 `json:"download_mbps"` // peer -> this sidecar
+	UploadMbps    float64 `json:"upload_mbps"`   // this sidecar -> peer
+	DownloadBytes int64   `json:"download_bytes"`
+	UploadBytes   int64   `json:"upload_bytes"`
+}
+
+// speedtestHandler is the companion endpoint a peer's speedtest talks to.
+func speedtestHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /speedtest/ping", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("GET /speedtest/download", func(w http.ResponseWriter, r *http.Request) {
+		seconds, _ := strconv.Atoi(r.URL.Query().Get("seconds"))
+		if seconds < 1 || seconds > speedtestMaxSeconds {
+			http.Error(w, fmt.Sprintf("seconds must be between 1 and %d", speedtestMaxSeconds), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		chunk := make([]byte, speedtestChunk)
+		deadline := time.Now().Add(time.Duration(seconds) * time.Second)
+		for time.Now().Before(deadline) {
+			if _, err := w.Write(chunk); err != nil {
+				return
+			}
+		}
+	})
+	mux.HandleFunc("POST /speedtest/upload", func(w http.ResponseWriter, r *http.Request) {
+		n, _ := io.Copy(io.Discard, r.Body)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]int64{"bytes": n})
+	})
+	return mux
+}
+
+// runSpeedtest measures latency, download and upload against the companion
+// endpoint at base (e.g. "http://100.64.0.10:9901").
+func runSpeedtest(ctx context.Context, client *http.Client, base string, seconds int) (SpeedtestResult, error) {
+	res := SpeedtestResult{Seconds: seconds}
+	window := time.Duration(seconds) * time.Second
+
+	// Latency: a handful of tiny requests over a warm connection
+	var total time.Duration
+	for i := 0; i < speedtestPings; i++ {
+		start := time.Now()
+		req, _ := http.NewRequestWithContext(ctx, "GET", base+"/speedtest/ping", nil)
+		resp, err := client.Do(req)
+		if err != nil {
+			return res, fmt.Errorf("ping: %w", err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusNoContent {
+			return res, fmt.Errorf("ping: %s (is the peer serving the speedtest companion?)", resp.Status)
+		}
+		rtt := time.Since(start)
+		total += rtt
+		if ms := float64(rtt) / float64(time.Millisecond); i == 0 || ms < res.LatencyMinMs {
+			res.LatencyMinMs = ms
+		}
+	}
+	res.LatencyAvgMs = float64(total) / float64(time.Millisecond) / speedtestPings
+
+	// Download: the peer streams for the whole window
+	req, _ := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf("%s/speedtest/download?seconds=%d", base, seconds), nil)
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		return res, fmt.Errorf("download: %w", err)
+	}
+	res.DownloadBytes, err = io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return res, fmt.Errorf("download: %w", err)
+	}
+	res.DownloadMbps = mbps(res.DownloadBytes, time.Since(start))
+
+	// Upload: stream to the peer until the window closes
+	pr, pw := io.Pipe()
+	go func() {
+		chunk := make([]byte, speedtestChunk)
+		deadline := time.Now().Add(window)
+		for time.Now().Before(deadline) {
+			if _, err := pw.Write(chunk); err != nil {
+				return
+			}
+		}
+		pw.Close()
+	}()
+	req, _ = http.NewRequestWithContext(ctx, "POST", base+"/speedtest/upload", pr)
+	start = time.Now()
+	resp, err = client.Do(req)
+	if err != nil {
+		pr.CloseWithError(err)
+		return res, fmt.Errorf("upload: %w", err)
+	}
+	var up struct {
+		Bytes int64 `json:"bytes"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&up)
+	resp.Body.Close()
+	if err != nil {
+		return res, fmt.Errorf("upload: %w", err)
+	}
+	res.UploadBytes = up.Bytes
+	res.UploadMbps = mbps(up.Bytes, time.Since(start))
+	return res, nil
+}
+
+func mbps(n int64, d time.Duration) float64 {
+	if d <= 0 {
+		return 0
+	}
+	return float64(n) * 8 / d.Seconds() / 1e6
+}
+
+// findPeer looks a peer up by hostname or MagicDNS name
+func findPeer(status *ipnstate.Status, name string) *ipnstate.PeerStatus {
+	for _, peer := range status.Peer {
+		dnsName := strings.TrimSuffix(peer.DNSName, ".")
+		if strings.EqualFold(peer.HostName, name) || strings.EqualFold(dnsName, name) ||
+			strings.EqualFold(strings.Split(dnsName, ".")[0], name) {
+			return peer
+		}
+	}
+	return nil
+}
+
+// handleSpeedtest serves /peers/{name}/speedtest on the status API
+func handleSpeedtest(s *tsnet.Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		seconds := 5
+		if v := r.URL.Query().Get("seconds"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 1 || n > speedtestMaxSeconds {
+				http.Error(w, fmt.Sprintf("seconds must be between 1 and %d", speedtestMaxSeconds), http.StatusBadRequest)
+				return
+			}
+			seconds = n
+		}
+
+		lc, err := s.LocalClient()
+		if err != nil {
+			http.Error(w, fmt.Sprintf("failed to get local client: %v", err), http.StatusInternalServerError)
+			return
+		}
+		status, err := lc.Status(r.Context())
+		if err != nil {
+			http.Error(w, fmt.Sprintf("failed to get status: %v", err), http.StatusInternalServerError)
+			return
+		}
+		name := r.PathValue("name")
+		peer := findPeer(status, name)
+		if peer == nil || len(peer.TailscaleIPs) == 0 {
+			http.Error(w, fmt.Sprintf("no peer named %q", name), http.StatusNotFound)
+			return
+		}
+
+		client := &http.Client{Transport: &http.Transport{DialContext: s.Dial}}
+		base := "http://" + net.JoinHostPort(peer.TailscaleIPs[0].String(), speedtestPort)
+		fmt.Fprintf(console, "[SPEEDTEST] %s for %ds per direction\n", peer.HostName, seconds)
+		res, err := runSpeedtest(r.Context(), client, base, seconds)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("speedtest against %s failed: %v", peer.HostName, err), http.StatusBadGateway)
+			return
+		}
+		res.Peer = peer.HostName
+
+		// The path after the test is the one that carried (most of) it
+		if after, err := lc.Status(r.Context()); err == nil {
+			if p := findPeer(after, name); p != nil {
+				peer = p
+			}
+		}
+		res.Path = "derp"
+		if peer.CurAddr != "" && peer.Relay == "" {
+			res.Path = "direct"
+		}
+		res.RelayedVia = peer.Relay
+		res.CurAddr = peer.CurAddr
+		res.SchemaVersion = apiSchemaVersion
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(res)
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/types/key"
+)
+
+func TestRunSpeedtest(t *testing.T) {
+	server := httptest.NewServer(speedtestHandler())
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	res, err := runSpeedtest(ctx, server.Client(), server.URL, 1)
+	if err != nil {
+		t.Fatalf("speedtest failed: %v", err)
+	}
+	if res.DownloadBytes == 0 || res.UploadBytes == 0 {
+		t.Errorf("Expected bytes in both directions, got %+v", res)
+	}
+	if res.DownloadMbps <= 0 || res.UploadMbps <= 0 {
+		t.Errorf("Expected positive throughput, got %+v", res)
+	}
+	if res.LatencyMinMs <= 0 || res.LatencyMinMs > res.LatencyAvgMs {
+		t.Errorf("Unexpected latency min %v avg %v", res.LatencyMinMs, res.LatencyAvgMs)
+	}
+}
+
+func TestRunSpeedtestWithoutCompanion(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	defer server.Close()
+	if _, err := runSpeedtest(context.Background(), server.Client(), server.URL, 1); err == nil {
+		t.Fatal("Expected error when the peer has no companion endpoint")
+	}
+}
+
+func TestFindPeer(t *testing.T) {
+	status := &ipnstate.Status{Peer: map[key.NodePublic]*ipnstate.PeerStatus{
+		key.NewNode().Public(): {HostName: "Workstation-1", DNSName: "gpu-box.tail1234.ts.net."},
+	}}
+	for _, name := range []string{"workstation-1", "gpu-box", "gpu-box.tail1234.ts.net"} {
+		if findPeer(status, name) == nil {
+			t.Errorf("Expected to find peer by %q", name)
+		}
+	}
+	if findPeer(status, "other") != nil {
+		t.Error("Expected no peer for unknown name")
+	}
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// --- STATE DIRECTORY LOCK ---
+
+// stateLockFile is held by the sidecar using a state directory. Two nodes
+// sharing one state fight over the node key and keep kicking each other
+// off the tailnet.
+const stateLockFile = "sidecar.lock"
+
+var errStateLocked = errors.New("state directory is in use by another sidecar")
+
+// lockStateDir takes the state directory's lock until release is called.
+// The OS drops it when the process dies, so a crash never leaves it stale.
+func lockStateDir(dir string) (release func(), err error) {
+	f, err := os.OpenFile(filepath.Join(dir, stateLockFile), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := lockFile(f); err != nil {
+		f.Close()
+		if errors.Is(err, errStateLocked) {
+			return nil, fmt.Errorf("%s: %w", dir, err)
+		}
+		return nil, err
+	}
+	return func() { f.Close() }, nil
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+)
+
+// --- STATUS API CORS ---
+
+// corsMaxAge is how long browsers may cache a preflight answer, in seconds
+const corsMaxAge = "600"
+
+// parseCORSOrigins reads -status-cors: a comma-separated list of origins
+// (scheme://host[:port]). Wildcards are refused; the status API controls
+// the node.
+func parseCORSOrigins(spec string) ([]string, error) {
+	var origins []string
+	for o := range strings.SplitSeq(spec, ",") {
+		o = strings.TrimSpace(o)
+		if o == "" {
+			continue
+		}
+		if o == "*" || o == "null" {
+			return nil, fmt.Errorf("origin %q is not allowed, list the origins", o)
+		}
+		u, err := url.Parse(o)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" ||
+			(u.Path != "" && u.Path != "/") || u.RawQuery != "" || u.User != nil {
+			return nil, fmt.Errorf("invalid origin %q (use scheme://host[:port])", o)
+		}
+		origins = append(origins, strings.ToLower(u.Scheme+"://"+u.Host))
+	}
+	return origins, nil
+}
+
+// loopbackHost reports whether a Host header names the machine itself:
+// 127.0.0.1, localhost or ::1, with or without port
+func loopbackHost(host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	return host == "127.0.0.1" || host == "::1" || strings.EqualFold(host, "localhost")
+}
+
+// withCORS lets the listed origins call the status API from a browser.
+// Preflights from them are answered here; other cross-origin requests get
+// no CORS headers, and the ones that change something are refused, since a
+// browser would send them before finding out it may not read the answer.
+// The dashboard and clients without an Origin header are unaffected.
+// Requests for any host but loopback are refused before all of that: a
+// DNS rebinding page (evil.example resolving to 127.0.0.1) sends its own
+// name as Host and Origin and would otherwise look like the dashboard.
+func withCORS(h http.Handler, origins []string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !loopbackHost(r.Host) {
+			http.Error(w, fmt.Sprintf("host %q is not served here, use 127.0.0.1", r.Host), http.StatusMisdirectedRequest)
+			return
+		}
+		origin := r.Header.Get("Origin")
+		if sameOrigin(r) {
+			h.ServeHTTP(w, r)
+			return
+		}
+		allowed := slices.Contains(origins, strings.ToLower(origin))
+		preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+		w.Header().Add("Vary", "Origin")
+		if !allowed {
+			if preflight || (r.Method != http.MethodGet && r.Method != http.MethodHead) {
+				http.Error(w, fmt.Sprintf("origin %s is not allowed, see -status-cors", origin), http.StatusForbidden)
+				return
+			}
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		w.Header().Set("Access-Control-Expose-Headers", schemaVersionHeader+", "+requestIDHeader)
+		if !preflight {
+			h.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE")
+		if headers := r.Header.Get("Access-Control-Request-Headers"); headers != "" {
+			w.Header().Set("Access-Control-Allow-Headers", headers)
+		}
+		// Chrome asks before a public site may reach a loopback address
+		if r.Header.Get("Access-Control-Request-Private-Network") == "true" {
+			w.Header().Set("Access-Control-Allow-Private-Network", "true")
+		}
+		w.Header().Set("Access-Control-Max-Age", corsMaxAge)
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseCORSOrigins(t *testing.T) {
+	origins, err := parseCORSOrigins("https://App.Arkitekt.live, http://localhost:5173/")
+	if err != nil || len(origins) != 2 || origins[0] != "https://app.arkitekt.live" || origins[1] != "http://localhost:5173" {
+		t.Errorf("Expected two normalized origins, got %v, %v", origins, err)
+	}
+	for _, bad := range []string{"*", "null", "app.arkitekt.live", "https://app.arkitekt.live/ui", "ftp://host"} {
+		if _, err := parseCORSOrigins(bad); err == nil {
+			t.Errorf("Expected %q to be refused", bad)
+		}
+	}
+}
+
+func TestStatusCORS(t *testing.T) {
+	served := 0
+	h := withCORS(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		served++
+		w.Write([]byte("{}"))
+	}), []string{"https://app.arkitekt.live"})
+
+	do := func(method, origin string, headers map[string]string) *http.Response {
+		req := httptest.NewRequest(method, "http://127.0.0.1:9090/api/v1/status", nil)
+		if origin != "" {
+			req.Header.Set("Origin", origin)
+		}
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w.Result()
+	}
+
+	resp := do("OPTIONS", "https://app.arkitekt.live", map[string]string{
+		"Access-Control-Request-Method":          "POST",
+		"Access-Control-Request-Headers":         "content-type",
+		"Access-Control-Request-Private-Network": "true",
+	})
+	if resp.StatusCode != http.StatusNoContent || resp.Header.Get("Access-Control-Allow-Origin") != "https://app.arkitekt.live" ||
+		resp.Header.Get("Access-Control-Allow-Headers") != "content-type" ||
+		resp.Header.Get("Access-Control-Allow-Private-Network") != "true" || served != 0 {
+		t.Errorf("Expected the preflight to be answered here, got %d %v", resp.StatusCode, resp.Header)
+	}
+
+	resp = do("GET", "https://app.arkitekt.live", nil)
+	if resp.StatusCode != 200 || resp.Header.Get("Access-Control-Allow-Origin") != "https://app.arkitekt.live" {
+		t.Errorf("Expected CORS headers for an allowed origin, got %d %v", resp.StatusCode, resp.Header)
+	}
+
+	if resp := do("OPTIONS", "https://evil.example", map[string]string{"Access-Control-Request-Method": "GET"}); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("Expected 403 for a preflight from another origin, got %d", resp.StatusCode)
+	}
+	resp = do("GET", "https://evil.example", nil)
+	if resp.StatusCode != 200 || resp.Header.Get("Access-Control-Allow-Origin") != "" {
+		t.Errorf("Expected no CORS headers for another origin, got %v", resp.Header)
+	}
+	if resp := do("POST", "https://evil.example", nil); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("Expected 403 for a POST from another origin, got %d", resp.StatusCode)
+	}
+
+	// The dashboard and clients without Origin are unaffected
+	before := served
+	do("POST", "http://127.0.0.1:9090", nil)
+	do("POST", "", nil)
+	if served != before+2 {
+		t.Error("Expected same-origin and Origin-less requests to be served")
+	}
+
+	// A DNS rebinding page sends its own name as Host and Origin
+	before = served
+	for _, host := range []string{"evil.example:9090", "127.0.0.1.evil.example:9090", "10.0.0.5:9090"} {
+		req := httptest.NewRequest("POST", "http://"+host+"/api/v1/control/shutdown", nil)
+		req.Header.Set("Origin", "http://"+host)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if w.Code != http.StatusMisdirectedRequest || sameOrigin(req) {
+			t.Errorf("Expected a request for %s to be refused, got %d", host, w.Code)
+		}
+	}
+	if served != before {
+		t.Error("Expected requests for foreign hosts not to be served")
+	}
+	for _, host := range []string{"127.0.0.1:9090", "localhost:9090", "[::1]:9090", "localhost"} {
+		if !loopbackHost(host) {
+			t.Errorf("Expected %s to be a loopback host", host)
+		}
+	}
+}
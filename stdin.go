@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// --- STDIN COMMANDS ---
+
+// stdinStatusTimeout bounds how long STATUS waits for the tailnet node
+const stdinStatusTimeout = 5 * time.Second
+
+// stdinCommands lets a parent that already owns the sidecar's pipes control
+// it by writing one command per line to stdin:
+//
+//	SHUTDOWN  exit cleanly (replies @@SIDECAR:SHUTDOWN@@ stdin)
+//	RELOAD    re-read the config file (replies @@SIDECAR:RELOADED@@)
+//	STATUS    report the /status document (replies @@SIDECAR:STATUS@@ {...})
+type stdinCommands struct {
+	Shutdown func(reason string)
+	Reload   func() (string, error) // details for the RELOADED reply
+	Status   func(ctx context.Context) (any, error)
+}
+
+// run handles commands until r is closed. A parent closing stdin does not
+// stop the sidecar.
+func (c *stdinCommands) run(r io.Reader) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		c.handle(strings.TrimSpace(scanner.Text()))
+	}
+}
+
+func (c *stdinCommands) handle(line string) {
+	switch strings.ToUpper(line) {
+	case "":
+	case "SHUTDOWN":
+		fmt.Fprintln(console, ">>> Shutdown requested on stdin")
+		c.Shutdown("stdin")
+	case "RELOAD":
+		runReload(c.Reload)
+	case "STATUS":
+		ctx, cancel := context.WithTimeout(context.Background(), stdinStatusTimeout)
+		status, err := c.Status(ctx)
+		cancel()
+		if err != nil {
+			status = map[string]string{"error": err.Error()}
+		}
+		data, _ := json.Marshal(status)
+		signal(SignalStatus, string(data))
+	default:
+		signal(SignalWarning, fmt.Sprintf("unknown command %q (use SHUTDOWN, RELOAD or STATUS)", line))
+	}
+}
+
+// exitHooks undo process-wide changes, like the system proxy setting,
+// before a requested shutdown
+var exitHooks struct {
+	sync.Mutex
+	fns  []func()
+	once sync.Once
+}
+
+// onExit registers f to run on shutdown
+func onExit(f func()) {
+	exitHooks.Lock()
+	defer exitHooks.Unlock()
+	exitHooks.fns = append(exitHooks.fns, f)
+}
+
+// shutdown runs the exit hooks, signals SHUTDOWN with reason, closes the
+// node and exits. Concurrent calls shut down only once.
+func shutdown(reason string, node io.Closer) {
+	exitHooks.once.Do(func() {
+		exitHooks.Lock()
+		for _, f := range exitHooks.fns {
+			f()
+		}
+		exitHooks.Unlock()
+		signal(SignalShutdown, reason)
+		audit.record("shutdown", "reason", reason)
+		events.close()
+		node.Close()
+		os.Exit(0)
+	})
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// captureStdout returns what fn writes to stdout, signals included
+func captureStdout(t *testing.T, fn func()) string {
+	t.Helper()
+	var out bytes.Buffer
+	stdout := console.swap(&out)
+	func() {
+		defer console.swap(stdout)
+		fn()
+	}()
+	return out.String()
+}
+
+func TestStdinCommands(t *testing.T) {
+	var shutdownReason string
+	reloadErr := error(nil)
+	cmds := &stdinCommands{
+		Shutdown: func(reason string) { shutdownReason = reason },
+		Reload: func() (string, error) {
+			return "routes=2 services=1", reloadErr
+		},
+		Status: func(ctx context.Context) (any, error) {
+			return StatusResponse{SchemaVersion: apiSchemaVersion, BackendState: "Running"}, nil
+		},
+	}
+
+	out := captureStdout(t, func() {
+		cmds.run(strings.NewReader("status\n\nRELOAD\nFROB\nSHUTDOWN\n"))
+	})
+	for _, want := range []string{
+		SignalStatus + ` {"schema_version":1,"self":`,
+		`"backend_state":"Running"}`,
+		SignalReloaded + " ok=true routes=2 services=1",
+		SignalWarning + ` unknown command "FROB"`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("Expected %q in output:\n%s", want, out)
+		}
+	}
+	if shutdownReason != "stdin" {
+		t.Errorf("Expected shutdown for stdin, got %q", shutdownReason)
+	}
+
+	reloadErr = errors.New("bad route")
+	out = captureStdout(t, func() { cmds.handle("RELOAD") })
+	if !strings.Contains(out, SignalReloaded+` ok=false error="bad route"`) {
+		t.Errorf("Expected a failed reload reply, got:\n%s", out)
+	}
+}
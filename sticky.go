@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"net/http"
+)
+
+// --- STICKY SESSIONS ---
+
+// Stickiness options for PoolConfig.Sticky
+const (
+	StickyClientIP = "client_ip"
+	StickyCookie   = "cookie"
+)
+
+// stickyCookieName is the cookie that pins a browser to a backend
+const stickyCookieName = "sidecar_backend"
+
+type clientAddrKey struct{}
+
+// withClientAddr records the address of the local client a dial is made for
+func withClientAddr(ctx context.Context, addr string) context.Context {
+	return context.WithValue(ctx, clientAddrKey{}, addr)
+}
+
+// clientIP returns the IP of the client recorded by withClientAddr, if any
+func clientIP(ctx context.Context) string {
+	addr, _ := ctx.Value(clientAddrKey{}).(string)
+	return addrHost(addr)
+}
+
+// addrHost strips the port from addr, if it has one
+func addrHost(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
+
+func stickyHash(key string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return h.Sum32()
+}
+
+// backendID is the opaque cookie value identifying a backend
+func backendID(addr string) string {
+	return fmt.Sprintf("%08x", stickyHash(addr))
+}
+
+// stickyPin is a backend chosen for a single plain HTTP request
+type stickyPin struct {
+	pool    *Pool
+	backend *backend
+	cookie  *http.Cookie // set on the response when the client needs (re-)pinning
+}
+
+// pin picks the backend for a plain HTTP request on a sticky route and points
+// req at it. HTTP keep-alive would otherwise pin whole connections, not
+// clients, so sticky routes are resolved per request instead of per dial.
+func (r *Router) pin(req *http.Request) (*stickyPin, bool) {
+	target, err := r.resolve(req.URL.Host)
+	if err != nil {
+		return nil, false
+	}
+	rt, ok := r.match(target)
+	if !ok || rt.pool.sticky == "" {
+		return nil, false
+	}
+	pool := rt.pool
+
+	pin := &stickyPin{pool: pool}
+	if pool.sticky == StickyCookie {
+		if c, err := req.Cookie(stickyCookieName); err == nil {
+			for _, b := range pool.backends {
+				if backendID(b.addr) == c.Value && !pool.isDown(b) {
+					pin.backend = b
+					break
+				}
+			}
+		}
+		if pin.backend == nil {
+			pin.backend = pool.order("")[0]
+			pin.cookie = &http.Cookie{
+				Name:     stickyCookieName,
+				Value:    backendID(pin.backend.addr),
+				Path:     "/",
+				HttpOnly: true,
+			}
+		}
+	} else {
+		pin.backend = pool.order(addrHost(req.RemoteAddr))[0]
+	}
+
+	addr := pin.backend.addr
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		_, port, _ := net.SplitHostPort(target)
+		if port == "" {
+			port = "80"
+			if req.URL.Scheme == "https" {
+				port = "443"
+			}
+		}
+		addr = net.JoinHostPort(addr, port)
+	}
+
+	// Only the dial target changes; the Host header still names the route
+	if req.Host == "" {
+		req.Host = req.URL.Host
+	}
+	req.URL.Host = addr
+	return pin, true
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestPoolStickyClientIP(t *testing.T) {
+	d := &recordingDialer{}
+	pool := newPool("test", PoolConfig{Targets: []string{"w1", "w2", "w3"}, Sticky: StickyClientIP}, nil)
+
+	ctx := withClientAddr(context.Background(), "192.168.1.20:51234")
+	for i := 0; i < 5; i++ {
+		conn, err := pool.Dial(ctx, d, "tcp", "8888")
+		if err != nil {
+			t.Fatalf("Dial failed: %v", err)
+		}
+		conn.Close()
+	}
+
+	for _, addr := range d.dialed[1:] {
+		if addr != d.dialed[0] {
+			t.Fatalf("Expected every dial to hit %s, got %v", d.dialed[0], d.dialed)
+		}
+	}
+}
+
+func TestPoolStickyFallsBackWhenBackendDown(t *testing.T) {
+	pool := newPool("test", PoolConfig{Targets: []string{"w1", "w2"}, Sticky: StickyClientIP}, nil)
+
+	preferred := pool.order("10.0.0.7")[0]
+	for i := 0; i < defaultMaxFailures; i++ {
+		pool.report(preferred, io.ErrUnexpectedEOF)
+	}
+
+	if got := pool.order("10.0.0.7")[0]; got == preferred {
+		t.Errorf("Expected ejected backend %s not to be preferred", preferred.addr)
+	}
+}
+
+func TestStickyCookie(t *testing.T) {
+	var hosts []string
+	mockRT := &MockRoundTripper{
+		RoundTripFunc: func(req *http.Request) (*http.Response, error) {
+			hosts = append(hosts, req.URL.Host)
+			if req.Host != "kernels:8888" {
+				t.Errorf("Expected Host header kernels:8888, got %s", req.Host)
+			}
+			return &http.Response{
+				StatusCode: 200,
+				Body:       io.NopCloser(strings.NewReader("OK")),
+				Header:     make(http.Header),
+			}, nil
+		},
+	}
+
+	router := newRouter(&recordingDialer{}, []RouteRule{
+		{Host: "kernels", PoolConfig: PoolConfig{Targets: []string{"k1", "k2"}, Sticky: StickyCookie}},
+	}, nil)
+	proxy := &TailscaleProxy{Transport: mockRT, Router: router}
+
+	// First request gets pinned and told so via Set-Cookie
+	w := httptest.NewRecorder()
+	proxy.handleHTTP(w, httptest.NewRequest("GET", "http://kernels:8888/api", nil))
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != stickyCookieName {
+		t.Fatalf("Expected %s cookie, got %v", stickyCookieName, cookies)
+	}
+
+	// Subsequent requests presenting the cookie stay on that backend
+	for i := 0; i < 3; i++ {
+		req := httptest.NewRequest("GET", "http://kernels:8888/api", nil)
+		req.AddCookie(cookies[0])
+		w := httptest.NewRecorder()
+		proxy.handleHTTP(w, req)
+		if len(w.Result().Cookies()) != 0 {
+			t.Error("Expected no new cookie for an already pinned client")
+		}
+	}
+
+	for _, h := range hosts {
+		if h != hosts[0] {
+			t.Fatalf("Expected all requests to reach %s, got %v", hosts[0], hosts)
+		}
+	}
+	if hosts[0] != "k1:8888" && hosts[0] != "k2:8888" {
+		t.Errorf("Expected a pool backend, got %s", hosts[0])
+	}
+}
+
+func TestTailnetResolverKeepsHostnames(t *testing.T) {
+	_, ip, err := tailnetResolver{}.Resolve(context.Background(), "data-node")
+	if err != nil || ip != nil {
+		t.Errorf("Expected hostname to stay unresolved, got ip=%v err=%v", ip, err)
+	}
+}
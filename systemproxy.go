@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os/exec"
+	"runtime"
+	"strings"
+)
+
+// --- SYSTEM PROXY ---
+
+// systemProxy changes OS-wide proxy settings with the platform's own tools
+// and remembers how to put every setting back.
+type systemProxy struct {
+	run  func(name string, args ...string) (string, error)
+	undo [][]string
+}
+
+func runCommand(name string, args ...string) (string, error) {
+	out, err := exec.Command(name, args...).Output()
+	return string(out), err
+}
+
+// set runs one change and records the command that reverts it.
+func (p *systemProxy) set(undo []string, name string, args ...string) error {
+	if _, err := p.run(name, args...); err != nil {
+		return fmt.Errorf("%s %s: %w", name, strings.Join(args, " "), err)
+	}
+	p.undo = append(p.undo, undo)
+	return nil
+}
+
+// restore reverts all changes, newest first.
+func (p *systemProxy) restore() {
+	for i := len(p.undo) - 1; i >= 0; i-- {
+		cmd := p.undo[i]
+		if _, err := p.run(cmd[0], cmd[1:]...); err != nil {
+			fmt.Fprintf(console, "!!! Failed to restore system proxy setting (%s): %v\n", strings.Join(cmd, " "), err)
+		}
+	}
+	p.undo = nil
+}
+
+// enable registers addr as the system proxy. On failure any settings
+// already changed are reverted.
+func (p *systemProxy) enable(goos, scheme, addr string) error {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	switch goos {
+	case "darwin":
+		err = p.enableNetworkSetup(scheme, host, port)
+	case "windows":
+		err = p.enableWinINet(scheme, host, port)
+	case "linux", "freebsd", "openbsd":
+		err = p.enableGnome(scheme, host, port)
+	default:
+		err = fmt.Errorf("not supported on %s", goos)
+	}
+	if err != nil {
+		p.restore()
+	}
+	return err
+}
+
+// enableGnome sets the GNOME proxy settings via gsettings.
+func (p *systemProxy) enableGnome(scheme, host, port string) error {
+	const schema = "org.gnome.system.proxy"
+	values := [][3]string{}
+	if scheme == "socks5" {
+		values = append(values, [3]string{schema + ".socks", "host", "'" + host + "'"}, [3]string{schema + ".socks", "port", port})
+	} else {
+		values = append(values,
+			[3]string{schema + ".http", "host", "'" + host + "'"}, [3]string{schema + ".http", "port", port},
+			[3]string{schema + ".https", "host", "'" + host + "'"}, [3]string{schema + ".https", "port", port})
+	}
+	values = append(values, [3]string{schema, "mode", "'manual'"})
+
+	for _, v := range values {
+		prev, err := p.run("gsettings", "get", v[0], v[1])
+		if err != nil {
+			return fmt.Errorf("gsettings get %s %s: %w", v[0], v[1], err)
+		}
+		undo := []string{"gsettings", "set", v[0], v[1], strings.TrimSpace(prev)}
+		if err := p.set(undo, "gsettings", "set", v[0], v[1], v[2]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// enableNetworkSetup sets the proxy on every enabled macOS network service.
+func (p *systemProxy) enableNetworkSetup(scheme, host, port string) error {
+	out, err := p.run("networksetup", "-listallnetworkservices")
+	if err != nil {
+		return fmt.Errorf("networksetup -listallnetworkservices: %w", err)
+	}
+	kinds := []string{"webproxy", "securewebproxy"}
+	if scheme == "socks5" {
+		kinds = []string{"socksfirewallproxy"}
+	}
+
+	sc := bufio.NewScanner(strings.NewReader(out))
+	sc.Scan() // "An asterisk (*) denotes that a network service is disabled."
+	for sc.Scan() {
+		service := strings.TrimSpace(sc.Text())
+		if service == "" || strings.HasPrefix(service, "*") {
+			continue
+		}
+		for _, kind := range kinds {
+			prev, err := p.run("networksetup", "-get"+kind, service)
+			if err != nil {
+				return fmt.Errorf("networksetup -get%s %s: %w", kind, service, err)
+			}
+			fields := map[string]string{}
+			for _, line := range strings.Split(prev, "\n") {
+				if k, v, ok := strings.Cut(line, ":"); ok {
+					fields[strings.TrimSpace(k)] = strings.TrimSpace(v)
+				}
+			}
+			undo := []string{"networksetup", "-set" + kind + "state", service, "off"}
+			if fields["Enabled"] == "Yes" {
+				undo = []string{"networksetup", "-set" + kind, service, fields["Server"], fields["Port"]}
+			}
+			if err := p.set(undo, "networksetup", "-set"+kind, service, host, port); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// enableWinINet sets the per-user Internet Settings used by WinINet/WinHTTP
+// aware applications.
+func (p *systemProxy) enableWinINet(scheme, host, port string) error {
+	const key = `HKCU\Software\Microsoft\Windows\CurrentVersion\Internet Settings`
+	server := host + ":" + port
+	if scheme == "socks5" {
+		server = "socks=" + server
+	}
+	values := [][3]string{
+		{"ProxyServer", "REG_SZ", server},
+		{"ProxyEnable", "REG_DWORD", "1"},
+	}
+
+	for _, v := range values {
+		undo := []string{"reg", "delete", key, "/v", v[0], "/f"}
+		if prev, err := p.run("reg", "query", key, "/v", v[0]); err == nil {
+			// "    ProxyEnable    REG_DWORD    0x0"
+			for _, line := range strings.Split(prev, "\n") {
+				f := strings.Fields(line)
+				if len(f) >= 2 && f[0] == v[0] {
+					data := ""
+					if len(f) >= 3 {
+						data = strings.Join(f[2:], " ")
+					}
+					undo = []string{"reg", "add", key, "/v", v[0], "/t", f[1], "/d", data, "/f"}
+				}
+			}
+		}
+		if err := p.set(undo, "reg", "add", key, "/v", v[0], "/t", v[1], "/d", v[2], "/f"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// startSystemProxy registers the proxy at addr with the OS and reverts the
+// settings on shutdown, including when the sidecar is interrupted or
+// terminated (see handleTermination).
+func startSystemProxy(scheme, addr string) error {
+	p := &systemProxy{run: runCommand}
+	if err := p.enable(runtime.GOOS, scheme, addr); err != nil {
+		return err
+	}
+	fmt.Fprintf(console, ">>> Registered %s://%s as the system proxy\n", scheme, addr)
+
+	onExit(p.restore)
+	return nil
+}
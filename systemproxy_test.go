@@ -0,0 +1,95 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// fakeCommands answers commands from a table and records what was run.
+type fakeCommands struct {
+	outputs map[string]string
+	ran     []string
+}
+
+func (f *fakeCommands) run(name string, args ...string) (string, error) {
+	cmd := strings.Join(append([]string{name}, args...), " ")
+	f.ran = append(f.ran, cmd)
+	if strings.Contains(cmd, " get ") || strings.Contains(cmd, " -get") || strings.Contains(cmd, " -list") || strings.Contains(cmd, " query ") {
+		out, ok := f.outputs[cmd]
+		if !ok {
+			return "", errors.New("not found")
+		}
+		return out, nil
+	}
+	return "", nil
+}
+
+func TestSystemProxyGnomeRestoresPreviousValues(t *testing.T) {
+	f := &fakeCommands{outputs: map[string]string{
+		"gsettings get org.gnome.system.proxy.socks host": "''\n",
+		"gsettings get org.gnome.system.proxy.socks port": "0\n",
+		"gsettings get org.gnome.system.proxy mode":       "'none'\n",
+	}}
+	p := &systemProxy{run: f.run}
+	if err := p.enable("linux", "socks5", "127.0.0.1:1080"); err != nil {
+		t.Fatalf("enable failed: %v", err)
+	}
+	f.ran = nil
+	p.restore()
+
+	want := []string{
+		"gsettings set org.gnome.system.proxy mode 'none'",
+		"gsettings set org.gnome.system.proxy.socks port 0",
+		"gsettings set org.gnome.system.proxy.socks host ''",
+	}
+	if !reflect.DeepEqual(f.ran, want) {
+		t.Fatalf("Expected restore %v, got %v", want, f.ran)
+	}
+}
+
+func TestSystemProxyNetworkSetup(t *testing.T) {
+	f := &fakeCommands{outputs: map[string]string{
+		"networksetup -listallnetworkservices":  "An asterisk (*) denotes that a network service is disabled.\nWi-Fi\n*Thunderbolt Bridge\n",
+		"networksetup -getwebproxy Wi-Fi":       "Enabled: Yes\nServer: corp-proxy\nPort: 3128\nAuthenticated Proxy Enabled: 0\n",
+		"networksetup -getsecurewebproxy Wi-Fi": "Enabled: No\nServer: \nPort: 0\n",
+	}}
+	p := &systemProxy{run: f.run}
+	if err := p.enable("darwin", "http", "127.0.0.1:8080"); err != nil {
+		t.Fatalf("enable failed: %v", err)
+	}
+	if got := f.ran[len(f.ran)-1]; got != "networksetup -setsecurewebproxy Wi-Fi 127.0.0.1 8080" {
+		t.Fatalf("Unexpected last command %q", got)
+	}
+	f.ran = nil
+	p.restore()
+
+	want := []string{
+		"networksetup -setsecurewebproxystate Wi-Fi off",
+		"networksetup -setwebproxy Wi-Fi corp-proxy 3128",
+	}
+	if !reflect.DeepEqual(f.ran, want) {
+		t.Fatalf("Expected restore %v, got %v", want, f.ran)
+	}
+}
+
+func TestSystemProxyWinINetRestoresRegistry(t *testing.T) {
+	f := &fakeCommands{outputs: map[string]string{
+		`reg query HKCU\Software\Microsoft\Windows\CurrentVersion\Internet Settings /v ProxyEnable`: "\r\nHKEY_CURRENT_USER\\...\r\n    ProxyEnable    REG_DWORD    0x0\r\n",
+	}}
+	p := &systemProxy{run: f.run}
+	if err := p.enable("windows", "http", "127.0.0.1:8080"); err != nil {
+		t.Fatalf("enable failed: %v", err)
+	}
+	f.ran = nil
+	p.restore()
+
+	want := []string{
+		`reg add HKCU\Software\Microsoft\Windows\CurrentVersion\Internet Settings /v ProxyEnable /t REG_DWORD /d 0x0 /f`,
+		`reg delete HKCU\Software\Microsoft\Windows\CurrentVersion\Internet Settings /v ProxyServer /f`,
+	}
+	if !reflect.DeepEqual(f.ran, want) {
+		t.Fatalf("Expected restore %v, got %v", want, f.ran)
+	}
+}
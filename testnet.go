@@ -0,0 +1,46 @@
+//go:build testnet
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	ossignal "os/signal"
+	"syscall"
+
+	"arkitekt.live/arkitekt-sidecar/testnet"
+	"tailscale.com/types/logger"
+)
+
+// runTestnet implements `sidecar testnet`, which keeps a test tailnet up
+// until interrupted so downstream CI can point real sidecars at it
+func runTestnet(args []string) error {
+	fs := flag.NewFlagSet("testnet", flag.ContinueOnError)
+	port := fs.String("port", "0", "Port for the coordination server (0 picks a free one)")
+	verbose := fs.Bool("verbose", false, "Log control server activity")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	logf := logger.Discard
+	if *verbose {
+		logf = log.Printf
+	}
+	tn, err := testnet.Start(net.JoinHostPort("127.0.0.1", *port), logf)
+	if err != nil {
+		return err
+	}
+	defer tn.Close()
+
+	fmt.Fprintf(console, ">>> Test tailnet up: run sidecars with -control-url %s -authkey test\n", tn.ControlURL)
+	signal(SignalReady, tn.ControlURL)
+
+	sigs := make(chan os.Signal, 1)
+	ossignal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	<-sigs
+	signal(SignalShutdown, "testnet")
+	return nil
+}
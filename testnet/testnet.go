@@ -0,0 +1,112 @@
+// Package testnet runs a throwaway tailnet in the calling process: a
+// coordination server and a DERP relay that let nodes join with any auth
+// key. The sidecar's tests use it, and it backs `sidecar testnet` in builds
+// with -tags testnet. It is its own package so release builds don't link
+// the test control server.
+package testnet
+
+import (
+	"crypto/tls"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+
+	"tailscale.com/derp/derpserver"
+	"tailscale.com/ipn/store/mem"
+	"tailscale.com/tailcfg"
+	"tailscale.com/tsnet"
+	"tailscale.com/tstest/integration/testcontrol"
+	"tailscale.com/types/key"
+	"tailscale.com/types/logger"
+)
+
+// MagicDNSSuffix is the MagicDNS domain of the test tailnet
+const MagicDNSSuffix = "sidecar.test"
+
+// Tailnet is a throwaway coordination server plus DERP relay running in
+// this process. Nodes join it with any auth key, so integration tests run in
+// CI without credentials. Everything listens on 127.0.0.1.
+type Tailnet struct {
+	ControlURL string
+
+	control *testcontrol.Server
+	derp    *derpserver.Server
+	derpSrv *httptest.Server
+	ctrlSrv *http.Server
+	ctrlLn  net.Listener
+}
+
+// Start brings up DERP and the control server; the control server listens
+// on addr ("127.0.0.1:0" picks a free port)
+func Start(addr string, logf logger.Logf) (*Tailnet, error) {
+	tn := &Tailnet{derp: derpserver.New(key.NewNode(), logger.Discard)}
+
+	// Nodes accept the relay's self-signed certificate because of
+	// InsecureForTests. Without STUN they stay on DERP, which is fine here.
+	tn.derpSrv = httptest.NewUnstartedServer(derpserver.Handler(tn.derp))
+	tn.derpSrv.Config.ErrorLog = log.New(io.Discard, "", 0)
+	tn.derpSrv.Config.TLSNextProto = make(map[string]func(*http.Server, *tls.Conn, http.Handler))
+	tn.derpSrv.StartTLS()
+	derpMap := &tailcfg.DERPMap{
+		Regions: map[int]*tailcfg.DERPRegion{
+			1: {
+				RegionID:   1,
+				RegionCode: "test",
+				RegionName: "In-process test relay",
+				Nodes: []*tailcfg.DERPNode{{
+					Name:             "1a",
+					RegionID:         1,
+					HostName:         "127.0.0.1",
+					IPv4:             "127.0.0.1",
+					IPv6:             "none",
+					STUNPort:         -1,
+					DERPPort:         tn.derpSrv.Listener.Addr().(*net.TCPAddr).Port,
+					InsecureForTests: true,
+				}},
+			},
+		},
+	}
+
+	tn.control = &testcontrol.Server{
+		DERPMap:        derpMap,
+		DNSConfig:      &tailcfg.DNSConfig{Proxied: true},
+		MagicDNSDomain: MagicDNSSuffix,
+		Logf:           logf,
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		tn.Close()
+		return nil, err
+	}
+	tn.ctrlLn = ln
+	tn.ctrlSrv = &http.Server{Handler: tn.control, ErrorLog: log.New(io.Discard, "", 0)}
+	go tn.ctrlSrv.Serve(ln)
+	tn.ControlURL = "http://" + ln.Addr().String()
+	return tn, nil
+}
+
+// Node returns a tsnet server set up to join the test tailnet. Its state
+// lives in dir and in memory, and it is removed from the tailnet on Close.
+func (tn *Tailnet) Node(hostname, dir string, logf logger.Logf) *tsnet.Server {
+	return &tsnet.Server{
+		Hostname:   hostname,
+		Dir:        dir,
+		Store:      new(mem.Store),
+		Ephemeral:  true,
+		AuthKey:    "test",
+		ControlURL: tn.ControlURL,
+		Logf:       logf,
+	}
+}
+
+// Close stops the control server and the relay
+func (tn *Tailnet) Close() {
+	if tn.ctrlSrv != nil {
+		tn.ctrlSrv.Close()
+	}
+	tn.derpSrv.CloseClientConnections()
+	tn.derpSrv.Close()
+	tn.derp.Close()
+}
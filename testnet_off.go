@@ -0,0 +1,11 @@
+//go:build !testnet
+
+package main
+
+import "errors"
+
+// runTestnet fails in builds without the test tailnet, so release binaries
+// don't carry the test control server
+func runTestnet(args []string) error {
+	return errors.New("`testnet` needs a build with -tags testnet")
+}
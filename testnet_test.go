@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"arkitekt.live/arkitekt-sidecar/testnet"
+)
+
+// TestTestTailnetProxy joins two nodes to the in-process tailnet and proxies
+// a request from one to the other, without any credentials
+func TestTestTailnetProxy(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping in-process tailnet test in short mode")
+	}
+
+	tn, err := testnet.Start("127.0.0.1:0", t.Logf)
+	if err != nil {
+		t.Fatalf("Failed to start test tailnet: %v", err)
+	}
+	defer tn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+
+	quietLogf := func(format string, args ...any) {}
+	server := tn.Node("echo-node", t.TempDir(), quietLogf)
+	defer server.Close()
+	status, err := server.Up(ctx)
+	if err != nil {
+		t.Fatalf("Server node failed to join: %v", err)
+	}
+	ln, err := server.Listen("tcp", ":80")
+	if err != nil {
+		t.Fatalf("Failed to listen on the tailnet: %v", err)
+	}
+	go http.Serve(ln, echoHandler("echo-node"))
+
+	client := tn.Node("sidecar-node", t.TempDir(), quietLogf)
+	defer client.Close()
+	if _, err := client.Up(ctx); err != nil {
+		t.Fatalf("Client node failed to join: %v", err)
+	}
+
+	proxy := &TailscaleProxy{
+		Dialer:    client,
+		Transport: &http.Transport{DialContext: client.Dial},
+	}
+	target := "http://" + status.TailscaleIPs[0].String() + "/hello"
+	req := httptest.NewRequest("GET", target, nil).WithContext(ctx)
+	w := httptest.NewRecorder()
+	proxy.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var echo EchoResponse
+	if err := json.NewDecoder(w.Body).Decode(&echo); err != nil {
+		t.Fatalf("Failed to decode echo response: %v", err)
+	}
+	if echo.Hostname != "echo-node" || echo.Path != "/hello" {
+		t.Errorf("Unexpected echo response: %+v", echo)
+	}
+}
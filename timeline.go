@@ -0,0 +1,275 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"tailscale.com/ipn/ipnstate"
+)
+
+// --- PEER TIMELINE ---
+
+// A user reporting "it was slow around 10:40" needs to know what the path
+// to the peer did then: whether it fell back to a relay, whether its
+// endpoint moved, and what the round trips were. The sidecar samples that
+// for every peer and keeps the last hour.
+
+// timelineWindow is how far back a peer's timeline reaches
+const timelineWindow = time.Hour
+
+// timelineMaxEvents bounds one peer's timeline whatever the interval
+const timelineMaxEvents = 2000
+
+// timelinePingTimeout bounds one RTT sample
+const timelinePingTimeout = 5 * time.Second
+
+// TimelineEvent is one entry of a peer's timeline. Kind is "path" when the
+// traffic moved between direct and a relay, "endpoint" when the direct
+// address changed, "online" or "offline", or "rtt" for a sample.
+type TimelineEvent struct {
+	Time    string  `json:"time"`
+	Kind    string  `json:"kind"`
+	Path    string  `json:"path,omitempty"`    // "direct" or "derp"
+	From    string  `json:"from,omitempty"`    // the previous path or endpoint
+	Address string  `json:"address,omitempty"` // direct endpoint
+	Relay   string  `json:"relay,omitempty"`   // DERP region, for the derp path
+	RTTMs   float64 `json:"rtt_ms,omitempty"`  // for rtt
+	Error   string  `json:"error,omitempty"`   // a failed rtt sample
+	at      time.Time
+}
+
+// PeerTimeline is the body of /peers/{name}/timeline
+type PeerTimeline struct {
+	SchemaVersion int             `json:"schema_version"`
+	Peer          string          `json:"peer"`
+	Since         string          `json:"since"`
+	Path          string          `json:"path"`
+	Address       string          `json:"address,omitempty"`
+	Relay         string          `json:"relay,omitempty"`
+	Samples       int             `json:"rtt_samples"`
+	MinRTTMs      float64         `json:"rtt_min_ms,omitempty"`
+	AvgRTTMs      float64         `json:"rtt_avg_ms,omitempty"`
+	MaxRTTMs      float64         `json:"rtt_max_ms,omitempty"`
+	Events        []TimelineEvent `json:"events"` // oldest first
+}
+
+// peerSample is what one round learns about a peer
+type peerSample struct {
+	Name    string // hostname
+	DNSName string // MagicDNS name without the trailing dot
+	Online  bool
+	Address string // direct endpoint, empty when relayed
+	Relay   string
+	RTT     time.Duration // 0 if not pinged
+	PingErr string
+}
+
+func (p peerSample) path() string {
+	if p.Address != "" && p.Relay == "" {
+		return "direct"
+	}
+	return "derp"
+}
+
+// peerTrack is one peer's timeline and the state the next sample is
+// compared against
+type peerTrack struct {
+	name, dnsName string
+	last          peerSample
+	events        []TimelineEvent
+}
+
+// peerTimelines samples every peer at an interval
+type peerTimelines struct {
+	Interval time.Duration
+	status   func(ctx context.Context) (*ipnstate.Status, error)
+	ping     func(ctx context.Context, ip netip.Addr) (*ipnstate.PingResult, error)
+
+	mu    sync.Mutex
+	peers map[string]*peerTrack // by lowercased hostname
+}
+
+// timelines is nil unless -peer-timeline is above zero
+var timelines *peerTimelines
+
+// observe records one round of samples taken at now
+func (t *peerTimelines) observe(now time.Time, samples []peerSample) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.peers == nil {
+		t.peers = make(map[string]*peerTrack)
+	}
+	for _, s := range samples {
+		key := strings.ToLower(s.Name)
+		tr, seen := t.peers[key]
+		if !seen {
+			tr = &peerTrack{name: s.Name}
+			t.peers[key] = tr
+		}
+		tr.dnsName = s.DNSName
+		ev := func(e TimelineEvent) {
+			e.at = now
+			e.Time = now.UTC().Format(time.RFC3339)
+			tr.events = append(tr.events, e)
+		}
+
+		prev := tr.last
+		switch {
+		case !s.Online && (!seen || prev.Online):
+			ev(TimelineEvent{Kind: "offline"})
+		case !seen:
+			ev(TimelineEvent{Kind: "path", Path: s.path(), Address: s.Address, Relay: s.Relay})
+		case s.Online != prev.Online:
+			ev(TimelineEvent{Kind: "online", Path: s.path(), Address: s.Address, Relay: s.Relay})
+		case s.path() != prev.path():
+			ev(TimelineEvent{Kind: "path", Path: s.path(), From: prev.path(), Address: s.Address, Relay: s.Relay})
+			fmt.Fprintf(console, "[TIMELINE] %s: %s -> %s\n", s.Name, describePath(prev), describePath(s))
+		case s.Relay != prev.Relay:
+			ev(TimelineEvent{Kind: "path", Path: s.path(), From: "derp(" + prev.Relay + ")", Relay: s.Relay})
+		case s.Address != prev.Address:
+			ev(TimelineEvent{Kind: "endpoint", Path: s.path(), From: prev.Address, Address: s.Address})
+		}
+		if s.RTT > 0 {
+			ev(TimelineEvent{Kind: "rtt", Path: s.path(), RTTMs: millis(s.RTT)})
+		} else if s.PingErr != "" {
+			ev(TimelineEvent{Kind: "rtt", Path: s.path(), Error: s.PingErr})
+		}
+		tr.last = s
+	}
+
+	// Forget what fell out of the window, and peers with nothing left
+	cutoff := now.Add(-timelineWindow)
+	for key, tr := range t.peers {
+		i, _ := slices.BinarySearchFunc(tr.events, cutoff, func(e TimelineEvent, c time.Time) int { return e.at.Compare(c) })
+		i = max(i, len(tr.events)-timelineMaxEvents)
+		tr.events = slices.Delete(tr.events, 0, i)
+		if len(tr.events) == 0 {
+			delete(t.peers, key)
+		}
+	}
+}
+
+// describePath is how the log names a path
+func describePath(s peerSample) string {
+	if s.path() == "direct" {
+		return "direct " + s.Address
+	}
+	return "derp(" + s.Relay + ")"
+}
+
+// timeline returns the timeline of the peer named name, by hostname or
+// MagicDNS name, or false if it has none
+func (t *peerTimelines) timeline(name string) (PeerTimeline, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, tr := range t.peers {
+		short, _, _ := strings.Cut(tr.dnsName, ".")
+		if !strings.EqualFold(tr.name, name) && !strings.EqualFold(tr.dnsName, name) && !strings.EqualFold(short, name) {
+			continue
+		}
+		pt := PeerTimeline{
+			SchemaVersion: apiSchemaVersion,
+			Peer:          tr.name,
+			Since:         tr.events[0].Time,
+			Path:          tr.last.path(),
+			Address:       tr.last.Address,
+			Relay:         tr.last.Relay,
+			Events:        slices.Clone(tr.events),
+		}
+		var sum float64
+		for _, e := range tr.events {
+			if e.Kind != "rtt" || e.Error != "" {
+				continue
+			}
+			if pt.Samples == 0 || e.RTTMs < pt.MinRTTMs {
+				pt.MinRTTMs = e.RTTMs
+			}
+			pt.MaxRTTMs = max(pt.MaxRTTMs, e.RTTMs)
+			sum += e.RTTMs
+			pt.Samples++
+		}
+		if pt.Samples > 0 {
+			pt.AvgRTTMs = sum / float64(pt.Samples)
+		}
+		return pt, true
+	}
+	return PeerTimeline{}, false
+}
+
+// sample takes one round: the path of every peer from the node's status,
+// and an RTT for the ones in active use. Idle peers aren't pinged, which
+// would wake up paths nobody uses.
+func (t *peerTimelines) sample(ctx context.Context) error {
+	status, err := t.status(ctx)
+	if err != nil {
+		return err
+	}
+	var samples []peerSample
+	for _, peer := range status.Peer {
+		s := peerSample{
+			Name:    peer.HostName,
+			DNSName: strings.TrimSuffix(peer.DNSName, "."),
+			Online:  peer.Online,
+			Address: peer.CurAddr,
+			Relay:   peer.Relay,
+		}
+		if s.Address != "" {
+			s.Relay = ""
+		}
+		if peer.Active && len(peer.TailscaleIPs) > 0 {
+			pctx, cancel := context.WithTimeout(ctx, timelinePingTimeout)
+			res, err := t.ping(pctx, peer.TailscaleIPs[0])
+			cancel()
+			switch {
+			case err != nil:
+				s.PingErr = err.Error()
+			case res.Err != "":
+				s.PingErr = res.Err
+			default:
+				s.RTT = time.Duration(res.LatencySeconds * float64(time.Second))
+			}
+		}
+		samples = append(samples, s)
+	}
+	t.observe(time.Now(), samples)
+	return nil
+}
+
+// run samples every Interval until ctx is done
+func (t *peerTimelines) run(ctx context.Context) {
+	ticker := time.NewTicker(t.Interval)
+	defer ticker.Stop()
+	for {
+		if err := t.sample(ctx); err != nil && ctx.Err() == nil {
+			fmt.Fprintf(console, "[TIMELINE] Sampling peers failed: %v\n", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// handlePeerTimeline serves /peers/{name}/timeline on the status API
+func handlePeerTimeline(w http.ResponseWriter, r *http.Request) {
+	if timelines == nil {
+		http.Error(w, "peer timelines are off (-peer-timeline 0)", http.StatusNotFound)
+		return
+	}
+	name := r.PathValue("name")
+	pt, ok := timelines.timeline(name)
+	if !ok {
+		http.Error(w, fmt.Sprintf("no timeline for a peer named %q", name), http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(pt)
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+	"time"
+
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/types/key"
+)
+
+func TestPeerTimelineObserve(t *testing.T) {
+	tl := &peerTimelines{}
+	start := time.Date(2026, 10, 1, 10, 0, 0, 0, time.UTC)
+	relayed := peerSample{Name: "lab-b", DNSName: "lab-b.tail.ts.net", Online: true, Relay: "fra"}
+	direct := peerSample{Name: "lab-b", DNSName: "lab-b.tail.ts.net", Online: true, Address: "203.0.113.7:41641"}
+	moved := direct
+	moved.Address = "198.51.100.2:41641"
+
+	var rounds []peerSample
+	for _, s := range []peerSample{relayed, relayed, direct, moved, {Name: "lab-b", DNSName: "lab-b.tail.ts.net"}, moved} {
+		s.RTT = 20 * time.Millisecond
+		if !s.Online {
+			s.RTT = 0
+		}
+		rounds = append(rounds, s)
+	}
+	for i, s := range rounds {
+		tl.observe(start.Add(time.Duration(i)*time.Minute), []peerSample{s})
+	}
+
+	pt, ok := tl.timeline("LAB-B")
+	if !ok {
+		t.Fatalf("Expected a timeline by hostname")
+	}
+	if _, ok := tl.timeline("lab-b.tail.ts.net"); !ok {
+		t.Errorf("Expected a timeline by MagicDNS name")
+	}
+	var kinds []string
+	for _, e := range pt.Events {
+		if e.Kind != "rtt" {
+			kinds = append(kinds, e.Kind)
+		}
+	}
+	want := []string{"path", "path", "endpoint", "offline", "online"}
+	if len(kinds) != len(want) {
+		t.Fatalf("Expected events %v, got %v", want, kinds)
+	}
+	for i := range want {
+		if kinds[i] != want[i] {
+			t.Fatalf("Expected events %v, got %v", want, kinds)
+		}
+	}
+	if pt.Samples != 5 || pt.AvgRTTMs != 20 || pt.Path != "direct" || pt.Address != moved.Address {
+		t.Errorf("Unexpected summary %+v", pt)
+	}
+	if e := pt.Events[3]; e.Kind != "path" || e.From != "derp" || e.Path != "direct" {
+		t.Errorf("Expected derp -> direct, got %+v", e)
+	}
+
+	// Only the last hour is kept
+	tl.observe(start.Add(time.Hour+150*time.Second), []peerSample{moved})
+	pt, _ = tl.timeline("lab-b")
+	if pt.Since != start.Add(3*time.Minute).Format(time.RFC3339) {
+		t.Errorf("Expected the timeline to start at the endpoint change, got %s", pt.Since)
+	}
+}
+
+func TestPeerTimelineSample(t *testing.T) {
+	ip := netip.MustParseAddr("100.64.0.2")
+	status := &ipnstate.Status{Peer: map[key.NodePublic]*ipnstate.PeerStatus{
+		key.NewNode().Public(): {HostName: "lab-b", DNSName: "lab-b.tail.ts.net.", Online: true, Active: true,
+			TailscaleIPs: []netip.Addr{ip}, CurAddr: "203.0.113.7:41641", Relay: "fra"},
+		key.NewNode().Public(): {HostName: "idle", Online: true, Relay: "nyc"},
+	}}
+	var pinged []netip.Addr
+	tl := &peerTimelines{
+		status: func(ctx context.Context) (*ipnstate.Status, error) { return status, nil },
+		ping: func(ctx context.Context, ip netip.Addr) (*ipnstate.PingResult, error) {
+			pinged = append(pinged, ip)
+			return &ipnstate.PingResult{LatencySeconds: 0.012}, nil
+		},
+	}
+	if err := tl.sample(context.Background()); err != nil {
+		t.Fatalf("sample failed: %v", err)
+	}
+	if len(pinged) != 1 || pinged[0] != ip {
+		t.Errorf("Expected only the active peer to be pinged, got %v", pinged)
+	}
+	pt, _ := tl.timeline("lab-b")
+	if pt.Path != "direct" || pt.Relay != "" || pt.Samples != 1 || pt.MinRTTMs != 12 {
+		t.Errorf("Unexpected timeline %+v", pt)
+	}
+	if pt, _ := tl.timeline("idle"); pt.Path != "derp" || pt.Relay != "nyc" || pt.Samples != 0 {
+		t.Errorf("Unexpected timeline %+v", pt)
+	}
+
+	tl.status = func(ctx context.Context) (*ipnstate.Status, error) { return nil, errors.New("not running") }
+	if err := tl.sample(context.Background()); err == nil {
+		t.Errorf("Expected the status error")
+	}
+}
+
+func TestHandlePeerTimeline(t *testing.T) {
+	old := timelines
+	defer func() { timelines = old }()
+
+	mux := http.NewServeMux()
+	apiMux{mux}.HandleFunc("GET /peers/{name}/timeline", handlePeerTimeline)
+	get := func(path string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+		return rec
+	}
+
+	timelines = nil
+	if rec := get("/peers/lab-b/timeline"); rec.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 with timelines off, got %d", rec.Code)
+	}
+
+	timelines = &peerTimelines{}
+	timelines.observe(time.Now(), []peerSample{{Name: "lab-b", Online: true, Relay: "fra", RTT: 40 * time.Millisecond}})
+	rec := get("/api/v1/peers/lab-b/timeline")
+	var pt PeerTimeline
+	if err := json.NewDecoder(rec.Body).Decode(&pt); err != nil {
+		t.Fatalf("Failed to decode timeline: %v", err)
+	}
+	if pt.Peer != "lab-b" || len(pt.Events) != 2 || pt.MaxRTTMs != 40 {
+		t.Errorf("Unexpected timeline %+v", pt)
+	}
+	if rec := get("/peers/other/timeline"); rec.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for an unknown peer, got %d", rec.Code)
+	}
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	ossignal "os/signal"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// --- TERMINAL DASHBOARD ---
+
+// topSnapshot is one poll of a running sidecar's status API
+type topSnapshot struct {
+	at     time.Time
+	status StatusResponse
+	conns  []ConnInfo
+}
+
+// runTop implements `sidecar top`: a live view of a running sidecar's peers,
+// paths and tunnels, redrawn every -interval until interrupted
+func runTop(args []string, stdout io.Writer) error {
+	fs := flag.NewFlagSet("top", flag.ContinueOnError)
+	var (
+		port     = fs.String("statusport", "", "Status API port of the sidecar to watch")
+		interval = fs.Duration("interval", 2*time.Second, "How often to refresh")
+		once     = fs.Bool("once", false, "Print one frame without clearing the screen and exit")
+		langFlag = fs.String("lang", "", "Language of the output: 'en' or 'de' (default from the system locale)")
+	)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if err := flagsFromEnv(fs, os.LookupEnv); err != nil {
+		return err
+	}
+	if *port == "" {
+		return fmt.Errorf("top needs -statusport or %s", envName("statusport"))
+	}
+	if *interval < 100*time.Millisecond {
+		return fmt.Errorf("-interval must be at least 100ms, got %s", *interval)
+	}
+	lang, err := resolveLang(*langFlag)
+	if err != nil {
+		return err
+	}
+	base := "http://127.0.0.1:" + *port
+
+	if *once {
+		// Rates need two polls, so a single frame waits one interval
+		ctx, cancel := context.WithTimeout(context.Background(), *interval+10*time.Second)
+		defer cancel()
+		prev, err := fetchTop(ctx, base)
+		if err != nil {
+			return err
+		}
+		time.Sleep(*interval)
+		cur, err := fetchTop(ctx, base)
+		if err != nil {
+			return err
+		}
+		renderTop(stdout, cur, prev, lang)
+		return nil
+	}
+
+	ctx, stop := ossignal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	fmt.Fprint(stdout, "\x1b[?25l")         // hide the cursor
+	defer fmt.Fprint(stdout, "\x1b[?25h\n") // and bring it back
+	ticker := time.NewTicker(*interval)
+	defer ticker.Stop()
+	var prev *topSnapshot
+	for {
+		pollCtx, cancel := context.WithTimeout(ctx, *interval)
+		cur, err := fetchTop(pollCtx, base)
+		cancel()
+		fmt.Fprint(stdout, "\x1b[H\x1b[2J")
+		if err != nil {
+			// The sidecar may be restarting; keep trying
+			fmt.Fprintf(stdout, "!!! %s %s: %v\n", base, tr(lang, "cli.unreachable"), err)
+		} else {
+			renderTop(stdout, cur, prev, lang)
+			prev = cur
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// fetchTop polls the status and connection endpoints
+func fetchTop(ctx context.Context, base string) (*topSnapshot, error) {
+	snap := &topSnapshot{at: time.Now()}
+	if err := getJSON(ctx, base+apiPrefix+"/status", &snap.status); err != nil {
+		return nil, err
+	}
+	if err := getJSON(ctx, base+apiPrefix+"/connections", &snap.conns); err != nil {
+		return nil, err
+	}
+	return snap, nil
+}
+
+// getJSON decodes the JSON answer to a GET on the status API into v
+func getJSON(ctx context.Context, url string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("status API unreachable: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s answered %s", req.URL.Path, resp.Status)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("unreadable %s: %w", req.URL.Path, err)
+	}
+	return nil
+}
+
+// renderTop draws one frame. Rates are computed against prev and shown as
+// "-" on the first frame or for peers and tunnels prev didn't have.
+func renderTop(w io.Writer, cur, prev *topSnapshot, lang string) {
+	st := cur.status
+	derp := tr(lang, "cli.no_derp")
+	if st.DERP.HomeRegion != "" {
+		derp = st.DERP.HomeRegion
+		if !st.DERP.Connected {
+			derp += " (disconnected)"
+		}
+	}
+	fmt.Fprintf(w, "%s  %s  DERP %s  %s\n\n", st.Self.HostName, st.BackendState, derp, cur.at.Format("15:04:05"))
+
+	var elapsed float64
+	prevPeers := map[string]PeerStatus{}
+	prevConns := map[string]ConnInfo{}
+	if prev != nil {
+		elapsed = cur.at.Sub(prev.at).Seconds()
+		for _, p := range prev.status.Peers {
+			prevPeers[p.Name] = p
+		}
+		for _, c := range prev.conns {
+			prevConns[c.ID] = c
+		}
+	}
+	rate := func(now, before int64, ok bool) string {
+		if !ok || elapsed <= 0 || now < before {
+			return "-"
+		}
+		return humanBytes(float64(now-before)/elapsed) + "/s"
+	}
+
+	peers := slices.Clone(st.Peers)
+	slices.SortFunc(peers, func(a, b PeerStatus) int {
+		if a.Online != b.Online {
+			if a.Online {
+				return -1
+			}
+			return 1
+		}
+		return strings.Compare(a.Name, b.Name)
+	})
+	online := 0
+	for _, p := range peers {
+		if p.Online {
+			online++
+		}
+	}
+	fmt.Fprintln(w, tr(lang, "cli.peers", "online", online, "total", len(peers)))
+	fmt.Fprintf(w, "%-24s %-28s %10s %10s\n", tr(lang, "cli.name"), tr(lang, "cli.path"), "RX", "TX")
+	for _, p := range peers {
+		path := tr(lang, "cli.offline")
+		switch {
+		case p.Online && p.Direct:
+			path = tr(lang, "cli.direct", "address", p.CurAddr)
+		case p.Online && p.RelayedVia != "":
+			path = tr(lang, "cli.relayed", "region", p.RelayedVia)
+		case p.Online:
+			path = tr(lang, "cli.idle")
+		}
+		before, ok := prevPeers[p.Name]
+		fmt.Fprintf(w, "%-24s %-28s %10s %10s\n", clip(p.Name, 24), clip(path, 28),
+			rate(p.RxBytes, before.RxBytes, ok), rate(p.TxBytes, before.TxBytes, ok))
+	}
+
+	conns := slices.Clone(cur.conns)
+	slices.SortFunc(conns, func(a, b ConnInfo) int { return cmp.Compare(b.AgeSeconds, a.AgeSeconds) })
+	fmt.Fprintf(w, "\n%s\n", tr(lang, "cli.tunnels", "count", len(conns)))
+	fmt.Fprintf(w, "%-8s %-8s %-32s %10s %10s %8s\n", "ID", tr(lang, "cli.kind"), tr(lang, "cli.target"), "RX", "TX", tr(lang, "cli.age"))
+	for _, c := range conns {
+		before, ok := prevConns[c.ID]
+		age := time.Duration(c.AgeSeconds * float64(time.Second)).Round(time.Second)
+		fmt.Fprintf(w, "%-8s %-8s %-32s %10s %10s %8s\n", clip(c.ID, 8), c.Kind, clip(c.Target, 32),
+			rate(c.RxBytes, before.RxBytes, ok), rate(c.TxBytes, before.TxBytes, ok), age)
+	}
+}
+
+// humanBytes formats a byte count with a binary unit
+func humanBytes(n float64) string {
+	const units = "KMGT"
+	if n < 1024 {
+		return fmt.Sprintf("%.0fB", n)
+	}
+	i := -1
+	for n >= 1024 && i < len(units)-1 {
+		n /= 1024
+		i++
+	}
+	return fmt.Sprintf("%.1f%ciB", n, units[i])
+}
+
+// clip shortens s to width columns, marking the cut
+func clip(s string, width int) string {
+	if len(s) <= width {
+		return s
+	}
+	return s[:width-1] + "…"
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestTop(t *testing.T) {
+	var polls atomic.Int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case apiPrefix + "/status":
+			n := polls.Add(1)
+			json.NewEncoder(w).Encode(StatusResponse{
+				Self:         PeerStatus{HostName: "bench-laptop"},
+				DERP:         DERPStatus{HomeRegion: "fra", Connected: true},
+				BackendState: "Running",
+				Peers: []PeerStatus{
+					{Name: "gpu-node", Online: true, RelayedVia: "fra", RxBytes: n << 20},
+					{Name: "old-node"},
+					{Name: "data-node", Online: true, Direct: true, CurAddr: "10.0.0.7:41641"},
+				},
+			})
+		case apiPrefix + "/connections":
+			json.NewEncoder(w).Encode([]ConnInfo{{ID: "c1", Kind: "forward", Target: "data-node:5432", AgeSeconds: 75}})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+	_, port, _ := net.SplitHostPort(srv.Listener.Addr().String())
+
+	var out bytes.Buffer
+	if err := runTop([]string{"-statusport", port, "-once", "-interval", "100ms", "-lang", "en"}, &out); err != nil {
+		t.Fatalf("top failed: %v", err)
+	}
+	frame := out.String()
+	if strings.Contains(frame, "\x1b[") {
+		t.Errorf("Expected -once to print without escape codes, got %q", frame)
+	}
+	lines := strings.Split(frame, "\n")
+	if !strings.HasPrefix(lines[0], "bench-laptop  Running  DERP fra") {
+		t.Errorf("Unexpected header %q", lines[0])
+	}
+	for _, want := range []string{"PEERS (2/3 online)", "direct 10.0.0.7:41641", "DERP fra", "offline", "TUNNELS (1 active)", "data-node:5432", "1m15s"} {
+		if !strings.Contains(frame, want) {
+			t.Errorf("Expected %q in the frame:\n%s", want, frame)
+		}
+	}
+	// Online peers come first, then by name
+	if strings.Index(frame, "data-node ") > strings.Index(frame, "gpu-node") || strings.Index(frame, "gpu-node") > strings.Index(frame, "old-node") {
+		t.Errorf("Unexpected peer order:\n%s", frame)
+	}
+	// gpu-node received 1 MiB between the two polls
+	for _, line := range lines {
+		if strings.HasPrefix(line, "gpu-node") && !strings.Contains(line, "MiB/s") {
+			t.Errorf("Expected a receive rate for gpu-node, got %q", line)
+		}
+	}
+
+	if err := runTop([]string{"-once"}, &out); err == nil {
+		t.Error("Expected an error without -statusport")
+	}
+}
+
+func TestRenderTopFirstFrame(t *testing.T) {
+	cur := &topSnapshot{at: time.Now(), conns: []ConnInfo{{ID: "c1", Kind: "connect", Target: "gpu-node:8080", RxBytes: 4096}}}
+	var out bytes.Buffer
+	renderTop(&out, cur, nil, "en")
+	if !strings.Contains(out.String(), "DERP none") {
+		t.Errorf("Expected no DERP region, got:\n%s", out.String())
+	}
+	for _, line := range strings.Split(out.String(), "\n") {
+		if strings.HasPrefix(line, "c1") && strings.Count(line, " - ") < 1 {
+			t.Errorf("Expected no rates without a previous frame, got %q", line)
+		}
+	}
+	out.Reset()
+	renderTop(&out, cur, nil, "de")
+	for _, want := range []string{"DERP keiner", "TUNNEL (1 aktiv)", "ZIEL"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("Expected %q in the German frame:\n%s", want, out.String())
+		}
+	}
+	if got := humanBytes(1536); got != "1.5KiB" {
+		t.Errorf("Expected 1.5KiB, got %s", got)
+	}
+}
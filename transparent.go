@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+)
+
+// --- TRANSPARENT MODE ---
+
+// errTransparentUnsupported is returned by originalDst on platforms without
+// a way to recover the pre-redirect destination.
+var errTransparentUnsupported = errors.New("transparent mode is only supported on Linux (iptables REDIRECT) and macOS (pf rdr)")
+
+// serveTransparent accepts connections that the OS firewall redirected to
+// ln, recovers where each one was originally headed and dials that address
+// through the tailnet instead. lookup is originalDst outside of tests.
+func serveTransparent(ln net.Listener, d Dialer, lookup func(net.Conn) (string, error)) error {
+	for {
+		clientConn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		if maintenance.Load() || limits.admit() != nil {
+			clientConn.Close()
+			continue
+		}
+		go func() {
+			defer clientConn.Close()
+
+			target, err := lookup(clientConn)
+			if err != nil {
+				fmt.Fprintf(console, "[TRANSPARENT] %s: no original destination: %v\n", clientConn.RemoteAddr(), err)
+				return
+			}
+
+			id := newRequestID()
+			ctx := withRequestID(withClientAddr(context.Background(), clientConn.RemoteAddr().String()), id)
+			targetConn, err := d.Dial(ctx, "tcp", target)
+			if err != nil {
+				fmt.Fprintf(console, "[TRANSPARENT] %s: dial %s failed: %v\n", id, target, err)
+				requestFailed(id, "transparent", target, err)
+				return
+			}
+			targetConn = connections.track("transparent", id, clientConn.RemoteAddr().String(), target, targetConn, clientConn)
+			defer targetConn.Close()
+
+			fmt.Fprintf(console, "[TRANSPARENT] %s %s -> %s\n", id, clientConn.RemoteAddr(), target)
+			go io.Copy(targetConn, clientConn)
+			io.Copy(clientConn, targetConn)
+		}()
+	}
+}
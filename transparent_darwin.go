@@ -0,0 +1,81 @@
+//go:build darwin
+
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// pfioc_natlook layout from <net/pfvar.h> (XNU).
+const (
+	diocNatLook    = 0xC0544417 // _IOWR('D', 23, struct pfioc_natlook)
+	pfNatLookSize  = 84
+	pfOut          = 2
+	natLookSaddr   = 0
+	natLookDaddr   = 16
+	natLookRdaddr  = 48
+	natLookSxport  = 64
+	natLookDxport  = 68
+	natLookRdxport = 76
+	natLookAF      = 80
+	natLookProto   = 81
+	natLookDir     = 83
+)
+
+// originalDst asks pf which rdr rule state a connection belongs to and
+// returns the address the client originally dialed. Reading /dev/pf needs
+// root, same as loading the rdr rules in the first place.
+func originalDst(conn net.Conn) (string, error) {
+	remote, err := netip.ParseAddrPort(conn.RemoteAddr().String())
+	if err != nil {
+		return "", err
+	}
+	local, err := netip.ParseAddrPort(conn.LocalAddr().String())
+	if err != nil {
+		return "", err
+	}
+
+	dev, err := os.Open("/dev/pf")
+	if err != nil {
+		return "", fmt.Errorf("open /dev/pf: %w", err)
+	}
+	defer dev.Close()
+
+	var nl [pfNatLookSize]byte
+	af := byte(unix.AF_INET)
+	if remote.Addr().Unmap().Is4() {
+		a, b := remote.Addr().Unmap().As4(), local.Addr().Unmap().As4()
+		copy(nl[natLookSaddr:], a[:])
+		copy(nl[natLookDaddr:], b[:])
+	} else {
+		af = unix.AF_INET6
+		a, b := remote.Addr().As16(), local.Addr().As16()
+		copy(nl[natLookSaddr:], a[:])
+		copy(nl[natLookDaddr:], b[:])
+	}
+	binary.BigEndian.PutUint16(nl[natLookSxport:], remote.Port())
+	binary.BigEndian.PutUint16(nl[natLookDxport:], local.Port())
+	nl[natLookAF] = af
+	nl[natLookProto] = unix.IPPROTO_TCP
+	nl[natLookDir] = pfOut
+
+	if _, _, errno := unix.Syscall(unix.SYS_IOCTL, dev.Fd(), diocNatLook, uintptr(unsafe.Pointer(&nl[0]))); errno != 0 {
+		return "", fmt.Errorf("DIOCNATLOOK: %w", errno)
+	}
+
+	var addr netip.Addr
+	if af == unix.AF_INET {
+		addr = netip.AddrFrom4([4]byte(nl[natLookRdaddr : natLookRdaddr+4]))
+	} else {
+		addr = netip.AddrFrom16([16]byte(nl[natLookRdaddr : natLookRdaddr+16]))
+	}
+	port := binary.BigEndian.Uint16(nl[natLookRdxport:])
+	return netip.AddrPortFrom(addr, port).String(), nil
+}
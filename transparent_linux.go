@@ -0,0 +1,59 @@
+//go:build linux
+
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/netip"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// originalDst recovers the destination of a connection redirected with
+// iptables -j REDIRECT via SO_ORIGINAL_DST (IP6T_SO_ORIGINAL_DST for IPv6).
+func originalDst(conn net.Conn) (string, error) {
+	tc, ok := unwrapConn(conn).(*net.TCPConn)
+	if !ok {
+		return "", fmt.Errorf("not a TCP connection")
+	}
+	raw, err := tc.SyscallConn()
+	if err != nil {
+		return "", err
+	}
+
+	local, _ := netip.ParseAddrPort(conn.LocalAddr().String())
+	var dst netip.AddrPort
+	var sockErr error
+	err = raw.Control(func(fd uintptr) {
+		if local.Addr().Unmap().Is4() {
+			// sockaddr_in comes back in the 16 bytes of an ipv6_mreq
+			mreq, err := unix.GetsockoptIPv6Mreq(int(fd), unix.SOL_IP, unix.SO_ORIGINAL_DST)
+			if err != nil {
+				sockErr = err
+				return
+			}
+			b := mreq.Multiaddr
+			port := binary.BigEndian.Uint16(b[2:4])
+			dst = netip.AddrPortFrom(netip.AddrFrom4([4]byte{b[4], b[5], b[6], b[7]}), port)
+			return
+		}
+		info, err := unix.GetsockoptIPv6MTUInfo(int(fd), unix.SOL_IPV6, unix.SO_ORIGINAL_DST)
+		if err != nil {
+			sockErr = err
+			return
+		}
+		// sin6_port is stored in network byte order
+		port := binary.BigEndian.Uint16((*[2]byte)(unsafe.Pointer(&info.Addr.Port))[:])
+		dst = netip.AddrPortFrom(netip.AddrFrom16(info.Addr.Addr), port)
+	})
+	if err != nil {
+		return "", err
+	}
+	if sockErr != nil {
+		return "", fmt.Errorf("SO_ORIGINAL_DST: %w", sockErr)
+	}
+	return dst.String(), nil
+}
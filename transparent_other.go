@@ -0,0 +1,10 @@
+//go:build !linux && !darwin
+
+package main
+
+import "net"
+
+// originalDst is not available on this platform.
+func originalDst(conn net.Conn) (string, error) {
+	return "", errTransparentUnsupported
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+)
+
+func TestTransparentDialsOriginalDestination(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer ln.Close()
+
+	mockDialer := &MockDialer{
+		DialFunc: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			client, server := net.Pipe()
+			go func() {
+				server.Write([]byte(addr))
+				server.Close()
+			}()
+			return client, nil
+		},
+	}
+	lookup := func(net.Conn) (string, error) { return "100.64.0.7:8000", nil }
+	go serveTransparent(ln, mockDialer, lookup)
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to dial transparent listener: %v", err)
+	}
+	defer conn.Close()
+
+	got, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatalf("Failed to read: %v", err)
+	}
+	if string(got) != "100.64.0.7:8000" {
+		t.Fatalf("Expected dial to original destination, got %q", got)
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/png"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// --- TRAY ICON ---
+
+// trayPollInterval is how often the tray icon refreshes the node's state
+const trayPollInterval = 5 * time.Second
+
+// trayState is what the tray icon shows and does. main fills it in while
+// the sidecar starts; it is nil unless -tray.
+type trayState struct {
+	mu        sync.Mutex
+	lang      string                                            // the system locale until -lang is parsed
+	proxyURL  string                                            // empty until READY
+	dashboard string                                            // status page, empty without -statusport
+	status    func(ctx context.Context) (StatusResponse, error) // nil until the node runs
+	quit      func()                                            // nil until the node runs
+}
+
+var tray *trayState
+
+// attach hands the tray the running node
+func (t *trayState) attach(lang, dashboard string, status func(ctx context.Context) (StatusResponse, error), quit func()) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.lang, t.dashboard, t.status, t.quit = lang, dashboard, status, quit
+}
+
+// setProxyURL records the URL apps should use, once the proxy listens
+func (t *trayState) setProxyURL(u string) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.proxyURL = u
+}
+
+// label describes the node's state for the tray menu and tooltip
+func (t *trayState) label(ctx context.Context) (text string, connected bool) {
+	t.mu.Lock()
+	lang, status := t.lang, t.status
+	t.mu.Unlock()
+	if status == nil {
+		return tr(lang, "tray.starting"), false
+	}
+	st, err := status(ctx)
+	if err != nil {
+		return tr(lang, "tray.error", "error", err), false
+	}
+	return trayLabel(&st, lang), st.BackendState == "Running"
+}
+
+// trayLabel summarizes a status response in a few words
+func trayLabel(st *StatusResponse, lang string) string {
+	if st.BackendState != "Running" {
+		return st.BackendState
+	}
+	online := 0
+	for _, p := range st.Peers {
+		if p.Online {
+			online++
+		}
+	}
+	return tr(lang, "tray.connected", "host", st.Self.HostName, "online", online)
+}
+
+// trayRequested reports whether the sidecar runs with -tray. It is decided
+// before flags are parsed, because the tray has to own the main thread.
+// Subcommands never show one.
+func trayRequested(args []string, lookup func(string) (string, bool)) bool {
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		return false
+	}
+	on := false
+	if v, ok := lookup(envName("tray")); ok {
+		on, _ = strconv.ParseBool(v)
+	}
+	for _, arg := range args {
+		if arg == "--" {
+			break
+		}
+		name, value, hasValue := strings.Cut(strings.TrimLeft(arg, "-"), "=")
+		if name != "tray" || !strings.HasPrefix(arg, "-") {
+			continue
+		}
+		on = true
+		if hasValue {
+			on, _ = strconv.ParseBool(value)
+		}
+	}
+	return on
+}
+
+// trayIcon draws the icon: a filled circle in c. Windows wants an ICO
+// file, which may carry a PNG as is.
+func trayIcon(c color.Color, ico bool) []byte {
+	const size = 32
+	img := image.NewNRGBA(image.Rect(0, 0, size, size))
+	for y := 0; y < size; y++ {
+		for x := 0; x < size; x++ {
+			dx, dy := float64(x)-size/2+0.5, float64(y)-size/2+0.5
+			if dx*dx+dy*dy <= (size/2-2)*(size/2-2) {
+				img.Set(x, y, c)
+			}
+		}
+	}
+	var buf bytes.Buffer
+	png.Encode(&buf, img)
+	if !ico {
+		return buf.Bytes()
+	}
+	var out bytes.Buffer
+	binary.Write(&out, binary.LittleEndian, []uint16{0, 1, 1}) // reserved, type icon, one image
+	out.Write([]byte{size, size, 0, 0})                        // width, height, no palette
+	binary.Write(&out, binary.LittleEndian, []uint16{1, 32})   // planes, bits per pixel
+	binary.Write(&out, binary.LittleEndian, []uint32{uint32(buf.Len()), 6 + 16})
+	out.Write(buf.Bytes())
+	return out.Bytes()
+}
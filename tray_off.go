@@ -0,0 +1,10 @@
+//go:build !tray
+
+package main
+
+import "errors"
+
+// runTray fails in builds without the tray, which need no GUI libraries
+func runTray(t *trayState, sidecar func()) error {
+	return errors.New("-tray needs a build with -tags tray")
+}
@@ -0,0 +1,144 @@
+//go:build tray
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"image/color"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"time"
+
+	"fyne.io/systray"
+)
+
+var (
+	trayConnected = color.RGBA{0x2e, 0x9d, 0x5b, 0xff}
+	trayWaiting   = color.RGBA{0x8a, 0x93, 0xa3, 0xff}
+)
+
+// runTray shows the tray icon on the main thread and runs the sidecar
+// beside it. Quitting from the menu shuts the sidecar down cleanly.
+func runTray(t *trayState, sidecar func()) error {
+	systray.Run(func() {
+		go serveTray(t)
+		go func() {
+			sidecar()
+			systray.Quit()
+		}()
+	}, nil)
+	// Quit before the node ran, or the sidecar returned
+	os.Exit(0)
+	return nil
+}
+
+func serveTray(t *trayState) {
+	ico := runtime.GOOS == "windows"
+	systray.SetIcon(trayIcon(trayWaiting, ico))
+	systray.SetTooltip("Arkitekt Sidecar")
+	state := systray.AddMenuItem("", "")
+	state.Disable()
+	systray.AddSeparator()
+	copyURL := systray.AddMenuItem("", "")
+	openDash := systray.AddMenuItem("", "")
+	systray.AddSeparator()
+	quit := systray.AddMenuItem("", "")
+
+	ticker := time.NewTicker(trayPollInterval)
+	defer ticker.Stop()
+	last, lastLang := "", ""
+	for {
+		// -lang is only known once the sidecar parsed its flags
+		t.mu.Lock()
+		lang := t.lang
+		t.mu.Unlock()
+		if lang != lastLang {
+			lastLang = lang
+			copyURL.SetTitle(tr(lang, "tray.copy_url"))
+			openDash.SetTitle(tr(lang, "tray.dashboard"))
+			quit.SetTitle(tr(lang, "tray.quit"))
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), trayPollInterval)
+		text, connected := t.label(ctx)
+		cancel()
+		if text != last {
+			last = text
+			state.SetTitle(text)
+			systray.SetTooltip("Arkitekt Sidecar: " + text)
+			if connected {
+				systray.SetIcon(trayIcon(trayConnected, ico))
+			} else {
+				systray.SetIcon(trayIcon(trayWaiting, ico))
+			}
+		}
+		t.mu.Lock()
+		proxyURL, dashboard, quitFn := t.proxyURL, t.dashboard, t.quit
+		t.mu.Unlock()
+		setEnabled(copyURL, proxyURL != "")
+		setEnabled(openDash, dashboard != "")
+
+		select {
+		case <-ticker.C:
+		case <-copyURL.ClickedCh:
+			if err := copyToClipboard(proxyURL); err != nil {
+				fmt.Fprintf(console, "!!! [TRAY] Copying the proxy URL failed: %v\n", err)
+			}
+		case <-openDash.ClickedCh:
+			if err := openBrowser(dashboard); err != nil {
+				fmt.Fprintf(console, "!!! [TRAY] Opening the dashboard failed: %v\n", err)
+			}
+		case <-quit.ClickedCh:
+			fmt.Fprintln(console, ">>> Quit from the tray icon")
+			if quitFn != nil {
+				quitFn()
+			}
+			systray.Quit()
+			return
+		}
+	}
+}
+
+func setEnabled(item *systray.MenuItem, enabled bool) {
+	if enabled == item.Disabled() {
+		if enabled {
+			item.Enable()
+		} else {
+			item.Disable()
+		}
+	}
+}
+
+// copyToClipboard uses the platform's clipboard tool
+func copyToClipboard(text string) error {
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "darwin":
+		cmd = exec.Command("pbcopy")
+	case "windows":
+		cmd = exec.Command("clip")
+	default:
+		if os.Getenv("WAYLAND_DISPLAY") != "" {
+			cmd = exec.Command("wl-copy")
+		} else {
+			cmd = exec.Command("xclip", "-selection", "clipboard")
+		}
+	}
+	cmd.Stdin = strings.NewReader(text)
+	return cmd.Run()
+}
+
+// openBrowser shows url in the default browser
+func openBrowser(url string) error {
+	switch runtime.GOOS {
+	case "darwin":
+		return exec.Command("open", url).Start()
+	case "windows":
+		return exec.Command("rundll32", "url.dll,FileProtocolHandler", url).Start()
+	default:
+		return exec.Command("xdg-open", url).Start()
+	}
+}
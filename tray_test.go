@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image/color"
+	"image/png"
+	"testing"
+)
+
+func TestTrayRequested(t *testing.T) {
+	tests := []struct {
+		args []string
+		env  string
+		want bool
+	}{
+		{[]string{"-authkey", "k", "-tray"}, "", true},
+		{[]string{"--tray=true"}, "", true},
+		{[]string{"-tray=false"}, "1", false},
+		{nil, "true", true},
+		{[]string{"-port", "8080"}, "", false},
+		{[]string{"exec", "-tray", "--", "python"}, "", false},
+		{[]string{"healthcheck"}, "true", false},
+		{[]string{"-hostname", "tray"}, "", false},
+	}
+	for _, tc := range tests {
+		lookup := func(name string) (string, bool) {
+			return tc.env, name == "SIDECAR_TRAY" && tc.env != ""
+		}
+		if got := trayRequested(tc.args, lookup); got != tc.want {
+			t.Errorf("trayRequested(%q, SIDECAR_TRAY=%q) = %v, want %v", tc.args, tc.env, got, tc.want)
+		}
+	}
+}
+
+func TestTrayLabel(t *testing.T) {
+	st := &StatusResponse{
+		BackendState: "Running",
+		Self:         PeerStatus{HostName: "lab-laptop"},
+		Peers:        []PeerStatus{{Online: true}, {}, {Online: true}},
+	}
+	if got := trayLabel(st, "en"); got != "Connected as lab-laptop (2 peers online)" {
+		t.Errorf("Unexpected label %q", got)
+	}
+	if got := trayLabel(st, "de"); got != "Verbunden als lab-laptop (2 Peers online)" {
+		t.Errorf("Unexpected German label %q", got)
+	}
+	st.BackendState = "NeedsLogin"
+	if got := trayLabel(st, "en"); got != "NeedsLogin" {
+		t.Errorf("Expected the backend state, got %q", got)
+	}
+
+	var state *trayState
+	state.attach("en", "", nil, nil) // nil unless -tray
+	state.setProxyURL("http://127.0.0.1:8080")
+	state = &trayState{lang: "en"}
+	if text, connected := state.label(t.Context()); text != "Starting…" || connected {
+		t.Errorf("Expected a starting node, got %q %v", text, connected)
+	}
+}
+
+func TestTrayIcon(t *testing.T) {
+	green := color.RGBA{0x2e, 0x9d, 0x5b, 0xff}
+	img, err := png.Decode(bytes.NewReader(trayIcon(green, false)))
+	if err != nil {
+		t.Fatalf("Expected a PNG: %v", err)
+	}
+	if r, g, b, _ := img.At(16, 16).RGBA(); r>>8 != 0x2e || g>>8 != 0x9d || b>>8 != 0x5b {
+		t.Errorf("Expected a green center, got %v", img.At(16, 16))
+	}
+	if _, _, _, a := img.At(0, 0).RGBA(); a != 0 {
+		t.Errorf("Expected transparent corners, got %v", img.At(0, 0))
+	}
+
+	ico := trayIcon(green, true)
+	var header struct {
+		Reserved, Type, Count uint16
+		Width, Height         uint8
+		_                     [2]uint8
+		Planes, Bits          uint16
+		Size, Offset          uint32
+	}
+	if err := binary.Read(bytes.NewReader(ico), binary.LittleEndian, &header); err != nil {
+		t.Fatal(err)
+	}
+	if header.Type != 1 || header.Count != 1 || header.Width != 32 || int(header.Offset+header.Size) != len(ico) {
+		t.Errorf("Unexpected ICO header %+v for %d bytes", header, len(ico))
+	}
+	if _, err := png.Decode(bytes.NewReader(ico[header.Offset:])); err != nil {
+		t.Errorf("Expected the ICO to carry the PNG: %v", err)
+	}
+}
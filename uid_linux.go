@@ -0,0 +1,123 @@
+//go:build linux
+
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// clientUID returns the UID owning the other end of a local connection.
+// Unix sockets report it through SO_PEERCRED; for TCP the client's socket
+// is looked up in /proc/net/tcp{,6} by both ends of the connection.
+func clientUID(conn net.Conn) (int, error) {
+	conn = unwrapConn(conn)
+	if uc, ok := conn.(*net.UnixConn); ok {
+		raw, err := uc.SyscallConn()
+		if err != nil {
+			return unknownUID, err
+		}
+		var cred *unix.Ucred
+		var credErr error
+		if err := raw.Control(func(fd uintptr) {
+			cred, credErr = unix.GetsockoptUcred(int(fd), unix.SOL_SOCKET, unix.SO_PEERCRED)
+		}); err != nil {
+			return unknownUID, err
+		}
+		if credErr != nil {
+			return unknownUID, fmt.Errorf("SO_PEERCRED: %w", credErr)
+		}
+		return int(cred.Uid), nil
+	}
+
+	client, err := netip.ParseAddrPort(conn.RemoteAddr().String())
+	if err != nil {
+		return unknownUID, err
+	}
+	server, err := netip.ParseAddrPort(conn.LocalAddr().String())
+	if err != nil {
+		return unknownUID, err
+	}
+	for _, path := range []string{"/proc/net/tcp", "/proc/net/tcp6"} {
+		f, err := os.Open(path)
+		if err != nil {
+			continue
+		}
+		uid, found := procNetUID(f, client, server)
+		f.Close()
+		if found {
+			return uid, nil
+		}
+	}
+	return unknownUID, fmt.Errorf("no socket bound to %s in /proc/net", client)
+}
+
+// procNetUID finds the established socket from local to remote in a
+// /proc/net/tcp table and returns its owner. Matching only the local end
+// could pick a socket of another user that used the same port before and
+// lingers in TIME_WAIT, or one connected elsewhere.
+func procNetUID(r io.Reader, local, remote netip.AddrPort) (int, bool) {
+	local = netip.AddrPortFrom(local.Addr().Unmap(), local.Port())
+	remote = netip.AddrPortFrom(remote.Addr().Unmap(), remote.Port())
+	sc := bufio.NewScanner(r)
+	sc.Scan() // header
+	for sc.Scan() {
+		// sl local_address rem_address st tx_queue:rx_queue tr:tm->when retrnsmt uid ...
+		fields := strings.Fields(sc.Text())
+		if len(fields) < 8 {
+			continue
+		}
+		if fields[3] != tcpEstablished {
+			continue
+		}
+		addr, ok := parseProcAddr(fields[1])
+		if !ok || addr != local {
+			continue
+		}
+		if addr, ok = parseProcAddr(fields[2]); !ok || addr != remote {
+			continue
+		}
+		uid, err := strconv.Atoi(fields[7])
+		if err != nil {
+			return unknownUID, false
+		}
+		return uid, true
+	}
+	return unknownUID, false
+}
+
+// tcpEstablished is TCP_ESTABLISHED in the st column of /proc/net/tcp
+const tcpEstablished = "01"
+
+// parseProcAddr decodes "0100007F:1F90", an address printed as 32-bit words
+// in host byte order followed by the port
+func parseProcAddr(s string) (netip.AddrPort, bool) {
+	hexAddr, hexPort, ok := strings.Cut(s, ":")
+	if !ok {
+		return netip.AddrPort{}, false
+	}
+	raw, err := hex.DecodeString(hexAddr)
+	if err != nil || (len(raw) != 4 && len(raw) != 16) {
+		return netip.AddrPort{}, false
+	}
+	port, err := strconv.ParseUint(hexPort, 16, 16)
+	if err != nil {
+		return netip.AddrPort{}, false
+	}
+	b := make([]byte, len(raw))
+	for i := 0; i < len(raw); i += 4 {
+		binary.NativeEndian.PutUint32(b[i:], binary.BigEndian.Uint32(raw[i:]))
+	}
+	addr, _ := netip.AddrFromSlice(b)
+	return netip.AddrPortFrom(addr.Unmap(), uint16(port)), true
+}
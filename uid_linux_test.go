@@ -0,0 +1,35 @@
+package main
+
+import (
+	"net/netip"
+	"strings"
+	"testing"
+)
+
+func TestProcNetUID(t *testing.T) {
+	// 127.0.0.1:40000 connected to 127.0.0.1:8080, in little-endian words
+	table := `  sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode
+   0: 0100007F:9C40 0100007F:1F90 06 00000000:00000000 03:00001770 00000000     0        0 0 3 0000000000000000
+   1: 0100007F:9C40 0100007F:2382 01 00000000:00000000 00:00000000 00000000  1002        0 41 1 0000000000000000
+   2: 0100007F:9C40 0100007F:1F90 01 00000000:00000000 00:00000000 00000000  1001        0 42 1 0000000000000000
+   3: 0100007F:1F90 00000000:0000 0A 00000000:00000000 00:00000000 00000000  1000        0 40 1 0000000000000000
+`
+	client := netip.MustParseAddrPort("127.0.0.1:40000")
+	for _, tc := range []struct {
+		name          string
+		local, remote netip.AddrPort
+		wantUID       int
+		wantFound     bool
+	}{
+		{"established past TIME_WAIT", client, netip.MustParseAddrPort("127.0.0.1:8080"), 1001, true},
+		{"mapped addresses", netip.MustParseAddrPort("[::ffff:127.0.0.1]:40000"), netip.MustParseAddrPort("[::ffff:127.0.0.1]:8080"), 1001, true},
+		{"same port to another server", client, netip.MustParseAddrPort("127.0.0.1:9090"), 1002, true},
+		{"no such connection", client, netip.MustParseAddrPort("127.0.0.1:9191"), unknownUID, false},
+		{"listener only", netip.MustParseAddrPort("127.0.0.1:8080"), netip.MustParseAddrPort("0.0.0.0:0"), unknownUID, false},
+	} {
+		uid, found := procNetUID(strings.NewReader(table), tc.local, tc.remote)
+		if uid != tc.wantUID || found != tc.wantFound {
+			t.Errorf("%s: got uid %d found %v, want %d %v", tc.name, uid, found, tc.wantUID, tc.wantFound)
+		}
+	}
+}
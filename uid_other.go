@@ -0,0 +1,10 @@
+//go:build !linux
+
+package main
+
+import "net"
+
+// clientUID is not available on this platform.
+func clientUID(conn net.Conn) (int, error) {
+	return unknownUID, errUIDUnsupported
+}
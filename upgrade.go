@@ -0,0 +1,157 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"slices"
+	"sync"
+	"time"
+)
+
+// --- ZERO-DOWNTIME UPGRADE ---
+
+// A new binary started with -upgrade asks the sidecar running on the same
+// state directory for its client listeners over a Unix socket there. The
+// old process passes them on and keeps accepting on them while the
+// connections open at the handover finish. Only then does it stop
+// accepting, give the rest a moment and exit; the new one takes the state
+// lock, brings the node up with the same state and serves on the listeners
+// it was given. Only connections arriving in that last step, while the
+// node changes hands, wait in the listen backlog.
+
+// upgradeSocketName is the handover socket in the state directory
+const upgradeSocketName = "upgrade.sock"
+
+// upgradeDrain bounds the drain when -grace-period is 0
+const upgradeDrain = 30 * time.Second
+
+// upgradeSettle is how long connections accepted during the drain get once
+// the old process stops accepting
+const upgradeSettle = 2 * time.Second
+
+// handoverSet tracks the open client listeners, which an upgrade hands to
+// the new process
+type handoverSet struct {
+	mu         sync.Mutex
+	lns        []*handoverListener
+	handedOver bool
+}
+
+var handovers = &handoverSet{}
+
+// handoverListener stops accepting once its socket is handed over, without
+// failing the server that accepts on it
+type handoverListener struct {
+	net.Listener
+	set *handoverSet
+}
+
+func (s *handoverSet) track(ln net.Listener) net.Listener {
+	l := &handoverListener{Listener: ln, set: s}
+	s.mu.Lock()
+	s.lns = append(s.lns, l)
+	s.mu.Unlock()
+	return l
+}
+
+func (l *handoverListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil && l.set.done() {
+		select {} // the new process accepts now; this one exits after draining
+	}
+	return conn, err
+}
+
+func (l *handoverListener) Close() error {
+	l.set.mu.Lock()
+	l.set.lns = slices.DeleteFunc(l.set.lns, func(o *handoverListener) bool { return o == l })
+	l.set.mu.Unlock()
+	return l.Listener.Close()
+}
+
+func (s *handoverSet) done() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.handedOver
+}
+
+// sockets returns the distinct TCP listeners to hand over. Accept loops
+// sharing a socket-activated listener count once.
+func (s *handoverSet) sockets() []*net.TCPListener {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var out []*net.TCPListener
+	for _, l := range s.lns {
+		if tl := tcpListener(l.Listener); tl != nil && !slices.Contains(out, tl) {
+			out = append(out, tl)
+		}
+	}
+	return out
+}
+
+// stop marks the listeners handed over and wakes the accept loops blocked
+// on them, which then wait for the process to exit
+func (s *handoverSet) stop() {
+	s.mu.Lock()
+	s.handedOver = true
+	s.mu.Unlock()
+	for _, tl := range s.sockets() {
+		tl.SetDeadline(time.Now())
+	}
+}
+
+// tcpListener finds the TCP listener under ln's wrappers
+func tcpListener(ln net.Listener) *net.TCPListener {
+	for {
+		switch l := ln.(type) {
+		case *net.TCPListener:
+			return l
+		case *inheritedListener:
+			ln = l.Listener
+		case *handoverListener:
+			ln = l.Listener
+		default:
+			return nil
+		}
+	}
+}
+
+// upgradeRequest is what the new process sends; the old one answers with
+// an upgradeOffer carrying the descriptors
+type upgradeRequest struct {
+	Op  string `json:"op"` // "handover"
+	PID int    `json:"pid"`
+}
+
+type upgradeOffer struct {
+	Addrs []string `json:"addrs"` // in the order of the descriptors
+	Error string   `json:"error,omitempty"`
+}
+
+// drainForUpgrade lets the connections open at the handover finish, for up
+// to grace or upgradeDrain if that is 0, while still accepting new ones.
+// It then stops accepting and shuts down, which lets the new process take
+// the state.
+func drainForUpgrade(grace time.Duration, node io.Closer) {
+	if grace <= 0 {
+		grace = upgradeDrain
+	}
+	handedOver := time.Now()
+	openBefore := func() int { return connections.countStartedBefore(handedOver) }
+	if open := openBefore(); open > 0 {
+		fmt.Fprintf(console, ">>> Waiting up to %v for %d open connections\n", grace, open)
+	}
+	if left := drain(openBefore, grace, 100*time.Millisecond); left > 0 {
+		fmt.Fprintf(console, "!!! Closing %d connections still open after %v\n", left, grace)
+	}
+	handovers.stop()
+	drain(connections.count, upgradeSettle, 100*time.Millisecond)
+	shutdown("upgrade", node)
+}
+
+var (
+	errNoUpgradeSource    = errors.New("no running sidecar on this state directory")
+	errUpgradeUnsupported = errors.New("-upgrade passes sockets over a Unix socket, which Windows can't")
+)
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"io"
+	"net"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestUpgradeHandover(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("no Unix socket handover on Windows")
+	}
+	oldHandovers, oldInherited := handovers, inherited
+	handovers, inherited = &handoverSet{}, &inheritedSet{}
+	t.Cleanup(func() { handovers, inherited = oldHandovers, oldInherited })
+
+	dir := t.TempDir()
+	if _, err := takeOver(dir, time.Second); err != errNoUpgradeSource {
+		t.Fatalf("Expected errNoUpgradeSource without a running sidecar, got %v", err)
+	}
+
+	old, err := listenClients("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listenClients failed: %v", err)
+	}
+	defer old.Close()
+	addr := old.Addr().String()
+	go func() {
+		for {
+			conn, err := old.Accept()
+			if err != nil {
+				return
+			}
+			conn.Write([]byte("old"))
+			conn.Close()
+		}
+	}()
+
+	handedOver, release := make(chan struct{}), make(chan struct{})
+	srv, err := serveUpgrades(dir, func() {
+		close(handedOver)
+		<-release
+		handovers.stop()
+	})
+	if err != nil {
+		t.Fatalf("serveUpgrades failed: %v", err)
+	}
+	defer srv.Close()
+
+	type result struct {
+		addrs []string
+		err   error
+	}
+	took := make(chan result, 1)
+	go func() {
+		addrs, err := takeOver(dir, 5*time.Second)
+		took <- result{addrs, err}
+	}()
+
+	// Clients dialing during the drain are still served by the old process
+	select {
+	case <-handedOver:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the listeners to be handed over")
+	}
+	if got := dialRead(t, addr); got != "old" {
+		t.Errorf("Expected the old process to serve during the drain, got %q", got)
+	}
+	select {
+	case r := <-took:
+		t.Fatalf("Expected takeOver to wait for the old process, got %v %v", r.addrs, r.err)
+	default:
+	}
+
+	close(release)
+	r := <-took
+	if r.err != nil {
+		t.Fatalf("takeOver failed: %v", r.err)
+	}
+	if len(r.addrs) != 1 || r.addrs[0] != addr {
+		t.Fatalf("Expected [%s], got %v", addr, r.addrs)
+	}
+
+	// Once the old process stopped, clients wait in the backlog for the new one
+	got := make(chan string, 1)
+	go func() { got <- dialRead(t, addr) }()
+	time.Sleep(50 * time.Millisecond)
+	ln, err := listenClients(addr)
+	if err != nil {
+		t.Fatalf("listenClients on the handed over address failed: %v", err)
+	}
+	defer ln.Close()
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatalf("Accept on the new listener failed: %v", err)
+	}
+	conn.Write([]byte("new"))
+	conn.Close()
+	if s := <-got; s != "new" {
+		t.Errorf("Expected the new process to serve the waiting client, got %q", s)
+	}
+}
+
+// dialRead connects to addr and returns everything the server sends
+func dialRead(t *testing.T, addr string) string {
+	conn, err := net.DialTimeout("tcp", addr, 2*time.Second)
+	if err != nil {
+		t.Errorf("Dial failed: %v", err)
+		return ""
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	data, _ := io.ReadAll(conn)
+	return string(data)
+}
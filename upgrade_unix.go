@@ -0,0 +1,177 @@
+//go:build !windows
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// maxHandoverFDs bounds the descriptors one handover carries
+const maxHandoverFDs = 256
+
+// serveUpgrades listens for a new process on the handover socket. Once it
+// has the listeners, after runs: the drain and shutdown, in main. The
+// socket is closed when after returns, which the new process waits for.
+func serveUpgrades(stateDir string, after func()) (io.Closer, error) {
+	path := filepath.Join(stateDir, upgradeSocketName)
+	os.Remove(path) // left over from a crash; the state lock is ours
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			if handOver(conn.(*net.UnixConn)) {
+				ln.Close()
+				after()
+				conn.Close()
+				return
+			}
+			conn.Close()
+		}
+	}()
+	return ln, nil
+}
+
+// handOver answers one request with the client listeners, which this
+// process keeps accepting on until it has drained. It reports whether the
+// new process has them.
+func handOver(conn *net.UnixConn) bool {
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	defer conn.SetDeadline(time.Time{})
+	var req upgradeRequest
+	if err := json.NewDecoder(conn).Decode(&req); err != nil || req.Op != "handover" {
+		return false
+	}
+
+	var offer upgradeOffer
+	var fds []int
+	for _, tl := range handovers.sockets() {
+		f, err := tl.File()
+		if err != nil {
+			offer.Error = fmt.Sprintf("%s: %v", tl.Addr(), err)
+			break
+		}
+		defer f.Close()
+		// Not f.Fd(): that makes the shared socket blocking, and this
+		// process keeps accepting on it
+		if err := rawFD(f, &fds); err != nil {
+			offer.Error = fmt.Sprintf("%s: %v", tl.Addr(), err)
+			break
+		}
+		offer.Addrs = append(offer.Addrs, tl.Addr().String())
+	}
+	if len(fds) > maxHandoverFDs {
+		offer.Error = fmt.Sprintf("%d listeners, at most %d can be handed over", len(fds), maxHandoverFDs)
+	}
+	if offer.Error != "" {
+		fds = nil
+	}
+	msg, _ := json.Marshal(offer)
+	var oob []byte
+	if len(fds) > 0 {
+		oob = unix.UnixRights(fds...)
+	}
+	if _, _, err := conn.WriteMsgUnix(msg, oob, nil); err != nil {
+		fmt.Fprintf(console, "!!! Upgrade by process %d failed: %v\n", req.PID, err)
+		return false
+	}
+	if offer.Error != "" {
+		fmt.Fprintf(console, "!!! Upgrade by process %d refused: %s\n", req.PID, offer.Error)
+		return false
+	}
+	fmt.Fprintf(console, ">>> Handed %d listeners to process %d, draining\n", len(fds), req.PID)
+	audit.record("upgrade", "pid", strconv.Itoa(req.PID), "listeners", strconv.Itoa(len(fds)))
+	return true
+}
+
+// rawFD appends f's descriptor to fds without changing its mode
+func rawFD(f *os.File, fds *[]int) error {
+	rc, err := f.SyscallConn()
+	if err != nil {
+		return err
+	}
+	return rc.Control(func(fd uintptr) { *fds = append(*fds, int(fd)) })
+}
+
+// takeOver asks the sidecar running on stateDir for its listeners, adds
+// them to the inherited set and waits up to wait for it to exit. It returns
+// the listeners' addresses, or errNoUpgradeSource if nothing runs there.
+func takeOver(stateDir string, wait time.Duration) ([]string, error) {
+	conn, err := net.DialTimeout("unix", filepath.Join(stateDir, upgradeSocketName), 5*time.Second)
+	if errors.Is(err, fs.ErrNotExist) || errors.Is(err, syscall.ECONNREFUSED) {
+		return nil, errNoUpgradeSource
+	}
+	if err != nil {
+		return nil, err
+	}
+	uc := conn.(*net.UnixConn)
+	defer uc.Close()
+	if err := json.NewEncoder(uc).Encode(upgradeRequest{Op: "handover", PID: os.Getpid()}); err != nil {
+		return nil, err
+	}
+
+	uc.SetReadDeadline(time.Now().Add(10 * time.Second))
+	buf := make([]byte, 64<<10)
+	oob := make([]byte, unix.CmsgSpace(4*maxHandoverFDs))
+	n, oobn, _, _, err := uc.ReadMsgUnix(buf, oob)
+	if err != nil {
+		return nil, fmt.Errorf("no answer from the running sidecar: %w", err)
+	}
+	var fds []int
+	msgs, err := unix.ParseSocketControlMessage(oob[:oobn])
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range msgs {
+		rights, err := unix.ParseUnixRights(&m)
+		if err != nil {
+			return nil, err
+		}
+		fds = append(fds, rights...)
+	}
+	var offer upgradeOffer
+	if err := json.Unmarshal(buf[:n], &offer); err != nil || offer.Error != "" || len(fds) != len(offer.Addrs) {
+		for _, fd := range fds {
+			unix.Close(fd)
+		}
+		if offer.Error != "" {
+			return nil, fmt.Errorf("the running sidecar can't hand over: %s", offer.Error)
+		}
+		return nil, fmt.Errorf("malformed handover (%d descriptors for %d addresses): %v", len(fds), len(offer.Addrs), err)
+	}
+	for i, fd := range fds {
+		ln, err := fileListener(uintptr(fd))
+		if err != nil {
+			return nil, fmt.Errorf("listener %s: %w", offer.Addrs[i], err)
+		}
+		inherited.add(ln)
+	}
+
+	// The old process closes the socket when it exits, releasing the state
+	uc.SetReadDeadline(time.Now().Add(wait))
+	if _, err := uc.Read(buf); !errors.Is(err, io.EOF) && !errors.Is(err, syscall.ECONNRESET) {
+		return offer.Addrs, fmt.Errorf("the running sidecar did not exit within %v: %v", wait, err)
+	}
+	return offer.Addrs, nil
+}
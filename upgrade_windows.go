@@ -0,0 +1,18 @@
+//go:build windows
+
+package main
+
+import (
+	"io"
+	"time"
+)
+
+// serveUpgrades is a no-op: Windows can't pass sockets to another process
+// this way
+func serveUpgrades(stateDir string, after func()) (io.Closer, error) {
+	return nil, nil
+}
+
+func takeOver(stateDir string, wait time.Duration) ([]string, error) {
+	return nil, errUpgradeUnsupported
+}
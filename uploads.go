@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// --- UPLOAD LIMITS ---
+
+// UploadLimits keep accidental bulk uploads off metered links. They apply
+// to plain HTTP requests on a route; tunnels are opaque.
+type UploadLimits struct {
+	MaxBodyBytes      int64    `json:"max_body_bytes,omitempty"`      // 0 = unlimited
+	BlockContentTypes []string `json:"block_content_types,omitempty"` // media types, "video/*" for a whole family
+}
+
+func (l UploadLimits) validate() error {
+	if l.MaxBodyBytes < 0 {
+		return fmt.Errorf("max_body_bytes must not be negative, got %d", l.MaxBodyBytes)
+	}
+	for _, ct := range l.BlockContentTypes {
+		major, minor, ok := strings.Cut(ct, "/")
+		if !ok || major == "" || minor == "" || major == "*" {
+			return fmt.Errorf("invalid content type %q in block_content_types (use type/subtype or type/*)", ct)
+		}
+	}
+	return nil
+}
+
+// blocked reports whether contentType (a Content-Type header) is blocked
+func (l UploadLimits) blocked(contentType string) bool {
+	if contentType == "" {
+		return false
+	}
+	mt, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		mt = strings.ToLower(strings.TrimSpace(contentType))
+	}
+	for _, ct := range l.BlockContentTypes {
+		ct = strings.ToLower(ct)
+		if family, ok := strings.CutSuffix(ct, "/*"); ok {
+			if strings.HasPrefix(mt, family+"/") {
+				return true
+			}
+		} else if mt == ct {
+			return true
+		}
+	}
+	return false
+}
+
+// UploadRefusal is the JSON body of 413 and 415 answers to uploads a route
+// doesn't allow
+type UploadRefusal struct {
+	Error       string `json:"error"`   // body_too_large or content_type_blocked
+	Message     string `json:"message"` // in the client's language
+	Route       string `json:"route"`
+	LimitBytes  int64  `json:"limit_bytes,omitempty"`
+	ContentType string `json:"content_type,omitempty"`
+}
+
+// errBodyTooLarge is returned by a cappedBody past its limit
+var errBodyTooLarge = errors.New("request body exceeds max_body_bytes")
+
+// cappedBody fails reads once more than limit bytes were read, for bodies
+// whose length isn't announced
+type cappedBody struct {
+	io.ReadCloser
+	limit    int64
+	read     int64
+	exceeded bool
+}
+
+func (b *cappedBody) Read(p []byte) (int, error) {
+	if b.exceeded {
+		return 0, errBodyTooLarge
+	}
+	n, err := b.ReadCloser.Read(p)
+	b.read += int64(n)
+	if b.read > b.limit {
+		b.exceeded = true
+		return 0, errBodyTooLarge
+	}
+	return n, err
+}
+
+// limitUpload checks r against rule's upload limits. A request that may not
+// be sent is answered right away and limitUpload returns false. A body of
+// unknown length is capped instead; the returned cappedBody tells whether
+// sending it failed because of the cap.
+func limitUpload(w http.ResponseWriter, r *http.Request, rule RouteRule) (*cappedBody, bool) {
+	l := rule.UploadLimits
+	if ct := r.Header.Get("Content-Type"); l.blocked(ct) && r.Body != nil && r.Body != http.NoBody {
+		refuseUpload(w, r, rule, http.StatusUnsupportedMediaType)
+		return nil, false
+	}
+	if l.MaxBodyBytes == 0 || r.Body == nil || r.Body == http.NoBody {
+		return nil, true
+	}
+	if r.ContentLength > l.MaxBodyBytes {
+		refuseUpload(w, r, rule, http.StatusRequestEntityTooLarge)
+		return nil, false
+	}
+	if r.ContentLength >= 0 {
+		return nil, true // the server stops reading at the announced length
+	}
+	capped := &cappedBody{ReadCloser: r.Body, limit: l.MaxBodyBytes}
+	r.Body = capped
+	return capped, true
+}
+
+// refuseUpload answers with status (413 or 415) and an UploadRefusal
+func refuseUpload(w http.ResponseWriter, r *http.Request, rule RouteRule, status int) {
+	lang := clientLang(r)
+	refusal := UploadRefusal{Route: rule.Host}
+	if status == http.StatusUnsupportedMediaType {
+		refusal.Error = "content_type_blocked"
+		refusal.ContentType = r.Header.Get("Content-Type")
+		refusal.Message = tr(lang, "client.type_blocked", "type", refusal.ContentType, "route", rule.Host)
+	} else {
+		refusal.Error = "body_too_large"
+		refusal.LimitBytes = rule.MaxBodyBytes
+		refusal.Message = tr(lang, "client.body_limit", "limit", fmt.Sprint(rule.MaxBodyBytes), "route", rule.Host)
+	}
+	logRedacted("[HTTP] %s refused %s %s: %s\n", requestID(r.Context()), r.Method, r.URL, refusal.Error)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(refusal)
+}
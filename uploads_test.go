@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestUploadLimitsBlocked(t *testing.T) {
+	l := UploadLimits{BlockContentTypes: []string{"video/*", "application/zip"}}
+	for ct, want := range map[string]bool{
+		"video/mp4":                       true,
+		"Video/MP4; codecs=avc1":          true,
+		"application/zip":                 true,
+		"application/json":                false,
+		"application/zip-compressed":      false,
+		"":                                false,
+		"multipart/form-data; boundary=x": false,
+	} {
+		if got := l.blocked(ct); got != want {
+			t.Errorf("blocked(%q) = %v, want %v", ct, got, want)
+		}
+	}
+	if err := (UploadLimits{BlockContentTypes: []string{"*/*"}}).validate(); err == nil {
+		t.Error("Expected */* to be refused")
+	}
+}
+
+func TestRouteUploadLimits(t *testing.T) {
+	sent := 0
+	mockRT := &MockRoundTripper{
+		RoundTripFunc: func(req *http.Request) (*http.Response, error) {
+			if req.Body != nil {
+				if _, err := io.ReadAll(req.Body); err != nil {
+					return nil, err
+				}
+			}
+			sent++
+			return &http.Response{StatusCode: 200, Body: io.NopCloser(strings.NewReader("OK")), Header: make(http.Header)}, nil
+		},
+	}
+	router := newRouter(&recordingDialer{}, []RouteRule{{
+		Host:         "minio",
+		UploadLimits: UploadLimits{MaxBodyBytes: 10, BlockContentTypes: []string{"video/*"}},
+		PoolConfig:   PoolConfig{Targets: []string{"minio"}},
+	}}, nil)
+	proxy := &TailscaleProxy{Transport: mockRT, Router: router}
+
+	send := func(ct string, body io.Reader, length int64) (*httptest.ResponseRecorder, UploadRefusal) {
+		req := httptest.NewRequest("PUT", "http://minio:9000/bucket/key", body)
+		req.ContentLength = length
+		if ct != "" {
+			req.Header.Set("Content-Type", ct)
+		}
+		w := httptest.NewRecorder()
+		proxy.handleHTTP(w, req)
+		var refusal UploadRefusal
+		json.Unmarshal(w.Body.Bytes(), &refusal)
+		return w, refusal
+	}
+
+	if w, _ := send("text/csv", strings.NewReader("a,b\n"), 4); w.Code != 200 {
+		t.Errorf("Expected a small upload to pass, got %d", w.Code)
+	}
+	w, refusal := send("text/csv", strings.NewReader(strings.Repeat("x", 11)), 11)
+	if w.Code != http.StatusRequestEntityTooLarge || refusal.Error != "body_too_large" || refusal.LimitBytes != 10 || refusal.Route != "minio" {
+		t.Errorf("Expected 413 body_too_large, got %d %+v", w.Code, refusal)
+	}
+	w, refusal = send("video/mp4", strings.NewReader("x"), 1)
+	if w.Code != http.StatusUnsupportedMediaType || refusal.Error != "content_type_blocked" || refusal.ContentType != "video/mp4" {
+		t.Errorf("Expected 415 content_type_blocked, got %d %+v", w.Code, refusal)
+	}
+	// A body of unknown length is cut off while it is sent
+	w, refusal = send("", io.MultiReader(strings.NewReader(strings.Repeat("x", 8)), strings.NewReader(strings.Repeat("x", 8))), -1)
+	if w.Code != http.StatusRequestEntityTooLarge || refusal.Error != "body_too_large" {
+		t.Errorf("Expected 413 for an oversized chunked body, got %d %+v", w.Code, refusal)
+	}
+	if sent != 1 {
+		t.Errorf("Expected only the small upload to reach the service, got %d", sent)
+	}
+
+	// Other hosts aren't limited
+	req := httptest.NewRequest("PUT", "http://other:9000/", strings.NewReader(strings.Repeat("x", 100)))
+	w = httptest.NewRecorder()
+	proxy.handleHTTP(w, req)
+	if w.Code != 200 {
+		t.Errorf("Expected uploads to other hosts to pass, got %d", w.Code)
+	}
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os/user"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// --- LOCAL USERS ---
+
+// errUIDUnsupported is returned by clientUID on platforms where the owner
+// of a local connection can't be looked up
+var errUIDUnsupported = errors.New("identifying local users is only supported on Linux")
+
+// unknownUID stands for a client whose owner couldn't be determined
+const unknownUID = -1
+
+// UsersConfig is the users section of the config file. On a shared
+// workstation it restricts which local accounts may use the proxies.
+type UsersConfig struct {
+	Allow []string `json:"allow,omitempty"` // user names or numeric UIDs; empty allows everyone not denied
+	Deny  []string `json:"deny,omitempty"`
+}
+
+func (c *UsersConfig) validate() error {
+	for _, name := range append(slices.Clone(c.Allow), c.Deny...) {
+		if name == "" {
+			return fmt.Errorf("users: empty user name")
+		}
+	}
+	return nil
+}
+
+// UserStats is one local user's row in /stats/users
+type UserStats struct {
+	UID             int    `json:"uid"` // -1 if the owner couldn't be determined
+	User            string `json:"user,omitempty"`
+	Connections     int64  `json:"connections"`
+	OpenConnections int64  `json:"open_connections"`
+	Denied          int64  `json:"denied"`
+	RxBytes         int64  `json:"rx_bytes"` // from the tailnet to the user
+	TxBytes         int64  `json:"tx_bytes"`
+}
+
+type userCounters struct {
+	total, open, denied, rx, tx atomic.Int64
+}
+
+// userPolicy identifies the local user behind every client connection,
+// applies the allow and deny lists and accounts traffic per UID.
+type userPolicy struct {
+	allow, deny map[int]bool
+	lookup      func(net.Conn) (int, error) // clientUID outside of tests
+
+	mu    sync.Mutex
+	users map[int]*userCounters
+}
+
+// users is nil unless the config has a users section
+var users *userPolicy
+
+// newUserPolicy resolves the names in cfg to UIDs
+func newUserPolicy(cfg *UsersConfig) (*userPolicy, error) {
+	p := &userPolicy{allow: map[int]bool{}, deny: map[int]bool{}, lookup: clientUID, users: map[int]*userCounters{}}
+	for _, list := range []struct {
+		names []string
+		uids  map[int]bool
+	}{{cfg.Allow, p.allow}, {cfg.Deny, p.deny}} {
+		for _, name := range list.names {
+			uid, err := resolveUID(name)
+			if err != nil {
+				return nil, err
+			}
+			list.uids[uid] = true
+		}
+	}
+	return p, nil
+}
+
+// resolveUID accepts a user name or a numeric UID
+func resolveUID(name string) (int, error) {
+	if uid, err := strconv.Atoi(name); err == nil {
+		return uid, nil
+	}
+	u, err := user.Lookup(name)
+	if err != nil {
+		return 0, fmt.Errorf("users: %w", err)
+	}
+	return strconv.Atoi(u.Uid)
+}
+
+// userName returns the account name of uid, or "" if it has none
+func userName(uid int) string {
+	if uid == unknownUID {
+		return ""
+	}
+	u, err := user.LookupId(strconv.Itoa(uid))
+	if err != nil {
+		return ""
+	}
+	return u.Username
+}
+
+// permits reports whether uid may use the proxies. Deny wins over allow,
+// and a client of unknown owner only passes when there is no allow list.
+func (p *userPolicy) permits(uid int) bool {
+	if p.deny[uid] {
+		return false
+	}
+	return len(p.allow) == 0 || p.allow[uid]
+}
+
+func (p *userPolicy) counters(uid int) *userCounters {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	c, ok := p.users[uid]
+	if !ok {
+		c = &userCounters{}
+		p.users[uid] = c
+	}
+	return c
+}
+
+// admit identifies the owner of conn and returns it wrapped for
+// accounting, or false if that user may not connect
+func (p *userPolicy) admit(conn net.Conn) (net.Conn, bool) {
+	uid, err := p.lookup(conn)
+	if err != nil {
+		fmt.Fprintf(console, "[USERS] %s: owner unknown: %v\n", conn.RemoteAddr(), err)
+		uid = unknownUID
+	}
+	c := p.counters(uid)
+	if !p.permits(uid) {
+		c.denied.Add(1)
+		fmt.Fprintf(console, "[USERS] Refusing %s from uid %d (%s)\n", conn.RemoteAddr(), uid, userName(uid))
+		audit.record("denied", "by", "users", "source", conn.RemoteAddr().String(), "uid", strconv.Itoa(uid))
+		return nil, false
+	}
+	c.total.Add(1)
+	c.open.Add(1)
+	return &userConn{Conn: conn, counters: c}, true
+}
+
+// stats returns the per-UID counters, ordered by UID
+func (p *userPolicy) stats() []UserStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	list := make([]UserStats, 0, len(p.users))
+	for uid, c := range p.users {
+		list = append(list, UserStats{
+			UID:             uid,
+			User:            userName(uid),
+			Connections:     c.total.Load(),
+			OpenConnections: c.open.Load(),
+			Denied:          c.denied.Load(),
+			RxBytes:         c.rx.Load(),
+			TxBytes:         c.tx.Load(),
+		})
+	}
+	slices.SortFunc(list, func(a, b UserStats) int { return a.UID - b.UID })
+	return list
+}
+
+// userConn counts a client connection's traffic for its owner
+type userConn struct {
+	net.Conn
+	counters *userCounters
+	once     sync.Once
+}
+
+func (c *userConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.counters.tx.Add(int64(n))
+	return n, err
+}
+
+func (c *userConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.counters.rx.Add(int64(n))
+	return n, err
+}
+
+func (c *userConn) Close() error {
+	c.once.Do(func() { c.counters.open.Add(-1) })
+	return c.Conn.Close()
+}
+
+// NetConn returns the client's socket, like tls.Conn does
+func (c *userConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// unwrapConn returns the socket under connections that wrap one
+func unwrapConn(conn net.Conn) net.Conn {
+	for {
+		w, ok := conn.(interface{ NetConn() net.Conn })
+		if !ok {
+			return conn
+		}
+		conn = w.NetConn()
+	}
+}
+
+// userListener drops connections from users the policy refuses
+type userListener struct {
+	net.Listener
+	policy *userPolicy
+}
+
+func (l userListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		if wrapped, ok := l.policy.admit(conn); ok {
+			return wrapped, nil
+		}
+		conn.Close()
+	}
+}
+
+// handleUserStats serves the per-user counters on the status API
+func handleUserStats(w http.ResponseWriter, r *http.Request) {
+	if users == nil {
+		http.Error(w, "no users section in the config", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(users.stats())
+}
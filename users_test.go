@@ -0,0 +1,86 @@
+package main
+
+import (
+	"io"
+	"net"
+	"os"
+	"runtime"
+	"testing"
+)
+
+func TestUserPolicy(t *testing.T) {
+	policy, err := newUserPolicy(&UsersConfig{Allow: []string{"1000", "1001"}, Deny: []string{"1001"}})
+	if err != nil {
+		t.Fatalf("Failed to build policy: %v", err)
+	}
+	owners := map[string]int{}
+	policy.lookup = func(conn net.Conn) (int, error) { return owners[conn.RemoteAddr().String()], nil }
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer ln.Close()
+	uln := userListener{ln, policy}
+
+	connect := func(uid int) {
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatalf("Failed to dial: %v", err)
+		}
+		owners[conn.LocalAddr().String()] = uid
+		conn.Write([]byte("ping"))
+		conn.Close()
+	}
+
+	// uid 1001 is denied despite being allowed, 1002 isn't allowed
+	connect(1001)
+	connect(1002)
+	connect(1000)
+	conn, err := uln.Accept()
+	if err != nil {
+		t.Fatalf("Accept failed: %v", err)
+	}
+	io.ReadAll(conn)
+	conn.Close()
+
+	stats := policy.stats()
+	if len(stats) != 3 {
+		t.Fatalf("Expected stats for 3 users, got %+v", stats)
+	}
+	if s := stats[0]; s.UID != 1000 || s.Connections != 1 || s.OpenConnections != 0 || s.TxBytes != 4 {
+		t.Errorf("Unexpected stats for uid 1000: %+v", s)
+	}
+	if stats[1].Denied != 1 || stats[2].Denied != 1 {
+		t.Errorf("Expected uids 1001 and 1002 to be denied, got %+v", stats[1:])
+	}
+}
+
+func TestClientUID(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("needs /proc/net/tcp")
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer ln.Close()
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	defer client.Close()
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatalf("Accept failed: %v", err)
+	}
+	defer conn.Close()
+
+	uid, err := clientUID(&userConn{Conn: conn, counters: &userCounters{}})
+	if err != nil {
+		t.Fatalf("clientUID failed: %v", err)
+	}
+	if uid != os.Getuid() {
+		t.Errorf("Expected uid %d, got %d", os.Getuid(), uid)
+	}
+}